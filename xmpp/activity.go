@@ -0,0 +1,51 @@
+package xmpp
+
+// This file contains support for user activity, XEP-0108.
+
+import (
+	"encoding/xml"
+)
+
+const NsActivity = "http://jabber.org/protocol/activity"
+
+// What a user is doing: a general activity, such as "relaxing", and
+// optionally a specific one within it, such as "reading", with
+// optional text. An Activity with no Value clears a previously
+// published activity.
+type Activity struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/activity activity"`
+	Value   *Generic `xml:",any"`
+	Text    string   `xml:"text,omitempty"`
+}
+
+// Creates an Activity, whose general and specific values are among
+// those listed in XEP-0108. The specific value may be empty.
+func NewActivity(general, specific, text string) *Activity {
+	a := &Activity{Text: text}
+	if general == "" {
+		return a
+	}
+	a.Value = &Generic{XMLName: xml.Name{Space: NsActivity,
+		Local: general}}
+	if specific != "" {
+		a.Value.Any = &Generic{XMLName: xml.Name{Space: NsActivity,
+			Local: specific}}
+	}
+	return a
+}
+
+// Returns the general activity, or the empty string.
+func (a *Activity) General() string {
+	if a.Value == nil {
+		return ""
+	}
+	return a.Value.XMLName.Local
+}
+
+// Returns the specific activity, or the empty string.
+func (a *Activity) Specific() string {
+	if a.Value == nil || a.Value.Any == nil {
+		return ""
+	}
+	return a.Value.Any.XMLName.Local
+}
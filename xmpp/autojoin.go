@@ -0,0 +1,153 @@
+package xmpp
+
+// This file contains a manager which joins the multi-user chat rooms
+// the user has bookmarked.
+
+import (
+	"context"
+	"sync"
+)
+
+// AutoJoiner is an extension which, once the session is running,
+// joins every bookmarked room whose autojoin flag is set, using the
+// bookmark's nick and password. It follows changes to the bookmarks
+// as they're pushed by the server, joining newly added rooms and
+// leaving rooms whose bookmarks are removed or no longer autojoin.
+//
+// The server only pushes bookmark changes to clients which express
+// interest in urn:xmpp:bookmarks:1+notify through entity
+// capabilities, so the AutoJoiner adds that to the client's
+// features. Bookmarks in private storage are joined when the session
+// starts, but changes to them aren't followed. Changes are only
+// accepted from the user's own account.
+type AutoJoiner struct {
+	Extension
+	// The nick to use for bookmarks which don't specify one.
+	DefaultNick string
+	lock        sync.Mutex
+	cl          *Client
+	// Rooms we've joined, and the nick used to join each.
+	joined map[JID]string
+	// Changes which arrived before the initial fetch completed.
+	pending []*PubsubItems
+	started bool
+}
+
+// Creates an AutoJoiner, to be passed to NewClient among the
+// extensions.
+func NewAutoJoiner(defaultNick string) *AutoJoiner {
+	aj := &AutoJoiner{DefaultNick: defaultNick}
+	aj.joined = make(map[JID]string)
+	aj.StanzaTypes = BookmarksExt.StanzaTypes
+	aj.Features = []string{NsBookmarks + "+notify"}
+	aj.RecvFilter = aj.recvFilter
+	aj.BeforePresence = aj.attach
+	aj.Start = aj.start
+	return aj
+}
+
+// Learns the client, so that changes from others can be told apart
+// before the session starts.
+func (aj *AutoJoiner) attach(cl *Client) {
+	aj.lock.Lock()
+	defer aj.lock.Unlock()
+	aj.cl = cl
+}
+
+// Returns the rooms which have been joined automatically.
+func (aj *AutoJoiner) Joined() []JID {
+	aj.lock.Lock()
+	defer aj.lock.Unlock()
+	var rooms []JID
+	for room := range aj.joined {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+func (aj *AutoJoiner) start(cl *Client) {
+	bms, err := cl.Bookmarks(context.Background())
+	aj.lock.Lock()
+	defer aj.lock.Unlock()
+	aj.cl = cl
+	aj.started = true
+	if err == nil {
+		for _, bm := range bms {
+			aj.apply(bm)
+		}
+	}
+	for _, items := range aj.pending {
+		aj.applyItems(items)
+	}
+	aj.pending = nil
+}
+
+func (aj *AutoJoiner) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for stan := range in {
+		if m, ok := stan.(*Message); ok {
+			ev := m.PubsubEvent()
+			if ev != nil && ev.Items != nil &&
+				ev.Items.Node == NsBookmarks {
+				aj.changed(m.From, ev.Items)
+			}
+		}
+		out <- stan
+	}
+}
+
+func (aj *AutoJoiner) changed(from JID, items *PubsubItems) {
+	aj.lock.Lock()
+	defer aj.lock.Unlock()
+	if from != "" && (aj.cl == nil || from != aj.cl.Jid.Bare()) {
+		return
+	}
+	if !aj.started {
+		aj.pending = append(aj.pending, items)
+		return
+	}
+	aj.applyItems(items)
+}
+
+// Must be called with the lock held.
+func (aj *AutoJoiner) applyItems(items *PubsubItems) {
+	for _, bm := range bookmarksFromItems(items.Items) {
+		aj.apply(bm)
+	}
+	for _, r := range items.Retract {
+		aj.leave(JID(r.Id))
+	}
+}
+
+// Join or leave a room according to its bookmark. Must be called
+// with the lock held.
+func (aj *AutoJoiner) apply(bm Bookmark) {
+	room := bm.Jid.Bare()
+	if !bm.Autojoin {
+		aj.leave(room)
+		return
+	}
+	nick := bm.Nick
+	if nick == "" {
+		nick = aj.DefaultNick
+	}
+	if nick == "" {
+		nick = aj.cl.Jid.Node()
+	}
+	if old, ok := aj.joined[room]; ok && old == nick {
+		return
+	}
+	aj.joined[room] = nick
+	aj.cl.Send <- MucJoinPresence(room, nick, bm.Password, nil)
+}
+
+// Must be called with the lock held.
+func (aj *AutoJoiner) leave(room JID) {
+	room = room.Bare()
+	nick, ok := aj.joined[room]
+	if !ok {
+		return
+	}
+	delete(aj.joined, room)
+	aj.cl.Send <- MucLeavePresence(room, nick)
+}
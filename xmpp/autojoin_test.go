@@ -0,0 +1,92 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestBookmarkUnmarshal(t *testing.T) {
+	str := `<message xmlns="jabber:client"><event xmlns="` +
+		NsPubsubEvent + `"><items node="` + NsBookmarks + `">` +
+		`<item id="room@muc.example.com"><conference xmlns="` +
+		NsBookmarks + `" name="The Room" autojoin="true">` +
+		`<nick>me</nick></conference></item>` +
+		`<retract id="old@muc.example.com"/></items></event></message>`
+	msg := Message{}
+	xml.Unmarshal([]byte(str), &msg)
+	err := parseExtended(&msg.Header, PubsubExt.StanzaTypes)
+	if err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	ev := msg.PubsubEvent()
+	if ev == nil || ev.Items == nil {
+		t.Fatalf("no event: %v", msg.Nested)
+	}
+	assertEquals(t, NsBookmarks, ev.Items.Node)
+	bms := bookmarksFromItems(ev.Items.Items)
+	if len(bms) != 1 {
+		t.Fatalf("wrong # bookmarks: %v", bms)
+	}
+	assertEquals(t, "room@muc.example.com", string(bms[0].Jid))
+	assertEquals(t, "The Room", bms[0].Name)
+	assertEquals(t, "me", bms[0].Nick)
+	if !bms[0].Autojoin {
+		t.Error("not autojoin")
+	}
+	assertEquals(t, "old@muc.example.com", ev.Items.Retract[0].Id)
+}
+
+func TestAutoJoinApply(t *testing.T) {
+	send := make(chan Stanza, 10)
+	aj := NewAutoJoiner("bot")
+	aj.cl = &Client{Send: send}
+	aj.started = true
+
+	aj.apply(Bookmark{Jid: "a@muc", Autojoin: true, Password: "pw"})
+	pr := (<-send).(*Presence)
+	assertEquals(t, "a@muc/bot", string(pr.To))
+	assertEquals(t, "pw", pr.Nested[0].(*MucJoin).Password)
+
+	// No change.
+	aj.apply(Bookmark{Jid: "a@muc", Autojoin: true})
+	aj.apply(Bookmark{Jid: "b@muc"})
+	if len(send) != 0 {
+		t.Fatalf("sent %d", len(send))
+	}
+
+	aj.applyItems(&PubsubItems{Retract: []PubsubRetract{{Id: "a@muc"}}})
+	pr = (<-send).(*Presence)
+	assertEquals(t, "a@muc/bot", string(pr.To))
+	assertEquals(t, "unavailable", pr.Type)
+	if len(aj.Joined()) != 0 {
+		t.Errorf("still joined: %v", aj.Joined())
+	}
+}
+
+func TestAutoJoinForgedEvent(t *testing.T) {
+	send := make(chan Stanza, 10)
+	aj := NewAutoJoiner("bot")
+	aj.attach(&Client{Jid: "me@b.c/r", Send: send})
+	aj.started = true
+	in := make(chan Stanza)
+	out := make(chan Stanza, 1)
+	go aj.recvFilter(in, out)
+	defer close(in)
+
+	event := func(from JID) *Message {
+		return &Message{Header: Header{From: from, Nested: []interface{}{
+			&PubsubEvent{Items: &PubsubItems{Node: NsBookmarks,
+				Items: []PubsubItem{{Id: "a@muc", Payload: `<conference ` +
+					`xmlns="` + NsBookmarks + `" autojoin="true"/>`}}}}}}}
+	}
+	in <- event("mallory@evil.example")
+	<-out
+	if len(send) != 0 || len(aj.Joined()) != 0 {
+		t.Fatalf("joined %v from a forged event", aj.Joined())
+	}
+
+	in <- event("me@b.c")
+	<-out
+	pr := (<-send).(*Presence)
+	assertEquals(t, "a@muc/bot", string(pr.To))
+}
@@ -0,0 +1,303 @@
+package xmpp
+
+// This file contains support for user avatars published with PEP,
+// XEP-0084, and a cache which also understands vCard-based avatars,
+// XEP-0153.
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	NsAvatarData     = "urn:xmpp:avatar:data"
+	NsAvatarMetadata = "urn:xmpp:avatar:metadata"
+)
+
+// The image data of an avatar, published in PEP.
+type AvatarData struct {
+	XMLName xml.Name `xml:"urn:xmpp:avatar:data data"`
+	Data    string   `xml:",chardata"`
+}
+
+// Describes the avatars a user has published. No Info means the user
+// has disabled their avatar.
+type AvatarMetadata struct {
+	XMLName xml.Name     `xml:"urn:xmpp:avatar:metadata metadata"`
+	Info    []AvatarInfo `xml:"info"`
+}
+
+// Describes one version of an avatar. Id is the SHA-1 hash of the
+// image data, in hex. If Url is set, the image isn't in PEP.
+type AvatarInfo struct {
+	Id     string `xml:"id,attr"`
+	Type   string `xml:"type,attr"`
+	Bytes  int    `xml:"bytes,attr"`
+	Width  int    `xml:"width,attr,omitempty"`
+	Height int    `xml:"height,attr,omitempty"`
+	Url    string `xml:"url,attr,omitempty"`
+}
+
+// An avatar image.
+type Avatar struct {
+	// The hex SHA-1 hash of Data.
+	Hash string
+	// The MIME type, such as image/png.
+	Type string
+	Data []byte
+}
+
+// Builds an Avatar from an image.
+func NewAvatar(typ string, data []byte) *Avatar {
+	sum := sha1.Sum(data)
+	return &Avatar{Hash: hex.EncodeToString(sum[:]), Type: typ,
+		Data: data}
+}
+
+// Stores avatar images by hash. Implementations must be safe for
+// concurrent use.
+type AvatarStore interface {
+	GetAvatar(hash string) (*Avatar, bool)
+	PutAvatar(av *Avatar)
+}
+
+type memAvatarStore struct {
+	lock    sync.Mutex
+	avatars map[string]*Avatar
+}
+
+// Returns an AvatarStore which keeps images in memory.
+func NewMemAvatarStore() AvatarStore {
+	return &memAvatarStore{avatars: make(map[string]*Avatar)}
+}
+
+func (s *memAvatarStore) GetAvatar(hash string) (*Avatar, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	av, ok := s.avatars[hash]
+	return av, ok
+}
+
+func (s *memAvatarStore) PutAvatar(av *Avatar) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.avatars[av.Hash] = av
+}
+
+// Reports that a contact's avatar changed. An empty Hash means the
+// contact no longer has one.
+type AvatarChange struct {
+	Jid  JID
+	Hash string
+}
+
+// AvatarCache is an extension which keeps track of contacts'
+// avatars, whether they announce them in PEP or through vCard hashes
+// in their presence, and keeps the images in an AvatarStore. Images
+// are downloaded when they're announced, unless they're already in
+// the store.
+//
+// PEP announcements are only pushed to clients which express
+// interest in urn:xmpp:avatar:metadata+notify through entity
+// capabilities, so the cache adds that to the client's features.
+type AvatarCache struct {
+	Extension
+	// Changes to contacts' avatars are reported here, once the new
+	// image is available. If the application doesn't keep up,
+	// changes are discarded.
+	Changes <-chan AvatarChange
+	changes chan AvatarChange
+	store   AvatarStore
+	lock    sync.Mutex
+	cl      *Client
+	// The current hash for each bare JID, and where it came from.
+	hashes map[JID]avatarSource
+}
+
+type avatarSource struct {
+	hash string
+	pep  bool
+}
+
+// Creates an AvatarCache, to be passed to NewClient among the
+// extensions. If store is nil, images are kept in memory.
+func NewAvatarCache(store AvatarStore) *AvatarCache {
+	if store == nil {
+		store = NewMemAvatarStore()
+	}
+	ac := &AvatarCache{store: store}
+	ac.changes = make(chan AvatarChange, 16)
+	ac.Changes = ac.changes
+	ac.hashes = make(map[JID]avatarSource)
+	ac.StanzaTypes = mergeStanzaTypes(PubsubExt, VCardExt)
+	ac.Features = []string{NsAvatarMetadata + "+notify"}
+	ac.RecvFilter = ac.recvFilter
+	ac.Start = func(cl *Client) {
+		ac.lock.Lock()
+		ac.cl = cl
+		ac.lock.Unlock()
+	}
+	return ac
+}
+
+func (ac *AvatarCache) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for stan := range in {
+		switch st := stan.(type) {
+		case *Presence:
+			if st.Type != "" {
+				break
+			}
+			if hash, ok := st.VCardPhotoHash(); ok {
+				ac.announced(st.From.Bare(), hash, false)
+			}
+		case *Message:
+			ev := st.PubsubEvent()
+			if ev == nil || ev.Items == nil ||
+				ev.Items.Node != NsAvatarMetadata {
+				break
+			}
+			for _, item := range ev.Items.Items {
+				var md AvatarMetadata
+				if item.Decode(&md) != nil {
+					continue
+				}
+				hash := ""
+				if len(md.Info) > 0 {
+					hash = item.Id
+				}
+				ac.announced(st.From.Bare(), hash, true)
+			}
+		}
+		out <- stan
+	}
+}
+
+// A contact announced an avatar hash. PEP announcements take
+// precedence over vCard ones.
+func (ac *AvatarCache) announced(jid JID, hash string, pep bool) {
+	hash = strings.ToLower(hash)
+	ac.lock.Lock()
+	old, ok := ac.hashes[jid]
+	if (ok && old.hash == hash) || (old.pep && !pep) {
+		ac.lock.Unlock()
+		return
+	}
+	ac.hashes[jid] = avatarSource{hash: hash, pep: pep}
+	ac.lock.Unlock()
+	if hash == "" {
+		ac.changed(jid, "")
+		return
+	}
+	go func() {
+		if _, err := ac.fetch(jid, avatarSource{hash, pep}); err == nil {
+			ac.changed(jid, hash)
+		}
+	}()
+}
+
+func (ac *AvatarCache) changed(jid JID, hash string) {
+	select {
+	case ac.changes <- AvatarChange{Jid: jid, Hash: hash}:
+	default:
+	}
+}
+
+// Returns the avatar of the given JID, or nil if it doesn't have
+// one. The image is downloaded if it isn't in the store.
+func (ac *AvatarCache) GetAvatar(jid JID) (*Avatar, error) {
+	ac.lock.Lock()
+	src := ac.hashes[jid.Bare()]
+	ac.lock.Unlock()
+	if src.hash == "" {
+		return nil, nil
+	}
+	return ac.fetch(jid.Bare(), src)
+}
+
+func (ac *AvatarCache) fetch(jid JID, src avatarSource) (*Avatar, error) {
+	if av, ok := ac.store.GetAvatar(src.hash); ok {
+		return av, nil
+	}
+	ac.lock.Lock()
+	cl := ac.cl
+	ac.lock.Unlock()
+	if cl == nil {
+		return nil, fmt.Errorf("avatar cache not started")
+	}
+	ctx := context.Background()
+	var av *Avatar
+	var err error
+	if src.pep {
+		av, err = cl.fetchPepAvatar(ctx, jid, src.hash)
+	} else {
+		av, err = cl.fetchVCardAvatar(ctx, jid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if av.Hash != src.hash {
+		return nil, fmt.Errorf("avatar of %s has hash %s, not %s", jid,
+			av.Hash, src.hash)
+	}
+	ac.store.PutAvatar(av)
+	return av, nil
+}
+
+// Builds an Avatar from base64-encoded image data.
+func decodeAvatar(typ, b64 string) (*Avatar, error) {
+	// Servers and clients often wrap the base64 text.
+	b64 = strings.Join(strings.Fields(b64), "")
+	data, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, err
+	}
+	return NewAvatar(typ, data), nil
+}
+
+func (cl *Client) fetchPepAvatar(ctx context.Context, jid JID,
+	hash string) (*Avatar, error) {
+
+	mds, err := cl.PubsubItems(ctx, jid, NsAvatarMetadata, hash)
+	if err != nil {
+		return nil, err
+	}
+	typ := ""
+	for _, item := range mds {
+		var md AvatarMetadata
+		if item.Decode(&md) == nil && len(md.Info) > 0 {
+			typ = md.Info[0].Type
+		}
+	}
+	items, err := cl.PubsubItems(ctx, jid, NsAvatarData, hash)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		var data AvatarData
+		if item.Decode(&data) == nil {
+			return decodeAvatar(typ, data.Data)
+		}
+	}
+	return nil, fmt.Errorf("no avatar data for %s", hash)
+}
+
+func (cl *Client) fetchVCardAvatar(ctx context.Context, jid JID) (*Avatar,
+	error) {
+
+	vc, err := cl.VCard(ctx, jid)
+	if err != nil {
+		return nil, err
+	}
+	av, err := vc.Avatar()
+	if err == nil && av == nil {
+		err = fmt.Errorf("no photo in vCard of %s", jid)
+	}
+	return av, err
+}
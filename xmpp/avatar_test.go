@@ -0,0 +1,85 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"testing"
+)
+
+func TestDecodeAvatar(t *testing.T) {
+	b64 := base64.StdEncoding.EncodeToString([]byte("abc"))
+	av, err := decodeAvatar("image/png", b64[:2]+"\n "+b64[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, "a9993e364706816aba3e25717850c26c9cd0d89d", av.Hash)
+	assertEquals(t, "abc", string(av.Data))
+}
+
+func TestAvatarCache(t *testing.T) {
+	store := NewMemAvatarStore()
+	store.PutAvatar(&Avatar{Hash: "1234", Data: []byte("x")})
+	ac := NewAvatarCache(store)
+	in := make(chan Stanza)
+	out := make(chan Stanza)
+	go ac.RecvFilter(in, out)
+	defer close(in)
+
+	str := `<presence xmlns="jabber:client" from="a@b.c/d"><x xmlns="` +
+		NsVCardUpdate + `"><photo>1234</photo></x></presence>`
+	pr := &Presence{}
+	xml.Unmarshal([]byte(str), pr)
+	if err := parseExtended(&pr.Header, ac.StanzaTypes); err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	in <- pr
+	<-out
+	ch := <-ac.Changes
+	assertEquals(t, "a@b.c", string(ch.Jid))
+	assertEquals(t, "1234", ch.Hash)
+	av, err := ac.GetAvatar("a@b.c/e")
+	if err != nil || av == nil {
+		t.Fatalf("GetAvatar: %v, %v", av, err)
+	}
+	assertEquals(t, "x", string(av.Data))
+
+	// PEP disabling the avatar overrides the vCard.
+	md, _ := NewPubsubItem("", &AvatarMetadata{})
+	in <- &Message{Header: Header{From: "a@b.c", Nested: []interface{}{
+		&PubsubEvent{Items: &PubsubItems{Node: NsAvatarMetadata,
+			Items: []PubsubItem{md}}}}}}
+	<-out
+	ch = <-ac.Changes
+	assertEquals(t, "", ch.Hash)
+	if av, _ := ac.GetAvatar("a@b.c"); av != nil {
+		t.Errorf("still have avatar")
+	}
+}
+
+func TestPublishAvatar(t *testing.T) {
+	send := make(chan Stanza, 1)
+	cl := &Client{handlers: make(chan *callback, 1), Send: send}
+	nodes := make(chan string, 2)
+	go func() {
+		for {
+			h := <-cl.handlers
+			iq := (<-send).(*Iq)
+			ps := iq.Nested[0].(*Pubsub)
+			nodes <- ps.Publish.Node + " " + ps.Publish.Items[0].Id
+			h.f(&Iq{Header: Header{Id: iq.Id, Type: "result"}})
+		}
+	}()
+	av := NewAvatar("image/png", []byte("abc"))
+	if err := cl.PublishAvatar(context.Background(), av, 1, 1); err != nil {
+		t.Fatalf("PublishAvatar: %v", err)
+	}
+	hash := "a9993e364706816aba3e25717850c26c9cd0d89d"
+	assertEquals(t, NsAvatarData+" "+hash, <-nodes)
+	assertEquals(t, NsAvatarMetadata+" "+hash, <-nodes)
+
+	info := ownDiscoInfo([]Extension{NewAvatarCache(nil).Extension}, nil)
+	if !info.HasFeature(NsAvatarMetadata + "+notify") {
+		t.Errorf("no +notify in %v", info.Features)
+	}
+}
@@ -0,0 +1,254 @@
+package xmpp
+
+// This file contains support for the blocking command, XEP-0191.
+
+import (
+	"context"
+	"encoding/xml"
+	"reflect"
+	"sync"
+)
+
+const NsBlocking = "urn:xmpp:blocking"
+
+// Asks the server to block communication with the listed JIDs.
+type BlockReq struct {
+	XMLName xml.Name    `xml:"urn:xmpp:blocking block"`
+	Items   []BlockItem `xml:"urn:xmpp:blocking item"`
+}
+
+type BlockItem struct {
+	Jid JID `xml:"jid,attr"`
+	// An optional spam or abuse report about the JID, XEP-0377.
+	Report *SpamReport `xml:"urn:xmpp:reporting:1 report"`
+}
+
+// Asks the server to unblock the listed JIDs, or everyone if there
+// are none.
+type UnblockReq struct {
+	XMLName xml.Name    `xml:"urn:xmpp:blocking unblock"`
+	Items   []BlockItem `xml:"urn:xmpp:blocking item"`
+}
+
+// The JIDs the user has blocked.
+type BlockList struct {
+	XMLName xml.Name    `xml:"urn:xmpp:blocking blocklist"`
+	Items   []BlockItem `xml:"urn:xmpp:blocking item"`
+}
+
+// BlockingExt may be included in the extensions passed to NewClient
+// to use BlockList. A BlockingManager includes it.
+var BlockingExt Extension = Extension{}
+
+func init() {
+	BlockingExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	bName := xml.Name{Space: NsBlocking, Local: "block"}
+	BlockingExt.StanzaTypes[bName] = reflect.TypeOf(BlockReq{})
+	bName = xml.Name{Space: NsBlocking, Local: "unblock"}
+	BlockingExt.StanzaTypes[bName] = reflect.TypeOf(UnblockReq{})
+	bName = xml.Name{Space: NsBlocking, Local: "blocklist"}
+	BlockingExt.StanzaTypes[bName] = reflect.TypeOf(BlockList{})
+}
+
+func blockItems(jids []JID) []BlockItem {
+	items := make([]BlockItem, len(jids))
+	for i, jid := range jids {
+		items[i] = BlockItem{Jid: jid}
+	}
+	return items
+}
+
+func itemJids(items []BlockItem) []JID {
+	var jids []JID
+	for _, item := range items {
+		jids = append(jids, item.Jid)
+	}
+	return jids
+}
+
+// Blocks communication with the given JIDs, which may be full or
+// bare JIDs, or domains.
+func (cl *Client) Block(ctx context.Context, jids ...JID) error {
+	iq := &Iq{Header: Header{Type: "set", Nested: []interface{}{
+		&BlockReq{Items: blockItems(jids)}}}}
+	_, err := cl.SendIq(ctx, iq)
+	return err
+}
+
+// Unblocks the given JIDs, or everyone if none are given.
+func (cl *Client) Unblock(ctx context.Context, jids ...JID) error {
+	iq := &Iq{Header: Header{Type: "set", Nested: []interface{}{
+		&UnblockReq{Items: blockItems(jids)}}}}
+	_, err := cl.SendIq(ctx, iq)
+	return err
+}
+
+// Fetches the JIDs the user has blocked.
+func (cl *Client) BlockList(ctx context.Context) ([]JID, error) {
+	iq := &Iq{Header: Header{Type: "get", Nested: []interface{}{
+		&BlockList{}}}}
+	reply, err := cl.SendIq(ctx, iq)
+	if err != nil {
+		return nil, err
+	}
+	for _, ele := range reply.Nested {
+		if bl, ok := ele.(*BlockList); ok {
+			return itemJids(bl.Items), nil
+		}
+	}
+	return nil, nil
+}
+
+// A change to the block list, made by this or another of the user's
+// clients. Unblocking with no Jids unblocked everyone.
+type BlockChange struct {
+	Blocked bool
+	Jids    []JID
+}
+
+// BlockingManager is an extension which keeps a copy of the user's
+// block list. It fetches the list once the session is running, and
+// follows the changes the server pushes to all of the user's
+// clients.
+type BlockingManager struct {
+	Extension
+	// Changes to the block list are reported here. They're
+	// discarded if the channel isn't ready for them.
+	Changes  <-chan BlockChange
+	changes  chan BlockChange
+	toServer chan Stanza
+	sendDone chan bool
+	lock     sync.Mutex
+	cl       *Client
+	blocked  map[JID]bool
+}
+
+// Creates a BlockingManager, to be passed to NewClient among the
+// extensions.
+func NewBlockingManager() *BlockingManager {
+	bm := &BlockingManager{}
+	bm.changes = make(chan BlockChange, 16)
+	bm.Changes = bm.changes
+	bm.toServer = make(chan Stanza)
+	bm.sendDone = make(chan bool)
+	bm.blocked = make(map[JID]bool)
+	bm.StanzaTypes = BlockingExt.StanzaTypes
+	bm.Features = []string{NsBlocking}
+	bm.RecvFilter = bm.recvFilter
+	bm.SendFilter = bm.sendFilter
+	bm.Start = bm.start
+	return bm
+}
+
+func (bm *BlockingManager) start(cl *Client) {
+	bm.lock.Lock()
+	bm.cl = cl
+	bm.lock.Unlock()
+	jids, err := cl.BlockList(context.Background())
+	if err != nil {
+		return
+	}
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	bm.blocked = make(map[JID]bool)
+	for _, jid := range jids {
+		bm.blocked[jid] = true
+	}
+}
+
+// Returns the blocked JIDs.
+func (bm *BlockingManager) Blocked() []JID {
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	var jids []JID
+	for jid := range bm.blocked {
+		jids = append(jids, jid)
+	}
+	return jids
+}
+
+// Is communication with the given JID blocked? It is if the JID, its
+// bare JID, or its domain is on the list.
+func (bm *BlockingManager) IsBlocked(jid JID) bool {
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	return bm.blocked[jid] || bm.blocked[jid.Bare()] ||
+		bm.blocked[JID(jid.Domain())]
+}
+
+// Is the stanza a push from the user's own account?
+func (bm *BlockingManager) fromAccount(from JID) bool {
+	if from == "" {
+		return true
+	}
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	return bm.cl != nil && from == bm.cl.Jid.Bare()
+}
+
+func (bm *BlockingManager) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for stan := range in {
+		iq, ok := stan.(*Iq)
+		if !ok || iq.Type != "set" || len(iq.Nested) != 1 ||
+			!bm.fromAccount(iq.From) {
+			out <- stan
+			continue
+		}
+		var change BlockChange
+		switch req := iq.Nested[0].(type) {
+		case *BlockReq:
+			change = BlockChange{Blocked: true,
+				Jids: itemJids(req.Items)}
+		case *UnblockReq:
+			change = BlockChange{Jids: itemJids(req.Items)}
+		default:
+			out <- stan
+			continue
+		}
+		bm.apply(change)
+		reply := &Iq{Header: Header{To: iq.From, Id: iq.Id,
+			Type: "result"}}
+		select {
+		case bm.toServer <- reply:
+		case <-bm.sendDone:
+		}
+	}
+}
+
+func (bm *BlockingManager) apply(change BlockChange) {
+	bm.lock.Lock()
+	switch {
+	case change.Blocked:
+		for _, jid := range change.Jids {
+			bm.blocked[jid] = true
+		}
+	case len(change.Jids) == 0:
+		bm.blocked = make(map[JID]bool)
+	default:
+		for _, jid := range change.Jids {
+			delete(bm.blocked, jid)
+		}
+	}
+	bm.lock.Unlock()
+	select {
+	case bm.changes <- change:
+	default:
+	}
+}
+
+func (bm *BlockingManager) sendFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	defer close(bm.sendDone)
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			out <- stan
+		case stan := <-bm.toServer:
+			out <- stan
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package xmpp
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestBlockingManager(t *testing.T) {
+	send := make(chan Stanza, 1)
+	cl := &Client{Jid: "me@b.c/r", handlers: make(chan *callback, 1),
+		Send: send}
+	go func() {
+		h := <-cl.handlers
+		iq := (<-send).(*Iq)
+		if _, ok := iq.Nested[0].(*BlockList); !ok {
+			t.Errorf("asked %v", iq.Nested)
+		}
+		h.f(&Iq{Header: Header{Id: iq.Id, Type: "result",
+			Nested: []interface{}{&BlockList{Items: blockItems(
+				[]JID{"spam.example"})}}}})
+	}()
+	bm := NewBlockingManager()
+	bm.Start(cl)
+	if !bm.IsBlocked("x@spam.example/y") || bm.IsBlocked("x@b.c") {
+		t.Errorf("blocked %v", bm.Blocked())
+	}
+
+	recvIn := make(chan Stanza)
+	recvOut := make(chan Stanza, 1)
+	go bm.RecvFilter(recvIn, recvOut)
+	sendIn := make(chan Stanza)
+	sendOut := make(chan Stanza)
+	go bm.SendFilter(sendIn, sendOut)
+	defer close(sendIn)
+	defer close(recvIn)
+
+	recvIn <- &Iq{Header: Header{From: "me@b.c", Id: "p1", Type: "set",
+		Nested: []interface{}{&BlockReq{Items: blockItems(
+			[]JID{"x@b.c"})}}}}
+	reply := (<-sendOut).(*Iq)
+	assertEquals(t, "p1", reply.Id)
+	assertEquals(t, "result", reply.Type)
+	assertEquals(t, "{true [x@b.c]}", fmt.Sprint(<-bm.Changes))
+	if !bm.IsBlocked("x@b.c/z") {
+		t.Error("not blocked")
+	}
+
+	// Pushes from anyone else are ignored.
+	recvIn <- &Iq{Header: Header{From: "evil@b.c", Id: "p2", Type: "set",
+		Nested: []interface{}{&UnblockReq{}}}}
+	<-recvOut
+	recvIn <- &Iq{Header: Header{Id: "p3", Type: "set",
+		Nested: []interface{}{&UnblockReq{}}}}
+	<-sendOut
+	assertEquals(t, "{false []}", fmt.Sprint(<-bm.Changes))
+	if len(bm.Blocked()) != 0 {
+		t.Errorf("still blocked %v", bm.Blocked())
+	}
+
+	go func() {
+		h := <-cl.handlers
+		iq := (<-send).(*Iq)
+		assertMarshal(t, `<unblock xmlns="`+NsBlocking+`"><item xmlns="`+
+			NsBlocking+`" jid="a@b.c"></item></unblock>`, iq.Nested[0])
+		h.f(&Iq{Header: Header{Id: iq.Id, Type: "result"}})
+	}()
+	if err := cl.Unblock(context.Background(), "a@b.c"); err != nil {
+		t.Errorf("Unblock: %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+package xmpp
+
+// This file contains support for bookmarks of multi-user chat rooms,
+// XEP-0402, falling back to the older bookmarks in private XML
+// storage, XEP-0048 and XEP-0049, on servers without PEP.
+
+import (
+	"context"
+	"encoding/xml"
+	"reflect"
+)
+
+const (
+	NsBookmarks       = "urn:xmpp:bookmarks:1"
+	NsPrivate         = "jabber:iq:private"
+	NsLegacyBookmarks = "storage:bookmarks"
+)
+
+// A bookmarked room. In PEP, each is stored as an item whose id is
+// the room's JID.
+type Bookmark struct {
+	XMLName  xml.Name `xml:"urn:xmpp:bookmarks:1 conference"`
+	Jid      JID      `xml:"-"`
+	Name     string   `xml:"name,attr,omitempty"`
+	Autojoin bool     `xml:"autojoin,attr,omitempty"`
+	Nick     string   `xml:"urn:xmpp:bookmarks:1 nick,omitempty"`
+	Password string   `xml:"urn:xmpp:bookmarks:1 password,omitempty"`
+}
+
+// A private XML storage request or result.
+type PrivateQuery struct {
+	XMLName xml.Name `xml:"jabber:iq:private query"`
+	Storage *LegacyBookmarks
+}
+
+// The bookmarks kept in private XML storage, XEP-0048. Bookmarked
+// web pages are kept so they survive when the storage is rewritten.
+type LegacyBookmarks struct {
+	XMLName     xml.Name           `xml:"storage:bookmarks storage"`
+	Conferences []LegacyConference `xml:"conference"`
+	Urls        []LegacyUrl        `xml:"url"`
+}
+
+type LegacyConference struct {
+	Jid      JID    `xml:"jid,attr"`
+	Name     string `xml:"name,attr,omitempty"`
+	Autojoin string `xml:"autojoin,attr,omitempty"`
+	Nick     string `xml:"nick,omitempty"`
+	Password string `xml:"password,omitempty"`
+}
+
+type LegacyUrl struct {
+	Name string `xml:"name,attr,omitempty"`
+	Url  string `xml:"url,attr"`
+}
+
+// BookmarksExt may be included in the extensions passed to NewClient
+// to use the bookmark functions. An AutoJoiner includes it.
+var BookmarksExt Extension = Extension{}
+
+func init() {
+	BookmarksExt.StanzaTypes = pubsubStanzaTypes()
+	pName := xml.Name{Space: NsPrivate, Local: "query"}
+	BookmarksExt.StanzaTypes[pName] = reflect.TypeOf(PrivateQuery{})
+}
+
+// Decodes the bookmarks in a list of pubsub items.
+func bookmarksFromItems(items []PubsubItem) []Bookmark {
+	var bms []Bookmark
+	for _, item := range items {
+		var bm Bookmark
+		if err := item.Decode(&bm); err != nil {
+			continue
+		}
+		bm.Jid = JID(item.Id)
+		bms = append(bms, bm)
+	}
+	return bms
+}
+
+// Can't PEP be used, so that bookmarks have to be kept in private
+// storage? A missing node may just mean the bookmarks haven't been
+// moved from there.
+func pepUnavailable(err error) bool {
+	switch errCondition(err) {
+	case "service-unavailable", "feature-not-implemented",
+		"item-not-found":
+		return true
+	}
+	return false
+}
+
+// Fetches the user's bookmarks from PEP, or from private storage if
+// the server doesn't keep them in PEP.
+func (cl *Client) Bookmarks(ctx context.Context) ([]Bookmark, error) {
+	items, err := cl.PubsubItems(ctx, "", NsBookmarks)
+	if err == nil {
+		return bookmarksFromItems(items), nil
+	}
+	if !pepUnavailable(err) {
+		return nil, err
+	}
+	legacy, lerr := cl.legacyBookmarks(ctx)
+	if lerr != nil {
+		return nil, err
+	}
+	var bms []Bookmark
+	for _, c := range legacy.Conferences {
+		bms = append(bms, Bookmark{Jid: c.Jid, Name: c.Name,
+			Autojoin: c.Autojoin == "true" || c.Autojoin == "1",
+			Nick:     c.Nick, Password: c.Password})
+	}
+	return bms, nil
+}
+
+// Adds a bookmark, or replaces the one for the same room.
+func (cl *Client) AddBookmark(ctx context.Context, bm Bookmark) error {
+	item, err := NewPubsubItem(string(bm.Jid.Bare()), &bm)
+	if err != nil {
+		return err
+	}
+	_, err = cl.Publish(ctx, "", NsBookmarks, item, map[string]string{
+		"pubsub#persist_items":            "true",
+		"pubsub#max_items":                "max",
+		"pubsub#send_last_published_item": "never",
+		"pubsub#access_model":             AccessWhitelist})
+	if !pepUnavailable(err) {
+		return err
+	}
+	return cl.updateLegacyBookmarks(ctx, bm.Jid, &bm)
+}
+
+// Removes the bookmark for a room.
+func (cl *Client) RemoveBookmark(ctx context.Context, room JID) error {
+	err := cl.Retract(ctx, "", NsBookmarks, string(room.Bare()), true)
+	if !pepUnavailable(err) {
+		return err
+	}
+	return cl.updateLegacyBookmarks(ctx, room, nil)
+}
+
+func (cl *Client) legacyBookmarks(ctx context.Context) (*LegacyBookmarks,
+	error) {
+
+	iq := &Iq{Header: Header{Type: "get", Nested: []interface{}{
+		&PrivateQuery{Storage: &LegacyBookmarks{}}}}}
+	reply, err := cl.SendIq(ctx, iq)
+	if err != nil {
+		return nil, err
+	}
+	for _, ele := range reply.Nested {
+		if q, ok := ele.(*PrivateQuery); ok && q.Storage != nil {
+			return q.Storage, nil
+		}
+	}
+	return &LegacyBookmarks{}, nil
+}
+
+// Replaces the private storage bookmark for a room with bm, or
+// removes it if bm is nil. Private storage can only be rewritten as a
+// whole.
+func (cl *Client) updateLegacyBookmarks(ctx context.Context, room JID,
+	bm *Bookmark) error {
+
+	legacy, err := cl.legacyBookmarks(ctx)
+	if err != nil {
+		return err
+	}
+	room = room.Bare()
+	confs := legacy.Conferences[:0]
+	for _, c := range legacy.Conferences {
+		if c.Jid.Bare() != room {
+			confs = append(confs, c)
+		}
+	}
+	if bm != nil {
+		c := LegacyConference{Jid: room, Name: bm.Name, Nick: bm.Nick,
+			Password: bm.Password}
+		if bm.Autojoin {
+			c.Autojoin = "true"
+		}
+		confs = append(confs, c)
+	}
+	legacy.Conferences = confs
+	iq := &Iq{Header: Header{Type: "set", Nested: []interface{}{
+		&PrivateQuery{Storage: legacy}}}}
+	_, err = cl.SendIq(ctx, iq)
+	return err
+}
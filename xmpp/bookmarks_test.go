@@ -0,0 +1,71 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+)
+
+func TestLegacyBookmarks(t *testing.T) {
+	send := make(chan Stanza, 1)
+	cl := &Client{handlers: make(chan *callback, 1), Send: send}
+	asked := make(chan string, 4)
+	replies := make(chan *Iq, 4)
+	go func() {
+		for {
+			h := <-cl.handlers
+			iq := (<-send).(*Iq)
+			buf, _ := xml.Marshal(iq.Nested[0])
+			asked <- iq.Type + " " + string(buf)
+			reply := <-replies
+			reply.Id = iq.Id
+			h.f(reply)
+		}
+	}()
+	ctx := context.Background()
+	unavailable := &Iq{Header: Header{Type: "error",
+		Error: stanzaError("cancel", "service-unavailable")}}
+	storage := func(confs ...LegacyConference) *Iq {
+		return &Iq{Header: Header{Type: "result", Nested: []interface{}{
+			&PrivateQuery{Storage: &LegacyBookmarks{
+				Conferences: confs,
+				Urls:        []LegacyUrl{{Url: "http://x"}}}}}}}
+	}
+
+	replies <- unavailable
+	replies <- storage(LegacyConference{Jid: "a@muc", Autojoin: "1",
+		Nick: "al"})
+	bms, err := cl.Bookmarks(ctx)
+	<-asked
+	assertEquals(t, `get <query xmlns="`+NsPrivate+`"><storage xmlns="`+
+		NsLegacyBookmarks+`"></storage></query>`, <-asked)
+	if err != nil || len(bms) != 1 || !bms[0].Autojoin ||
+		bms[0].Nick != "al" {
+		t.Fatalf("Bookmarks: %v %v", bms, err)
+	}
+
+	replies <- unavailable
+	replies <- storage(LegacyConference{Jid: "a@muc"})
+	replies <- &Iq{Header: Header{Type: "result"}}
+	err = cl.AddBookmark(ctx, Bookmark{Jid: "b@muc", Autojoin: true})
+	if err != nil {
+		t.Fatalf("AddBookmark: %v", err)
+	}
+	<-asked
+	<-asked
+	assertEquals(t, `set <query xmlns="`+NsPrivate+`"><storage xmlns="`+
+		NsLegacyBookmarks+`"><conference jid="a@muc"></conference>`+
+		`<conference jid="b@muc" autojoin="true"></conference>`+
+		`<url url="http://x"></url></storage></query>`, <-asked)
+
+	// Other errors aren't a reason to fall back.
+	replies <- &Iq{Header: Header{Type: "error",
+		Error: stanzaError("auth", "forbidden")}}
+	if err := cl.RemoveBookmark(ctx, "a@muc"); err == nil {
+		t.Error("RemoveBookmark succeeded")
+	}
+	<-asked
+	if len(asked) != 0 {
+		t.Errorf("fell back to private storage")
+	}
+}
@@ -0,0 +1,427 @@
+package xmpp
+
+// This file contains a transport which carries the XMPP stream over
+// BOSH, the long-polling HTTP binding of XEP-0124 and XEP-0206.
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	NsHttpBind = "http://jabber.org/protocol/httpbind"
+	NsXBosh    = "urn:xmpp:xbosh"
+
+	// How long the server may hold a request open, in seconds.
+	boshWait = 60
+)
+
+// Returns a Transport which connects to a BOSH connection manager at
+// the given http:// or https:// URL, for NewClientWithFailover. See
+// DialBosh.
+func BoshTransport(url string, tlsconf *tls.Config) Transport {
+	return Transport{Name: "bosh",
+		Dial: func(ctx context.Context, domain string) (net.Conn, error) {
+			return DialBosh(ctx, url, tlsconf)
+		}}
+}
+
+// Returns a connection which carries an XMPP stream over a BOSH
+// session with the connection manager at the given URL, so it can be
+// given to NewClientFromConn. The session is created when the stream
+// header is written. Requests are made over HTTPS with tlsconf for
+// https:// URLs; STARTTLS isn't available over BOSH.
+func DialBosh(ctx context.Context, url string, tlsconf *tls.Config) (net.Conn,
+	error) {
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("not an HTTP URL: %s", url)
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsconf
+	c := &boshConn{url: url, requests: 1, results: make(map[uint64][]byte)}
+	c.client = &http.Client{Transport: tr,
+		Timeout: (boshWait + 30) * time.Second}
+	c.cond = sync.NewCond(&c.lock)
+	c.input = make(chan []byte, 16)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	// Leave room for plenty of requests below 2^53.
+	c.rid = binary.BigEndian.Uint64(b[:]) >> 24
+	c.nextRid = c.rid
+	return c, nil
+}
+
+// The body element which wraps everything sent over BOSH.
+type boshBody struct {
+	XMLName   xml.Name `xml:"http://jabber.org/protocol/httpbind body"`
+	Sid       string   `xml:"sid,attr"`
+	Type      string   `xml:"type,attr"`
+	Condition string   `xml:"condition,attr"`
+	Requests  int      `xml:"requests,attr"`
+	From      string   `xml:"from,attr"`
+	Version   string   `xml:"urn:xmpp:xbosh version,attr"`
+	Inner     []byte   `xml:",innerxml"`
+}
+
+// What a request is for, which decides how its response is
+// translated.
+type boshKind int
+
+const (
+	boshCreate boshKind = iota
+	boshRestart
+	boshPayload
+	boshTerminate
+)
+
+// A BOSH session, which looks like an ordinary XMPP stream to the
+// layers above.
+type boshConn struct {
+	msgReader
+	url    string
+	client *http.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	split  xmlSplitter
+	// Protects everything below, and signals changes to it.
+	lock sync.Mutex
+	cond *sync.Cond
+	// The stream's to and xml:lang, from the first stream header.
+	to, lang string
+	started  bool
+	sid      string
+	// Set while the session is being created.
+	creating bool
+	// The next request id, and the number of requests which may be
+	// outstanding at once.
+	rid         uint64
+	requests    int
+	outstanding int
+	// Pieces written by the client, waiting to be sent.
+	queue []xmlPiece
+	// Translated responses, waiting to be delivered in order of
+	// request id.
+	results map[uint64][]byte
+	nextRid uint64
+	done    bool
+	// The TLS connection the last response came over, for https://
+	// URLs.
+	tlsState *tls.ConnectionState
+	// Held while delivering responses, so they stay in order.
+	deliver sync.Mutex
+}
+
+func (c *boshConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.done {
+		return 0, io.ErrClosedPipe
+	}
+	for _, p := range c.split.write(b) {
+		if p.stream != nil && !c.started {
+			c.started = true
+			c.to = p.stream.To
+			c.lang = p.stream.Lang
+			go c.run()
+		}
+		c.queue = append(c.queue, p)
+	}
+	c.cond.Broadcast()
+	return len(b), nil
+}
+
+// Makes requests as they're needed, until the session ends. One
+// request is always left outstanding, so the connection manager has a
+// way to push stanzas to us.
+func (c *boshConn) run() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for !c.done {
+		kind, body, ok := c.next()
+		if !ok {
+			c.cond.Wait()
+			continue
+		}
+		rid := c.rid
+		c.rid++
+		c.outstanding++
+		go c.post(rid, kind, body)
+	}
+}
+
+// Chooses the next request to make, if one should be made now. Called
+// with the lock held.
+func (c *boshConn) next() (boshKind, []byte, bool) {
+	if c.creating || c.outstanding >= c.requests {
+		return 0, nil, false
+	}
+	if c.sid == "" {
+		// The first piece is the stream header.
+		c.queue = c.queue[1:]
+		c.creating = true
+		return boshCreate, c.body(fmt.Sprintf(` content="text/xml; `+
+			`charset=utf-8" hold="1" to="%s" ver="1.11" wait="%d" `+
+			`xmpp:version="%s" xmlns:xmpp="%s"`, xmlAttr(c.to),
+			boshWait, XMPPVersion, NsXBosh), nil), true
+	}
+	if len(c.queue) == 0 {
+		if c.outstanding > 0 {
+			return 0, nil, false
+		}
+		return boshPayload, c.body("", nil), true
+	}
+	switch p := c.queue[0]; {
+	case p.stream != nil:
+		c.queue = c.queue[1:]
+		return boshRestart, c.body(fmt.Sprintf(` to="%s" xmpp:restart="true" `+
+			`xmlns:xmpp="%s"`, xmlAttr(c.to), NsXBosh), nil), true
+	case p.end:
+		c.queue = c.queue[1:]
+		return boshTerminate, c.body(` type="terminate"`, nil), true
+	}
+	var payload [][]byte
+	for len(c.queue) > 0 && c.queue[0].elem != nil {
+		payload = append(payload, c.queue[0].elem)
+		c.queue = c.queue[1:]
+	}
+	return boshPayload, c.body("", payload), true
+}
+
+// Builds a body element for the next request. Called with the lock
+// held.
+func (c *boshConn) body(attrs string, payload [][]byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<body rid="%d"`, c.rid)
+	if c.sid != "" {
+		fmt.Fprintf(&buf, ` sid="%s"`, xmlAttr(c.sid))
+	}
+	if c.lang != "" {
+		fmt.Fprintf(&buf, ` xml:lang="%s"`, xmlAttr(c.lang))
+	}
+	buf.WriteString(attrs)
+	buf.WriteString(` xmlns="` + NsHttpBind + `"`)
+	if len(payload) == 0 {
+		buf.WriteString(`/>`)
+		return buf.Bytes()
+	}
+	buf.WriteString(`>`)
+	for _, p := range payload {
+		buf.Write(p)
+	}
+	buf.WriteString(`</body>`)
+	return buf.Bytes()
+}
+
+// Escapes an attribute value.
+func xmlAttr(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// Makes one request, and queues the translation of its response for
+// delivery.
+func (c *boshConn) post(rid uint64, kind boshKind, body []byte) {
+	data, err := c.roundTrip(kind, body)
+	c.lock.Lock()
+	c.outstanding--
+	if kind == boshCreate {
+		c.creating = false
+	}
+	if err != nil || kind == boshTerminate {
+		if err == nil {
+			err = io.EOF
+		}
+		c.fail(err)
+		c.lock.Unlock()
+		return
+	}
+	if c.done {
+		c.lock.Unlock()
+		return
+	}
+	c.results[rid] = data
+	var ready [][]byte
+	for {
+		data, ok := c.results[c.nextRid]
+		if !ok {
+			break
+		}
+		delete(c.results, c.nextRid)
+		c.nextRid++
+		if len(data) > 0 {
+			ready = append(ready, data)
+		}
+	}
+	c.cond.Broadcast()
+	c.deliver.Lock()
+	c.lock.Unlock()
+	defer c.deliver.Unlock()
+	for _, data := range ready {
+		// The input channel is closed once the context is done.
+		if c.ctx.Err() != nil {
+			return
+		}
+		select {
+		case c.input <- data:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *boshConn) roundTrip(kind boshKind, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(c.ctx, "POST", c.url,
+		bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("BOSH request: %s", resp.Status)
+	}
+	if resp.TLS != nil {
+		c.lock.Lock()
+		c.tlsState = resp.TLS
+		c.lock.Unlock()
+	}
+	var rb boshBody
+	if err := xml.NewDecoder(resp.Body).Decode(&rb); err != nil {
+		return nil, fmt.Errorf("BOSH response: %v", err)
+	}
+	if rb.Type == "terminate" {
+		if kind == boshTerminate {
+			return nil, nil
+		}
+		if rb.Condition != "" {
+			return nil, fmt.Errorf("BOSH session terminated: %s",
+				rb.Condition)
+		}
+		return nil, io.EOF
+	}
+
+	// The stream headers which BOSH leaves out are put back in.
+	var header []byte
+	switch kind {
+	case boshCreate:
+		if rb.Sid == "" {
+			return nil, fmt.Errorf("BOSH response has no sid")
+		}
+		c.lock.Lock()
+		c.sid = rb.Sid
+		// Allow one request to be held by the connection
+		// manager, and another to carry what we send.
+		c.requests = 2
+		if rb.Requests > 0 {
+			c.requests = rb.Requests
+		}
+		c.lock.Unlock()
+		fallthrough
+	case boshRestart:
+		st := &stream{From: rb.From, Id: rb.Sid, Version: rb.Version}
+		if st.Id == "" {
+			c.lock.Lock()
+			st.Id = c.sid
+			c.lock.Unlock()
+		}
+		header = []byte(st.String())
+	}
+	return append(header, rb.Inner...), nil
+}
+
+// Ends the session with an error. Called with the lock held.
+func (c *boshConn) fail(err error) {
+	if c.done {
+		return
+	}
+	c.done = true
+	c.err = err
+	// Deliveries in progress give up once the context is done.
+	c.cancel()
+	c.cond.Broadcast()
+	c.deliver.Lock()
+	close(c.input)
+	c.deliver.Unlock()
+}
+
+// Terminates the session, if the client hasn't already ended the
+// stream.
+func (c *boshConn) Close() error {
+	c.lock.Lock()
+	if c.done {
+		c.lock.Unlock()
+		return nil
+	}
+	sid := c.sid
+	body := c.body(` type="terminate"`, nil)
+	c.rid++
+	c.lock.Unlock()
+	if sid != "" {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			5*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, "POST", c.url,
+			bytes.NewReader(body))
+		if err == nil {
+			if resp, err := c.client.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}
+	c.lock.Lock()
+	c.fail(io.ErrClosedPipe)
+	c.lock.Unlock()
+	return nil
+}
+
+// Describes the TLS connection of the latest response, for https://
+// URLs.
+func (c *boshConn) ConnectionState() tls.ConnectionState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.tlsState == nil {
+		return tls.ConnectionState{}
+	}
+	return *c.tlsState
+}
+
+type boshAddr string
+
+func (a boshAddr) Network() string { return "bosh" }
+func (a boshAddr) String() string  { return string(a) }
+
+func (c *boshConn) LocalAddr() net.Addr  { return boshAddr("") }
+func (c *boshConn) RemoteAddr() net.Addr { return boshAddr(c.url) }
+
+func (c *boshConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// Writes never block on the network, so there's nothing for a write
+// deadline to do.
+func (c *boshConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
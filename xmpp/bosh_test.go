@@ -0,0 +1,140 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Plays a BOSH connection manager. The names of the elements the
+// client sends are reported on frames, and whatever is sent on push
+// is delivered to the client in reply to a held request.
+func boshServer(t *testing.T, frames chan<- string,
+	push <-chan string) http.Handler {
+
+	respond := func(w http.ResponseWriter, attrs, inner string) {
+		fmt.Fprintf(w, `<body%s xmlns="%s" xmlns:stream="%s">%s</body>`,
+			attrs, NsHttpBind, NsStream, inner)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b struct {
+			Sid     string `xml:"sid,attr"`
+			Type    string `xml:"type,attr"`
+			Restart string `xml:"urn:xmpp:xbosh restart,attr"`
+			Inner   []byte `xml:",innerxml"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&b); err != nil {
+			t.Errorf("server decode: %v", err)
+			return
+		}
+		switch {
+		case b.Sid == "":
+			frames <- "create"
+			respond(w, ` sid="s1" requests="2" from="example.com"`+
+				` xmpp:version="1.0" xmlns:xmpp="`+NsXBosh+`"`,
+				`<stream:features/>`)
+			return
+		case b.Restart == "true":
+			frames <- "restart"
+			respond(w, "", `<stream:features><bind xmlns="`+NsBind+
+				`"/></stream:features>`)
+			return
+		case b.Type == "terminate":
+			frames <- "terminate"
+			respond(w, ` type="terminate"`, "")
+			return
+		}
+		dec := xml.NewDecoder(strings.NewReader(string(b.Inner)))
+		var names []string
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				break
+			}
+			if se, ok := tok.(xml.StartElement); ok {
+				names = append(names, se.Name.Local)
+				dec.Skip()
+			}
+		}
+		if len(names) > 0 {
+			frames <- strings.Join(names, ",")
+			inner := ""
+			if names[0] == "auth" {
+				inner = `<success xmlns="` + NsSASL + `"/>`
+			}
+			respond(w, "", inner)
+			return
+		}
+		// Hold a poll until there's something to push.
+		select {
+		case s := <-push:
+			respond(w, "", s)
+		case <-time.After(100 * time.Millisecond):
+			respond(w, "", "")
+		}
+	})
+}
+
+func TestBosh(t *testing.T) {
+	frames := make(chan string, 100)
+	push := make(chan string, 1)
+	srv := httptest.NewServer(boshServer(t, frames, push))
+	defer srv.Close()
+
+	conn, err := DialBosh(context.Background(), srv.URL, nil)
+	if err != nil {
+		t.Fatalf("DialBosh: %v", err)
+	}
+	buf := make([]byte, 4096)
+	read := func() string {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		return string(buf[:n])
+	}
+	frame := func() string {
+		select {
+		case f := <-frames:
+			return f
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a request")
+		}
+		return ""
+	}
+
+	st := &stream{To: "example.com", Version: XMPPVersion}
+	io.WriteString(conn, st.String())
+	assertEquals(t, "create", frame())
+	assertEquals(t, (&stream{From: "example.com", Id: "s1",
+		Version: "1.0"}).String()+`<stream:features/>`, read())
+
+	io.WriteString(conn, `<auth xmlns="`+NsSASL+`" mechanism="PLAIN">`+
+		`eA==</auth>`)
+	assertEquals(t, "auth", frame())
+	assertEquals(t, `<success xmlns="`+NsSASL+`"/>`, read())
+
+	io.WriteString(conn, st.String())
+	assertEquals(t, "restart", frame())
+	assertEquals(t, (&stream{Id: "s1"}).String()+`<stream:features>`+
+		`<bind xmlns="`+NsBind+`"/></stream:features>`, read())
+
+	io.WriteString(conn, `<message to="a@b"><body>hi</body></message>`+
+		`<presence/>`)
+	assertEquals(t, "message,presence", frame())
+	push <- `<message xmlns="jabber:client" from="a@b"/>`
+	assertEquals(t, `<message xmlns="jabber:client" from="a@b"/>`, read())
+
+	conn.Close()
+	assertEquals(t, "terminate", frame())
+	if _, err := conn.Read(buf); err == nil {
+		t.Error("read after close should fail")
+	}
+}
@@ -0,0 +1,157 @@
+package xmpp
+
+// This file contains the callbacks waiting for replies by id, and
+// dropping those whose replies never come.
+
+import (
+	"errors"
+	"time"
+)
+
+// How many callbacks may wait for replies at once if
+// MaxCallbacksExt doesn't say.
+const defaultMaxCallbacks = 10000
+
+var (
+	// Given to the expiry function of SetCallbackTimeout when no
+	// stanza with the id arrived in time.
+	ErrCallbackExpired = errors.New("no reply in time")
+	// Given to the expiry function of SetCallbackTimeout when as
+	// many callbacks as MaxCallbacksExt allows are waiting already,
+	// so the new one wasn't registered.
+	ErrTooManyCallbacks = errors.New("too many callbacks waiting")
+)
+
+// Sets how many callbacks, of SetCallback and SetCallbackTimeout and
+// those of SendIq, may wait for replies at once. Beyond that, new
+// ones are refused, so that a peer which never answers can't make
+// them pile up.
+func MaxCallbacksExt(n int) Extension {
+	return Extension{option: func(o *options) {
+		o.maxCallbacks = n
+	}}
+}
+
+// Like SetCallback, but if no stanza with the id arrives within the
+// timeout, the callback is dropped and expired is called, in a
+// goroutine of its own, with ErrCallbackExpired. It's also called, with
+// ErrTooManyCallbacks, if there are too many callbacks waiting to
+// register this one. Either may be nil. A timeout which isn't
+// positive never expires.
+func (cl *Client) SetCallbackTimeout(id string, timeout time.Duration,
+	f func(Stanza), expired func(error)) {
+
+	h := &callback{id: id, f: cl.timeCallback(f), expired: expired}
+	if timeout > 0 {
+		h.deadline = time.Now().Add(timeout)
+	}
+	cl.addCallback(h)
+}
+
+func (cl *Client) addCallback(h *callback) {
+	select {
+	case cl.handlers <- h:
+	case <-cl.closing:
+		// It would never be called.
+	}
+}
+
+// Drops the callback of an id, which is no longer wanted. It doesn't
+// wait if the callbacks aren't being read, since one with a deadline
+// expires anyway.
+func (cl *Client) dropCallback(id string) {
+	select {
+	case cl.handlers <- &callback{id: id, drop: true}:
+	default:
+	}
+}
+
+// The callbacks waiting for replies, which belong to recvStream's
+// goroutine.
+type callbackTable struct {
+	cl *Client
+	m  map[string]*callback
+	// Fires at the earliest deadline, if there is one.
+	timer *time.Timer
+	next  time.Time
+}
+
+func newCallbackTable(cl *Client) *callbackTable {
+	return &callbackTable{cl: cl, m: make(map[string]*callback)}
+}
+
+func (t *callbackTable) add(h *callback) {
+	if h.drop {
+		delete(t.m, h.id)
+		return
+	}
+	max := t.cl.opts.maxCallbacks
+	if max <= 0 {
+		max = defaultMaxCallbacks
+	}
+	if _, ok := t.m[h.id]; !ok && len(t.m) >= max {
+		t.cl.logf(LogError, "callback for %s refused: %d waiting",
+			h.id, len(t.m))
+		if h.expired != nil {
+			go h.expired(ErrTooManyCallbacks)
+		}
+		return
+	}
+	t.m[h.id] = h
+	if !h.deadline.IsZero() && (t.next.IsZero() ||
+		h.deadline.Before(t.next)) {
+		t.arm(h.deadline)
+	}
+}
+
+// Removes and returns the callback of an id, if there is one.
+func (t *callbackTable) take(id string) *callback {
+	h := t.m[id]
+	delete(t.m, id)
+	return h
+}
+
+// Drops the callbacks whose deadlines have passed, and waits for the
+// next one.
+func (t *callbackTable) expire(now time.Time) {
+	var next time.Time
+	for id, h := range t.m {
+		switch {
+		case h.deadline.IsZero():
+		case !h.deadline.After(now):
+			delete(t.m, id)
+			if h.expired != nil {
+				go h.expired(ErrCallbackExpired)
+			}
+		case next.IsZero() || h.deadline.Before(next):
+			next = h.deadline
+		}
+	}
+	t.stop()
+	if !next.IsZero() {
+		t.arm(next)
+	}
+}
+
+func (t *callbackTable) arm(at time.Time) {
+	t.stop()
+	t.next = at
+	t.timer = time.NewTimer(time.Until(at))
+}
+
+func (t *callbackTable) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.timer = nil
+	t.next = time.Time{}
+}
+
+// Delivers the time once the earliest deadline has passed. It's nil
+// if no callback has one.
+func (t *callbackTable) fired() <-chan time.Time {
+	if t.timer == nil {
+		return nil
+	}
+	return t.timer.C
+}
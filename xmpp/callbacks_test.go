@@ -0,0 +1,56 @@
+package xmpp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCallbackExpiry(t *testing.T) {
+	cl := &Client{}
+	cl.opts.maxCallbacks = 3
+	tab := newCallbackTable(cl)
+	defer tab.stop()
+	errs := make(chan string, 4)
+	add := func(id string, timeout time.Duration) {
+		h := &callback{id: id, f: func(Stanza) {},
+			expired: func(err error) { errs <- id + " " + err.Error() }}
+		if timeout > 0 {
+			h.deadline = time.Now().Add(timeout)
+		}
+		tab.add(h)
+	}
+	add("forever", 0)
+	add("late", time.Hour)
+	add("soon", 10*time.Millisecond)
+	add("more", time.Millisecond)
+	assertEquals(t, "more "+ErrTooManyCallbacks.Error(), <-errs)
+
+	select {
+	case now := <-tab.fired():
+		tab.expire(now)
+	case <-time.After(time.Second):
+		t.Fatal("timer didn't fire")
+	}
+	assertEquals(t, "soon "+ErrCallbackExpired.Error(), <-errs)
+	if tab.take("soon") != nil || len(tab.m) != 2 {
+		t.Errorf("callbacks %v", tab.m)
+	}
+	if !tab.next.Equal(tab.m["late"].deadline) {
+		t.Errorf("next deadline %v", tab.next)
+	}
+
+	// A reply takes its callback, and dropping one removes it
+	// without calling anything.
+	if tab.take("late") == nil {
+		t.Errorf("callback not taken")
+	}
+	tab.add(&callback{id: "forever", drop: true})
+	if len(tab.m) != 0 {
+		t.Errorf("callbacks %v", tab.m)
+	}
+	select {
+	case err := <-errs:
+		t.Errorf("unexpected %s", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
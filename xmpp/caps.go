@@ -0,0 +1,296 @@
+package xmpp
+
+// This file contains support for entity capabilities, XEP-0115.
+
+import (
+	"./forms"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"hash"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const NsCaps = "http://jabber.org/protocol/caps"
+
+// The node which identifies this library in the caps it advertises.
+const capsNode = "https://cjones.org/hg/go-xmpp2"
+
+// The hash functions caps may be computed with, by their names in
+// the hash attribute.
+var capsHashes = map[string]func() hash.Hash{
+	"sha-1":   sha1.New,
+	"sha-256": sha256.New,
+}
+
+// Advertises an entity's capabilities in its presence. Ver
+// identifies the set of features, which can be discovered by a
+// disco#info query to the node Node#Ver.
+type Caps struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/caps c"`
+	Hash    string   `xml:"hash,attr"`
+	Node    string   `xml:"node,attr"`
+	Ver     string   `xml:"ver,attr"`
+}
+
+// Keeps track of the capabilities of the entities we've seen
+// presence from, so features can be looked up without asking each
+// one.
+type capsCache struct {
+	Extension
+	lock sync.Mutex
+	// The caps most recently advertised by each full JID.
+	jids map[JID]Caps
+	// What each caps ver stands for, which may be shared with
+	// other clients.
+	vers *capsVers
+	// Results of disco queries to entities without caps.
+	infos map[JID]*DiscoInfo
+	// The caps we advertise in our own presence.
+	own Caps
+}
+
+// What caps vers stand for. A ver is a hash of what it stands for,
+// so what's learned by one client holds for all of them.
+type capsVers struct {
+	lock sync.Mutex
+	m    map[string]*DiscoInfo
+	// If set, what's learned is stored, and what isn't known is
+	// looked for there.
+	storage Storage
+}
+
+func newCapsVers() *capsVers {
+	return &capsVers{m: make(map[string]*DiscoInfo)}
+}
+
+func (v *capsVers) useStorage(s Storage) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.storage = s
+}
+
+func (v *capsVers) get(ver string) *DiscoInfo {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if di := v.m[ver]; di != nil || v.storage == nil {
+		return di
+	}
+	buf, ok, err := v.storage.Get(StorageCaps, ver)
+	if err != nil || !ok {
+		return nil
+	}
+	di := &DiscoInfo{}
+	if xml.Unmarshal(buf, di) != nil {
+		return nil
+	}
+	v.m[ver] = di
+	return di
+}
+
+func (v *capsVers) put(ver string, di *DiscoInfo) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.m[ver] = di
+	if v.storage == nil {
+		return
+	}
+	if buf, err := xml.Marshal(di); err == nil {
+		v.storage.Set(StorageCaps, ver, buf)
+	}
+}
+
+func newCapsCache() *capsCache {
+	cc := &capsCache{}
+	cc.jids = make(map[JID]Caps)
+	cc.vers = newCapsVers()
+	cc.infos = make(map[JID]*DiscoInfo)
+	cc.StanzaTypes = make(map[xml.Name]reflect.Type)
+	cName := xml.Name{Space: NsCaps, Local: "c"}
+	cc.StanzaTypes[cName] = reflect.TypeOf(Caps{})
+	for k, v := range DiscoExt.StanzaTypes {
+		cc.StanzaTypes[k] = v
+	}
+	cc.Features = []string{NsCaps}
+	cc.RecvFilter = cc.recvFilter
+	cc.SendFilter = cc.sendFilter
+	return cc
+}
+
+// Computes the verification string for a disco#info result, XEP-0115
+// section 5.
+func capsVer(di *DiscoInfo, h func() hash.Hash) string {
+	var ids, features []string
+	for _, id := range di.Identities {
+		ids = append(ids, id.Category+"/"+id.Type+"/"+id.Lang+"/"+
+			id.Name)
+	}
+	for _, f := range di.Features {
+		features = append(features, f.Var)
+	}
+	sort.Strings(ids)
+	sort.Strings(features)
+	var b strings.Builder
+	for _, s := range append(ids, features...) {
+		b.WriteString(s + "<")
+	}
+	byType := make(map[string]*forms.Form)
+	var types []string
+	for i := range di.Forms {
+		f := &di.Forms[i]
+		if v := f.Values("FORM_TYPE"); len(v) > 0 {
+			byType[v[0]] = f
+			types = append(types, v[0])
+		}
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		b.WriteString(t + "<")
+		fields := append([]forms.Field(nil), byType[t].Fields...)
+		sort.Slice(fields, func(i, j int) bool {
+			return fields[i].Var < fields[j].Var
+		})
+		for _, field := range fields {
+			if field.Var == "FORM_TYPE" {
+				continue
+			}
+			b.WriteString(field.Var + "<")
+			vals := append([]string(nil), field.Values...)
+			sort.Strings(vals)
+			for _, v := range vals {
+				b.WriteString(v + "<")
+			}
+		}
+	}
+	sum := h()
+	sum.Write([]byte(b.String()))
+	return base64.StdEncoding.EncodeToString(sum.Sum(nil))
+}
+
+// Does the disco#info result match the caps which were advertised
+// for it? Caps with unknown hashes, or the legacy format without
+// one, can't be checked.
+func capsVerified(c *Caps, di *DiscoInfo) bool {
+	h, ok := capsHashes[c.Hash]
+	return ok && capsVer(di, h) == c.Ver
+}
+
+// Sets the features we advertise. Returns the disco node at which
+// they can be queried.
+func (cc *capsCache) advertise(di *DiscoInfo) string {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	cc.own = Caps{Hash: "sha-1", Node: capsNode,
+		Ver: capsVer(di, sha1.New)}
+	return cc.own.Node + "#" + cc.own.Ver
+}
+
+// Adds our caps to the available presence we send.
+func (cc *capsCache) sendFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for stan := range in {
+		if p, ok := stan.(*Presence); ok && p.Type == "" {
+			stan = cc.withCaps(p)
+		}
+		out <- stan
+	}
+}
+
+func (cc *capsCache) withCaps(p *Presence) *Presence {
+	for _, ele := range p.Nested {
+		if _, ok := ele.(*Caps); ok {
+			return p
+		}
+	}
+	cc.lock.Lock()
+	c := cc.own
+	cc.lock.Unlock()
+	if c.Ver == "" {
+		return p
+	}
+	pr := *p
+	pr.Nested = append(append([]interface{}(nil), p.Nested...), &c)
+	return &pr
+}
+
+func (cc *capsCache) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for stan := range in {
+		if p, ok := stan.(*Presence); ok {
+			cc.presence(p)
+		}
+		out <- stan
+	}
+}
+
+func (cc *capsCache) presence(p *Presence) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	delete(cc.infos, p.From)
+	switch p.Type {
+	case "":
+		for _, ele := range p.Nested {
+			if c, ok := ele.(*Caps); ok {
+				cc.jids[p.From] = *c
+				return
+			}
+		}
+		delete(cc.jids, p.From)
+	case "unavailable":
+		delete(cc.jids, p.From)
+	}
+}
+
+// Returns the cached features of a JID, if known, and the caps it
+// advertised, if any.
+func (cc *capsCache) lookup(jid JID) (*DiscoInfo, *Caps) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	if c, ok := cc.jids[jid]; ok {
+		return cc.vers.get(c.Ver), &c
+	}
+	return cc.infos[jid], nil
+}
+
+func (cc *capsCache) store(jid JID, c *Caps, di *DiscoInfo) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	if c != nil {
+		cc.vers.put(c.Ver, di)
+	} else {
+		cc.infos[jid] = di
+	}
+}
+
+// Reports whether the entity supports a feature, identified by its
+// disco#info var (usually a namespace). The capabilities advertised
+// in the entity's presence are used if they're already known;
+// otherwise the entity is asked with a disco#info query.
+func (cl *Client) Supports(ctx context.Context, jid JID,
+	feature string) (bool, error) {
+
+	di, c := cl.caps.lookup(jid)
+	if di == nil {
+		node := ""
+		if c != nil {
+			node = c.Node + "#" + c.Ver
+		}
+		var err error
+		di, err = cl.DiscoInfo(ctx, jid, node)
+		if err != nil {
+			return false, err
+		}
+		if c != nil && !capsVerified(c, di) {
+			// Don't let the wrong answer stand for everyone
+			// using the same ver.
+			c = nil
+		}
+		cl.caps.store(jid, c, di)
+	}
+	return di.HasFeature(feature), nil
+}
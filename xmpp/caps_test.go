@@ -0,0 +1,99 @@
+package xmpp
+
+import (
+	"./forms"
+	"context"
+	"crypto/sha1"
+	"encoding/xml"
+	"testing"
+)
+
+func TestCapsCache(t *testing.T) {
+	cc := newCapsCache()
+	str := `<presence xmlns="jabber:client" from="a@b/c"><c xmlns="` +
+		NsCaps + `" hash="sha-1" node="http://n" ver="v1"/></presence>`
+	var p Presence
+	err := xml.Unmarshal([]byte(str), &p)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	err = parseExtended(&p.Header, cc.StanzaTypes)
+	if err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	cc.presence(&p)
+	di, c := cc.lookup("a@b/c")
+	if di != nil || c == nil {
+		t.Fatalf("lookup: %v %v", di, c)
+	}
+	assertEquals(t, "v1", c.Ver)
+	cc.store("a@b/c", c, &DiscoInfo{Features: []DiscoFeature{{Var: "x"}}})
+	di, _ = cc.lookup("a@b/c")
+	if !di.HasFeature("x") || di.HasFeature("y") {
+		t.Errorf("HasFeature: %v", di.Features)
+	}
+
+	cl := &Client{caps: cc}
+	ok, err := cl.Supports(context.Background(), "a@b/c", "x")
+	if err != nil || !ok {
+		t.Errorf("Supports: %v %v", ok, err)
+	}
+
+	p.Type = "unavailable"
+	cc.presence(&p)
+	di, c = cc.lookup("a@b/c")
+	if di != nil || c != nil {
+		t.Errorf("after unavailable: %v %v", di, c)
+	}
+}
+
+// The examples from XEP-0115, section 5.
+func TestCapsVer(t *testing.T) {
+	features := []DiscoFeature{{Var: "http://jabber.org/protocol/disco#info"},
+		{Var: NsCaps}, {Var: "http://jabber.org/protocol/muc"},
+		{Var: "http://jabber.org/protocol/disco#items"}}
+	di := &DiscoInfo{Identities: []DiscoIdentity{{Category: "client",
+		Type: "pc", Name: "Exodus 0.9.1"}}, Features: features}
+	assertEquals(t, "QgayPKawpkPSDYmwT/WM94uAlu0=", capsVer(di, sha1.New))
+
+	di = &DiscoInfo{Identities: []DiscoIdentity{
+		{Category: "client", Type: "pc", Lang: "en", Name: "Psi 0.11"},
+		{Category: "client", Type: "pc", Lang: "el", Name: "Ψ 0.11"}},
+		Features: features,
+		Forms: []forms.Form{{Type: "result", Fields: []forms.Field{
+			{Var: "os", Values: []string{"Mac"}},
+			{Var: "FORM_TYPE", Values: []string{
+				"urn:xmpp:dataforms:softwareinfo"}},
+			{Var: "ip_version", Values: []string{"ipv6", "ipv4"}},
+			{Var: "os_version", Values: []string{"10.5.1"}},
+			{Var: "software", Values: []string{"Psi"}},
+			{Var: "software_version", Values: []string{"0.11"}}}}}}
+	assertEquals(t, "q07IKJEyjvHSyhy//CH0CxmKi8w=", capsVer(di, sha1.New))
+}
+
+func TestCapsAdvertise(t *testing.T) {
+	cc := newCapsCache()
+	info := ownDiscoInfo([]Extension{ReceiptsExt}, nil)
+	node := cc.advertise(info)
+	assertEquals(t, capsNode+"#"+capsVer(info, sha1.New), node)
+
+	in := make(chan Stanza)
+	out := make(chan Stanza)
+	go cc.SendFilter(in, out)
+	defer close(in)
+	pr := &Presence{}
+	in <- pr
+	sent := (<-out).(*Presence)
+	if len(pr.Nested) != 0 || len(sent.Nested) != 1 {
+		t.Fatalf("got %v from %v", sent.Nested, pr.Nested)
+	}
+	c := sent.Nested[0].(*Caps)
+	if !capsVerified(c, info) {
+		t.Errorf("caps %v don't match %v", c, info)
+	}
+	unavail := &Presence{Header: Header{Type: "unavailable"}}
+	in <- unavail
+	if st := <-out; st != unavail {
+		t.Errorf("got %v", st)
+	}
+}
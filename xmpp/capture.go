@@ -0,0 +1,250 @@
+package xmpp
+
+// This file contains capturing the XML a client sends and receives to
+// files, for diagnosing problems with particular servers, and
+// replaying what was received through the parser, in tests.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Configures a Capture.
+type CaptureConfig struct {
+	// The directory the files are written in. It's created if it
+	// doesn't exist.
+	Dir string
+	// Starts the name of each file, which goes on with the time the
+	// file was started. Empty means "capture".
+	Prefix string
+	// How large a file may grow before the next is started. Zero
+	// means 10 MiB.
+	MaxSize int64
+	// How many files are kept; once there are more, the oldest are
+	// removed. Zero means all are kept.
+	MaxFiles int
+}
+
+const defaultCaptureSize = 10 << 20
+
+// Capture writes the XML a client sends and receives, as TrafficExt
+// sees it, after TLS and with secrets redacted, to files. Each chunk
+// is written as a line with the time, the direction, ">>" for sent
+// and "<<" for received, and the length, followed by the chunk
+// itself and a newline, so that the files can be read as they are
+// and by ReadCapture. Each client should have a Capture of its own.
+type Capture struct {
+	conf CaptureConfig
+	now  func() time.Time
+	lock sync.Mutex
+	f    *os.File
+	size int64
+	// The first error writing the files.
+	err error
+}
+
+// One chunk of a capture.
+type CaptureRecord struct {
+	Time     time.Time
+	Outbound bool
+	Data     []byte
+}
+
+// Creates a Capture, to be given to CaptureExt.
+func NewCapture(conf CaptureConfig) (*Capture, error) {
+	if conf.Prefix == "" {
+		conf.Prefix = "capture"
+	}
+	if conf.MaxSize <= 0 {
+		conf.MaxSize = defaultCaptureSize
+	}
+	if err := os.MkdirAll(conf.Dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Capture{conf: conf, now: time.Now}, nil
+}
+
+// Returns an extension which writes the client's traffic to c, along
+// with whatever TrafficExt taps.
+func CaptureExt(c *Capture) Extension {
+	return Extension{option: func(o *options) {
+		o.capture = c
+	}}
+}
+
+// Returns the first error writing the files, if any. Once there's
+// been one, nothing more is written.
+func (c *Capture) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// Closes the current file. Anything written after is in a new one.
+func (c *Capture) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.f == nil {
+		return nil
+	}
+	err := c.f.Close()
+	c.f = nil
+	return err
+}
+
+func (c *Capture) write(outbound bool, p []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return
+	}
+	now := c.now()
+	arrow := "<<"
+	if outbound {
+		arrow = ">>"
+	}
+	head := fmt.Sprintf("%s %s %d\n", now.UTC().Format(time.RFC3339Nano),
+		arrow, len(p))
+	n := int64(len(head) + len(p) + 1)
+	if c.f != nil && c.size > 0 && c.size+n > c.conf.MaxSize {
+		c.err = c.f.Close()
+		c.f = nil
+	}
+	if c.f == nil && c.err == nil {
+		c.err = c.rotate(now)
+	}
+	if c.err != nil {
+		return
+	}
+	buf := make([]byte, 0, n)
+	buf = append(append(append(buf, head...), p...), '\n')
+	_, c.err = c.f.Write(buf)
+	c.size += n
+}
+
+// Starts a new file, and removes the oldest if there are too many.
+func (c *Capture) rotate(now time.Time) error {
+	name := fmt.Sprintf("%s-%s.log", c.conf.Prefix,
+		now.UTC().Format("20060102T150405.000000000"))
+	f, err := os.OpenFile(filepath.Join(c.conf.Dir, name),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	c.f, c.size = f, 0
+	if c.conf.MaxFiles <= 0 {
+		return nil
+	}
+	names, err := filepath.Glob(filepath.Join(c.conf.Dir,
+		c.conf.Prefix+"-*.log"))
+	if err != nil {
+		return err
+	}
+	// The times in the names sort as the files were started.
+	sort.Strings(names)
+	for len(names) > c.conf.MaxFiles {
+		if err := os.Remove(names[0]); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// Reads the records of a capture file.
+func ReadCapture(r io.Reader) ([]CaptureRecord, error) {
+	br := bufio.NewReader(r)
+	var recs []CaptureRecord
+	for {
+		head, err := br.ReadString('\n')
+		if err == io.EOF && head == "" {
+			return recs, nil
+		}
+		if err != nil {
+			return recs, err
+		}
+		var stamp, arrow string
+		var n int
+		if _, err := fmt.Sscanf(head, "%s %s %d\n", &stamp, &arrow,
+			&n); err != nil || (arrow != "<<" && arrow != ">>") ||
+			n < 0 {
+			return recs, fmt.Errorf("capture: bad record %q",
+				strings.TrimSpace(head))
+		}
+		t, err := time.Parse(time.RFC3339Nano, stamp)
+		if err != nil {
+			return recs, fmt.Errorf("capture: bad time %q", stamp)
+		}
+		data := make([]byte, n+1)
+		if _, err := io.ReadFull(br, data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return recs, err
+		}
+		if data[n] != '\n' {
+			return recs, errors.New("capture: record too long")
+		}
+		recs = append(recs, CaptureRecord{Time: t, Outbound: arrow == ">>",
+			Data: data[:n]})
+	}
+}
+
+// Feeds what was received in a capture file through the parser, as
+// a client with the given extensions would, and returns the stanzas
+// it makes, with their payloads decoded. The error is the one the
+// client would have ended its session with, if any.
+func ReplayCapture(r io.Reader, exts ...Extension) ([]Stanza, error) {
+	recs, err := ReadCapture(r)
+	if err != nil {
+		return nil, err
+	}
+	var in []io.Reader
+	for _, rec := range recs {
+		if !rec.Outbound {
+			in = append(in, strings.NewReader(string(rec.Data)))
+		}
+	}
+	jid := JID("")
+	cl := newBareClient(&jid, "", nil)
+	cl.Send = make(chan Stanza)
+	types := registeredPayloads()
+	for _, ext := range exts {
+		for k, v := range ext.StanzaTypes {
+			types[k] = v
+		}
+	}
+	cl.extensions.init(exts, types)
+	ch := make(chan interface{})
+	in = append(in, captureEnd{})
+	go cl.recvXml(io.MultiReader(in...), ch, types)
+	var sts []Stanza
+	for x := range ch {
+		if st, ok := x.(Stanza); ok {
+			sts = append(sts, st)
+		}
+	}
+	err = cl.getError(nil)
+	if errors.Is(err, errCaptureEnd) {
+		err = nil
+	}
+	return sts, err
+}
+
+// A capture usually ends within the stream, which is only an error
+// for a parser which expects more.
+var errCaptureEnd = errors.New("end of capture")
+
+type captureEnd struct{}
+
+func (captureEnd) Read([]byte) (int, error) {
+	return 0, errCaptureEnd
+}
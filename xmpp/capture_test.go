@@ -0,0 +1,117 @@
+package xmpp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCapture(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	dir := t.TempDir()
+	c, err := NewCapture(CaptureConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewCapture: %v", err)
+	}
+	jid := JID("alice@b.c/pc")
+	cl, err := NewClientFromConn(s.Dial(), &jid, "secret", &tls.Config{},
+		[]Extension{CaptureExt(c)}, Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn: %v", err)
+	}
+	cl.Send <- &Message{Header: Header{To: "b.c"},
+		Body: []Text{{Chardata: "echo"}}}
+	recvMessage(t, cl)
+	cl.Close()
+	for range cl.Recv {
+	}
+	if err := c.Close(); err != nil || c.Err() != nil {
+		t.Fatalf("Close: %v %v", err, c.Err())
+	}
+
+	names, _ := filepath.Glob(filepath.Join(dir, "capture-*.log"))
+	if len(names) != 1 {
+		t.Fatalf("files %v", names)
+	}
+	buf, err := os.ReadFile(names[0])
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	recs, err := ReadCapture(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("ReadCapture: %v", err)
+	}
+	var sent strings.Builder
+	for _, rec := range recs {
+		if rec.Outbound {
+			sent.Write(rec.Data)
+		}
+	}
+	if !strings.Contains(sent.String(), `mechanism="PLAIN">[redacted]</auth>`) {
+		t.Errorf("SASL not redacted: %s", sent.String())
+	}
+
+	sts, err := ReplayCapture(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("ReplayCapture: %v", err)
+	}
+	found := false
+	for _, st := range sts {
+		if m, ok := st.(*Message); ok && firstText(m.Body) == "echo" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("echo not replayed: %v", sts)
+	}
+}
+
+func TestCaptureRotate(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewCapture(CaptureConfig{Dir: dir, Prefix: "x", MaxSize: 100,
+		MaxFiles: 2})
+	if err != nil {
+		t.Fatalf("NewCapture: %v", err)
+	}
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	// Each record is more than half a file.
+	chunk := strings.Repeat("a", 40)
+	for i := 0; i < 4; i++ {
+		c.write(i%2 == 0, []byte(chunk))
+	}
+	c.Close()
+	names, _ := filepath.Glob(filepath.Join(dir, "x-*.log"))
+	if len(names) != 2 {
+		t.Fatalf("files %v", names)
+	}
+	assertEquals(t, "x-20200102T030408.000000000.log",
+		filepath.Base(names[0]))
+	f, _ := os.Open(names[1])
+	defer f.Close()
+	recs, err := ReadCapture(f)
+	if err != nil || len(recs) != 1 {
+		t.Fatalf("ReadCapture: %v %v", recs, err)
+	}
+	if recs[0].Outbound || string(recs[0].Data) != chunk ||
+		!recs[0].Time.Equal(now) {
+		t.Errorf("record %+v", recs[0])
+	}
+
+	if _, err := ReadCapture(strings.NewReader("nonsense\n")); err == nil {
+		t.Errorf("bad record read")
+	}
+	if _, err := ReadCapture(strings.NewReader(
+		"2020-01-02T03:04:05Z << 10\nabc")); err == nil {
+		t.Errorf("short record read")
+	}
+}
@@ -0,0 +1,164 @@
+package xmpp
+
+// This file contains support for message carbons, XEP-0280, which
+// copy the messages sent and received by the user's other clients to
+// this one.
+
+import (
+	"context"
+	"encoding/xml"
+	"reflect"
+	"time"
+)
+
+const NsCarbons = "urn:xmpp:carbons:2"
+
+// Asks the server to start, or stop, sending carbons.
+type CarbonsEnable struct {
+	XMLName xml.Name `xml:"urn:xmpp:carbons:2 enable"`
+}
+
+type CarbonsDisable struct {
+	XMLName xml.Name `xml:"urn:xmpp:carbons:2 disable"`
+}
+
+// A copy of a message another of the user's clients received.
+type CarbonReceived struct {
+	XMLName   xml.Name `xml:"urn:xmpp:carbons:2 received"`
+	Forwarded Forwarded
+}
+
+// A copy of a message another of the user's clients sent.
+type CarbonSent struct {
+	XMLName   xml.Name `xml:"urn:xmpp:carbons:2 sent"`
+	Forwarded Forwarded
+}
+
+func (c *CarbonReceived) carried() []*Header { return c.Forwarded.carried() }
+func (c *CarbonSent) carried() []*Header     { return c.Forwarded.carried() }
+
+// Included in a message to keep it from being copied to the user's
+// other clients.
+type CarbonPrivate struct {
+	XMLName xml.Name `xml:"urn:xmpp:carbons:2 private"`
+}
+
+// Attached to a message unwrapped from a carbon copy, saying where it
+// came from. It isn't sent if the message is.
+type CarbonCopy struct {
+	// Was the message sent by another of the user's clients, rather
+	// than received by one?
+	Sent bool
+	// The message which carried the copy.
+	Carrier *Message
+}
+
+func (*CarbonCopy) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return nil
+}
+
+// CarbonsExt may be included in the extensions passed to NewClient to
+// receive copies of the messages the user's other clients send and
+// receive. Carbons are enabled before the initial presence is sent.
+// Each copy is delivered on Client.Recv as the message it carried,
+// with a CarbonCopy among its Nested elements.
+var CarbonsExt Extension = Extension{}
+
+func init() {
+	CarbonsExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	rName := xml.Name{Space: NsCarbons, Local: "received"}
+	CarbonsExt.StanzaTypes[rName] = reflect.TypeOf(CarbonReceived{})
+	sName := xml.Name{Space: NsCarbons, Local: "sent"}
+	CarbonsExt.StanzaTypes[sName] = reflect.TypeOf(CarbonSent{})
+	CarbonsExt.Features = []string{NsCarbons}
+	CarbonsExt.RecvFilter = carbonsFilter
+	CarbonsExt.option = func(o *options) {
+		o.carbons = true
+	}
+	CarbonsExt.BeforePresence = func(cl *Client) {
+		if cl.inlined[NsCarbons] {
+			// Bind 2 enabled them.
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(),
+			10*time.Second)
+		defer cancel()
+		cl.EnableCarbons(ctx)
+	}
+}
+
+// Asks the server to send carbons to this client.
+func (cl *Client) EnableCarbons(ctx context.Context) error {
+	iq := &Iq{Header: Header{Type: "set",
+		Nested: []interface{}{&CarbonsEnable{}}}}
+	_, err := cl.SendIq(ctx, iq)
+	if err == nil {
+		cl.rc.setCarbons(true)
+	}
+	return err
+}
+
+// Asks the server to stop sending carbons to this client.
+func (cl *Client) DisableCarbons(ctx context.Context) error {
+	iq := &Iq{Header: Header{Type: "set",
+		Nested: []interface{}{&CarbonsDisable{}}}}
+	_, err := cl.SendIq(ctx, iq)
+	if err == nil {
+		cl.rc.setCarbons(false)
+	}
+	return err
+}
+
+// Returns where a message unwrapped from a carbon came from, or nil
+// if it wasn't.
+func (m *Message) CarbonCopy() *CarbonCopy {
+	for _, ele := range m.Nested {
+		if cc, ok := ele.(*CarbonCopy); ok {
+			return cc
+		}
+	}
+	return nil
+}
+
+func carbonsFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for stan := range in {
+		if m, ok := stan.(*Message); ok {
+			if inner := unwrapCarbon(m); inner != nil {
+				stan = inner
+			}
+		}
+		out <- stan
+	}
+}
+
+// Returns the message carried by a carbon, or nil if the message
+// isn't one.
+func unwrapCarbon(m *Message) *Message {
+	// Only the user's own account may send carbons; from anyone else
+	// they'd be forgeries.
+	if m.To == "" || m.From != m.To.Bare() {
+		return nil
+	}
+	for _, ele := range m.Nested {
+		var fwd *Forwarded
+		cc := &CarbonCopy{Carrier: m}
+		switch c := ele.(type) {
+		case *CarbonReceived:
+			fwd = &c.Forwarded
+		case *CarbonSent:
+			fwd = &c.Forwarded
+			cc.Sent = true
+		default:
+			continue
+		}
+		if fwd.Message == nil {
+			return nil
+		}
+		inner := *fwd.Message
+		inner.Nested = append(append([]interface{}(nil),
+			inner.Nested...), cc)
+		return &inner
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestCarbons(t *testing.T) {
+	in := make(chan Stanza)
+	out := make(chan Stanza)
+	go CarbonsExt.RecvFilter(in, out)
+	defer close(in)
+	types := mergeStanzaTypes(CarbonsExt, ReceiptsExt)
+	parse := func(str string) *Message {
+		var m Message
+		if err := xml.Unmarshal([]byte(str), &m); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		if err := parseExtended(&m.Header, types); err != nil {
+			t.Fatalf("parseExtended: %v", err)
+		}
+		return &m
+	}
+	carbon := func(from, dir string) string {
+		return `<message xmlns="jabber:client" from="` + from +
+			`" to="me@b.c/phone"><` + dir + ` xmlns="` + NsCarbons +
+			`"><forwarded xmlns="` + NsForward + `">` +
+			`<message xmlns="jabber:client" from="me@b.c/laptop" ` +
+			`to="al@b.c" id="m1"><body>hi</body>` +
+			`<request xmlns="` + NsReceipts + `"/></message>` +
+			`</forwarded></` + dir + `></message>`
+	}
+
+	in <- parse(carbon("me@b.c", "sent"))
+	m := (<-out).(*Message)
+	assertEquals(t, "al@b.c", string(m.To))
+	assertEquals(t, "hi", firstText(m.Body))
+	cc := m.CarbonCopy()
+	if cc == nil || !cc.Sent || cc.Carrier.From != "me@b.c" {
+		t.Fatalf("carbon copy %+v", cc)
+	}
+	// The payloads of the carried message are decoded too.
+	var haveRequest bool
+	for _, ele := range m.Nested {
+		if _, ok := ele.(*ReceiptRequest); ok {
+			haveRequest = true
+		}
+	}
+	if !haveRequest {
+		t.Errorf("receipt request not decoded in %v", m.Nested)
+	}
+	buf, _ := xml.Marshal(&Message{Header: Header{Nested: m.Nested[1:]}})
+	assertEquals(t, `<message xmlns="jabber:client"></message>`, string(buf))
+
+	in <- parse(carbon("me@b.c", "received"))
+	if cc := (<-out).(*Message).CarbonCopy(); cc == nil || cc.Sent {
+		t.Errorf("carbon copy %+v", cc)
+	}
+
+	// Carbons from anyone else are forged.
+	forged := parse(carbon("eve@b.c", "received"))
+	in <- forged
+	if st := <-out; st != forged {
+		t.Errorf("forged carbon unwrapped: %v", st)
+	}
+}
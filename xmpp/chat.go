@@ -0,0 +1,429 @@
+package xmpp
+
+// This file contains a conversation abstraction, which gathers the
+// messages exchanged with one correspondent (or in one room) along
+// with their receipts, markers, corrections, and chat states.
+
+import (
+	"encoding/xml"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// The kinds of event which occur in a conversation.
+type ChatEventType int
+
+const (
+	// A message with a body.
+	ChatEventMessage ChatEventType = iota
+	// A delivery receipt (XEP-0184) for an earlier message.
+	ChatEventReceipt
+	// A chat marker (XEP-0333) for an earlier message.
+	ChatEventMarker
+	// A correction (XEP-0308) of an earlier message.
+	ChatEventCorrection
+	// A change of chat state (XEP-0085).
+	ChatEventState
+)
+
+// Something which happened in a conversation.
+type ChatEvent struct {
+	Type ChatEventType
+	// True for messages this client sent.
+	Outgoing bool
+	// The sender's full JID, for incoming events.
+	From JID
+	// For a message, its id. For receipts, markers, and
+	// corrections, the id of the earlier message being referred
+	// to.
+	Id string
+	// The message body, for messages and corrections.
+	Body string
+	// The kind of marker, or the chat state.
+	State string
+	// When the event was seen by this client.
+	Time time.Time
+	// The stanza the event was taken from.
+	Message *Message
+}
+
+// A conversation with one correspondent, or in one multi-user chat
+// room. Events are delivered in the order they happened. Those the
+// application hasn't read yet wait in a queue of the Chat's own, so
+// a conversation nobody reads doesn't hold up the others; Close one
+// that's no longer wanted.
+type Chat struct {
+	// The bare JID of the correspondent or room.
+	With JID
+	// Is this a multi-user chat room?
+	Room   bool
+	Events <-chan ChatEvent
+	events chan ChatEvent
+	mgr    *ChatManager
+	lock   sync.Mutex
+	// The full JID which last sent us a message. Replies go there,
+	// as RFC 6121 section 5.1 suggests.
+	to JID
+	// Events waiting to be delivered. Once the conversation has
+	// ended, no more are added.
+	cond  *sync.Cond
+	queue []ChatEvent
+	ended bool
+	// Closed by Close.
+	gone chan struct{}
+}
+
+// ChatManager is an extension which sorts incoming messages into
+// conversations. Messages belonging to a conversation are consumed,
+// and don't appear on Client.Recv; other stanzas pass through.
+type ChatManager struct {
+	Extension
+	// Conversations started by the remote are announced here.
+	New <-chan *Chat
+	// If set, groupchat messages from the rooms it reports are
+	// passed through, for another extension to claim, such as a
+	// muc.Manager with its Owns. It's set before the client starts.
+	SkipRoom func(room JID) bool
+	newChats chan *Chat
+	toServer chan Stanza
+	done     chan bool
+	lock     sync.Mutex
+	chats    map[JID]*Chat
+	cl       *Client
+	// Set once the session is over, so new conversations start
+	// out ended.
+	ended bool
+	// The conversations still waiting to be announced on New.
+	announcing sync.WaitGroup
+}
+
+// Combines the payload types of several extensions.
+func mergeStanzaTypes(exts ...Extension) map[xml.Name]reflect.Type {
+	m := make(map[xml.Name]reflect.Type)
+	for _, ext := range exts {
+		for k, v := range ext.StanzaTypes {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// Creates a ChatManager, to be passed to NewClient among the
+// extensions. It decodes receipts, markers, corrections, and chat
+// states itself.
+func NewChatManager() *ChatManager {
+	cm := &ChatManager{}
+	cm.newChats = make(chan *Chat, 10)
+	cm.New = cm.newChats
+	cm.toServer = make(chan Stanza)
+	cm.done = make(chan bool)
+	cm.chats = make(map[JID]*Chat)
+	cm.StanzaTypes = mergeStanzaTypes(ChatStatesExt, ReceiptsExt,
+		CorrectionExt, ChatMarkersExt)
+	cm.RecvFilter = cm.recvFilter
+	cm.SendFilter = cm.sendFilter
+	cm.Start = func(cl *Client) {
+		cm.lock.Lock()
+		cm.cl = cl
+		cm.lock.Unlock()
+	}
+	return cm
+}
+
+// Returns the conversation with the given JID, creating it if
+// necessary.
+func (cm *ChatManager) Chat(with JID) *Chat {
+	return cm.chat(with.Bare(), false, false)
+}
+
+// Returns the conversation in the given multi-user chat room,
+// creating it if necessary.
+func (cm *ChatManager) Room(room JID) *Chat {
+	return cm.chat(room.Bare(), true, false)
+}
+
+// Returns a conversation, creating it if necessary. A new one is
+// announced on New if announce is set.
+func (cm *ChatManager) chat(with JID, room, announce bool) *Chat {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	if c := cm.chats[with]; c != nil {
+		return c
+	}
+	c := &Chat{With: with, Room: room, mgr: cm, to: with}
+	c.cond = sync.NewCond(&c.lock)
+	c.events = make(chan ChatEvent, 32)
+	c.Events = c.events
+	c.gone = make(chan struct{})
+	c.ended = cm.ended
+	announce = announce && !cm.ended
+	if announce {
+		cm.announcing.Add(1)
+	}
+	cm.chats[with] = c
+	go c.deliver(announce)
+	return c
+}
+
+func (cm *ChatManager) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	defer func() {
+		cm.lock.Lock()
+		cm.ended = true
+		for _, c := range cm.chats {
+			c.end()
+		}
+		cm.lock.Unlock()
+		close(cm.done)
+		cm.announcing.Wait()
+		close(cm.newChats)
+	}()
+	for stan := range in {
+		m, ok := stan.(*Message)
+		if !ok || !cm.handle(m) {
+			out <- stan
+		}
+	}
+}
+
+func (cm *ChatManager) sendFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			out <- stan
+		case stan := <-cm.toServer:
+			out <- stan
+		}
+	}
+}
+
+// Delivers a message's events to its conversation. Returns false if
+// the message isn't part of a conversation.
+func (cm *ChatManager) handle(m *Message) bool {
+	if m.From == "" {
+		return false
+	}
+	switch m.Type {
+	case "", "normal", "chat", "groupchat":
+	default:
+		return false
+	}
+	if m.Type == "groupchat" && cm.SkipRoom != nil &&
+		cm.SkipRoom(m.From.Bare()) {
+		return false
+	}
+	cm.lock.Lock()
+	cl := cm.cl
+	cm.lock.Unlock()
+	evs := chatEvents(cl, m)
+	if len(evs) == 0 {
+		return false
+	}
+	c := cm.chat(m.From.Bare(), m.Type == "groupchat", true)
+	if !c.Room {
+		c.lock.Lock()
+		c.to = m.From
+		c.lock.Unlock()
+	}
+	for _, ev := range evs {
+		c.push(ev)
+	}
+	return true
+}
+
+// Queues an event for delivery, unless the conversation has ended.
+func (c *Chat) push(ev ChatEvent) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.ended {
+		c.queue = append(c.queue, ev)
+		c.cond.Signal()
+	}
+}
+
+// No more events are queued; those already queued are still
+// delivered.
+func (c *Chat) end() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.ended = true
+	c.cond.Signal()
+}
+
+// Waits for the next event. Returns false once the conversation has
+// ended and its queue is empty.
+func (c *Chat) pop() (ChatEvent, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(c.queue) == 0 && !c.ended {
+		c.cond.Wait()
+	}
+	if len(c.queue) == 0 {
+		return ChatEvent{}, false
+	}
+	ev := c.queue[0]
+	c.queue[0] = ChatEvent{}
+	c.queue = c.queue[1:]
+	return ev, true
+}
+
+// Announces the conversation on New, if asked to, and then passes
+// its queued events to Events until it ends or is closed.
+func (c *Chat) deliver(announce bool) {
+	defer close(c.events)
+	if announce {
+		select {
+		case c.mgr.newChats <- c:
+		case <-c.mgr.done:
+		case <-c.gone:
+		}
+		c.mgr.announcing.Done()
+	}
+	for ev, ok := c.pop(); ok; ev, ok = c.pop() {
+		select {
+		case c.events <- ev:
+		case <-c.gone:
+			return
+		}
+	}
+}
+
+// Ends the conversation, dropping the events which haven't been read
+// yet, and closes Events. The manager forgets it, so the next message
+// from the correspondent starts a new conversation, announced on New.
+func (c *Chat) Close() {
+	cm := c.mgr
+	cm.lock.Lock()
+	if cm.chats[c.With] == c {
+		delete(cm.chats, c.With)
+	}
+	cm.lock.Unlock()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	select {
+	case <-c.gone:
+	default:
+		close(c.gone)
+	}
+	c.ended = true
+	c.queue = nil
+	c.cond.Signal()
+}
+
+// Extracts the conversation events carried by a message, with its body
+// in the client's preferred language.
+func chatEvents(cl *Client, m *Message) []ChatEvent {
+	now := time.Now()
+	body := clientText(cl, &m.Header, m.Body)
+	ev := ChatEvent{From: m.From, Time: now, Message: m}
+	var evs []ChatEvent
+	if id, ok := m.Replaces(); ok {
+		ev.Type = ChatEventCorrection
+		ev.Id = id
+		ev.Body = body
+		evs = append(evs, ev)
+	} else if len(m.Body) > 0 {
+		ev.Type = ChatEventMessage
+		ev.Id = m.Id
+		ev.Body = body
+		evs = append(evs, ev)
+	}
+	ev.Body = ""
+	if id, ok := m.Receipt(); ok {
+		ev.Type = ChatEventReceipt
+		ev.Id = id
+		evs = append(evs, ev)
+	}
+	if mk := m.Marker(); mk != nil {
+		ev.Type = ChatEventMarker
+		ev.Id = mk.Id
+		ev.State = mk.XMLName.Local
+		evs = append(evs, ev)
+	}
+	if state := m.ChatState(); state != "" {
+		ev.Type = ChatEventState
+		ev.Id = m.Id
+		ev.State = state
+		evs = append(evs, ev)
+	}
+	return evs
+}
+
+// Returns the text of the first of several alternatives, or the
+// empty string.
+func firstText(texts []Text) string {
+	if len(texts) == 0 {
+		return ""
+	}
+	return texts[0].Chardata
+}
+
+// Sends a message stanza in this conversation, addressed and typed
+// appropriately, and records it as an outgoing event.
+func (c *Chat) send(msg *Message, ev ChatEvent) {
+	c.lock.Lock()
+	msg.To = c.to
+	c.lock.Unlock()
+	msg.Type = "chat"
+	if c.Room {
+		msg.Type = "groupchat"
+	}
+	if msg.Id == "" {
+		msg.Id = NextId()
+	}
+	select {
+	case c.mgr.toServer <- msg:
+	case <-c.mgr.done:
+		return
+	}
+	ev.Outgoing = true
+	ev.Time = time.Now()
+	ev.Message = msg
+	if ev.Id == "" {
+		ev.Id = msg.Id
+	}
+	c.push(ev)
+}
+
+// Sends a message, asking for a receipt and marking it markable so
+// the correspondent's acknowledgements show up as events. Returns
+// the message's id.
+func (c *Chat) Send(body string) string {
+	msg := &Message{Body: []Text{{Chardata: body}},
+		Header: Header{Nested: []interface{}{NewChatState(ChatActive),
+			&Markable{}}}}
+	if !c.Room {
+		msg.Nested = append(msg.Nested, &ReceiptRequest{})
+	}
+	c.send(msg, ChatEvent{Type: ChatEventMessage, Body: body})
+	return msg.Id
+}
+
+// Sends a correction of an earlier message with the given id.
+// Returns the correction's own id.
+func (c *Chat) Correct(id, body string) string {
+	msg := &Message{Body: []Text{{Chardata: body}},
+		Header: Header{Nested: []interface{}{&Replace{Id: id}}}}
+	c.send(msg, ChatEvent{Type: ChatEventCorrection, Id: id, Body: body})
+	return msg.Id
+}
+
+// Tells the correspondent our chat state, such as ChatComposing.
+func (c *Chat) SetState(state string) {
+	msg := &Message{Header: Header{
+		Nested: []interface{}{NewChatState(state)}}}
+	c.send(msg, ChatEvent{Type: ChatEventState, State: state})
+}
+
+// Sends a chat marker, such as MarkerDisplayed, for a message we
+// received.
+func (c *Chat) Mark(kind, id string) {
+	msg := &Message{Header: Header{
+		Nested: []interface{}{NewChatMarker(kind, id)}}}
+	c.send(msg, ChatEvent{Type: ChatEventMarker, Id: id, State: kind})
+}
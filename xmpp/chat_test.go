@@ -0,0 +1,118 @@
+package xmpp
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestChatManager(t *testing.T) {
+	cm := NewChatManager()
+	cm.SkipRoom = func(room JID) bool { return room == "room@muc" }
+	recvIn := make(chan Stanza)
+	recvOut := make(chan Stanza)
+	go cm.RecvFilter(recvIn, recvOut)
+	sendIn := make(chan Stanza)
+	sendOut := make(chan Stanza)
+	go cm.SendFilter(sendIn, sendOut)
+	defer close(sendIn)
+
+	recvIn <- &Message{Header: Header{From: "a@b.c/phone", Id: "m1",
+		Type: "chat", Nested: []interface{}{NewChatState(ChatActive)}},
+		Body: []Text{{Chardata: "hi"}}}
+	c := <-cm.New
+	assertEquals(t, "a@b.c", string(c.With))
+	ev := <-c.Events
+	if ev.Type != ChatEventMessage || ev.Body != "hi" || ev.Id != "m1" {
+		t.Errorf("bad event %#v", ev)
+	}
+	ev = <-c.Events
+	if ev.Type != ChatEventState || ev.State != ChatActive {
+		t.Errorf("bad event %#v", ev)
+	}
+
+	// Not part of a conversation.
+	pr := &Presence{Header: Header{From: "a@b.c/phone"}}
+	recvIn <- pr
+	if st := <-recvOut; st != pr {
+		t.Errorf("got %v", st)
+	}
+	// Left for the room's manager.
+	gc := &Message{Header: Header{From: "room@muc/bo", Type: "groupchat"},
+		Body: []Text{{Chardata: "hi all"}}}
+	recvIn <- gc
+	if st := <-recvOut; st != gc {
+		t.Errorf("got %v", st)
+	}
+
+	go c.Send("hello")
+	out := (<-sendOut).(*Message)
+	assertEquals(t, "a@b.c/phone", string(out.To))
+	assertEquals(t, "chat", out.Type)
+	ev = <-c.Events
+	if !ev.Outgoing || ev.Body != "hello" || ev.Id != out.Id {
+		t.Errorf("bad event %#v", ev)
+	}
+
+	recvIn <- &Message{Header: Header{From: "a@b.c/phone", Type: "chat",
+		Nested: []interface{}{&ReceiptReceived{Id: out.Id}}}}
+	ev = <-c.Events
+	if ev.Type != ChatEventReceipt || ev.Id != out.Id {
+		t.Errorf("bad event %#v", ev)
+	}
+
+	recvIn <- &Message{Header: Header{From: "a@b.c/phone", Type: "chat",
+		Nested: []interface{}{&Replace{Id: "m1"}}},
+		Body: []Text{{Chardata: "hey"}}}
+	ev = <-c.Events
+	if ev.Type != ChatEventCorrection || ev.Id != "m1" || ev.Body != "hey" {
+		t.Errorf("bad event %#v", ev)
+	}
+
+	close(recvIn)
+	if _, ok := <-c.Events; ok {
+		t.Errorf("events not closed")
+	}
+}
+
+func TestChatClose(t *testing.T) {
+	cm := NewChatManager()
+	recvIn := make(chan Stanza)
+	recvOut := make(chan Stanza)
+	go cm.RecvFilter(recvIn, recvOut)
+	defer close(recvIn)
+	msg := func(from JID, body string) *Message {
+		return &Message{Header: Header{From: from, Type: "chat"},
+			Body: []Text{{Chardata: body}}}
+	}
+
+	// Nobody reads New or Events, and the filter doesn't wait for
+	// them.
+	for i := 0; i < 100; i++ {
+		recvIn <- msg(JID(fmt.Sprintf("u%d@b.c/x", i%20)), "hi")
+	}
+	c := cm.Chat("u0@b.c")
+	for i := 0; i < 5; i++ {
+		if ev := <-c.Events; ev.Body != "hi" {
+			t.Errorf("bad event %#v", ev)
+		}
+	}
+
+	c.Close()
+	for range c.Events {
+	}
+	if cm.Chat("u0@b.c") == c {
+		t.Error("closed chat still managed")
+	}
+	recvIn <- msg("u1@b.c/x", "again")
+	c = cm.Chat("u1@b.c")
+	n := 0
+	for ev := range c.Events {
+		n++
+		if ev.Body == "again" {
+			break
+		}
+	}
+	if n != 6 {
+		t.Errorf("%d events before the last", n-1)
+	}
+}
@@ -0,0 +1,75 @@
+package xmpp
+
+// This file contains support for chat state notifications, XEP-0085.
+
+import (
+	"encoding/xml"
+	"reflect"
+)
+
+const NsChatStates = "http://jabber.org/protocol/chatstates"
+
+// The chat states.
+const (
+	ChatActive    = "active"
+	ChatComposing = "composing"
+	ChatPaused    = "paused"
+	ChatInactive  = "inactive"
+	ChatGone      = "gone"
+)
+
+// A chat state notification. XMLName.Local gives the state.
+type ChatState struct {
+	XMLName xml.Name
+}
+
+// Returns a notification of the given state, for inclusion in an
+// outgoing message.
+func NewChatState(state string) *ChatState {
+	return &ChatState{XMLName: xml.Name{Space: NsChatStates, Local: state}}
+}
+
+// ChatStatesExt may be included in the extensions passed to
+// NewClient to decode chat state notifications in incoming messages.
+var ChatStatesExt Extension = Extension{}
+
+func init() {
+	ChatStatesExt.Features = []string{NsChatStates}
+	ChatStatesExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	for _, state := range []string{ChatActive, ChatComposing,
+		ChatPaused, ChatInactive, ChatGone} {
+		name := xml.Name{Space: NsChatStates, Local: state}
+		ChatStatesExt.StanzaTypes[name] = reflect.TypeOf(ChatState{})
+	}
+}
+
+// Returns the chat state carried by the message, or the empty string
+// if there is none.
+func (m *Message) ChatState() string {
+	for _, ele := range m.Nested {
+		switch cs := ele.(type) {
+		case *ChatState:
+			return cs.XMLName.Local
+		case ChatState:
+			return cs.XMLName.Local
+		}
+	}
+	return ""
+}
+
+// Attaches the given chat state to the message, replacing any it
+// already carries. The empty string removes it.
+func (m *Message) SetChatState(state string) {
+	nested := m.Nested[:0:0]
+	for _, ele := range m.Nested {
+		switch ele.(type) {
+		case *ChatState, ChatState:
+			continue
+		}
+		nested = append(nested, ele)
+	}
+	if state != "" {
+		nested = append(nested, NewChatState(state))
+	}
+	m.Nested = nested
+}
@@ -0,0 +1,38 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestChatStates(t *testing.T) {
+	var m Message
+	str := `<message xmlns="jabber:client" from="a@b.c/d">` +
+		`<composing xmlns="` + NsChatStates + `"/></message>`
+	if err := xml.Unmarshal([]byte(str), &m); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if err := parseExtended(&m.Header, ChatStatesExt.StanzaTypes); err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	assertEquals(t, ChatComposing, m.ChatState())
+
+	m = Message{Header: Header{To: "a@b.c", Nested: []interface{}{
+		&ReceiptRequest{}}}}
+	m.SetChatState(ChatComposing)
+	m.SetChatState(ChatPaused)
+	assertEquals(t, ChatPaused, m.ChatState())
+	buf, err := xml.Marshal(&m)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	assertEquals(t, `<message xmlns="jabber:client" to="a@b.c">`+
+		`<request xmlns="`+NsReceipts+`"></request>`+
+		`<paused xmlns="`+NsChatStates+`"></paused></message>`,
+		string(buf))
+	m.SetChatState("")
+	assertEquals(t, "", m.ChatState())
+	if len(m.Nested) != 1 {
+		t.Errorf("nested %v", m.Nested)
+	}
+}
@@ -0,0 +1,454 @@
+package xmpp
+
+// This file contains support for ad-hoc commands, XEP-0050: running
+// commands offered by other entities, and offering commands which
+// they can run on this client.
+
+import (
+	"./forms"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+const NsCommands = "http://jabber.org/protocol/commands"
+
+// The actions a requester may take.
+const (
+	CommandExecute  = "execute"
+	CommandCancel   = "cancel"
+	CommandPrev     = "prev"
+	CommandNext     = "next"
+	CommandComplete = "complete"
+)
+
+// The statuses of a command session.
+const (
+	CommandExecuting = "executing"
+	CommandCompleted = "completed"
+	CommandCanceled  = "canceled"
+)
+
+// A command request or response.
+type Command struct {
+	XMLName   xml.Name        `xml:"http://jabber.org/protocol/commands command"`
+	Node      string          `xml:"node,attr"`
+	SessionId string          `xml:"sessionid,attr,omitempty"`
+	Action    string          `xml:"action,attr,omitempty"`
+	Status    string          `xml:"status,attr,omitempty"`
+	Actions   *CommandActions `xml:"actions"`
+	Notes     []CommandNote   `xml:"note"`
+	Form      *forms.Form     `xml:"jabber:x:data x"`
+}
+
+// The actions the requester may take next. Execute names the one
+// to take by default.
+type CommandActions struct {
+	Execute  string    `xml:"execute,attr,omitempty"`
+	Prev     *struct{} `xml:"prev"`
+	Next     *struct{} `xml:"next"`
+	Complete *struct{} `xml:"complete"`
+}
+
+// A note from the responder. Type is info, warn, or error.
+type CommandNote struct {
+	Type string `xml:"type,attr,omitempty"`
+	Text string `xml:",chardata"`
+}
+
+// CommandsExt may be included in the extensions passed to NewClient
+// to run other entities' commands with ExecuteCommand. A
+// CommandManager includes it.
+var CommandsExt Extension = Extension{}
+
+func init() {
+	CommandsExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	cName := xml.Name{Space: NsCommands, Local: "command"}
+	CommandsExt.StanzaTypes[cName] = reflect.TypeOf(Command{})
+}
+
+// Lists the commands an entity offers.
+func (cl *Client) Commands(ctx context.Context, jid JID) ([]DiscoItem,
+	error) {
+
+	items, err := cl.DiscoItems(ctx, jid, NsCommands)
+	if err != nil {
+		return nil, err
+	}
+	return items.Items, nil
+}
+
+// A command being run on another entity. After each stage, Status
+// says whether the command is still executing, and Form holds
+// whatever the responder wants filled in.
+type CommandSession struct {
+	Jid    JID
+	Node   string
+	Id     string
+	Status string
+	// The allowed actions, if the responder said.
+	Actions *CommandActions
+	Notes   []CommandNote
+	Form    *forms.Form
+	cl      *Client
+}
+
+// Starts running a command on another entity. Simple commands may
+// complete at once; others return a form for the next stage.
+func (cl *Client) ExecuteCommand(ctx context.Context, jid JID,
+	node string) (*CommandSession, error) {
+
+	s := &CommandSession{Jid: jid, Node: node, cl: cl}
+	if err := s.do(ctx, CommandExecute, nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Is the command still executing?
+func (s *CommandSession) Executing() bool {
+	return s.Status == CommandExecuting
+}
+
+// Submits the current stage's form, if any, and moves to the next
+// stage.
+func (s *CommandSession) Next(ctx context.Context, form *forms.Form) error {
+	return s.do(ctx, CommandNext, form)
+}
+
+// Returns to the previous stage.
+func (s *CommandSession) Prev(ctx context.Context) error {
+	return s.do(ctx, CommandPrev, nil)
+}
+
+// Submits the current stage's form, if any, and finishes the
+// command.
+func (s *CommandSession) Complete(ctx context.Context, form *forms.Form) error {
+	return s.do(ctx, CommandComplete, form)
+}
+
+// Abandons the command.
+func (s *CommandSession) Cancel(ctx context.Context) error {
+	return s.do(ctx, CommandCancel, nil)
+}
+
+func (s *CommandSession) do(ctx context.Context, action string,
+	form *forms.Form) error {
+
+	req := &Command{Node: s.Node, SessionId: s.Id, Action: action}
+	if form != nil {
+		req.Form = form.Submit()
+	}
+	iq := &Iq{Header: Header{To: s.Jid, Type: "set",
+		Nested: []interface{}{req}}}
+	reply, err := s.cl.SendIq(ctx, iq)
+	if err != nil {
+		return err
+	}
+	for _, ele := range reply.Nested {
+		if c, ok := ele.(*Command); ok {
+			if c.SessionId != "" {
+				s.Id = c.SessionId
+			}
+			s.Status = c.Status
+			s.Actions = c.Actions
+			s.Notes = c.Notes
+			s.Form = c.Form
+			return nil
+		}
+	}
+	return fmt.Errorf("no command in reply from %s", s.Jid)
+}
+
+// A command this client offers to other entities.
+type LocalCommand struct {
+	Node string
+	// A human-readable name, listed in disco#items.
+	Name string
+	// Decides who may run the command. If nil, only other
+	// resources of the client's own account may.
+	Allow func(from JID) bool
+	// Runs one stage of the command, and returns the response. Its
+	// Status says whether the command is still executing; the
+	// empty string means completed. Node and SessionId are filled
+	// in. An error is returned to the requester as a stanza error;
+	// if it isn't an *Error, it's reported as an internal server
+	// error. Run is called on its own goroutine.
+	Run func(ctx context.Context, req *CommandRequest) (*Command, error)
+}
+
+// One stage of a command being run on this client.
+type CommandRequest struct {
+	From JID
+	// CommandExecute for the first stage; then whatever action the
+	// requester took. Run is called for CommandCancel too, so it
+	// can clean up.
+	Action string
+	// The form the requester submitted, if any.
+	Form      *forms.Form
+	SessionId string
+	// Kept between the stages of one session, for Run's use.
+	Data interface{}
+}
+
+// Sessions which aren't used for this long are forgotten.
+const commandSessionTimeout = 10 * time.Minute
+
+// How long one stage of a local command may take.
+const commandTimeout = time.Minute
+
+// CommandManager is an extension which answers other entities'
+// requests to list and run the commands it offers. It also allows
+// the client to run other entities' commands.
+type CommandManager struct {
+	Extension
+	toServer chan Stanza
+	sendDone chan bool
+	lock     sync.Mutex
+	cl       *Client
+	commands map[string]*LocalCommand
+	sessions map[string]*commandSession
+}
+
+type commandSession struct {
+	from     JID
+	node     string
+	data     interface{}
+	lastUsed time.Time
+}
+
+// Creates a CommandManager, to be passed to NewClient among the
+// extensions.
+func NewCommandManager() *CommandManager {
+	cm := &CommandManager{}
+	cm.toServer = make(chan Stanza)
+	cm.sendDone = make(chan bool)
+	cm.commands = make(map[string]*LocalCommand)
+	cm.sessions = make(map[string]*commandSession)
+	cm.StanzaTypes = mergeStanzaTypes(CommandsExt, DiscoExt)
+	cm.Features = []string{NsCommands}
+	cm.RecvFilter = cm.recvFilter
+	cm.SendFilter = cm.sendFilter
+	cm.Start = func(cl *Client) {
+		cm.lock.Lock()
+		defer cm.lock.Unlock()
+		cm.cl = cl
+	}
+	return cm
+}
+
+// Offers a command, replacing any other with the same node.
+func (cm *CommandManager) Add(cmd LocalCommand) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	cm.commands[cmd.Node] = &cmd
+}
+
+// Withdraws the command with the given node. Sessions already
+// running it may finish.
+func (cm *CommandManager) Remove(node string) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	delete(cm.commands, node)
+}
+
+// Returns the command with the given node, if from may run it.
+func (cm *CommandManager) command(node string, from JID) (*LocalCommand,
+	bool) {
+
+	cm.lock.Lock()
+	cmd := cm.commands[node]
+	cl := cm.cl
+	cm.lock.Unlock()
+	if cmd == nil {
+		return nil, false
+	}
+	if cmd.Allow != nil {
+		return cmd, cmd.Allow(from)
+	}
+	return cmd, cl != nil && from.Bare() == cl.Jid.Bare()
+}
+
+func (cm *CommandManager) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for stan := range in {
+		iq, ok := stan.(*Iq)
+		if !ok || len(iq.Nested) != 1 {
+			out <- stan
+			continue
+		}
+		var reply *Iq
+		switch q := iq.Nested[0].(type) {
+		case *DiscoItems:
+			if iq.Type == "get" && q.Node == NsCommands {
+				reply = cm.listCommands(iq)
+			}
+		case *DiscoInfo:
+			if iq.Type == "get" && q.Node != "" {
+				reply = cm.commandInfo(iq, q.Node)
+			}
+		case *Command:
+			if iq.Type == "set" {
+				go cm.run(iq, q)
+				continue
+			}
+		}
+		if reply == nil {
+			out <- stan
+			continue
+		}
+		cm.reply(reply)
+	}
+}
+
+func (cm *CommandManager) reply(reply *Iq) {
+	select {
+	case cm.toServer <- reply:
+	case <-cm.sendDone:
+	}
+}
+
+func (cm *CommandManager) listCommands(iq *Iq) *Iq {
+	cm.lock.Lock()
+	var nodes []string
+	for node := range cm.commands {
+		nodes = append(nodes, node)
+	}
+	cm.lock.Unlock()
+	sort.Strings(nodes)
+	items := &DiscoItems{Node: NsCommands}
+	for _, node := range nodes {
+		if cmd, ok := cm.command(node, iq.From); ok {
+			items.Items = append(items.Items, DiscoItem{Jid: iq.To,
+				Node: node, Name: cmd.Name})
+		}
+	}
+	return &Iq{Header: Header{To: iq.From, Id: iq.Id, Type: "result",
+		Nested: []interface{}{items}}}
+}
+
+// Answers disco#info for the node of a command. Returns nil for
+// other nodes.
+func (cm *CommandManager) commandInfo(iq *Iq, node string) *Iq {
+	cmd, ok := cm.command(node, iq.From)
+	if cmd == nil {
+		return nil
+	}
+	reply := &Iq{Header: Header{To: iq.From, Id: iq.Id, Type: "result"}}
+	if !ok {
+		reply.Type = "error"
+		reply.Nested = iq.Nested
+		reply.Error = stanzaError("auth", "forbidden")
+		return reply
+	}
+	reply.Nested = []interface{}{&DiscoInfo{Node: node,
+		Identities: []DiscoIdentity{{Category: "automation",
+			Type: "command-node", Name: cmd.Name}},
+		Features: []DiscoFeature{{Var: NsCommands}, {Var: forms.NsXData}}}}
+	return reply
+}
+
+// Runs one stage of a command, and sends the response.
+func (cm *CommandManager) run(iq *Iq, req *Command) {
+	reply := &Iq{Header: Header{To: iq.From, Id: iq.Id, Type: "result"}}
+	resp, err := cm.stage(iq.From, req)
+	if err != nil {
+		reply.Type = "error"
+		reply.Nested = iq.Nested
+		er, ok := err.(*Error)
+		if !ok {
+			er = stanzaError("wait", "internal-server-error")
+		}
+		reply.Error = er
+	} else {
+		reply.Nested = []interface{}{resp}
+	}
+	cm.reply(reply)
+}
+
+func (cm *CommandManager) stage(from JID, req *Command) (*Command, error) {
+	cmd, ok := cm.command(req.Node, from)
+	switch {
+	case cmd == nil:
+		return nil, stanzaError("cancel", "item-not-found")
+	case !ok:
+		return nil, stanzaError("auth", "forbidden")
+	}
+	action := req.Action
+	if action == "" {
+		action = CommandExecute
+	}
+
+	cm.lock.Lock()
+	now := time.Now()
+	for id, s := range cm.sessions {
+		if now.Sub(s.lastUsed) > commandSessionTimeout {
+			delete(cm.sessions, id)
+		}
+	}
+	var sess *commandSession
+	id := req.SessionId
+	if id == "" {
+		id = NextId()
+		sess = &commandSession{from: from, node: req.Node}
+		cm.sessions[id] = sess
+	} else {
+		sess = cm.sessions[id]
+		if sess == nil || sess.from != from || sess.node != req.Node {
+			cm.lock.Unlock()
+			return nil, stanzaError("modify", "bad-request")
+		}
+	}
+	sess.lastUsed = now
+	cm.lock.Unlock()
+
+	creq := &CommandRequest{From: from, Action: action, Form: req.Form,
+		SessionId: id, Data: sess.data}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		commandTimeout)
+	defer cancel()
+	resp, err := cmd.Run(ctx, creq)
+	if err == nil && resp == nil {
+		resp = &Command{}
+	}
+	if err == nil && resp.Status == "" {
+		resp.Status = CommandCompleted
+		if action == CommandCancel {
+			resp.Status = CommandCanceled
+		}
+	}
+
+	cm.lock.Lock()
+	sess.data = creq.Data
+	if err != nil || resp.Status != CommandExecuting {
+		delete(cm.sessions, id)
+	}
+	cm.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	resp.Node = req.Node
+	resp.SessionId = id
+	resp.Action = ""
+	return resp, nil
+}
+
+func (cm *CommandManager) sendFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	defer close(cm.sendDone)
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			out <- stan
+		case stan := <-cm.toServer:
+			out <- stan
+		}
+	}
+}
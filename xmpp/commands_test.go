@@ -0,0 +1,140 @@
+package xmpp
+
+import (
+	"./forms"
+	"context"
+	"encoding/xml"
+	"testing"
+)
+
+func TestCommandManager(t *testing.T) {
+	cm := NewCommandManager()
+	cm.Start(&Client{Jid: "me@b.c/bot"})
+	cm.Add(LocalCommand{Node: "greet", Name: "Greet",
+		Run: func(ctx context.Context, req *CommandRequest) (*Command,
+			error) {
+			if req.Action == CommandExecute {
+				req.Data = "Hello"
+				form := &forms.Form{Type: forms.TypeForm}
+				form.Set("name")
+				return &Command{Status: CommandExecuting,
+					Form: form}, nil
+			}
+			return &Command{Notes: []CommandNote{{Type: "info",
+				Text: req.Data.(string) + " " +
+					req.Form.Value("name")}}}, nil
+		}})
+	cm.Add(LocalCommand{Node: "open", Allow: func(JID) bool { return true },
+		Run: func(context.Context, *CommandRequest) (*Command, error) {
+			return nil, nil
+		}})
+	recvIn := make(chan Stanza)
+	recvOut := make(chan Stanza, 1)
+	go cm.RecvFilter(recvIn, recvOut)
+	sendIn := make(chan Stanza)
+	sendOut := make(chan Stanza)
+	go cm.SendFilter(sendIn, sendOut)
+	defer close(sendIn)
+	defer close(recvIn)
+
+	ask := func(from JID, typ string, q interface{}) *Iq {
+		recvIn <- &Iq{Header: Header{From: from, To: "me@b.c/bot",
+			Id: "1", Type: typ, Nested: []interface{}{q}}}
+		return (<-sendOut).(*Iq)
+	}
+	items := func(from JID) string {
+		reply := ask(from, "get", &DiscoItems{Node: NsCommands})
+		buf, _ := xml.Marshal(reply.Nested[0])
+		return string(buf)
+	}
+	assertEquals(t, `<query xmlns="`+NsDiscoItems+`" node="`+
+		NsCommands+`"><item jid="me@b.c/bot" node="greet" name="Greet">`+
+		`</item><item jid="me@b.c/bot" node="open"></item></query>`,
+		items("me@b.c/phone"))
+	assertEquals(t, `<query xmlns="`+NsDiscoItems+`" node="`+
+		NsCommands+`"><item jid="me@b.c/bot" node="open"></item>`+
+		`</query>`, items("x@b.c/d"))
+	reply := ask("me@b.c/phone", "get", &DiscoInfo{Node: "greet"})
+	if di, ok := reply.Nested[0].(*DiscoInfo); !ok ||
+		!di.HasFeature(NsCommands) {
+		t.Errorf("info %v", reply.Nested)
+	}
+
+	reply = ask("me@b.c/phone", "set", &Command{Node: "greet",
+		Action: CommandExecute})
+	c := reply.Nested[0].(*Command)
+	assertEquals(t, CommandExecuting, c.Status)
+	if c.SessionId == "" || c.Form.Field("name") == nil {
+		t.Fatalf("bad first stage %+v", c)
+	}
+	form := c.Form.Submit()
+	form.Set("name", "Al")
+	// Nobody else may continue the session.
+	reply = ask("me@b.c/laptop", "set", &Command{Node: "greet",
+		SessionId: c.SessionId, Action: CommandComplete, Form: form})
+	assertEquals(t, "error", reply.Type)
+	reply = ask("me@b.c/phone", "set", &Command{Node: "greet",
+		SessionId: c.SessionId, Action: CommandComplete, Form: form})
+	c = reply.Nested[0].(*Command)
+	assertEquals(t, CommandCompleted, c.Status)
+	assertEquals(t, "Hello Al", c.Notes[0].Text)
+	assertEquals(t, "greet", c.Node)
+
+	reply = ask("x@b.c/d", "set", &Command{Node: "greet"})
+	assertEquals(t, "error", reply.Type)
+	reply = ask("x@b.c/d", "set", &Command{Node: "open"})
+	assertEquals(t, CommandCompleted, reply.Nested[0].(*Command).Status)
+	reply = ask("x@b.c/d", "set", &Command{Node: "none"})
+	assertEquals(t, "error", reply.Type)
+
+	// Disco queries for other nodes pass through.
+	recvIn <- &Iq{Header: Header{Type: "get", Nested: []interface{}{
+		&DiscoItems{}}}}
+	<-recvOut
+}
+
+func TestExecuteCommand(t *testing.T) {
+	send := make(chan Stanza, 1)
+	cl := &Client{handlers: make(chan *callback, 1), Send: send}
+	asked := make(chan *Command, 1)
+	replies := make(chan *Command, 1)
+	go func() {
+		for {
+			h := <-cl.handlers
+			iq := (<-send).(*Iq)
+			asked <- iq.Nested[0].(*Command)
+			h.f(&Iq{Header: Header{Id: iq.Id, Type: "result",
+				Nested: []interface{}{<-replies}}})
+		}
+	}()
+	ctx := context.Background()
+
+	form := &forms.Form{Type: forms.TypeForm, Fields: []forms.Field{{Var: "n",
+		Label: "Number"}}}
+	replies <- &Command{Node: "add", SessionId: "s1",
+		Status: CommandExecuting, Form: form}
+	s, err := cl.ExecuteCommand(ctx, "svc", "add")
+	if err != nil {
+		t.Fatalf("ExecuteCommand: %v", err)
+	}
+	req := <-asked
+	assertEquals(t, CommandExecute, req.Action)
+	if !s.Executing() || s.Id != "s1" || s.Form == nil {
+		t.Fatalf("session %+v", s)
+	}
+
+	s.Form.Set("n", "2")
+	replies <- &Command{Node: "add", SessionId: "s1",
+		Status: CommandCompleted}
+	if err := s.Complete(ctx, s.Form); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	req = <-asked
+	assertEquals(t, "s1", req.SessionId)
+	assertEquals(t, CommandComplete, req.Action)
+	assertEquals(t, forms.TypeSubmit, req.Form.Type)
+	assertEquals(t, "2", req.Form.Value("n"))
+	if s.Executing() {
+		t.Errorf("still executing")
+	}
+}
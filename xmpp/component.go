@@ -0,0 +1,220 @@
+package xmpp
+
+// This file contains the external component protocol, XEP-0114, with
+// which a service such as a gateway attaches to a server and handles
+// the stanzas for a whole subdomain.
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const NsComponent = "jabber:component:accept"
+
+// The component's proof that it knows the secret, and the server's
+// empty answer if it does.
+type handshake struct {
+	XMLName xml.Name
+	Digest  string `xml:",chardata"`
+}
+
+// Connects to a server as an external component, which handles
+// stanzas for the domain of jid, and authenticates with the secret
+// shared with the server. Components don't have rosters or presence
+// of their own, and they're responsible for addressing what they
+// send; stanzas with no from address are sent from the component's
+// domain. Stream management and reconnection aren't used. Otherwise,
+// the returned Client is used like any other.
+func NewComponent(jid *JID, secret string, exts []Extension,
+	status chan<- Status, host string, port int) (*Client, error) {
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	return NewComponentFromConn(conn, jid, secret, exts, status)
+}
+
+// Like NewComponent, but over a connection which has already been
+// established.
+func NewComponentFromConn(conn net.Conn, jid *JID, secret string,
+	exts []Extension, status chan<- Status) (*Client, error) {
+
+	caps := newCapsCache()
+	exts = append(exts, caps.Extension)
+	exts = append(exts, newPingResponder().Extension)
+	cl := newBareClient(jid, secret, status)
+	cl.component = true
+	cl.caps = caps
+	cl.opts = newOptions(exts)
+	exts = append(exts, newInfoResponder(&cl.opts).Extension)
+	info := ownDiscoInfo(exts, cl.opts.identities)
+	disco := newDiscoResponder(info, caps.advertise(info))
+	exts = append(exts, disco.Extension)
+	cl.disco = disco
+	// This goes last, so it sees what the other extensions send.
+	exts = append(exts, Extension{SendFilter: cl.componentFilter})
+
+	if err := cl.startStream(conn, exts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	cl.sendRaw <- &stream{To: jid.Domain(), ns: NsComponent}
+	if err := cl.statmgr.awaitStatus(StatusRunning); err != nil {
+		return nil, cl.getError(err)
+	}
+	cl.password = ""
+
+	for _, ext := range exts {
+		if ext.Start != nil {
+			go ext.Start(cl)
+		}
+	}
+	return cl, cl.getError(nil)
+}
+
+// Answers the server's stream header with the handshake, the SHA-1
+// of the stream id and the secret.
+func (cl *Client) startHandshake(st *stream) {
+	if st.Id == "" {
+		cl.setError(fmt.Errorf("component stream has no id"))
+		return
+	}
+	digest := sha1.Sum([]byte(st.Id + cl.password))
+	cl.sendRaw <- &handshake{XMLName: xml.Name{Space: NsComponent,
+		Local: "handshake"}, Digest: hex.EncodeToString(digest[:])}
+}
+
+// The server answers a good handshake with an empty one, and a bad
+// one with a stream error. There's no binding or session to wait for,
+// and the server routes stanzas to the component right away, so it's
+// running as soon as it's authenticated.
+func (cl *Client) handleHandshake(*handshake) {
+	cl.setStatus(StatusRunning)
+}
+
+// Fills in the from address of what the component sends.
+func (cl *Client) componentFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for st := range in {
+		if h := st.GetHeader(); h.From == "" {
+			h.From = cl.Jid
+		}
+		out <- st
+	}
+}
+
+// Writes a stanza marshaled in the client namespace, in the component
+// namespace instead. Only the stanza's own namespace changes; what it carries, such as a forwarded message,
+// stays in the client namespace.
+func writeComponent(w io.Writer, buf []byte) error {
+	i := bytes.Index(buf, clientXmlns)
+	if i < 0 {
+		_, err := w.Write(buf)
+		return err
+	}
+	if _, err := w.Write(buf[:i]); err != nil {
+		return err
+	}
+	if _, err := w.Write(componentXmlns); err != nil {
+		return err
+	}
+	_, err := w.Write(buf[i+len(clientXmlns):])
+	return err
+}
+
+var (
+	clientXmlns    = []byte(`xmlns="` + NsClient + `"`)
+	componentXmlns = []byte(`xmlns="` + NsComponent + `"`)
+)
+
+// Reads a component stream, declaring the client namespace wherever
+// the component namespace is declared, so that stanzas parse the same
+// way as in a client's stream. Only xmlns attributes are touched.
+type componentReader struct {
+	r   io.Reader
+	buf []byte
+	out []byte
+	err error
+	// Where the reader is: inside a tag, and inside a quoted
+	// attribute value.
+	inTag   bool
+	quote   byte
+	afterWs bool
+	name    []byte
+	// The value of an xmlns attribute, held back until it's
+	// complete.
+	xmlns bool
+	value []byte
+}
+
+func newComponentReader(r io.Reader) *componentReader {
+	return &componentReader{r: r, buf: make([]byte, 4096)}
+}
+
+func (cr *componentReader) Read(p []byte) (int, error) {
+	for len(cr.out) == 0 && cr.err == nil {
+		n, err := cr.r.Read(cr.buf)
+		cr.rewrite(cr.buf[:n])
+		cr.err = err
+	}
+	if len(cr.out) == 0 {
+		return 0, cr.err
+	}
+	n := copy(p, cr.out)
+	cr.out = cr.out[n:]
+	return n, nil
+}
+
+func (cr *componentReader) rewrite(b []byte) {
+	for _, c := range b {
+		switch {
+		case cr.quote != 0 && c == cr.quote:
+			if cr.xmlns {
+				if string(cr.value) == NsComponent {
+					cr.value = []byte(NsClient)
+				}
+				cr.out = append(cr.out, cr.value...)
+				cr.value = cr.value[:0]
+			}
+			cr.quote = 0
+			cr.afterWs = true
+			cr.out = append(cr.out, c)
+		case cr.quote != 0 && cr.xmlns:
+			cr.value = append(cr.value, c)
+		case cr.quote != 0:
+			cr.out = append(cr.out, c)
+		case cr.inTag:
+			switch c {
+			case '"', '\'':
+				cr.quote = c
+				cr.xmlns = string(cr.name) == "xmlns"
+			case '>':
+				cr.inTag = false
+			case ' ', '\t', '\r', '\n':
+				cr.afterWs = true
+			case '=':
+			default:
+				if cr.afterWs {
+					cr.name = cr.name[:0]
+					cr.afterWs = false
+				}
+				cr.name = append(cr.name, c)
+			}
+			cr.out = append(cr.out, c)
+		default:
+			if c == '<' {
+				cr.inTag = true
+				cr.name = cr.name[:0]
+				cr.afterWs = false
+			}
+			cr.out = append(cr.out, c)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package xmpp
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// Plays the server's side of a component stream, with the given
+// secret, and reports the stanzas the component sends.
+func fakeComponentServer(t *testing.T, conn net.Conn, secret string,
+	stanzas chan<- string) {
+
+	defer close(stanzas)
+	dec := xml.NewDecoder(conn)
+	write := func(s string) {
+		if _, err := io.WriteString(conn, s); err != nil {
+			t.Errorf("server write: %v", err)
+		}
+	}
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return
+		}
+		if ee, ok := tok.(xml.EndElement); ok && ee.Name.Local == "stream" {
+			write(`</stream:stream>`)
+			conn.Close()
+			return
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if se.Name.Local == "stream" {
+			for _, a := range se.Attr {
+				if a.Name.Local == "xmlns" {
+					assertEquals(t, NsComponent, a.Value)
+				}
+			}
+			write(`<stream:stream xmlns:stream="` + NsStream +
+				`" xmlns='` + NsComponent + `' from="gw.b.c" id="s1">`)
+			continue
+		}
+		var el struct {
+			From   string `xml:"from,attr"`
+			Digest string `xml:",chardata"`
+			Inner  string `xml:",innerxml"`
+		}
+		if err := dec.DecodeElement(&el, &se); err != nil {
+			return
+		}
+		if se.Name.Local == "handshake" {
+			digest := sha1.Sum([]byte("s1" + secret))
+			if el.Digest != hex.EncodeToString(digest[:]) {
+				write(`<stream:error><not-authorized xmlns="` +
+					NsStreams + `"/></stream:error>`)
+				return
+			}
+			write(`<handshake/>`)
+			write(`<message from="al@b.c/x" to="bot@gw.b.c">` +
+				`<body>hi</body></message>`)
+			continue
+		}
+		stanzas <- se.Name.Space + " " + se.Name.Local + " " + el.From +
+			" " + el.Inner
+	}
+}
+
+func TestComponent(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	stanzas := make(chan string, 10)
+	go fakeComponentServer(t, sconn, "sesame", stanzas)
+
+	jid := JID("gw.b.c")
+	cl, err := NewComponentFromConn(cconn, &jid, "sesame", nil, nil)
+	if err != nil {
+		t.Fatalf("NewComponentFromConn: %v", err)
+	}
+	defer cl.Close()
+	var m *Message
+	select {
+	case st := <-cl.Recv:
+		m = st.(*Message)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message sent after the handshake never arrived")
+	}
+	assertEquals(t, "al@b.c/x", string(m.From))
+	assertEquals(t, "hi", firstText(m.Body))
+
+	cl.Send <- &Message{Header: Header{To: "al@b.c/x"},
+		Body: []Text{{Chardata: "yo"}}}
+	select {
+	case s := <-stanzas:
+		assertEquals(t, NsComponent+` message gw.b.c <body xmlns="`+
+			NsClient+`">yo</body>`, s)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server never got the component's message")
+	}
+}
+
+func TestComponentBadSecret(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	go fakeComponentServer(t, sconn, "sesame", make(chan string, 10))
+
+	jid := JID("gw.b.c")
+	if _, err := NewComponentFromConn(cconn, &jid, "open", nil,
+		nil); err == nil {
+		t.Error("authenticated with the wrong secret")
+	}
+}
+
+func TestComponentReader(t *testing.T) {
+	in := `<stream:stream xmlns='` + NsComponent + `' id="x">` +
+		`<message xmlns = "` + NsComponent + `" a="` + NsComponent +
+		`">xmlns="` + NsComponent + `"</message>`
+	want := strings.Replace(in, `xmlns='`+NsComponent, `xmlns='`+NsClient, 1)
+	want = strings.Replace(want, `xmlns = "`+NsComponent,
+		`xmlns = "`+NsClient, 1)
+	var buf bytes.Buffer
+	_, err := io.Copy(&buf, newComponentReader(
+		iotest.OneByteReader(strings.NewReader(in))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, want, buf.String())
+}
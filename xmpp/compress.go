@@ -0,0 +1,203 @@
+package xmpp
+
+// This file contains stream compression, XEP-0138. Once the client
+// has authenticated, the rest of the stream may be compressed with
+// zlib, which saves a lot of bandwidth on chatty connections.
+
+import (
+	"compress/zlib"
+	"crypto/tls"
+	"encoding/xml"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	NsCompress        = "http://jabber.org/protocol/compress"
+	NsCompressFeature = "http://jabber.org/features/compress"
+)
+
+// Passing CompressionExt to NewClient among the extensions makes the
+// client compress the stream with zlib, if the server offers it.
+// Compression is negotiated after authentication, as recommended,
+// since compressing secrets before encryption can leak them. If the
+// server refuses, the stream carries on uncompressed.
+var CompressionExt = Extension{option: func(o *options) {
+	o.compress = true
+}}
+
+// The compression methods offered in the stream features.
+type compressionFeature struct {
+	Methods []string `xml:"method"`
+}
+
+// A request to compress the stream, or the server's answer.
+type compress struct {
+	XMLName xml.Name
+	Method  string `xml:"method,omitempty"`
+	Any     *Generic
+}
+
+func (cf *compressionFeature) offers(method string) bool {
+	for _, m := range cf.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Asks to compress the stream, if the client wants to and the server
+// offers zlib. Returns false if the client should carry on without.
+// There's no need to check for TLS compression, which would make this
+// redundant, since crypto/tls never negotiates it.
+func (cl *Client) startCompression(fe *Features) bool {
+	if !cl.opts.compress || cl.compressTried || fe.Compression == nil ||
+		!fe.Compression.offers("zlib") {
+		return false
+	}
+	cl.compressTried = true
+	cl.sendRaw <- &compress{XMLName: xml.Name{Space: NsCompress,
+		Local: "compress"}, Method: "zlib"}
+	return true
+}
+
+func (cl *Client) handleCompress(c *compress) {
+	if c.XMLName.Local == "failure" {
+		// Carry on uncompressed.
+		cl.handleFeatures(cl.Features)
+		return
+	}
+	cl.layer1.compress()
+	cl.Features = nil
+	cl.sendRaw <- cl.streamHeader()
+}
+
+func (l1 *layer1) compress() {
+	l1.setSock(newCompressConn(l1.current()))
+}
+
+// A connection which compresses what's written and decompresses
+// what's read. Decompression runs in a goroutine of its own, since a
+// zlib reader can't carry on after a read times out.
+type compressConn struct {
+	net.Conn
+	wlock sync.Mutex
+	w     *zlib.Writer
+	data  chan []byte
+	// Why decompression stopped, once data is closed.
+	err      error
+	buf      []byte
+	lock     sync.Mutex
+	deadline time.Time
+	start    sync.Once
+	close    sync.Once
+	done     chan struct{}
+}
+
+func newCompressConn(conn net.Conn) *compressConn {
+	return &compressConn{Conn: conn, w: zlib.NewWriter(conn),
+		data: make(chan []byte), done: make(chan struct{})}
+}
+
+func (cc *compressConn) inflate() {
+	defer close(cc.data)
+	r, err := zlib.NewReader(cc.Conn)
+	if err != nil {
+		cc.err = err
+		return
+	}
+	for {
+		p := make([]byte, 4096)
+		n, err := r.Read(p)
+		if n > 0 {
+			select {
+			case cc.data <- p[:n]:
+			case <-cc.done:
+				return
+			}
+		}
+		if err != nil {
+			cc.err = err
+			return
+		}
+	}
+}
+
+func (cc *compressConn) Read(p []byte) (int, error) {
+	// Until the first read, the connection underneath may still be
+	// read by whoever used it before.
+	cc.start.Do(func() {
+		cc.Conn.SetReadDeadline(time.Time{})
+		go cc.inflate()
+	})
+	if len(cc.buf) == 0 {
+		cc.lock.Lock()
+		deadline := cc.deadline
+		cc.lock.Unlock()
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			t := time.NewTimer(time.Until(deadline))
+			defer t.Stop()
+			timeout = t.C
+		}
+		select {
+		case b, ok := <-cc.data:
+			if !ok {
+				return 0, cc.err
+			}
+			cc.buf = b
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(p, cc.buf)
+	cc.buf = cc.buf[n:]
+	return n, nil
+}
+
+func (cc *compressConn) Write(p []byte) (int, error) {
+	cc.wlock.Lock()
+	defer cc.wlock.Unlock()
+	if _, err := cc.w.Write(p); err != nil {
+		return 0, err
+	}
+	if err := cc.w.Flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (cc *compressConn) Close() error {
+	cc.close.Do(func() { close(cc.done) })
+	return cc.Conn.Close()
+}
+
+func (cc *compressConn) SetDeadline(t time.Time) error {
+	cc.SetReadDeadline(t)
+	return cc.Conn.SetWriteDeadline(t)
+}
+
+// Only applies to reads of decompressed data; the connection
+// underneath is read without a deadline.
+func (cc *compressConn) SetReadDeadline(t time.Time) error {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	cc.deadline = t
+	return nil
+}
+
+// Reports the TLS state of the connection underneath, if any.
+func (cc *compressConn) ConnectionState() tls.ConnectionState {
+	if c, ok := cc.Conn.(interface {
+		ConnectionState() tls.ConnectionState
+	}); ok {
+		return c.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+var _ io.ReadWriteCloser = &compressConn{}
@@ -0,0 +1,58 @@
+package xmpp
+
+// This file contains support for last message correction, XEP-0308.
+
+import (
+	"encoding/xml"
+	"reflect"
+)
+
+const NsCorrection = "urn:xmpp:message-correct:0"
+
+// Marks a message as a correction of the earlier message with the
+// given id.
+type Replace struct {
+	XMLName xml.Name `xml:"urn:xmpp:message-correct:0 replace"`
+	Id      string   `xml:"id,attr"`
+}
+
+// CorrectionExt may be included in the extensions passed to
+// NewClient to decode corrections in incoming messages.
+var CorrectionExt Extension = Extension{}
+
+func init() {
+	CorrectionExt.Features = []string{NsCorrection}
+	CorrectionExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	rName := xml.Name{Space: NsCorrection, Local: "replace"}
+	CorrectionExt.StanzaTypes[rName] = reflect.TypeOf(Replace{})
+}
+
+// If the message is a correction, returns the id of the message it
+// replaces.
+func (m *Message) Replaces() (string, bool) {
+	for _, ele := range m.Nested {
+		switch r := ele.(type) {
+		case *Replace:
+			return r.Id, true
+		case Replace:
+			return r.Id, true
+		}
+	}
+	return "", false
+}
+
+// Returns a message which corrects the earlier message with the
+// given id, replacing its body. Send it to the same recipient, with
+// the same type, as the original.
+func NewCorrection(to JID, typ, id, body string) *Message {
+	return &Message{Header: Header{To: to, Type: typ, Id: NextId(),
+		Nested: []interface{}{&Replace{Id: id}}},
+		Body: []Text{{Chardata: body}}}
+}
+
+// Does this message correct the given earlier one? Only its sender
+// may correct a message, so both must come from the same full JID.
+func (m *Message) Corrects(orig *Message) bool {
+	id, ok := m.Replaces()
+	return ok && id != "" && id == orig.Id && m.From == orig.From
+}
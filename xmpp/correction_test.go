@@ -0,0 +1,40 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestCorrection(t *testing.T) {
+	c := NewCorrection("a@b.c", "chat", "m1", "fixed")
+	buf, err := xml.Marshal(c)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	assertEquals(t, `<message xmlns="jabber:client" to="a@b.c" id="`+c.Id+
+		`" type="chat"><replace xmlns="`+NsCorrection+`" id="m1">`+
+		`</replace><body xmlns="jabber:client">fixed</body></message>`,
+		string(buf))
+
+	var m Message
+	str := `<message xmlns="jabber:client" from="a@b.c/d" id="m2">` +
+		`<body>fixed</body><replace xmlns="` + NsCorrection +
+		`" id="m1"/></message>`
+	if err := xml.Unmarshal([]byte(str), &m); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if err := parseExtended(&m.Header, CorrectionExt.StanzaTypes); err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	if id, ok := m.Replaces(); !ok || id != "m1" {
+		t.Errorf("Replaces: %q %v", id, ok)
+	}
+	orig := &Message{Header: Header{From: "a@b.c/d", Id: "m1"}}
+	if !m.Corrects(orig) {
+		t.Error("doesn't correct the original")
+	}
+	orig.From = "a@b.c/e"
+	if m.Corrects(orig) {
+		t.Error("corrects another resource's message")
+	}
+}
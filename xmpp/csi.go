@@ -0,0 +1,46 @@
+package xmpp
+
+// This file contains Client State Indication, XEP-0352, which lets a
+// client tell the server when nobody is looking at it, so the server
+// can hold back or drop traffic which isn't urgent.
+
+import (
+	"encoding/xml"
+	"errors"
+)
+
+const NsCsi = "urn:xmpp:csi:0"
+
+// Tells the server the client is active or inactive.
+type csiState struct {
+	XMLName xml.Name
+}
+
+var errNoCsi = errors.New("server doesn't support client state indication")
+
+// Tells the server the user is using the client again, so it should
+// send everything straight away. Clients start out active.
+func (cl *Client) SetActive() error {
+	return cl.sendCsi("active")
+}
+
+// Tells the server the user isn't using the client, for instance
+// because it's in the background. The server may then hold back
+// presence and other traffic which isn't urgent until the client is
+// active again. The server forgets this if the client reconnects
+// without resuming the stream, unless ReconnectExt tells it again.
+func (cl *Client) SetInactive() error {
+	return cl.sendCsi("inactive")
+}
+
+func (cl *Client) sendCsi(state string) error {
+	if cl.Features == nil || cl.Features.Csi == nil {
+		return errNoCsi
+	}
+	if !cl.trySendRaw(&csiState{XMLName: xml.Name{Space: NsCsi,
+		Local: state}}) {
+		return errSessionEnded
+	}
+	cl.rc.setInactive(state == "inactive")
+	return nil
+}
@@ -0,0 +1,43 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestCsi(t *testing.T) {
+	sendRaw := make(chan interface{}, 1)
+	cl := &Client{sendRaw: sendRaw, Features: &Features{}}
+	if err := cl.SetInactive(); err != errNoCsi {
+		t.Errorf("without server support: %v", err)
+	}
+
+	cl.Features.Csi = &Generic{}
+	if err := cl.SetInactive(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := xml.Marshal(<-sendRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, `<inactive xmlns="urn:xmpp:csi:0"></inactive>`, string(b))
+	if err := cl.SetActive(); err != nil {
+		t.Fatal(err)
+	}
+	b, err = xml.Marshal(<-sendRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, `<active xmlns="urn:xmpp:csi:0"></active>`, string(b))
+}
+
+func TestCsiFeature(t *testing.T) {
+	var fe Features
+	err := xml.Unmarshal([]byte(`<features><csi xmlns="urn:xmpp:csi:0"/></features>`), &fe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fe.Csi == nil {
+		t.Error("csi feature not parsed")
+	}
+}
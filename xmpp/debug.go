@@ -0,0 +1,135 @@
+package xmpp
+
+// This file contains a pretty-printer for the XML traffic logged when
+// Debug is set.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// If Debug and DebugPretty are both set, the XML is logged one
+// stanza at a time, indented and colorized, with a timestamp and an
+// arrow showing its direction, rather than in the raw chunks read
+// from and written to the socket.
+var DebugPretty = false
+
+const (
+	ansiReset = "\x1b[0m"
+	ansiDim   = "\x1b[2m"
+	ansiSend  = "\x1b[32m"
+	ansiRecv  = "\x1b[36m"
+)
+
+// Formats one direction of the stream. The bytes written to it
+// needn't be aligned with elements; incomplete tags are kept until
+// the rest arrive.
+type debugTap struct {
+	arrow, color string
+	out          io.Writer
+	now          func() time.Time
+	pending      []byte
+	depth        int
+	block        bytes.Buffer
+}
+
+func newDebugTap(send bool) *debugTap {
+	t := &debugTap{arrow: "<<", color: ansiRecv, now: time.Now}
+	if send {
+		t.arrow, t.color = ">>", ansiSend
+	}
+	return t
+}
+
+func (t *debugTap) Write(p []byte) (int, error) {
+	t.pending = append(t.pending, p...)
+	for t.next() {
+	}
+	return len(p), nil
+}
+
+// Consumes one tag or run of text from the pending bytes, if it's
+// complete. Returns false if more bytes are needed.
+func (t *debugTap) next() bool {
+	if len(t.pending) == 0 {
+		return false
+	}
+	if t.pending[0] != '<' {
+		n := bytes.IndexByte(t.pending, '<')
+		if n < 0 {
+			return false
+		}
+		text := strings.TrimSpace(string(t.pending[:n]))
+		t.pending = t.pending[n:]
+		if text != "" {
+			t.line(text)
+		}
+		return true
+	}
+	n := tagEnd(t.pending)
+	if n < 0 {
+		return false
+	}
+	tag := string(t.pending[:n])
+	t.pending = t.pending[n:]
+	closing := strings.HasPrefix(tag, "</")
+	if closing {
+		t.depth--
+	}
+	t.line(t.color + tag + ansiReset)
+	// The stream's root element stays open, so it's a block of its
+	// own.
+	if !closing && !strings.HasPrefix(tag, "<?") &&
+		!strings.HasPrefix(tag, "<!") && !strings.HasSuffix(tag, "/>") &&
+		!strings.HasPrefix(tag, "<stream:stream") {
+		t.depth++
+	}
+	if t.depth <= 0 {
+		t.depth = 0
+		t.flush()
+	}
+	return true
+}
+
+// Returns the length of the tag at the start of b, or -1 if it isn't
+// complete. A > inside a quoted attribute value doesn't end the tag.
+func tagEnd(b []byte) int {
+	var quote byte
+	for i, c := range b {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i + 1
+		}
+	}
+	return -1
+}
+
+func (t *debugTap) line(s string) {
+	t.block.WriteString(strings.Repeat("  ", t.depth+1))
+	t.block.WriteString(s)
+	t.block.WriteByte('\n')
+}
+
+func (t *debugTap) flush() {
+	if t.block.Len() == 0 {
+		return
+	}
+	out := t.out
+	if out == nil {
+		out = log.Writer()
+	}
+	stamp := t.now().Format("15:04:05.000")
+	fmt.Fprintf(out, "%s%s%s %s\n%s", ansiDim, stamp, ansiReset, t.arrow,
+		t.block.String())
+	t.block.Reset()
+}
@@ -0,0 +1,39 @@
+package xmpp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebugTap(t *testing.T) {
+	var out bytes.Buffer
+	tap := newDebugTap(true)
+	tap.out = &out
+	tap.now = func() time.Time {
+		return time.Date(2012, 1, 2, 3, 4, 5, 6e6, time.UTC)
+	}
+	// Split in awkward places, including inside an attribute
+	// containing >.
+	for _, chunk := range []string{`<stream:stream to="a">`,
+		`<message to="a>b"`, `><bo`, `dy>hi</body></mess`,
+		`age> <presence/>`} {
+		tap.Write([]byte(chunk))
+	}
+	g := func(s string) string { return ansiSend + s + ansiReset }
+	stamp := ansiDim + "03:04:05.006" + ansiReset + " >>\n"
+	exp := stamp + "  " + g(`<stream:stream to="a">`) + "\n" +
+		stamp + "  " + g(`<message to="a>b">`) + "\n" +
+		"    " + g(`<body>`) + "\n" +
+		"      hi\n" +
+		"    " + g(`</body>`) + "\n" +
+		"  " + g(`</message>`) + "\n" +
+		stamp + "  " + g(`<presence/>`) + "\n"
+	if out.String() != exp {
+		t.Errorf("Expected:\n%s\nObserved:\n%s", exp, out.String())
+	}
+	if !strings.HasPrefix(newDebugTap(false).arrow, "<") {
+		t.Errorf("wrong arrow for received traffic")
+	}
+}
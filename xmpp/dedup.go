@@ -0,0 +1,84 @@
+package xmpp
+
+// This file contains a filter which drops messages the client has
+// already received.
+
+import (
+	"container/list"
+)
+
+// DedupFilter is an extension which drops incoming messages which
+// are copies of ones already seen, as happens when the same message
+// arrives as a carbon, from an archive catch-up, and reflected by a
+// multi-user chat room. Messages are recognized by their origin id,
+// their stanza ids, or failing those their sender and id. Only the
+// most recent messages are remembered.
+type DedupFilter struct {
+	Extension
+	window int
+	seen   map[string]*list.Element
+	order  *list.List
+}
+
+// Creates a DedupFilter which remembers the ids of the last window
+// messages, to be passed to NewClient among the extensions.
+func NewDedupFilter(window int) *DedupFilter {
+	if window < 1 {
+		window = 1
+	}
+	df := &DedupFilter{window: window}
+	df.seen = make(map[string]*list.Element)
+	df.order = list.New()
+	df.StanzaTypes = StanzaIdExt.StanzaTypes
+	df.RecvFilter = df.recvFilter
+	return df
+}
+
+func (df *DedupFilter) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for stan := range in {
+		if m, ok := stan.(*Message); ok && m.Type != "error" &&
+			df.duplicate(m) {
+			continue
+		}
+		out <- stan
+	}
+}
+
+// The keys by which a message may be recognized.
+func dedupKeys(m *Message) []string {
+	var keys []string
+	if oid, ok := m.OriginId(); ok {
+		keys = append(keys, "o "+string(m.From.Bare())+" "+oid)
+	}
+	for by, sid := range m.StanzaIds() {
+		keys = append(keys, "s "+string(by.Bare())+" "+sid)
+	}
+	if len(keys) == 0 && m.Id != "" {
+		keys = append(keys, "i "+string(m.From)+" "+m.Id)
+	}
+	return keys
+}
+
+// Reports whether the message has been seen, and remembers it.
+func (df *DedupFilter) duplicate(m *Message) bool {
+	keys := dedupKeys(m)
+	dup := false
+	for _, k := range keys {
+		if e := df.seen[k]; e != nil {
+			dup = true
+			df.order.MoveToFront(e)
+		}
+	}
+	for _, k := range keys {
+		if df.seen[k] == nil {
+			df.seen[k] = df.order.PushFront(k)
+		}
+	}
+	for df.order.Len() > df.window {
+		e := df.order.Back()
+		df.order.Remove(e)
+		delete(df.seen, e.Value.(string))
+	}
+	return dup
+}
@@ -0,0 +1,35 @@
+package xmpp
+
+import (
+	"testing"
+)
+
+func TestDedupFilter(t *testing.T) {
+	df := NewDedupFilter(3)
+	msg := func(from, id string, nested ...interface{}) *Message {
+		return &Message{Header: Header{From: JID(from), Id: id,
+			Nested: nested}}
+	}
+	check := func(m *Message, exp bool) {
+		if dup := df.duplicate(m); dup != exp {
+			t.Errorf("duplicate(%v) = %v", m, dup)
+		}
+	}
+
+	// The same message, as a carbon and reflected by a room.
+	check(msg("a@b/c", "1", &OriginId{Id: "o1"}), false)
+	check(msg("a@b/d", "2", &OriginId{Id: "o1"},
+		&StanzaId{Id: "s1", By: "a@b"}), true)
+	// Caught up from the archive: known by its stanza id.
+	check(msg("a@b/c", "", &StanzaId{Id: "s1", By: "a@b"}), true)
+	// Without stanza or origin ids, sender and id decide.
+	check(msg("x@y/z", "m"), false)
+	check(msg("x@y/z", "m"), true)
+	check(msg("x@y/w", "m"), false)
+
+	// Only the last few are remembered.
+	check(msg("p@q/r", "1"), false)
+	check(msg("p@q/r", "2"), false)
+	check(msg("p@q/r", "3"), false)
+	check(msg("x@y/z", "m"), false)
+}
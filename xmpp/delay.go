@@ -0,0 +1,48 @@
+package xmpp
+
+// This file contains support for delayed delivery, XEP-0203, which
+// marks stanzas that were stored or held before being delivered.
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+const NsDelay = "urn:xmpp:delay"
+
+// Says when, and by whom, a stanza was originally sent or stored.
+type Delay struct {
+	XMLName xml.Name `xml:"urn:xmpp:delay delay"`
+	// The entity which delayed the stanza, such as the server which
+	// stored it.
+	From JID
+	// The time the stanza was originally sent. It's zero if the
+	// stamp couldn't be parsed.
+	Stamp  time.Time
+	Reason string
+}
+
+// The wire form of Delay.
+type delayXml struct {
+	XMLName xml.Name `xml:"urn:xmpp:delay delay"`
+	From    JID      `xml:"from,attr,omitempty"`
+	Stamp   string   `xml:"stamp,attr"`
+	Reason  string   `xml:",chardata"`
+}
+
+func (d *Delay) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.Encode(&delayXml{From: d.From, Reason: d.Reason,
+		Stamp: d.Stamp.UTC().Format(time.RFC3339Nano)})
+}
+
+// A malformed stamp is ignored rather than treated as an error,
+// since it would otherwise make the whole stanza unreadable.
+func (d *Delay) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	var dx delayXml
+	if err := dec.DecodeElement(&dx, &start); err != nil {
+		return err
+	}
+	*d = Delay{XMLName: dx.XMLName, From: dx.From, Reason: dx.Reason}
+	d.Stamp, _ = time.Parse(time.RFC3339Nano, dx.Stamp)
+	return nil
+}
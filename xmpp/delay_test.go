@@ -0,0 +1,44 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	str := `<message xmlns="jabber:client" from="a@b/c"><body>hi</body>` +
+		`<delay xmlns="` + NsDelay + `" from="b" ` +
+		`stamp="2002-09-10T23:08:25.5+02:00">Offline</delay></message>`
+	var m Message
+	if err := xml.Unmarshal([]byte(str), &m); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if m.Delay == nil {
+		t.Fatal("no delay")
+	}
+	want := time.Date(2002, 9, 10, 21, 8, 25, 500000000, time.UTC)
+	if !m.Delay.Stamp.Equal(want) {
+		t.Errorf("stamp %v, want %v", m.Delay.Stamp, want)
+	}
+	assertEquals(t, "b", string(m.Delay.From))
+	assertEquals(t, "Offline", m.Delay.Reason)
+
+	buf, err := xml.Marshal(m.Delay)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	assertEquals(t, `<delay xmlns="`+NsDelay+`" from="b" `+
+		`stamp="2002-09-10T21:08:25.5Z">Offline</delay>`, string(buf))
+
+	// A bad stamp doesn't spoil the stanza.
+	str = `<presence xmlns="jabber:client" from="a@b/c"><delay xmlns="` +
+		NsDelay + `" stamp="yesterday"/></presence>`
+	var p Presence
+	if err := xml.Unmarshal([]byte(str), &p); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if p.Delay == nil || !p.Delay.Stamp.IsZero() {
+		t.Errorf("delay %+v", p.Delay)
+	}
+}
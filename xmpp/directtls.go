@@ -0,0 +1,214 @@
+package xmpp
+
+// This file contains direct TLS connections, where TLS starts as soon
+// as the socket is connected instead of after STARTTLS. XEP-0368.
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+)
+
+// Chooses between direct TLS endpoints and ones which use STARTTLS
+// when NewClient connects.
+type DirectTlsMode int
+
+const (
+	// Use direct TLS endpoints when the domain advertises them in
+	// _xmpps-client._tcp SRV records, and STARTTLS endpoints
+	// otherwise. Endpoints of both kinds are tried in order of
+	// priority, and direct TLS is preferred between endpoints of
+	// the same priority.
+	DirectTlsAuto DirectTlsMode = iota
+	// Only use direct TLS. If the domain has no _xmpps-client._tcp
+	// records, the domain itself is tried on port 5223.
+	DirectTlsOnly
+	// Only use STARTTLS.
+	DirectTlsNever
+)
+
+// ALPN protocol name for direct TLS connections.
+const directTlsProto = "xmpp-client"
+
+// Returns an extension which sets how NewClient and
+// NewClientWithFailover's DirectTlsTransport choose between direct
+// TLS and STARTTLS. Without it, DirectTlsAuto is used by NewClient.
+func DirectTlsExt(mode DirectTlsMode) Extension {
+	return Extension{option: func(o *options) {
+		o.directTls = mode
+	}}
+}
+
+// Returns a Transport which connects to the servers listed in the
+// domain's _xmpps-client._tcp SRV records, or port 5223 of the
+// domain if there are none, and starts TLS immediately with tlsconf.
+func DirectTlsTransport(tlsconf *tls.Config) Transport {
+	return Transport{Name: "directtls",
+		Dial: func(ctx context.Context, domain string) (net.Conn, error) {
+			return dialDomain(ctx, nil, domain, tlsconf,
+				DirectTlsOnly)
+		}}
+}
+
+// An address to connect to, and whether it expects TLS right away.
+type endpoint struct {
+	addr      string
+	directTls bool
+	priority  uint16
+	// Set for the domain itself, tried since it has no SRV records.
+	fallback bool
+}
+
+// Connects to whichever of the domain's endpoints answers first,
+// trying them in order but without waiting long for each. Connections
+// to direct TLS endpoints are returned once the TLS handshake is done.
+// If the options have a Dialer, it makes the connections, and
+// resolves the hosts itself. With HostMetaExt, a domain without SRV
+// records is reached through its host-meta first. The options may be
+// nil.
+func dialDomain(ctx context.Context, o *options, domain string,
+	tlsconf *tls.Config, mode DirectTlsMode) (net.Conn, error) {
+
+	if o == nil {
+		o = &options{}
+	}
+	d := o.dialer
+	eps, err := clientEndpoints(ctx, o.srv, domain, mode)
+	if err != nil {
+		return nil, err
+	}
+	if o.hostMeta && len(eps) == 1 && eps[0].fallback {
+		conn, err := dialHostMeta(ctx, hostMetaHttp(d), domain, tlsconf)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	if d == nil {
+		if eps, err = resolveEndpoints(ctx, eps); err != nil {
+			return nil, err
+		}
+	}
+
+	return raceEndpoints(ctx, eps, func(ctx context.Context,
+		ep endpoint) (net.Conn, error) {
+
+		conn, err := dialWith(ctx, d, ep.addr)
+		if err != nil || !ep.directTls {
+			return conn, err
+		}
+		tlsConn := tls.Client(conn, directTlsConfig(tlsconf, domain))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	})
+}
+
+// The certificate has to be valid for the XMPP domain, not the host
+// named by the SRV record, and the server is told which protocol we
+// want with ALPN. XEP-0368, section 3.
+func directTlsConfig(tlsconf *tls.Config, domain string) *tls.Config {
+	var conf *tls.Config
+	if tlsconf == nil {
+		conf = &tls.Config{}
+	} else {
+		conf = tlsconf.Clone()
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = domain
+	}
+	if len(conf.NextProtos) == 0 {
+		conf.NextProtos = []string{directTlsProto}
+	}
+	return conf
+}
+
+// Returns the endpoints to try for a domain's client connections, in
+// order. The resolver orders SRV records by priority, and randomly by
+// weight within a priority, as RFC 2782 says. If the domain has no
+// records, the domain itself is tried on the standard port, as RFC
+// 6120 section 3.2.2 says. Lookups are cached in srv, if it isn't
+// nil.
+func clientEndpoints(ctx context.Context, srv *srvCache, domain string,
+	mode DirectTlsMode) ([]endpoint, error) {
+
+	var eps []endpoint
+	found := false
+	add := func(service string, directTls bool) error {
+		srvs, ok, err := srv.lookup(ctx, service, domain)
+		if err != nil {
+			return err
+		}
+		found = found || ok
+		for _, srv := range srvs {
+			eps = append(eps, endpoint{addr: net.JoinHostPort(
+				srv.Target, strconv.Itoa(int(srv.Port))),
+				directTls: directTls, priority: srv.Priority})
+		}
+		return nil
+	}
+
+	switch mode {
+	case DirectTlsOnly:
+		if err := add(directTlsSrv, true); err != nil {
+			return nil, err
+		}
+		if !found {
+			return []endpoint{{addr: net.JoinHostPort(domain,
+				"5223"), directTls: true, fallback: true}}, nil
+		}
+	case DirectTlsNever:
+		if err := add(clientSrv, false); err != nil {
+			return nil, err
+		}
+	default:
+		// Direct TLS is optional, so trouble looking it up
+		// isn't fatal.
+		add(directTlsSrv, true)
+		if err := add(clientSrv, false); err != nil {
+			return nil, err
+		}
+	}
+	if !found {
+		return []endpoint{{addr: net.JoinHostPort(domain, "5222"),
+			fallback: true}}, nil
+	}
+	if len(eps) == 0 {
+		return nil, fmt.Errorf("%s doesn't offer XMPP client service",
+			domain)
+	}
+
+	// Merge the two lists by priority. The direct TLS records are
+	// first, so they win ties.
+	sort.SliceStable(eps, func(i, j int) bool {
+		return eps[i].priority < eps[j].priority
+	})
+	return eps, nil
+}
+
+// Looks up one client SRV service. Found is false if the domain has
+// no records for it. A lone record with the target "." means the
+// service isn't offered, so it's found but yields no records.
+func lookupClientSrv(ctx context.Context, service,
+	domain string) (srvs []*net.SRV, found bool, err error) {
+
+	_, srvs, err = lookupSRV(ctx, service, "tcp", domain)
+	if dnsErr, ok := err.(*net.DNSError); (ok && dnsErr.IsNotFound) ||
+		(err == nil && len(srvs) == 0) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("LookupSrv %s: %v", domain, err)
+	}
+	if len(srvs) == 1 && (srvs[0].Target == "." || srvs[0].Target == "") {
+		return nil, true, nil
+	}
+	return srvs, true, nil
+}
@@ -0,0 +1,133 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Replaces lookupSRV with a table of records by service, until the
+// returned function is called.
+func fakeSRV(records map[string][]*net.SRV, errs map[string]error) func() {
+	saved := lookupSRV
+	lookupSRV = func(ctx context.Context, service, proto,
+		name string) (string, []*net.SRV, error) {
+		if err := errs[service]; err != nil {
+			return "", nil, err
+		}
+		if records[service] == nil {
+			return "", nil, &net.DNSError{Err: "no such host",
+				IsNotFound: true}
+		}
+		return "", records[service], nil
+	}
+	return func() { lookupSRV = saved }
+}
+
+func TestClientEndpoints(t *testing.T) {
+	records := map[string][]*net.SRV{}
+	errs := map[string]error{}
+	defer fakeSRV(records, errs)()
+	eps := func(mode DirectTlsMode) string {
+		a, err := clientEndpoints(context.Background(), nil,
+			"example.com", mode)
+		if err != nil {
+			return "error"
+		}
+		var s []string
+		for _, ep := range a {
+			if ep.directTls {
+				s = append(s, "tls:"+ep.addr)
+			} else {
+				s = append(s, ep.addr)
+			}
+		}
+		return strings.Join(s, " ")
+	}
+
+	records[clientSrv] = []*net.SRV{{Target: "a.example.net.", Port: 5222},
+		{Target: "b.example.net.", Port: 5333}}
+	assertEquals(t, "a.example.net.:5222 b.example.net.:5333",
+		eps(DirectTlsAuto))
+	// Without records, the domain itself is tried.
+	assertEquals(t, "tls:example.com:5223", eps(DirectTlsOnly))
+
+	// Direct TLS wins ties, but not over a better priority.
+	records[directTlsSrv] = []*net.SRV{{Target: "c.example.net.",
+		Port: 443, Priority: 0}, {Target: "d.example.net.",
+		Port: 5223, Priority: 10}}
+	records[clientSrv][1].Priority = 5
+	assertEquals(t, "tls:c.example.net.:443 a.example.net.:5222 "+
+		"b.example.net.:5333 tls:d.example.net.:5223",
+		eps(DirectTlsAuto))
+	assertEquals(t, "tls:c.example.net.:443 tls:d.example.net.:5223",
+		eps(DirectTlsOnly))
+	assertEquals(t, "a.example.net.:5222 b.example.net.:5333",
+		eps(DirectTlsNever))
+
+	// A failed direct TLS lookup only matters if it's required.
+	errs[directTlsSrv] = &net.DNSError{Err: "server misbehaving",
+		IsTemporary: true}
+	assertEquals(t, "a.example.net.:5222 b.example.net.:5333",
+		eps(DirectTlsAuto))
+	assertEquals(t, "error", eps(DirectTlsOnly))
+	delete(errs, directTlsSrv)
+
+	delete(records, directTlsSrv)
+	delete(records, clientSrv)
+	assertEquals(t, "example.com:5222", eps(DirectTlsAuto))
+	records[clientSrv] = []*net.SRV{}
+	assertEquals(t, "example.com:5222", eps(DirectTlsAuto))
+
+	records[clientSrv] = []*net.SRV{{Target: ".", Port: 0}}
+	assertEquals(t, "error", eps(DirectTlsAuto))
+	errs[clientSrv] = &net.DNSError{Err: "server misbehaving",
+		IsTemporary: true}
+	assertEquals(t, "error", eps(DirectTlsAuto))
+}
+
+func TestDialDirectTls(t *testing.T) {
+	// Borrow the test certificate, which is valid for example.com.
+	hs := httptest.NewTLSServer(nil)
+	defer hs.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(hs.Certificate())
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: hs.TLS.Certificates,
+		NextProtos:   []string{directTlsProto}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+		conn.Write([]byte("x"))
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+	defer fakeSRV(map[string][]*net.SRV{directTlsSrv: {{
+		Target: "127.0.0.1", Port: uint16(p)}}}, nil)()
+	conn, err := dialDomain(context.Background(), nil, "example.com",
+		&tls.Config{RootCAs: pool}, DirectTlsAuto)
+	if err != nil {
+		t.Fatalf("dialDomain: %v", err)
+	}
+	defer conn.Close()
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		t.Fatalf("got a %T, not a TLS connection", conn)
+	}
+	assertEquals(t, directTlsProto,
+		tlsConn.ConnectionState().NegotiatedProtocol)
+}
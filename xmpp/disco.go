@@ -0,0 +1,385 @@
+package xmpp
+
+// This file contains support for service discovery, XEP-0030.
+
+import (
+	"./forms"
+	"context"
+	"encoding/xml"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+const (
+	NsDiscoInfo  = "http://jabber.org/protocol/disco#info"
+	NsDiscoItems = "http://jabber.org/protocol/disco#items"
+)
+
+// A disco#info query or result, describing an entity's identities
+// and the features it supports.
+type DiscoInfo struct {
+	XMLName    xml.Name        `xml:"http://jabber.org/protocol/disco#info query"`
+	Node       string          `xml:"node,attr,omitempty"`
+	Identities []DiscoIdentity `xml:"identity"`
+	Features   []DiscoFeature  `xml:"feature"`
+	// Extended information, XEP-0128.
+	Forms []forms.Form `xml:"jabber:x:data x"`
+}
+
+type DiscoIdentity struct {
+	Category string `xml:"category,attr"`
+	Type     string `xml:"type,attr"`
+	Name     string `xml:"name,attr,omitempty"`
+	Lang     string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+}
+
+type DiscoFeature struct {
+	Var string `xml:"var,attr"`
+}
+
+// A disco#items query or result, listing the items associated with
+// an entity, such as the rooms of a multi-user chat service or the
+// nodes of a pubsub service.
+type DiscoItems struct {
+	XMLName xml.Name    `xml:"http://jabber.org/protocol/disco#items query"`
+	Node    string      `xml:"node,attr,omitempty"`
+	Items   []DiscoItem `xml:"item"`
+	Set     *RsmSet
+}
+
+type DiscoItem struct {
+	Jid  JID    `xml:"jid,attr"`
+	Node string `xml:"node,attr,omitempty"`
+	Name string `xml:"name,attr,omitempty"`
+}
+
+// DiscoExt may be included in the extensions passed to NewClient to
+// decode service discovery queries and results.
+var DiscoExt Extension = Extension{}
+
+func init() {
+	DiscoExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	dName := xml.Name{Space: NsDiscoInfo, Local: "query"}
+	DiscoExt.StanzaTypes[dName] = reflect.TypeOf(DiscoInfo{})
+	iName := xml.Name{Space: NsDiscoItems, Local: "query"}
+	DiscoExt.StanzaTypes[iName] = reflect.TypeOf(DiscoItems{})
+}
+
+// Does the entity advertise the given feature?
+func (di *DiscoInfo) HasFeature(v string) bool {
+	for _, f := range di.Features {
+		if f.Var == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Queries an entity's identities and features, optionally at a node.
+func (cl *Client) DiscoInfo(ctx context.Context, jid JID,
+	node string) (*DiscoInfo, error) {
+
+	iq := &Iq{Header: Header{To: jid, Type: "get",
+		Nested: []interface{}{&DiscoInfo{Node: node}}}}
+	reply, err := cl.SendIq(ctx, iq)
+	if err != nil {
+		return nil, err
+	}
+	for _, ele := range reply.Nested {
+		if di, ok := ele.(*DiscoInfo); ok {
+			return di, nil
+		}
+	}
+	return &DiscoInfo{}, nil
+}
+
+// Queries the items associated with an entity, optionally at a node.
+// Only the first page is returned if the result is paged; use
+// WalkDiscoItems to see them all.
+func (cl *Client) DiscoItems(ctx context.Context, jid JID,
+	node string) (*DiscoItems, error) {
+
+	iq := &Iq{Header: Header{To: jid, Type: "get",
+		Nested: []interface{}{&DiscoItems{Node: node}}}}
+	reply, err := cl.SendIq(ctx, iq)
+	if err != nil {
+		return nil, err
+	}
+	for _, ele := range reply.Nested {
+		if di, ok := ele.(*DiscoItems); ok {
+			return di, nil
+		}
+	}
+	return &DiscoItems{}, nil
+}
+
+// Returns an extension which sets the identity the client reports
+// in answer to disco#info queries. It may be given more than once
+// for several identities. The default is a client of type pc.
+func DiscoIdentityExt(id DiscoIdentity) Extension {
+	return Extension{option: func(o *options) {
+		o.identities = append(o.identities, id)
+	}}
+}
+
+// Describes the client, from its identities and the features
+// declared by its extensions.
+func ownDiscoInfo(exts []Extension, identities []DiscoIdentity) *DiscoInfo {
+	if len(identities) == 0 {
+		identities = []DiscoIdentity{{Category: "client", Type: "pc"}}
+	}
+	di := &DiscoInfo{Identities: identities}
+	seen := make(map[string]bool)
+	vars := []string{NsDiscoInfo}
+	for _, ext := range exts {
+		vars = append(vars, ext.Features...)
+	}
+	sort.Strings(vars)
+	for _, v := range vars {
+		if !seen[v] {
+			seen[v] = true
+			di.Features = append(di.Features, DiscoFeature{Var: v})
+		}
+	}
+	return di
+}
+
+// Answers the disco#info and disco#items queries sent to the client.
+type discoResponder struct {
+	Extension
+	lock sync.Mutex
+	info *DiscoInfo
+	// The node of our entity capabilities, which also has info.
+	capsNode string
+	toServer chan Stanza
+	sendDone chan bool
+}
+
+func newDiscoResponder(info *DiscoInfo, capsNode string) *discoResponder {
+	dr := &discoResponder{info: info, capsNode: capsNode}
+	dr.toServer = make(chan Stanza)
+	dr.sendDone = make(chan bool)
+	dr.StanzaTypes = DiscoExt.StanzaTypes
+	dr.RecvFilter = dr.recvFilter
+	dr.SendFilter = dr.sendFilter
+	return dr
+}
+
+func (dr *discoResponder) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for stan := range in {
+		iq, ok := stan.(*Iq)
+		if !ok || iq.Type != "get" || len(iq.Nested) != 1 {
+			out <- stan
+			continue
+		}
+		var reply *Iq
+		switch q := iq.Nested[0].(type) {
+		case *DiscoInfo:
+			reply = dr.answerInfo(iq, q)
+		case *DiscoItems:
+			// The client has no items.
+			reply = &Iq{Header: Header{To: iq.From, Id: iq.Id,
+				Type: "result", Nested: []interface{}{
+					&DiscoItems{Node: q.Node}}}}
+		default:
+			out <- stan
+			continue
+		}
+		select {
+		case dr.toServer <- reply:
+		case <-dr.sendDone:
+		}
+	}
+}
+
+func (dr *discoResponder) answerInfo(iq *Iq, q *DiscoInfo) *Iq {
+	reply := &Iq{Header: Header{To: iq.From, Id: iq.Id, Type: "result"}}
+	dr.lock.Lock()
+	di, capsNode := dr.info, dr.capsNode
+	dr.lock.Unlock()
+	if q.Node != "" && q.Node != capsNode {
+		reply.Type = "error"
+		reply.Nested = []interface{}{q}
+		reply.Error = stanzaError("cancel", "item-not-found")
+		return reply
+	}
+	info := *di
+	info.Node = q.Node
+	reply.Nested = []interface{}{&info}
+	return reply
+}
+
+// Replaces the info we answer with, when the extensions change.
+func (dr *discoResponder) setInfo(info *DiscoInfo, capsNode string) {
+	dr.lock.Lock()
+	defer dr.lock.Unlock()
+	dr.info, dr.capsNode = info, capsNode
+}
+
+func (dr *discoResponder) sendFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	defer close(dr.sendDone)
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			out <- stan
+		case stan := <-dr.toServer:
+			out <- stan
+		}
+	}
+}
+
+// An item found by a DiscoWalker.
+type DiscoWalkItem struct {
+	DiscoItem
+	// The entity and node whose items included this one.
+	Parent     JID
+	ParentNode string
+	// 1 for the starting point's own items, 2 for their items, and
+	// so on.
+	Depth int
+}
+
+type discoKey struct {
+	jid  JID
+	node string
+}
+
+type discoWalkNode struct {
+	discoKey
+	depth int
+}
+
+// DiscoWalker traverses the tree of disco#items below an entity,
+// fetching a page at a time with result set management. It's used
+// like bufio.Scanner:
+//
+//	w := cl.WalkDiscoItems(ctx, "conference.example.com", "", 1)
+//	for w.Next() {
+//		room := w.Item()
+//		...
+//	}
+//	if err := w.Err(); err != nil {
+//		...
+//	}
+//
+// Items are visited breadth first, and each (jid, node) pair is
+// visited at most once. Errors listing the items of anything but the
+// starting point are ignored, since many entities have no items to
+// list.
+type DiscoWalker struct {
+	// The number of items to ask for in each request. Servers may
+	// return fewer.
+	PageSize int
+	ctx      context.Context
+	maxDepth int
+	query    func(context.Context, *Iq) (*Iq, error)
+	queue    []discoWalkNode
+	seen     map[discoKey]bool
+	// The node being listed, and the pages of its items.
+	cur   *discoWalkNode
+	pager *RsmPager
+	items []DiscoWalkItem
+	item  DiscoWalkItem
+	err   error
+}
+
+// Returns a DiscoWalker which lists the items of jid (at node, if
+// non-empty), and the items below them down to maxDepth levels. A
+// maxDepth of 1 lists only the immediate items, as for browsing the
+// rooms of a MUC service.
+func (cl *Client) WalkDiscoItems(ctx context.Context, jid JID, node string,
+	maxDepth int) *DiscoWalker {
+
+	return newDiscoWalker(ctx, cl.SendIq, jid, node, maxDepth)
+}
+
+func newDiscoWalker(ctx context.Context,
+	query func(context.Context, *Iq) (*Iq, error), jid JID, node string,
+	maxDepth int) *DiscoWalker {
+
+	if maxDepth < 1 {
+		maxDepth = 1
+	}
+	w := &DiscoWalker{PageSize: 100, ctx: ctx, maxDepth: maxDepth,
+		query: query}
+	start := discoWalkNode{discoKey{jid, node}, 0}
+	w.queue = []discoWalkNode{start}
+	w.seen = map[discoKey]bool{start.discoKey: true}
+	return w
+}
+
+// Advances to the next item, fetching more from the network if
+// necessary. Returns false when there are no more items or an error
+// occurred.
+func (w *DiscoWalker) Next() bool {
+	for len(w.items) == 0 {
+		if w.err != nil {
+			return false
+		}
+		if w.cur == nil {
+			if len(w.queue) == 0 {
+				return false
+			}
+			w.cur = &w.queue[0]
+			w.queue = w.queue[1:]
+			w.pager = NewRsmPager(w.PageSize, w.fetch)
+		}
+		if !w.pager.Next() {
+			err := w.pager.Err()
+			if err != nil && (w.cur.depth == 0 || w.ctx.Err() != nil) {
+				w.err = err
+			}
+			w.cur = nil
+		}
+	}
+	w.item = w.items[0]
+	w.items = w.items[1:]
+	return true
+}
+
+// Returns the item Next advanced to.
+func (w *DiscoWalker) Item() DiscoWalkItem {
+	return w.item
+}
+
+// Returns the error which stopped the walk, if any.
+func (w *DiscoWalker) Err() error {
+	return w.err
+}
+
+// Fetches a page of the current node's items.
+func (w *DiscoWalker) fetch(set *RsmSet) (*RsmSet, int, error) {
+	cur := w.cur
+	iq := &Iq{Header: Header{To: cur.jid, Type: "get",
+		Nested: []interface{}{&DiscoItems{Node: cur.node, Set: set}}}}
+	reply, err := w.query(w.ctx, iq)
+	if err != nil {
+		return nil, 0, err
+	}
+	var res *DiscoItems
+	for _, ele := range reply.Nested {
+		if di, ok := ele.(*DiscoItems); ok {
+			res = di
+		}
+	}
+	if res == nil {
+		return nil, 0, nil
+	}
+	for _, it := range res.Items {
+		w.items = append(w.items, DiscoWalkItem{DiscoItem: it,
+			Parent: cur.jid, ParentNode: cur.node,
+			Depth: cur.depth + 1})
+		key := discoKey{it.Jid, it.Node}
+		if cur.depth+1 < w.maxDepth && !w.seen[key] {
+			w.seen[key] = true
+			w.queue = append(w.queue, discoWalkNode{key, cur.depth + 1})
+		}
+	}
+	return res.Set, len(res.Items), nil
+}
@@ -0,0 +1,136 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"testing"
+)
+
+func TestDiscoItemsUnmarshal(t *testing.T) {
+	str := `<iq xmlns="jabber:client" type="result" id="1">` +
+		`<query xmlns="` + NsDiscoItems + `">` +
+		`<item jid="room@muc.example.com" name="Room"/>` +
+		`<set xmlns="` + NsRsm + `"><first index="0">a</first>` +
+		`<last>b</last><count>20</count></set></query></iq>`
+	var iq Iq
+	if err := xml.Unmarshal([]byte(str), &iq); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if err := parseExtended(&iq.Header, DiscoExt.StanzaTypes); err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	di, ok := iq.Nested[0].(*DiscoItems)
+	if !ok {
+		t.Fatalf("not DiscoItems: %T", iq.Nested[0])
+	}
+	assertEquals(t, "room@muc.example.com", string(di.Items[0].Jid))
+	assertEquals(t, "Room", di.Items[0].Name)
+	assertEquals(t, "a", di.Set.First.Id)
+	assertEquals(t, "b", di.Set.Last)
+	if di.Set.Count == nil || *di.Set.Count != 20 {
+		t.Errorf("count: %v", di.Set.Count)
+	}
+}
+
+func TestDiscoWalker(t *testing.T) {
+	// The service has 5 rooms, served 2 at a time. Room 3 has
+	// items of its own; the others answer with errors.
+	var queries []string
+	query := func(ctx context.Context, iq *Iq) (*Iq, error) {
+		req := iq.Nested[0].(*DiscoItems)
+		queries = append(queries, string(iq.To)+" "+req.Set.After)
+		reply := &Iq{Header: Header{Type: "result"}}
+		res := &DiscoItems{}
+		switch iq.To {
+		case "muc":
+			start := 0
+			if req.Set.After != "" {
+				fmt.Sscan(req.Set.After, &start)
+			}
+			for i := start; i < start+*req.Set.Max && i < 5; i++ {
+				res.Items = append(res.Items,
+					DiscoItem{Jid: JID(fmt.Sprintf("r%d@muc", i))})
+			}
+			res.Set = &RsmSet{Last: fmt.Sprint(start + len(res.Items))}
+		case "r3@muc":
+			res.Items = []DiscoItem{{Jid: "r3@muc", Node: "n"}}
+		default:
+			return nil, fmt.Errorf("no items")
+		}
+		reply.Nested = []interface{}{res}
+		return reply, nil
+	}
+
+	w := newDiscoWalker(context.Background(), query, "muc", "", 1)
+	w.PageSize = 2
+	var got []string
+	for w.Next() {
+		got = append(got, string(w.Item().Jid))
+	}
+	if w.Err() != nil {
+		t.Errorf("Err: %v", w.Err())
+	}
+	assertEquals(t, "[r0@muc r1@muc r2@muc r3@muc r4@muc]",
+		fmt.Sprint(got))
+	assertEquals(t, "[muc  muc 2 muc 4 muc 5]", fmt.Sprint(queries))
+
+	queries = nil
+	w = newDiscoWalker(context.Background(), query, "muc", "", 2)
+	w.PageSize = 5
+	got = nil
+	for w.Next() {
+		it := w.Item()
+		got = append(got, fmt.Sprintf("%d:%s/%s", it.Depth, it.Jid,
+			it.Node))
+	}
+	if w.Err() != nil {
+		t.Errorf("Err: %v", w.Err())
+	}
+	assertEquals(t, "[1:r0@muc/ 1:r1@muc/ 1:r2@muc/ 1:r3@muc/ "+
+		"1:r4@muc/ 2:r3@muc/n]", fmt.Sprint(got))
+}
+
+func TestDiscoResponder(t *testing.T) {
+	info := ownDiscoInfo([]Extension{ReceiptsExt, MucExt, ReceiptsExt},
+		[]DiscoIdentity{{Category: "client", Type: "bot"}})
+	dr := newDiscoResponder(info, "")
+	recvIn := make(chan Stanza)
+	recvOut := make(chan Stanza, 1)
+	go dr.RecvFilter(recvIn, recvOut)
+	sendIn := make(chan Stanza)
+	sendOut := make(chan Stanza)
+	go dr.SendFilter(sendIn, sendOut)
+	defer close(sendIn)
+	defer close(recvIn)
+
+	recvIn <- &Iq{Header: Header{From: "a@b/c", Id: "1", Type: "get",
+		Nested: []interface{}{&DiscoInfo{}}}}
+	reply := (<-sendOut).(*Iq)
+	assertEquals(t, "a@b/c", string(reply.To))
+	assertEquals(t, "result", reply.Type)
+	buf, _ := xml.Marshal(reply.Nested[0])
+	assertEquals(t, `<query xmlns="`+NsDiscoInfo+`">`+
+		`<identity category="client" type="bot"></identity>`+
+		`<feature var="`+NsDiscoInfo+`"></feature>`+
+		`<feature var="`+NsMuc+`"></feature>`+
+		`<feature var="`+NsReceipts+`"></feature></query>`, string(buf))
+
+	recvIn <- &Iq{Header: Header{From: "a@b/c", Id: "2", Type: "get",
+		Nested: []interface{}{&DiscoInfo{Node: "x"}}}}
+	reply = (<-sendOut).(*Iq)
+	assertEquals(t, "error", reply.Type)
+
+	recvIn <- &Iq{Header: Header{From: "a@b/c", Id: "3", Type: "get",
+		Nested: []interface{}{&DiscoItems{}}}}
+	reply = (<-sendOut).(*Iq)
+	assertEquals(t, "result", reply.Type)
+
+	// Anything else passes through.
+	other := &Iq{Header: Header{From: "a@b/c", Id: "4", Type: "result",
+		Nested: []interface{}{&DiscoInfo{}}}}
+	recvIn <- other
+	if st := <-recvOut; st != other {
+		t.Errorf("got %v", st)
+	}
+}
@@ -0,0 +1,296 @@
+package xmpp
+
+// This file contains a dispatcher, which reads what a client receives
+// and calls the handlers registered for it, so that applications
+// needn't each write the same loop and type switch over Client.Recv.
+
+import (
+	"hash/fnv"
+	"path"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Decides whether a handler registered with a Dispatcher wants a
+// stanza.
+type Match func(st Stanza) bool
+
+// Matches stanzas from senders whose JID matches a pattern, with the
+// syntax of path.Match. A pattern without a resource is matched
+// against the sender's bare JID, so "*@muc.example.com" matches
+// every occupant of every room on that service, and one with a
+// resource against the full JID.
+func FromJid(pattern string) Match {
+	withResource := strings.Contains(pattern, "/")
+	return func(st Stanza) bool {
+		from := st.GetHeader().From
+		if !withResource {
+			from = from.Bare()
+		}
+		ok, _ := path.Match(pattern, string(from))
+		return ok
+	}
+}
+
+// Matches stanzas carrying a nested element in the namespace. Only
+// elements decoded by an extension, or by a type registered with
+// RegisterPayload, are seen.
+func WithNamespace(ns string) Match {
+	return func(st Stanza) bool {
+		for _, ele := range st.GetHeader().Nested {
+			if payloadSpace(ele) == ns {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Matches stanzas with the type attribute, such as "chat" or "get".
+func OfType(typ string) Match {
+	return func(st Stanza) bool {
+		return st.GetHeader().Type == typ
+	}
+}
+
+// Returns the namespace of a nested element, from its XMLName or the
+// name its type is registered with.
+func payloadSpace(ele interface{}) string {
+	if name := nestedName(ele); name.Local != "" {
+		return name.Space
+	}
+	t := reflect.TypeOf(ele)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	payloadLock.Lock()
+	defer payloadLock.Unlock()
+	return payloadNames[t].Space
+}
+
+// Dispatcher reads the stanzas a client receives, and calls each
+// handler registered for one with a matching kind of stanza, and
+// whose matches all accept it, in the order they were registered.
+// Handlers run on a pool of worker goroutines, so they may run
+// concurrently, and those of a later stanza may run before those of
+// an earlier one, unless it's ordered. Stanzas nobody handles are
+// dropped. Handlers of iq gets and sets should reply to them.
+type Dispatcher struct {
+	workers  int
+	ordered  bool
+	lock     sync.Mutex
+	handlers []*dispatchHandler
+}
+
+type dispatchHandler struct {
+	matches []Match
+	f       func(cl *Client, st Stanza)
+}
+
+// Creates a Dispatcher which runs handlers on the given number of
+// workers, or on one per CPU if it's zero.
+func NewDispatcher(workers int) *Dispatcher {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return &Dispatcher{workers: workers}
+}
+
+// Like NewDispatcher, but the stanzas from each bare JID are handled
+// one at a time, in the order they arrived, while those of different
+// senders are still handled concurrently. Each sender is always
+// handled by the same worker, so a slow handler also delays the other
+// senders which share it, though not those of other workers: what
+// arrives for a busy worker waits in a queue of its own.
+func NewOrderedDispatcher(workers int) *Dispatcher {
+	d := NewDispatcher(workers)
+	d.ordered = true
+	return d
+}
+
+// Registers a function to be called with the messages the matches
+// accept. The returned function removes it again.
+func (d *Dispatcher) OnMessage(f func(cl *Client, m *Message),
+	matches ...Match) (remove func()) {
+
+	return d.add(matches, func(cl *Client, st Stanza) {
+		if m, ok := st.(*Message); ok {
+			f(cl, m)
+		}
+	})
+}
+
+// Like OnMessage, for presence.
+func (d *Dispatcher) OnPresence(f func(cl *Client, p *Presence),
+	matches ...Match) (remove func()) {
+
+	return d.add(matches, func(cl *Client, st Stanza) {
+		if p, ok := st.(*Presence); ok {
+			f(cl, p)
+		}
+	})
+}
+
+// Like OnMessage, for iqs.
+func (d *Dispatcher) OnIq(f func(cl *Client, iq *Iq),
+	matches ...Match) (remove func()) {
+
+	return d.add(matches, func(cl *Client, st Stanza) {
+		if iq, ok := st.(*Iq); ok {
+			f(cl, iq)
+		}
+	})
+}
+
+func (d *Dispatcher) add(matches []Match,
+	f func(*Client, Stanza)) func() {
+
+	h := &dispatchHandler{matches: matches, f: f}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.handlers = append(d.handlers, h)
+	return func() {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		for i, other := range d.handlers {
+			if other == h {
+				d.handlers = append(d.handlers[:i:i],
+					d.handlers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Reads the client's Recv channel until it's closed, dispatching what
+// arrives, and returns once the handlers have finished with why the
+// session ended, from Client.Done. A dispatcher may run several
+// clients at once, each on a pool of its own.
+func (d *Dispatcher) Run(cl *Client) error {
+	if d.ordered {
+		d.runOrdered(cl)
+	} else {
+		d.runShared(cl)
+	}
+	return <-cl.Done
+}
+
+// Runs workers which all take stanzas from one channel.
+func (d *Dispatcher) runShared(cl *Client) {
+	work := make(chan Stanza)
+	var wg sync.WaitGroup
+	for i := 0; i < d.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for st := range work {
+				d.dispatch(cl, st)
+			}
+		}()
+	}
+	for st := range cl.Recv {
+		work <- st
+	}
+	close(work)
+	wg.Wait()
+}
+
+// Runs workers which each have a queue, and passes each stanza to its
+// sender's.
+func (d *Dispatcher) runOrdered(cl *Client) {
+	queues := make([]*dispatchQueue, d.workers)
+	var wg sync.WaitGroup
+	for i := range queues {
+		q := newDispatchQueue()
+		queues[i] = q
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for st, ok := q.pop(); ok; st, ok = q.pop() {
+				d.dispatch(cl, st)
+			}
+		}()
+	}
+	for st := range cl.Recv {
+		queues[senderQueue(st, len(queues))].push(st)
+	}
+	for _, q := range queues {
+		q.close()
+	}
+	wg.Wait()
+}
+
+// The stanzas waiting for one worker of an ordered Dispatcher. Adding
+// to it never blocks.
+type dispatchQueue struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	queue  []Stanza
+	closed bool
+}
+
+func newDispatchQueue() *dispatchQueue {
+	q := &dispatchQueue{}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+func (q *dispatchQueue) push(st Stanza) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.queue = append(q.queue, st)
+	q.cond.Signal()
+}
+
+// No more is pushed; what's queued is still popped.
+func (q *dispatchQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.cond.Signal()
+}
+
+// Waits for the next stanza. Returns false once the queue is closed
+// and empty.
+func (q *dispatchQueue) pop() (Stanza, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for len(q.queue) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.queue) == 0 {
+		return nil, false
+	}
+	st := q.queue[0]
+	q.queue[0] = nil
+	q.queue = q.queue[1:]
+	return st, true
+}
+
+// Returns which of n queues the stanzas from the sender of st go to.
+func senderQueue(st Stanza, n int) int {
+	if n == 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(st.GetHeader().From.Bare()))
+	return int(h.Sum32() % uint32(n))
+}
+
+// Calls the handlers of one stanza.
+func (d *Dispatcher) dispatch(cl *Client, st Stanza) {
+	d.lock.Lock()
+	handlers := d.handlers
+	d.lock.Unlock()
+Handlers:
+	for _, h := range handlers {
+		for _, m := range h.matches {
+			if !m(st) {
+				continue Handlers
+			}
+		}
+		h.f(cl, st)
+	}
+}
@@ -0,0 +1,129 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestDispatcher(t *testing.T) {
+	recv := make(chan Stanza)
+	done := make(chan error, 1)
+	cl := &Client{Recv: recv, Done: done}
+	d := NewDispatcher(2)
+
+	var lock sync.Mutex
+	var got []string
+	record := func(what string) {
+		lock.Lock()
+		defer lock.Unlock()
+		got = append(got, what)
+	}
+	d.OnMessage(func(c *Client, m *Message) {
+		if c != cl {
+			t.Error("wrong client")
+		}
+		record("muc " + firstText(m.Body))
+	}, FromJid("*@muc.b.c"), OfType("groupchat"))
+	d.OnMessage(func(_ *Client, m *Message) {
+		record("alice " + firstText(m.Body))
+	}, FromJid("alice@b.c/phone"))
+	d.OnIq(func(_ *Client, iq *Iq) {
+		record("ping " + iq.Id)
+	}, WithNamespace(NsPing))
+	remove := d.OnPresence(func(*Client, *Presence) {
+		record("presence")
+	})
+	remove()
+
+	go func() {
+		recv <- &Message{Header: Header{From: "room@muc.b.c/nick",
+			Type: "groupchat"}, Body: []Text{{Chardata: "hi"}}}
+		recv <- &Message{Header: Header{From: "room@muc.b.c/nick",
+			Type: "chat"}, Body: []Text{{Chardata: "private"}}}
+		recv <- &Message{Header: Header{From: "alice@b.c/phone"},
+			Body: []Text{{Chardata: "hello"}}}
+		recv <- &Message{Header: Header{From: "alice@b.c/pc"},
+			Body: []Text{{Chardata: "elsewhere"}}}
+		recv <- &Iq{Header: Header{Id: "p1", Type: "get",
+			Nested: []interface{}{&Generic{XMLName: xml.Name{
+				Space: NsPing, Local: "ping"}}}}}
+		recv <- &Presence{Header: Header{From: "alice@b.c/pc"}}
+		close(recv)
+		done <- nil
+	}()
+	if err := d.Run(cl); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+	want := map[string]bool{"muc hi": true, "alice hello": true,
+		"ping p1": true}
+	if len(got) != len(want) {
+		t.Fatalf("got %q", got)
+	}
+	for _, g := range got {
+		if !want[g] {
+			t.Errorf("unexpected %q", g)
+		}
+	}
+}
+
+func TestOrderedDispatcher(t *testing.T) {
+	recv := make(chan Stanza)
+	done := make(chan error, 1)
+	cl := &Client{Recv: recv, Done: done}
+	d := NewOrderedDispatcher(4)
+
+	// Two senders handled by different workers.
+	senders := []JID{"a@b.c"}
+	for i := 0; len(senders) < 2; i++ {
+		jid := JID(fmt.Sprintf("u%d@b.c", i))
+		if senderQueue(&Message{Header: Header{From: jid}}, 4) !=
+			senderQueue(&Message{Header: Header{From: senders[0]}}, 4) {
+			senders = append(senders, jid)
+		}
+	}
+	// The first sender's first message is handled only once the
+	// second sender's last has been, which would never happen if
+	// they were handled one after another, or if the first sender's
+	// later messages held up the second's.
+	other := make(chan bool)
+	var lock sync.Mutex
+	got := map[JID][]string{}
+	d.OnMessage(func(_ *Client, m *Message) {
+		from := m.From.Bare()
+		if body := firstText(m.Body); from == senders[0] && body == "0" {
+			<-other
+		} else if from == senders[1] && body == "19" {
+			close(other)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		got[from] = append(got[from], firstText(m.Body))
+	})
+
+	go func() {
+		for i := 0; i < 20; i++ {
+			for _, from := range senders {
+				// Different resources of the same sender are
+				// still ordered.
+				recv <- &Message{Header: Header{From: from +
+					JID(fmt.Sprintf("/r%d", i%3))},
+					Body: []Text{{Chardata: fmt.Sprint(i)}}}
+			}
+		}
+		close(recv)
+		done <- nil
+	}()
+	if err := d.Run(cl); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+	for _, from := range senders {
+		if len(got[from]) != 20 {
+			t.Fatalf("%s: got %q", from, got[from])
+		}
+		for i, body := range got[from] {
+			assertEquals(t, fmt.Sprint(i), body)
+		}
+	}
+}
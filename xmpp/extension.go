@@ -0,0 +1,256 @@
+package xmpp
+
+// This file contains the registration of extensions with a client
+// which is already running, and the factories through which other
+// packages can provide their own.
+
+import (
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var factoryLock sync.Mutex
+var extFactories = make(map[string]func() Extension)
+
+// Makes an extension available by the namespace of the protocol it
+// implements, so that a package implementing a XEP can offer it from
+// an init function, and clients can enable it with EnableExtension.
+// Registering a namespace twice panics.
+func RegisterExtensionFactory(ns string, factory func() Extension) {
+	factoryLock.Lock()
+	defer factoryLock.Unlock()
+	if _, ok := extFactories[ns]; ok {
+		panic(fmt.Sprintf("xmpp: extension %s registered twice", ns))
+	}
+	extFactories[ns] = factory
+}
+
+// The extensions of a client: those it was created with, and those
+// registered since.
+type extRegistry struct {
+	lock sync.Mutex
+	// The payload types of every extension. A new map replaces it
+	// on change, so the receiver can use it without the lock.
+	types map[xml.Name]reflect.Type
+	// How many extensions registered each payload type, so that
+	// it's only removed with the last of them.
+	refs    map[xml.Name]int
+	entries []*extEntry
+	// The names of the payload types, for marshaling them.
+	names map[reflect.Type]xml.Name
+}
+
+type extEntry struct {
+	ext    Extension
+	remove []func()
+}
+
+// Starts the registry off with the extensions the client was created
+// with, and the payload types they and RegisterPayload provide.
+func (er *extRegistry) init(exts []Extension,
+	types map[xml.Name]reflect.Type) {
+
+	er.lock.Lock()
+	defer er.lock.Unlock()
+	er.setTypes(types)
+	er.refs = make(map[xml.Name]int)
+	for k := range types {
+		er.refs[k] = 1
+	}
+	for _, ext := range exts {
+		er.entries = append(er.entries, &extEntry{ext: ext})
+	}
+}
+
+// Replaces the payload types. The lock must be held.
+func (er *extRegistry) setTypes(types map[xml.Name]reflect.Type) {
+	er.types = types
+	er.names = make(map[reflect.Type]xml.Name, len(types))
+	for k, v := range types {
+		er.names[v] = k
+	}
+}
+
+func (er *extRegistry) payloadName(t reflect.Type) (xml.Name, bool) {
+	er.lock.Lock()
+	defer er.lock.Unlock()
+	name, ok := er.names[t]
+	return name, ok
+}
+
+func (er *extRegistry) stanzaTypes() map[xml.Name]reflect.Type {
+	er.lock.Lock()
+	defer er.lock.Unlock()
+	return er.types
+}
+
+func (er *extRegistry) extensions() []Extension {
+	er.lock.Lock()
+	defer er.lock.Unlock()
+	exts := make([]Extension, len(er.entries))
+	for i, e := range er.entries {
+		exts[i] = e.ext
+	}
+	return exts
+}
+
+// Adds an extension's payload types, unless one of them is already
+// registered as a different type.
+func (er *extRegistry) add(e *extEntry) error {
+	er.lock.Lock()
+	defer er.lock.Unlock()
+	for k, v := range e.ext.StanzaTypes {
+		if t, ok := er.types[k]; ok && t != v {
+			return fmt.Errorf("duplicate handler %s", k)
+		}
+	}
+	types := make(map[xml.Name]reflect.Type, len(er.types))
+	for k, v := range er.types {
+		types[k] = v
+	}
+	for k, v := range e.ext.StanzaTypes {
+		types[k] = v
+		er.refs[k]++
+	}
+	er.setTypes(types)
+	er.entries = append(er.entries, e)
+	return nil
+}
+
+// Removes an extension, and reports whether it was still registered.
+func (er *extRegistry) drop(e *extEntry) bool {
+	er.lock.Lock()
+	defer er.lock.Unlock()
+	for i, other := range er.entries {
+		if other != e {
+			continue
+		}
+		er.entries = append(er.entries[:i:i], er.entries[i+1:]...)
+		types := make(map[xml.Name]reflect.Type, len(er.types))
+		for k, v := range er.types {
+			types[k] = v
+		}
+		for k := range e.ext.StanzaTypes {
+			if er.refs[k]--; er.refs[k] == 0 {
+				delete(types, k)
+				delete(er.refs, k)
+			}
+		}
+		er.setTypes(types)
+		return true
+	}
+	return false
+}
+
+// Removes every extension, and returns them.
+func (er *extRegistry) dropAll() []*extEntry {
+	er.lock.Lock()
+	defer er.lock.Unlock()
+	entries := er.entries
+	er.entries = nil
+	return entries
+}
+
+// RegisterExtension adds an extension to a running client. Its
+// payload types are decoded from then on, its middleware is added, its
+// features are advertised in the next presence the application sends,
+// its BeforePresence hook runs whenever ReconnectExt starts a new
+// session, and its Start function is called in a new goroutine. The
+// returned function unregisters it again and calls its Stop function.
+//
+// Filters can't be removed, so an extension with a RecvFilter or
+// SendFilter can't be registered this way; it should use middleware
+// instead. Neither can option extensions, which only take effect when
+// the client connects.
+func (cl *Client) RegisterExtension(ext Extension) (unregister func(),
+	err error) {
+
+	if ext.option != nil {
+		return nil, fmt.Errorf("options can't be registered at run time")
+	}
+	if ext.RecvFilter != nil || ext.SendFilter != nil {
+		return nil, fmt.Errorf("filters can't be registered at run time")
+	}
+	e := &extEntry{ext: ext}
+	if err := cl.extensions.add(e); err != nil {
+		return nil, err
+	}
+	if ext.RecvMiddleware != nil {
+		e.remove = append(e.remove, cl.AddRecvMiddleware(
+			ext.MiddlewareOrder, ext.RecvMiddleware))
+	}
+	if ext.SendMiddleware != nil {
+		e.remove = append(e.remove, cl.AddSendMiddleware(
+			ext.MiddlewareOrder, ext.SendMiddleware))
+	}
+	if len(ext.Features) > 0 {
+		cl.readvertise()
+	}
+	if ext.Start != nil {
+		go ext.Start(cl)
+	}
+	var once sync.Once
+	return func() { once.Do(func() { cl.unregister(e) }) }, nil
+}
+
+// Creates the extension registered with RegisterExtensionFactory for
+// a namespace, and registers it with RegisterExtension.
+func (cl *Client) EnableExtension(ns string) (unregister func(),
+	err error) {
+
+	factoryLock.Lock()
+	factory := extFactories[ns]
+	factoryLock.Unlock()
+	if factory == nil {
+		return nil, fmt.Errorf("no extension for %s", ns)
+	}
+	return cl.RegisterExtension(factory())
+}
+
+func (cl *Client) unregister(e *extEntry) {
+	if !cl.extensions.drop(e) {
+		// The session has ended, and it's been stopped.
+		return
+	}
+	for _, remove := range e.remove {
+		remove()
+	}
+	if len(e.ext.Features) > 0 {
+		cl.readvertise()
+	}
+	if e.ext.Stop != nil {
+		e.ext.Stop(cl)
+	}
+}
+
+// Updates our disco#info, and the caps which stand for it, after the
+// extensions have changed.
+func (cl *Client) readvertise() {
+	if cl.disco == nil {
+		return
+	}
+	info := ownDiscoInfo(cl.extensions.extensions(), cl.opts.identities)
+	cl.disco.setInfo(info, cl.caps.advertise(info))
+}
+
+// Calls the Stop functions of the extensions, once the session has
+// ended.
+func (cl *Client) stopExtensions() {
+	for _, e := range cl.extensions.dropAll() {
+		if e.ext.Stop != nil {
+			e.ext.Stop(cl)
+		}
+	}
+}
+
+// Runs the BeforePresence hooks of the extensions, in the order they
+// were registered.
+func (cl *Client) runBeforePresence() {
+	for _, ext := range cl.extensions.extensions() {
+		if ext.BeforePresence != nil {
+			ext.BeforePresence(cl)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testWidget struct {
+	XMLName xml.Name `xml:"urn:test:ext widget"`
+	Size    string   `xml:"size,attr"`
+}
+
+func hasFeature(cl *Client, feature string) bool {
+	reply := cl.disco.answerInfo(&Iq{}, &DiscoInfo{})
+	return reply.Nested[0].(*DiscoInfo).HasFeature(feature)
+}
+
+func TestRegisterExtension(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	cl := mockClient(t, s, "alice@b.c/pc", "secret", &tls.Config{})
+	defer cl.Close()
+
+	started := make(chan bool, 1)
+	stopped := make(chan bool, 1)
+	seen := 0
+	ext := Extension{
+		StanzaTypes: map[xml.Name]reflect.Type{
+			{Space: "urn:test:ext", Local: "widget"}: reflect.TypeOf(testWidget{}),
+		},
+		Features: []string{"urn:test:ext"},
+		RecvMiddleware: func(st Stanza, next func(Stanza)) {
+			if _, ok := GetPayload[testWidget](st); ok {
+				seen++
+			}
+			next(st)
+		},
+		Start: func(cl *Client) { started <- true },
+		Stop:  func(cl *Client) { stopped <- true },
+	}
+	ver := cl.caps.own.Ver
+	unregister, err := cl.RegisterExtension(ext)
+	if err != nil {
+		t.Fatalf("RegisterExtension: %v", err)
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not started")
+	}
+	if !hasFeature(cl, "urn:test:ext") {
+		t.Error("feature not advertised")
+	}
+	if cl.caps.own.Ver == ver {
+		t.Error("caps not updated")
+	}
+
+	send := func() *Message {
+		if err := s.Send(&Message{Header: Header{From: "b.c",
+			To: "alice@b.c/pc", Nested: []interface{}{
+				&testWidget{Size: "big"}}}}); err != nil {
+			t.Fatal(err)
+		}
+		return recvMessage(t, cl)
+	}
+	if w, ok := GetPayload[testWidget](send()); !ok || w.Size != "big" {
+		t.Errorf("payload not decoded")
+	}
+	assertEquals(t, "1", fmt.Sprint(seen))
+
+	// A different type for the same element is refused.
+	type otherWidget testWidget
+	if _, err := cl.RegisterExtension(Extension{
+		StanzaTypes: map[xml.Name]reflect.Type{
+			{Space: "urn:test:ext", Local: "widget"}: reflect.TypeOf(otherWidget{}),
+		}}); err == nil {
+		t.Error("registered a conflicting type")
+	}
+	if _, err := cl.RegisterExtension(Extension{RecvFilter: passthru}); err == nil {
+		t.Error("registered a filter")
+	}
+
+	unregister()
+	unregister()
+	select {
+	case <-stopped:
+	default:
+		t.Error("not stopped")
+	}
+	if _, ok := GetPayload[testWidget](send()); ok {
+		t.Error("payload decoded after unregistering")
+	}
+	assertEquals(t, "1", fmt.Sprint(seen))
+	if hasFeature(cl, "urn:test:ext") {
+		t.Error("feature still advertised")
+	}
+	assertEquals(t, ver, cl.caps.own.Ver)
+}
+
+// Stopped extensions from the factory report here.
+var factoryStopped = make(chan bool, 1)
+
+func init() {
+	RegisterExtensionFactory("urn:test:factory", func() Extension {
+		return Extension{Stop: func(cl *Client) { factoryStopped <- true }}
+	})
+}
+
+func TestEnableExtension(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	cl := mockClient(t, s, "alice@b.c/pc", "secret", &tls.Config{})
+
+	if _, err := cl.EnableExtension("urn:test:none"); err == nil {
+		t.Error("enabled an unknown extension")
+	}
+	if _, err := cl.EnableExtension("urn:test:factory"); err != nil {
+		t.Fatalf("EnableExtension: %v", err)
+	}
+	// It's stopped when the session ends.
+	cl.Close()
+	select {
+	case <-factoryStopped:
+	case <-time.After(5 * time.Second):
+		t.Error("not stopped")
+	}
+}
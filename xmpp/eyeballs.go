@@ -0,0 +1,163 @@
+package xmpp
+
+// This file contains connecting to whichever of a domain's servers
+// answers first, in the manner of Happy Eyeballs. RFC 8305.
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// How long a connection attempt has before the next one is started
+// alongside it. RFC 8305, section 5.
+var attemptDelay = 250 * time.Millisecond
+
+// Resolve host names and make TCP connections. Replaced by the tests.
+var (
+	lookupIPAddr = net.DefaultResolver.LookupIPAddr
+	dialTCP      = func(ctx context.Context, addr string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", addr)
+	}
+)
+
+// Resolves the endpoints' hosts, all at once, and returns an endpoint
+// for each of their addresses. Endpoints keep their order, and each
+// one's addresses alternate between IPv6 and IPv4, starting with
+// IPv6. An endpoint whose host can't be resolved is left out, unless
+// none can be, when the first error is returned.
+func resolveEndpoints(ctx context.Context, eps []endpoint) ([]endpoint,
+	error) {
+
+	addrs := make([][]endpoint, len(eps))
+	errs := make([]error, len(eps))
+	var wg sync.WaitGroup
+	for i, ep := range eps {
+		host, port, err := net.SplitHostPort(ep.addr)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if net.ParseIP(host) != nil {
+			addrs[i] = []endpoint{ep}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, ep endpoint) {
+			defer wg.Done()
+			ips, err := lookupIPAddr(ctx, host)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			var v6, v4 []endpoint
+			for _, ip := range ips {
+				a := ep
+				a.addr = net.JoinHostPort(ip.String(), port)
+				if ip.IP.To4() == nil {
+					v6 = append(v6, a)
+				} else {
+					v4 = append(v4, a)
+				}
+			}
+			addrs[i] = interleave(v6, v4)
+		}(i, ep)
+	}
+	wg.Wait()
+
+	var res []endpoint
+	var err error
+	for i := range eps {
+		res = append(res, addrs[i]...)
+		if err == nil {
+			err = errs[i]
+		}
+	}
+	if len(res) == 0 {
+		if err == nil {
+			err = errors.New("no addresses to connect to")
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+// Alternates between two lists, starting with the first.
+func interleave(a, b []endpoint) []endpoint {
+	var res []endpoint
+	for len(a) > 0 || len(b) > 0 {
+		if len(a) > 0 {
+			res = append(res, a[0])
+			a = a[1:]
+		}
+		if len(b) > 0 {
+			res = append(res, b[0])
+			b = b[1:]
+		}
+	}
+	return res
+}
+
+// Connects to the endpoints in order, starting each attempt once the
+// one before has failed or attemptDelay has passed, without waiting
+// for it to give up. The first connection made is returned, and the
+// attempts still going are cancelled, or closed if they succeed
+// anyway. If every attempt fails, the last error is returned.
+func raceEndpoints(ctx context.Context, eps []endpoint,
+	dial func(context.Context, endpoint) (net.Conn, error)) (net.Conn,
+	error) {
+
+	type attempt struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan attempt, len(eps))
+	next, pending := 0, 0
+	var delay <-chan time.Time
+	start := func() {
+		ep := eps[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, ep)
+			results <- attempt{conn, err}
+		}()
+		delay = nil
+		if next < len(eps) {
+			delay = time.After(attemptDelay)
+		}
+	}
+
+	var err error
+	if len(eps) > 0 {
+		start()
+	}
+	for pending > 0 {
+		select {
+		case a := <-results:
+			pending--
+			if a.err == nil {
+				go func(n int) {
+					for ; n > 0; n-- {
+						if a := <-results; a.conn != nil {
+							a.conn.Close()
+						}
+					}
+				}(pending)
+				return a.conn, nil
+			}
+			err = a.err
+			if next < len(eps) {
+				start()
+			}
+		case <-delay:
+			start()
+		}
+	}
+	return nil, err
+}
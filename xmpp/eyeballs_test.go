@@ -0,0 +1,98 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveEndpoints(t *testing.T) {
+	saved := lookupIPAddr
+	defer func() { lookupIPAddr = saved }()
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr,
+		error) {
+		if host != "a.example.net." {
+			return nil, errors.New("no such host")
+		}
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")},
+			{IP: net.ParseIP("192.0.2.2")},
+			{IP: net.ParseIP("2001:db8::1")}}, nil
+	}
+
+	eps, err := resolveEndpoints(context.Background(), []endpoint{
+		{addr: "b.example.net.:5222"}, {addr: "a.example.net.:5222"},
+		{addr: "192.0.2.9:5223", directTls: true}})
+	if err != nil {
+		t.Fatalf("resolveEndpoints: %v", err)
+	}
+	var s []string
+	for _, ep := range eps {
+		if ep.directTls {
+			s = append(s, "tls:"+ep.addr)
+		} else {
+			s = append(s, ep.addr)
+		}
+	}
+	assertEquals(t, "[2001:db8::1]:5222 192.0.2.1:5222 192.0.2.2:5222 "+
+		"tls:192.0.2.9:5223", strings.Join(s, " "))
+
+	if _, err := resolveEndpoints(context.Background(),
+		[]endpoint{{addr: "b.example.net.:5222"}}); err == nil {
+		t.Error("nothing resolved, but no error")
+	}
+}
+
+func TestRaceEndpoints(t *testing.T) {
+	saved := attemptDelay
+	defer func() { attemptDelay = saved }()
+	eps := []endpoint{{addr: "slow"}, {addr: "down"}, {addr: "up"}}
+	cancelled := make(chan bool, 1)
+	dial := func(ctx context.Context, ep endpoint) (net.Conn, error) {
+		switch ep.addr {
+		case "slow":
+			<-ctx.Done()
+			cancelled <- true
+			return nil, ctx.Err()
+		case "up":
+			c, s := net.Pipe()
+			s.Close()
+			return c, nil
+		}
+		return nil, errors.New("connection refused")
+	}
+
+	// The slow server only holds things up for the delay, and the
+	// one which is down not at all.
+	attemptDelay = 50 * time.Millisecond
+	start := time.Now()
+	conn, err := raceEndpoints(context.Background(), eps, dial)
+	if err != nil {
+		t.Fatalf("raceEndpoints: %v", err)
+	}
+	conn.Close()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("connecting took %v", d)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("the slow attempt wasn't cancelled")
+	}
+
+	// A failure starts the next attempt at once.
+	attemptDelay = time.Hour
+	if conn, err := raceEndpoints(context.Background(), eps[1:],
+		dial); err != nil {
+		t.Errorf("raceEndpoints: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	if _, err := raceEndpoints(context.Background(), eps[1:2],
+		dial); err == nil || err.Error() != "connection refused" {
+		t.Errorf("got %v, want the attempt's error", err)
+	}
+}
@@ -0,0 +1,143 @@
+package xmpp
+
+// This file contains a connection strategy which tries several ways
+// of reaching the server in turn.
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// A way of reaching an XMPP server. Dial returns a connection which
+// carries an ordinary XMPP stream.
+type Transport struct {
+	Name string
+	Dial func(ctx context.Context, domain string) (net.Conn, error)
+}
+
+// Connects over TCP to the servers listed in the domain's
+// _xmpp-client._tcp SRV records, and negotiates TLS with STARTTLS.
+var TcpTransport = Transport{Name: "tcp", Dial: dialSrv}
+
+// The outcome of one attempt made by NewClientWithFailover. Err is
+// nil for the transport which was chosen.
+type TransportAttempt struct {
+	Name string
+	Err  error
+}
+
+// Configures NewClientWithFailover.
+type FailoverConfig struct {
+	// The transports to try, in order.
+	Transports []Transport
+	// How long each attempt may take, from dialing until the
+	// session is running. Zero means 30 seconds.
+	Timeout time.Duration
+	// If non-nil, the outcome of each attempt is reported here.
+	// Reports are discarded if the channel isn't ready for them.
+	Attempts chan<- TransportAttempt
+}
+
+// Creates a client like NewClient, but tries each configured
+// transport in turn until one of them yields a running session. This
+// lets a client fall back to transports which get through captive
+// portals and filtering firewalls when direct connections fail. The
+// name of the transport chosen is stored in Client.Transport.
+//
+// Status updates from failed attempts are passed on to status,
+// except for the fatal ones. If every attempt fails, status isn't
+// closed.
+func NewClientWithFailover(ctx context.Context, jid *JID, password string,
+	tlsconf *tls.Config, exts []Extension, pr Presence,
+	status chan<- Status, conf FailoverConfig) (*Client, error) {
+
+	timeout := conf.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	var errs []error
+	for _, t := range conf.Transports {
+		cl, err := tryTransport(ctx, t, timeout, jid, password,
+			tlsconf, exts, pr, status)
+		if conf.Attempts != nil {
+			select {
+			case conf.Attempts <- TransportAttempt{t.Name, err}:
+			default:
+			}
+		}
+		if err == nil {
+			return cl, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %v", t.Name, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no transports configured")
+	}
+	return nil, fmt.Errorf("all transports failed: %v", errs)
+}
+
+func tryTransport(ctx context.Context, t Transport, timeout time.Duration,
+	jid *JID, password string, tlsconf *tls.Config, exts []Extension,
+	pr Presence, status chan<- Status) (*Client, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := t.Dial(ctx, jid.Domain())
+	if err != nil {
+		return nil, err
+	}
+
+	won := make(chan bool)
+	lost := make(chan bool)
+	var st chan<- Status
+	if status != nil {
+		attempt := make(chan Status)
+		st = attempt
+		go forwardStatus(attempt, status, won, lost)
+	}
+	redial := func(ctx context.Context) (net.Conn, error) {
+		return t.Dial(ctx, jid.Domain())
+	}
+	// Abandon the connection if negotiation takes too long.
+	cl, err := newClientContext(ctx, conn, redial, jid, password,
+		tlsconf, exts, pr, st)
+	if err != nil {
+		close(lost)
+		return nil, err
+	}
+	cl.Transport = t.Name
+	close(won)
+	return cl, nil
+}
+
+// Passes on the status updates of one attempt. Fatal ones are held
+// until it's known whether the attempt succeeded, and once it's
+// known to have failed nothing more is passed on. Only the
+// successful attempt closes to.
+func forwardStatus(from <-chan Status, to chan<- Status, won, lost chan bool) {
+	for stat := range from {
+		if stat.Fatal() {
+			select {
+			case <-won:
+			case <-lost:
+			}
+		}
+		select {
+		case <-lost:
+			continue
+		default:
+		}
+		to <- stat
+	}
+	select {
+	case <-won:
+		close(to)
+	case <-lost:
+	}
+}
@@ -0,0 +1,69 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestNewClientWithFailover(t *testing.T) {
+	stanzas := make(chan string, 10)
+	broken := Transport{Name: "broken",
+		Dial: func(ctx context.Context, domain string) (net.Conn, error) {
+			return nil, fmt.Errorf("filtered")
+		}}
+	pipe := Transport{Name: "pipe",
+		Dial: func(ctx context.Context, domain string) (net.Conn, error) {
+			cconn, sconn := net.Pipe()
+			go fakeServer(t, sconn, stanzas)
+			return cconn, nil
+		}}
+	attempts := make(chan TransportAttempt, 2)
+	jid := JID("user@example.com/res")
+	cl, err := NewClientWithFailover(context.Background(), &jid, "secret",
+		&tls.Config{}, nil, Presence{}, nil,
+		FailoverConfig{Transports: []Transport{broken, pipe},
+			Attempts: attempts})
+	if err != nil {
+		t.Fatalf("NewClientWithFailover: %v", err)
+	}
+	assertEquals(t, "pipe", cl.Transport)
+	a := <-attempts
+	if a.Name != "broken" || a.Err == nil {
+		t.Errorf("bad attempt %v", a)
+	}
+	a = <-attempts
+	if a.Name != "pipe" || a.Err != nil {
+		t.Errorf("bad attempt %v", a)
+	}
+	cl.Close()
+
+	_, err = NewClientWithFailover(context.Background(), &jid, "secret",
+		&tls.Config{}, nil, Presence{}, nil,
+		FailoverConfig{Transports: []Transport{broken}})
+	if err == nil {
+		t.Errorf("no error when every transport fails")
+	}
+}
+
+func TestForwardStatus(t *testing.T) {
+	from := make(chan Status)
+	to := make(chan Status, 10)
+	won := make(chan bool)
+	lost := make(chan bool)
+	go forwardStatus(from, to, won, lost)
+	from <- StatusConnected
+	go func() {
+		from <- StatusError
+		close(from)
+	}()
+	close(lost)
+	assertEquals(t, fmt.Sprint(StatusConnected), fmt.Sprint(<-to))
+	select {
+	case st := <-to:
+		t.Errorf("forwarded %v from failed attempt", st)
+	default:
+	}
+}
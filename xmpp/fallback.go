@@ -0,0 +1,191 @@
+package xmpp
+
+// This file contains support for Fallback Indication, XEP-0428.
+
+import (
+	"encoding/xml"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const NsFallback = "urn:xmpp:fallback:0"
+
+// Marks all or part of a message's body (or subject) as fallback
+// text, intended only for recipients which don't understand the
+// element identified by For. A Fallback with no Body or Subject
+// ranges covers the entire body.
+type Fallback struct {
+	XMLName xml.Name        `xml:"urn:xmpp:fallback:0 fallback"`
+	For     string          `xml:"for,attr,omitempty"`
+	Body    []FallbackRange `xml:"urn:xmpp:fallback:0 body"`
+	Subject []FallbackRange `xml:"urn:xmpp:fallback:0 subject"`
+}
+
+// A range of characters (not bytes) within the body or subject. End
+// is exclusive. If Start and End are both nil, the range covers the
+// whole of the text.
+type FallbackRange struct {
+	Start *int `xml:"start,attr,omitempty"`
+	End   *int `xml:"end,attr,omitempty"`
+}
+
+// FallbackExt may be included in the extensions passed to NewClient
+// to decode fallback indications on incoming messages. When the
+// element named by a fallback's For attribute was also decoded,
+// meaning some extension understood it, the fallback text is
+// stripped from the message body before the message is delivered.
+var FallbackExt Extension = Extension{}
+
+func init() {
+	FallbackExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	fName := xml.Name{Space: NsFallback, Local: "fallback"}
+	FallbackExt.StanzaTypes[fName] = reflect.TypeOf(Fallback{})
+	FallbackExt.RecvFilter = fallbackFilter
+}
+
+func fallbackFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for stan := range in {
+		if m, ok := stan.(*Message); ok {
+			m.stripFallbacks(func(ns string) bool {
+				return ns != "" && m.hasNested(ns)
+			})
+		}
+		out <- stan
+	}
+}
+
+// Marks the entire body of the message as fallback text for the
+// given namespace, typically that of an encrypted payload.
+func (m *Message) MarkFallback(ns string) {
+	m.Nested = append(m.Nested, &Fallback{For: ns,
+		Body: []FallbackRange{{}}})
+}
+
+// Marks the characters of the body from start up to (but not
+// including) end as fallback text for the given namespace, for
+// example a quotation that stands in for a reply element.
+func (m *Message) MarkFallbackRange(ns string, start, end int) {
+	m.Nested = append(m.Nested, &Fallback{For: ns,
+		Body: []FallbackRange{{Start: &start, End: &end}}})
+}
+
+// Returns the fallback indications attached to this message.
+func (m *Message) Fallbacks() []*Fallback {
+	var fbs []*Fallback
+	for _, ele := range m.Nested {
+		switch fb := ele.(type) {
+		case *Fallback:
+			fbs = append(fbs, fb)
+		case Fallback:
+			fbs = append(fbs, &fb)
+		}
+	}
+	return fbs
+}
+
+// Removes the text marked as fallback for the given namespace from
+// the message's body and subject elements.
+func (m *Message) StripFallback(ns string) {
+	m.stripFallbacks(func(f string) bool { return f == ns })
+}
+
+// Removes the text marked as fallback for the namespaces strip
+// accepts. The ranges are offsets into the original text, so those of
+// every fallback are removed at once.
+func (m *Message) stripFallbacks(strip func(ns string) bool) {
+	var body, subject []FallbackRange
+	for _, fb := range m.Fallbacks() {
+		if !strip(fb.For) {
+			continue
+		}
+		body = append(body, fb.Body...)
+		subject = append(subject, fb.Subject...)
+		if len(fb.Body) == 0 && len(fb.Subject) == 0 {
+			body = append(body, FallbackRange{})
+		}
+	}
+	for i := range m.Body {
+		m.Body[i].Chardata = stripRanges(m.Body[i].Chardata, body)
+	}
+	for i := range m.Subject {
+		m.Subject[i].Chardata = stripRanges(m.Subject[i].Chardata,
+			subject)
+	}
+}
+
+// Does this stanza carry a decoded nested element in the given
+// namespace?
+func (h *Header) hasNested(ns string) bool {
+	for _, ele := range h.Nested {
+		if nestedName(ele).Space == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the XML name of an element that might be found in
+// Header.Nested, or the zero Name if it can't be determined.
+func nestedName(ele interface{}) xml.Name {
+	v := reflect.Indirect(reflect.ValueOf(ele))
+	if v.Kind() != reflect.Struct {
+		return xml.Name{}
+	}
+	f, ok := v.Type().FieldByName("XMLName")
+	if !ok || f.Type != reflect.TypeOf(xml.Name{}) {
+		return xml.Name{}
+	}
+	name := v.FieldByIndex(f.Index).Interface().(xml.Name)
+	if name.Local != "" {
+		return name
+	}
+	// Not filled in by the decoder, so use the struct tag.
+	tag := strings.Split(f.Tag.Get("xml"), ",")[0]
+	if i := strings.LastIndex(tag, " "); i >= 0 {
+		return xml.Name{Space: tag[:i], Local: tag[i+1:]}
+	}
+	return xml.Name{Local: tag}
+}
+
+// Removes the given character ranges from a string. Ranges may
+// overlap, and are clipped to the length of the string.
+func stripRanges(s string, ranges []FallbackRange) string {
+	if len(ranges) == 0 {
+		return s
+	}
+	runes := []rune(s)
+	type span struct{ start, end int }
+	var spans []span
+	for _, r := range ranges {
+		if r.Start == nil || r.End == nil {
+			return ""
+		}
+		sp := span{*r.Start, *r.End}
+		if sp.start < 0 {
+			sp.start = 0
+		}
+		if sp.end > len(runes) {
+			sp.end = len(runes)
+		}
+		if sp.start < sp.end {
+			spans = append(spans, sp)
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].start < spans[j].start
+	})
+	var out []rune
+	pos := 0
+	for _, sp := range spans {
+		if sp.start > pos {
+			out = append(out, runes[pos:sp.start]...)
+		}
+		if sp.end > pos {
+			pos = sp.end
+		}
+	}
+	out = append(out, runes[pos:]...)
+	return string(out)
+}
@@ -0,0 +1,86 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestFallbackMarshal(t *testing.T) {
+	fb := &Fallback{For: "urn:xmpp:reply:0",
+		Body: []FallbackRange{{Start: new(int), End: new(int)}}}
+	*fb.Body[0].End = 7
+	exp := `<fallback xmlns="` + NsFallback +
+		`" for="urn:xmpp:reply:0"><body xmlns="` + NsFallback +
+		`" start="0" end="7"></body></fallback>`
+	assertMarshal(t, exp, fb)
+
+	fb = &Fallback{For: "eu.siacs.conversations.axolotl",
+		Body: []FallbackRange{{}}}
+	exp = `<fallback xmlns="` + NsFallback +
+		`" for="eu.siacs.conversations.axolotl"><body xmlns="` +
+		NsFallback + `"></body></fallback>`
+	assertMarshal(t, exp, fb)
+}
+
+func TestFallbackUnmarshal(t *testing.T) {
+	str := `<message xmlns="jabber:client"><body>&gt; hi
+hello</body><fallback xmlns="` + NsFallback +
+		`" for="urn:xmpp:reply:0"><body start="0" end="5"/></fallback></message>`
+	msg := Message{}
+	xml.Unmarshal([]byte(str), &msg)
+	err := parseExtended(&msg.Header, FallbackExt.StanzaTypes)
+	if err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	fbs := msg.Fallbacks()
+	if len(fbs) != 1 {
+		t.Fatalf("wrong # fallbacks: %v", fbs)
+	}
+	assertEquals(t, "urn:xmpp:reply:0", fbs[0].For)
+	if len(fbs[0].Body) != 1 || *fbs[0].Body[0].End != 5 {
+		t.Fatalf("bad range: %v", fbs[0].Body)
+	}
+	msg.StripFallback("urn:xmpp:reply:0")
+	assertEquals(t, "hello", msg.Body[0].Chardata)
+}
+
+func TestStripRanges(t *testing.T) {
+	r := func(start, end int) FallbackRange {
+		return FallbackRange{Start: &start, End: &end}
+	}
+	assertEquals(t, "abc", stripRanges("abc", nil))
+	assertEquals(t, "", stripRanges("abc", []FallbackRange{{}}))
+	assertEquals(t, "ac", stripRanges("abc", []FallbackRange{r(1, 2)}))
+	assertEquals(t, "é", stripRanges("«é»", []FallbackRange{r(2, 9),
+		r(0, 1)}))
+	assertEquals(t, "f", stripRanges("abcdef", []FallbackRange{r(2, 5),
+		r(0, 3)}))
+}
+
+func TestNestedName(t *testing.T) {
+	n := nestedName(Fallback{})
+	assertEquals(t, NsFallback, n.Space)
+	assertEquals(t, "fallback", n.Local)
+	n = nestedName(&Generic{XMLName: xml.Name{Space: "a", Local: "b"}})
+	assertEquals(t, "a", n.Space)
+	assertEquals(t, "b", n.Local)
+}
+
+func TestFallbackFilterRanges(t *testing.T) {
+	// Both ranges are offsets into the original body.
+	m := &Message{Body: []Text{{Chardata: "> hi\nhello /me"}},
+		Header: Header{Nested: []interface{}{
+			&Generic{XMLName: xml.Name{Space: "urn:xmpp:reply:0",
+				Local: "reply"}},
+			&Generic{XMLName: xml.Name{Space: "urn:x:test",
+				Local: "x"}}}}}
+	m.MarkFallbackRange("urn:xmpp:reply:0", 0, 5)
+	m.MarkFallbackRange("urn:x:test", 10, 14)
+	m.MarkFallback("urn:x:unknown")
+	in := make(chan Stanza, 1)
+	out := make(chan Stanza, 1)
+	in <- m
+	close(in)
+	fallbackFilter(in, out)
+	assertEquals(t, "hello", (<-out).(*Message).Body[0].Chardata)
+}
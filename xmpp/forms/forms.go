@@ -0,0 +1,179 @@
+// This package implements data forms, XEP-0004, which many other
+// XEPs embed: room configuration, registration, ad-hoc commands,
+// search, and pubsub options, among others. It doesn't depend on the
+// xmpp package, which uses it; JIDs are strings here.
+package forms
+
+import (
+	"encoding/xml"
+	"sort"
+	"strings"
+)
+
+const NsXData = "jabber:x:data"
+
+// The types of form.
+const (
+	TypeForm   = "form"
+	TypeSubmit = "submit"
+	TypeCancel = "cancel"
+	TypeResult = "result"
+)
+
+// The types of field.
+const (
+	FieldBoolean     = "boolean"
+	FieldFixed       = "fixed"
+	FieldHidden      = "hidden"
+	FieldJidMulti    = "jid-multi"
+	FieldJidSingle   = "jid-single"
+	FieldListMulti   = "list-multi"
+	FieldListSingle  = "list-single"
+	FieldTextMulti   = "text-multi"
+	FieldTextPrivate = "text-private"
+	FieldTextSingle  = "text-single"
+)
+
+// A data form. Type is form, submit, cancel, or result. A result may
+// hold a table, with the columns described by Reported and a row in
+// each of Items.
+type Form struct {
+	XMLName      xml.Name `xml:"jabber:x:data x"`
+	Type         string   `xml:"type,attr"`
+	Title        string   `xml:"title,omitempty"`
+	Instructions []string `xml:"instructions"`
+	Fields       []Field  `xml:"field"`
+	Reported     *Item    `xml:"reported"`
+	Items        []Item   `xml:"item"`
+}
+
+type Field struct {
+	Var      string    `xml:"var,attr,omitempty"`
+	Type     string    `xml:"type,attr,omitempty"`
+	Label    string    `xml:"label,attr,omitempty"`
+	Desc     string    `xml:"desc,omitempty"`
+	Required *struct{} `xml:"required"`
+	Values   []string  `xml:"value"`
+	Options  []Option  `xml:"option"`
+}
+
+// One of the choices for a list-single or list-multi field.
+type Option struct {
+	Label string `xml:"label,attr,omitempty"`
+	Value string `xml:"value"`
+}
+
+// A row of a result table, or its column headings.
+type Item struct {
+	Fields []Field `xml:"field"`
+}
+
+// Builds a form of type submit with the given FORM_TYPE and values.
+func NewSubmit(formType string, values map[string]string) *Form {
+	f := &Form{Type: "submit"}
+	f.Fields = append(f.Fields, Field{Var: "FORM_TYPE",
+		Type: "hidden", Values: []string{formType}})
+	var vars []string
+	for v := range values {
+		vars = append(vars, v)
+	}
+	sort.Strings(vars)
+	for _, v := range vars {
+		f.Fields = append(f.Fields, Field{Var: v,
+			Values: []string{values[v]}})
+	}
+	return f
+}
+
+// Returns the field with the given var, or nil.
+func (f *Form) Field(v string) *Field {
+	for i := range f.Fields {
+		if f.Fields[i].Var == v {
+			return &f.Fields[i]
+		}
+	}
+	return nil
+}
+
+// Returns the values of the field with the given var, or nil.
+func (f *Form) Values(v string) []string {
+	if field := f.Field(v); field != nil {
+		return field.Values
+	}
+	return nil
+}
+
+// Returns the first value of the field with the given var, which is
+// all a text-single or list-single field has, or the empty string.
+func (f *Form) Value(v string) string {
+	if vals := f.Values(v); len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+// Returns the lines of a text-multi field.
+func (f *Form) Text(v string) string {
+	return strings.Join(f.Values(v), "\n")
+}
+
+// Returns the value of a boolean field. The second result is false
+// if the field is missing or its value isn't a boolean.
+func (f *Form) Bool(v string) (bool, bool) {
+	switch f.Value(v) {
+	case "1", "true":
+		return true, true
+	case "0", "false":
+		return false, true
+	}
+	return false, false
+}
+
+// Returns the JIDs of a jid-single or jid-multi field.
+func (f *Form) Jids(v string) []string {
+	return f.Values(v)
+}
+
+// Sets the values of the field with the given var, adding the field
+// if the form hasn't got it.
+func (f *Form) Set(v string, values ...string) {
+	if field := f.Field(v); field != nil {
+		field.Values = values
+		return
+	}
+	f.Fields = append(f.Fields, Field{Var: v, Values: values})
+}
+
+// Sets the value of a boolean field.
+func (f *Form) SetBool(v string, b bool) {
+	if b {
+		f.Set(v, "1")
+	} else {
+		f.Set(v, "0")
+	}
+}
+
+// Sets the value of a jid-single or jid-multi field.
+func (f *Form) SetJids(v string, jids ...string) {
+	f.Set(v, jids...)
+}
+
+// Returns the answer to this form, of type submit, holding the
+// current values of its fields. Fixed fields and those without a var
+// are left out, as are labels, descriptions, and options.
+func (f *Form) Submit() *Form {
+	sub := &Form{Type: TypeSubmit}
+	for _, field := range f.Fields {
+		if field.Var == "" || field.Type == FieldFixed {
+			continue
+		}
+		sub.Fields = append(sub.Fields, Field{Var: field.Var,
+			Values: field.Values})
+	}
+	return sub
+}
+
+// Returns a form of type cancel, which declines to fill in a form.
+func Cancel() *Form {
+	return &Form{Type: TypeCancel}
+}
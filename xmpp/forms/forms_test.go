@@ -0,0 +1,95 @@
+package forms
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestForm(t *testing.T) {
+	str := `<x xmlns="jabber:x:data" type="form"><title>Config</title>` +
+		`<instructions>Fill it in</instructions>` +
+		`<field type="fixed"><value>Section</value></field>` +
+		`<field var="public" type="boolean" label="Public?">` +
+		`<required/><value>true</value></field>` +
+		`<field var="admins" type="jid-multi"><value>a@b.c</value>` +
+		`<value>d@b.c</value></field>` +
+		`<field var="color" type="list-single"><value>red</value>` +
+		`<option label="Red"><value>red</value></option>` +
+		`<option label="Blue"><value>blue</value></option></field>` +
+		`</x>`
+	var f Form
+	if err := xml.Unmarshal([]byte(str), &f); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if f.Instructions[0] != "Fill it in" {
+		t.Errorf("instructions %q", f.Instructions)
+	}
+	if b, ok := f.Bool("public"); !b || !ok {
+		t.Errorf("public %v %v", b, ok)
+	}
+	if _, ok := f.Bool("color"); ok {
+		t.Error("color is a boolean")
+	}
+	if f.Field("public").Required == nil {
+		t.Error("public isn't required")
+	}
+	jids := f.Jids("admins")
+	if len(jids) != 2 || jids[1] != "d@b.c" {
+		t.Errorf("admins %v", jids)
+	}
+	if v := f.Value("color"); v != "red" {
+		t.Errorf("color %q", v)
+	}
+	opts := f.Field("color").Options
+	if len(opts) != 2 || opts[1].Value != "blue" {
+		t.Errorf("options %v", opts)
+	}
+
+	f.SetBool("public", false)
+	f.Set("color", "blue")
+	f.SetJids("admins", "a@b.c")
+	f.Set("extra", "x")
+	buf, err := xml.Marshal(f.Submit())
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	exp := `<x xmlns="jabber:x:data" type="submit">` +
+		`<field var="public"><value>0</value></field>` +
+		`<field var="admins"><value>a@b.c</value></field>` +
+		`<field var="color"><value>blue</value></field>` +
+		`<field var="extra"><value>x</value></field></x>`
+	if string(buf) != exp {
+		t.Errorf("got %s, want %s", buf, exp)
+	}
+
+	str = `<x xmlns="jabber:x:data" type="result"><reported>` +
+		`<field var="jid"/></reported>` +
+		`<item><field var="jid"><value>a@b.c</value></field></item>` +
+		`<item><field var="jid"><value>d@b.c</value></field></item></x>`
+	f = Form{}
+	if err := xml.Unmarshal([]byte(str), &f); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if f.Reported == nil || len(f.Items) != 2 ||
+		f.Items[1].Fields[0].Values[0] != "d@b.c" {
+		t.Errorf("result %+v", f)
+	}
+}
+
+func TestNewSubmit(t *testing.T) {
+	buf, err := xml.Marshal(NewSubmit("urn:x", map[string]string{
+		"b": "2", "a": "1"}))
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	exp := `<x xmlns="jabber:x:data" type="submit">` +
+		`<field var="FORM_TYPE" type="hidden"><value>urn:x</value></field>` +
+		`<field var="a"><value>1</value></field>` +
+		`<field var="b"><value>2</value></field></x>`
+	if string(buf) != exp {
+		t.Errorf("got %s, want %s", buf, exp)
+	}
+	if Cancel().Type != TypeCancel {
+		t.Errorf("cancel %+v", Cancel())
+	}
+}
@@ -0,0 +1,100 @@
+package xmpp
+
+// This file contains support for stanza forwarding, XEP-0297, which
+// other extensions use to carry whole stanzas inside others.
+
+import (
+	"encoding/xml"
+	"reflect"
+	"time"
+)
+
+const NsForward = "urn:xmpp:forward:0"
+
+// A forwarded stanza, and when it was originally sent. One of
+// Message, Presence and Iq is set. Carbons, archives and others carry
+// stanzas this way, and the payloads of the carried stanza are
+// decoded with the client's extensions like those of any other.
+type Forwarded struct {
+	XMLName  xml.Name `xml:"urn:xmpp:forward:0 forwarded"`
+	Delay    *Delay
+	Message  *Message  `xml:"jabber:client message"`
+	Presence *Presence `xml:"jabber:client presence"`
+	Iq       *Iq       `xml:"jabber:client iq"`
+}
+
+// ForwardExt may be included in the extensions passed to NewClient to
+// decode stanzas forwarded directly in messages, as when a contact
+// passes a message on. Extensions which carry stanzas in their own
+// payloads, like CarbonsExt, decode those themselves.
+var ForwardExt Extension = Extension{}
+
+func init() {
+	ForwardExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	name := xml.Name{Space: NsForward, Local: "forwarded"}
+	ForwardExt.StanzaTypes[name] = reflect.TypeOf(Forwarded{})
+}
+
+// Wraps a stanza for forwarding, noting when it was originally sent
+// unless stamp is zero.
+func NewForwarded(st Stanza, stamp time.Time) *Forwarded {
+	f := &Forwarded{}
+	if !stamp.IsZero() {
+		f.Delay = &Delay{Stamp: stamp}
+	}
+	switch st := st.(type) {
+	case *Message:
+		f.Message = st
+	case *Presence:
+		f.Presence = st
+	case *Iq:
+		f.Iq = st
+	}
+	return f
+}
+
+// Returns the forwarded stanza, or nil if there isn't one.
+func (f *Forwarded) Stanza() Stanza {
+	switch {
+	case f.Message != nil:
+		return f.Message
+	case f.Presence != nil:
+		return f.Presence
+	case f.Iq != nil:
+		return f.Iq
+	}
+	return nil
+}
+
+// Returns when the forwarded stanza was originally sent, or the zero
+// time if that isn't known.
+func (f *Forwarded) Stamp() time.Time {
+	if f.Delay == nil {
+		return time.Time{}
+	}
+	return f.Delay.Stamp
+}
+
+// Returns the stanzas forwarded directly in a message.
+func (m *Message) Forwarded() []*Forwarded {
+	var res []*Forwarded
+	for _, ele := range m.Nested {
+		if f, ok := ele.(*Forwarded); ok {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// Implemented by payloads which carry whole stanzas, so that the
+// payloads of those stanzas are decoded too.
+type stanzaCarrier interface {
+	carried() []*Header
+}
+
+func (f *Forwarded) carried() []*Header {
+	if st := f.Stanza(); st != nil {
+		return []*Header{st.GetHeader()}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestForwarded(t *testing.T) {
+	str := `<message xmlns="jabber:client" from="al@b.c/pc" to="me@b.c">` +
+		`<forwarded xmlns="` + NsForward + `"><delay xmlns="` + NsDelay +
+		`" stamp="2010-07-10T23:08:25Z"/><message xmlns="jabber:client" ` +
+		`from="Bo@B.c/x" to="al@b.c" id="m1"><body>hi</body><request ` +
+		`xmlns="` + NsReceipts + `"/></message></forwarded>` +
+		`<forwarded xmlns="` + NsForward + `"><presence ` +
+		`xmlns="jabber:client" from="bo@b.c/x"><show>away</show>` +
+		`</presence></forwarded></message>`
+	var m Message
+	if err := xml.Unmarshal([]byte(str), &m); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	types := mergeStanzaTypes(ForwardExt, ReceiptsExt)
+	if err := parseExtended(&m.Header, types); err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	fwds := m.Forwarded()
+	if len(fwds) != 2 {
+		t.Fatalf("forwarded %v", m.Nested)
+	}
+	msg, ok := fwds[0].Stanza().(*Message)
+	if !ok {
+		t.Fatalf("first forwarded %#v", fwds[0].Stanza())
+	}
+	// Carried stanzas are decoded like any others.
+	assertEquals(t, "bo@b.c/x", string(msg.From))
+	if len(msg.Nested) != 1 {
+		t.Errorf("carried payloads %v", msg.Nested)
+	} else if _, ok := msg.Nested[0].(*ReceiptRequest); !ok {
+		t.Errorf("carried payload %T", msg.Nested[0])
+	}
+	stamp := time.Date(2010, 7, 10, 23, 8, 25, 0, time.UTC)
+	if !fwds[0].Stamp().Equal(stamp) {
+		t.Errorf("stamp %v", fwds[0].Stamp())
+	}
+	pr, ok := fwds[1].Stanza().(*Presence)
+	if !ok || pr.Show == nil || pr.Show.Chardata != "away" {
+		t.Errorf("second forwarded %#v", fwds[1].Stanza())
+	}
+	if !fwds[1].Stamp().IsZero() {
+		t.Errorf("stamp %v", fwds[1].Stamp())
+	}
+
+	f := NewForwarded(&Message{Header: Header{To: "al@b.c", Id: "m2"},
+		Body: []Text{{Chardata: "yo"}}}, stamp)
+	exp := `<forwarded xmlns="` + NsForward + `"><delay xmlns="` +
+		NsDelay + `" stamp="2010-07-10T23:08:25Z"></delay><message ` +
+		`xmlns="jabber:client" to="al@b.c" id="m2"><body xmlns="jabber:client">yo</body>` +
+		`</message></forwarded>`
+	assertMarshal(t, exp, f)
+}
@@ -0,0 +1,162 @@
+package xmpp
+
+// This file contains gateway interaction, XEP-0100: finding the
+// gateways to other networks a server offers, registering with them,
+// and addressing the contacts on those networks.
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+const NsGateway = "jabber:iq:gateway"
+
+// Asks a gateway how to address contacts on its network, or tells it
+// a contact's address there. In the gateway's answer to a get, Desc
+// and Prompt describe what the address looks like; in its answer to a
+// set, Jid is the contact's JID.
+type GatewayQuery struct {
+	XMLName xml.Name `xml:"jabber:iq:gateway query"`
+	Desc    string   `xml:"desc,omitempty"`
+	Prompt  *string  `xml:"prompt"`
+	Jid     JID      `xml:"jid,omitempty"`
+}
+
+// A gateway to another network.
+type Gateway struct {
+	Jid  JID
+	Name string
+	// The network, the type of the gateway's identity, such as
+	// "irc" or "sms".
+	Type string
+}
+
+// GatewayExt must be included in the extensions passed to NewClient
+// to use gateways.
+var GatewayExt Extension = Extension{}
+
+func init() {
+	GatewayExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	rName := xml.Name{Space: NsRegister, Local: "query"}
+	GatewayExt.StanzaTypes[rName] = reflect.TypeOf(RegisterQuery{})
+	gName := xml.Name{Space: NsGateway, Local: "query"}
+	GatewayExt.StanzaTypes[gName] = reflect.TypeOf(GatewayQuery{})
+}
+
+// Returns the gateways among the server's services.
+func (cl *Client) Gateways(ctx context.Context) ([]Gateway, error) {
+	items, err := cl.DiscoItems(ctx, JID(cl.Jid.Domain()), "")
+	if err != nil {
+		return nil, err
+	}
+	var gws []Gateway
+	for _, item := range items.Items {
+		di, err := cl.DiscoInfo(ctx, item.Jid, "")
+		if err != nil {
+			continue
+		}
+		for _, id := range di.Identities {
+			if id.Category == "gateway" {
+				gws = append(gws, Gateway{Jid: item.Jid,
+					Name: id.Name, Type: id.Type})
+				break
+			}
+		}
+	}
+	return gws, nil
+}
+
+// Asks a gateway what it needs to register us with it, such as our
+// username and password on its network. Fill in the fields that are
+// present, or the form, and pass the query to RegisterGateway. If
+// Registered is set, we're registered already, and the fields hold
+// what we registered with.
+func (cl *Client) GatewayRegistration(ctx context.Context,
+	gw JID) (*RegisterQuery, error) {
+
+	iq := &Iq{Header: Header{To: gw, Type: "get",
+		Nested: []interface{}{&RegisterQuery{}}}}
+	st, err := cl.SendIq(ctx, iq)
+	if err != nil {
+		return nil, err
+	}
+	return registerReply(st)
+}
+
+// Registers with a gateway, with a query from GatewayRegistration. If
+// it has a form, the form's current values are submitted. The gateway
+// then asks to subscribe to our presence, which is to be approved,
+// and may add our contacts on its network to the roster. Registering
+// again changes what we registered with.
+func (cl *Client) RegisterGateway(ctx context.Context, gw JID,
+	q *RegisterQuery) error {
+
+	iq := &Iq{Header: Header{To: gw, Type: "set",
+		Nested: []interface{}{q.submission()}}}
+	_, err := cl.SendIq(ctx, iq)
+	return err
+}
+
+// Unregisters from a gateway. Contacts on its network stay in the
+// roster, along with the gateway itself, until they're removed.
+func (cl *Client) UnregisterGateway(ctx context.Context, gw JID) error {
+	iq := &Iq{Header: Header{To: gw, Type: "set",
+		Nested: []interface{}{&RegisterQuery{Remove: &struct{}{}}}}}
+	_, err := cl.SendIq(ctx, iq)
+	return err
+}
+
+// Asks a gateway what addresses on its network look like. It returns
+// a description for people, and the label of the field to enter one
+// in, such as "Phone number".
+func (cl *Client) GatewayPrompt(ctx context.Context,
+	gw JID) (desc, prompt string, err error) {
+
+	q, err := cl.gatewayIq(ctx, gw, "get", &GatewayQuery{})
+	if err != nil {
+		return "", "", err
+	}
+	if q.Prompt != nil {
+		prompt = *q.Prompt
+	}
+	return q.Desc, prompt, nil
+}
+
+// Asks a gateway for the JID of a contact with the given address on
+// its network, escaped the way the gateway escapes them.
+func (cl *Client) GatewayJid(ctx context.Context, gw JID,
+	address string) (JID, error) {
+
+	q, err := cl.gatewayIq(ctx, gw, "set", &GatewayQuery{Prompt: &address})
+	if err != nil {
+		return "", err
+	}
+	if q.Jid != "" {
+		return q.Jid, nil
+	}
+	// Older gateways answer with the JID in the prompt.
+	if q.Prompt != nil && *q.Prompt != "" {
+		return JID(*q.Prompt), nil
+	}
+	return "", fmt.Errorf("%s gave no JID for %q", gw, address)
+}
+
+func (cl *Client) gatewayIq(ctx context.Context, gw JID, typ string,
+	q *GatewayQuery) (*GatewayQuery, error) {
+
+	iq := &Iq{Header: Header{To: gw, Type: typ,
+		Nested: []interface{}{q}}}
+	reply, err := cl.SendIq(ctx, iq)
+	if err != nil {
+		return nil, err
+	}
+	for _, ele := range reply.Nested {
+		if res, ok := ele.(*GatewayQuery); ok {
+			return res, nil
+		}
+	}
+	return nil, errors.New("no gateway query in reply")
+}
@@ -0,0 +1,89 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+)
+
+func TestGateways(t *testing.T) {
+	send := make(chan Stanza, 1)
+	cl := &Client{Jid: "me@b.c/r", handlers: make(chan *callback, 1),
+		Send: send}
+	asked := make(chan string, 1)
+	replies := make(chan interface{}, 3)
+	go func() {
+		for {
+			h := <-cl.handlers
+			iq := (<-send).(*Iq)
+			buf, _ := xml.Marshal(iq.Nested[0])
+			asked <- iq.Type + " " + string(iq.To) + " " + string(buf)
+			h.f(&Iq{Header: Header{Id: iq.Id, Type: "result",
+				Nested: []interface{}{<-replies}}})
+		}
+	}()
+	ctx := context.Background()
+
+	replies <- &DiscoItems{Items: []DiscoItem{{Jid: "muc.b.c"},
+		{Jid: "irc.b.c"}}}
+	replies <- &DiscoInfo{Identities: []DiscoIdentity{{
+		Category: "conference", Type: "text"}}}
+	replies <- &DiscoInfo{Identities: []DiscoIdentity{{
+		Category: "gateway", Type: "irc", Name: "IRC"}}}
+	go func() {
+		for i := 0; i < 3; i++ {
+			<-asked
+		}
+	}()
+	gws, err := cl.Gateways(ctx)
+	if err != nil || len(gws) != 1 || gws[0] != (Gateway{Jid: "irc.b.c",
+		Name: "IRC", Type: "irc"}) {
+		t.Fatalf("Gateways: %+v %v", gws, err)
+	}
+
+	empty := ""
+	replies <- &RegisterQuery{Instructions: "Your nick",
+		Username: &empty, Password: &empty}
+	q, err := cl.GatewayRegistration(ctx, "irc.b.c")
+	assertEquals(t, `get irc.b.c <query xmlns="`+NsRegister+`"></query>`,
+		<-asked)
+	if err != nil || q.Username == nil || q.Registered != nil {
+		t.Fatalf("GatewayRegistration: %+v %v", q, err)
+	}
+	user, pass := "al", "secret"
+	q.Username, q.Password = &user, &pass
+	replies <- nil
+	if err := cl.RegisterGateway(ctx, "irc.b.c", q); err != nil {
+		t.Fatalf("RegisterGateway: %v", err)
+	}
+	assertEquals(t, `set irc.b.c <query xmlns="`+NsRegister+`">`+
+		`<username>al</username><password>secret</password></query>`,
+		<-asked)
+
+	prompt := "Nick"
+	replies <- &GatewayQuery{Desc: "Enter a nick", Prompt: &prompt}
+	desc, p, err := cl.GatewayPrompt(ctx, "irc.b.c")
+	<-asked
+	if err != nil || desc != "Enter a nick" || p != "Nick" {
+		t.Errorf("GatewayPrompt: %q %q %v", desc, p, err)
+	}
+	replies <- &GatewayQuery{Jid: `bo\40net@irc.b.c`}
+	jid, err := cl.GatewayJid(ctx, "irc.b.c", "bo@net")
+	assertEquals(t, `set irc.b.c <query xmlns="`+NsGateway+`">`+
+		`<prompt>bo@net</prompt></query>`, <-asked)
+	if err != nil || jid != `bo\40net@irc.b.c` {
+		t.Errorf("GatewayJid: %q %v", jid, err)
+	}
+	// The way older gateways answer.
+	replies <- &GatewayQuery{Prompt: &prompt}
+	jid, _ = cl.GatewayJid(ctx, "irc.b.c", "x")
+	<-asked
+	assertEquals(t, prompt, string(jid))
+
+	replies <- nil
+	if err := cl.UnregisterGateway(ctx, "irc.b.c"); err != nil {
+		t.Fatalf("UnregisterGateway: %v", err)
+	}
+	assertEquals(t, `set irc.b.c <query xmlns="`+NsRegister+`">`+
+		`<remove></remove></query>`, <-asked)
+}
@@ -0,0 +1,55 @@
+package xmpp
+
+// This file contains support for user location, XEP-0080.
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+const NsGeoloc = "http://jabber.org/protocol/geoloc"
+
+// Where a user is. The coordinates are pointers, since zero is a
+// place like any other; nil ones are left out. A Geoloc with nothing
+// set says the user has stopped publishing their location.
+type Geoloc struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/geoloc geoloc"`
+	// Latitude and longitude in decimal degrees, and altitude in
+	// meters above or below sea level, in Datum, which is WGS84 if
+	// it's empty.
+	Lat   *float64 `xml:"lat,omitempty"`
+	Lon   *float64 `xml:"lon,omitempty"`
+	Alt   *float64 `xml:"alt,omitempty"`
+	Datum string   `xml:"datum,omitempty"`
+	// The horizontal and vertical accuracy, in meters.
+	Accuracy    *float64 `xml:"accuracy,omitempty"`
+	AltAccuracy *float64 `xml:"altaccuracy,omitempty"`
+	// The direction of travel, in degrees from true north, and the
+	// speed, in meters per second.
+	Bearing *float64 `xml:"bearing,omitempty"`
+	Speed   *float64 `xml:"speed,omitempty"`
+	// The address, from the largest place to the smallest.
+	Country     string `xml:"country,omitempty"`
+	CountryCode string `xml:"countrycode,omitempty"`
+	Region      string `xml:"region,omitempty"`
+	Locality    string `xml:"locality,omitempty"`
+	Area        string `xml:"area,omitempty"`
+	PostalCode  string `xml:"postalcode,omitempty"`
+	Street      string `xml:"street,omitempty"`
+	Building    string `xml:"building,omitempty"`
+	Floor       string `xml:"floor,omitempty"`
+	Room        string `xml:"room,omitempty"`
+	// A description of the place, and text about it.
+	Description string `xml:"description,omitempty"`
+	Text        string `xml:"text,omitempty"`
+	// When the user was there, and the offset of their time zone,
+	// such as "-07:00".
+	Timestamp *time.Time `xml:"timestamp,omitempty"`
+	Tzo       string     `xml:"tzo,omitempty"`
+	Uri       string     `xml:"uri,omitempty"`
+}
+
+// Whether the location says the user has stopped publishing it.
+func (g *Geoloc) Stopped() bool {
+	return *g == Geoloc{XMLName: g.XMLName}
+}
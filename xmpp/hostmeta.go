@@ -0,0 +1,191 @@
+package xmpp
+
+// This file contains discovering the WebSocket and BOSH endpoints a
+// domain advertises in its host-meta, XEP-0156, for domains served
+// from web hosting which can only be reached over HTTP.
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// The link relations of the endpoints.
+const (
+	NsAltWebSocket = "urn:xmpp:alt-connections:websocket"
+	NsAltBosh      = "urn:xmpp:alt-connections:xbosh"
+)
+
+// The largest host-meta document we'll read.
+const hostMetaMax = 64 << 10
+
+// The endpoints a domain's host-meta lists, in its order.
+type HostMeta struct {
+	WebSocket []string
+	Bosh      []string
+}
+
+// Host-meta as XRD, RFC 6415.
+type hostMetaXrd struct {
+	XMLName xml.Name `xml:"http://docs.oasis-open.org/ns/xri/xrd-1.0 XRD"`
+	Links   []struct {
+		Rel  string `xml:"rel,attr"`
+		Href string `xml:"href,attr"`
+	} `xml:"Link"`
+}
+
+// Host-meta as JSON.
+type hostMetaJrd struct {
+	Links []struct {
+		Rel  string `json:"rel"`
+		Href string `json:"href"`
+	} `json:"links"`
+}
+
+func (hm *HostMeta) add(rel, href string) {
+	switch rel {
+	case NsAltWebSocket:
+		hm.WebSocket = append(hm.WebSocket, href)
+	case NsAltBosh:
+		hm.Bosh = append(hm.Bosh, href)
+	}
+}
+
+// Makes the requests of HostMetaExt without a Dialer. Replaced by the
+// tests.
+var hostMetaClient = http.DefaultClient
+
+// Returns the client which fetches host-meta through the Dialer, if
+// there is one.
+func hostMetaHttp(d Dialer) *http.Client {
+	if d == nil {
+		return hostMetaClient
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = nil
+	tr.DialContext = d.DialContext
+	return &http.Client{Transport: tr}
+}
+
+// Fetches a domain's host-meta, as JSON from
+// /.well-known/host-meta.json, or failing that as XRD from
+// /.well-known/host-meta. Only HTTPS is used, since what an
+// unauthenticated document says can't be trusted. A nil client means
+// http.DefaultClient.
+func LookupHostMeta(ctx context.Context, client *http.Client,
+	domain string) (*HostMeta, error) {
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	base := "https://" + domain + "/.well-known/host-meta"
+	var hm HostMeta
+	buf, jsonErr := fetchHostMeta(ctx, client, base+".json")
+	if jsonErr == nil {
+		var jrd hostMetaJrd
+		if jsonErr = json.Unmarshal(buf, &jrd); jsonErr == nil {
+			for _, l := range jrd.Links {
+				hm.add(l.Rel, l.Href)
+			}
+			return &hm, nil
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	buf, err := fetchHostMeta(ctx, client, base)
+	if err != nil {
+		return nil, fmt.Errorf("host-meta: %v; %v", jsonErr, err)
+	}
+	var xrd hostMetaXrd
+	if err := xml.Unmarshal(buf, &xrd); err != nil {
+		return nil, fmt.Errorf("host-meta: %v", err)
+	}
+	for _, l := range xrd.Links {
+		hm.add(l.Rel, l.Href)
+	}
+	return &hm, nil
+}
+
+func fetchHostMeta(ctx context.Context, client *http.Client,
+	url string) ([]byte, error) {
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, hostMetaMax))
+}
+
+// Returns an extension which makes NewClient, and NewClientContext,
+// look up the host-meta of a domain which has no SRV records, and
+// connect to the first of its WebSocket endpoints, and then its BOSH
+// ones, which answers, before trying the domain itself on the
+// standard port.
+func HostMetaExt() Extension {
+	return Extension{option: func(o *options) {
+		o.hostMeta = true
+	}}
+}
+
+// Returns a Transport which connects to the endpoints the domain's
+// host-meta lists, as HostMetaExt does, for NewClientWithFailover.
+func HostMetaTransport(tlsconf *tls.Config) Transport {
+	return Transport{Name: "hostmeta",
+		Dial: func(ctx context.Context, domain string) (net.Conn, error) {
+			return dialHostMeta(ctx, hostMetaClient, domain, tlsconf)
+		}}
+}
+
+// Connects to the first of the host-meta's endpoints which answers.
+// The certificates of the endpoints are verified against their own
+// hosts, which host-meta served over HTTPS vouches for, rather than
+// against the domain.
+func dialHostMeta(ctx context.Context, client *http.Client, domain string,
+	tlsconf *tls.Config) (net.Conn, error) {
+
+	hm, err := LookupHostMeta(ctx, client, domain)
+	if err != nil {
+		return nil, err
+	}
+	if tlsconf != nil {
+		tlsconf = tlsconf.Clone()
+		tlsconf.ServerName = ""
+	}
+	var errs []error
+	for _, u := range hm.WebSocket {
+		conn, err := DialWebSocket(ctx, u, tlsconf)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	for _, u := range hm.Bosh {
+		conn, err := DialBosh(ctx, u, tlsconf)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("host-meta lists no endpoints")
+	}
+	return nil, fmt.Errorf("host-meta endpoints failed: %v", errs)
+}
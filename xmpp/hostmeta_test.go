@@ -0,0 +1,87 @@
+package xmpp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Serves host-meta documents by path.
+func hostMetaServer(docs map[string]string) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		doc, ok := docs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(doc))
+	}))
+}
+
+func TestLookupHostMeta(t *testing.T) {
+	srv := hostMetaServer(map[string]string{
+		"/.well-known/host-meta.json": `{"links":[` +
+			`{"rel":"` + NsAltWebSocket + `","href":"wss://a/ws"},` +
+			`{"rel":"` + NsAltBosh + `","href":"https://a/bosh"},` +
+			`{"rel":"other","href":"https://a/x"}]}`,
+	})
+	defer srv.Close()
+	ctx := context.Background()
+	domain := srv.Listener.Addr().String()
+	hm, err := LookupHostMeta(ctx, srv.Client(), domain)
+	if err != nil {
+		t.Fatalf("LookupHostMeta: %v", err)
+	}
+	if len(hm.WebSocket) != 1 || hm.WebSocket[0] != "wss://a/ws" ||
+		len(hm.Bosh) != 1 || hm.Bosh[0] != "https://a/bosh" {
+		t.Errorf("got %+v", hm)
+	}
+	srv.Close()
+
+	// Without JSON, the XRD is read.
+	srv = hostMetaServer(map[string]string{
+		"/.well-known/host-meta": `<?xml version="1.0"?><XRD xmlns=` +
+			`"http://docs.oasis-open.org/ns/xri/xrd-1.0"><Link rel="` +
+			NsAltBosh + `" href="https://b/bosh"/></XRD>`,
+	})
+	defer srv.Close()
+	domain = srv.Listener.Addr().String()
+	hm, err = LookupHostMeta(ctx, srv.Client(), domain)
+	if err != nil {
+		t.Fatalf("LookupHostMeta XRD: %v", err)
+	}
+	if len(hm.WebSocket) != 0 || len(hm.Bosh) != 1 ||
+		hm.Bosh[0] != "https://b/bosh" {
+		t.Errorf("got %+v", hm)
+	}
+
+	if _, err := LookupHostMeta(ctx, srv.Client(), "127.0.0.1:1"); err == nil {
+		t.Errorf("no error without a server")
+	}
+}
+
+func TestHostMetaExt(t *testing.T) {
+	// The WebSocket endpoint doesn't answer, so the BOSH one is used.
+	srv := hostMetaServer(map[string]string{
+		"/.well-known/host-meta.json": `{"links":[` +
+			`{"rel":"` + NsAltWebSocket + `","href":"ws://127.0.0.1:1/"},` +
+			`{"rel":"` + NsAltBosh + `","href":"https://c/bosh"}]}`,
+	})
+	defer srv.Close()
+	saved := hostMetaClient
+	hostMetaClient = srv.Client()
+	defer func() { hostMetaClient = saved }()
+	defer fakeSRV(map[string][]*net.SRV{}, nil)()
+
+	o := newOptions([]Extension{HostMetaExt()})
+	conn, err := dialDomain(context.Background(), &o,
+		srv.Listener.Addr().String(), nil, DirectTlsNever)
+	if err != nil {
+		t.Fatalf("dialDomain: %v", err)
+	}
+	defer conn.Close()
+	assertEquals(t, "https://c/bosh", conn.RemoteAddr().String())
+}
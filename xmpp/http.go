@@ -0,0 +1,308 @@
+package xmpp
+
+// This file contains support for tunneling HTTP requests and
+// responses over XMPP, XEP-0332.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	NsHttp = "urn:xmpp:http"
+	NsShim = "http://jabber.org/protocol/shim"
+)
+
+// An HTTP request, carried in an iq set.
+type HttpReq struct {
+	XMLName  xml.Name     `xml:"urn:xmpp:http req"`
+	Method   string       `xml:"method,attr"`
+	Resource string       `xml:"resource,attr"`
+	Version  string       `xml:"version,attr"`
+	Headers  *ShimHeaders `xml:"http://jabber.org/protocol/shim headers"`
+	Data     *HttpData    `xml:"urn:xmpp:http data"`
+}
+
+// An HTTP response, carried in the iq result.
+type HttpResp struct {
+	XMLName       xml.Name     `xml:"urn:xmpp:http resp"`
+	Version       string       `xml:"version,attr"`
+	StatusCode    int          `xml:"statusCode,attr"`
+	StatusMessage string       `xml:"statusMessage,attr,omitempty"`
+	Headers       *ShimHeaders `xml:"http://jabber.org/protocol/shim headers"`
+	Data          *HttpData    `xml:"urn:xmpp:http data"`
+}
+
+// Stanza headers, XEP-0131.
+type ShimHeaders struct {
+	Header []ShimHeader `xml:"http://jabber.org/protocol/shim header"`
+}
+
+type ShimHeader struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+// The body of an HTTP request or response. Only one of the fields
+// should be set.
+type HttpData struct {
+	Text   *string `xml:"urn:xmpp:http text"`
+	Base64 *string `xml:"urn:xmpp:http base64"`
+	Xml    *struct {
+		Inner string `xml:",innerxml"`
+	} `xml:"urn:xmpp:http xml"`
+}
+
+// HttpExt may be included in the extensions passed to NewClient to
+// decode HTTP requests and responses in incoming iq stanzas. It's
+// needed by HttpTransport.
+var HttpExt Extension = Extension{}
+
+func init() {
+	HttpExt.StanzaTypes = httpStanzaTypes()
+}
+
+func httpStanzaTypes() map[xml.Name]reflect.Type {
+	m := make(map[xml.Name]reflect.Type)
+	m[xml.Name{Space: NsHttp, Local: "req"}] = reflect.TypeOf(HttpReq{})
+	m[xml.Name{Space: NsHttp, Local: "resp"}] = reflect.TypeOf(HttpResp{})
+	return m
+}
+
+func newShimHeaders(h http.Header) *ShimHeaders {
+	if len(h) == 0 {
+		return nil
+	}
+	sh := &ShimHeaders{}
+	for name, values := range h {
+		for _, v := range values {
+			sh.Header = append(sh.Header, ShimHeader{Name: name,
+				Value: v})
+		}
+	}
+	return sh
+}
+
+func (sh *ShimHeaders) httpHeader() http.Header {
+	h := make(http.Header)
+	if sh != nil {
+		for _, hdr := range sh.Header {
+			h.Add(hdr.Name, hdr.Value)
+		}
+	}
+	return h
+}
+
+func newHttpData(body []byte) *HttpData {
+	if len(body) == 0 {
+		return nil
+	}
+	enc := base64.StdEncoding.EncodeToString(body)
+	return &HttpData{Base64: &enc}
+}
+
+func (d *HttpData) bytes() ([]byte, error) {
+	switch {
+	case d == nil:
+		return nil, nil
+	case d.Base64 != nil:
+		return base64.StdEncoding.DecodeString(
+			strings.TrimSpace(*d.Base64))
+	case d.Text != nil:
+		return []byte(*d.Text), nil
+	case d.Xml != nil:
+		return []byte(d.Xml.Inner), nil
+	}
+	return nil, nil
+}
+
+// HttpTransport is an http.RoundTripper which sends requests to an
+// XMPP entity, which must be included in the request URL's host (as
+// in httpx://device@example.com/path) unless To is set. The client
+// must have been created with HttpExt.
+type HttpTransport struct {
+	Client *Client
+	To     JID
+}
+
+var _ http.RoundTripper = &HttpTransport{}
+
+func (t *HttpTransport) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+
+	to := t.To
+	if to == "" {
+		to = JID(req.URL.Host)
+		if req.URL.User != nil {
+			to = JID(req.URL.User.Username() + "@" + req.URL.Host)
+		}
+	}
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	resource := req.URL.RequestURI()
+	hreq := &HttpReq{Method: req.Method, Resource: resource,
+		Version: "1.1", Headers: newShimHeaders(req.Header),
+		Data: newHttpData(body)}
+	iq := &Iq{Header: Header{To: to, Type: "set",
+		Nested: []interface{}{hreq}}}
+	reply, err := t.Client.SendIq(req.Context(), iq)
+	if err != nil {
+		return nil, err
+	}
+	var hresp *HttpResp
+	for _, ele := range reply.Nested {
+		if r, ok := ele.(*HttpResp); ok {
+			hresp = r
+			break
+		}
+	}
+	if hresp == nil {
+		return nil, fmt.Errorf("no HTTP response in %#v", reply)
+	}
+	body, err = hresp.Data.bytes()
+	if err != nil {
+		return nil, err
+	}
+	status := fmt.Sprintf("%d %s", hresp.StatusCode,
+		hresp.StatusMessage)
+	resp := &http.Response{Status: status, StatusCode: hresp.StatusCode,
+		Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1,
+		Header:        hresp.Headers.httpHeader(),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)), Request: req}
+	return resp, nil
+}
+
+// HttpServer is an extension which answers HTTP requests arriving
+// over XMPP by passing them to an http.Handler. The requests are
+// consumed and will not appear on Client.Recv.
+type HttpServer struct {
+	Extension
+	handler  http.Handler
+	toServer chan Stanza
+	sendDone chan bool
+}
+
+// Creates an HttpServer extension, to be passed to NewClient.
+func NewHttpServer(h http.Handler) *HttpServer {
+	s := &HttpServer{handler: h, toServer: make(chan Stanza),
+		sendDone: make(chan bool)}
+	s.StanzaTypes = httpStanzaTypes()
+	s.RecvFilter = s.recvFilter
+	s.SendFilter = s.sendFilter
+	return s
+}
+
+func (s *HttpServer) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for stan := range in {
+		if iq, ok := stan.(*Iq); ok && iq.Type == "set" {
+			var hreq *HttpReq
+			for _, ele := range iq.Nested {
+				if r, ok := ele.(*HttpReq); ok {
+					hreq = r
+					break
+				}
+			}
+			if hreq != nil {
+				go s.serve(iq, hreq)
+				continue
+			}
+		}
+		out <- stan
+	}
+}
+
+func (s *HttpServer) sendFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	defer close(s.sendDone)
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			out <- stan
+		case stan := <-s.toServer:
+			out <- stan
+		}
+	}
+}
+
+func (s *HttpServer) serve(iq *Iq, hreq *HttpReq) {
+	reply := &Iq{Header: Header{To: iq.From, Id: iq.Id, Type: "result"}}
+	body, err := hreq.Data.bytes()
+	var req *http.Request
+	if err == nil {
+		req, err = http.NewRequest(hreq.Method, hreq.Resource,
+			bytes.NewReader(body))
+	}
+	if err != nil {
+		reply.Type = "error"
+		reply.Error = &Error{Type: "modify"}
+		s.reply(reply)
+		return
+	}
+	req.Header = hreq.Headers.httpHeader()
+	req.Host = req.Header.Get("Host")
+	req.RemoteAddr = string(iq.From)
+
+	w := &httpResponseWriter{header: make(http.Header)}
+	s.handler.ServeHTTP(w, req)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.header.Set("Content-Length", strconv.Itoa(w.body.Len()))
+	reply.Nested = []interface{}{&HttpResp{Version: "1.1",
+		StatusCode:    w.status,
+		StatusMessage: http.StatusText(w.status),
+		Headers:       newShimHeaders(w.header),
+		Data:          newHttpData(w.body.Bytes())}}
+	s.reply(reply)
+}
+
+// Sends a reply, unless the client has closed while the handler ran.
+func (s *HttpServer) reply(iq *Iq) {
+	select {
+	case s.toServer <- iq:
+	case <-s.sendDone:
+	}
+}
+
+// Collects the response written by an http.Handler.
+type httpResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *httpResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *httpResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *httpResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+var _ http.ResponseWriter = &httpResponseWriter{}
@@ -0,0 +1,95 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHttpReqUnmarshal(t *testing.T) {
+	str := `<iq xmlns="jabber:client" type="set" id="1"><req xmlns="` +
+		NsHttp + `" method="GET" resource="/api?x=1" version="1.1">` +
+		`<headers xmlns="` + NsShim + `"><header name="Host">dev</header>` +
+		`</headers><data><text>hi</text></data></req></iq>`
+	iq := Iq{}
+	xml.Unmarshal([]byte(str), &iq)
+	err := parseExtended(&iq.Header, HttpExt.StanzaTypes)
+	if err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	if len(iq.Nested) != 1 {
+		t.Fatalf("wrong size nested: %v", iq.Nested)
+	}
+	req, ok := iq.Nested[0].(*HttpReq)
+	if !ok {
+		t.Fatalf("nested not HttpReq: %T", iq.Nested[0])
+	}
+	assertEquals(t, "GET", req.Method)
+	assertEquals(t, "/api?x=1", req.Resource)
+	assertEquals(t, "dev", req.Headers.httpHeader().Get("Host"))
+	body, err := req.Data.bytes()
+	if err != nil {
+		t.Fatalf("data: %v", err)
+	}
+	assertEquals(t, "hi", string(body))
+}
+
+func TestHttpServer(t *testing.T) {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusTeapot)
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}
+	s := NewHttpServer(http.HandlerFunc(h))
+	recvIn := make(chan Stanza)
+	recvOut := make(chan Stanza)
+	go s.RecvFilter(recvIn, recvOut)
+	sendIn := make(chan Stanza)
+	sendOut := make(chan Stanza)
+	go s.SendFilter(sendIn, sendOut)
+	defer close(sendIn)
+	defer close(recvIn)
+
+	iq := &Iq{Header: Header{From: "a@b.c/d", Id: "7", Type: "set",
+		Nested: []interface{}{&HttpReq{Method: "POST",
+			Resource: "/pot", Version: "1.1"}}}}
+	recvIn <- iq
+	reply, ok := (<-sendOut).(*Iq)
+	if !ok {
+		t.Fatalf("reply not Iq")
+	}
+	assertEquals(t, "7", reply.Id)
+	assertEquals(t, "a@b.c/d", string(reply.To))
+	assertEquals(t, "result", reply.Type)
+	resp := reply.Nested[0].(*HttpResp)
+	if resp.StatusCode != http.StatusTeapot {
+		t.Errorf("status %d", resp.StatusCode)
+	}
+	assertEquals(t, "text/plain", resp.Headers.httpHeader().Get("Content-Type"))
+	body, _ := resp.Data.bytes()
+	assertEquals(t, "POST /pot", string(body))
+}
+
+func TestHttpServerClosed(t *testing.T) {
+	s := NewHttpServer(http.NotFoundHandler())
+	sendIn := make(chan Stanza)
+	sendOut := make(chan Stanza)
+	go s.SendFilter(sendIn, sendOut)
+	close(sendIn)
+	<-sendOut
+
+	// A request which finishes after the client closed.
+	done := make(chan bool)
+	go func() {
+		s.serve(&Iq{Header: Header{Id: "1", Type: "set"}},
+			&HttpReq{Method: "GET", Resource: "/"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reply blocked after close")
+	}
+}
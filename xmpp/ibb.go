@@ -0,0 +1,445 @@
+package xmpp
+
+// This file contains in-band bytestreams, XEP-0047: a stream of
+// bytes between two entities, carried in iq stanzas through their
+// servers. It's slow, but works wherever XMPP does.
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const NsIbb = "http://jabber.org/protocol/ibb"
+
+// Asks to open a stream. Blocks are at most BlockSize bytes before
+// they're base64 encoded.
+type IbbOpen struct {
+	XMLName   xml.Name `xml:"http://jabber.org/protocol/ibb open"`
+	BlockSize int      `xml:"block-size,attr"`
+	Sid       string   `xml:"sid,attr"`
+	Stanza    string   `xml:"stanza,attr,omitempty"`
+}
+
+// One block of a stream. Seq counts the blocks from 0, wrapping
+// around after 65535.
+type IbbData struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/ibb data"`
+	Seq     uint16   `xml:"seq,attr"`
+	Sid     string   `xml:"sid,attr"`
+	Data    string   `xml:",chardata"`
+}
+
+type IbbClose struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/ibb close"`
+	Sid     string   `xml:"sid,attr"`
+}
+
+// IbbExt may be included in the extensions passed to NewClient to
+// decode in-band bytestream elements. An IbbManager includes it.
+var IbbExt Extension = Extension{}
+
+func init() {
+	IbbExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	oName := xml.Name{Space: NsIbb, Local: "open"}
+	IbbExt.StanzaTypes[oName] = reflect.TypeOf(IbbOpen{})
+	dName := xml.Name{Space: NsIbb, Local: "data"}
+	IbbExt.StanzaTypes[dName] = reflect.TypeOf(IbbData{})
+	cName := xml.Name{Space: NsIbb, Local: "close"}
+	IbbExt.StanzaTypes[cName] = reflect.TypeOf(IbbClose{})
+}
+
+const (
+	// The block size used by IbbManager.Open if none is given.
+	IbbBlockSize = 4096
+	// The largest block size an IbbManager accepts.
+	ibbMaxBlockSize = 65535
+	// How long the peer may take to acknowledge a block.
+	ibbTimeout = 30 * time.Second
+)
+
+var errIbbClosed = errors.New("in-band bytestream closed")
+
+// IbbManager is an extension which opens in-band bytestreams to
+// other entities and accepts those they open.
+type IbbManager struct {
+	Extension
+	// Streams opened by others and accepted. If the channel isn't
+	// ready for a stream, the stream is refused.
+	Incoming <-chan *IbbStream
+	incoming chan *IbbStream
+	accept   func(from JID, sid string) bool
+	toServer chan Stanza
+	sendDone chan bool
+	lock     sync.Mutex
+	cl       *Client
+	streams  map[sidKey]*IbbStream
+	expected map[sidKey]chan *IbbStream
+}
+
+// Identifies a stream or session by the peer and its id.
+type sidKey struct {
+	peer JID
+	sid  string
+}
+
+// Creates an IbbManager, to be passed to NewClient among the
+// extensions. Streams others open are accepted if accept returns
+// true, or if they were expected; accept may be nil, and must not
+// block.
+func NewIbbManager(accept func(from JID, sid string) bool) *IbbManager {
+	m := &IbbManager{accept: accept}
+	m.incoming = make(chan *IbbStream, 16)
+	m.Incoming = m.incoming
+	m.toServer = make(chan Stanza)
+	m.sendDone = make(chan bool)
+	m.streams = make(map[sidKey]*IbbStream)
+	m.expected = make(map[sidKey]chan *IbbStream)
+	m.StanzaTypes = IbbExt.StanzaTypes
+	m.Features = []string{NsIbb}
+	m.RecvFilter = m.recvFilter
+	m.SendFilter = m.sendFilter
+	m.Start = func(cl *Client) {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		m.cl = cl
+	}
+	return m
+}
+
+func (m *IbbManager) client() (*Client, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.cl == nil {
+		return nil, fmt.Errorf("ibb manager not started")
+	}
+	return m.cl, nil
+}
+
+// Makes the manager accept a stream with the given id from the given
+// full JID, once, as when the stream was negotiated by another
+// protocol. The stream arrives on the returned channel rather than
+// on Incoming.
+func (m *IbbManager) Expect(from JID, sid string) <-chan *IbbStream {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ch := make(chan *IbbStream, 1)
+	m.expected[sidKey{from, sid}] = ch
+	return ch
+}
+
+// Opens a stream to a full JID. The id must be unique between the
+// two entities. A blockSize of 0 means IbbBlockSize.
+func (m *IbbManager) Open(ctx context.Context, to JID, sid string,
+	blockSize int) (*IbbStream, error) {
+
+	cl, err := m.client()
+	if err != nil {
+		return nil, err
+	}
+	if blockSize == 0 {
+		blockSize = IbbBlockSize
+	}
+	s := newIbbStream(m, to, sid, blockSize)
+	key := sidKey{to, sid}
+	m.lock.Lock()
+	if m.streams[key] != nil {
+		m.lock.Unlock()
+		return nil, fmt.Errorf("stream %s to %s is already open", sid, to)
+	}
+	m.streams[key] = s
+	m.lock.Unlock()
+	iq := &Iq{Header: Header{To: to, Type: "set",
+		Nested: []interface{}{&IbbOpen{BlockSize: blockSize,
+			Sid: sid, Stanza: "iq"}}}}
+	if _, err := cl.SendIq(ctx, iq); err != nil {
+		m.remove(s)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (m *IbbManager) stream(from JID, sid string) *IbbStream {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.streams[sidKey{from, sid}]
+}
+
+func (m *IbbManager) remove(s *IbbStream) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key := sidKey{s.Peer, s.Sid}
+	if m.streams[key] == s {
+		delete(m.streams, key)
+	}
+}
+
+// Accepts or refuses a stream someone else opens.
+func (m *IbbManager) opened(from JID, op *IbbOpen) *Error {
+	if op.BlockSize <= 0 || op.BlockSize > ibbMaxBlockSize {
+		return stanzaError("modify", "resource-constraint")
+	}
+	key := sidKey{from, op.Sid}
+	m.lock.Lock()
+	expected := m.expected[key]
+	delete(m.expected, key)
+	exists := m.streams[key] != nil
+	m.lock.Unlock()
+	if exists {
+		return stanzaError("cancel", "not-acceptable")
+	}
+	if expected == nil && (m.accept == nil || !m.accept(from, op.Sid)) {
+		return stanzaError("cancel", "not-acceptable")
+	}
+	s := newIbbStream(m, from, op.Sid, op.BlockSize)
+	m.lock.Lock()
+	m.streams[key] = s
+	m.lock.Unlock()
+	incoming := m.incoming
+	if expected != nil {
+		incoming = expected
+	}
+	select {
+	case incoming <- s:
+		return nil
+	default:
+		m.remove(s)
+		return stanzaError("wait", "resource-constraint")
+	}
+}
+
+// Handles an open, data, or close element from a peer. Returns the
+// error to report, if any.
+func (m *IbbManager) handle(from JID, ele interface{}) *Error {
+	switch x := ele.(type) {
+	case *IbbOpen:
+		return m.opened(from, x)
+	case *IbbData:
+		s := m.stream(from, x.Sid)
+		if s == nil {
+			return stanzaError("cancel", "item-not-found")
+		}
+		if err := s.received(x); err != nil {
+			m.remove(s)
+			return err
+		}
+	case *IbbClose:
+		s := m.stream(from, x.Sid)
+		if s == nil {
+			return stanzaError("cancel", "item-not-found")
+		}
+		m.remove(s)
+		s.finish(io.EOF)
+	}
+	return nil
+}
+
+func ibbElement(h *Header) interface{} {
+	for _, ele := range h.Nested {
+		switch ele.(type) {
+		case *IbbOpen, *IbbData, *IbbClose:
+			return ele
+		}
+	}
+	return nil
+}
+
+func (m *IbbManager) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for stan := range in {
+		switch st := stan.(type) {
+		case *Iq:
+			ele := ibbElement(&st.Header)
+			if st.Type != "set" || ele == nil {
+				out <- stan
+				continue
+			}
+			reply := &Iq{Header: Header{To: st.From, Id: st.Id,
+				Type: "result"}}
+			if err := m.handle(st.From, ele); err != nil {
+				reply.Type = "error"
+				reply.Error = err
+			}
+			select {
+			case m.toServer <- reply:
+			case <-m.sendDone:
+			}
+		case *Message:
+			// Data may come in messages if the peer asked for
+			// that. There's nothing to acknowledge or refuse.
+			ele := ibbElement(&st.Header)
+			if _, ok := ele.(*IbbData); !ok {
+				out <- stan
+				continue
+			}
+			m.handle(st.From, ele)
+		default:
+			out <- stan
+		}
+	}
+}
+
+func (m *IbbManager) sendFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	defer close(m.sendDone)
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			out <- stan
+		case stan := <-m.toServer:
+			out <- stan
+		}
+	}
+}
+
+// IbbStream is one in-band bytestream. Each Write waits until the
+// peer has acknowledged its blocks. Read returns io.EOF once the
+// peer has closed the stream and everything it sent has been read.
+type IbbStream struct {
+	// The peer, and the stream's id.
+	Peer JID
+	Sid  string
+	m    *IbbManager
+	size int
+	// Serializes writes, and guards sendSeq.
+	wlock   sync.Mutex
+	sendSeq uint16
+	lock    sync.Mutex
+	cond    *sync.Cond
+	buf     bytes.Buffer
+	recvSeq uint16
+	// Why reading ends, once it does.
+	err    error
+	closed bool
+}
+
+var _ io.ReadWriteCloser = &IbbStream{}
+
+func newIbbStream(m *IbbManager, peer JID, sid string,
+	size int) *IbbStream {
+
+	s := &IbbStream{Peer: peer, Sid: sid, m: m, size: size}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+// Takes a block from the peer. A block out of sequence ends the
+// stream.
+func (s *IbbStream) received(d *IbbData) *Error {
+	data, err := base64.StdEncoding.DecodeString(d.Data)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch {
+	case s.err != nil:
+		return stanzaError("cancel", "item-not-found")
+	case d.Seq != s.recvSeq:
+		s.err = fmt.Errorf("block %d of %s out of sequence", d.Seq,
+			s.Sid)
+	case err != nil || len(data) > s.size:
+		s.err = fmt.Errorf("bad block %d of %s", d.Seq, s.Sid)
+	default:
+		s.recvSeq++
+		s.buf.Write(data)
+		s.cond.Broadcast()
+		return nil
+	}
+	s.cond.Broadcast()
+	return stanzaError("cancel", "unexpected-request")
+}
+
+func (s *IbbStream) finish(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+}
+
+func (s *IbbStream) Read(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.buf.Len() == 0 && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.buf.Len() > 0 {
+		return s.buf.Read(p)
+	}
+	return 0, s.err
+}
+
+func (s *IbbStream) Write(p []byte) (int, error) {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+	cl, err := s.m.client()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for len(p) > 0 {
+		s.lock.Lock()
+		closed := s.closed || s.err != nil
+		s.lock.Unlock()
+		if closed {
+			return n, errIbbClosed
+		}
+		block := p
+		if len(block) > s.size {
+			block = block[:s.size]
+		}
+		iq := &Iq{Header: Header{To: s.Peer, Type: "set",
+			Nested: []interface{}{&IbbData{Seq: s.sendSeq,
+				Sid:  s.Sid,
+				Data: base64.StdEncoding.EncodeToString(block)}}}}
+		ctx, cancel := context.WithTimeout(context.Background(),
+			ibbTimeout)
+		_, err := cl.SendIq(ctx, iq)
+		cancel()
+		if err != nil {
+			s.m.remove(s)
+			s.finish(err)
+			return n, err
+		}
+		s.sendSeq++
+		n += len(block)
+		p = p[len(block):]
+	}
+	return n, nil
+}
+
+// Closes the stream in both directions.
+func (s *IbbStream) Close() error {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	open := s.err == nil
+	s.lock.Unlock()
+	s.m.remove(s)
+	s.finish(errIbbClosed)
+	if !open {
+		return nil
+	}
+	cl, err := s.m.client()
+	if err != nil {
+		return err
+	}
+	iq := &Iq{Header: Header{To: s.Peer, Type: "set",
+		Nested: []interface{}{&IbbClose{Sid: s.Sid}}}}
+	_, err = cl.SendIq(context.Background(), iq)
+	return err
+}
@@ -0,0 +1,103 @@
+package xmpp
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestIbbIncoming(t *testing.T) {
+	m := NewIbbManager(func(from JID, sid string) bool {
+		return sid == "s1"
+	})
+	send := make(chan Stanza, 1)
+	cl := &Client{Jid: "me@b.c/r", handlers: make(chan *callback, 1),
+		Send: send}
+	m.Start(cl)
+	recvIn := make(chan Stanza)
+	recvOut := make(chan Stanza, 1)
+	go m.RecvFilter(recvIn, recvOut)
+	sendIn := make(chan Stanza)
+	sendOut := make(chan Stanza)
+	go m.SendFilter(sendIn, sendOut)
+	defer close(sendIn)
+	defer close(recvIn)
+
+	ask := func(ele interface{}) *Iq {
+		recvIn <- &Iq{Header: Header{From: "a@b.c/x", Id: "1",
+			Type: "set", Nested: []interface{}{ele}}}
+		return (<-sendOut).(*Iq)
+	}
+	reply := ask(&IbbOpen{BlockSize: 4, Sid: "s2"})
+	assertEquals(t, "error", reply.Type)
+	expected := m.Expect("a@b.c/x", "s2")
+	reply = ask(&IbbOpen{BlockSize: 4, Sid: "s2"})
+	assertEquals(t, "result", reply.Type)
+	s2 := <-expected
+	reply = ask(&IbbOpen{BlockSize: 4, Sid: "s1"})
+	assertEquals(t, "result", reply.Type)
+	s := <-m.Incoming
+	assertEquals(t, "s1", s.Sid)
+
+	assertEquals(t, "result", ask(&IbbData{Seq: 0, Sid: "s1",
+		Data: "aGVs"}).Type)
+	assertEquals(t, "result", ask(&IbbData{Seq: 1, Sid: "s1",
+		Data: "bG8="}).Type)
+	assertEquals(t, "result", ask(&IbbClose{Sid: "s1"}).Type)
+	buf, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	assertEquals(t, "hello", string(buf))
+	assertEquals(t, "error", ask(&IbbData{Sid: "s1", Data: "aGVs"}).Type)
+
+	// A block out of sequence ends the stream.
+	assertEquals(t, "error", ask(&IbbData{Seq: 1, Sid: "s2",
+		Data: "aGVs"}).Type)
+	if _, err := s2.Read(make([]byte, 4)); err == nil || err == io.EOF {
+		t.Errorf("Read: %v", err)
+	}
+}
+
+func TestIbbOpen(t *testing.T) {
+	m := NewIbbManager(nil)
+	send := make(chan Stanza, 1)
+	cl := &Client{Jid: "me@b.c/r", handlers: make(chan *callback, 1),
+		Send: send}
+	m.Start(cl)
+	asked := make(chan interface{}, 4)
+	go func() {
+		for {
+			h := <-cl.handlers
+			iq := (<-send).(*Iq)
+			asked <- iq.Nested[0]
+			h.f(&Iq{Header: Header{Id: iq.Id, Type: "result"}})
+		}
+	}()
+	s, err := m.Open(context.Background(), "a@b.c/x", "s1", 3)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	assertMarshal(t, `<open xmlns="`+NsIbb+`" block-size="3" sid="s1" `+
+		`stanza="iq"></open>`, <-asked)
+	if n, err := s.Write([]byte("hello")); n != 5 || err != nil {
+		t.Fatalf("Write: %d %v", n, err)
+	}
+	d := (<-asked).(*IbbData)
+	assertEquals(t, "aGVs", d.Data)
+	d = (<-asked).(*IbbData)
+	assertEquals(t, "bG8=", d.Data)
+	if d.Seq != 1 {
+		t.Errorf("seq %d", d.Seq)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, ok := (<-asked).(*IbbClose); !ok {
+		t.Error("not closed")
+	}
+	if _, err := s.Write([]byte("x")); err == nil {
+		t.Error("wrote after close")
+	}
+}
@@ -3,27 +3,46 @@ package xmpp
 // Code to generate unique IDs for outgoing messages.
 
 import (
+	"crypto/rand"
 	"fmt"
 )
 
-var id <-chan string
-
-func init() {
-	// Start the unique id generator.
-	idCh := make(chan string)
-	id = idCh
-	go func(ch chan<- string) {
-		id := int64(1)
-		for {
-			str := fmt.Sprintf("id_%d", id)
-			ch <- str
-			id++
-		}
-	}(idCh)
+// Returns a random (version 4) UUID, RFC 4122. Being random rather
+// than counted, the ids of different clients and processes don't
+// collide, so they can serve as origin ids and be matched against
+// archives and carbons, XEP-0359.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic("xmpp: no randomness for ids: " + err.Error())
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10],
+		b[10:])
 }
 
 // This function may be used as a convenient way to generate a unique
-// id for an outgoing iq, message, or presence stanza.
+// id for an outgoing iq, message, or presence stanza. Where there's a
+// client, Client.NextId is better, since it uses IdGeneratorExt.
 func NextId() string {
-	return <-id
+	return newUUID()
+}
+
+// Returns an extension which has the client generate the ids of the
+// stanzas it sends with gen, instead of as random UUIDs. Ids should be
+// unique, since they're matched against replies, and are used as
+// origin ids, XEP-0359.
+func IdGeneratorExt(gen func() string) Extension {
+	return Extension{option: func(o *options) {
+		o.ids = gen
+	}}
+}
+
+// Returns a unique id for an outgoing stanza.
+func (cl *Client) NextId() string {
+	if cl.opts.ids != nil {
+		return cl.opts.ids()
+	}
+	return newUUID()
 }
@@ -0,0 +1,103 @@
+package xmpp
+
+// This file contains invisibility, XEP-0186, which lets a session
+// take part in conversations without the user's contacts seeing it
+// online.
+
+import (
+	"context"
+	"encoding/xml"
+	"sync/atomic"
+	"time"
+)
+
+const NsInvisible = "urn:xmpp:invisible:0"
+
+// Asks the server to stop broadcasting this session's presence. If
+// Probe is set, the server still probes the user's contacts, so
+// their presence is known.
+type Invisible struct {
+	XMLName xml.Name `xml:"urn:xmpp:invisible:0 invisible"`
+	Probe   bool     `xml:"probe,attr,omitempty"`
+}
+
+// Asks the server to broadcast this session's presence again.
+type Visible struct {
+	XMLName xml.Name `xml:"urn:xmpp:invisible:0 visible"`
+}
+
+// Values of Client.invisible.
+const (
+	visible = iota
+	// Invisible with the server's help.
+	invisibleCommand
+	// Gone unavailable, for servers which can't help.
+	invisibleUnavailable
+)
+
+// Makes the session invisible to the user's contacts. If the server
+// supports XEP-0186 they still see nothing of it, while it goes on
+// receiving their presence and messages. Otherwise the session
+// sends unavailable presence, which the contacts see as it going
+// offline; it can still send, and receive what's addressed to its
+// full JID, but not their presence. Invisibility lasts until
+// GoVisible, even if the client reconnects.
+func (cl *Client) GoInvisible(ctx context.Context) error {
+	ok, err := cl.Supports(ctx, JID(cl.Jid.Domain()), NsInvisible)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		pr := &Presence{Header: Header{Type: "unavailable"}}
+		if err := cl.send(ctx, pr); err != nil {
+			return err
+		}
+		atomic.StoreInt32(&cl.invisible, invisibleUnavailable)
+		return nil
+	}
+	if err := cl.sendInvisible(ctx); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&cl.invisible, invisibleCommand)
+	return nil
+}
+
+func (cl *Client) sendInvisible(ctx context.Context) error {
+	iq := &Iq{Header: Header{Type: "set",
+		Nested: []interface{}{&Invisible{}}}}
+	_, err := cl.SendIq(ctx, iq)
+	return err
+}
+
+// Makes the session visible again, broadcasting pr, for instance
+// the initial presence, as its presence.
+func (cl *Client) GoVisible(ctx context.Context, pr Presence) error {
+	if atomic.LoadInt32(&cl.invisible) == invisibleCommand {
+		iq := &Iq{Header: Header{Type: "set",
+			Nested: []interface{}{&Visible{}}}}
+		if _, err := cl.SendIq(ctx, iq); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&cl.invisible, visible)
+	return cl.send(ctx, &pr)
+}
+
+// Sends the initial presence again in a new session, unless the
+// session is invisible. If the server made it invisible, it's asked
+// to again first, and if it won't, nothing is sent.
+func (cl *Client) sendPresenceAgain(pr Presence) {
+	switch atomic.LoadInt32(&cl.invisible) {
+	case invisibleUnavailable:
+		return
+	case invisibleCommand:
+		ctx, cancel := context.WithTimeout(context.Background(),
+			10*time.Second)
+		defer cancel()
+		if err := cl.sendInvisible(ctx); err != nil {
+			cl.logf(LogError, "can't stay invisible: %v", err)
+			return
+		}
+	}
+	cl.send(context.Background(), &pr)
+}
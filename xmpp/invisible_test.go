@@ -0,0 +1,56 @@
+package xmpp
+
+import (
+	"context"
+	"testing"
+)
+
+func TestInvisible(t *testing.T) {
+	send := make(chan Stanza, 1)
+	cc := newCapsCache()
+	cl := &Client{Jid: "a@b.c/d", caps: cc, handlers: make(chan *callback, 1),
+		Send: send, closing: make(chan bool)}
+	ctx := context.Background()
+
+	// Without the server's help, the session goes unavailable.
+	cc.store("b.c", nil, &DiscoInfo{})
+	if err := cl.GoInvisible(ctx); err != nil {
+		t.Fatalf("GoInvisible: %v", err)
+	}
+	assertEquals(t, "unavailable", (<-send).(*Presence).Type)
+	// And stays so in a new session.
+	cl.sendPresenceAgain(Presence{})
+	if len(send) != 0 {
+		t.Errorf("sent %#v", <-send)
+	}
+	if err := cl.GoVisible(ctx, Presence{}); err != nil {
+		t.Fatalf("GoVisible: %v", err)
+	}
+	assertEquals(t, "", (<-send).(*Presence).Type)
+
+	cc.store("b.c", nil, &DiscoInfo{Features: []DiscoFeature{
+		{Var: NsInvisible}}})
+	answer := func(want string) {
+		h := <-cl.handlers
+		iq := (<-send).(*Iq)
+		assertMarshal(t, want, iq.Nested[0])
+		h.f(&Iq{Header: Header{Id: iq.Id, Type: "result"}})
+	}
+	go answer(`<invisible xmlns="` + NsInvisible + `"></invisible>`)
+	if err := cl.GoInvisible(ctx); err != nil {
+		t.Fatalf("GoInvisible: %v", err)
+	}
+	// A new session is made invisible before its presence is sent.
+	go answer(`<invisible xmlns="` + NsInvisible + `"></invisible>`)
+	cl.sendPresenceAgain(Presence{})
+	if _, ok := (<-send).(*Presence); !ok {
+		t.Error("no presence")
+	}
+	go answer(`<visible xmlns="` + NsInvisible + `"></visible>`)
+	if err := cl.GoVisible(ctx, Presence{}); err != nil {
+		t.Fatalf("GoVisible: %v", err)
+	}
+	if _, ok := (<-send).(*Presence); !ok {
+		t.Error("no presence")
+	}
+}
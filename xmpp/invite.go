@@ -0,0 +1,247 @@
+package xmpp
+
+// This file contains handling for invitations to group chats, in the
+// three forms they come in: mediated multi-user chat invitations
+// (XEP-0045), direct invitations (XEP-0249), and MIX invitations
+// (XEP-0407).
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+const (
+	NsConference = "jabber:x:conference"
+	NsMixCore    = "urn:xmpp:mix:core:1"
+	NsMixPam     = "urn:xmpp:mix:pam:2"
+	NsMixMisc    = "urn:xmpp:mix:misc:0"
+	// The MIX nodes subscribed to when accepting an invitation.
+	NsMixNodeMessages = "urn:xmpp:mix:nodes:messages"
+	NsMixNodePresence = "urn:xmpp:mix:nodes:presence"
+)
+
+// A direct invitation to a room, XEP-0249.
+type DirectInvite struct {
+	XMLName  xml.Name `xml:"jabber:x:conference x"`
+	Jid      JID      `xml:"jid,attr"`
+	Password string   `xml:"password,attr,omitempty"`
+	Reason   string   `xml:"reason,attr,omitempty"`
+	Continue bool     `xml:"continue,attr,omitempty"`
+	Thread   string   `xml:"thread,attr,omitempty"`
+}
+
+// An invitation to a MIX channel, XEP-0407.
+type MixInvitation struct {
+	XMLName xml.Name `xml:"urn:xmpp:mix:misc:0 invitation"`
+	Inviter JID      `xml:"inviter"`
+	Invitee JID      `xml:"invitee"`
+	Channel JID      `xml:"channel"`
+	Token   string   `xml:"token"`
+}
+
+// Tells the inviter what became of a MIX invitation: Joined,
+// Declined, or Acknowledged.
+type MixInvitationAck struct {
+	XMLName    xml.Name      `xml:"urn:xmpp:mix:misc:0 invitation-ack"`
+	Value      string        `xml:"value"`
+	Invitation MixInvitation `xml:"invitation"`
+}
+
+// Asks the user's server to join a MIX channel on the client's
+// behalf, XEP-0405.
+type MixClientJoin struct {
+	XMLName xml.Name `xml:"urn:xmpp:mix:pam:2 client-join"`
+	Channel JID      `xml:"channel,attr"`
+	Join    MixJoin
+}
+
+type MixJoin struct {
+	XMLName    xml.Name       `xml:"urn:xmpp:mix:core:1 join"`
+	Nick       string         `xml:"nick,omitempty"`
+	Subscribe  []MixSubscribe `xml:"subscribe"`
+	Invitation *MixInvitation
+}
+
+type MixSubscribe struct {
+	Node string `xml:"node,attr"`
+}
+
+// The forms an invitation can take.
+type InviteKind int
+
+const (
+	InviteMediated InviteKind = iota
+	InviteDirect
+	InviteMix
+)
+
+// An invitation to a multi-user chat room or MIX channel, whatever
+// form it came in.
+type Invitation struct {
+	Kind InviteKind
+	// The room or channel.
+	Room JID
+	// Who sent the invitation.
+	From     JID
+	Reason   string
+	Password string
+	// The stanza the invitation was taken from.
+	Message *Message
+	ih      *InviteHandler
+	mix     *MixInvitation
+}
+
+// InviteHandler is an extension which recognizes invitations in
+// incoming messages and passes them to a single function. Messages
+// carrying invitations are consumed.
+type InviteHandler struct {
+	Extension
+	// If non-nil, rooms are joined through it when invitations are
+	// accepted, rather than by sending the join presence directly.
+	// It's typically the Join method of a muc.Manager.
+	Join     func(room JID, nick, password string)
+	onInvite func(*Invitation)
+	toServer chan Stanza
+	done     chan bool
+	lock     sync.Mutex
+	cl       *Client
+}
+
+// Creates an InviteHandler, to be passed to NewClient among the
+// extensions. The function is called in a new goroutine for each
+// invitation, so it may wait for the user to decide.
+func NewInviteHandler(onInvite func(*Invitation)) *InviteHandler {
+	ih := &InviteHandler{onInvite: onInvite}
+	ih.toServer = make(chan Stanza)
+	ih.done = make(chan bool)
+	ih.StanzaTypes = mergeStanzaTypes(MucExt)
+	dName := xml.Name{Space: NsConference, Local: "x"}
+	ih.StanzaTypes[dName] = reflect.TypeOf(DirectInvite{})
+	mName := xml.Name{Space: NsMixMisc, Local: "invitation"}
+	ih.StanzaTypes[mName] = reflect.TypeOf(MixInvitation{})
+	ih.RecvFilter = ih.recvFilter
+	ih.SendFilter = ih.sendFilter
+	ih.Start = func(cl *Client) {
+		ih.lock.Lock()
+		ih.cl = cl
+		ih.lock.Unlock()
+	}
+	return ih
+}
+
+func (ih *InviteHandler) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	defer close(ih.done)
+	for stan := range in {
+		if m, ok := stan.(*Message); ok && m.Type != "error" {
+			if inv := ih.invitation(m); inv != nil {
+				go ih.onInvite(inv)
+				continue
+			}
+		}
+		out <- stan
+	}
+}
+
+func (ih *InviteHandler) sendFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			out <- stan
+		case stan := <-ih.toServer:
+			out <- stan
+		}
+	}
+}
+
+// Extracts the invitation from a message, if it carries one.
+func (ih *InviteHandler) invitation(m *Message) *Invitation {
+	inv := &Invitation{Message: m, ih: ih}
+	for _, ele := range m.Nested {
+		switch x := ele.(type) {
+		case *MucUserX:
+			if len(x.Invite) == 0 {
+				continue
+			}
+			inv.Kind = InviteMediated
+			inv.Room = m.From.Bare()
+			inv.From = x.Invite[0].From
+			inv.Reason = x.Invite[0].Reason
+			inv.Password = x.Password
+			return inv
+		case *DirectInvite:
+			inv.Kind = InviteDirect
+			inv.Room = x.Jid
+			inv.From = m.From
+			inv.Reason = x.Reason
+			inv.Password = x.Password
+			return inv
+		case *MixInvitation:
+			inv.Kind = InviteMix
+			inv.Room = x.Channel
+			inv.From = x.Inviter
+			inv.mix = x
+			return inv
+		}
+	}
+	return nil
+}
+
+func (ih *InviteHandler) send(st Stanza) {
+	select {
+	case ih.toServer <- st:
+	case <-ih.done:
+	}
+}
+
+// Joins the room or channel with the given nick. For a MIX channel,
+// this waits for the user's server to report the result.
+func (inv *Invitation) Accept(nick string) error {
+	if inv.Kind == InviteMix {
+		inv.ih.lock.Lock()
+		cl := inv.ih.cl
+		inv.ih.lock.Unlock()
+		if cl == nil {
+			return fmt.Errorf("invite handler not started")
+		}
+		join := &MixClientJoin{Channel: inv.Room,
+			Join: MixJoin{Nick: nick, Invitation: inv.mix,
+				Subscribe: []MixSubscribe{{NsMixNodeMessages},
+					{NsMixNodePresence}}}}
+		iq := &Iq{Header: Header{To: cl.Jid.Bare(), Type: "set",
+			Nested: []interface{}{join}}}
+		_, err := cl.SendIq(context.Background(), iq)
+		return err
+	}
+	if inv.ih.Join != nil {
+		inv.ih.Join(inv.Room, nick, inv.Password)
+		return nil
+	}
+	inv.ih.send(MucJoinPresence(inv.Room, nick, inv.Password, nil))
+	return nil
+}
+
+// Refuses the invitation, telling the inviter why if the protocol
+// allows. Direct invitations have no way of refusing, so nothing is
+// sent.
+func (inv *Invitation) Decline(reason string) {
+	switch inv.Kind {
+	case InviteMediated:
+		x := &MucUserX{Decline: &MucInvite{To: inv.From,
+			Reason: reason}}
+		inv.ih.send(&Message{Header: Header{To: inv.Room, Id: NextId(),
+			Nested: []interface{}{x}}})
+	case InviteMix:
+		ack := &MixInvitationAck{Value: "Declined",
+			Invitation: *inv.mix}
+		inv.ih.send(&Message{Header: Header{To: inv.From, Id: NextId(),
+			Nested: []interface{}{ack}}})
+	}
+}
@@ -0,0 +1,81 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestInviteHandler(t *testing.T) {
+	invites := make(chan *Invitation)
+	ih := NewInviteHandler(func(inv *Invitation) { invites <- inv })
+	recvIn := make(chan Stanza)
+	recvOut := make(chan Stanza)
+	go ih.RecvFilter(recvIn, recvOut)
+	sendIn := make(chan Stanza)
+	sendOut := make(chan Stanza)
+	go ih.SendFilter(sendIn, sendOut)
+	defer close(sendIn)
+
+	parse := func(str string) *Message {
+		var m Message
+		if err := xml.Unmarshal([]byte(str), &m); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		if err := parseExtended(&m.Header, ih.StanzaTypes); err != nil {
+			t.Fatalf("parseExtended: %v", err)
+		}
+		return &m
+	}
+
+	recvIn <- parse(`<message xmlns="jabber:client" from="room@muc">` +
+		`<x xmlns="` + NsMucUser + `"><invite from="al@b/c">` +
+		`<reason>Join us</reason></invite><password>pw</password>` +
+		`</x></message>`)
+	inv := <-invites
+	if inv.Kind != InviteMediated || inv.Room != "room@muc" ||
+		inv.From != "al@b/c" || inv.Reason != "Join us" ||
+		inv.Password != "pw" {
+		t.Errorf("bad invitation %#v", inv)
+	}
+	go inv.Decline("No thanks")
+	dec := (<-sendOut).(*Message)
+	assertEquals(t, "room@muc", string(dec.To))
+	x := dec.Nested[0].(*MucUserX)
+	assertEquals(t, "al@b/c", string(x.Decline.To))
+
+	recvIn <- parse(`<message xmlns="jabber:client" from="al@b/c">` +
+		`<x xmlns="` + NsConference + `" jid="room@muc" ` +
+		`reason="Hi"/></message>`)
+	inv = <-invites
+	if inv.Kind != InviteDirect || inv.Room != "room@muc" ||
+		inv.From != "al@b/c" || inv.Reason != "Hi" {
+		t.Errorf("bad invitation %#v", inv)
+	}
+	go inv.Accept("me")
+	join := (<-sendOut).(*Presence)
+	assertEquals(t, "room@muc/me", string(join.To))
+
+	recvIn <- parse(`<message xmlns="jabber:client" from="al@b/c">` +
+		`<invitation xmlns="` + NsMixMisc + `"><inviter>al@b</inviter>` +
+		`<invitee>me@b</invitee><channel>chan@mix</channel>` +
+		`<token>t1</token></invitation></message>`)
+	inv = <-invites
+	if inv.Kind != InviteMix || inv.Room != "chan@mix" ||
+		inv.From != "al@b" {
+		t.Errorf("bad invitation %#v", inv)
+	}
+	go inv.Decline("")
+	ack := (<-sendOut).(*Message)
+	assertEquals(t, "al@b", string(ack.To))
+	assertEquals(t, "t1",
+		ack.Nested[0].(*MixInvitationAck).Invitation.Token)
+
+	plain := &Message{Header: Header{From: "al@b/c"}}
+	recvIn <- plain
+	if st := <-recvOut; st != plain {
+		t.Errorf("got %v", st)
+	}
+	close(recvIn)
+	for _ = range recvOut {
+	}
+}
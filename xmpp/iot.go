@@ -0,0 +1,301 @@
+package xmpp
+
+// This file contains support for reading sensor data from, and
+// controlling, networked devices. See XEP-0323 and XEP-0325.
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	NsSensorData = "urn:xmpp:iot:sensordata"
+	NsControl    = "urn:xmpp:iot:control"
+)
+
+// Field types which may appear in a sensor data readout, as found
+// in SensorField.XMLName.Local.
+const (
+	SensorNumeric  = "numeric"
+	SensorString   = "string"
+	SensorBoolean  = "boolean"
+	SensorDate     = "date"
+	SensorDateTime = "dateTime"
+	SensorTimeSpan = "timeSpan"
+	SensorEnum     = "enum"
+)
+
+// A request to read out sensor data, sent in an iq get. The boolean
+// fields select which kinds of values the requester is interested
+// in. If Nodes or Fields is non-empty, the readout is limited to
+// those.
+type SensorReq struct {
+	XMLName    xml.Name         `xml:"urn:xmpp:iot:sensordata req"`
+	SeqNr      int64            `xml:"seqnr,attr"`
+	Momentary  bool             `xml:"momentary,attr,omitempty"`
+	Peak       bool             `xml:"peak,attr,omitempty"`
+	Status     bool             `xml:"status,attr,omitempty"`
+	Computed   bool             `xml:"computed,attr,omitempty"`
+	Identity   bool             `xml:"identity,attr,omitempty"`
+	Historical bool             `xml:"historical,attr,omitempty"`
+	From       string           `xml:"from,attr,omitempty"`
+	To         string           `xml:"to,attr,omitempty"`
+	When       string           `xml:"when,attr,omitempty"`
+	Nodes      []SensorNodeRef  `xml:"urn:xmpp:iot:sensordata node"`
+	Fields     []SensorFieldRef `xml:"urn:xmpp:iot:sensordata field"`
+}
+
+// Identifies a node behind a concentrator.
+type SensorNodeRef struct {
+	NodeId    string `xml:"nodeId,attr"`
+	SourceId  string `xml:"sourceId,attr,omitempty"`
+	CacheType string `xml:"cacheType,attr,omitempty"`
+}
+
+// Names a field to be read out.
+type SensorFieldRef struct {
+	Name string `xml:"name,attr"`
+}
+
+// The device's reply to a readout request it will fulfil. The
+// requested data follows in one or more messages.
+type SensorAccepted struct {
+	XMLName xml.Name `xml:"urn:xmpp:iot:sensordata accepted"`
+	SeqNr   int64    `xml:"seqnr,attr"`
+	Queued  bool     `xml:"queued,attr,omitempty"`
+}
+
+// The device's reply to a readout request it won't fulfil.
+type SensorRejected struct {
+	XMLName xml.Name `xml:"urn:xmpp:iot:sensordata rejected"`
+	SeqNr   int64    `xml:"seqnr,attr"`
+	Error   string   `xml:"urn:xmpp:iot:sensordata error,omitempty"`
+}
+
+// Sensor data read out in response to a request, carried in a
+// message. Done is set in the last message for the request.
+type SensorFields struct {
+	XMLName xml.Name     `xml:"urn:xmpp:iot:sensordata fields"`
+	SeqNr   int64        `xml:"seqnr,attr"`
+	Done    bool         `xml:"done,attr,omitempty"`
+	Nodes   []SensorNode `xml:"urn:xmpp:iot:sensordata node"`
+}
+
+// The values read from one node.
+type SensorNode struct {
+	SensorNodeRef
+	Timestamps []SensorTimestamp `xml:"urn:xmpp:iot:sensordata timestamp"`
+}
+
+// Field values which were valid at a given time.
+type SensorTimestamp struct {
+	Value  string        `xml:"value,attr"`
+	Fields []SensorField `xml:",any"`
+}
+
+// A single value read from a sensor. XMLName.Local gives its type,
+// one of the Sensor* constants.
+type SensorField struct {
+	XMLName          xml.Name
+	Name             string `xml:"name,attr"`
+	Value            string `xml:"value,attr,omitempty"`
+	Unit             string `xml:"unit,attr,omitempty"`
+	NrDecimals       string `xml:"nrDecimals,attr,omitempty"`
+	Momentary        bool   `xml:"momentary,attr,omitempty"`
+	Peak             bool   `xml:"peak,attr,omitempty"`
+	Status           bool   `xml:"status,attr,omitempty"`
+	Computed         bool   `xml:"computed,attr,omitempty"`
+	Identity         bool   `xml:"identity,attr,omitempty"`
+	Historical       bool   `xml:"historical,attr,omitempty"`
+	Missing          bool   `xml:"missing,attr,omitempty"`
+	AutomaticReadout bool   `xml:"automaticReadout,attr,omitempty"`
+	Writable         bool   `xml:"writable,attr,omitempty"`
+}
+
+// Reports that a readout failed, in whole or in part.
+type SensorFailure struct {
+	XMLName xml.Name      `xml:"urn:xmpp:iot:sensordata failure"`
+	SeqNr   int64         `xml:"seqnr,attr"`
+	Done    bool          `xml:"done,attr,omitempty"`
+	Errors  []SensorError `xml:"urn:xmpp:iot:sensordata error"`
+}
+
+type SensorError struct {
+	NodeId    string `xml:"nodeId,attr,omitempty"`
+	Timestamp string `xml:"timestamp,attr,omitempty"`
+	Text      string `xml:",chardata"`
+}
+
+// Sets control parameters on a device, in an iq set or a message.
+type ControlSet struct {
+	XMLName xml.Name        `xml:"urn:xmpp:iot:control set"`
+	Nodes   []SensorNodeRef `xml:"urn:xmpp:iot:control node"`
+	Params  []ControlParam  `xml:",any"`
+}
+
+// A control parameter. XMLName.Local gives its type: boolean, color,
+// date, dateTime, double, duration, int, long, string, or time.
+type ControlParam struct {
+	XMLName xml.Name
+	Name    string `xml:"name,attr"`
+	Value   string `xml:"value,attr"`
+}
+
+// The device's reply to a successful ControlSet.
+type ControlSetResponse struct {
+	XMLName      xml.Name `xml:"urn:xmpp:iot:control setResponse"`
+	ResponseCode string   `xml:"responseCode,attr,omitempty"`
+}
+
+// IotExt may be included in the extensions passed to NewClient to
+// decode sensor data and control elements in incoming stanzas.
+var IotExt Extension = Extension{}
+
+func init() {
+	IotExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	for local, v := range map[string]interface{}{
+		"req":      SensorReq{},
+		"accepted": SensorAccepted{},
+		"rejected": SensorRejected{},
+		"fields":   SensorFields{},
+		"failure":  SensorFailure{},
+	} {
+		name := xml.Name{Space: NsSensorData, Local: local}
+		IotExt.StanzaTypes[name] = reflect.TypeOf(v)
+	}
+	for local, v := range map[string]interface{}{
+		"set":         ControlSet{},
+		"setResponse": ControlSetResponse{},
+	} {
+		name := xml.Name{Space: NsControl, Local: local}
+		IotExt.StanzaTypes[name] = reflect.TypeOf(v)
+	}
+}
+
+var sensorSeqNr int64
+
+// Ask a device to read out sensor data. If req.SeqNr is zero, a new
+// sequence number is assigned. This returns once the device has
+// accepted or rejected the request; the data itself arrives later as
+// messages containing SensorFields (or SensorFailure) with the same
+// sequence number.
+func (cl *Client) RequestReadout(ctx context.Context, to JID,
+	req *SensorReq) error {
+
+	if req.SeqNr == 0 {
+		req.SeqNr = atomic.AddInt64(&sensorSeqNr, 1)
+	}
+	iq := &Iq{Header: Header{To: to, Type: "get",
+		Nested: []interface{}{req}}}
+	reply, err := cl.SendIq(ctx, iq)
+	if reply != nil {
+		for _, ele := range reply.Nested {
+			if rej, ok := ele.(*SensorRejected); ok {
+				return fmt.Errorf("readout %d rejected: %s",
+					rej.SeqNr, rej.Error)
+			}
+		}
+	}
+	return err
+}
+
+// Reply to a readout request received from the remote, accepting or
+// (if reason is non-empty) rejecting it.
+func (cl *Client) AnswerReadout(iq *Iq, req *SensorReq, reason string) {
+	reply := &Iq{Header: Header{To: iq.From, Id: iq.Id, Type: "result"}}
+	if reason == "" {
+		reply.Nested = []interface{}{&SensorAccepted{SeqNr: req.SeqNr}}
+	} else {
+		reply.Type = "error"
+		reply.Nested = []interface{}{&SensorRejected{SeqNr: req.SeqNr,
+			Error: reason}}
+	}
+	cl.Send <- reply
+}
+
+// Send read out sensor data to the requester.
+func (cl *Client) SendReadout(to JID, fields *SensorFields) {
+	cl.Send <- &Message{Header: Header{To: to,
+		Nested: []interface{}{fields}}}
+}
+
+// Set control parameters on a device, and wait for it to confirm.
+func (cl *Client) ControlSet(ctx context.Context, to JID,
+	set *ControlSet) error {
+
+	iq := &Iq{Header: Header{To: to, Type: "set",
+		Nested: []interface{}{set}}}
+	_, err := cl.SendIq(ctx, iq)
+	return err
+}
+
+// Returns a numeric field value.
+func NumericField(name string, value float64, unit string) SensorField {
+	return SensorField{XMLName: xml.Name{Space: NsSensorData,
+		Local: SensorNumeric}, Name: name,
+		Value: strconv.FormatFloat(value, 'f', -1, 64), Unit: unit}
+}
+
+// Returns a string field value.
+func StringField(name, value string) SensorField {
+	return SensorField{XMLName: xml.Name{Space: NsSensorData,
+		Local: SensorString}, Name: name, Value: value}
+}
+
+// Returns a boolean field value.
+func BooleanField(name string, value bool) SensorField {
+	return SensorField{XMLName: xml.Name{Space: NsSensorData,
+		Local: SensorBoolean}, Name: name,
+		Value: strconv.FormatBool(value)}
+}
+
+// Interprets the value of a numeric field.
+func (f *SensorField) Float() (float64, error) {
+	return strconv.ParseFloat(f.Value, 64)
+}
+
+// Interprets the value of a boolean field.
+func (f *SensorField) Bool() (bool, error) {
+	return strconv.ParseBool(f.Value)
+}
+
+// Interprets the value of a dateTime field.
+func (f *SensorField) Time() (time.Time, error) {
+	return time.Parse(time.RFC3339, f.Value)
+}
+
+// Returns a timestamp for the given time, in the form expected by
+// SensorTimestamp.Value.
+func SensorTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Returns a boolean control parameter.
+func BoolParam(name string, value bool) ControlParam {
+	return ControlParam{XMLName: xml.Name{Space: NsControl,
+		Local: "boolean"}, Name: name, Value: strconv.FormatBool(value)}
+}
+
+// Returns an int control parameter.
+func IntParam(name string, value int) ControlParam {
+	return ControlParam{XMLName: xml.Name{Space: NsControl,
+		Local: "int"}, Name: name, Value: strconv.Itoa(value)}
+}
+
+// Returns a double control parameter.
+func DoubleParam(name string, value float64) ControlParam {
+	return ControlParam{XMLName: xml.Name{Space: NsControl,
+		Local: "double"}, Name: name,
+		Value: strconv.FormatFloat(value, 'f', -1, 64)}
+}
+
+// Returns a string control parameter.
+func StringParam(name, value string) ControlParam {
+	return ControlParam{XMLName: xml.Name{Space: NsControl,
+		Local: "string"}, Name: name, Value: value}
+}
@@ -0,0 +1,62 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestSensorReqMarshal(t *testing.T) {
+	req := &SensorReq{SeqNr: 4, Momentary: true,
+		Nodes: []SensorNodeRef{{NodeId: "Device01"}}}
+	exp := `<req xmlns="` + NsSensorData + `" seqnr="4" momentary="true">` +
+		`<node xmlns="` + NsSensorData + `" nodeId="Device01"></node></req>`
+	assertMarshal(t, exp, req)
+}
+
+func TestSensorFieldsUnmarshal(t *testing.T) {
+	str := `<message xmlns="jabber:client"><fields xmlns="` +
+		NsSensorData + `" seqnr="4" done="true"><node nodeId="Device01">` +
+		`<timestamp value="2013-03-07T16:24:30Z">` +
+		`<numeric name="Temperature" momentary="true" value="23.4" unit="C"/>` +
+		`<boolean name="Alarm" value="false"/>` +
+		`</timestamp></node></fields></message>`
+	msg := Message{}
+	xml.Unmarshal([]byte(str), &msg)
+	err := parseExtended(&msg.Header, IotExt.StanzaTypes)
+	if err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	if len(msg.Nested) != 1 {
+		t.Fatalf("wrong size nested: %v", msg.Nested)
+	}
+	fields, ok := msg.Nested[0].(*SensorFields)
+	if !ok {
+		t.Fatalf("nested not SensorFields: %T", msg.Nested[0])
+	}
+	if fields.SeqNr != 4 || !fields.Done {
+		t.Errorf("bad fields: %#v", fields)
+	}
+	if len(fields.Nodes) != 1 || len(fields.Nodes[0].Timestamps) != 1 {
+		t.Fatalf("bad nodes: %#v", fields.Nodes)
+	}
+	assertEquals(t, "Device01", fields.Nodes[0].NodeId)
+	vals := fields.Nodes[0].Timestamps[0].Fields
+	if len(vals) != 2 {
+		t.Fatalf("wrong # fields: %v", vals)
+	}
+	assertEquals(t, SensorNumeric, vals[0].XMLName.Local)
+	if f, err := vals[0].Float(); err != nil || f != 23.4 {
+		t.Errorf("bad value %v: %v", f, err)
+	}
+	assertEquals(t, SensorBoolean, vals[1].XMLName.Local)
+	if b, err := vals[1].Bool(); err != nil || b {
+		t.Errorf("bad value %v: %v", b, err)
+	}
+}
+
+func TestControlSetMarshal(t *testing.T) {
+	set := &ControlSet{Params: []ControlParam{BoolParam("Output", true)}}
+	exp := `<set xmlns="` + NsControl + `"><boolean xmlns="` + NsControl +
+		`" name="Output" value="true"></boolean></set>`
+	assertMarshal(t, exp, set)
+}
@@ -0,0 +1,125 @@
+package xmpp
+
+// This file contains a registry of the handlers which answer iq gets
+// and sets, by the namespace of their payload.
+
+import (
+	"context"
+	"encoding/xml"
+	"math"
+	"strings"
+	"sync"
+)
+
+// Answers an iq get or set. It returns the payload of the result, or
+// nil for an empty result, or an error. A *Error is sent back as it
+// is; any other error is logged, and answered with
+// internal-server-error so that nothing about it is disclosed.
+type IqHandler func(cl *Client, iq *Iq) (result interface{}, err error)
+
+// The handlers of one client, by namespace.
+type iqRegistry struct {
+	lock     sync.Mutex
+	handlers map[string]*iqEntry
+}
+
+type iqEntry struct {
+	f IqHandler
+}
+
+// HandleIq has the handler answer the iq gets and sets with a payload
+// in the namespace, and returns the function which removes it again.
+// A later handler for the same namespace replaces an earlier one.
+// Handlers run in a goroutine of their own, and the client sends
+// their answer back; they see the payload in the iq's Innerxml, and
+// in Nested if its type is registered.
+//
+// While any handler is registered, iq gets and sets no handler takes
+// are answered with service-unavailable, as RFC 6120 requires,
+// instead of being delivered on Recv. Those which the library's own
+// extensions answer never get that far. The namespaces aren't
+// advertised; an extension with them among its Features, given to
+// RegisterExtension, does that.
+func (cl *Client) HandleIq(namespace string, h IqHandler) (remove func()) {
+	e := &iqEntry{f: h}
+	r := &cl.iqs
+	r.lock.Lock()
+	if r.handlers == nil {
+		r.handlers = make(map[string]*iqEntry)
+		// Last, so that other middleware sees iqs first.
+		cl.AddRecvMiddleware(math.MaxInt32, cl.iqMiddleware)
+	}
+	r.handlers[namespace] = e
+	r.lock.Unlock()
+	return func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if r.handlers[namespace] == e {
+			delete(r.handlers, namespace)
+		}
+	}
+}
+
+func (cl *Client) iqMiddleware(st Stanza, next func(Stanza)) {
+	iq, ok := st.(*Iq)
+	if !ok || (iq.Type != "get" && iq.Type != "set") {
+		next(st)
+		return
+	}
+	r := &cl.iqs
+	r.lock.Lock()
+	e := r.handlers[iqPayloadSpace(iq)]
+	registry := len(r.handlers) > 0
+	r.lock.Unlock()
+	switch {
+	case e != nil:
+		go cl.answerIq(iq, e.f)
+	case registry:
+		go cl.send(context.Background(), ErrorReply(iq,
+			stanzaError("", CondServiceUnavailable)))
+	default:
+		next(st)
+	}
+}
+
+// Calls a handler, and sends its answer.
+func (cl *Client) answerIq(iq *Iq, f IqHandler) {
+	result, err := f(cl, iq)
+	var reply Stanza
+	switch er := err.(type) {
+	case nil:
+		res := &Iq{Header: Header{To: iq.From, Id: iq.Id,
+			Type: "result"}}
+		if result != nil {
+			res.Nested = []interface{}{result}
+		}
+		reply = res
+	case *Error:
+		reply = ErrorReply(iq, er)
+	default:
+		cl.logf(LogError, "answering %s iq %s from %s: %v",
+			iqPayloadSpace(iq), iq.Id, iq.From, err)
+		reply = ErrorReply(iq,
+			stanzaError("", CondInternalServerError))
+	}
+	cl.send(context.Background(), reply)
+}
+
+// Returns the namespace of an iq's payload, its first child element.
+func iqPayloadSpace(iq *Iq) string {
+	d := xml.NewDecoder(strings.NewReader(iq.Innerxml))
+	for {
+		t, err := d.Token()
+		if err != nil {
+			break
+		}
+		if se, ok := t.(xml.StartElement); ok {
+			return se.Name.Space
+		}
+	}
+	// Perhaps made by the application rather than received.
+	if len(iq.Nested) > 0 {
+		return payloadSpace(iq.Nested[0])
+	}
+	return ""
+}
@@ -0,0 +1,77 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"testing"
+)
+
+func TestHandleIq(t *testing.T) {
+	send := make(chan Stanza, 1)
+	cl := &Client{Send: send, recvPipeline: new(pipeline)}
+	type query struct {
+		XMLName xml.Name `xml:"urn:example:q query"`
+		Answer  string   `xml:"answer,attr"`
+	}
+	remove := cl.HandleIq("urn:example:q", func(c *Client,
+		iq *Iq) (interface{}, error) {
+
+		if c != cl {
+			t.Error("wrong client")
+		}
+		switch iq.Id {
+		case "fail":
+			return nil, errors.New("secret")
+		case "bad":
+			return nil, NewError("", CondBadRequest, "no")
+		case "empty":
+			return nil, nil
+		}
+		return &query{Answer: "42"}, nil
+	})
+	var passed []Stanza
+	recv := func(id, typ, payload string) *Iq {
+		iq := &Iq{}
+		str := `<iq xmlns="jabber:client" from="al@b.c/x" id="` + id +
+			`" type="` + typ + `">` + payload + `</iq>`
+		if err := xml.Unmarshal([]byte(str), iq); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		cl.recvPipeline.run(iq, func(st Stanza) {
+			passed = append(passed, st)
+		})
+		if len(passed) > 0 {
+			return nil
+		}
+		return (<-send).(*Iq)
+	}
+	q := `<query xmlns="urn:example:q"/>`
+
+	reply := recv("ok", "get", q)
+	assertEquals(t, "result", reply.Type)
+	assertEquals(t, "al@b.c/x", string(reply.To))
+	assertEquals(t, "42", reply.Nested[0].(*query).Answer)
+	if reply = recv("empty", "set", q); reply.Type != "result" ||
+		reply.Nested != nil {
+		t.Errorf("empty result %+v", reply)
+	}
+	reply = recv("bad", "set", q)
+	assertEquals(t, CondBadRequest, reply.Error.Condition())
+	assertEquals(t, "no", reply.Error.Message())
+	reply = recv("fail", "get", q)
+	assertEquals(t, CondInternalServerError, reply.Error.Condition())
+	assertEquals(t, "", reply.Error.Message())
+	reply = recv("other", "get", `<query xmlns="urn:example:other"/>`)
+	assertEquals(t, "other", reply.Id)
+	assertEquals(t, CondServiceUnavailable, reply.Error.Condition())
+	if recv("res", "result", q) != nil || len(passed) != 1 {
+		t.Errorf("result not passed on")
+	}
+
+	// Without handlers, iqs reach the application again.
+	passed = nil
+	remove()
+	if recv("other", "get", q) != nil || len(passed) != 1 {
+		t.Errorf("iq not passed on")
+	}
+}
@@ -0,0 +1,166 @@
+package xmpp
+
+// This file contains the parsing, validation and normalization of
+// JIDs, RFC 7622, and the escaping of node parts, XEP-0106.
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The longest each part of a JID may be, in bytes.
+const jidPartMax = 1023
+
+// Splits a JID into its parts. The resource is everything after the
+// first slash, so it may itself contain slashes and at signs.
+func (j JID) split() (node, domain, resource string) {
+	s := string(j)
+	if slash := strings.Index(s, "/"); slash != -1 {
+		s, resource = s[:slash], s[slash+1:]
+	}
+	if at := strings.Index(s, "@"); at != -1 {
+		node, s = s[:at], s[at+1:]
+	}
+	return node, s, resource
+}
+
+// Parses and validates a JID, and returns it normalized: the node and
+// domain are case-folded, and a trailing dot is removed from the
+// domain. The resource is left as it is. This approximates the
+// PRECIS profiles of RFC 7622 without their Unicode tables, so that
+// "User@Example.com" and "user@example.com" are the same JID.
+func ParseJID(s string) (JID, error) {
+	if !utf8.ValidString(s) {
+		return "", fmt.Errorf("JID %q isn't UTF-8", s)
+	}
+	node, domain, res := JID(s).split()
+	hasNode := strings.Contains(s, "@") &&
+		(!strings.Contains(s, "/") ||
+			strings.Index(s, "@") < strings.Index(s, "/"))
+	hasRes := strings.Contains(s, "/")
+
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" {
+		return "", fmt.Errorf("JID %q has no domain", s)
+	}
+	prohibited := " \"&'/:<>@\\"
+	if strings.HasPrefix(domain, "[") {
+		// An IPv6 address.
+		prohibited = strings.Replace(prohibited, ":", "", 1)
+	}
+	if err := checkJidPart(domain, "domain", prohibited); err != nil {
+		return "", fmt.Errorf("JID %q: %v", s, err)
+	}
+	out := strings.ToLower(domain)
+	if hasNode {
+		if node == "" {
+			return "", fmt.Errorf("JID %q has an empty node", s)
+		}
+		if err := checkJidPart(node, "node", " \"&'/:<>@"); err != nil {
+			return "", fmt.Errorf("JID %q: %v", s, err)
+		}
+		out = strings.ToLower(node) + "@" + out
+	}
+	if hasRes {
+		if res == "" {
+			return "", fmt.Errorf("JID %q has an empty resource", s)
+		}
+		if err := checkJidPart(res, "resource", ""); err != nil {
+			return "", fmt.Errorf("JID %q: %v", s, err)
+		}
+		out += "/" + res
+	}
+	return JID(out), nil
+}
+
+func checkJidPart(part, name, prohibited string) error {
+	if len(part) > jidPartMax {
+		return fmt.Errorf("%s is longer than %d bytes", name,
+			jidPartMax)
+	}
+	for _, r := range part {
+		if unicode.IsControl(r) || strings.ContainsRune(prohibited, r) ||
+			(name != "resource" && unicode.IsSpace(r)) {
+			return fmt.Errorf("%s contains %q", name, r)
+		}
+	}
+	return nil
+}
+
+// Returns the normalized form of the JID, or the JID as it is if it
+// isn't valid.
+func (j JID) Normalized() JID {
+	n, err := ParseJID(string(j))
+	if err != nil {
+		return j
+	}
+	return n
+}
+
+// Reports whether two JIDs are the same once they're normalized.
+func (j JID) Equal(other JID) bool {
+	return j == other || j.Normalized() == other.Normalized()
+}
+
+// The characters XEP-0106 escapes in node parts, and their escapes.
+var jidEscapes = map[rune]string{
+	' ': `\20`, '"': `\22`, '&': `\26`, '\'': `\27`, '/': `\2f`,
+	':': `\3a`, '<': `\3c`, '>': `\3e`, '@': `\40`, '\\': `\5c`,
+}
+
+// Reports whether s starts with one of XEP-0106's escapes.
+func jidEscapeAt(s string) (rune, bool) {
+	if len(s) < 3 || s[0] != '\\' {
+		return 0, false
+	}
+	for r, esc := range jidEscapes {
+		if strings.EqualFold(s[:3], esc) {
+			return r, true
+		}
+	}
+	return 0, false
+}
+
+// Escapes a string, such as an email address, so that it can be used
+// as the node part of a JID. XEP-0106. A backslash is only escaped
+// where it would otherwise be read as the start of an escape.
+func EscapeNode(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case r == '\\':
+			if _, ok := jidEscapeAt(s[i:]); ok {
+				b.WriteString(jidEscapes[r])
+			} else {
+				b.WriteRune(r)
+			}
+		case jidEscapes[r] != "":
+			b.WriteString(jidEscapes[r])
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Reverses EscapeNode.
+func UnescapeNode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if r, ok := jidEscapeAt(s[i:]); ok {
+			b.WriteRune(r)
+			i += 2
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Normalizes the addresses of a stanza which has arrived.
+func normalizeHeader(h *Header) {
+	h.To = h.To.Normalized()
+	h.From = h.From.Normalized()
+}
@@ -0,0 +1,593 @@
+package jingle
+
+// This file contains Jingle file transfer, XEP-0234, over SOCKS5
+// bytestreams (XEP-0260) or, if they can't connect, in-band
+// bytestreams (XEP-0261).
+
+import (
+	".."
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"sort"
+)
+
+const (
+	NsJingleFileTransfer = "urn:xmpp:jingle:apps:file-transfer:5"
+	NsJingleS5B          = "urn:xmpp:jingle:transports:s5b:1"
+	NsJingleIbb          = "urn:xmpp:jingle:transports:ibb:1"
+	NsHashes             = "urn:xmpp:hashes:2"
+	NsHashSha256         = "urn:xmpp:hash-function-text-names:sha-256"
+)
+
+// Describes the file a session transfers.
+type FileDesc struct {
+	XMLName xml.Name `xml:"urn:xmpp:jingle:apps:file-transfer:5 description"`
+	File    File     `xml:"file"`
+}
+
+type File struct {
+	MediaType string `xml:"media-type,omitempty"`
+	Name      string `xml:"name,omitempty"`
+	Size      int64  `xml:"size,omitempty"`
+	Desc      string `xml:"desc,omitempty"`
+	Hashes    []Hash `xml:"urn:xmpp:hashes:2 hash"`
+}
+
+// A hash of some data, base64 encoded, as in XEP-0300.
+type Hash struct {
+	Algo  string `xml:"algo,attr"`
+	Value string `xml:",chardata"`
+}
+
+// Returns the file's hash with the given algorithm, such as sha-256,
+// or the empty string.
+func (f *File) Hash(algo string) string {
+	for _, h := range f.Hashes {
+		if h.Algo == algo {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// The hash of a file, sent in session-info once the file has been
+// sent.
+type Checksum struct {
+	XMLName xml.Name `xml:"urn:xmpp:jingle:apps:file-transfer:5 checksum"`
+	Creator string   `xml:"creator,attr"`
+	Name    string   `xml:"name,attr"`
+	File    File     `xml:"file"`
+}
+
+type IbbTransport struct {
+	XMLName   xml.Name `xml:"urn:xmpp:jingle:transports:ibb:1 transport"`
+	BlockSize int      `xml:"block-size,attr"`
+	Sid       string   `xml:"sid,attr"`
+}
+
+// A SOCKS5 transport: the candidates on offer, or later, which of
+// the other side's candidates worked.
+type S5BTransport struct {
+	XMLName        xml.Name       `xml:"urn:xmpp:jingle:transports:s5b:1 transport"`
+	Sid            string         `xml:"sid,attr"`
+	DstAddr        string         `xml:"dstaddr,attr,omitempty"`
+	Mode           string         `xml:"mode,attr,omitempty"`
+	Candidates     []S5BCandidate `xml:"candidate"`
+	CandidateUsed  *S5BCid        `xml:"candidate-used"`
+	CandidateError *struct{}      `xml:"candidate-error"`
+	Activated      *S5BCid        `xml:"activated"`
+	ProxyError     *struct{}      `xml:"proxy-error"`
+}
+
+type S5BCandidate struct {
+	Cid      string   `xml:"cid,attr"`
+	Host     string   `xml:"host,attr"`
+	Jid      xmpp.JID `xml:"jid,attr"`
+	Port     int      `xml:"port,attr,omitempty"`
+	Priority uint32   `xml:"priority,attr"`
+	Type     string   `xml:"type,attr,omitempty"`
+}
+
+type S5BCid struct {
+	Cid string `xml:"cid,attr"`
+}
+
+// The priorities of direct and proxy candidates, as recommended.
+const (
+	s5bDirectPriority = 126 << 16
+	s5bProxyPriority  = 10 << 16
+)
+
+// The name of the one content of a file transfer session.
+const fileContentName = "file"
+
+var errNoCandidate = errors.New("no SOCKS5 candidate worked")
+
+// FileTransfer is a Jingle application type which sends files to
+// others and receives those they offer. Files are sent over SOCKS5
+// if the client has a BytestreamManager, falling back to in-band
+// bytestreams.
+type FileTransfer struct {
+	// Files others offer. Each must be accepted or declined. If
+	// the channel isn't ready for an offer, it's declined as busy.
+	Offers <-chan *FileOffer
+	offers chan *FileOffer
+	jm     *Manager
+	ibb    *xmpp.IbbManager
+	bs     *xmpp.BytestreamManager
+}
+
+// Called with the number of bytes transferred so far.
+type FileProgress func(n int64)
+
+// Creates a FileTransfer and registers it with a Manager, which
+// must then be passed to xmpp.NewClient along with the IbbManager
+// and the BytestreamManager. The latter may be nil, to only send
+// files in band.
+func NewFileTransfer(jm *Manager, ibb *xmpp.IbbManager,
+	bs *xmpp.BytestreamManager) *FileTransfer {
+
+	ft := &FileTransfer{jm: jm, ibb: ibb, bs: bs}
+	ft.offers = make(chan *FileOffer, 16)
+	ft.Offers = ft.offers
+	jm.Register(ft)
+	return ft
+}
+
+func (ft *FileTransfer) Namespace() string {
+	return NsJingleFileTransfer
+}
+
+func (ft *FileTransfer) Features() []string {
+	return []string{NsJingleS5B, NsJingleIbb, NsHashes, NsHashSha256}
+}
+
+func (ft *FileTransfer) HandleSession(s *Session) {
+	var desc FileDesc
+	if err := s.Contents[0].Description.Decode(&desc); err != nil {
+		s.Terminate(context.Background(), ReasonFailedApplication)
+		return
+	}
+	offer := &FileOffer{From: s.Peer, File: desc.File, Session: s,
+		ft: ft}
+	select {
+	case ft.offers <- offer:
+	default:
+		s.Terminate(context.Background(), ReasonBusy)
+	}
+}
+
+// Waits for the peer's next action on a session.
+func nextAction(ctx context.Context, s *Session) (*Jingle,
+	error) {
+
+	select {
+	case j, ok := <-s.Actions:
+		if !ok {
+			reason := "no reason"
+			if r := s.Reason(); r != nil {
+				reason = r.Condition.XMLName.Local
+			}
+			return nil, fmt.Errorf("session %s ended: %s", s.Sid,
+				reason)
+		}
+		return j, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Decodes the transport of an action's first content into v. It's
+// false if there is none of that type.
+func decodeTransport(j *Jingle, v interface{}) bool {
+	if len(j.Contents) == 0 || j.Contents[0].Transport == nil {
+		return false
+	}
+	return j.Contents[0].Transport.Decode(v) == nil
+}
+
+func fileContent(creator string, desc, transport interface{}) Content {
+	c := Content{Creator: creator, Name: fileContentName}
+	if desc != nil {
+		c.Description, _ = NewPayload(desc)
+	}
+	c.Transport, _ = NewPayload(transport)
+	return c
+}
+
+func sendTransportInfo(ctx context.Context, s *Session,
+	tr *S5BTransport) error {
+
+	return s.Send(ctx, &Jingle{Action: TransportInfo,
+		Contents: []Content{fileContent(Initiator, nil, tr)}})
+}
+
+// Copies from r to w, reporting progress and hashing what's copied.
+func copyFile(w io.Writer, r io.Reader, h hash.Hash,
+	progress FileProgress) (int64, error) {
+
+	buf := make([]byte, 32*1024)
+	var n int64
+	for {
+		nr, err := r.Read(buf)
+		if nr > 0 {
+			h.Write(buf[:nr])
+			if _, werr := w.Write(buf[:nr]); werr != nil {
+				return n, werr
+			}
+			n += int64(nr)
+			if progress != nil {
+				progress(n)
+			}
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// Sends a file to a full JID, reading file.Size bytes from r. Returns
+// once the peer has it, or has declined it. Progress may be nil.
+func (ft *FileTransfer) SendFile(ctx context.Context, to xmpp.JID,
+	file File, r io.Reader, progress FileProgress) error {
+
+	jid, _, err := ft.jm.client()
+	if err != nil {
+		return err
+	}
+	tsid := xmpp.NextId()
+	dst := xmpp.BytestreamAddr(tsid, jid, to)
+	var hosts []xmpp.Streamhost
+	var direct <-chan net.Conn
+	if ft.bs != nil {
+		hosts = ft.bs.Streamhosts(ctx)
+		var cancel func()
+		direct, cancel = ft.bs.AwaitDirect(dst)
+		defer cancel()
+	}
+	var tr interface{} = &IbbTransport{BlockSize: xmpp.IbbBlockSize,
+		Sid: tsid}
+	var cands []S5BCandidate
+	if len(hosts) > 0 {
+		for _, h := range hosts {
+			c := S5BCandidate{Cid: xmpp.NextId(), Host: h.Host,
+				Jid: h.Jid, Port: h.Port, Type: "proxy",
+				Priority: s5bProxyPriority}
+			if h.Jid == jid {
+				c.Type, c.Priority = "direct", s5bDirectPriority
+			}
+			cands = append(cands, c)
+		}
+		tr = &S5BTransport{Sid: tsid, DstAddr: dst, Mode: "tcp",
+			Candidates: cands}
+	}
+	content := fileContent(Initiator, &FileDesc{File: file},
+		tr)
+	content.Senders = Initiator
+	s, err := ft.jm.Initiate(ctx, to, []Content{content})
+	if err != nil {
+		return err
+	}
+	fail := func(reason string, err error) error {
+		s.Terminate(context.Background(), reason)
+		return err
+	}
+	for {
+		j, err := nextAction(ctx, s)
+		if err != nil {
+			return fail(ReasonCancel, err)
+		}
+		if j.Action == SessionAccept {
+			break
+		}
+	}
+
+	var conn io.ReadWriteCloser
+	if len(cands) > 0 {
+		conn, err = ft.s5bInitiator(ctx, s, dst, cands, direct)
+		if err == errNoCandidate {
+			conn, err = ft.replaceWithIbb(ctx, s)
+		}
+	} else {
+		conn, err = ft.ibb.Open(ctx, to, tsid, xmpp.IbbBlockSize)
+	}
+	if err != nil {
+		return fail(ReasonFailedTransport, err)
+	}
+
+	h := sha256.New()
+	if file.Size > 0 {
+		r = io.LimitReader(r, file.Size)
+	}
+	n, err := copyFile(conn, r, h, progress)
+	if err == nil && file.Size > 0 && n < file.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		conn.Close()
+		return fail(ReasonFailedApplication, err)
+	}
+	sum := &Checksum{Creator: Initiator,
+		Name: fileContentName, File: File{Hashes: []Hash{{
+			Algo:  "sha-256",
+			Value: base64.StdEncoding.EncodeToString(h.Sum(nil))}}}}
+	info, _ := NewPayload(sum)
+	s.Send(ctx, &Jingle{Action: SessionInfo, Info: info})
+	conn.Close()
+	return s.Terminate(ctx, ReasonSuccess)
+}
+
+// Finds out which of the initiator's candidates the responder could
+// use, and connects by it. The responder's own candidates aren't
+// tried.
+func (ft *FileTransfer) s5bInitiator(ctx context.Context, s *Session,
+	dst string, cands []S5BCandidate,
+	direct <-chan net.Conn) (io.ReadWriteCloser, error) {
+
+	var tr S5BTransport
+	decodeTransport(&Jingle{Contents: s.Contents}, &tr)
+	report := &S5BTransport{Sid: tr.Sid, CandidateError: &struct{}{}}
+	if err := sendTransportInfo(ctx, s, report); err != nil {
+		return nil, err
+	}
+	for {
+		j, err := nextAction(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		var got S5BTransport
+		if j.Action != TransportInfo || !decodeTransport(j, &got) {
+			continue
+		}
+		if got.CandidateError != nil {
+			return nil, errNoCandidate
+		}
+		if got.CandidateUsed == nil {
+			continue
+		}
+		for _, c := range cands {
+			if c.Cid != got.CandidateUsed.Cid {
+				continue
+			}
+			if c.Type == "direct" {
+				return xmpp.WaitDirect(ctx, direct)
+			}
+			conn, err := xmpp.DialStreamhost(ctx, xmpp.Streamhost{Jid: c.Jid,
+				Host: c.Host, Port: c.Port}, dst)
+			if err != nil {
+				return nil, err
+			}
+			err = ft.bs.Activate(ctx, c.Jid, tr.Sid, s.Peer)
+			if err == nil {
+				err = sendTransportInfo(ctx, s, &S5BTransport{
+					Sid: tr.Sid, Activated: &S5BCid{c.Cid}})
+			}
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}
+		return nil, fmt.Errorf("unknown candidate %q",
+			got.CandidateUsed.Cid)
+	}
+}
+
+// Asks the responder to switch to an in-band bytestream, and opens
+// it.
+func (ft *FileTransfer) replaceWithIbb(ctx context.Context,
+	s *Session) (io.ReadWriteCloser, error) {
+
+	sid := xmpp.NextId()
+	tr := &IbbTransport{BlockSize: xmpp.IbbBlockSize, Sid: sid}
+	err := s.Send(ctx, &Jingle{Action: TransportReplace,
+		Contents: []Content{fileContent(Initiator, nil, tr)}})
+	if err != nil {
+		return nil, err
+	}
+	for {
+		j, err := nextAction(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		switch j.Action {
+		case TransportAccept:
+			return ft.ibb.Open(ctx, s.Peer, sid, xmpp.IbbBlockSize)
+		case TransportReject:
+			return nil, errors.New("in-band bytestream refused")
+		}
+	}
+}
+
+// A file someone else offers.
+type FileOffer struct {
+	From    xmpp.JID
+	File    File
+	Session *Session
+	ft      *FileTransfer
+}
+
+// Declines the file.
+func (o *FileOffer) Decline(ctx context.Context) error {
+	return o.Session.Terminate(ctx, ReasonDecline)
+}
+
+// Accepts the file and writes it to w. Returns once it's been
+// received and its hash, if the sender gave one, checked. Progress
+// may be nil.
+func (o *FileOffer) Accept(ctx context.Context, w io.Writer,
+	progress FileProgress) error {
+
+	s := o.Session
+	fail := func(reason string, err error) error {
+		s.Terminate(context.Background(), reason)
+		return err
+	}
+	offered := s.Contents[0]
+	accepted := offered
+	var conn io.ReadWriteCloser
+	var ibbTr IbbTransport
+	var s5bTr S5BTransport
+	var replace *Jingle
+	switch {
+	case decodeTransport(&Jingle{Contents: s.Contents}, &ibbTr):
+		expected := o.ft.ibb.Expect(s.Peer, ibbTr.Sid)
+		if err := s.Accept(ctx, []Content{accepted}); err != nil {
+			return fail(ReasonGeneralError, err)
+		}
+		var err error
+		if conn, err = awaitIbb(ctx, s, expected); err != nil {
+			return fail(ReasonFailedTransport, err)
+		}
+	case decodeTransport(&Jingle{Contents: s.Contents}, &s5bTr):
+		accepted.Transport, _ = NewPayload(&S5BTransport{
+			Sid: s5bTr.Sid, Mode: s5bTr.Mode})
+		if err := s.Accept(ctx, []Content{accepted}); err != nil {
+			return fail(ReasonGeneralError, err)
+		}
+		var err error
+		conn, replace, err = o.s5bResponder(ctx, &s5bTr)
+		if err != nil {
+			return fail(ReasonFailedTransport, err)
+		}
+		if replace != nil {
+			if !decodeTransport(replace, &ibbTr) {
+				return fail(ReasonUnsupportedTransports,
+					errors.New("unsupported replacement transport"))
+			}
+			expected := o.ft.ibb.Expect(s.Peer, ibbTr.Sid)
+			err := s.Send(ctx, &Jingle{Action: TransportAccept,
+				Contents: replace.Contents})
+			if err == nil {
+				conn, err = awaitIbb(ctx, s, expected)
+			}
+			if err != nil {
+				return fail(ReasonFailedTransport, err)
+			}
+		}
+	default:
+		return fail(ReasonUnsupportedTransports,
+			errors.New("unsupported transport"))
+	}
+
+	h := sha256.New()
+	var r io.Reader = conn
+	if o.File.Size > 0 {
+		r = io.LimitReader(conn, o.File.Size)
+	}
+	n, err := copyFile(w, r, h, progress)
+	conn.Close()
+	if err == nil && o.File.Size > 0 && n < o.File.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return fail(ReasonFailedApplication, err)
+	}
+	want := o.File.Hash("sha-256")
+	for want == "" {
+		j, err := nextAction(ctx, s)
+		if err != nil {
+			// The session ended without a checksum.
+			break
+		}
+		var sum Checksum
+		if j.Action == SessionInfo && j.Info != nil &&
+			j.Info.Decode(&sum) == nil {
+			want = sum.File.Hash("sha-256")
+		}
+	}
+	got := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	if want != "" && want != got {
+		return fail(ReasonFailedApplication,
+			fmt.Errorf("%s has the wrong hash", o.File.Name))
+	}
+	return nil
+}
+
+func awaitIbb(ctx context.Context, s *Session,
+	expected <-chan *xmpp.IbbStream) (*xmpp.IbbStream, error) {
+
+	select {
+	case st := <-expected:
+		return st, nil
+	case <-s.Done():
+		return nil, fmt.Errorf("session %s ended", s.Sid)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Tries the initiator's candidates, best first, and reports the
+// outcome. Returns the connection once the initiator has reported
+// on its side and activated any proxy, or the initiator's request to
+// replace the transport.
+func (o *FileOffer) s5bResponder(ctx context.Context,
+	tr *S5BTransport) (io.ReadWriteCloser, *Jingle, error) {
+
+	s := o.Session
+	dst := xmpp.BytestreamAddr(tr.Sid, s.Initiator, s.Responder)
+	cands := append([]S5BCandidate{}, tr.Candidates...)
+	sort.SliceStable(cands, func(i, j int) bool {
+		return cands[i].Priority > cands[j].Priority
+	})
+	var conn net.Conn
+	var used S5BCandidate
+	for _, c := range cands {
+		var err error
+		conn, err = xmpp.DialStreamhost(ctx, xmpp.Streamhost{Jid: c.Jid,
+			Host: c.Host, Port: c.Port}, dst)
+		if err == nil {
+			used = c
+			break
+		}
+	}
+	report := &S5BTransport{Sid: tr.Sid}
+	if conn != nil {
+		report.CandidateUsed = &S5BCid{used.Cid}
+	} else {
+		report.CandidateError = &struct{}{}
+	}
+	if err := sendTransportInfo(ctx, s, report); err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, nil, err
+	}
+	reported, activated := false, used.Type != "proxy"
+	for conn == nil || !reported || !activated {
+		j, err := nextAction(ctx, s)
+		if err != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return nil, nil, err
+		}
+		if j.Action == TransportReplace {
+			if conn != nil {
+				conn.Close()
+			}
+			return nil, j, nil
+		}
+		var got S5BTransport
+		if j.Action != TransportInfo || !decodeTransport(j, &got) {
+			continue
+		}
+		if got.CandidateUsed != nil || got.CandidateError != nil {
+			reported = true
+		}
+		if got.Activated != nil {
+			activated = true
+		}
+	}
+	return conn, nil, nil
+}
@@ -0,0 +1,131 @@
+package jingle
+
+import (
+	".."
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+// Connects a client for the user, with the given extensions, to the
+// server, and discards what it receives.
+func testClient(t *testing.T, s *xmpp.MockServer, user string,
+	exts ...xmpp.Extension) *xmpp.Client {
+
+	jid := xmpp.JID(user + "@b.c/r")
+	cl, err := xmpp.NewClientFromConn(s.Dial(), &jid, "pw",
+		&tls.Config{}, exts, xmpp.Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn %s: %v", jid, err)
+	}
+	go func() {
+		for range cl.Recv {
+		}
+	}()
+	return cl
+}
+
+// Connects a sender and a receiver, and returns their file transfers.
+func testPeers(t *testing.T, sconf, rconf *xmpp.BytestreamConfig) (
+	*FileTransfer, *FileTransfer) {
+
+	s := xmpp.NewMockServer("b.c")
+	t.Cleanup(s.Close)
+	s.AddUser("al", "pw")
+	s.AddUser("di", "pw")
+	side := func(user string, conf *xmpp.BytestreamConfig,
+		ft chan<- *FileTransfer) {
+
+		ibb := xmpp.NewIbbManager(nil)
+		var bs *xmpp.BytestreamManager
+		jm := NewManager()
+		exts := []xmpp.Extension{}
+		if conf != nil {
+			bs = xmpp.NewBytestreamManager(*conf)
+			exts = append(exts, bs.Extension)
+		}
+		f := NewFileTransfer(jm, ibb, bs)
+		exts = append(exts, ibb.Extension, jm.Extension)
+		cl := testClient(t, s, user, exts...)
+		t.Cleanup(cl.Close)
+		// The bytestream manager starts after the client does.
+		for bs != nil && len(bs.Streamhosts(context.Background())) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		ft <- f
+	}
+	sft, rft := make(chan *FileTransfer, 1), make(chan *FileTransfer, 1)
+	go side("al", sconf, sft)
+	side("di", rconf, rft)
+	return <-sft, <-rft
+}
+
+func testFileTransfer(t *testing.T, sconf, rconf *xmpp.BytestreamConfig) {
+	sft, rft := testPeers(t, sconf, rconf)
+
+	data := make([]byte, 10000)
+	rand.Read(data)
+	file := File{Name: "f.bin", Size: int64(len(data))}
+	done := make(chan error, 1)
+	var got bytes.Buffer
+	var progress int64
+	go func() {
+		offer := <-rft.Offers
+		assertEquals(t, "f.bin", offer.File.Name)
+		done <- offer.Accept(context.Background(), &got,
+			func(n int64) { progress = n })
+	}()
+	err := sft.SendFile(context.Background(), "di@b.c/r", file,
+		bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatalf("SendFile: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	if !bytes.Equal(data, got.Bytes()) || progress != int64(len(data)) {
+		t.Errorf("received %d bytes, progress %d", got.Len(), progress)
+	}
+}
+
+func TestFileTransferIbb(t *testing.T) {
+	testFileTransfer(t, nil, nil)
+}
+
+func TestFileTransferDirect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	testFileTransfer(t, &xmpp.BytestreamConfig{Listener: l,
+		Proxies: []xmpp.Streamhost{}}, nil)
+}
+
+func TestFileTransferFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	l.Close()
+	testFileTransfer(t, &xmpp.BytestreamConfig{Proxies: []xmpp.Streamhost{{
+		Jid: "proxy.b.c", Host: "127.0.0.1", Port: addr.Port}}}, nil)
+}
+
+func TestFileOfferDecline(t *testing.T) {
+	sft, rft := testPeers(t, nil, nil)
+	go func() {
+		offer := <-rft.Offers
+		offer.Decline(context.Background())
+	}()
+	err := sft.SendFile(context.Background(), "di@b.c/r",
+		File{Name: "f", Size: 1}, bytes.NewReader([]byte("x")), nil)
+	if err == nil {
+		t.Error("declined file was sent")
+	}
+}
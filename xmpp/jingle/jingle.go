@@ -0,0 +1,483 @@
+// This package implements Jingle, XEP-0166, on top of the xmpp
+// package: sessions between two entities, each negotiating its
+// application types and transports, and file transfer over them,
+// XEP-0234.
+package jingle
+
+// This file contains the core of Jingle, XEP-0166: negotiating
+// sessions between two entities, each with contents whose
+// application types (such as file transfer or RTP) and transports
+// are defined elsewhere.
+
+import (
+	".."
+	"context"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+const NsJingle = "urn:xmpp:jingle:1"
+
+// Jingle actions.
+const (
+	ContentAccept    = "content-accept"
+	ContentAdd       = "content-add"
+	ContentModify    = "content-modify"
+	ContentReject    = "content-reject"
+	ContentRemove    = "content-remove"
+	DescriptionInfo  = "description-info"
+	SessionAccept    = "session-accept"
+	SessionInfo      = "session-info"
+	SessionInitiate  = "session-initiate"
+	SessionTerminate = "session-terminate"
+	TransportAccept  = "transport-accept"
+	TransportInfo    = "transport-info"
+	TransportReject  = "transport-reject"
+	TransportReplace = "transport-replace"
+)
+
+// Which side created a content.
+const (
+	Initiator = "initiator"
+	Responder = "responder"
+)
+
+// Reasons for ending a session.
+const (
+	ReasonSuccess               = "success"
+	ReasonDecline               = "decline"
+	ReasonBusy                  = "busy"
+	ReasonCancel                = "cancel"
+	ReasonGeneralError          = "general-error"
+	ReasonTimeout               = "timeout"
+	ReasonConnectivityError     = "connectivity-error"
+	ReasonFailedApplication     = "failed-application"
+	ReasonFailedTransport       = "failed-transport"
+	ReasonUnsupportedApps       = "unsupported-applications"
+	ReasonUnsupportedTransports = "unsupported-transports"
+)
+
+// A Jingle action on a session.
+type Jingle struct {
+	XMLName   xml.Name  `xml:"urn:xmpp:jingle:1 jingle"`
+	Action    string    `xml:"action,attr"`
+	Sid       string    `xml:"sid,attr"`
+	Initiator xmpp.JID  `xml:"initiator,attr,omitempty"`
+	Responder xmpp.JID  `xml:"responder,attr,omitempty"`
+	Contents  []Content `xml:"content"`
+	Reason    *Reason   `xml:"reason"`
+	// Extra information for session-info.
+	Info *Payload `xml:",any"`
+}
+
+// One content of a session: what's exchanged, and how.
+type Content struct {
+	Creator     string   `xml:"creator,attr"`
+	Name        string   `xml:"name,attr"`
+	Senders     string   `xml:"senders,attr,omitempty"`
+	Description *Payload `xml:"description"`
+	Transport   *Payload `xml:"transport"`
+}
+
+// Why a session or content ended. Condition's name is one of the
+// reasons, such as ReasonSuccess.
+type Reason struct {
+	Condition xmpp.Generic `xml:",any"`
+	Text      string       `xml:"text,omitempty"`
+}
+
+// Returns a reason with the given condition.
+func NewReason(condition string) *Reason {
+	return &Reason{Condition: xmpp.Generic{
+		XMLName: xml.Name{Local: condition}}}
+}
+
+// A description, transport, or other element in the namespace of
+// whatever defines it, kept as XML.
+type Payload struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+// Creates a payload from a value, which is marshaled to XML.
+func NewPayload(v interface{}) (*Payload, error) {
+	buf, err := xml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	p := &Payload{}
+	if err := xml.Unmarshal(buf, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Payload) UnmarshalXML(d *xml.Decoder,
+	start xml.StartElement) error {
+
+	var raw struct {
+		Inner string `xml:",innerxml"`
+	}
+	if err := d.DecodeElement(&raw, &start); err != nil {
+		return err
+	}
+	p.XMLName = start.Name
+	p.Attrs = nil
+	for _, a := range start.Attr {
+		// The namespace is written again from XMLName.
+		if a.Name.Space == "xmlns" || (a.Name.Space == "" &&
+			a.Name.Local == "xmlns") {
+			continue
+		}
+		p.Attrs = append(p.Attrs, a)
+	}
+	p.Inner = raw.Inner
+	return nil
+}
+
+// Unmarshals the payload.
+func (p *Payload) Decode(v interface{}) error {
+	buf, err := xml.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(buf, v)
+}
+
+// Ext may be included in the extensions passed to xmpp.NewClient to
+// decode Jingle actions. A Manager includes it.
+var Ext xmpp.Extension = xmpp.Extension{}
+
+func init() {
+	Ext.StanzaTypes = make(map[xml.Name]reflect.Type)
+	jName := xml.Name{Space: NsJingle, Local: "jingle"}
+	Ext.StanzaTypes[jName] = reflect.TypeOf(Jingle{})
+}
+
+// An application type, such as file transfer, which handles the
+// sessions others initiate with its descriptions.
+type Application interface {
+	// The namespace of the application's descriptions.
+	Namespace() string
+	// Other features to advertise, such as the transports the
+	// application supports.
+	Features() []string
+	// Takes a session someone else initiated, whose first content
+	// has one of the application's descriptions. It's called in a
+	// goroutine of its own, and must accept or terminate the
+	// session.
+	HandleSession(s *Session)
+}
+
+// Manager is an extension which keeps track of Jingle sessions
+// and hands those others initiate to the application types which
+// handle them.
+type Manager struct {
+	xmpp.Extension
+	apps     map[string]Application
+	toServer chan xmpp.Stanza
+	sendDone chan bool
+	lock     sync.Mutex
+	// The client's full JID and SendIq, once it's started.
+	jid      xmpp.JID
+	sendIq   func(context.Context, *xmpp.Iq) (*xmpp.Iq, error)
+	sessions map[sessionKey]*Session
+}
+
+// Identifies a session by the peer and its id.
+type sessionKey struct {
+	peer xmpp.JID
+	sid  string
+}
+
+// Creates a Manager with the given application types, to be
+// passed to xmpp.NewClient among the extensions.
+func NewManager(apps ...Application) *Manager {
+	jm := &Manager{}
+	jm.apps = make(map[string]Application)
+	jm.toServer = make(chan xmpp.Stanza)
+	jm.sendDone = make(chan bool)
+	jm.sessions = make(map[sessionKey]*Session)
+	jm.StanzaTypes = Ext.StanzaTypes
+	jm.Features = []string{NsJingle}
+	for _, app := range apps {
+		jm.Register(app)
+	}
+	jm.RecvFilter = jm.recvFilter
+	jm.SendFilter = jm.sendFilter
+	// Sessions may be initiated as soon as the initial presence
+	// goes out.
+	jm.BeforePresence = func(cl *xmpp.Client) {
+		jm.lock.Lock()
+		defer jm.lock.Unlock()
+		jm.jid = cl.Jid
+		jm.sendIq = cl.SendIq
+	}
+	return jm
+}
+
+// Adds an application type. Its features are only advertised if
+// it's added before the manager is passed to xmpp.NewClient.
+func (jm *Manager) Register(app Application) {
+	jm.lock.Lock()
+	defer jm.lock.Unlock()
+	jm.apps[app.Namespace()] = app
+	jm.Features = append(jm.Features, app.Namespace())
+	jm.Features = append(jm.Features, app.Features()...)
+}
+
+// Returns the client's full JID, and how to send it iqs.
+func (jm *Manager) client() (xmpp.JID,
+	func(context.Context, *xmpp.Iq) (*xmpp.Iq, error), error) {
+
+	jm.lock.Lock()
+	defer jm.lock.Unlock()
+	if jm.sendIq == nil {
+		return "", nil, fmt.Errorf("jingle manager not started")
+	}
+	return jm.jid, jm.sendIq, nil
+}
+
+// Initiates a session with a full JID, offering the given contents.
+// Returns once the peer has acknowledged the offer; whether it
+// accepts arrives later on the session's Actions.
+func (jm *Manager) Initiate(ctx context.Context, to xmpp.JID,
+	contents []Content) (*Session, error) {
+
+	jid, _, err := jm.client()
+	if err != nil {
+		return nil, err
+	}
+	s := newSession(jm, to, xmpp.NextId(), jid, to)
+	s.Contents = contents
+	jm.lock.Lock()
+	jm.sessions[sessionKey{to, s.Sid}] = s
+	jm.lock.Unlock()
+	err = s.Send(ctx, &Jingle{Action: SessionInitiate,
+		Initiator: jid, Contents: contents})
+	if err != nil {
+		jm.remove(s)
+		s.end(nil)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (jm *Manager) remove(s *Session) {
+	jm.lock.Lock()
+	defer jm.lock.Unlock()
+	key := sessionKey{s.Peer, s.Sid}
+	if jm.sessions[key] == s {
+		delete(jm.sessions, key)
+	}
+}
+
+// The sessions in progress.
+func (jm *Manager) Sessions() []*Session {
+	jm.lock.Lock()
+	defer jm.lock.Unlock()
+	var sessions []*Session
+	for _, s := range jm.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// Handles an action from a peer, and returns the error to report,
+// if any.
+func (jm *Manager) handle(from xmpp.JID, j *Jingle) *xmpp.Error {
+	key := sessionKey{from, j.Sid}
+	jm.lock.Lock()
+	s := jm.sessions[key]
+	jid := jm.jid
+	jm.lock.Unlock()
+	if j.Action == SessionInitiate {
+		if s != nil || jid == "" {
+			return xmpp.NewError("cancel", "bad-request", "")
+		}
+		initiator := j.Initiator
+		if initiator == "" {
+			initiator = from
+		}
+		s = newSession(jm, from, j.Sid, initiator, jid)
+		s.Contents = j.Contents
+		jm.lock.Lock()
+		jm.sessions[key] = s
+		jm.lock.Unlock()
+		var app Application
+		if len(j.Contents) > 0 && j.Contents[0].Description != nil {
+			jm.lock.Lock()
+			app = jm.apps[j.Contents[0].Description.XMLName.Space]
+			jm.lock.Unlock()
+		}
+		if app == nil {
+			go s.Terminate(context.Background(),
+				ReasonUnsupportedApps)
+		} else {
+			go app.HandleSession(s)
+		}
+		return nil
+	}
+	if s == nil {
+		return xmpp.NewError("cancel", "item-not-found", "")
+	}
+	if j.Action == SessionTerminate {
+		jm.remove(s)
+		s.end(j.Reason)
+		return nil
+	}
+	return s.deliver(j)
+}
+
+func (jm *Manager) recvFilter(in <-chan xmpp.Stanza, out chan<- xmpp.Stanza) {
+	defer close(out)
+	for stan := range in {
+		iq, ok := stan.(*xmpp.Iq)
+		if !ok || iq.Type != "set" || len(iq.Nested) != 1 {
+			out <- stan
+			continue
+		}
+		j, ok := iq.Nested[0].(*Jingle)
+		if !ok {
+			out <- stan
+			continue
+		}
+		reply := &xmpp.Iq{Header: xmpp.Header{To: iq.From, Id: iq.Id,
+			Type: "result"}}
+		if err := jm.handle(iq.From, j); err != nil {
+			reply.Type = "error"
+			reply.Error = err
+		}
+		select {
+		case jm.toServer <- reply:
+		case <-jm.sendDone:
+		}
+	}
+}
+
+func (jm *Manager) sendFilter(in <-chan xmpp.Stanza, out chan<- xmpp.Stanza) {
+	defer close(out)
+	defer close(jm.sendDone)
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			out <- stan
+		case stan := <-jm.toServer:
+			out <- stan
+		}
+	}
+}
+
+// Session is one session with a peer.
+type Session struct {
+	Peer, Initiator, Responder xmpp.JID
+	Sid                        string
+	// The contents offered by the initiator. Those accepted come
+	// with the session-accept action.
+	Contents []Content
+	// The peer's actions other than session-initiate and
+	// session-terminate. If the channel isn't ready for one, the
+	// peer is asked to try again later. It's closed when the
+	// session ends.
+	Actions <-chan *Jingle
+	actions chan *Jingle
+	jm      *Manager
+	lock    sync.Mutex
+	done    chan struct{}
+	reason  *Reason
+}
+
+func newSession(jm *Manager, peer xmpp.JID, sid string,
+	initiator, responder xmpp.JID) *Session {
+
+	s := &Session{Peer: peer, Sid: sid, Initiator: initiator,
+		Responder: responder, jm: jm}
+	s.actions = make(chan *Jingle, 16)
+	s.Actions = s.actions
+	s.done = make(chan struct{})
+	return s
+}
+
+// Sends an action to the peer, such as transport-info, and waits for
+// it to be acknowledged.
+func (s *Session) Send(ctx context.Context, j *Jingle) error {
+	_, sendIq, err := s.jm.client()
+	if err != nil {
+		return err
+	}
+	j.Sid = s.Sid
+	iq := &xmpp.Iq{Header: xmpp.Header{To: s.Peer, Type: "set",
+		Nested: []interface{}{j}}}
+	_, err = sendIq(ctx, iq)
+	return err
+}
+
+// Accepts a session someone else initiated, with the given contents.
+func (s *Session) Accept(ctx context.Context,
+	contents []Content) error {
+
+	return s.Send(ctx, &Jingle{Action: SessionAccept,
+		Responder: s.Responder, Contents: contents})
+}
+
+// Ends the session for the given reason, such as ReasonSuccess.
+func (s *Session) Terminate(ctx context.Context, reason string) error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	r := NewReason(reason)
+	s.jm.remove(s)
+	s.end(r)
+	return s.Send(ctx, &Jingle{Action: SessionTerminate,
+		Reason: r})
+}
+
+// Passes on an action from the peer, unless the session has ended.
+func (s *Session) deliver(j *Jingle) *xmpp.Error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-s.done:
+		return xmpp.NewError("cancel", "item-not-found", "")
+	default:
+	}
+	select {
+	case s.actions <- j:
+		return nil
+	default:
+		return xmpp.NewError("wait", "resource-constraint", "")
+	}
+}
+
+func (s *Session) end(reason *Reason) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	s.reason = reason
+	close(s.done)
+	close(s.actions)
+}
+
+// Closed when the session ends.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Why the session ended, once it has. It may be nil.
+func (s *Session) Reason() *Reason {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.reason
+}
@@ -0,0 +1,117 @@
+package jingle
+
+import (
+	".."
+	"context"
+	"encoding/xml"
+	"testing"
+)
+
+type testApp struct {
+	sessions chan *Session
+}
+
+func (a *testApp) Namespace() string        { return "urn:test" }
+func (a *testApp) Features() []string       { return []string{"urn:test:t"} }
+func (a *testApp) HandleSession(s *Session) { a.sessions <- s }
+
+func assertEquals(t *testing.T, expected, observed string) {
+	t.Helper()
+	if expected != observed {
+		t.Errorf("expected:\n%s\nobserved:\n%s", expected, observed)
+	}
+}
+
+func TestJinglePayload(t *testing.T) {
+	type desc struct {
+		XMLName xml.Name `xml:"urn:test description"`
+		Media   string   `xml:"media,attr"`
+		Name    string   `xml:"name"`
+	}
+	p, err := NewPayload(&desc{Media: "audio", Name: "x"})
+	if err != nil {
+		t.Fatalf("NewPayload: %v", err)
+	}
+	content := &Content{Creator: Initiator, Name: "c",
+		Description: p}
+	buf, _ := xml.Marshal(content)
+	var c Content
+	if err := xml.Unmarshal(buf, &c); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	assertEquals(t, "urn:test", c.Description.XMLName.Space)
+	var d desc
+	if err := c.Description.Decode(&d); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	assertEquals(t, "audio", d.Media)
+	assertEquals(t, "x", d.Name)
+
+	j := &Jingle{Action: SessionTerminate, Sid: "s",
+		Reason: NewReason(ReasonSuccess)}
+	buf, _ = xml.Marshal(j)
+	assertEquals(t, `<jingle xmlns="`+NsJingle+`" action="session-`+
+		`terminate" sid="s"><reason><success></success></reason>`+
+		`</jingle>`, string(buf))
+}
+
+func TestJingleManager(t *testing.T) {
+	app := &testApp{sessions: make(chan *Session, 1)}
+	jm := NewManager(app)
+	if len(jm.Features) != 3 {
+		t.Errorf("features %v", jm.Features)
+	}
+	sent := make(chan *xmpp.Iq, 1)
+	jm.jid = "me@b.c/r"
+	jm.sendIq = func(ctx context.Context, iq *xmpp.Iq) (*xmpp.Iq, error) {
+		sent <- iq
+		return &xmpp.Iq{Header: xmpp.Header{Id: iq.Id,
+			Type: "result"}}, nil
+	}
+	recvIn := make(chan xmpp.Stanza)
+	recvOut := make(chan xmpp.Stanza, 1)
+	go jm.RecvFilter(recvIn, recvOut)
+	sendIn := make(chan xmpp.Stanza)
+	sendOut := make(chan xmpp.Stanza)
+	go jm.SendFilter(sendIn, sendOut)
+	defer close(sendIn)
+	defer close(recvIn)
+	ask := func(j *Jingle) *xmpp.Iq {
+		recvIn <- &xmpp.Iq{Header: xmpp.Header{From: "a@b.c/x", Id: "1",
+			Type: "set", Nested: []interface{}{j}}}
+		return (<-sendOut).(*xmpp.Iq)
+	}
+	desc, _ := NewPayload(&xmpp.Generic{
+		XMLName: xml.Name{Space: "urn:test", Local: "description"}})
+
+	reply := ask(&Jingle{Action: SessionInitiate, Sid: "s1",
+		Initiator: "a@b.c/x", Contents: []Content{{
+			Creator: Initiator, Name: "c",
+			Description: desc}}})
+	assertEquals(t, "result", reply.Type)
+	s := <-app.sessions
+	assertEquals(t, "s1", s.Sid)
+	assertEquals(t, "me@b.c/r", string(s.Responder))
+	assertEquals(t, "error", ask(&Jingle{Action: TransportInfo,
+		Sid: "s2"}).Type)
+	assertEquals(t, "result", ask(&Jingle{Action: TransportInfo,
+		Sid: "s1"}).Type)
+	assertEquals(t, TransportInfo, (<-s.Actions).Action)
+
+	if err := s.Accept(context.Background(), s.Contents); err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	iq := <-sent
+	assertEquals(t, "a@b.c/x", string(iq.To))
+	assertEquals(t, SessionAccept, iq.Nested[0].(*Jingle).Action)
+	assertEquals(t, "result", ask(&Jingle{Action: SessionTerminate,
+		Sid: "s1", Reason: NewReason(ReasonSuccess)}).Type)
+	<-s.Done()
+	assertEquals(t, ReasonSuccess, s.Reason().Condition.XMLName.Local)
+	if _, ok := <-s.Actions; ok {
+		t.Error("actions not closed")
+	}
+	if len(jm.Sessions()) != 0 {
+		t.Error("session not removed")
+	}
+}
@@ -0,0 +1,133 @@
+package xmpp
+
+// This file contains the languages of streams and stanzas, xml:lang,
+// and choosing among the versions in several languages of a body,
+// subject or status.
+
+import (
+	"strings"
+)
+
+// Returns an extension which gives the languages the user prefers,
+// most preferred first, such as "de-CH" and "en". The first is the
+// default language of the client's streams, so servers may use it
+// for the text they send; the others are used by Client.Text.
+func LanguageExt(langs ...string) Extension {
+	return Extension{option: func(o *options) {
+		o.langs = langs
+	}}
+}
+
+// Returns the header of a new stream to the server.
+func (cl *Client) streamHeader() *stream {
+	st := &stream{To: cl.Jid.Domain(), Version: XMPPVersion}
+	if len(cl.opts.langs) > 0 {
+		st.Lang = cl.opts.langs[0]
+	}
+	return st
+}
+
+// Remembers the default language of the server's stream.
+func (cl *Client) setStreamLang(lang string) {
+	cl.langLock.Lock()
+	defer cl.langLock.Unlock()
+	cl.streamLang = lang
+}
+
+// Returns the default language of the server's stream, from its
+// header's xml:lang, which applies to stanzas without their own.
+func (cl *Client) StreamLang() string {
+	cl.langLock.Lock()
+	defer cl.langLock.Unlock()
+	return cl.streamLang
+}
+
+// Returns which of several texts is in the language best matching
+// one of the preferred ones, which are tried in order. A text without
+// a language of its own is in lang, the language of the stanza it's
+// in. A preference matches texts in its language, or in one its
+// language is a part of, such as "de-CH" of "de", or which is a part
+// of it; so "de-CH" is tried, then "de", and "de" matches "de-AT".
+// Without a match, the text in lang is returned, or else the first.
+// Languages are compared without regard to case.
+func BestText(texts []Text, lang string, prefs ...string) string {
+	if len(texts) == 0 {
+		return ""
+	}
+	langOf := func(t Text) string {
+		if t.Lang != "" {
+			return strings.ToLower(t.Lang)
+		}
+		return strings.ToLower(lang)
+	}
+	for _, pref := range prefs {
+		for tag := strings.ToLower(pref); tag != ""; tag = langParent(tag) {
+			for _, t := range texts {
+				if l := langOf(t); l == tag ||
+					strings.HasPrefix(l, tag+"-") {
+					return t.Chardata
+				}
+			}
+		}
+	}
+	for _, t := range texts {
+		if t.Lang == "" || strings.EqualFold(t.Lang, lang) {
+			return t.Chardata
+		}
+	}
+	return texts[0].Chardata
+}
+
+// Returns the language with its last subtag removed, such as "zh-Hant"
+// for "zh-Hant-TW", or the empty string for one with only one.
+func langParent(tag string) string {
+	i := strings.LastIndexByte(tag, '-')
+	if i < 0 {
+		return ""
+	}
+	tag = tag[:i]
+	// A single letter, such as the "x" of private use subtags, goes
+	// with what follows it. RFC 4647, section 3.4.
+	if j := strings.LastIndexByte(tag, '-'); j >= 0 && len(tag)-j == 2 {
+		tag = tag[:j]
+	}
+	return tag
+}
+
+// Returns the message's body in the language best matching the
+// preferences, as BestText chooses.
+func (m *Message) BodyText(prefs ...string) string {
+	return BestText(m.Body, m.Lang, prefs...)
+}
+
+// Returns the message's subject in the language best matching the
+// preferences, as BestText chooses.
+func (m *Message) SubjectText(prefs ...string) string {
+	return BestText(m.Subject, m.Lang, prefs...)
+}
+
+// Returns the presence's status in the language best matching the
+// preferences, as BestText chooses.
+func (p *Presence) StatusText(prefs ...string) string {
+	return BestText(p.Status, p.Lang, prefs...)
+}
+
+// Returns which of the texts of a stanza, such as a message's Body,
+// is in the language best matching those given to LanguageExt. The
+// stanza's language defaults to the stream's.
+func (cl *Client) Text(h *Header, texts []Text) string {
+	lang := h.Lang
+	if lang == "" {
+		lang = cl.StreamLang()
+	}
+	return BestText(texts, lang, cl.opts.langs...)
+}
+
+// Chooses among the texts as cl.Text does, or before an extension has
+// been given the client, as BestText does without preferences.
+func clientText(cl *Client, h *Header, texts []Text) string {
+	if cl == nil {
+		return BestText(texts, h.Lang)
+	}
+	return cl.Text(h, texts)
+}
@@ -0,0 +1,76 @@
+package xmpp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBestText(t *testing.T) {
+	texts := []Text{{Chardata: "Hello"}, {Lang: "de-AT", Chardata: "Servus"},
+		{Lang: "FR", Chardata: "Bonjour"}, {Lang: "zh-Hant-TW",
+			Chardata: "你好"}}
+	for _, c := range []struct {
+		lang  string
+		prefs []string
+		want  string
+	}{
+		{"en", nil, "Hello"},
+		{"en", []string{"fr"}, "Bonjour"},
+		{"en", []string{"fr-CA"}, "Bonjour"},
+		{"en", []string{"de-CH", "fr"}, "Servus"},
+		{"en", []string{"zh-Hant"}, "你好"},
+		{"en", []string{"it"}, "Hello"},
+		// The stanza's language applies to the text without one.
+		{"it", []string{"it-IT"}, "Hello"},
+	} {
+		if got := BestText(texts, c.lang, c.prefs...); got != c.want {
+			t.Errorf("%s %v: got %q, want %q", c.lang, c.prefs, got,
+				c.want)
+		}
+	}
+	// Without a text in the stanza's language, the first is chosen.
+	assertEquals(t, "Servus", BestText(texts[1:], "en", "it"))
+	assertEquals(t, "", BestText(nil, "en", "en"))
+
+	assertEquals(t, "zh-Hant", langParent("zh-Hant-TW"))
+	assertEquals(t, "de", langParent("de-x-foo"))
+	assertEquals(t, "", langParent("de"))
+
+	m := &Message{Header: Header{Lang: "en"}, Body: texts,
+		Subject: []Text{{Lang: "fr", Chardata: "Salut"}}}
+	assertEquals(t, "Bonjour", m.BodyText("fr"))
+	assertEquals(t, "Salut", m.SubjectText("de"))
+	p := &Presence{Status: []Text{{Lang: "de", Chardata: "Weg"},
+		{Lang: "en", Chardata: "Away"}}}
+	assertEquals(t, "Away", p.StatusText("en-GB"))
+}
+
+func TestLanguageExt(t *testing.T) {
+	cl := &Client{Jid: "a@b.c/r"}
+	if strings.Contains(cl.streamHeader().String(), "xml:lang") {
+		t.Errorf("language without LanguageExt: %s", cl.streamHeader())
+	}
+	cl.opts = newOptions([]Extension{LanguageExt("de-CH", "en")})
+	if !strings.Contains(cl.streamHeader().String(), ` xml:lang="de-CH"`) {
+		t.Errorf("stream header %s", cl.streamHeader())
+	}
+
+	// The stream's language applies to stanzas without one.
+	texts := []Text{{Chardata: "Guten Tag"}, {Lang: "en",
+		Chardata: "Good day"}}
+	assertEquals(t, "Good day", cl.Text(&Header{}, texts))
+	cl.setStreamLang("de")
+	assertEquals(t, "Guten Tag", cl.Text(&Header{}, texts))
+	assertEquals(t, "Good day", cl.Text(&Header{Lang: "fr"}, texts))
+}
+
+func TestChatEventLanguage(t *testing.T) {
+	m := &Message{Header: Header{From: "a@b.c/r", Type: "chat"},
+		Body: []Text{{Lang: "fr", Chardata: "Bonjour"},
+			{Chardata: "Hello"}}}
+	// Without preferences, the body in the message's own language.
+	assertEquals(t, "Hello", chatEvents(nil, m)[0].Body)
+	cl := &Client{Jid: "me@b.c/r"}
+	cl.opts = newOptions([]Extension{LanguageExt("fr-CA")})
+	assertEquals(t, "Bonjour", chatEvents(cl, m)[0].Body)
+}
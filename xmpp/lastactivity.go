@@ -0,0 +1,115 @@
+package xmpp
+
+// This file contains last activity, XEP-0012, and last user
+// interaction in presence, XEP-0319.
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"reflect"
+	"time"
+)
+
+const (
+	NsLast = "jabber:iq:last"
+	NsIdle = "urn:xmpp:idle:1"
+)
+
+// A last activity query or its answer. What Seconds means depends on
+// what was asked: for a full JID, how long the user has been idle; for
+// a bare JID, how long ago the user's last session ended, with the
+// status it ended with; for a server, how long it's been running.
+type LastActivity struct {
+	XMLName xml.Name `xml:"jabber:iq:last query"`
+	Seconds *int     `xml:"seconds,attr"`
+	Status  string   `xml:",chardata"`
+}
+
+// Says when the user last interacted with the client, in a presence.
+type Idle struct {
+	XMLName xml.Name `xml:"urn:xmpp:idle:1 idle"`
+	Since   time.Time
+}
+
+// The wire form of Idle.
+type idleXml struct {
+	XMLName xml.Name `xml:"urn:xmpp:idle:1 idle"`
+	Since   string   `xml:"since,attr"`
+}
+
+func (i *Idle) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.Encode(&idleXml{
+		Since: i.Since.UTC().Format(time.RFC3339)})
+}
+
+// A malformed time is read as the zero time rather than an error, as
+// with Delay.
+func (i *Idle) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	var ix idleXml
+	if err := dec.DecodeElement(&ix, &start); err != nil {
+		return err
+	}
+	*i = Idle{XMLName: ix.XMLName}
+	i.Since, _ = time.Parse(time.RFC3339Nano, ix.Since)
+	return nil
+}
+
+// IdleExt may be included in the extensions passed to NewClient to
+// decode the last interaction times in presences.
+var IdleExt Extension = Extension{}
+
+func init() {
+	IdleExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	iName := xml.Name{Space: NsIdle, Local: "idle"}
+	IdleExt.StanzaTypes[iName] = reflect.TypeOf(Idle{})
+}
+
+// Returns when the sender of the presence last interacted with its
+// client, if it says.
+func (p *Presence) IdleSince() (time.Time, bool) {
+	for _, ele := range p.Nested {
+		if i, ok := ele.(*Idle); ok && !i.Since.IsZero() {
+			return i.Since, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Returns an extension which has the client answer last activity
+// queries with how long the user has been idle, as idle reports.
+func LastActivityExt(idle func() time.Duration) Extension {
+	return Extension{Features: []string{NsLast},
+		option: func(o *options) {
+			o.idle = idle
+		}}
+}
+
+// Asks an entity for its last activity, and returns the time and the
+// status given; see LastActivity for what they mean.
+func (cl *Client) LastActivity(ctx context.Context, jid JID) (time.Duration,
+	string, error) {
+
+	iq := &Iq{Header: Header{To: jid, Type: "get",
+		Nested: []interface{}{&LastActivity{}}}}
+	reply, err := cl.SendIq(ctx, iq)
+	if err != nil {
+		return 0, "", err
+	}
+	for _, ele := range reply.Nested {
+		if la, ok := ele.(*LastActivity); ok && la.Seconds != nil {
+			return time.Duration(*la.Seconds) * time.Second,
+				la.Status, nil
+		}
+	}
+	return 0, "", errors.New("no last activity in reply")
+}
+
+// Answers a last activity query.
+func lastActivity(idle time.Duration) *LastActivity {
+	secs := int(idle / time.Second)
+	if secs < 0 {
+		secs = 0
+	}
+	return &LastActivity{Seconds: &secs}
+}
@@ -0,0 +1,57 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestIdle(t *testing.T) {
+	since := time.Date(2010, 8, 18, 16, 18, 33, 0, time.UTC)
+	exp := `<idle xmlns="` + NsIdle + `" since="2010-08-18T16:18:33Z"></idle>`
+	assertMarshal(t, exp, &Idle{Since: since})
+
+	var pr Presence
+	str := `<presence xmlns="jabber:client"><idle xmlns="` + NsIdle +
+		`" since="2010-08-18T18:18:33+02:00"/></presence>`
+	if err := xml.Unmarshal([]byte(str), &pr); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseExtended(&pr.Header, IdleExt.StanzaTypes); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := pr.IdleSince(); !ok || !got.Equal(since) {
+		t.Errorf("idle since %v %v", got, ok)
+	}
+}
+
+func TestLastActivityExt(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	s.AddUser("bob", "secret")
+	alice := mockClient(t, s, "alice@b.c/pc", "secret", &tls.Config{})
+	defer alice.Close()
+	jid := JID("bob@b.c/pc")
+	bob, err := NewClientFromConn(s.Dial(), &jid, "secret", &tls.Config{},
+		[]Extension{LastActivityExt(func() time.Duration {
+			return 90 * time.Second
+		})}, Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn: %v", err)
+	}
+	defer bob.Close()
+
+	idle, _, err := alice.LastActivity(context.Background(), jid)
+	if err != nil {
+		t.Fatalf("LastActivity: %v", err)
+	}
+	if idle != 90*time.Second {
+		t.Errorf("idle %v", idle)
+	}
+	if !bob.disco.info.HasFeature(NsLast) {
+		t.Error("last activity not advertised")
+	}
+}
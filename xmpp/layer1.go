@@ -9,6 +9,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -17,7 +18,20 @@ var Debug = false
 
 var l1interval = time.Second
 
+// How much the transport reads from or writes to the socket at once.
+const transportBufSize = 16 << 10
+
+// The transport's buffers, which are kept for the next session when
+// one ends.
+var transportBufs = sync.Pool{New: func() interface{} {
+	b := make([]byte, transportBufSize)
+	return &b
+}}
+
 type layer1 struct {
+	// Guards sock for readers outside the goroutine which changes
+	// it.
+	lock      sync.Mutex
 	sock      net.Conn
 	recvSocks chan<- net.Conn
 	sendSocks chan net.Conn
@@ -38,6 +52,53 @@ func (cl *Client) startLayer1(sock net.Conn, recvWriter io.WriteCloser,
 }
 
 func (l1 *layer1) startTls(conf *tls.Config) {
+	l1.setSock(tls.Client(l1.sock, conf))
+}
+
+// Whether the socket is a TLS connection, or a transport like
+// WebSocket which is carried over one.
+func (l1 *layer1) encrypted() bool {
+	switch c := l1.sock.(type) {
+	case *tls.Conn:
+		return true
+	case interface{ ConnectionState() tls.ConnectionState }:
+		return c.ConnectionState().HandshakeComplete
+	}
+	return false
+}
+
+// Returns the state of the TLS connection the stream runs over, if it
+// does and the handshake is done.
+func (l1 *layer1) tlsState() (tls.ConnectionState, bool) {
+	c, ok := l1.sock.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	cs := c.ConnectionState()
+	return cs, cs.HandshakeComplete
+}
+
+// Returns the connection under any TLS layer, which stays the same
+// across STARTTLS.
+func rawConn(sock net.Conn) net.Conn {
+	switch c := sock.(type) {
+	case *tls.Conn:
+		return c.NetConn()
+	case *compressConn:
+		return rawConn(c.Conn)
+	}
+	return sock
+}
+
+// Returns the socket in use.
+func (l1 *layer1) current() net.Conn {
+	l1.lock.Lock()
+	defer l1.lock.Unlock()
+	return l1.sock
+}
+
+// Switch the transport goroutines over to a new socket.
+func (l1 *layer1) setSock(sock net.Conn) {
 	sendSockToSender := func(sock net.Conn) {
 		for {
 			select {
@@ -50,7 +111,9 @@ func (l1 *layer1) startTls(conf *tls.Config) {
 
 	sendSockToSender(nil)
 	l1.recvSocks <- nil
-	l1.sock = tls.Client(l1.sock, conf)
+	l1.lock.Lock()
+	l1.sock = sock
+	l1.lock.Unlock()
 	sendSockToSender(l1.sock)
 	l1.recvSocks <- l1.sock
 }
@@ -60,7 +123,11 @@ func (cl *Client) recvTransport(socks <-chan net.Conn, w io.WriteCloser,
 
 	defer w.Close()
 	var sock net.Conn
-	p := make([]byte, 1024)
+	bp := transportBufs.Get().(*[]byte)
+	defer transportBufs.Put(bp)
+	p := *bp
+	tap := newDebugTap(false)
+	var r redactor
 	for {
 		select {
 		case stat := <-status:
@@ -78,17 +145,29 @@ func (cl *Client) recvTransport(socks <-chan net.Conn, w io.WriteCloser,
 			sock.SetReadDeadline(time.Now().Add(l1interval))
 			nr, err := sock.Read(p)
 			if nr == 0 {
-				if errno, ok := err.(*net.OpError); ok {
+				if errno, ok := err.(net.Error); ok {
 					if errno.Timeout() {
 						continue
 					}
 				}
-				cl.setError(fmt.Errorf("recv: %v", err))
+				// The socket may have been closed because the
+				// session is shutting down.
+				select {
+				case stat := <-status:
+					if stat.Fatal() {
+						return
+					}
+				default:
+				}
+				if cl.lostConnection(sock, fmt.Errorf("recv: %v",
+					err)) {
+					sock = nil
+					continue
+				}
 				return
 			}
-			if Debug {
-				log.Printf("recv: %s", p[:nr])
-			}
+			cl.countBytes(false, nr)
+			cl.traffic(&r, tap, false, p[:nr])
 			nw, err := w.Write(p[:nr])
 			if nw < nr {
 				cl.setError(fmt.Errorf("recv: %v", err))
@@ -100,35 +179,111 @@ func (cl *Client) recvTransport(socks <-chan net.Conn, w io.WriteCloser,
 
 func (cl *Client) sendTransport(socks <-chan net.Conn, r io.Reader) {
 	var sock net.Conn
-	p := make([]byte, 1024)
+	// While a lost connection is being replaced, output is
+	// discarded.
+	lost := false
+	bp := transportBufs.Get().(*[]byte)
+	defer transportBufs.Put(bp)
+	p := *bp
+	tap := newDebugTap(true)
+	var red redactor
 	for {
 		nr, err := r.Read(p)
 		if nr == 0 {
 			cl.setError(fmt.Errorf("send: %v", err))
 			break
 		}
-		if nr > 0 && Debug {
-			log.Printf("send: %s", p[:nr])
+		if nr > 0 {
+			cl.traffic(&red, tap, true, p[:nr])
 		}
 		for nr > 0 {
 			select {
 			case sock = <-socks:
 				if sock != nil {
-					defer sock.Close()
+					lost = false
+					defer cl.closeSock(sock)
 				}
 			default:
 			}
 
-			if sock == nil {
+			if sock == nil && lost {
+				break
+			} else if sock == nil {
 				time.Sleep(l1interval)
 			} else {
 				nw, err := sock.Write(p[:nr])
+				cl.countBytes(true, nw)
 				nr -= nw
 				if nr != 0 {
-					cl.setError(fmt.Errorf("send: %v", err))
+					if cl.lostConnection(sock,
+						fmt.Errorf("send: %v", err)) {
+						sock = nil
+						lost = true
+					}
 					break
 				}
 			}
 		}
 	}
 }
+
+// Closes a socket the sender has finished with, unless the stream has
+// been ended; then Close closes it, once the server has ended its
+// stream too.
+func (cl *Client) closeSock(sock net.Conn) {
+	select {
+	case <-cl.ended:
+	default:
+		sock.Close()
+	}
+}
+
+// Passes traffic, with its secrets removed, to the tap, the capture
+// and the debug log.
+func (cl *Client) traffic(r *redactor, tap *debugTap, outbound bool,
+	p []byte) {
+
+	if !Debug && cl.opts.traffic == nil && cl.opts.capture == nil {
+		return
+	}
+	p = r.redact(p)
+	if len(p) == 0 {
+		return
+	}
+	if cl.opts.traffic != nil {
+		cl.opts.traffic(outbound, p)
+	}
+	if cl.opts.capture != nil {
+		cl.opts.capture.write(outbound, p)
+	}
+	if Debug && DebugPretty {
+		tap.Write(p)
+	} else if Debug && outbound {
+		log.Printf("send: %s", p)
+	} else if Debug {
+		log.Printf("recv: %s", p)
+	}
+}
+
+// Adapts an io.ReadWriter to net.Conn, for NewClientFromReadWriter.
+type rwConn struct {
+	io.ReadWriter
+}
+
+type rwAddr struct{}
+
+func (rwAddr) Network() string { return "rw" }
+func (rwAddr) String() string  { return "rw" }
+
+func (c *rwConn) Close() error {
+	if cl, ok := c.ReadWriter.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
+
+func (c *rwConn) LocalAddr() net.Addr                { return rwAddr{} }
+func (c *rwConn) RemoteAddr() net.Addr               { return rwAddr{} }
+func (c *rwConn) SetDeadline(t time.Time) error      { return nil }
+func (c *rwConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *rwConn) SetWriteDeadline(t time.Time) error { return nil }
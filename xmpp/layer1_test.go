@@ -0,0 +1,136 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Plays the server's side of stream negotiation over conn, with PLAIN
+// authentication, optional compression, and no TLS, and then reports
+// the names of the stanzas the client sends.
+func fakeServer(t *testing.T, conn net.Conn, stanzas chan<- string) {
+	defer close(stanzas)
+	dec := xml.NewDecoder(conn)
+	write := func(s string) {
+		if _, err := io.WriteString(conn, s); err != nil {
+			t.Errorf("server write: %v", err)
+		}
+	}
+	authed, compressed := false, false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return
+		}
+		if ee, ok := tok.(xml.EndElement); ok &&
+			ee.Name.Local == "stream" {
+			write(`</stream:stream>`)
+			conn.Close()
+			return
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if se.Name.Local == "stream" {
+			write(`<stream:stream xmlns="jabber:client" ` +
+				`xmlns:stream="` + NsStream + `" ` +
+				`from="example.com" id="s1" version="1.0">`)
+			if authed {
+				comp := ""
+				if !compressed {
+					comp = `<compression xmlns="` +
+						NsCompressFeature + `"><method>zlib` +
+						`</method></compression>`
+				}
+				write(`<stream:features>` + comp + `<bind xmlns="` +
+					NsBind + `"/><session xmlns="` + NsSession +
+					`"/></stream:features>`)
+			} else {
+				write(`<stream:features><mechanisms xmlns="` +
+					NsSASL + `"><mechanism>PLAIN</mechanism>` +
+					`</mechanisms></stream:features>`)
+			}
+			continue
+		}
+		var el struct {
+			Id    string `xml:"id,attr"`
+			Type  string `xml:"type,attr"`
+			Inner string `xml:",innerxml"`
+		}
+		if err := dec.DecodeElement(&el, &se); err != nil {
+			return
+		}
+		switch {
+		case se.Name.Local == "auth":
+			authed = true
+			write(`<success xmlns="` + NsSASL + `"/>`)
+		case se.Name.Local == "compress":
+			write(`<compressed xmlns="` + NsCompress + `"/>`)
+			compressed = true
+			conn = newCompressConn(conn)
+			dec = xml.NewDecoder(conn)
+			stanzas <- "compress"
+		case strings.Contains(el.Inner, NsBind):
+			write(fmt.Sprintf(`<iq type="result" id="%s"><bind `+
+				`xmlns="%s"><jid>user@example.com/res</jid>`+
+				`</bind></iq>`, el.Id, NsBind))
+		case strings.Contains(el.Inner, NsSession):
+			write(fmt.Sprintf(`<iq type="result" id="%s"/>`, el.Id))
+		case strings.Contains(el.Inner, NsRegister) && el.Type == "get":
+			write(fmt.Sprintf(`<iq type="result" id="%s"><query `+
+				`xmlns="%s"><username/><password/><email/></query>`+
+				`</iq>`, el.Id, NsRegister))
+		case strings.Contains(el.Inner, NsRegister):
+			stanzas <- el.Inner
+			write(fmt.Sprintf(`<iq type="result" id="%s"/>`, el.Id))
+		default:
+			stanzas <- se.Name.Local
+		}
+	}
+}
+
+func TestNewClientFromConn(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	stanzas := make(chan string, 10)
+	go fakeServer(t, sconn, stanzas)
+
+	jid := JID("user@example.com/res")
+	cl, err := NewClientFromConn(cconn, &jid, "secret", &tls.Config{},
+		nil, Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn: %v", err)
+	}
+	assertEquals(t, "user@example.com/res", string(cl.Jid))
+	// The roster request, then the initial presence.
+	assertEquals(t, "iq", <-stanzas)
+	assertEquals(t, "presence", <-stanzas)
+	cl.Close()
+	sconn.Close()
+}
+
+func TestCompression(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	stanzas := make(chan string, 10)
+	go fakeServer(t, sconn, stanzas)
+
+	jid := JID("user@example.com/res")
+	cl, err := NewClientFromConn(cconn, &jid, "secret", &tls.Config{},
+		[]Extension{CompressionExt}, Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn: %v", err)
+	}
+	assertEquals(t, "compress", <-stanzas)
+	assertEquals(t, "iq", <-stanzas)
+	assertEquals(t, "presence", <-stanzas)
+	if _, ok := cl.layer1.current().(*compressConn); !ok {
+		t.Error("not compressed")
+	}
+	cl.Close()
+	sconn.Close()
+}
@@ -4,12 +4,31 @@
 package xmpp
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/xml"
 	"fmt"
 	"io"
-	"log"
 	"reflect"
 	"strings"
+	"sync"
+)
+
+// How many structures may wait for sendXml, so that their senders
+// don't wait for each to be marshaled, and they can be written
+// together.
+const sendXmlBuffer = 64
+
+// The buffers the XML is read from and written to, which are kept for
+// the next session when one ends, so that a process running many
+// sessions doesn't keep allocating them.
+var (
+	readerBufs = sync.Pool{New: func() interface{} {
+		return bufio.NewReaderSize(nil, transportBufSize)
+	}}
+	writerBufs = sync.Pool{New: func() interface{} {
+		return bufio.NewWriterSize(nil, transportBufSize)
+	}}
 )
 
 // Read bytes from a reader, unmarshal them as XML into structures of
@@ -23,7 +42,17 @@ func (cl *Client) recvXml(r io.Reader, ch chan<- interface{},
 	nsstr := fmt.Sprintf(`<a xmlns="%s" xmlns:stream="%s">`,
 		NsClient, NsStream)
 	nsrdr := strings.NewReader(nsstr)
-	p := xml.NewDecoder(io.MultiReader(nsrdr, r))
+	if cl.component {
+		r = newComponentReader(r)
+	}
+	r = newLimitReader(r, cl.opts.limits)
+	br := readerBufs.Get().(*bufio.Reader)
+	br.Reset(io.MultiReader(nsrdr, r))
+	defer func() {
+		br.Reset(nil)
+		readerBufs.Put(br)
+	}()
+	p := xml.NewDecoder(br)
 	p.Token()
 
 Loop:
@@ -32,10 +61,15 @@ Loop:
 		t, err := p.Token()
 		if t == nil {
 			if err != io.EOF {
-				cl.setError(fmt.Errorf("recv: %v", err))
+				cl.recvFailed(err)
 			}
 			break
 		}
+		if ee, ok := t.(xml.EndElement); ok &&
+			ee.Name.Space == NsStream && ee.Name.Local == "stream" {
+			cl.streamEnded()
+			continue
+		}
 		var se xml.StartElement
 		var ok bool
 		if se, ok = t.(xml.StartElement); !ok {
@@ -60,8 +94,25 @@ Loop:
 		case NsTLS + " proceed", NsTLS + " failure":
 			obj = &starttls{}
 		case NsSASL + " challenge", NsSASL + " failure",
-			NsSASL + " success":
+			NsSASL + " success", NsSasl2 + " challenge",
+			NsSasl2 + " failure", NsSasl2 + " continue":
 			obj = &auth{}
+		case NsSasl2 + " success":
+			obj = &sasl2Success{}
+		case NsCompress + " compressed", NsCompress + " failure":
+			obj = &compress{}
+		case NsClient + " handshake":
+			obj = &handshake{}
+		case NsSM + " enabled":
+			obj = &smEnabled{}
+		case NsSM + " resumed":
+			obj = &smResumed{}
+		case NsSM + " failed":
+			obj = &smFailed{}
+		case NsSM + " r":
+			obj = &smRequest{}
+		case NsSM + " a":
+			obj = &smAnswer{}
 		case NsClient + " iq":
 			obj = &Iq{}
 		case NsClient + " message":
@@ -70,16 +121,14 @@ Loop:
 			obj = &Presence{}
 		default:
 			obj = &Generic{}
-			if Debug {
-				log.Printf("Ignoring unrecognized: %s %s",
-					se.Name.Space, se.Name.Local)
-			}
+			cl.logf(LogDebug, "Ignoring unrecognized: %s %s",
+				se.Name.Space, se.Name.Local)
 		}
 
 		// Read the complete XML stanza.
 		err = p.DecodeElement(obj, &se)
 		if err != nil {
-			cl.setError(fmt.Errorf("recv: %v", err))
+			cl.recvFailed(err)
 			break Loop
 		}
 
@@ -87,7 +136,14 @@ Loop:
 		// into objects of the appropriate respective
 		// types. This is specified by our extensions.
 		if st, ok := obj.(Stanza); ok {
-			err = parseExtended(st.GetHeader(), extStanza)
+			normalizeHeader(st.GetHeader())
+			types := extStanza
+			if cl.extensions != nil {
+				// Extensions may have been registered
+				// since.
+				types = cl.extensions.stanzaTypes()
+			}
+			err = parseExtended(st.GetHeader(), types)
 			if err != nil {
 				cl.setError(fmt.Errorf("recv: %v", err))
 				break Loop
@@ -99,6 +155,15 @@ Loop:
 	}
 }
 
+// Ends the session when what the server sent couldn't be read.
+func (cl *Client) recvFailed(err error) {
+	if isLimitError(err) {
+		cl.refuseXml(err)
+		return
+	}
+	cl.setError(fmt.Errorf("recv: %w", err))
+}
+
 func parseExtended(st *Header, extStanza map[xml.Name]reflect.Type) error {
 	// Now parse the stanza's innerxml to find the string that we
 	// can unmarshal this nested element from.
@@ -122,6 +187,15 @@ func parseExtended(st *Header, extStanza map[xml.Name]reflect.Type) error {
 				if err != nil {
 					return err
 				}
+				if c, ok := nested.(stanzaCarrier); ok {
+					for _, h := range c.carried() {
+						normalizeHeader(h)
+						err := parseExtended(h, extStanza)
+						if err != nil {
+							return err
+						}
+					}
+				}
 				st.Nested = append(st.Nested, nested)
 			}
 		}
@@ -131,29 +205,107 @@ func parseExtended(st *Header, extStanza map[xml.Name]reflect.Type) error {
 }
 
 // Receive structures on a channel, marshal them to XML, and send the
-// bytes on a writer.
-func (cl *Client) sendXml(w io.Writer, ch <-chan interface{}) {
+// bytes on a writer, until the channel is closed or quit is. What's
+// marshaled is buffered, and only written once nothing else is
+// waiting to be sent, or the buffer is full, so that a burst of
+// stanzas goes out in a few writes instead of one each.
+func (cl *Client) sendXml(w io.Writer, ch <-chan interface{},
+	quit <-chan bool) {
+	bw := writerBufs.Get().(*bufio.Writer)
+	bw.Reset(w)
 	defer func(w io.Writer) {
+		bw.Flush()
+		bw.Reset(nil)
+		writerBufs.Put(bw)
 		if c, ok := w.(io.Closer); ok {
 			c.Close()
 		}
 	}(w)
 
-	enc := xml.NewEncoder(w)
-
-	for obj := range ch {
-		if st, ok := obj.(*stream); ok {
-			_, err := w.Write([]byte(st.String()))
-			if err != nil {
+	xw := &xmlWriter{cl: cl, bw: bw}
+	xw.enc = xml.NewEncoder(&xw.buf)
+	for {
+		var obj interface{}
+		var ok bool
+		select {
+		case obj, ok = <-ch:
+		default:
+			if err := bw.Flush(); err != nil {
 				cl.setError(fmt.Errorf("send: %v", err))
-				break
+				return
 			}
-		} else {
-			err := enc.Encode(obj)
-			if err != nil {
-				cl.setError(fmt.Errorf("send: %v", err))
-				break
+			select {
+			case obj, ok = <-ch:
+			case <-quit:
+				// What was sent before is still written,
+				// such as the end of the stream.
+				xw.drain(ch)
+				return
 			}
 		}
+		if !ok {
+			return
+		}
+		if err := xw.write(obj); err != nil {
+			cl.setError(fmt.Errorf("send: %v", err))
+			return
+		}
+	}
+}
+
+// Marshals what sendXml is given to its buffered writer.
+type xmlWriter struct {
+	cl *Client
+	bw *bufio.Writer
+	// Elements are marshaled here first, since the encoder flushes
+	// what it's written each time, and component stanzas have
+	// their namespace changed.
+	buf bytes.Buffer
+	enc *xml.Encoder
+}
+
+func (xw *xmlWriter) write(obj interface{}) error {
+	switch x := obj.(type) {
+	case *flushMarker:
+		// Everything before it has been written.
+		if err := xw.bw.Flush(); err != nil {
+			return err
+		}
+		close(x.done)
+		return nil
+	case *stream:
+		_, err := xw.bw.WriteString(x.String())
+		return err
+	case streamEnd:
+		_, err := xw.bw.WriteString("</stream:stream>")
+		return err
+	case whitespacePing:
+		return xw.bw.WriteByte(' ')
+	case Stanza:
+		xw.cl.countStanza(true, x)
+		obj = xw.cl.namePayloads(x)
+	}
+	xw.buf.Reset()
+	if err := xw.enc.Encode(obj); err != nil {
+		return err
+	}
+	if _, ok := obj.(Stanza); ok && xw.cl.component {
+		return writeComponent(xw.bw, xw.buf.Bytes())
+	}
+	_, err := xw.bw.Write(xw.buf.Bytes())
+	return err
+}
+
+// Writes whatever is waiting on the channel.
+func (xw *xmlWriter) drain(ch <-chan interface{}) {
+	for {
+		select {
+		case obj, ok := <-ch:
+			if !ok || xw.write(obj) != nil {
+				return
+			}
+		default:
+			return
+		}
 	}
 }
@@ -0,0 +1,139 @@
+package xmpp
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Keeps what's written, counting the writes.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestSendXmlBuffered(t *testing.T) {
+	cl := &Client{}
+	w := &countingWriter{}
+	ch := make(chan interface{})
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		cl.sendXml(w, ch, make(chan bool))
+	}()
+	for i := 0; i < 3; i++ {
+		ch <- &Message{Header: Header{To: "a@b.c", Id: "m"}}
+	}
+	// Once a flush marker is done, what came before it has been
+	// written.
+	m := &flushMarker{done: make(chan bool)}
+	ch <- m
+	<-m.done
+	want := strings.Repeat(`<message xmlns="jabber:client" `+
+		`to="a@b.c" id="m"></message>`, 3)
+	assertEquals(t, want, w.String())
+	if w.writes > 3 {
+		t.Errorf("%d writes", w.writes)
+	}
+	ch <- whitespacePing{}
+	close(ch)
+	<-done
+	assertEquals(t, want+" ", w.String())
+}
+
+func BenchmarkSendXml(b *testing.B) {
+	for _, component := range []bool{false, true} {
+		name := "client"
+		if component {
+			name = "component"
+		}
+		b.Run(name, func(b *testing.B) {
+			cl := &Client{component: component}
+			writes := 0
+			ch := make(chan interface{}, sendXmlBuffer)
+			done := make(chan bool)
+			go func() {
+				defer close(done)
+				cl.sendXml(discardWriter{&writes}, ch,
+					make(chan bool))
+			}()
+			m := &Message{Header: Header{To: "a@b.c", Id: "m",
+				Type: "chat"}, Body: []Text{{Chardata: "hello"}}}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ch <- m
+			}
+			close(ch)
+			<-done
+			b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+// Counts writes, and discards them.
+type discardWriter struct {
+	writes *int
+}
+
+func (w discardWriter) Write(p []byte) (int, error) {
+	*w.writes++
+	return len(p), nil
+}
+
+// Reads a stream header, one stanza over and over, and the end of
+// the stream.
+type repeatReader struct {
+	head, stanza string
+	n            int
+	r            *strings.Reader
+	ended        bool
+}
+
+func (rr *repeatReader) Read(p []byte) (int, error) {
+	for rr.r == nil || rr.r.Len() == 0 {
+		switch {
+		case rr.r == nil:
+			rr.r = strings.NewReader(rr.head)
+		case rr.n == 0 && rr.ended:
+			return 0, io.EOF
+		case rr.n == 0:
+			rr.ended = true
+			// Closing the element recvXml declares the
+			// namespaces in too, so the reader ends cleanly.
+			rr.r.Reset("</stream:stream></a>")
+		default:
+			rr.n--
+			rr.r.Reset(rr.stanza)
+		}
+	}
+	return rr.r.Read(p)
+}
+
+func BenchmarkRecvXml(b *testing.B) {
+	jid := JID("a@b.c/r")
+	cl := newBareClient(&jid, "", nil)
+	r := &repeatReader{head: `<stream:stream xmlns="jabber:client" ` +
+		`xmlns:stream="` + NsStream + `" from="b.c" id="s" ` +
+		`version="1.0">`,
+		stanza: `<message to="a@b.c/r" from="d@b.c/r" type="chat" ` +
+			`id="m"><body>hello</body></message>`,
+		n: b.N}
+	ch := make(chan interface{})
+	go cl.recvXml(r, ch, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != b.N+1 {
+		b.Fatalf("got %d elements", n)
+	}
+}
@@ -4,15 +4,23 @@
 package xmpp
 
 import (
+	"context"
 	"encoding/xml"
 	"fmt"
 	"log"
+	"time"
 )
 
 // Callback to handle a stanza with a particular id.
 type callback struct {
 	id string
 	f  func(Stanza)
+	// If set, when the callback is dropped, and expired called,
+	// unless a stanza with the id arrived first.
+	deadline time.Time
+	expired  func(error)
+	// Drops the callback of the id instead of adding one.
+	drop bool
 }
 
 // Receive XMPP stanzas from the client and send them on to the
@@ -20,16 +28,34 @@ type callback struct {
 // negotiation has completed.  This loop is paused until resource
 // binding is complete. Otherwise the app might inject something
 // inappropriate into our negotiations with the server. The control
-// channel controls this loop's activity.
-func sendStream(sendXml chan<- interface{}, recvXmpp <-chan Stanza,
-	status <-chan Status) {
-	defer close(sendXml)
+// channel controls this loop's activity. If sm is non-nil, sent
+// stanzas are kept until the server acknowledges them. When the
+// client closes, the stream is ended once what was sent before has
+// gone.
+func (cl *Client) sendStream(sendXml chan<- interface{}, quit chan<- bool,
+	recvXmpp <-chan Stanza, status <-chan Status, sm *streamMgmt) {
+	// Goroutines outside the stream, like the ones which resume it,
+	// may still try to send, so sendXml isn't closed.
+	defer close(quit)
+	// Whatever is still coming is dropped, so the filters sending
+	// it can finish.
+	defer func() {
+		go func() {
+			for range recvXmpp {
+			}
+		}()
+	}()
 
 	var input <-chan Stanza
 	for {
+		// While paused, there's no stream to end.
+		var closing <-chan bool
+		if input == nil {
+			closing = cl.closing
+		}
 		select {
 		case stat, ok := <-status:
-			if !ok {
+			if !ok || stat.Fatal() {
 				return
 			}
 			switch stat {
@@ -38,8 +64,12 @@ func sendStream(sendXml chan<- interface{}, recvXmpp <-chan Stanza,
 			case StatusRunning:
 				input = recvXmpp
 			}
+		case <-closing:
+			return
 		case x, ok := <-input:
 			if !ok {
+				sendXml <- streamEnd{}
+				close(cl.ended)
 				return
 			}
 			if x == nil {
@@ -49,6 +79,13 @@ func sendStream(sendXml chan<- interface{}, recvXmpp <-chan Stanza,
 				continue
 			}
 			sendXml <- x
+			if _, ok := x.(*flushMarker); ok {
+				continue
+			}
+			cl.rc.sent(x)
+			if sm != nil && sm.sent(x) {
+				sendXml <- &smRequest{}
+			}
 		}
 	}
 }
@@ -58,12 +95,18 @@ func sendStream(sendXml chan<- interface{}, recvXmpp <-chan Stanza,
 func (cl *Client) recvStream(recvXml <-chan interface{}, sendXmpp chan<- Stanza,
 	status <-chan Status) {
 	defer close(sendXmpp)
+	defer cl.finish()
+	defer cl.sm.abandon()
+	defer cl.stopExtensions()
 	defer cl.statmgr.close()
 
-	handlers := make(map[string]func(Stanza))
+	handlers := newCallbackTable(cl)
+	defer handlers.stop()
 	doSend := false
 	for {
 		select {
+		case now := <-handlers.fired():
+			handlers.expire(now)
 		case stat := <-status:
 			switch stat {
 			default:
@@ -72,38 +115,70 @@ func (cl *Client) recvStream(recvXml <-chan interface{}, sendXmpp chan<- Stanza,
 				doSend = true
 			}
 		case h := <-cl.handlers:
-			handlers[h.id] = h.f
+			handlers.add(h)
 		case x, ok := <-recvXml:
 			if !ok {
 				return
 			}
 			switch obj := x.(type) {
 			case *stream:
-				// Do nothing.
+				cl.setStreamLang(obj.Lang)
+				if cl.component {
+					cl.startHandshake(obj)
+				}
+			case *handshake:
+				cl.handleHandshake(obj)
+				// Don't wait for the status to come back
+				// around, or what follows the handshake
+				// would be dropped.
+				doSend = true
 			case *streamError:
-				cl.setError(fmt.Errorf("%#v", obj))
-				return
+				if !cl.handleStreamError(obj.typed()) {
+					return
+				}
 			case *Features:
-				cl.handleFeatures(obj)
+				if !cl.component {
+					cl.handleFeatures(obj)
+				}
 			case *starttls:
 				cl.handleTls(obj)
 			case *auth:
 				cl.handleSasl(obj)
+			case *sasl2Success:
+				cl.handleSasl2Success(obj)
+			case *compress:
+				cl.handleCompress(obj)
+			case *smEnabled, *smResumed, *smFailed, *smRequest,
+				*smAnswer:
+				cl.handleStreamMgmt(obj)
 			case Stanza:
-				id := obj.GetHeader().Id
-				if handlers[id] != nil {
-					f := handlers[id]
-					delete(handlers, id)
-					f(obj)
+				if cl.sm != nil {
+					cl.sm.received()
+				}
+				cl.countStanza(false, obj)
+				cl.rc.received(obj)
+				// Callbacks set and status changes made before
+				// this stanza arrived may still be waiting in
+				// their channels, since select doesn't prefer
+				// one case over another.
+				for pending := true; pending; {
+					select {
+					case h := <-cl.handlers:
+						handlers.add(h)
+					case stat := <-status:
+						doSend = stat == StatusRunning
+					default:
+						pending = false
+					}
+				}
+				if h := handlers.take(obj.GetHeader().Id); h != nil {
+					h.f(obj)
 				}
 				if doSend {
 					sendXmpp <- obj
 				}
 			default:
-				if Debug {
-					log.Printf("Unrecognized input: %T %#v",
-						x, x)
-				}
+				cl.logf(LogDebug, "Unrecognized input: %T %#v", x, x)
 			}
 		}
 	}
@@ -111,32 +186,57 @@ func (cl *Client) recvStream(recvXml <-chan interface{}, sendXmpp chan<- Stanza,
 
 func (cl *Client) handleFeatures(fe *Features) {
 	cl.Features = fe
-	if fe.Starttls != nil {
-		start := &starttls{XMLName: xml.Name{Space: NsTLS,
-			Local: "starttls"}}
-		cl.sendRaw <- start
-		return
+	if !cl.layer1.encrypted() {
+		switch {
+		case fe.Starttls != nil && cl.opts.tlsPolicy != TlsDisabled:
+			start := &starttls{XMLName: xml.Name{Space: NsTLS,
+				Local: "starttls"}}
+			cl.sendRaw <- start
+			return
+		case cl.opts.tlsPolicy == TlsRequired:
+			cl.setError(fmt.Errorf("server doesn't offer TLS"))
+			return
+		case fe.Starttls != nil && fe.Starttls.Required != nil:
+			cl.setError(fmt.Errorf("server requires TLS"))
+			return
+		}
 	}
 
-	if len(fe.Mechanisms.Mechanism) > 0 {
+	if len(fe.Mechanisms.Mechanism) > 0 || cl.useSasl2(fe) {
+		if cl.opts.register != nil && !cl.registered {
+			cl.register()
+			return
+		}
 		cl.chooseSasl(fe)
 		return
 	}
 
+	if cl.startCompression(fe) {
+		return
+	}
+
 	if fe.Bind != nil {
+		if cl.sm != nil && cl.sm.resuming() {
+			cl.sendRaw <- cl.sm.resumeRequest()
+			return
+		}
 		cl.bind()
 		return
 	}
 }
 
 func (cl *Client) handleTls(t *starttls) {
+	if t.XMLName.Local == "failure" {
+		cl.setError(fmt.Errorf("server refused STARTTLS"))
+		return
+	}
 	cl.layer1.startTls(cl.tlsConfig)
 
 	cl.setStatus(StatusConnectedTls)
 
 	// Now re-send the initial handshake message to start the new
 	// session.
-	cl.sendRaw <- &stream{To: cl.Jid.Domain(), Version: XMPPVersion}
+	cl.sendRaw <- cl.streamHeader()
 }
 
 // Send a request to bind a resource. RFC 3920, section 7.
@@ -146,7 +246,7 @@ func (cl *Client) bind() {
 	if res != "" {
 		bindReq.Resource = &res
 	}
-	msg := &Iq{Header: Header{Type: "set", Id: NextId(),
+	msg := &Iq{Header: Header{Type: "set", Id: cl.NextId(),
 		Nested: []interface{}{bindReq}}}
 	f := func(st Stanza) {
 		iq, ok := st.(*Iq)
@@ -188,8 +288,66 @@ func (cl *Client) bind() {
 // more than once. If it returns false, the stanza will not be made
 // available on the normal Client.Recv channel. The callback must not
 // read from that channel, as deliveries on it cannot proceed until
-// the handler returns true or false.
+// the handler returns true or false. It waits until a stanza with the
+// id arrives, or the session ends; SetCallbackTimeout gives up
+// sooner.
 func (cl *Client) SetCallback(id string, f func(Stanza)) {
-	h := &callback{id: id, f: f}
-	cl.handlers <- h
+	cl.SetCallbackTimeout(id, 0, f, nil)
+}
+
+// How long an iq waits for a reply if the context doesn't say.
+const iqTimeout = 30 * time.Second
+
+// Send an iq stanza of type get or set to the remote and wait for the
+// reply with the same id, assigning an id first if the stanza doesn't
+// have one. If the reply has type error, it's returned along with a
+// non-nil error. Gives up when the context is done; if it has no
+// deadline, SendIq gives up after 30 seconds.
+func (cl *Client) SendIq(ctx context.Context, iq *Iq) (*Iq, error) {
+	if iq.Type != "get" && iq.Type != "set" {
+		return nil, fmt.Errorf("iq of type %q expects no reply", iq.Type)
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, iqTimeout)
+		defer cancel()
+	}
+	if iq.Id == "" {
+		iq.Id = cl.NextId()
+	}
+	ch := make(chan Stanza, 1)
+	refused := make(chan error, 1)
+	deadline, _ := ctx.Deadline()
+	cl.SetCallbackTimeout(iq.Id, time.Until(deadline),
+		func(st Stanza) { ch <- st }, func(err error) {
+			if err == ErrTooManyCallbacks {
+				refused <- err
+			}
+		})
+	if err := cl.send(ctx, iq); err != nil {
+		cl.dropCallback(iq.Id)
+		return nil, err
+	}
+	var st Stanza
+	select {
+	case st = <-ch:
+	case err := <-refused:
+		return nil, err
+	case <-cl.closing:
+		return nil, errClientClosed
+	case <-ctx.Done():
+		cl.dropCallback(iq.Id)
+		return nil, ctx.Err()
+	}
+	reply, ok := st.(*Iq)
+	if !ok {
+		return nil, fmt.Errorf("non-iq response to %s: %#v", iq.Id, st)
+	}
+	if reply.Type == "error" {
+		if reply.Error != nil {
+			return reply, reply.Error
+		}
+		return reply, fmt.Errorf("iq %s failed", iq.Id)
+	}
+	return reply, nil
 }
@@ -0,0 +1,293 @@
+package xmpp
+
+// This file contains limits on what the server may send, so that a
+// malicious or broken one can't exhaust the client's memory.
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Limits on the XML the client accepts. Zero values mean the
+// defaults.
+type ParserLimits struct {
+	// The most bytes a stanza, or any other element at the top
+	// level of the stream, may take. The default is 10 MiB.
+	MaxStanzaSize int
+	// How deeply elements may be nested, counting a stanza as 1.
+	// The default is 64.
+	MaxDepth int
+	// The most attributes one element may have. The default is
+	// 128.
+	MaxAttrs int
+	// If set, a server which breaks the limits is sent a
+	// policy-violation stream error before the client disconnects.
+	StreamError bool
+}
+
+const (
+	defaultMaxStanzaSize = 10 << 20
+	defaultMaxDepth      = 64
+	defaultMaxAttrs      = 128
+)
+
+// Returns an extension which sets the limits on what the server may
+// send. The session ends with a *LimitError if they're broken.
+func ParserLimitsExt(l ParserLimits) Extension {
+	return Extension{option: func(o *options) {
+		o.limits = l
+	}}
+}
+
+// The session ends with one of these when the server breaks one of
+// the ParserLimits.
+type LimitError struct {
+	// "stanza size", "depth" or "attributes".
+	Limit string
+	Max   int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("server exceeded the %s limit of %d", e.Limit,
+		e.Max)
+}
+
+// The session ends with this if the server sends a document type
+// declaration, which could declare entities, or a processing
+// instruction. Neither is allowed in XMPP. RFC 6120, section 11.1.
+var ErrRestrictedXml = errors.New("server sent a DTD or processing instruction")
+
+func isLimitError(err error) bool {
+	var le *LimitError
+	return errors.As(err, &le) || errors.Is(err, ErrRestrictedXml)
+}
+
+// Ends the session when the server has broken the limits, telling it
+// why first if the limits say to.
+func (cl *Client) refuseXml(err error) {
+	if cl.opts.limits.StreamError {
+		cond := StreamPolicyViolation
+		if errors.Is(err, ErrRestrictedXml) {
+			cond = StreamRestrictedXml
+		}
+		cl.trySendRaw(&streamError{Any: Generic{XMLName: xml.Name{
+			Space: NsStreams, Local: cond}}})
+		cl.trySendRaw(streamEnd{})
+	}
+	cl.setError(err)
+}
+
+// States of limitReader.
+const (
+	lrText = iota
+	// Just after '<'.
+	lrOpen
+	// After "<!" or "<?", until it's clear what follows.
+	lrBang
+	lrStartTag
+	lrEndTag
+	// In a comment, a CDATA section or the XML declaration, until
+	// lrEnds says it's over.
+	lrComment
+	lrCdata
+	lrDecl
+)
+
+// What may follow "<" other than a tag, and the states they lead to.
+// Anything else starting with "!" or "?" is a DTD or a processing
+// instruction. The XML declaration's whitespace is read as a space.
+var lrOpeners = map[string]int{
+	"!--":      lrComment,
+	"![CDATA[": lrCdata,
+	"?xml ":    lrDecl,
+}
+
+var lrEnds = map[int]string{
+	lrComment: "-->",
+	lrCdata:   "]]>",
+	lrDecl:    "?>",
+}
+
+// Checks what the server sends against the limits, and fails once
+// they're broken, before the decoder has to hold any of it. Only as
+// much of the XML is understood as that needs; the decoder checks the
+// rest.
+type limitReader struct {
+	r      io.Reader
+	limits ParserLimits
+	err    error
+	state  int
+	// After "<!" or "<?", what's been seen; in a comment, a CDATA
+	// section or the XML declaration, the last few bytes.
+	seen []byte
+	// In a start tag: its name, whether all of it has been seen,
+	// the quote an attribute value began with, the attributes so
+	// far, and the previous byte.
+	name  []byte
+	named bool
+	quote byte
+	attrs int
+	prev  byte
+	// How deeply the reader is nested, where the stream's own
+	// element is 0 and stanzas are 1, and the size of the element
+	// at the top level so far.
+	depth int
+	size  int
+}
+
+func newLimitReader(r io.Reader, limits ParserLimits) *limitReader {
+	if limits.MaxStanzaSize <= 0 {
+		limits.MaxStanzaSize = defaultMaxStanzaSize
+	}
+	if limits.MaxDepth <= 0 {
+		limits.MaxDepth = defaultMaxDepth
+	}
+	if limits.MaxAttrs <= 0 {
+		limits.MaxAttrs = defaultMaxAttrs
+	}
+	return &limitReader{r: r, limits: limits, depth: -1}
+}
+
+func (lr *limitReader) Read(p []byte) (int, error) {
+	if lr.err != nil {
+		return 0, lr.err
+	}
+	n, err := lr.r.Read(p)
+	for i, c := range p[:n] {
+		if lr.err = lr.scan(c); lr.err != nil {
+			// Let through what came before, so whatever was
+			// complete is still delivered.
+			return i, nil
+		}
+	}
+	return n, err
+}
+
+func (lr *limitReader) scan(c byte) error {
+	if lr.depth <= 0 && lr.state == lrText && isSpace(c) {
+		// Whitespace between stanzas, such as keepalives.
+		lr.size = 0
+	} else {
+		lr.size++
+		if lr.size > lr.limits.MaxStanzaSize {
+			return &LimitError{"stanza size", lr.limits.MaxStanzaSize}
+		}
+	}
+	defer func() { lr.prev = c }()
+	switch lr.state {
+	case lrText:
+		if c == '<' {
+			lr.state = lrOpen
+		}
+	case lrOpen:
+		switch c {
+		case '/':
+			lr.state = lrEndTag
+		case '!', '?':
+			lr.state = lrBang
+			lr.seen = append(lr.seen[:0], c)
+		default:
+			lr.state = lrStartTag
+			lr.name = append(lr.name[:0], c)
+			lr.named = false
+			lr.quote = 0
+			lr.attrs = 0
+		}
+	case lrBang:
+		if isSpace(c) {
+			c = ' '
+		}
+		lr.seen = append(lr.seen, c)
+		if state, ok := lrOpeners[string(lr.seen)]; ok {
+			if state == lrDecl && lr.depth >= 1 {
+				return ErrRestrictedXml
+			}
+			lr.state = state
+			lr.seen = lr.seen[:0]
+			return nil
+		}
+		for opener := range lrOpeners {
+			if strings.HasPrefix(opener, string(lr.seen)) {
+				return nil
+			}
+		}
+		return ErrRestrictedXml
+	case lrComment, lrCdata, lrDecl:
+		end := lrEnds[lr.state]
+		lr.seen = append(lr.seen, c)
+		if len(lr.seen) > len(end) {
+			lr.seen = lr.seen[1:]
+		}
+		if string(lr.seen) == end {
+			lr.state = lrText
+			lr.finished()
+		}
+	case lrEndTag:
+		if c == '>' {
+			lr.state = lrText
+			lr.depth--
+			lr.finished()
+		}
+	case lrStartTag:
+		return lr.startTag(c)
+	}
+	return nil
+}
+
+func (lr *limitReader) startTag(c byte) error {
+	switch {
+	case lr.quote != 0:
+		if c == lr.quote {
+			lr.quote = 0
+		}
+	case c == '"' || c == '\'':
+		lr.quote = c
+	case c == '=':
+		lr.attrs++
+		if lr.attrs > lr.limits.MaxAttrs {
+			return &LimitError{"attributes", lr.limits.MaxAttrs}
+		}
+	case c == '>':
+		lr.state = lrText
+		name := string(lr.name)
+		if lr.depth <= 0 && (name == "stream" ||
+			strings.HasSuffix(name, ":stream")) {
+			// A stream starts, perhaps again after STARTTLS or
+			// authentication, inside the old one as far as
+			// the reader can tell. What follows is its top
+			// level.
+			lr.depth = 0
+			lr.size = 0
+			return nil
+		}
+		if lr.depth+1 > lr.limits.MaxDepth {
+			return &LimitError{"depth", lr.limits.MaxDepth}
+		}
+		if lr.prev == '/' {
+			// It's empty, so it's over already.
+			lr.finished()
+		} else {
+			lr.depth++
+		}
+	case isSpace(c) || c == '/':
+		lr.named = true
+	case !lr.named && len(lr.name) < len("stream:stream"):
+		lr.name = append(lr.name, c)
+	}
+	return nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// Called when something ends. If it was at the top level of the
+// stream, the next stanza is counted afresh.
+func (lr *limitReader) finished() {
+	if lr.depth <= 0 {
+		lr.size = 0
+	}
+}
@@ -0,0 +1,85 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestLimitReader(t *testing.T) {
+	limits := ParserLimits{MaxStanzaSize: 200, MaxDepth: 3, MaxAttrs: 5}
+	stream := `<?xml version='1.0'?><stream:stream xmlns='jabber:client' ` +
+		`xmlns:stream='` + NsStream + `' id='1' version='1.0' ` +
+		`from='b.c'>`
+	tests := []struct {
+		name, xml string
+		err       string
+	}{
+		{"stanzas", `<message to='a@b.c'><body>hi</body></message> ` +
+			`<iq type='get' id='2'/><presence/>`, ""},
+		{"restart", `<a/>` + stream + `<b/>` + strings.Repeat(" ", 300) +
+			`<!-- note -->`, ""},
+		{"cdata", `<message><body><![CDATA[<a><b><c><d>]]></body>` +
+			`</message>`, ""},
+		{"size", `<message><body>` + strings.Repeat("x", 200) +
+			`</body></message>`, "stanza size"},
+		{"depth", `<a><b><c><d/></c></b></a>`, "depth"},
+		{"attributes", `<a u="1" v="2" w="3" x="4" y="=" z="6"/>`, "attributes"},
+		{"doctype", `<!DOCTYPE a [<!ENTITY x 'y'>]>`, "dtd"},
+		{"pi", `<a><?foo bar?></a>`, "dtd"},
+		{"declaration", `<a><?xml version='1.0'?></a>`, "dtd"},
+	}
+	for _, test := range tests {
+		lr := newLimitReader(strings.NewReader(stream+test.xml), limits)
+		_, err := ioutil.ReadAll(lr)
+		var got string
+		switch e := err.(type) {
+		case nil:
+		case *LimitError:
+			got = e.Limit
+		default:
+			if err == ErrRestrictedXml {
+				got = "dtd"
+			} else {
+				got = err.Error()
+			}
+		}
+		if got != test.err {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.err)
+		}
+	}
+
+	// What came before a violation is delivered.
+	lr := newLimitReader(strings.NewReader(stream+`<a/><!DOCTYPE>`), limits)
+	buf, err := ioutil.ReadAll(lr)
+	assertEquals(t, stream+`<a/><!`, string(buf))
+	if err != ErrRestrictedXml {
+		t.Errorf("got %v", err)
+	}
+	if _, err := lr.Read(make([]byte, 1)); err != ErrRestrictedXml {
+		t.Errorf("then got %v", err)
+	}
+}
+
+func TestParserLimitsExt(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	jid := JID("alice@b.c/pc")
+	cl, err := NewClientFromConn(s.Dial(), &jid, "secret", &tls.Config{},
+		[]Extension{ParserLimitsExt(ParserLimits{MaxStanzaSize: 4096})},
+		Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn: %v", err)
+	}
+	defer cl.Close()
+
+	go s.Send(&Message{Header: Header{From: "bob@b.c/pc", To: jid},
+		Body: []Text{{Chardata: strings.Repeat("x", 5000)}}})
+	err = awaitDone(t, cl)
+	if le, ok := err.(*LimitError); !ok || le.Limit != "stanza size" ||
+		le.Max != 4096 {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package xmpp
+
+// This file contains the logging of the library's own messages, and
+// the tap through which the XML traffic can be watched.
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// How much a log message matters.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	}
+	return fmt.Sprintf("level %d", int(l))
+}
+
+// A Logger receives the messages the library logs about a client,
+// such as lost connections and elements it doesn't understand. It
+// may be called from any goroutine.
+type Logger interface {
+	Log(level LogLevel, msg string)
+}
+
+// Returns a Logger which writes messages of at least the given level
+// to l, or to the standard logger if l is nil.
+func StdLogger(l *log.Logger, min LogLevel) Logger {
+	return stdLogger{l: l, min: min}
+}
+
+type stdLogger struct {
+	l   *log.Logger
+	min LogLevel
+}
+
+func (sl stdLogger) Log(level LogLevel, msg string) {
+	if level < sl.min {
+		return
+	}
+	if sl.l == nil {
+		log.Printf("%s: %s", level, msg)
+		return
+	}
+	sl.l.Printf("%s: %s", level, msg)
+}
+
+// Sends the client's log messages to logger. Without it, they're only
+// logged when Debug is set.
+func LoggerExt(logger Logger) Extension {
+	return Extension{option: func(o *options) {
+		o.logger = logger
+	}}
+}
+
+// Calls tap with the XML the client sends and receives, as it goes
+// over the connection, with the contents of SASL exchanges, passwords
+// and component handshakes replaced by "[redacted]". The tap is
+// called from the client's transport goroutines, so it mustn't block.
+func TrafficExt(tap func(outbound bool, xml []byte)) Extension {
+	return Extension{option: func(o *options) {
+		o.traffic = tap
+	}}
+}
+
+// Logs a message about the client.
+func (cl *Client) logf(level LogLevel, format string, args ...interface{}) {
+	if cl.opts.logger != nil {
+		cl.opts.logger.Log(level, fmt.Sprintf(format, args...))
+	} else if Debug {
+		log.Printf(format, args...)
+	}
+}
+
+// The elements whose text is secret, by local name.
+var secretElements = map[string]bool{
+	// SASL, and SASL2, XEP-0388.
+	"auth": true, "response": true, "initial-response": true,
+	// In-band registration and password changes, and XEP-0078.
+	"password": true, "digest": true,
+	// XEP-0114.
+	"handshake": true,
+}
+
+const redacted = "[redacted]"
+
+// Removes secrets from one direction of the stream. The bytes written
+// to it needn't be aligned with elements; an incomplete tag is kept
+// until the rest arrives.
+type redactor struct {
+	pending []byte
+	// How deep inside a secret element the stream is, and whether
+	// its text has been replaced yet.
+	secret int
+	done   bool
+}
+
+// Returns what can be passed on of the bytes written so far.
+func (r *redactor) redact(p []byte) []byte {
+	r.pending = append(r.pending, p...)
+	var out bytes.Buffer
+	for len(r.pending) > 0 {
+		if r.pending[0] != '<' {
+			n := bytes.IndexByte(r.pending, '<')
+			if n < 0 {
+				n = len(r.pending)
+			}
+			if r.secret == 0 {
+				out.Write(r.pending[:n])
+			} else if !r.done {
+				out.WriteString(redacted)
+				r.done = true
+			}
+			r.pending = r.pending[n:]
+			continue
+		}
+		n := tagEnd(r.pending)
+		if n < 0 {
+			break
+		}
+		tag := string(r.pending[:n])
+		r.pending = r.pending[n:]
+		closing := strings.HasPrefix(tag, "</")
+		empty := strings.HasSuffix(tag, "/>")
+		switch {
+		case r.secret > 0 && closing:
+			r.secret--
+			if r.secret > 0 {
+				continue
+			}
+		case r.secret > 0:
+			// Whatever is nested in a secret is secret.
+			if !empty {
+				r.secret++
+			}
+			if !r.done {
+				out.WriteString(redacted)
+				r.done = true
+			}
+			continue
+		case !closing && !empty && secretElements[tagName(tag)]:
+			r.secret, r.done = 1, false
+		}
+		out.WriteString(tag)
+	}
+	return out.Bytes()
+}
+
+// Returns the local name of the element a tag opens.
+func tagName(tag string) string {
+	name := strings.TrimPrefix(tag, "<")
+	if i := strings.IndexAny(name, " \t\r\n/>"); i >= 0 {
+		name = name[:i]
+	}
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
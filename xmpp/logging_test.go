@@ -0,0 +1,98 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRedactor(t *testing.T) {
+	var r redactor
+	var out strings.Builder
+	for _, chunk := range []string{`<auth xmlns="urn:ietf:params:xml:ns:`,
+		`xmpp-sasl" mechanism="PLAIN">AGFsaWNl`, `AHNlY3JldA==</auth>`,
+		`<iq type="set"><query xmlns="jabber:iq:register"><username>`,
+		`alice</username><password>hun`, `ter2</password><password/>`,
+		`</query></iq><message to="a>b"><body>hi</body></message>`,
+		`<handshake><x>secret</x>more</handshake>`,
+		`<authenticate xmlns="urn:xmpp:sasl:2" mechanism="PLAIN">`,
+		`<initial-response>AGFsaWNlAHNlY3JldA==</initial-response>`,
+		`</authenticate>`} {
+		out.Write(r.redact([]byte(chunk)))
+	}
+	exp := `<auth xmlns="urn:ietf:params:xml:ns:xmpp-sasl" ` +
+		`mechanism="PLAIN">[redacted]</auth>` +
+		`<iq type="set"><query xmlns="jabber:iq:register"><username>` +
+		`alice</username><password>[redacted]</password><password/>` +
+		`</query></iq><message to="a>b"><body>hi</body></message>` +
+		`<handshake>[redacted]</handshake>` +
+		`<authenticate xmlns="urn:xmpp:sasl:2" mechanism="PLAIN">` +
+		`<initial-response>[redacted]</initial-response></authenticate>`
+	assertEquals(t, exp, out.String())
+}
+
+type testLogger struct {
+	lock sync.Mutex
+	msgs []string
+}
+
+func (tl *testLogger) Log(level LogLevel, msg string) {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	tl.msgs = append(tl.msgs, level.String()+": "+msg)
+}
+
+func TestTraffic(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	var lock sync.Mutex
+	var sent, recvd strings.Builder
+	tap := func(outbound bool, xml []byte) {
+		lock.Lock()
+		defer lock.Unlock()
+		if outbound {
+			sent.Write(xml)
+		} else {
+			recvd.Write(xml)
+		}
+	}
+	logger := &testLogger{}
+	jid := JID("alice@b.c/pc")
+	cl, err := NewClientFromConn(s.Dial(), &jid, "secret", &tls.Config{},
+		[]Extension{TrafficExt(tap), LoggerExt(logger)}, Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn: %v", err)
+	}
+	cl.Send <- &Message{Header: Header{To: "b.c"},
+		Body: []Text{{Chardata: "echo"}}}
+	recvMessage(t, cl)
+	s.StreamError(jid, &StreamError{Condition: StreamSystemShutdown})
+	awaitDone(t, cl)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if !strings.Contains(sent.String(), `mechanism="PLAIN">[redacted]</auth>`) {
+		t.Errorf("SASL not redacted: %s", sent.String())
+	}
+	if !strings.Contains(sent.String(), ">echo</body>") ||
+		!strings.Contains(recvd.String(), ">echo</body>") {
+		t.Errorf("message not tapped")
+	}
+	if !strings.Contains(recvd.String(), StreamSystemShutdown) {
+		t.Errorf("stream error not tapped: %s", recvd.String())
+	}
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	found := false
+	for _, msg := range logger.msgs {
+		if strings.HasPrefix(msg, "error: ") &&
+			strings.Contains(msg, StreamSystemShutdown) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("end of session not logged: %q", logger.msgs)
+	}
+}
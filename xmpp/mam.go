@@ -0,0 +1,353 @@
+package xmpp
+
+// This file contains a client for message archive management,
+// XEP-0313, which fetches history from a server-side archive.
+
+import (
+	"./forms"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const NsMam = "urn:xmpp:mam:2"
+
+// A query to an archive. The form filters the messages, and the set
+// asks for a page of them.
+type MamQuery struct {
+	XMLName xml.Name    `xml:"urn:xmpp:mam:2 query"`
+	QueryId string      `xml:"queryid,attr,omitempty"`
+	Node    string      `xml:"node,attr,omitempty"`
+	Form    *forms.Form `xml:"jabber:x:data x"`
+	Set     *RsmSet
+}
+
+// Carries one archived message, in answer to a query.
+type MamResult struct {
+	XMLName   xml.Name `xml:"urn:xmpp:mam:2 result"`
+	QueryId   string   `xml:"queryid,attr"`
+	Id        string   `xml:"id,attr"`
+	Forwarded Forwarded
+}
+
+func (r *MamResult) carried() []*Header { return r.Forwarded.carried() }
+
+// Ends the results of a query, in its iq result.
+type MamFin struct {
+	XMLName  xml.Name `xml:"urn:xmpp:mam:2 fin"`
+	Complete bool     `xml:"complete,attr,omitempty"`
+	Set      *RsmSet
+}
+
+// Chooses the messages to fetch from an archive. Zero fields don't
+// filter anything.
+type ArchiveFilter struct {
+	// Only messages exchanged with this JID. A bare JID matches all
+	// its resources.
+	With JID
+	// Only messages archived in this period.
+	Start, End time.Time
+	// Only messages archived after the one with this archive id,
+	// for catching up from the last message seen.
+	AfterId string
+	// The number of messages to ask for in each request. Servers
+	// may return fewer. Zero means 50.
+	PageSize int
+}
+
+// A message fetched from an archive.
+type ArchivedMessage struct {
+	// The id the archive gave the message, for use with AfterId.
+	Id string
+	// When the message was archived, if the archive says.
+	Time    time.Time
+	Message *Message
+}
+
+// ArchiveManager is an extension which queries message archives.
+// The archived messages the server sends in answer are consumed, and
+// delivered to the query which asked for them.
+type ArchiveManager struct {
+	Extension
+	lock sync.Mutex
+	cl   *Client
+	// Pages being fetched, by query id and by iq id.
+	pages map[string]*archivePage
+	iqs   map[string]*archivePage
+}
+
+// One page of results being fetched.
+type archivePage struct {
+	// Results are only accepted from the archive which was asked.
+	from    JID
+	queryId string
+	msgs    []ArchivedMessage
+	// Closed once the iq result ending the page has been seen.
+	done chan bool
+}
+
+// Creates an ArchiveManager, to be passed to NewClient among the
+// extensions.
+func NewArchiveManager() *ArchiveManager {
+	am := &ArchiveManager{}
+	am.pages = make(map[string]*archivePage)
+	am.iqs = make(map[string]*archivePage)
+	am.StanzaTypes = mergeStanzaTypes(StanzaIdExt)
+	qName := xml.Name{Space: NsMam, Local: "query"}
+	am.StanzaTypes[qName] = reflect.TypeOf(MamQuery{})
+	rName := xml.Name{Space: NsMam, Local: "result"}
+	am.StanzaTypes[rName] = reflect.TypeOf(MamResult{})
+	fName := xml.Name{Space: NsMam, Local: "fin"}
+	am.StanzaTypes[fName] = reflect.TypeOf(MamFin{})
+	am.RecvFilter = am.recvFilter
+	am.Start = func(cl *Client) {
+		am.lock.Lock()
+		am.cl = cl
+		am.lock.Unlock()
+	}
+	return am
+}
+
+func (am *ArchiveManager) client() (*Client, error) {
+	am.lock.Lock()
+	defer am.lock.Unlock()
+	if am.cl == nil {
+		return nil, fmt.Errorf("archive manager not started")
+	}
+	return am.cl, nil
+}
+
+func (am *ArchiveManager) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for stan := range in {
+		switch st := stan.(type) {
+		case *Message:
+			if am.result(st) {
+				continue
+			}
+		case *Iq:
+			am.lock.Lock()
+			if pg := am.iqs[st.Id]; pg != nil {
+				delete(am.iqs, st.Id)
+				delete(am.pages, pg.queryId)
+				close(pg.done)
+			}
+			am.lock.Unlock()
+		}
+		out <- stan
+	}
+}
+
+// Collects an archived message for the query which asked for it.
+// Returns false if the message isn't one.
+func (am *ArchiveManager) result(m *Message) bool {
+	for _, ele := range m.Nested {
+		res, ok := ele.(*MamResult)
+		if !ok || res.Forwarded.Message == nil {
+			continue
+		}
+		am.lock.Lock()
+		defer am.lock.Unlock()
+		pg := am.pages[res.QueryId]
+		if pg == nil || (m.From != "" && m.From != pg.from) {
+			return false
+		}
+		msg := ArchivedMessage{Id: res.Id,
+			Message: res.Forwarded.Message}
+		if d := res.Forwarded.Delay; d != nil {
+			msg.Time = d.Stamp
+		}
+		pg.msgs = append(pg.msgs, msg)
+		return true
+	}
+	return false
+}
+
+// A query to an archive, which fetches pages of messages in the
+// background.
+type ArchiveQuery struct {
+	// The matching messages, oldest first. It's closed when they've
+	// all been delivered, or the query failed.
+	Messages <-chan ArchivedMessage
+	err      error
+}
+
+// Returns the error which ended the query, once Messages has been
+// closed.
+func (q *ArchiveQuery) Err() error {
+	return q.err
+}
+
+// Fetches the messages matching the filter from an archive, which is
+// the user's own if archive is empty. A room's archive is queried by
+// giving the room's bare JID.
+func (am *ArchiveManager) Query(ctx context.Context, archive JID,
+	filter ArchiveFilter) *ArchiveQuery {
+
+	msgs := make(chan ArchivedMessage)
+	q := &ArchiveQuery{Messages: msgs}
+	go func() {
+		defer close(msgs)
+		q.err = am.query(ctx, archive, filter, msgs, nil)
+	}()
+	return q
+}
+
+// Like Query, but catches up with an archive from where the last
+// Sync of it got to, as kept in the Storage of StorageExt, so AfterId
+// is set from there. The id of the last message delivered is stored
+// after each page. Without a Storage, or before the first Sync, the
+// filter is used as it is.
+func (am *ArchiveManager) Sync(ctx context.Context, archive JID,
+	filter ArchiveFilter) *ArchiveQuery {
+
+	msgs := make(chan ArchivedMessage)
+	q := &ArchiveQuery{Messages: msgs}
+	go func() {
+		defer close(msgs)
+		q.err = am.sync(ctx, archive, filter, msgs)
+	}()
+	return q
+}
+
+func (am *ArchiveManager) sync(ctx context.Context, archive JID,
+	filter ArchiveFilter, msgs chan<- ArchivedMessage) error {
+
+	cl, err := am.client()
+	if err != nil {
+		return err
+	}
+	s := cl.opts.storage
+	if s == nil {
+		return am.query(ctx, archive, filter, msgs, nil)
+	}
+	if archive == "" {
+		archive = cl.Jid.Bare()
+	}
+	key := string(cl.Jid.Bare()) + " " + string(archive)
+	id, ok, err := s.Get(StorageArchive, key)
+	if err != nil {
+		return err
+	}
+	if ok {
+		filter.AfterId = string(id)
+	}
+	return am.query(ctx, archive, filter, msgs, func(id string) error {
+		return s.Set(StorageArchive, key, []byte(id))
+	})
+}
+
+// Fetches the pages of a query. If save isn't nil, it's given the id
+// of the last message of each page once it's been delivered.
+func (am *ArchiveManager) query(ctx context.Context, archive JID,
+	filter ArchiveFilter, msgs chan<- ArchivedMessage,
+	save func(id string) error) error {
+
+	cl, err := am.client()
+	if err != nil {
+		return err
+	}
+	if archive == "" {
+		archive = cl.Jid.Bare()
+	}
+	max := filter.PageSize
+	if max <= 0 {
+		max = 50
+	}
+	var pager *RsmPager
+	pager = NewRsmPager(max, func(req *RsmSet) (*RsmSet, int, error) {
+		page, fin, err := am.page(ctx, cl, archive, filter, req)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, m := range page {
+			select {
+			case msgs <- m:
+			case <-ctx.Done():
+				return nil, 0, ctx.Err()
+			}
+		}
+		if save != nil && len(page) > 0 {
+			if err := save(page[len(page)-1].Id); err != nil {
+				return nil, 0, err
+			}
+		}
+		if fin.Complete {
+			pager.Stop()
+		}
+		return fin.Set, len(page), nil
+	})
+	for pager.Next() {
+	}
+	return pager.Err()
+}
+
+// Fetches one page of results.
+func (am *ArchiveManager) page(ctx context.Context, cl *Client, archive JID,
+	filter ArchiveFilter, set *RsmSet) ([]ArchivedMessage, *MamFin, error) {
+
+	pg := &archivePage{from: archive, queryId: cl.NextId(),
+		done: make(chan bool)}
+	iq := &Iq{Header: Header{Type: "set", Id: cl.NextId(),
+		Nested: []interface{}{&MamQuery{QueryId: pg.queryId,
+			Form: filter.form(), Set: set}}}}
+	if archive != cl.Jid.Bare() {
+		iq.To = archive
+	}
+	am.lock.Lock()
+	am.pages[pg.queryId] = pg
+	am.iqs[iq.Id] = pg
+	am.lock.Unlock()
+	defer func() {
+		am.lock.Lock()
+		delete(am.pages, pg.queryId)
+		delete(am.iqs, iq.Id)
+		am.lock.Unlock()
+	}()
+
+	reply, err := cl.SendIq(ctx, iq)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The results precede the reply, but may still be on their way
+	// through the filters.
+	select {
+	case <-pg.done:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	fin := &MamFin{}
+	for _, ele := range reply.Nested {
+		if f, ok := ele.(*MamFin); ok {
+			fin = f
+		}
+	}
+	am.lock.Lock()
+	defer am.lock.Unlock()
+	return pg.msgs, fin, nil
+}
+
+// Returns the form which filters a query, or nil if nothing is
+// filtered.
+func (f *ArchiveFilter) form() *forms.Form {
+	vals := make(map[string]string)
+	if f.With != "" {
+		vals["with"] = string(f.With)
+	}
+	if !f.Start.IsZero() {
+		vals["start"] = f.Start.UTC().Format(time.RFC3339)
+	}
+	if !f.End.IsZero() {
+		vals["end"] = f.End.UTC().Format(time.RFC3339)
+	}
+	if f.AfterId != "" {
+		vals["after-id"] = f.AfterId
+	}
+	if len(vals) == 0 {
+		return nil
+	}
+	return forms.NewSubmit(NsMam, vals)
+}
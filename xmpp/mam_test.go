@@ -0,0 +1,106 @@
+package xmpp
+
+import (
+	"./forms"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestArchiveQuery(t *testing.T) {
+	send := make(chan Stanza, 1)
+	cl := &Client{Jid: "me@b.c/r", handlers: make(chan *callback, 1),
+		Send: send}
+	am := NewArchiveManager()
+	am.Start(cl)
+	recvIn := make(chan Stanza)
+	recvOut := make(chan Stanza, 10)
+	go am.RecvFilter(recvIn, recvOut)
+	defer close(recvIn)
+
+	parse := func(str string) Stanza {
+		var m Message
+		if err := xml.Unmarshal([]byte(str), &m); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		if err := parseExtended(&m.Header, am.StanzaTypes); err != nil {
+			t.Fatalf("parseExtended: %v", err)
+		}
+		return &m
+	}
+	result := func(from, qid, id string, n int) Stanza {
+		return parse(fmt.Sprintf(`<message xmlns="jabber:client" `+
+			`from="%s"><result xmlns="%s" queryid="%s" id="%s">`+
+			`<forwarded xmlns="%s"><delay xmlns="%s" `+
+			`stamp="2020-01-02T03:04:05Z"/><message `+
+			`xmlns="jabber:client" from="al@b.c/x"><body>%d</body>`+
+			`</message></forwarded></result></message>`, from,
+			NsMam, qid, id, NsForward, NsDelay, n))
+	}
+	// Plays the archive, sending two pages of two messages. A
+	// forged result is ignored.
+	submitted := make(chan *forms.Form, 2)
+	go func() {
+		for page := 0; page < 2; page++ {
+			h := <-cl.handlers
+			iq := (<-send).(*Iq)
+			q := iq.Nested[0].(*MamQuery)
+			submitted <- q.Form
+			after := ""
+			if page == 1 {
+				after = "a2"
+			}
+			if q.Set.After != after || *q.Set.Max != 2 {
+				t.Errorf("page %d: set %+v", page, q.Set)
+			}
+			recvIn <- result("eve@b.c", q.QueryId, "x", 0)
+			for i := 1; i <= 2; i++ {
+				n := page*2 + i
+				recvIn <- result("me@b.c", q.QueryId,
+					fmt.Sprintf("a%d", n), n)
+			}
+			last := fmt.Sprintf("a%d", page*2+2)
+			reply := &Iq{Header: Header{Id: iq.Id, Type: "result",
+				Nested: []interface{}{&MamFin{Complete: page == 1,
+					Set: &RsmSet{Last: last}}}}}
+			h.f(reply)
+			recvIn <- reply
+		}
+	}()
+
+	q := am.Query(context.Background(), "", ArchiveFilter{With: "al@b.c",
+		PageSize: 2})
+	n := 0
+	for m := range q.Messages {
+		n++
+		assertEquals(t, fmt.Sprintf("a%d", n), m.Id)
+		assertEquals(t, fmt.Sprint(n), firstText(m.Message.Body))
+		want := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		if !m.Time.Equal(want) {
+			t.Errorf("time %v, want %v", m.Time, want)
+		}
+	}
+	if err := q.Err(); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	if n != 4 {
+		t.Errorf("got %d messages", n)
+	}
+	if form := <-submitted; form.Values("with")[0] != "al@b.c" {
+		t.Errorf("form %+v", form)
+	}
+	// Only the forged results reach the application, besides the
+	// iq results.
+	forged := 0
+	for len(recvOut) > 0 {
+		if m, ok := (<-recvOut).(*Message); ok {
+			assertEquals(t, "eve@b.c", string(m.From))
+			forged++
+		}
+	}
+	if forged != 2 {
+		t.Errorf("%d forged results passed on", forged)
+	}
+}
@@ -0,0 +1,247 @@
+package xmpp
+
+// This file contains running several accounts in one process.
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// How long looked-up SRV records are kept, since the resolver doesn't
+// say how long they're good for.
+const srvCacheTime = 5 * time.Minute
+
+// How far apart ClientManager spaces its clients' attempts to
+// reconnect, if ClientManager.Stagger isn't set.
+const defaultStagger = 500 * time.Millisecond
+
+// Something that happened to one of a ClientManager's clients.
+type ManagerEvent struct {
+	// The account, as given to Add.
+	Account JID
+	Client  *Client
+	// A stanza the client received. Nil when the session has
+	// ended.
+	Stanza Stanza
+	// When Stanza is nil, why the session ended. Nil if it was
+	// closed.
+	Err error
+}
+
+// ClientManager runs the sessions of several accounts. What they
+// receive is delivered on one channel, with the account it's for.
+// They share one cache of SRV records, and one of what the caps the
+// entities they see advertise stand for, and when the network goes
+// and they all lose their connections, their attempts to reconnect
+// with ReconnectExt are spread out instead of made together.
+type ClientManager struct {
+	// Received stanzas, and the ends of sessions. Once the manager
+	// is closed and every session has ended, it's closed.
+	Events <-chan ManagerEvent
+	events chan ManagerEvent
+	// The least time between two of the clients' attempts to
+	// reconnect. Zero means half a second.
+	Stagger time.Duration
+	srv     *srvCache
+	vers    *capsVers
+	lock    sync.Mutex
+	clients map[JID]*Client
+	// Accounts whose sessions are being started.
+	adding map[JID]bool
+	// The time the last attempt to reconnect was put off until.
+	lastAttempt time.Time
+	closed      bool
+	running     sync.WaitGroup
+}
+
+// Creates a ClientManager without any accounts.
+func NewClientManager() *ClientManager {
+	m := &ClientManager{events: make(chan ManagerEvent, 100)}
+	m.Events = m.events
+	m.srv = newSrvCache()
+	m.vers = newCapsVers()
+	m.clients = make(map[JID]*Client)
+	m.adding = make(map[JID]bool)
+	return m
+}
+
+var errManagerClosed = errors.New("manager closed")
+
+// Starts a session for an account with NewClientContext, and adds it
+// to the manager. The account is identified by jid's bare JID, and
+// only one session per account is managed. The manager reads the
+// client's Recv and Done, and the application reads Events instead.
+func (m *ClientManager) Add(ctx context.Context, jid *JID, password string,
+	tlsconf *tls.Config, exts []Extension, pr Presence) (*Client, error) {
+
+	account := jid.Bare()
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return nil, errManagerClosed
+	}
+	if m.clients[account] != nil || m.adding[account] {
+		m.lock.Unlock()
+		return nil, errors.New(string(account) + " is already managed")
+	}
+	m.adding[account] = true
+	m.lock.Unlock()
+
+	exts = append(exts[:len(exts):len(exts)], m.option())
+	cl, err := NewClientContext(ctx, jid, password, tlsconf, exts, pr, nil)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.adding, account)
+	if err != nil || m.closed {
+		if err == nil {
+			cl.Close()
+			err = errManagerClosed
+		}
+		return nil, err
+	}
+	m.clients[account] = cl
+	m.running.Add(1)
+	go m.pump(account, cl)
+	return cl, nil
+}
+
+// Shares the manager's caches with a client, and paces its
+// reconnections.
+func (m *ClientManager) option() Extension {
+	return Extension{option: func(o *options) {
+		o.srv = m.srv
+		o.capsVers = m.vers
+		o.pace = m.pace
+	}}
+}
+
+// Puts off an attempt to reconnect, which would otherwise be made
+// after delay, until long enough after the last one.
+func (m *ClientManager) pace(delay time.Duration) time.Duration {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	stagger := m.Stagger
+	if stagger == 0 {
+		stagger = defaultStagger
+	}
+	now := time.Now()
+	at := now.Add(delay)
+	if earliest := m.lastAttempt.Add(stagger); at.Before(earliest) {
+		at = earliest
+	}
+	m.lastAttempt = at
+	return at.Sub(now)
+}
+
+// Tags what a client receives with its account.
+func (m *ClientManager) pump(account JID, cl *Client) {
+	defer m.running.Done()
+	for st := range cl.Recv {
+		m.events <- ManagerEvent{Account: account, Client: cl,
+			Stanza: st}
+	}
+	err := <-cl.Done
+	m.lock.Lock()
+	if m.clients[account] == cl {
+		delete(m.clients, account)
+	}
+	m.lock.Unlock()
+	m.events <- ManagerEvent{Account: account, Client: cl, Err: err}
+}
+
+// Returns the client of an account, given its bare JID, or nil if it
+// isn't managed.
+func (m *ClientManager) Client(account JID) *Client {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.clients[account.Bare()]
+}
+
+// Returns the clients of every managed account.
+func (m *ClientManager) Clients() []*Client {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var res []*Client
+	for _, cl := range m.clients {
+		res = append(res, cl)
+	}
+	return res
+}
+
+// Closes an account's session. Its end is reported on Events as
+// usual.
+func (m *ClientManager) Remove(account JID) {
+	if cl := m.Client(account); cl != nil {
+		cl.Close()
+	}
+}
+
+// Closes every session, and Events once the ends of the sessions have
+// been delivered.
+func (m *ClientManager) Close() {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return
+	}
+	m.closed = true
+	m.lock.Unlock()
+	var wg sync.WaitGroup
+	for _, cl := range m.Clients() {
+		wg.Add(1)
+		go func(cl *Client) {
+			defer wg.Done()
+			cl.Close()
+		}(cl)
+	}
+	wg.Wait()
+	go func() {
+		m.running.Wait()
+		close(m.events)
+	}()
+}
+
+// Keeps the SRV records of the domains connected to.
+type srvCache struct {
+	lock    sync.Mutex
+	entries map[string]srvEntry
+}
+
+type srvEntry struct {
+	srvs    []*net.SRV
+	found   bool
+	expires time.Time
+}
+
+func newSrvCache() *srvCache {
+	return &srvCache{entries: make(map[string]srvEntry)}
+}
+
+// Like lookupClientSrv, but successful lookups are remembered for a
+// while. A nil cache looks every time.
+func (c *srvCache) lookup(ctx context.Context, service,
+	domain string) ([]*net.SRV, bool, error) {
+
+	if c == nil {
+		return lookupClientSrv(ctx, service, domain)
+	}
+	key := service + " " + domain
+	c.lock.Lock()
+	e, ok := c.entries[key]
+	c.lock.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.srvs, e.found, nil
+	}
+	srvs, found, err := lookupClientSrv(ctx, service, domain)
+	if err != nil {
+		return nil, false, err
+	}
+	c.lock.Lock()
+	c.entries[key] = srvEntry{srvs, found, time.Now().Add(srvCacheTime)}
+	c.lock.Unlock()
+	return srvs, found, nil
+}
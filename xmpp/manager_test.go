@@ -0,0 +1,106 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientManager(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	s.AddUser("bob", "secret")
+	var lock sync.Mutex
+	lookups := 0
+	defer fakeSRV(nil, nil)()
+	fake := lookupSRV
+	lookupSRV = func(ctx context.Context, service, proto,
+		name string) (string, []*net.SRV, error) {
+		lock.Lock()
+		lookups++
+		lock.Unlock()
+		return fake(ctx, service, proto, name)
+	}
+	d := DialerExt(DialerFunc(func(ctx context.Context, network,
+		addr string) (net.Conn, error) {
+		return s.Dial(), nil
+	}))
+
+	m := NewClientManager()
+	ctx := context.Background()
+	for _, jid := range []JID{"alice@b.c/pc", "bob@b.c/pc"} {
+		if _, err := m.Add(ctx, &jid, "secret", &tls.Config{},
+			[]Extension{d}, Presence{}); err != nil {
+			t.Fatalf("Add %s: %v", jid, err)
+		}
+	}
+	jid := JID("bob@b.c/phone")
+	if _, err := m.Add(ctx, &jid, "secret", &tls.Config{},
+		[]Extension{d}, Presence{}); err == nil {
+		t.Error("added bob twice")
+	}
+	// Each service was looked up once.
+	lock.Lock()
+	if lookups != 2 {
+		t.Errorf("%d SRV lookups", lookups)
+	}
+	lock.Unlock()
+
+	m.Client("alice@b.c").Send <- &Message{Header: Header{To: "bob@b.c/pc"},
+		Body: []Text{{Chardata: "hi"}}}
+	next := func() ManagerEvent {
+		for {
+			select {
+			case ev := <-m.Events:
+				// Only messages and the ends of sessions.
+				switch ev.Stanza.(type) {
+				case *Message, nil:
+					return ev
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no event")
+			}
+		}
+	}
+	ev := next()
+	assertEquals(t, "bob@b.c", string(ev.Account))
+	if msg, ok := ev.Stanza.(*Message); !ok || firstText(msg.Body) != "hi" {
+		t.Errorf("got %#v", ev.Stanza)
+	}
+
+	m.Remove("alice@b.c")
+	ev = next()
+	assertEquals(t, "alice@b.c", string(ev.Account))
+	if ev.Stanza != nil || ev.Err != nil {
+		t.Errorf("got %#v, want the end of the session", ev)
+	}
+	if m.Client("alice@b.c") != nil {
+		t.Error("alice is still managed")
+	}
+
+	m.Close()
+	ev = next()
+	assertEquals(t, "bob@b.c", string(ev.Account))
+	if _, ok := <-m.Events; ok {
+		t.Error("Events wasn't closed")
+	}
+}
+
+func TestManagerPace(t *testing.T) {
+	m := NewClientManager()
+	m.Stagger = time.Second
+	a := m.pace(0)
+	b := m.pace(0)
+	if a > time.Millisecond || b < 900*time.Millisecond {
+		t.Errorf("delays %v and %v", a, b)
+	}
+	// A later attempt isn't put off.
+	if c := m.pace(time.Hour); c < time.Hour-time.Millisecond ||
+		c > time.Hour {
+		t.Errorf("delay %v", c)
+	}
+}
@@ -0,0 +1,298 @@
+package xmpp
+
+// This file contains support for chat markers, XEP-0333.
+
+import (
+	"encoding/xml"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const NsChatMarkers = "urn:xmpp:chat-markers:0"
+
+// The kinds of chat marker.
+const (
+	MarkerReceived     = "received"
+	MarkerDisplayed    = "displayed"
+	MarkerAcknowledged = "acknowledged"
+)
+
+// Marks an outgoing message as one the recipient may send markers
+// for.
+type Markable struct {
+	XMLName xml.Name `xml:"urn:xmpp:chat-markers:0 markable"`
+}
+
+// A chat marker for the message with the given id. XMLName.Local
+// gives the kind of marker.
+type ChatMarker struct {
+	XMLName xml.Name
+	Id      string `xml:"id,attr"`
+}
+
+// Returns a marker of the given kind for a message id.
+func NewChatMarker(kind, id string) *ChatMarker {
+	return &ChatMarker{XMLName: xml.Name{Space: NsChatMarkers,
+		Local: kind}, Id: id}
+}
+
+// ChatMarkersExt may be included in the extensions passed to
+// NewClient to decode chat markers in incoming messages.
+var ChatMarkersExt Extension = Extension{}
+
+func init() {
+	ChatMarkersExt.Features = []string{NsChatMarkers}
+	ChatMarkersExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	mName := xml.Name{Space: NsChatMarkers, Local: "markable"}
+	ChatMarkersExt.StanzaTypes[mName] = reflect.TypeOf(Markable{})
+	for _, kind := range []string{MarkerReceived, MarkerDisplayed,
+		MarkerAcknowledged} {
+		mName = xml.Name{Space: NsChatMarkers, Local: kind}
+		ChatMarkersExt.StanzaTypes[mName] = reflect.TypeOf(ChatMarker{})
+	}
+}
+
+// Was the message marked as markable by its sender?
+func (m *Message) IsMarkable() bool {
+	for _, ele := range m.Nested {
+		switch ele.(type) {
+		case *Markable, Markable:
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the chat marker carried by the message, if any.
+func (m *Message) Marker() *ChatMarker {
+	for _, ele := range m.Nested {
+		switch cm := ele.(type) {
+		case *ChatMarker:
+			return cm
+		case ChatMarker:
+			return &cm
+		}
+	}
+	return nil
+}
+
+// Returns a marker of the given kind for a message we received, to
+// be sent to its sender, or nil if the sender didn't mark it
+// markable. In multi-user chat rooms the marker goes to the room and
+// refers to the room's stanza id, and received markers aren't sent.
+func NewMarkerFor(orig *Message, kind string) *Message {
+	if !orig.IsMarkable() || orig.Type == "error" {
+		return nil
+	}
+	to, id := orig.From, orig.Id
+	if orig.Type == "groupchat" {
+		if kind == MarkerReceived {
+			return nil
+		}
+		to = orig.From.Bare()
+		id = orig.StanzaIds()[to]
+	}
+	if id == "" {
+		return nil
+	}
+	m := &Message{Header: Header{To: to, Type: orig.Type,
+		Nested: []interface{}{NewChatMarker(kind, id)}}}
+	if orig.Thread != nil {
+		thread := *orig.Thread
+		m.Thread = &thread
+	}
+	return m
+}
+
+// How many of the messages sent to one correspondent a MarkerManager
+// remembers.
+const maxMarkable = 100
+
+// A chat marker for a message this client sent.
+type MarkerEvent struct {
+	// The id of the marked message, as it was sent.
+	Id string
+	// MarkerReceived, MarkerDisplayed or MarkerAcknowledged.
+	Kind string
+	// Who marked it. In rooms, the occupant.
+	From JID
+	// When the message was sent.
+	Sent time.Time
+	// The ids of the messages sent to the same correspondent before
+	// it, oldest first, which the marker covers too.
+	Earlier []string
+}
+
+// MarkerManager is an extension which marks outgoing messages as
+// markable, optionally sends received markers for incoming ones,
+// and reports the markers the messages it sent get. Messages
+// carrying markers still appear on Client.Recv.
+type MarkerManager struct {
+	Extension
+	// Markers for the messages this client sent. They're discarded
+	// if the channel isn't ready for them. It's closed when the
+	// client closes.
+	Markers  <-chan MarkerEvent
+	markers  chan MarkerEvent
+	received bool
+	toServer chan Stanza
+	sendDone chan bool
+	lock     sync.Mutex
+	// The messages sent to each correspondent, and each room,
+	// oldest first.
+	sent map[JID][]sentMarkable
+}
+
+type sentMarkable struct {
+	id string
+	// In rooms, the id the room gave the message when it was
+	// reflected.
+	stanzaId string
+	sent     time.Time
+}
+
+// Creates a MarkerManager, to be passed to NewClient among the
+// extensions. Every outgoing message with a body is marked
+// markable, and given an id if it has none. If received is true,
+// markable messages received outside rooms are answered with a
+// received marker.
+func NewMarkerManager(received bool) *MarkerManager {
+	mm := &MarkerManager{received: received}
+	mm.markers = make(chan MarkerEvent, 16)
+	mm.Markers = mm.markers
+	mm.toServer = make(chan Stanza)
+	mm.sendDone = make(chan bool)
+	mm.sent = make(map[JID][]sentMarkable)
+	mm.StanzaTypes = ChatMarkersExt.StanzaTypes
+	mm.Features = ChatMarkersExt.Features
+	mm.RecvFilter = mm.recvFilter
+	mm.SendFilter = mm.sendFilter
+	return mm
+}
+
+// Sends a marker of the given kind, such as MarkerDisplayed, for a
+// message we received. Does nothing if NewMarkerFor returns nil.
+func (mm *MarkerManager) Mark(orig *Message, kind string) {
+	if m := NewMarkerFor(orig, kind); m != nil {
+		mm.send(m)
+	}
+}
+
+func (mm *MarkerManager) send(m *Message) {
+	select {
+	case mm.toServer <- m:
+	case <-mm.sendDone:
+	}
+}
+
+func (mm *MarkerManager) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	defer close(mm.markers)
+	for stan := range in {
+		if m, ok := stan.(*Message); ok && m.Type != "error" {
+			if mk := m.Marker(); mk != nil {
+				mm.marked(mk, m.From)
+			} else if m.Type == "groupchat" {
+				mm.reflected(m)
+			}
+			if mm.received && m.Type != "groupchat" {
+				if ack := NewMarkerFor(m, MarkerReceived); ack != nil {
+					mm.send(ack)
+				}
+			}
+		}
+		out <- stan
+	}
+}
+
+// Notes the id a room gave one of our messages.
+func (mm *MarkerManager) reflected(m *Message) {
+	room := m.From.Bare()
+	sid := m.StanzaIds()[room]
+	id, ok := m.OriginId()
+	if !ok {
+		id = m.Id
+	}
+	if sid == "" || id == "" {
+		return
+	}
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	sent := mm.sent[room]
+	for i := range sent {
+		if sent[i].id == id {
+			sent[i].stanzaId = sid
+		}
+	}
+}
+
+func (mm *MarkerManager) marked(mk *ChatMarker, from JID) {
+	peer := from.Bare()
+	mm.lock.Lock()
+	sent := mm.sent[peer]
+	i := len(sent) - 1
+	for ; i >= 0; i-- {
+		if sent[i].id == mk.Id || sent[i].stanzaId == mk.Id {
+			break
+		}
+	}
+	if i < 0 {
+		mm.lock.Unlock()
+		return
+	}
+	ev := MarkerEvent{Id: sent[i].id, Kind: mk.XMLName.Local,
+		From: from, Sent: sent[i].sent}
+	for _, s := range sent[:i] {
+		ev.Earlier = append(ev.Earlier, s.id)
+	}
+	if ev.Kind == MarkerAcknowledged {
+		// Nothing more is expected of these.
+		mm.sent[peer] = append(sent[:0:0], sent[i+1:]...)
+	}
+	mm.lock.Unlock()
+	select {
+	case mm.markers <- ev:
+	default:
+	}
+}
+
+func (mm *MarkerManager) sendFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	defer close(mm.sendDone)
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			if m, ok := stan.(*Message); ok {
+				mm.sending(m)
+			}
+			out <- stan
+		case stan := <-mm.toServer:
+			out <- stan
+		}
+	}
+}
+
+// Marks the message markable if need be, and remembers it if it is.
+func (mm *MarkerManager) sending(m *Message) {
+	if m.Type == "error" || len(m.Body) == 0 {
+		return
+	}
+	if !m.IsMarkable() {
+		m.Nested = append(m.Nested, &Markable{})
+	}
+	if m.Id == "" {
+		m.Id = NextId()
+	}
+	peer := m.To.Bare()
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	sent := append(mm.sent[peer], sentMarkable{id: m.Id, sent: time.Now()})
+	if len(sent) > maxMarkable {
+		sent = sent[len(sent)-maxMarkable:]
+	}
+	mm.sent[peer] = sent
+}
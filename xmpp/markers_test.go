@@ -0,0 +1,130 @@
+package xmpp
+
+import (
+	"testing"
+)
+
+func TestNewMarkerFor(t *testing.T) {
+	orig := &Message{Header: Header{From: "a@b.c/d", Id: "m1", Type: "chat",
+		Nested: []interface{}{&Markable{}}},
+		Body: []Text{{Chardata: "hi"}}}
+	m := NewMarkerFor(orig, MarkerDisplayed)
+	assertEquals(t, "a@b.c/d", string(m.To))
+	if mk := m.Marker(); mk == nil || mk.Id != "m1" ||
+		mk.XMLName.Local != MarkerDisplayed {
+		t.Errorf("bad marker %+v", m)
+	}
+
+	// In rooms, the room's id is used.
+	orig = &Message{Header: Header{From: "r@b.c/nick", Id: "m2",
+		Type: "groupchat", Nested: []interface{}{&Markable{},
+			&StanzaId{By: "r@b.c", Id: "s2"}}}}
+	m = NewMarkerFor(orig, MarkerDisplayed)
+	assertEquals(t, "r@b.c", string(m.To))
+	assertEquals(t, "s2", m.Marker().Id)
+	if NewMarkerFor(orig, MarkerReceived) != nil {
+		t.Error("received marker sent to a room")
+	}
+
+	orig.Nested = nil
+	if NewMarkerFor(orig, MarkerDisplayed) != nil {
+		t.Error("marker for a message which isn't markable")
+	}
+}
+
+func TestMarkerManager(t *testing.T) {
+	mm := NewMarkerManager(true)
+	sendIn := make(chan Stanza)
+	sendOut := make(chan Stanza)
+	go mm.SendFilter(sendIn, sendOut)
+	defer close(sendIn)
+	recvIn := make(chan Stanza)
+	recvOut := make(chan Stanza)
+	go mm.RecvFilter(recvIn, recvOut)
+	defer close(recvIn)
+
+	// Outgoing messages with a body are markable.
+	var ids []string
+	for i := 0; i < 3; i++ {
+		sendIn <- &Message{Header: Header{To: "a@b.c/d", Type: "chat"},
+			Body: []Text{{Chardata: "hi"}}}
+		m := (<-sendOut).(*Message)
+		if !m.IsMarkable() || m.Id == "" {
+			t.Fatalf("not markable: %+v", m)
+		}
+		ids = append(ids, m.Id)
+	}
+	sendIn <- &Message{Header: Header{To: "a@b.c/d", Type: "chat"}}
+	if (<-sendOut).(*Message).IsMarkable() {
+		t.Error("message without a body marked markable")
+	}
+
+	// A marker from someone else doesn't count.
+	recvIn <- &Message{Header: Header{From: "x@b.c/d", Nested: []interface{}{
+		NewChatMarker(MarkerDisplayed, ids[1])}}}
+	<-recvOut
+	recvIn <- &Message{Header: Header{From: "a@b.c/e", Nested: []interface{}{
+		NewChatMarker(MarkerDisplayed, ids[1])}}}
+	<-recvOut
+	ev := <-mm.Markers
+	assertEquals(t, ids[1], ev.Id)
+	assertEquals(t, MarkerDisplayed, ev.Kind)
+	assertEquals(t, "a@b.c/e", string(ev.From))
+	if len(ev.Earlier) != 1 || ev.Earlier[0] != ids[0] ||
+		len(mm.Markers) != 0 {
+		t.Errorf("got %+v", ev)
+	}
+
+	// Once acknowledged, earlier messages are forgotten.
+	recvIn <- &Message{Header: Header{From: "a@b.c/e", Nested: []interface{}{
+		NewChatMarker(MarkerAcknowledged, ids[1])}}}
+	<-recvOut
+	<-mm.Markers
+	recvIn <- &Message{Header: Header{From: "a@b.c/e", Nested: []interface{}{
+		NewChatMarker(MarkerDisplayed, ids[0])}}}
+	<-recvOut
+	recvIn <- &Message{Header: Header{From: "a@b.c/e", Nested: []interface{}{
+		NewChatMarker(MarkerDisplayed, ids[2])}}}
+	<-recvOut
+	ev = <-mm.Markers
+	assertEquals(t, ids[2], ev.Id)
+	if len(ev.Earlier) != 0 {
+		t.Errorf("earlier %v", ev.Earlier)
+	}
+
+	// In rooms, markers refer to the id the room gave the message.
+	sendIn <- &Message{Header: Header{To: "r@b.c", Type: "groupchat"},
+		Body: []Text{{Chardata: "hi"}}}
+	m := (<-sendOut).(*Message)
+	recvIn <- &Message{Header: Header{From: "r@b.c/me", Type: "groupchat",
+		Nested: []interface{}{&OriginId{Id: m.Id},
+			&StanzaId{By: "r@b.c", Id: "s1"}}},
+		Body: []Text{{Chardata: "hi"}}}
+	<-recvOut
+	recvIn <- &Message{Header: Header{From: "r@b.c/bob", Type: "groupchat",
+		Nested: []interface{}{NewChatMarker(MarkerDisplayed, "s1")}}}
+	<-recvOut
+	ev = <-mm.Markers
+	assertEquals(t, m.Id, ev.Id)
+	assertEquals(t, "r@b.c/bob", string(ev.From))
+
+	// Markable messages are answered with a received marker.
+	go func() {
+		recvIn <- &Message{Header: Header{From: "a@b.c/d", Id: "m2",
+			Type: "chat", Nested: []interface{}{&Markable{}}},
+			Body: []Text{{Chardata: "yo"}}}
+	}()
+	m = (<-sendOut).(*Message)
+	assertEquals(t, "a@b.c/d", string(m.To))
+	if mk := m.Marker(); mk == nil || mk.Id != "m2" ||
+		mk.XMLName.Local != MarkerReceived {
+		t.Errorf("bad marker %+v", m)
+	}
+	<-recvOut
+
+	// And the application can send others.
+	go mm.Mark(&Message{Header: Header{From: "a@b.c/d", Id: "m2",
+		Type: "chat", Nested: []interface{}{&Markable{}}}}, MarkerDisplayed)
+	m = (<-sendOut).(*Message)
+	assertEquals(t, MarkerDisplayed, m.Marker().XMLName.Local)
+}
@@ -0,0 +1,645 @@
+package xmpp
+
+// This file contains an in-memory server, for testing applications
+// built on this package without a real one.
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// MockServer implements just enough of an XMPP server to run a
+// Client against: the stream, STARTTLS if configured, SASL PLAIN, or
+// SASL2 PLAIN with Bind 2 if configured, resource binding, sessions,
+// and rosters. Stanzas between connected
+// clients are routed to them, and messages sent to the server's own
+// domain are echoed back to the sender. Iqs the server doesn't
+// understand are answered with service-unavailable.
+//
+// Connect a Client to it with NewClientFromConn and the connection
+// returned by Dial.
+type MockServer struct {
+	// The domain the server serves.
+	Domain string
+	// If non-nil, STARTTLS is offered and required, with this
+	// configuration.
+	TLS *tls.Config
+	// If set, SASL2 and Bind 2 are offered instead of SASL and
+	// resource binding.
+	Sasl2 bool
+	// Everything clients send once they've bound a resource, with
+	// the from address filled in. Stanzas are dropped if the test
+	// doesn't keep up.
+	Received <-chan Stanza
+	received chan Stanza
+	lock     sync.Mutex
+	// Accounts by bare JID, bound sessions by full JID, and every
+	// stream being served.
+	accounts map[JID]*mockAccount
+	sessions map[JID]*mockSession
+	streams  map[*mockSession]bool
+	closed   bool
+}
+
+type mockAccount struct {
+	password string
+	roster   []RosterItem
+}
+
+// One client's stream.
+type mockSession struct {
+	// The connection, and what it's running over if that's TLS.
+	conn, raw net.Conn
+	jid       JID
+	lock      sync.Mutex
+}
+
+// The payloads the server understands.
+var mockPayloads = map[xml.Name]reflect.Type{
+	{Space: NsRoster, Local: "query"}: reflect.TypeOf(RosterQuery{}),
+	{Space: NsBind, Local: "bind"}:    reflect.TypeOf(bindIq{}),
+}
+
+// Creates a MockServer for a domain, with no accounts.
+func NewMockServer(domain string) *MockServer {
+	s := &MockServer{Domain: domain}
+	s.received = make(chan Stanza, 100)
+	s.Received = s.received
+	s.accounts = make(map[JID]*mockAccount)
+	s.sessions = make(map[JID]*mockSession)
+	s.streams = make(map[*mockSession]bool)
+	return s
+}
+
+// Adds an account for user, the node part of the JID, with a password
+// and the initial contents of its roster.
+func (s *MockServer) AddUser(user, password string, roster ...RosterItem) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.accounts[JID(user+"@"+s.Domain)] = &mockAccount{password: password,
+		roster: roster}
+}
+
+// Returns the current roster of user's account.
+func (s *MockServer) Roster(user string) []RosterItem {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	acct := s.accounts[JID(user+"@"+s.Domain)]
+	if acct == nil {
+		return nil
+	}
+	return append([]RosterItem(nil), acct.roster...)
+}
+
+// Returns one end of a new in-memory connection, with the server
+// serving the other.
+func (s *MockServer) Dial() net.Conn {
+	cconn, sconn := net.Pipe()
+	go s.Serve(sconn)
+	return cconn
+}
+
+// Sends a stanza from the server to the connected clients it's
+// addressed to: the session with that full JID, or all of a bare
+// JID's sessions. The stanza should have a from address.
+func (s *MockServer) Send(st Stanza) error {
+	to := s.route(st.GetHeader().To)
+	if len(to) == 0 {
+		return fmt.Errorf("%s isn't connected", st.GetHeader().To)
+	}
+	for _, ss := range to {
+		if err := ss.write(st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ends the streams of the connected clients jid is routed to with a
+// stream error, and closes their connections.
+func (s *MockServer) StreamError(jid JID, se *StreamError) error {
+	to := s.route(jid)
+	if len(to) == 0 {
+		return fmt.Errorf("%s isn't connected", jid)
+	}
+	cond := &Generic{XMLName: xml.Name{Space: NsStreams,
+		Local: se.Condition}, Chardata: se.Host}
+	var text *errText
+	if se.Text != "" {
+		text = &errText{Text: se.Text}
+	}
+	buf, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"stream:error"`
+		Cond    *Generic
+		Text    *errText
+	}{Cond: cond, Text: text})
+	if err != nil {
+		return err
+	}
+	for _, ss := range to {
+		ss.write(string(buf) + "</stream:stream>")
+		ss.raw.Close()
+	}
+	return nil
+}
+
+// Closes every client's connection.
+func (s *MockServer) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	for ss := range s.streams {
+		ss.raw.Close()
+	}
+}
+
+// Returns the sessions a stanza to jid is delivered to.
+func (s *MockServer) route(jid JID) []*mockSession {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if jid.Resource() != "" {
+		if ss := s.sessions[jid]; ss != nil {
+			return []*mockSession{ss}
+		}
+		return nil
+	}
+	var res []*mockSession
+	for full, ss := range s.sessions {
+		if full.Bare() == jid {
+			res = append(res, ss)
+		}
+	}
+	return res
+}
+
+func (ss *mockSession) write(v interface{}) error {
+	var buf []byte
+	switch v := v.(type) {
+	case string:
+		buf = []byte(v)
+	default:
+		var err error
+		buf, err = xml.Marshal(v)
+		if err != nil {
+			return err
+		}
+	}
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	_, err := ss.conn.Write(buf)
+	return err
+}
+
+// Serves one client over conn until its stream ends, then closes the
+// connection.
+func (s *MockServer) Serve(conn net.Conn) error {
+	conn = newQueuedConn(conn)
+	ss := &mockSession{conn: conn, raw: conn}
+	defer func() {
+		s.lock.Lock()
+		if s.sessions[ss.jid] == ss {
+			delete(s.sessions, ss.jid)
+		}
+		delete(s.streams, ss)
+		s.lock.Unlock()
+		ss.raw.Close()
+	}()
+	s.lock.Lock()
+	closed := s.closed
+	s.streams[ss] = true
+	s.lock.Unlock()
+	if closed {
+		return errors.New("server closed")
+	}
+
+	dec := xml.NewDecoder(conn)
+	secure := false
+	var user JID
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if ee, ok := tok.(xml.EndElement); ok &&
+			ee.Name.Space == NsStream && ee.Name.Local == "stream" {
+			// The client ended its stream, so the server ends
+			// its own.
+			return ss.write("</stream:stream>")
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch se.Name.Space + " " + se.Name.Local {
+		case NsStream + " stream":
+			if err := s.startStream(ss, secure, user); err != nil {
+				return err
+			}
+			continue
+		case NsTLS + " starttls":
+			if err := dec.Skip(); err != nil {
+				return err
+			}
+			if s.TLS == nil || secure {
+				return ss.write(`<failure xmlns="` + NsTLS + `"/>`)
+			}
+			if err := ss.write(`<proceed xmlns="` + NsTLS +
+				`"/>`); err != nil {
+				return err
+			}
+			tc := tls.Server(ss.conn, s.TLS)
+			if err := tc.Handshake(); err != nil {
+				return err
+			}
+			ss.lock.Lock()
+			ss.conn = tc
+			ss.lock.Unlock()
+			dec = xml.NewDecoder(tc)
+			secure = true
+			continue
+		case NsSASL + " auth":
+			var a auth
+			if err := dec.DecodeElement(&a, &se); err != nil {
+				return err
+			}
+			if s.TLS != nil && !secure {
+				return errors.New("auth before STARTTLS")
+			}
+			if user = s.authenticate(&a); user == "" {
+				err = ss.write(`<failure xmlns="` + NsSASL +
+					`"><not-authorized/></failure>`)
+			} else {
+				err = ss.write(`<success xmlns="` + NsSASL + `"/>`)
+				// The stream restarts.
+				dec = xml.NewDecoder(ss.conn)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		case NsSasl2 + " authenticate":
+			if s.TLS != nil && !secure {
+				return errors.New("auth before STARTTLS")
+			}
+			if user, err = s.authenticate2(ss, dec, &se); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var st Stanza
+		switch se.Name.Local {
+		case "iq":
+			st = &Iq{}
+		case "message":
+			st = &Message{}
+		case "presence":
+			st = &Presence{}
+		default:
+			if err := dec.Skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := dec.DecodeElement(st, &se); err != nil {
+			return err
+		}
+		if user == "" {
+			return errors.New("stanza before authentication")
+		}
+		if err := parseExtended(st.GetHeader(), mockPayloads); err != nil {
+			return err
+		}
+		if err := s.handle(ss, user, st); err != nil {
+			return err
+		}
+	}
+}
+
+// Sends the stream header and the features for the stream's state.
+func (s *MockServer) startStream(ss *mockSession, secure bool,
+	user JID) error {
+
+	hdr := &stream{From: s.Domain, Id: NextId(), Version: XMPPVersion}
+	var feat string
+	switch {
+	case s.TLS != nil && !secure:
+		feat = `<starttls xmlns="` + NsTLS + `"><required/></starttls>`
+	case user == "" && s.Sasl2:
+		feat = `<authentication xmlns="` + NsSasl2 +
+			`"><mechanism>PLAIN</mechanism><inline><bind xmlns="` +
+			NsBind2 + `"/></inline></authentication>`
+	case user == "":
+		feat = `<mechanisms xmlns="` + NsSASL +
+			`"><mechanism>PLAIN</mechanism></mechanisms>`
+	default:
+		feat = `<bind xmlns="` + NsBind + `"/><session xmlns="` +
+			NsSession + `"/>`
+	}
+	return ss.write(hdr.String() + `<stream:features>` + feat +
+		`</stream:features>`)
+}
+
+// Checks SASL PLAIN credentials, and returns the account's bare JID
+// if they're right.
+func (s *MockServer) authenticate(a *auth) JID {
+	if a.Mechanism != "PLAIN" {
+		return ""
+	}
+	buf, err := base64.StdEncoding.DecodeString(a.Chardata)
+	if err != nil {
+		return ""
+	}
+	// authzid NUL authcid NUL password
+	parts := bytes.Split(buf, []byte{0})
+	if len(parts) != 3 {
+		return ""
+	}
+	jid := JID(string(parts[1]) + "@" + s.Domain)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	acct := s.accounts[jid]
+	if acct == nil || acct.password != string(parts[2]) {
+		return ""
+	}
+	return jid
+}
+
+// Authenticates with SASL2 and binds a resource with Bind 2, and
+// returns the account's bare JID, or the empty JID if the
+// credentials are wrong.
+func (s *MockServer) authenticate2(ss *mockSession, dec *xml.Decoder,
+	se *xml.StartElement) (JID, error) {
+
+	var a struct {
+		Mechanism string `xml:"mechanism,attr"`
+		Initial   string `xml:"initial-response"`
+		Bind      *struct {
+			Tag string `xml:"tag"`
+		} `xml:"urn:xmpp:bind:0 bind"`
+	}
+	if err := dec.DecodeElement(&a, se); err != nil {
+		return "", err
+	}
+	user := s.authenticate(&auth{Mechanism: a.Mechanism,
+		Chardata: a.Initial})
+	if user == "" || a.Bind == nil {
+		return "", ss.write(`<failure xmlns="` + NsSasl2 +
+			`"><not-authorized xmlns="` + NsSASL + `"/></failure>`)
+	}
+	s.lock.Lock()
+	ss.jid = user + "/" + JID(a.Bind.Tag+"."+NextId())
+	s.sessions[ss.jid] = ss
+	s.lock.Unlock()
+	return user, ss.write(`<success xmlns="` + NsSasl2 +
+		`"><authorization-identifier>` + string(ss.jid) +
+		`</authorization-identifier><bound xmlns="` + NsBind2 +
+		`"/></success>`)
+}
+
+// Handles a stanza from an authenticated client.
+func (s *MockServer) handle(ss *mockSession, user JID, st Stanza) error {
+	h := st.GetHeader()
+	if iq, ok := st.(*Iq); ok && ss.jid == "" {
+		return s.bind(ss, user, iq)
+	}
+	if ss.jid == "" {
+		return errors.New("stanza before binding")
+	}
+	h.From = ss.jid
+	select {
+	case s.received <- st:
+	default:
+	}
+
+	domain := JID(s.Domain)
+	toServer := h.To == "" || h.To == domain || h.To == user
+	raw := newMockRaw(st)
+	switch st := st.(type) {
+	case *Iq:
+		if toServer {
+			return s.handleIq(ss, user, st)
+		}
+	case *Message:
+		if h.To == domain {
+			raw.To, raw.From = ss.jid, domain
+			return ss.write(raw)
+		}
+	}
+	if h.To == "" || h.To == domain {
+		return nil
+	}
+	// Everything else goes to the addressee, as it was sent.
+	to := s.route(h.To)
+	for _, peer := range to {
+		if err := peer.write(raw); err != nil {
+			return err
+		}
+	}
+	if iq, ok := st.(*Iq); ok && len(to) == 0 &&
+		(iq.Type == "get" || iq.Type == "set") {
+		return ss.write(&Iq{Header: Header{To: ss.jid, From: h.To,
+			Id: iq.Id, Type: "error",
+			Error: stanzaError("cancel", "service-unavailable")}})
+	}
+	return nil
+}
+
+// A stanza as it was received, for passing on. Unlike the stanza's
+// own type, it only has the children it arrived with.
+type mockRaw struct {
+	XMLName xml.Name
+	To      JID    `xml:"to,attr,omitempty"`
+	From    JID    `xml:"from,attr,omitempty"`
+	Id      string `xml:"id,attr,omitempty"`
+	Type    string `xml:"type,attr,omitempty"`
+	Lang    string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Inner   string `xml:",innerxml"`
+}
+
+func newMockRaw(st Stanza) *mockRaw {
+	h := st.GetHeader()
+	name := xml.Name{Space: NsClient}
+	switch st.(type) {
+	case *Iq:
+		name.Local = "iq"
+	case *Message:
+		name.Local = "message"
+	case *Presence:
+		name.Local = "presence"
+	}
+	return &mockRaw{XMLName: name, To: h.To, From: h.From, Id: h.Id,
+		Type: h.Type, Lang: h.Lang, Inner: h.Innerxml}
+}
+
+// Binds a resource, which is the only thing a client can do before it
+// has one.
+func (s *MockServer) bind(ss *mockSession, user JID, iq *Iq) error {
+	var req *bindIq
+	for _, ele := range iq.Nested {
+		if b, ok := ele.(*bindIq); ok {
+			req = b
+		}
+	}
+	if iq.Type != "set" || req == nil {
+		return errors.New("stanza before binding")
+	}
+	res := ""
+	if req.Resource != nil {
+		res = *req.Resource
+	}
+	s.lock.Lock()
+	if res == "" || s.sessions[user+"/"+JID(res)] != nil {
+		res = NextId()
+	}
+	ss.jid = user + "/" + JID(res)
+	s.sessions[ss.jid] = ss
+	s.lock.Unlock()
+	jid := ss.jid
+	return ss.write(&Iq{Header: Header{Id: iq.Id, Type: "result",
+		Nested: []interface{}{&bindIq{Jid: &jid}}}})
+}
+
+// Answers an iq addressed to the server or the user's account.
+func (s *MockServer) handleIq(ss *mockSession, user JID, iq *Iq) error {
+	if iq.Type != "get" && iq.Type != "set" {
+		return nil
+	}
+	reply := &Iq{Header: Header{To: ss.jid, From: iq.To, Id: iq.Id,
+		Type: "result"}}
+	var rq *RosterQuery
+	for _, ele := range iq.Nested {
+		if q, ok := ele.(*RosterQuery); ok {
+			rq = q
+		}
+	}
+	switch {
+	case strings.Contains(iq.Innerxml, NsSession):
+	case rq != nil && iq.Type == "get":
+		// As some servers do.
+		reply.From = user
+		reply.Nested = []interface{}{&RosterQuery{Item: s.Roster(
+			user.Node())}}
+	case rq != nil && len(rq.Item) == 1:
+		if err := s.rosterSet(user, rq.Item[0]); err != nil {
+			return err
+		}
+	default:
+		reply.Type = "error"
+		reply.Error = stanzaError("cancel", "service-unavailable")
+	}
+	return ss.write(reply)
+}
+
+// Changes an item in the user's roster, and pushes the change to the
+// user's sessions.
+func (s *MockServer) rosterSet(user JID, item RosterItem) error {
+	item.Jid = item.Jid.Bare()
+	s.lock.Lock()
+	acct := s.accounts[user]
+	roster := acct.roster[:0:0]
+	for _, it := range acct.roster {
+		if it.Jid != item.Jid {
+			roster = append(roster, it)
+		}
+	}
+	if item.Subscription != "remove" {
+		if item.Subscription == "" {
+			item.Subscription = "none"
+		}
+		roster = append(roster, item)
+	}
+	acct.roster = roster
+	s.lock.Unlock()
+
+	for _, ss := range s.route(user) {
+		push := &Iq{Header: Header{From: user, To: ss.jid, Id: NextId(),
+			Type: "set", Nested: []interface{}{&RosterQuery{
+				Item: []RosterItem{item}}}}}
+		if err := ss.write(push); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A connection whose writes are queued and written by a goroutine of
+// its own, so that the server reads what the client sends even while
+// the client isn't reading, as over net.Pipe, where otherwise both
+// would block writing at once, such as during a failing TLS
+// handshake. Closing it closes the connection once the queue has been
+// written.
+type queuedConn struct {
+	net.Conn
+	lock   sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	closed bool
+	err    error
+}
+
+func newQueuedConn(conn net.Conn) *queuedConn {
+	qc := &queuedConn{Conn: conn}
+	qc.cond = sync.NewCond(&qc.lock)
+	go qc.flush()
+	return qc
+}
+
+func (qc *queuedConn) Write(buf []byte) (int, error) {
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	if qc.err != nil {
+		return 0, qc.err
+	}
+	if qc.closed {
+		return 0, net.ErrClosed
+	}
+	qc.queue = append(qc.queue, append([]byte(nil), buf...))
+	qc.cond.Signal()
+	return len(buf), nil
+}
+
+func (qc *queuedConn) Close() error {
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	qc.closed = true
+	qc.cond.Signal()
+	return nil
+}
+
+// Writes the queue until the connection is closed or fails.
+func (qc *queuedConn) flush() {
+	defer qc.Conn.Close()
+	for {
+		qc.lock.Lock()
+		for len(qc.queue) == 0 && !qc.closed {
+			qc.cond.Wait()
+		}
+		if len(qc.queue) == 0 {
+			qc.lock.Unlock()
+			return
+		}
+		buf := qc.queue[0]
+		qc.queue = qc.queue[1:]
+		qc.lock.Unlock()
+		if _, err := qc.Conn.Write(buf); err != nil {
+			qc.lock.Lock()
+			qc.err = err
+			qc.queue = nil
+			qc.lock.Unlock()
+			return
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func mockClient(t *testing.T, s *MockServer, jid JID, password string,
+	tlsconf *tls.Config) *Client {
+
+	cl, err := NewClientFromConn(s.Dial(), &jid, password, tlsconf, nil,
+		Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn %s: %v", jid, err)
+	}
+	return cl
+}
+
+// Returns the next message the client receives, skipping anything
+// else.
+func recvMessage(t *testing.T, cl *Client) *Message {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case st := <-cl.Recv:
+			if m, ok := st.(*Message); ok {
+				return m
+			}
+		case <-timeout:
+			t.Fatal("no message received")
+		}
+	}
+}
+
+func TestMockServer(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret", RosterItem{Jid: "bob@b.c",
+		Subscription: "both"})
+	s.AddUser("bob", "hunter2")
+
+	alice := mockClient(t, s, "alice@b.c/pc", "secret", &tls.Config{})
+	defer alice.Close()
+	bob := mockClient(t, s, "bob@b.c/phone", "hunter2", &tls.Config{})
+	defer bob.Close()
+	if r := alice.Roster.Get(); len(r) != 1 || r[0].Jid != "bob@b.c" {
+		t.Errorf("alice's roster %v", r)
+	}
+
+	alice.Send <- &Message{Header: Header{To: "bob@b.c/phone", Type: "chat"},
+		Body: []Text{{Chardata: "hi"}}}
+	m := recvMessage(t, bob)
+	assertEquals(t, "alice@b.c/pc", string(m.From))
+	assertEquals(t, "hi", firstText(m.Body))
+
+	bob.Send <- &Message{Header: Header{To: "b.c"},
+		Body: []Text{{Chardata: "echo"}}}
+	m = recvMessage(t, bob)
+	assertEquals(t, "b.c", string(m.From))
+	assertEquals(t, "echo", firstText(m.Body))
+
+	if err := bob.AddContact(context.Background(), "alice@b.c", "Al",
+		nil); err != nil {
+		t.Fatalf("AddContact: %v", err)
+	}
+	if r := s.Roster("bob"); len(r) != 1 || r[0].Name != "Al" {
+		t.Errorf("bob's roster on the server %v", r)
+	}
+
+	// The server saw the application's stanzas.
+	for st := range s.Received {
+		if m, ok := st.(*Message); ok && m.To == "b.c" {
+			break
+		}
+	}
+
+	jid := JID("bob@b.c/x")
+	if _, err := NewClientFromConn(s.Dial(), &jid, "wrong",
+		&tls.Config{}, nil, Presence{}, nil); err == nil {
+		t.Error("authenticated with the wrong password")
+	}
+}
+
+// Makes a self-signed certificate for a domain.
+func mockCert(t *testing.T, domain string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1),
+		Subject:               pkix.Name{CommonName: domain},
+		DNSNames:              []string{domain},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true, IsCA: true}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		pool
+}
+
+func TestMockServerTls(t *testing.T) {
+	cert, pool := mockCert(t, "b.c")
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	s.AddUser("alice", "secret")
+
+	cl := mockClient(t, s, "alice@b.c/pc", "secret",
+		&tls.Config{RootCAs: pool})
+	defer cl.Close()
+	if !cl.layer1.encrypted() {
+		t.Error("not encrypted")
+	}
+	cl.Send <- &Message{Header: Header{To: "b.c"},
+		Body: []Text{{Chardata: "echo"}}}
+	assertEquals(t, "echo", firstText(recvMessage(t, cl).Body))
+}
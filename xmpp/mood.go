@@ -0,0 +1,35 @@
+package xmpp
+
+// This file contains support for user mood, XEP-0107.
+
+import (
+	"encoding/xml"
+)
+
+const NsMood = "http://jabber.org/protocol/mood"
+
+// A user's mood, such as happy, with optional text. A Mood with no
+// Value clears a previously published mood.
+type Mood struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/mood mood"`
+	Value   *Generic `xml:",any"`
+	Text    string   `xml:"text,omitempty"`
+}
+
+// Creates a Mood, whose value is one of those listed in XEP-0107.
+func NewMood(value, text string) *Mood {
+	m := &Mood{Text: text}
+	if value != "" {
+		m.Value = &Generic{XMLName: xml.Name{Space: NsMood,
+			Local: value}}
+	}
+	return m
+}
+
+// Returns the name of the mood, or the empty string.
+func (m *Mood) Name() string {
+	if m.Value == nil {
+		return ""
+	}
+	return m.Value.XMLName.Local
+}
@@ -0,0 +1,139 @@
+package xmpp
+
+// This file contains support for multi-user chat, XEP-0045.
+
+import (
+	"./forms"
+	"encoding/xml"
+	"reflect"
+)
+
+const (
+	NsMuc        = "http://jabber.org/protocol/muc"
+	NsMucUser    = "http://jabber.org/protocol/muc#user"
+	NsMucRequest = "http://jabber.org/protocol/muc#request"
+	NsMucAdmin   = "http://jabber.org/protocol/muc#admin"
+	NsMucOwner   = "http://jabber.org/protocol/muc#owner"
+)
+
+// Sent in the presence which joins a room.
+type MucJoin struct {
+	XMLName  xml.Name    `xml:"http://jabber.org/protocol/muc x"`
+	Password string      `xml:"http://jabber.org/protocol/muc password,omitempty"`
+	History  *MucHistory `xml:"history"`
+}
+
+// Limits the discussion history a room sends on joining. Nil fields
+// are left out.
+type MucHistory struct {
+	MaxChars   *int   `xml:"maxchars,attr"`
+	MaxStanzas *int   `xml:"maxstanzas,attr"`
+	Seconds    *int   `xml:"seconds,attr"`
+	Since      string `xml:"since,attr,omitempty"`
+}
+
+// Included by a room in the presence and messages it sends about its
+// occupants.
+type MucUserX struct {
+	XMLName  xml.Name    `xml:"http://jabber.org/protocol/muc#user x"`
+	Invite   []MucInvite `xml:"invite"`
+	Decline  *MucInvite  `xml:"decline"`
+	Items    []MucItem   `xml:"item"`
+	Status   []MucStatus `xml:"status"`
+	Password string      `xml:"password,omitempty"`
+}
+
+// An invitation to a room sent through the room itself, or a refusal
+// of one. From is set by the room when passing it on; To is set by
+// the sender.
+type MucInvite struct {
+	From   JID    `xml:"from,attr,omitempty"`
+	To     JID    `xml:"to,attr,omitempty"`
+	Reason string `xml:"reason,omitempty"`
+}
+
+// Describes an occupant's standing in a room.
+type MucItem struct {
+	Affiliation string `xml:"affiliation,attr,omitempty"`
+	Role        string `xml:"role,attr,omitempty"`
+	Jid         JID    `xml:"jid,attr,omitempty"`
+	Nick        string `xml:"nick,attr,omitempty"`
+	Reason      string `xml:"reason,omitempty"`
+}
+
+// Changes, or lists, occupants' roles and affiliations.
+type MucAdminQuery struct {
+	XMLName xml.Name  `xml:"http://jabber.org/protocol/muc#admin query"`
+	Items   []MucItem `xml:"item"`
+}
+
+// Carries a room's configuration form, or a request to destroy the
+// room.
+type MucOwnerQuery struct {
+	XMLName xml.Name    `xml:"http://jabber.org/protocol/muc#owner query"`
+	Form    *forms.Form `xml:"jabber:x:data x"`
+	Destroy *MucDestroy `xml:"destroy"`
+}
+
+// Destroys a room, optionally pointing its occupants to another.
+type MucDestroy struct {
+	Jid      JID    `xml:"jid,attr,omitempty"`
+	Reason   string `xml:"reason,omitempty"`
+	Password string `xml:"password,omitempty"`
+}
+
+// A status code, giving more information about a presence or message
+// from a room.
+type MucStatus struct {
+	Code int `xml:"code,attr"`
+}
+
+// MucExt may be included in the extensions passed to NewClient to
+// decode the multi-user chat elements in incoming stanzas.
+var MucExt Extension = Extension{}
+
+func init() {
+	MucExt.Features = []string{NsMuc}
+	MucExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	mName := xml.Name{Space: NsMucUser, Local: "x"}
+	MucExt.StanzaTypes[mName] = reflect.TypeOf(MucUserX{})
+}
+
+// Returns the presence which joins a room with the given nick, and
+// password if it needs one. A nil history leaves the discussion
+// history it sends up to the room.
+func MucJoinPresence(room JID, nick, password string,
+	history *MucHistory) *Presence {
+
+	to := JID(string(room.Bare()) + "/" + nick)
+	return &Presence{Header: Header{To: to,
+		Nested: []interface{}{&MucJoin{Password: password,
+			History: history}}}}
+}
+
+// Returns the presence which leaves a room.
+func MucLeavePresence(room JID, nick string) *Presence {
+	to := JID(string(room.Bare()) + "/" + nick)
+	return &Presence{Header: Header{To: to, Type: "unavailable"}}
+}
+
+// Returns the multi-user chat information in a stanza from a room, if
+// any.
+func (h *Header) MucUser() *MucUserX {
+	for _, ele := range h.Nested {
+		if x, ok := ele.(*MucUserX); ok {
+			return x
+		}
+	}
+	return nil
+}
+
+// Does the element include the given status code?
+func (x *MucUserX) HasStatus(code int) bool {
+	for _, st := range x.Status {
+		if st.Code == code {
+			return true
+		}
+	}
+	return false
+}
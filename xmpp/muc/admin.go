@@ -0,0 +1,168 @@
+package muc
+
+// This file contains the moderator, admin, and owner operations on
+// multi-user chat rooms, XEP-0045 sections 8 to 10, and message
+// moderation, XEP-0425.
+
+import (
+	".."
+	"../forms"
+	"context"
+	"encoding/xml"
+	"fmt"
+)
+
+// Affiliations and roles in a room.
+const (
+	AffiliationOwner   = "owner"
+	AffiliationAdmin   = "admin"
+	AffiliationMember  = "member"
+	AffiliationNone    = "none"
+	AffiliationOutcast = "outcast"
+
+	RoleModerator   = "moderator"
+	RoleParticipant = "participant"
+	RoleVisitor     = "visitor"
+	RoleNone        = "none"
+)
+
+// Sends an iq and returns the reply.
+func (rm *Manager) iq(ctx context.Context, iq *xmpp.Iq) (*xmpp.Iq, error) {
+	rm.lock.Lock()
+	sendIq := rm.sendIq
+	rm.lock.Unlock()
+	if sendIq == nil {
+		return nil, fmt.Errorf("room manager not started")
+	}
+	return sendIq(ctx, iq)
+}
+
+// Sends an iq to the room, and returns the reply.
+func (r *Room) iq(ctx context.Context, typ string,
+	query interface{}) (*xmpp.Iq, error) {
+
+	iq := &xmpp.Iq{Header: xmpp.Header{To: r.Jid, Type: typ,
+		Nested: []interface{}{query}}}
+	return r.mgr.iq(ctx, iq)
+}
+
+func (r *Room) admin(ctx context.Context, item xmpp.MucItem) error {
+	_, err := r.iq(ctx, "set", &xmpp.MucAdminQuery{Items: []xmpp.MucItem{item}})
+	return err
+}
+
+// Changes the role of the occupant with the given nick. Needs a
+// moderator.
+func (r *Room) SetRole(ctx context.Context, nick, role,
+	reason string) error {
+
+	return r.admin(ctx, xmpp.MucItem{Nick: nick, Role: role, Reason: reason})
+}
+
+// Changes the affiliation of a user, by bare JID, whether or not
+// they're in the room. Needs an admin or owner.
+func (r *Room) SetAffiliation(ctx context.Context, jid xmpp.JID, affiliation,
+	reason string) error {
+
+	return r.admin(ctx, xmpp.MucItem{Jid: jid.Bare(),
+		Affiliation: affiliation, Reason: reason})
+}
+
+// Removes an occupant from the room. They may join again.
+func (r *Room) Kick(ctx context.Context, nick, reason string) error {
+	return r.SetRole(ctx, nick, RoleNone, reason)
+}
+
+// Bans a user from the room, removing them if they're in it.
+func (r *Room) Ban(ctx context.Context, jid xmpp.JID, reason string) error {
+	return r.SetAffiliation(ctx, jid, AffiliationOutcast, reason)
+}
+
+// Lets an occupant speak in a moderated room.
+func (r *Room) GrantVoice(ctx context.Context, nick string) error {
+	return r.SetRole(ctx, nick, RoleParticipant, "")
+}
+
+// Stops an occupant speaking in a moderated room.
+func (r *Room) RevokeVoice(ctx context.Context, nick string) error {
+	return r.SetRole(ctx, nick, RoleVisitor, "")
+}
+
+// Makes a user a member of the room.
+func (r *Room) GrantMembership(ctx context.Context, jid xmpp.JID) error {
+	return r.SetAffiliation(ctx, jid, AffiliationMember, "")
+}
+
+// Takes away a user's membership, or any other affiliation.
+func (r *Room) RevokeMembership(ctx context.Context, jid xmpp.JID) error {
+	return r.SetAffiliation(ctx, jid, AffiliationNone, "")
+}
+
+// Lists the users with the given affiliation, such as the members or
+// those banned.
+func (r *Room) Affiliations(ctx context.Context,
+	affiliation string) ([]xmpp.MucItem, error) {
+
+	reply, err := r.iq(ctx, "get", &xmpp.MucAdminQuery{Items: []xmpp.MucItem{
+		{Affiliation: affiliation}}})
+	if err != nil {
+		return nil, err
+	}
+	for _, ele := range reply.Nested {
+		if q, ok := ele.(*xmpp.MucAdminQuery); ok {
+			return q.Items, nil
+		}
+	}
+	return nil, nil
+}
+
+// Fetches the room's configuration form. Needs an owner.
+func (r *Room) Config(ctx context.Context) (*forms.Form, error) {
+	reply, err := r.iq(ctx, "get", &xmpp.MucOwnerQuery{})
+	if err != nil {
+		return nil, err
+	}
+	for _, ele := range reply.Nested {
+		if q, ok := ele.(*xmpp.MucOwnerQuery); ok && q.Form != nil {
+			return q.Form, nil
+		}
+	}
+	return nil, fmt.Errorf("no configuration form from %s", r.Jid)
+}
+
+// Submits a changed configuration form. It's sent as type submit. A
+// nil form accepts the room's defaults, which creates a reserved
+// room.
+func (r *Room) SubmitConfig(ctx context.Context, form *forms.Form) error {
+	f := &forms.Form{Type: forms.TypeSubmit}
+	if form != nil {
+		f = form.Submit()
+	}
+	_, err := r.iq(ctx, "set", &xmpp.MucOwnerQuery{Form: f})
+	return err
+}
+
+// Destroys the room. Its occupants are told the reason, and may be
+// pointed to an alternative room. Needs an owner.
+func (r *Room) Destroy(ctx context.Context, alternative xmpp.JID,
+	reason string) error {
+
+	_, err := r.iq(ctx, "set", &xmpp.MucOwnerQuery{Destroy: &xmpp.MucDestroy{
+		Jid: alternative, Reason: reason}})
+	return err
+}
+
+// The request a moderator sends a room to remove a message.
+type moderate struct {
+	XMLName xml.Name `xml:"urn:xmpp:message-moderate:1 moderate"`
+	Id      string   `xml:"id,attr"`
+	Retract xmpp.Retract
+	Reason  string `xml:"reason,omitempty"`
+}
+
+// Asks the room to remove the message it gave the given stanza id,
+// telling its occupants the reason, XEP-0425. Needs a moderator.
+func (r *Room) Moderate(ctx context.Context, stanzaId, reason string) error {
+	_, err := r.iq(ctx, "set", &moderate{Id: stanzaId, Reason: reason})
+	return err
+}
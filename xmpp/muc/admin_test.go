@@ -0,0 +1,107 @@
+package muc
+
+import (
+	".."
+	"../forms"
+	"context"
+	"encoding/xml"
+	"testing"
+)
+
+func TestRoomAdmin(t *testing.T) {
+	rm := NewManager()
+	r := &Room{Jid: "room@muc", mgr: rm}
+	// Answers each iq with the given payload, and reports what was
+	// asked.
+	asked := make(chan string, 1)
+	replies := make(chan interface{}, 1)
+	rm.sendIq = func(ctx context.Context, iq *xmpp.Iq) (*xmpp.Iq, error) {
+		buf, _ := xml.Marshal(iq.Nested[0])
+		asked <- iq.Type + " " + string(iq.To) + " " + string(buf)
+		reply := &xmpp.Iq{Header: xmpp.Header{Id: iq.Id, Type: "result"}}
+		if p := <-replies; p != nil {
+			reply.Nested = []interface{}{p}
+		}
+		return reply, nil
+	}
+	ctx := context.Background()
+	admin := func(item string) string {
+		return `set room@muc <query xmlns="` + xmpp.NsMucAdmin + `"><item` +
+			item + `</item></query>`
+	}
+
+	replies <- nil
+	if err := r.Kick(ctx, "al", "spam"); err != nil {
+		t.Fatalf("Kick: %v", err)
+	}
+	assertEquals(t, admin(` role="none" nick="al"><reason>spam</reason>`),
+		<-asked)
+
+	replies <- nil
+	r.Ban(ctx, "bo@b.c/x", "")
+	assertEquals(t, admin(` affiliation="outcast" jid="bo@b.c">`), <-asked)
+
+	replies <- nil
+	r.GrantVoice(ctx, "al")
+	assertEquals(t, admin(` role="participant" nick="al">`), <-asked)
+
+	replies <- nil
+	r.GrantMembership(ctx, "cy@b.c")
+	assertEquals(t, admin(` affiliation="member" jid="cy@b.c">`), <-asked)
+
+	replies <- &xmpp.MucAdminQuery{Items: []xmpp.MucItem{{Jid: "cy@b.c",
+		Affiliation: "member"}}}
+	items, err := r.Affiliations(ctx, AffiliationMember)
+	<-asked
+	if err != nil || len(items) != 1 {
+		t.Fatalf("Affiliations: %v %v", items, err)
+	}
+	assertEquals(t, "cy@b.c", string(items[0].Jid))
+
+	replies <- &xmpp.MucOwnerQuery{Form: &forms.Form{Type: "form",
+		Fields: []forms.Field{{Var: "muc#roomconfig_roomname"}}}}
+	form, err := r.Config(ctx)
+	assertEquals(t, `get room@muc <query xmlns="`+xmpp.NsMucOwner+
+		`"></query>`, <-asked)
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+	form.Fields[0].Values = []string{"Room"}
+	replies <- nil
+	r.SubmitConfig(ctx, form)
+	assertEquals(t, `set room@muc <query xmlns="`+xmpp.NsMucOwner+`">`+
+		`<x xmlns="jabber:x:data" type="submit"><field `+
+		`var="muc#roomconfig_roomname"><value>Room</value></field>`+
+		`</x></query>`, <-asked)
+
+	replies <- nil
+	r.Destroy(ctx, "new@muc", "moved")
+	assertEquals(t, `set room@muc <query xmlns="`+xmpp.NsMucOwner+`">`+
+		`<destroy jid="new@muc"><reason>moved</reason></destroy>`+
+		`</query>`, <-asked)
+}
+
+func TestModerate(t *testing.T) {
+	rm := NewManager()
+	r := &Room{Jid: "room@muc", mgr: rm}
+	asked := make(chan string, 1)
+	rm.sendIq = func(ctx context.Context, iq *xmpp.Iq) (*xmpp.Iq, error) {
+		buf, _ := xml.Marshal(iq.Nested[0])
+		asked <- string(buf)
+		return &xmpp.Iq{Header: xmpp.Header{Id: iq.Id,
+			Type: "result"}}, nil
+	}
+	if err := r.Moderate(context.Background(), "s1", "spam"); err != nil {
+		t.Errorf("Moderate: %v", err)
+	}
+	assertEquals(t, `<moderate xmlns="`+xmpp.NsModerate+`" id="s1">`+
+		`<retract xmlns="`+xmpp.NsRetract+`"></retract><reason>spam`+
+		`</reason></moderate>`, <-asked)
+}
+
+func TestRoomNotStarted(t *testing.T) {
+	r := &Room{Jid: "room@muc", mgr: NewManager()}
+	if err := r.Kick(context.Background(), "al", ""); err == nil {
+		t.Errorf("kicked without a client")
+	}
+}
@@ -0,0 +1,606 @@
+// This package implements multi-user chat rooms, XEP-0045, on top of
+// the xmpp package: joining them, following what happens in them, and
+// administering them. The protocol elements themselves, and
+// invitations to rooms, are in the xmpp package.
+package muc
+
+// This file contains a higher-level interface to multi-user chat
+// rooms, which presents each joined room as a Room value with its
+// own stream of events.
+
+import (
+	".."
+	"../forms"
+	"context"
+	"encoding/xml"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The kinds of event which occur in a room.
+type EventType int
+
+const (
+	// A message sent to the room.
+	EventMessage EventType = iota
+	// The subject changed, or was announced on joining.
+	EventSubject
+	// An occupant joined. Our own join is reported with Self set.
+	EventJoin
+	// An occupant left, or was kicked or banned. If Self is set, the
+	// room has been left and no more events will follow.
+	EventLeave
+	// An occupant changed nick; the new one is in NewNick.
+	EventNick
+	// An occupant's role or affiliation changed.
+	EventRole
+	// The room refused to let us join, for instance because of a
+	// nick conflict. No more events will follow.
+	EventError
+	// A self-ping found we're no longer in the room, though it
+	// never said so, and it's being joined again. Self is set. Our
+	// join is reported again once the room lets us back in, and so
+	// is everyone else's.
+	EventDisconnected
+)
+
+// Something which happened in a room.
+type Event struct {
+	Type EventType
+	// The nick of the occupant concerned, or of the sender of a
+	// message or subject.
+	Nick    string
+	NewNick string
+	// Does this event concern our own occupant?
+	Self bool
+	// The occupant's standing, for presence events.
+	Item xmpp.MucItem
+	// The message body or subject.
+	Body    string
+	Subject string
+	// The stanza the event was taken from.
+	Message  *xmpp.Message
+	Presence *xmpp.Presence
+}
+
+// A multi-user chat room which has been joined through a
+// Manager.
+type Room struct {
+	// The bare JID of the room.
+	Jid       xmpp.JID
+	Events    <-chan Event
+	events    chan Event
+	mgr       *Manager
+	lock      sync.Mutex
+	nick      string
+	subject   string
+	occupants map[string]xmpp.MucItem
+	// New nicks announced by nick changes, whose arrival isn't a
+	// join.
+	renamed map[string]xmpp.MucItem
+	// The presence which joined the room, for joining it again.
+	join *xmpp.Presence
+	// When the room last sent anything, and whether it's being
+	// pinged.
+	heard   time.Time
+	pinging bool
+	// Events waiting to be delivered, so that a room nobody reads
+	// doesn't hold up the client. Once the room is forgotten, no
+	// more are added.
+	cond  *sync.Cond
+	queue []Event
+	ended bool
+}
+
+// Manager is an extension which keeps track of the multi-user
+// chat rooms joined through it. Presence and groupchat messages from
+// those rooms are consumed, and delivered as events on each Room;
+// other stanzas pass through.
+//
+// An xmpp.ChatManager also claims groupchat messages; set its SkipRoom
+// to Owns so that it leaves the rooms joined here alone.
+type Manager struct {
+	xmpp.Extension
+	// If non-nil, called in a new goroutine when a room we moderate
+	// passes on an occupant's request for voice.
+	OnVoiceRequest func(*VoiceRequest)
+	// If not zero, rooms which have sent nothing for this long are
+	// pinged through our own occupant, XEP-0410, to find out
+	// whether we're still in them, since a server can drop us after
+	// a hiccup between servers without telling us. A room which
+	// says we aren't is joined again. It's set before the client
+	// starts.
+	SelfPing time.Duration
+	toServer chan xmpp.Stanza
+	done     chan bool
+	// Rooms which self-pings found we're no longer in.
+	lost  chan *Room
+	lock  sync.Mutex
+	rooms map[xmpp.JID]*Room
+	cl    *xmpp.Client
+	// Sends iqs and waits for the replies; the client's SendIq, once
+	// it's started.
+	sendIq func(context.Context, *xmpp.Iq) (*xmpp.Iq, error)
+}
+
+// Creates a Manager, to be passed to xmpp.NewClient among the
+// extensions.
+func NewManager() *Manager {
+	rm := &Manager{}
+	rm.toServer = make(chan xmpp.Stanza)
+	rm.done = make(chan bool)
+	rm.lost = make(chan *Room)
+	rm.rooms = make(map[xmpp.JID]*Room)
+	rm.StanzaTypes = make(map[xml.Name]reflect.Type)
+	for name, typ := range xmpp.MucExt.StanzaTypes {
+		rm.StanzaTypes[name] = typ
+	}
+	rm.Features = xmpp.MucExt.Features
+	fName := xml.Name{Space: forms.NsXData, Local: "x"}
+	rm.StanzaTypes[fName] = reflect.TypeOf(forms.Form{})
+	rm.StanzaTypes[xml.Name{Space: xmpp.NsMucAdmin, Local: "query"}] =
+		reflect.TypeOf(xmpp.MucAdminQuery{})
+	rm.StanzaTypes[xml.Name{Space: xmpp.NsMucOwner, Local: "query"}] =
+		reflect.TypeOf(xmpp.MucOwnerQuery{})
+	rm.RecvFilter = rm.recvFilter
+	rm.SendFilter = rm.sendFilter
+	rm.Start = func(cl *xmpp.Client) {
+		rm.lock.Lock()
+		rm.cl = cl
+		rm.sendIq = cl.SendIq
+		rm.lock.Unlock()
+		if rm.SelfPing > 0 {
+			go rm.selfPing()
+		}
+	}
+	return rm
+}
+
+// Options for joining a room.
+type Options struct {
+	// The room's password, if it needs one.
+	Password string
+	// How much of the discussion history to ask for. If nil, the
+	// room sends as much as it usually does.
+	History *History
+}
+
+// Limits the discussion history a room sends on joining. Zero
+// fields set no limit.
+type History struct {
+	// Ask for no history at all. The other fields are ignored.
+	None       bool
+	MaxStanzas int
+	MaxChars   int
+	// Only messages sent in this last period, or since this time.
+	Seconds int
+	Since   time.Time
+}
+
+func (h *History) muc() *xmpp.MucHistory {
+	if h == nil {
+		return nil
+	}
+	limit := func(n int) *int {
+		if n == 0 {
+			return nil
+		}
+		return &n
+	}
+	if h.None {
+		return &xmpp.MucHistory{MaxStanzas: new(int)}
+	}
+	mh := &xmpp.MucHistory{MaxStanzas: limit(h.MaxStanzas),
+		MaxChars: limit(h.MaxChars), Seconds: limit(h.Seconds)}
+	if !h.Since.IsZero() {
+		mh.Since = h.Since.UTC().Format(time.RFC3339)
+	}
+	return mh
+}
+
+// Joins a room with the given nick, and password if the room needs
+// one. Events are delivered on the returned Room as soon as the
+// room answers; the first is either a join with Self set, or an
+// error. Joining a room which was already joined returns the
+// existing Room.
+func (rm *Manager) Join(room xmpp.JID, nick, password string) *Room {
+	return rm.JoinRoom(room, nick, Options{Password: password})
+}
+
+// Like Join, with more options.
+func (rm *Manager) JoinRoom(room xmpp.JID, nick string,
+	opts Options) *Room {
+
+	room = room.Bare()
+	join := xmpp.MucJoinPresence(room, nick, opts.Password, opts.History.muc())
+	rm.lock.Lock()
+	r := rm.rooms[room]
+	if r == nil {
+		r = &Room{Jid: room, mgr: rm, nick: nick, join: join,
+			heard: time.Now()}
+		r.cond = sync.NewCond(&r.lock)
+		r.events = make(chan Event, 32)
+		r.Events = r.events
+		r.occupants = make(map[string]xmpp.MucItem)
+		r.renamed = make(map[string]xmpp.MucItem)
+		rm.rooms[room] = r
+		go r.deliver()
+	}
+	rm.lock.Unlock()
+	r.lock.Lock()
+	r.join = join
+	r.lock.Unlock()
+	r.send(join)
+	return r
+}
+
+// Returns the rooms currently joined.
+func (rm *Manager) Rooms() []*Room {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+	var rooms []*Room
+	for _, r := range rm.rooms {
+		rooms = append(rooms, r)
+	}
+	return rooms
+}
+
+// Reports whether a room has been joined through the manager, and
+// not left since.
+func (rm *Manager) Owns(room xmpp.JID) bool {
+	return rm.room(room) != nil
+}
+
+func (rm *Manager) room(jid xmpp.JID) *Room {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+	return rm.rooms[jid.Bare()]
+}
+
+// Forgets a room and ends its events.
+func (rm *Manager) remove(r *Room) {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+	if rm.rooms[r.Jid] == r {
+		delete(rm.rooms, r.Jid)
+		r.end()
+	}
+}
+
+// Queues an event for delivery, unless the room has been forgotten.
+func (r *Room) push(ev Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.ended {
+		r.queue = append(r.queue, ev)
+		r.cond.Signal()
+	}
+}
+
+// No more events are queued; those already queued are still
+// delivered.
+func (r *Room) end() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.ended = true
+	r.cond.Signal()
+}
+
+// Passes the queued events to Events, and closes it once the room
+// has been forgotten and they've all been passed on.
+func (r *Room) deliver() {
+	defer close(r.events)
+	for {
+		r.lock.Lock()
+		for len(r.queue) == 0 && !r.ended {
+			r.cond.Wait()
+		}
+		if len(r.queue) == 0 {
+			r.lock.Unlock()
+			return
+		}
+		ev := r.queue[0]
+		r.queue[0] = Event{}
+		r.queue = r.queue[1:]
+		r.lock.Unlock()
+		r.events <- ev
+	}
+}
+
+func (rm *Manager) recvFilter(in <-chan xmpp.Stanza, out chan<- xmpp.Stanza) {
+	defer close(out)
+	defer func() {
+		close(rm.done)
+		rm.lock.Lock()
+		for jid, r := range rm.rooms {
+			delete(rm.rooms, jid)
+			r.end()
+		}
+		rm.lock.Unlock()
+	}()
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			if !rm.received(stan) {
+				out <- stan
+			}
+		case r := <-rm.lost:
+			rm.disconnected(r)
+		}
+	}
+}
+
+// Delivers a stanza from a room to it. Returns false if it isn't for
+// one of the rooms.
+func (rm *Manager) received(stan xmpp.Stanza) bool {
+	r := rm.room(stan.GetHeader().From)
+	if r == nil {
+		return false
+	}
+	r.lock.Lock()
+	r.heard = time.Now()
+	r.lock.Unlock()
+	switch st := stan.(type) {
+	case *xmpp.Presence:
+		return r.presence(st)
+	case *xmpp.Message:
+		return r.message(st) || r.voiceRequest(st)
+	}
+	return false
+}
+
+func (rm *Manager) sendFilter(in <-chan xmpp.Stanza, out chan<- xmpp.Stanza) {
+	defer close(out)
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			out <- stan
+		case stan := <-rm.toServer:
+			out <- stan
+		}
+	}
+}
+
+// Handles presence from the room. Returns false if it isn't about an
+// occupant.
+func (r *Room) presence(p *xmpp.Presence) bool {
+	nick := p.From.Resource()
+	if nick == "" {
+		return false
+	}
+	ev := Event{Nick: nick, Presence: p}
+	x := p.MucUser()
+	if x != nil && len(x.Items) > 0 {
+		ev.Item = x.Items[0]
+	}
+	r.lock.Lock()
+	ev.Self = nick == r.nick || (x != nil && x.HasStatus(110))
+	old, present := r.occupants[nick]
+	switch p.Type {
+	case "error":
+		if !ev.Self {
+			r.lock.Unlock()
+			return false
+		}
+		r.lock.Unlock()
+		ev.Type = EventError
+		r.push(ev)
+		r.mgr.remove(r)
+		return true
+	case "unavailable":
+		delete(r.occupants, nick)
+		if x != nil && x.HasStatus(303) {
+			ev.Type = EventNick
+			ev.NewNick = ev.Item.Nick
+			r.renamed[ev.NewNick] = old
+			if ev.Self {
+				r.nick = ev.NewNick
+			}
+		} else {
+			ev.Type = EventLeave
+		}
+	case "":
+		r.occupants[nick] = ev.Item
+		if ev.Self {
+			r.nick = nick
+		}
+		if item, ok := r.renamed[nick]; ok {
+			delete(r.renamed, nick)
+			old, present = item, true
+		}
+		switch {
+		case !present:
+			ev.Type = EventJoin
+		case old.Role != ev.Item.Role ||
+			old.Affiliation != ev.Item.Affiliation:
+			ev.Type = EventRole
+		default:
+			// Just a change of status.
+			r.lock.Unlock()
+			return true
+		}
+	default:
+		r.lock.Unlock()
+		return false
+	}
+	r.lock.Unlock()
+	r.push(ev)
+	if ev.Type == EventLeave && ev.Self {
+		r.mgr.remove(r)
+	}
+	return true
+}
+
+// Handles a message from the room. Returns false if it isn't a
+// groupchat message.
+func (r *Room) message(m *xmpp.Message) bool {
+	if m.Type != "groupchat" {
+		return false
+	}
+	ev := Event{Nick: m.From.Resource(), Message: m}
+	r.mgr.lock.Lock()
+	cl := r.mgr.cl
+	r.mgr.lock.Unlock()
+	r.lock.Lock()
+	ev.Self = ev.Nick != "" && ev.Nick == r.nick
+	if len(m.Subject) > 0 && len(m.Body) == 0 {
+		ev.Type = EventSubject
+		ev.Subject = text(cl, &m.Header, m.Subject)
+		r.subject = ev.Subject
+	} else {
+		ev.Type = EventMessage
+		ev.Body = text(cl, &m.Header, m.Body)
+	}
+	r.lock.Unlock()
+	r.push(ev)
+	return true
+}
+
+// Chooses among the texts as cl.Text does, or before the manager has
+// been given the client, as xmpp.BestText does without preferences.
+func text(cl *xmpp.Client, h *xmpp.Header, texts []xmpp.Text) string {
+	if cl == nil {
+		return xmpp.BestText(texts, h.Lang)
+	}
+	return cl.Text(h, texts)
+}
+
+func (r *Room) send(st xmpp.Stanza) {
+	select {
+	case r.mgr.toServer <- st:
+	case <-r.mgr.done:
+	}
+}
+
+// Returns our nick in the room.
+func (r *Room) Nick() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.nick
+}
+
+// Returns the room's current subject.
+func (r *Room) Subject() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.subject
+}
+
+// Returns the room's occupants, by nick.
+func (r *Room) Occupants() map[string]xmpp.MucItem {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	occ := make(map[string]xmpp.MucItem)
+	for nick, item := range r.occupants {
+		occ[nick] = item
+	}
+	return occ
+}
+
+// Sends a message to everyone in the room, and returns its id. The
+// room echoes it back as a message event with Self set.
+func (r *Room) SendMessage(body string) string {
+	msg := &xmpp.Message{Header: xmpp.Header{To: r.Jid, Type: "groupchat",
+		Id: xmpp.NextId()}, Body: []xmpp.Text{{Chardata: body}}}
+	r.send(msg)
+	return msg.Id
+}
+
+// Asks the room to change its subject.
+func (r *Room) SetSubject(subject string) {
+	msg := &xmpp.Message{Header: xmpp.Header{To: r.Jid, Type: "groupchat",
+		Id: xmpp.NextId()}, Subject: []xmpp.Text{{Chardata: subject}}}
+	r.send(msg)
+}
+
+// Asks the room to change our nick. The change takes effect when
+// the room reports it with a nick event.
+func (r *Room) ChangeNick(nick string) {
+	to := xmpp.JID(string(r.Jid) + "/" + nick)
+	r.send(&xmpp.Presence{Header: xmpp.Header{To: to, Id: xmpp.NextId()}})
+}
+
+// Leaves the room. The last event is a leave with Self set.
+func (r *Room) Leave() {
+	r.send(xmpp.MucLeavePresence(r.Jid, r.Nick()))
+}
+
+// An occupant's request for voice in a moderated room, passed on to
+// the room's moderators.
+type VoiceRequest struct {
+	Room *Room
+	// The occupant's real JID, if the room discloses it.
+	Jid  xmpp.JID
+	Nick string
+	// The stanza the request was taken from.
+	Message *xmpp.Message
+}
+
+// Asks the room for voice, and so the right to send messages, in a
+// moderated room. The moderators decide whether to grant it.
+func (r *Room) RequestVoice() {
+	form := forms.NewSubmit(xmpp.NsMucRequest,
+		map[string]string{"muc#role": "participant"})
+	r.send(&xmpp.Message{Header: xmpp.Header{To: r.Jid, Id: xmpp.NextId(),
+		Nested: []interface{}{form}}})
+}
+
+// Handles a voice request passed on by the room. Returns false if the
+// message isn't one.
+func (r *Room) voiceRequest(m *xmpp.Message) bool {
+	var form *forms.Form
+	for _, ele := range m.Nested {
+		if f, ok := ele.(*forms.Form); ok && f.Type == "form" {
+			if v := f.Values("FORM_TYPE"); len(v) > 0 &&
+				v[0] == xmpp.NsMucRequest {
+				form = f
+			}
+		}
+	}
+	if form == nil {
+		return false
+	}
+	f := r.mgr.OnVoiceRequest
+	if f == nil {
+		return false
+	}
+	req := &VoiceRequest{Room: r, Message: m}
+	if v := form.Values("muc#jid"); len(v) > 0 {
+		req.Jid = xmpp.JID(v[0])
+	}
+	if v := form.Values("muc#roomnick"); len(v) > 0 {
+		req.Nick = v[0]
+	}
+	go f(req)
+	return true
+}
+
+func (req *VoiceRequest) answer(allow bool) {
+	vals := map[string]string{"muc#role": "participant",
+		"muc#roomnick":      req.Nick,
+		"muc#request_allow": strconv.FormatBool(allow)}
+	if req.Jid != "" {
+		vals["muc#jid"] = string(req.Jid)
+	}
+	form := forms.NewSubmit(xmpp.NsMucRequest, vals)
+	req.Room.send(&xmpp.Message{Header: xmpp.Header{To: req.Room.Jid, Id: xmpp.NextId(),
+		Nested: []interface{}{form}}})
+}
+
+// Grants the occupant voice.
+func (req *VoiceRequest) Approve() {
+	req.answer(true)
+}
+
+// Refuses the occupant voice.
+func (req *VoiceRequest) Deny() {
+	req.answer(false)
+}
@@ -0,0 +1,198 @@
+package muc
+
+import (
+	".."
+	"../forms"
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func assertEquals(t *testing.T, expected, observed string) {
+	t.Helper()
+	if expected != observed {
+		t.Errorf("expected:\n%s\nobserved:\n%s", expected, observed)
+	}
+}
+
+func TestManager(t *testing.T) {
+	rm := NewManager()
+	recvIn := make(chan xmpp.Stanza)
+	recvOut := make(chan xmpp.Stanza)
+	go rm.RecvFilter(recvIn, recvOut)
+	sendIn := make(chan xmpp.Stanza)
+	sendOut := make(chan xmpp.Stanza)
+	go rm.SendFilter(sendIn, sendOut)
+	defer close(sendIn)
+
+	rooms := make(chan *Room)
+	go func() { rooms <- rm.Join("room@muc/x", "me", "") }()
+	join := (<-sendOut).(*xmpp.Presence)
+	assertEquals(t, "room@muc/me", string(join.To))
+	r := <-rooms
+	if !rm.Owns("room@muc/y") {
+		t.Error("joined room not owned")
+	}
+
+	occupant := func(nick, role string, typ string,
+		codes ...int) *xmpp.Presence {
+		x := &xmpp.MucUserX{Items: []xmpp.MucItem{{Affiliation: "none",
+			Role: role}}}
+		for _, c := range codes {
+			x.Status = append(x.Status, xmpp.MucStatus{Code: c})
+		}
+		return &xmpp.Presence{Header: xmpp.Header{From: xmpp.JID("room@muc/" + nick),
+			Type: typ, Nested: []interface{}{x}}}
+	}
+
+	recvIn <- occupant("al", "participant", "")
+	recvIn <- occupant("me", "participant", "", 110)
+	ev := <-r.Events
+	if ev.Type != EventJoin || ev.Nick != "al" || ev.Self {
+		t.Errorf("bad event %#v", ev)
+	}
+	ev = <-r.Events
+	if ev.Type != EventJoin || !ev.Self {
+		t.Errorf("bad event %#v", ev)
+	}
+
+	recvIn <- &xmpp.Message{Header: xmpp.Header{From: "room@muc/al",
+		Type: "groupchat"}, Subject: []xmpp.Text{{Chardata: "Topic"}}}
+	ev = <-r.Events
+	if ev.Type != EventSubject || ev.Subject != "Topic" {
+		t.Errorf("bad event %#v", ev)
+	}
+	assertEquals(t, "Topic", r.Subject())
+
+	recvIn <- &xmpp.Message{Header: xmpp.Header{From: "room@muc/al",
+		Type: "groupchat"}, Body: []xmpp.Text{{Chardata: "hi"}}}
+	ev = <-r.Events
+	if ev.Type != EventMessage || ev.Body != "hi" || ev.Nick != "al" {
+		t.Errorf("bad event %#v", ev)
+	}
+
+	// Al changes nick and then gets voice.
+	p := occupant("al", "participant", "unavailable", 303)
+	p.MucUser().Items[0].Nick = "bo"
+	recvIn <- p
+	recvIn <- occupant("bo", "participant", "")
+	recvIn <- occupant("bo", "moderator", "")
+	ev = <-r.Events
+	if ev.Type != EventNick || ev.Nick != "al" || ev.NewNick != "bo" {
+		t.Errorf("bad event %#v", ev)
+	}
+	ev = <-r.Events
+	if ev.Type != EventRole || ev.Nick != "bo" ||
+		ev.Item.Role != "moderator" {
+		t.Errorf("bad event %#v", ev)
+	}
+
+	// Not from a joined room.
+	other := &xmpp.Message{Header: xmpp.Header{From: "other@muc/x",
+		Type: "groupchat"}}
+	recvIn <- other
+	if st := <-recvOut; st != other {
+		t.Errorf("got %v", st)
+	}
+
+	// The filter doesn't wait for the events to be read.
+	for i := 0; i < 40; i++ {
+		recvIn <- &xmpp.Message{Header: xmpp.Header{From: "room@muc/bo",
+			Type: "groupchat"}, Body: []xmpp.Text{{Chardata: "hi"}}}
+	}
+	for i := 0; i < 40; i++ {
+		if ev := <-r.Events; ev.Type != EventMessage || ev.Body != "hi" {
+			t.Errorf("bad event %#v", ev)
+		}
+	}
+
+	go r.SendMessage("hello")
+	msg := (<-sendOut).(*xmpp.Message)
+	assertEquals(t, "room@muc", string(msg.To))
+	assertEquals(t, "groupchat", msg.Type)
+
+	go r.Leave()
+	leave := (<-sendOut).(*xmpp.Presence)
+	assertEquals(t, "room@muc/me", string(leave.To))
+	recvIn <- occupant("me", "none", "unavailable", 110)
+	ev = <-r.Events
+	if ev.Type != EventLeave || !ev.Self {
+		t.Errorf("bad event %#v", ev)
+	}
+	if _, ok := <-r.Events; ok {
+		t.Errorf("events not closed")
+	}
+	if len(rm.Rooms()) != 0 || rm.Owns("room@muc") {
+		t.Errorf("room not forgotten")
+	}
+	close(recvIn)
+	for _ = range recvOut {
+	}
+}
+
+func TestRoomVoiceRequest(t *testing.T) {
+	rm := NewManager()
+	reqs := make(chan *VoiceRequest)
+	rm.OnVoiceRequest = func(req *VoiceRequest) { reqs <- req }
+	recvIn := make(chan xmpp.Stanza)
+	recvOut := make(chan xmpp.Stanza)
+	go rm.RecvFilter(recvIn, recvOut)
+	sendIn := make(chan xmpp.Stanza)
+	sendOut := make(chan xmpp.Stanza)
+	go rm.SendFilter(sendIn, sendOut)
+	defer close(sendIn)
+
+	rooms := make(chan *Room)
+	go func() { rooms <- rm.Join("room@muc", "mod", "") }()
+	<-sendOut
+	r := <-rooms
+
+	go r.RequestVoice()
+	m := (<-sendOut).(*xmpp.Message)
+	form := m.Nested[0].(*forms.Form)
+	assertEquals(t, "participant", form.Values("muc#role")[0])
+
+	form = &forms.Form{Type: "form", Fields: []forms.Field{
+		{Var: "FORM_TYPE", Values: []string{xmpp.NsMucRequest}},
+		{Var: "muc#jid", Values: []string{"al@b/c"}},
+		{Var: "muc#roomnick", Values: []string{"al"}}}}
+	recvIn <- &xmpp.Message{Header: xmpp.Header{From: "room@muc",
+		Nested: []interface{}{form}}}
+	req := <-reqs
+	assertEquals(t, "al@b/c", string(req.Jid))
+	assertEquals(t, "al", req.Nick)
+	go req.Approve()
+	m = (<-sendOut).(*xmpp.Message)
+	assertEquals(t, "room@muc", string(m.To))
+	form = m.Nested[0].(*forms.Form)
+	assertEquals(t, "submit", form.Type)
+	assertEquals(t, "true", form.Values("muc#request_allow")[0])
+	assertEquals(t, "al", form.Values("muc#roomnick")[0])
+
+	close(recvIn)
+	for _ = range recvOut {
+	}
+}
+
+func TestRoomJoinHistory(t *testing.T) {
+	since := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, c := range []struct {
+		history *History
+		want    string
+	}{
+		{nil, `<x xmlns="http://jabber.org/protocol/muc"></x>`},
+		{&History{None: true}, `<x xmlns="http://jabber.org/protocol/muc">` +
+			`<history maxstanzas="0"></history></x>`},
+		{&History{MaxStanzas: 20, Since: since},
+			`<x xmlns="http://jabber.org/protocol/muc">` +
+				`<history maxstanzas="20" since="2020-01-02T03:04:05Z">` +
+				`</history></x>`},
+	} {
+		p := xmpp.MucJoinPresence("room@muc", "me", "", c.history.muc())
+		buf, err := xml.Marshal(p.Nested[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEquals(t, c.want, string(buf))
+	}
+}
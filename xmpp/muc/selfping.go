@@ -0,0 +1,95 @@
+package muc
+
+// This file contains MUC Self-Ping, XEP-0410: finding out whether
+// we're still in the rooms we joined, and joining them again if not.
+
+import (
+	".."
+	"context"
+	"time"
+)
+
+// Pings the rooms which have been quiet, until the session ends.
+func (rm *Manager) selfPing() {
+	tick := time.NewTicker(rm.SelfPing)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-rm.done:
+			return
+		}
+		for _, r := range rm.Rooms() {
+			r.lock.Lock()
+			quiet := !r.pinging && time.Since(r.heard) >= rm.SelfPing
+			if quiet {
+				r.pinging = true
+			}
+			r.lock.Unlock()
+			if quiet {
+				go r.ping()
+			}
+		}
+	}
+}
+
+// Pings our own occupant, and joins the room again if it says we
+// aren't in it.
+func (r *Room) ping() {
+	defer func() {
+		r.lock.Lock()
+		r.pinging = false
+		r.lock.Unlock()
+	}()
+	to := xmpp.JID(string(r.Jid) + "/" + r.Nick())
+	_, err := r.mgr.iq(context.Background(), &xmpp.Iq{
+		Header: xmpp.Header{To: to, Type: "get",
+			Nested: []interface{}{&xmpp.Ping{}}}})
+	if !selfPingLost(err) {
+		return
+	}
+	select {
+	case r.mgr.lost <- r:
+	case <-r.mgr.done:
+		return
+	}
+	r.lock.Lock()
+	join := *r.join
+	join.To = to
+	heard := r.heard
+	r.lock.Unlock()
+	r.send(xmpp.MucRejoinPresence(&join, heard))
+}
+
+// Does the answer to a self-ping say we're no longer in the room? A
+// result says we are, and so do errors which say that our client
+// doesn't answer pings, or that our nick is changing. Errors reaching
+// the room, like no answer at all, say nothing either way.
+func selfPingLost(err error) bool {
+	er, ok := err.(*xmpp.Error)
+	if !ok || er == nil {
+		return false
+	}
+	switch er.Condition() {
+	case xmpp.CondServiceUnavailable, xmpp.CondFeatureNotImplemented,
+		xmpp.CondItemNotFound, xmpp.CondRemoteServerNotFound,
+		xmpp.CondRemoteServerTimeout:
+		return false
+	}
+	return true
+}
+
+// Forgets who was in a room we've been found not to be in, so that
+// joining it again reports everyone's joins, ours included.
+func (rm *Manager) disconnected(r *Room) {
+	if rm.room(r.Jid) != r {
+		return
+	}
+	r.lock.Lock()
+	nick := r.nick
+	r.occupants = make(map[string]xmpp.MucItem)
+	r.renamed = make(map[string]xmpp.MucItem)
+	r.lock.Unlock()
+	r.push(Event{Type: EventDisconnected, Nick: nick,
+		Self: true})
+}
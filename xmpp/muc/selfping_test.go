@@ -0,0 +1,100 @@
+package muc
+
+import (
+	".."
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRoomSelfPing(t *testing.T) {
+	rm := NewManager()
+	rm.SelfPing = 10 * time.Millisecond
+	pings := make(chan *xmpp.Iq)
+	answers := make(chan *xmpp.Error)
+	recvIn := make(chan xmpp.Stanza)
+	recvOut := make(chan xmpp.Stanza, 10)
+	go rm.RecvFilter(recvIn, recvOut)
+	defer close(recvIn)
+	sendIn := make(chan xmpp.Stanza)
+	sendOut := make(chan xmpp.Stanza)
+	go rm.SendFilter(sendIn, sendOut)
+	defer close(sendIn)
+	rm.sendIq = func(ctx context.Context, iq *xmpp.Iq) (*xmpp.Iq, error) {
+		pings <- iq
+		reply := &xmpp.Iq{Header: xmpp.Header{From: iq.To, Id: iq.Id,
+			Type: "result"}}
+		if er := <-answers; er != nil {
+			reply.Type = "error"
+			reply.Error = er
+			return reply, er
+		}
+		return reply, nil
+	}
+	go rm.selfPing()
+
+	rooms := make(chan *Room)
+	go func() {
+		rooms <- rm.JoinRoom("room@muc", "me", Options{
+			History: &History{MaxStanzas: 5}})
+	}()
+	<-sendOut
+	r := <-rooms
+	self := &xmpp.Presence{Header: xmpp.Header{From: "room@muc/me",
+		Nested: []interface{}{&xmpp.MucUserX{Items: []xmpp.MucItem{{
+			Role: "participant"}}}}}}
+	recvIn <- self
+	if ev := <-r.Events; ev.Type != EventJoin || !ev.Self {
+		t.Fatalf("bad event %#v", ev)
+	}
+
+	// Answers the next self-ping.
+	pong := func(er *xmpp.Error) {
+		iq := <-pings
+		assertEquals(t, "room@muc/me", string(iq.To))
+		if _, ok := iq.Nested[0].(*xmpp.Ping); !ok {
+			t.Fatalf("not a ping: %#v", iq)
+		}
+		answers <- er
+	}
+	// Still joined, though our client doesn't answer pings.
+	pong(xmpp.NewError("", xmpp.CondServiceUnavailable, ""))
+	pong(nil)
+	// No longer joined.
+	pong(xmpp.NewError("", xmpp.CondNotAcceptable, ""))
+	if ev := <-r.Events; ev.Type != EventDisconnected || !ev.Self ||
+		ev.Nick != "me" {
+		t.Fatalf("bad event %#v", ev)
+	}
+	join := (<-sendOut).(*xmpp.Presence)
+	assertEquals(t, "room@muc/me", string(join.To))
+	mj := join.Nested[0].(*xmpp.MucJoin)
+	if mj.History == nil || mj.History.Since == "" {
+		t.Errorf("history %+v", mj.History)
+	}
+	recvIn <- self
+	if ev := <-r.Events; ev.Type != EventJoin || !ev.Self {
+		t.Fatalf("bad event %#v", ev)
+	}
+	if len(r.Occupants()) != 1 {
+		t.Errorf("occupants %v", r.Occupants())
+	}
+}
+
+func TestSelfPingLost(t *testing.T) {
+	for cond, lost := range map[string]bool{
+		xmpp.CondServiceUnavailable:    false,
+		xmpp.CondFeatureNotImplemented: false,
+		xmpp.CondItemNotFound:          false,
+		xmpp.CondRemoteServerTimeout:   false,
+		xmpp.CondNotAcceptable:         true,
+		xmpp.CondBadRequest:            true,
+	} {
+		if selfPingLost(xmpp.NewError("", cond, "")) != lost {
+			t.Errorf("%s: lost %v", cond, !lost)
+		}
+	}
+	if selfPingLost(nil) || selfPingLost(xmpp.ErrCallbackExpired) {
+		t.Errorf("lost without an error from the room")
+	}
+}
@@ -0,0 +1,262 @@
+package xmpp
+
+// This file contains a service which picks human-readable names for
+// JIDs.
+
+import (
+	"context"
+	"sync"
+)
+
+// The places a display name can come from.
+type NameSource int
+
+const (
+	// The name the user gave the contact in their roster.
+	NameRoster NameSource = iota
+	// The nickname the contact asserts, XEP-0172.
+	NameNick
+	// The full name in the contact's vCard, XEP-0054.
+	NameVCard
+	// The contact's nick in a multi-user chat room.
+	NameMucNick
+)
+
+// Reports that the display name of a JID changed.
+type NameChange struct {
+	Jid  JID
+	Name string
+}
+
+// NameResolver is an extension which chooses the best display name
+// for a JID from the sources it knows about, in a configurable order
+// of preference. It learns roster names, nicknames, and room
+// occupants' nicks from the stanzas passing through it, and fetches
+// vCards when they're needed.
+type NameResolver struct {
+	Extension
+	// Changes to display names are reported here. If the
+	// application doesn't keep up, changes are discarded.
+	Changes  <-chan NameChange
+	changes  chan NameChange
+	priority []NameSource
+	lock     sync.Mutex
+	cl       *Client
+	roster   map[JID]string
+	nicks    map[JID]string
+	// vCard full names which have been fetched, including empty
+	// ones.
+	vcards   map[JID]string
+	rooms    map[JID]bool
+	resolved map[JID]string
+}
+
+// Creates a NameResolver, to be passed to NewClient among the
+// extensions. The sources are consulted in the given order; by
+// default, NameRoster, NameMucNick, NameNick, NameVCard.
+func NewNameResolver(priority ...NameSource) *NameResolver {
+	if len(priority) == 0 {
+		priority = []NameSource{NameRoster, NameMucNick, NameNick,
+			NameVCard}
+	}
+	nr := &NameResolver{priority: priority}
+	nr.changes = make(chan NameChange, 16)
+	nr.Changes = nr.changes
+	nr.roster = make(map[JID]string)
+	nr.nicks = make(map[JID]string)
+	nr.vcards = make(map[JID]string)
+	nr.rooms = make(map[JID]bool)
+	nr.resolved = make(map[JID]string)
+	nr.StanzaTypes = mergeStanzaTypes(NickExt, VCardExt, PubsubExt,
+		MucExt)
+	nr.RecvFilter = nr.recvFilter
+	// The client is needed before the roster arrives.
+	nr.BeforePresence = func(cl *Client) {
+		nr.lock.Lock()
+		nr.cl = cl
+		nr.lock.Unlock()
+	}
+	return nr
+}
+
+// Returns the display name for a JID. If no source has a name for
+// it, the node part of the JID (or the whole JID) is used. This may
+// block while a vCard is fetched.
+func (nr *NameResolver) Name(jid JID) string {
+	nr.lock.Lock()
+	name, needVCard := nr.resolve(jid)
+	cl := nr.cl
+	nr.lock.Unlock()
+	if !needVCard || cl == nil {
+		return nr.record(jid, name)
+	}
+	fn := ""
+	if vc, err := cl.VCard(context.Background(),
+		jid.Bare()); err == nil {
+		fn = vc.FN
+	}
+	nr.lock.Lock()
+	nr.vcards[jid.Bare()] = fn
+	name, _ = nr.resolve(jid)
+	nr.lock.Unlock()
+	return nr.record(jid, name)
+}
+
+// Remember a resolved name, announcing it if it changed. Returns the
+// name.
+func (nr *NameResolver) record(jid JID, name string) string {
+	nr.lock.Lock()
+	old, ok := nr.resolved[jid]
+	nr.resolved[jid] = name
+	nr.lock.Unlock()
+	if ok && old != name {
+		select {
+		case nr.changes <- NameChange{Jid: jid, Name: name}:
+		default:
+		}
+	}
+	return name
+}
+
+// Picks the best name from what's known so far. Also reports whether
+// a vCard should be fetched to do better. Must be called with the
+// lock held.
+func (nr *NameResolver) resolve(jid JID) (string, bool) {
+	needVCard := false
+	bare := jid.Bare()
+	occupant := nr.rooms[bare] && jid.Resource() != ""
+	for _, src := range nr.priority {
+		name := ""
+		switch src {
+		case NameRoster:
+			if !occupant {
+				name = nr.roster[bare]
+			}
+		case NameNick:
+			if occupant {
+				name = nr.nicks[jid]
+			} else {
+				name = nr.nicks[bare]
+			}
+		case NameVCard:
+			if occupant {
+				break
+			}
+			fn, ok := nr.vcards[bare]
+			if !ok {
+				needVCard = true
+			}
+			name = fn
+		case NameMucNick:
+			if occupant {
+				name = jid.Resource()
+			}
+		}
+		if name != "" {
+			return name, needVCard
+		}
+	}
+	if occupant {
+		return jid.Resource(), false
+	}
+	if node := jid.Node(); node != "" {
+		return node, needVCard
+	}
+	return string(jid), needVCard
+}
+
+// Re-resolve the names of JIDs which have been asked about, after a
+// source changed.
+func (nr *NameResolver) refresh() {
+	nr.lock.Lock()
+	var changes []NameChange
+	for jid, old := range nr.resolved {
+		name, needVCard := nr.resolve(jid)
+		if !needVCard && name != old {
+			nr.resolved[jid] = name
+			changes = append(changes, NameChange{jid, name})
+		}
+	}
+	nr.lock.Unlock()
+	for _, ch := range changes {
+		select {
+		case nr.changes <- ch:
+		default:
+		}
+	}
+}
+
+func (nr *NameResolver) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for stan := range in {
+		if nr.learn(stan) {
+			nr.refresh()
+		}
+		out <- stan
+	}
+}
+
+// Update the sources from a stanza. Returns true if anything changed.
+func (nr *NameResolver) learn(stan Stanza) bool {
+	nr.lock.Lock()
+	defer nr.lock.Unlock()
+	changed := false
+	set := func(m map[JID]string, jid JID, name string) {
+		if m[jid] != name {
+			m[jid] = name
+			changed = true
+		}
+	}
+	h := stan.GetHeader()
+	switch st := stan.(type) {
+	case *Iq:
+		// Only the user's own account may name contacts.
+		if h.From != "" && (nr.cl == nil || h.From != nr.cl.Jid.Bare()) {
+			break
+		}
+		for _, ele := range st.Nested {
+			rq, ok := ele.(*RosterQuery)
+			if !ok || (st.Type != "result" && st.Type != "set") {
+				continue
+			}
+			for _, item := range rq.Item {
+				if item.Subscription == "remove" {
+					delete(nr.roster, item.Jid)
+					changed = true
+				} else {
+					set(nr.roster, item.Jid, item.Name)
+				}
+			}
+		}
+	case *Message:
+		if st.Type == "groupchat" && !nr.rooms[h.From.Bare()] {
+			nr.rooms[h.From.Bare()] = true
+			changed = true
+		}
+		if ev := st.PubsubEvent(); ev != nil && ev.Items != nil &&
+			ev.Items.Node == NsNick {
+			for _, item := range ev.Items.Items {
+				var n UserNick
+				if item.Decode(&n) == nil {
+					set(nr.nicks, h.From.Bare(), n.Nick)
+				}
+			}
+		}
+	case *Presence:
+		for _, ele := range st.Nested {
+			if _, ok := ele.(*MucUserX); ok &&
+				!nr.rooms[h.From.Bare()] {
+				nr.rooms[h.From.Bare()] = true
+				changed = true
+			}
+		}
+	}
+	if nick, ok := h.Nick(); ok && nick != "" {
+		jid := h.From.Bare()
+		if nr.rooms[jid] {
+			jid = h.From
+		}
+		set(nr.nicks, jid, nick)
+	}
+	return changed
+}
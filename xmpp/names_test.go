@@ -0,0 +1,44 @@
+package xmpp
+
+import (
+	"testing"
+)
+
+func TestNameResolver(t *testing.T) {
+	nr := NewNameResolver(NameRoster, NameMucNick, NameNick)
+	in := make(chan Stanza)
+	out := make(chan Stanza)
+	go nr.RecvFilter(in, out)
+	defer close(in)
+	pass := func(st Stanza) {
+		in <- st
+		<-out
+	}
+
+	assertEquals(t, "alice", nr.Name("alice@example.com/x"))
+	pass(&Message{Header: Header{From: "alice@example.com/x",
+		Nested: []interface{}{&UserNick{Nick: "Ally"}}}})
+	assertEquals(t, "Ally", nr.Name("alice@example.com/x"))
+	ch := <-nr.Changes
+	assertEquals(t, "Ally", ch.Name)
+
+	pass(&Iq{Header: Header{Type: "set", Nested: []interface{}{
+		&RosterQuery{Item: []RosterItem{{Jid: "alice@example.com",
+			Name: "Alice A.", Subscription: "both"}}}}}})
+	assertEquals(t, "Alice A.", nr.Name("alice@example.com"))
+	// Only the user's own account names contacts.
+	nr.BeforePresence(&Client{Jid: "me@example.com/r"})
+	pass(&Iq{Header: Header{From: "mallory@evil.example", Type: "set",
+		Nested: []interface{}{&RosterQuery{Item: []RosterItem{{
+			Jid: "alice@example.com", Name: "Boss"}}}}}})
+	assertEquals(t, "Alice A.", nr.Name("alice@example.com"))
+	pass(&Iq{Header: Header{From: "me@example.com", Type: "set",
+		Nested: []interface{}{&RosterQuery{Item: []RosterItem{{
+			Jid: "alice@example.com", Name: "Alice"}}}}}})
+	assertEquals(t, "Alice", nr.Name("alice@example.com"))
+
+	pass(&Presence{Header: Header{From: "room@muc/Bob",
+		Nested: []interface{}{&MucUserX{}}}})
+	assertEquals(t, "Bob", nr.Name("room@muc/Bob"))
+	assertEquals(t, "example.com", nr.Name("example.com"))
+}
@@ -0,0 +1,37 @@
+package xmpp
+
+// This file contains support for user nicknames, XEP-0172.
+
+import (
+	"encoding/xml"
+	"reflect"
+)
+
+const NsNick = "http://jabber.org/protocol/nick"
+
+// The nickname a user asserts for themselves. It may be included in
+// presence subscription requests and messages, or published in PEP.
+type UserNick struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/nick nick"`
+	Nick    string   `xml:",chardata"`
+}
+
+// NickExt may be included in the extensions passed to NewClient to
+// decode nicknames in incoming stanzas.
+var NickExt Extension = Extension{}
+
+func init() {
+	NickExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	nName := xml.Name{Space: NsNick, Local: "nick"}
+	NickExt.StanzaTypes[nName] = reflect.TypeOf(UserNick{})
+}
+
+// Returns the nickname included in a stanza, if any.
+func (h *Header) Nick() (string, bool) {
+	for _, ele := range h.Nested {
+		if n, ok := ele.(*UserNick); ok {
+			return n.Nick, true
+		}
+	}
+	return "", false
+}
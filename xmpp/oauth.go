@@ -0,0 +1,72 @@
+package xmpp
+
+// This file contains authentication with OAuth 2.0 access tokens,
+// using the OAUTHBEARER SASL mechanism of RFC 7628 or the older
+// X-OAUTH2.
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+// Supplies an OAuth 2.0 access token. It's called each time the
+// client authenticates, including when it reconnects, so it can
+// refresh the token as needed.
+type TokenProvider func(ctx context.Context) (string, error)
+
+// How long a TokenProvider may take.
+const tokenTimeout = 30 * time.Second
+
+// Returns an extension which makes the client authenticate with an
+// access token from the given provider, instead of the password, if
+// the server offers OAUTHBEARER or X-OAUTH2. Otherwise the password
+// mechanisms are used as usual.
+func OAuthExt(tokens TokenProvider) Extension {
+	return Extension{option: func(o *options) {
+		o.tokens = tokens
+	}}
+}
+
+// Authenticates with a token, if we have a provider and the server
+// offers a mechanism for it. Returns false if it didn't try.
+func (cl *Client) startOAuth(offered map[string]bool) bool {
+	var mech string
+	switch {
+	case cl.opts.tokens == nil:
+		return false
+	case offered["OAUTHBEARER"]:
+		mech = "OAUTHBEARER"
+	case offered["X-OAUTH2"]:
+		mech = "X-OAUTH2"
+	default:
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tokenTimeout)
+	defer cancel()
+	token, err := cl.opts.tokens(ctx)
+	if err != nil {
+		cl.setError(fmt.Errorf("SASL: getting token: %v", err))
+		return true
+	}
+	user := cl.Jid.Bare()
+	var raw string
+	if mech == "OAUTHBEARER" {
+		raw = "n,a=" + gs2Name(string(user)) + "," +
+			"\x01auth=Bearer " + token + "\x01\x01"
+	} else {
+		raw = "\x00" + string(user) + "\x00" + token
+	}
+	cl.saslMech = mech
+	cl.saslAuth(mech, base64.StdEncoding.EncodeToString([]byte(raw)))
+	return true
+}
+
+// A challenge to OAUTHBEARER carries an error. The client must
+// answer with a lone ^A, and then the server reports failure. RFC
+// 7628, section 3.2.3.
+func (cl *Client) oauthChallenge() {
+	cl.sendRaw <- cl.saslElement("response",
+		base64.StdEncoding.EncodeToString([]byte("\x01")))
+}
@@ -0,0 +1,141 @@
+package xmpp
+
+// This file contains support for flexible offline message retrieval,
+// XEP-0013, which lets a client look through the messages stored
+// while it was offline and fetch them selectively.
+
+import (
+	"context"
+	"encoding/xml"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+const NsOffline = "http://jabber.org/protocol/offline"
+
+// A request to act on stored messages, or the marker on a message
+// delivered from the store. Each item identifies a message by its
+// node.
+type Offline struct {
+	XMLName xml.Name      `xml:"http://jabber.org/protocol/offline offline"`
+	Items   []OfflineItem `xml:"item"`
+	Fetch   *OfflineFlag  `xml:"fetch"`
+	Purge   *OfflineFlag  `xml:"purge"`
+}
+
+// Action is view or remove in requests.
+type OfflineItem struct {
+	Action string `xml:"action,attr,omitempty"`
+	Node   string `xml:"node,attr"`
+}
+
+type OfflineFlag struct{}
+
+// Describes a stored message, without fetching it.
+type OfflineHeader struct {
+	Node string
+	From JID
+}
+
+// OfflineExt may be included in the extensions passed to NewClient to
+// use flexible offline message retrieval. Before the initial presence
+// is sent, it queries the server's features, which tells a server
+// supporting XEP-0013 not to flood the client with stored messages.
+// They're left for the application to fetch with OfflineView or
+// OfflineFetch.
+var OfflineExt Extension = Extension{}
+
+func init() {
+	OfflineExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	oName := xml.Name{Space: NsOffline, Local: "offline"}
+	OfflineExt.StanzaTypes[oName] = reflect.TypeOf(Offline{})
+	for k, v := range DiscoExt.StanzaTypes {
+		OfflineExt.StanzaTypes[k] = v
+	}
+	OfflineExt.BeforePresence = func(cl *Client) {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			10*time.Second)
+		defer cancel()
+		cl.DiscoInfo(ctx, JID(cl.Jid.Domain()), "")
+	}
+}
+
+// Returns the node of a message delivered from the offline store, if
+// it was requested with OfflineView.
+func (m *Message) OfflineNode() (string, bool) {
+	for _, ele := range m.Nested {
+		if o, ok := ele.(*Offline); ok && len(o.Items) > 0 {
+			return o.Items[0].Node, true
+		}
+	}
+	return "", false
+}
+
+// Returns the number of messages in the offline store.
+func (cl *Client) OfflineCount(ctx context.Context) (int, error) {
+	di, err := cl.DiscoInfo(ctx, cl.Jid.Bare(), NsOffline)
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range di.Forms {
+		if v := f.Values("number_of_messages"); len(v) > 0 {
+			return strconv.Atoi(v[0])
+		}
+	}
+	return 0, nil
+}
+
+// Lists the messages in the offline store.
+func (cl *Client) OfflineHeaders(ctx context.Context) ([]OfflineHeader,
+	error) {
+
+	items, err := cl.DiscoItems(ctx, cl.Jid.Bare(), NsOffline)
+	if err != nil {
+		return nil, err
+	}
+	var hdrs []OfflineHeader
+	for _, it := range items.Items {
+		hdrs = append(hdrs, OfflineHeader{Node: it.Node,
+			From: JID(it.Name)})
+	}
+	return hdrs, nil
+}
+
+func (cl *Client) offline(ctx context.Context, typ string,
+	off *Offline) error {
+
+	iq := &Iq{Header: Header{Type: typ, Nested: []interface{}{off}}}
+	_, err := cl.SendIq(ctx, iq)
+	return err
+}
+
+func offlineItems(action string, nodes []string) *Offline {
+	off := &Offline{}
+	for _, n := range nodes {
+		off.Items = append(off.Items, OfflineItem{Action: action, Node: n})
+	}
+	return off
+}
+
+// Asks the server to deliver the given stored messages. They arrive
+// on Client.Recv, and stay in the store until removed.
+func (cl *Client) OfflineView(ctx context.Context, nodes ...string) error {
+	return cl.offline(ctx, "get", offlineItems("view", nodes))
+}
+
+// Removes the given messages from the offline store.
+func (cl *Client) OfflineRemove(ctx context.Context, nodes ...string) error {
+	return cl.offline(ctx, "set", offlineItems("remove", nodes))
+}
+
+// Asks the server to deliver every stored message. They stay in the
+// store until removed.
+func (cl *Client) OfflineFetch(ctx context.Context) error {
+	return cl.offline(ctx, "get", &Offline{Fetch: &OfflineFlag{}})
+}
+
+// Removes every message from the offline store.
+func (cl *Client) OfflinePurge(ctx context.Context) error {
+	return cl.offline(ctx, "set", &Offline{Purge: &OfflineFlag{}})
+}
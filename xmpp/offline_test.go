@@ -0,0 +1,45 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestOfflineMarshal(t *testing.T) {
+	assertMarshal(t, `<offline xmlns="`+NsOffline+`"><item action="view"`+
+		` node="n1"></item><item action="view" node="n2"></item>`+
+		`</offline>`, offlineItems("view", []string{"n1", "n2"}))
+	assertMarshal(t, `<offline xmlns="`+NsOffline+`"><purge></purge>`+
+		`</offline>`, &Offline{Purge: &OfflineFlag{}})
+}
+
+func TestOfflineUnmarshal(t *testing.T) {
+	str := `<message xmlns="jabber:client" from="a@b/c"><body>hi</body>` +
+		`<offline xmlns="` + NsOffline + `"><item node="n1"/>` +
+		`</offline></message>`
+	var m Message
+	if err := xml.Unmarshal([]byte(str), &m); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if err := parseExtended(&m.Header, OfflineExt.StanzaTypes); err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	node, ok := m.OfflineNode()
+	if !ok {
+		t.Fatalf("no offline node")
+	}
+	assertEquals(t, "n1", node)
+
+	str = `<query xmlns="` + NsDiscoInfo + `" node="` + NsOffline + `">` +
+		`<x xmlns="jabber:x:data" type="result"><field var="FORM_TYPE">` +
+		`<value>` + NsOffline + `</value></field><field ` +
+		`var="number_of_messages"><value>66</value></field></x></query>`
+	var di DiscoInfo
+	if err := xml.Unmarshal([]byte(str), &di); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(di.Forms) != 1 {
+		t.Fatalf("forms: %v", di.Forms)
+	}
+	assertEquals(t, "66", di.Forms[0].Values("number_of_messages")[0])
+}
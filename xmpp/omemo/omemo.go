@@ -0,0 +1,804 @@
+// This package implements OMEMO encryption, XEP-0384, for one-to-one
+// messages, on top of the xmpp package. The key agreement and ratchet
+// are left to a backend; this publishes the device's keys with PEP,
+// keeps track of contacts' devices, and encrypts and decrypts the
+// messages themselves.
+package omemo
+
+// This file contains the protocol elements, the payload encryption,
+// and the Manager extension.
+
+import (
+	".."
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NsOmemo   = "urn:xmpp:omemo:2"
+	NsDevices = "urn:xmpp:omemo:2:devices"
+	NsBundles = "urn:xmpp:omemo:2:bundles"
+)
+
+// The list of devices a user has OMEMO keys for.
+type Devices struct {
+	XMLName xml.Name `xml:"urn:xmpp:omemo:2 devices"`
+	Devices []Device `xml:"device"`
+}
+
+type Device struct {
+	Id    uint32 `xml:"id,attr"`
+	Label string `xml:"label,attr,omitempty"`
+}
+
+// Binary data, which is base64-encoded in XML.
+type Data []byte
+
+func (d Data) MarshalText() ([]byte, error) {
+	buf := make([]byte, base64.StdEncoding.EncodedLen(len(d)))
+	base64.StdEncoding.Encode(buf, d)
+	return buf, nil
+}
+
+func (d *Data) UnmarshalText(text []byte) error {
+	buf, err := base64.StdEncoding.DecodeString(
+		strings.Join(strings.Fields(string(text)), ""))
+	if err != nil {
+		return err
+	}
+	*d = buf
+	return nil
+}
+
+// The public keys of a device, which others use to start sessions
+// with it: the signed prekey and its signature, the identity key, and
+// the one-time prekeys.
+type Bundle struct {
+	XMLName xml.Name `xml:"urn:xmpp:omemo:2 bundle"`
+	Spk     PreKey   `xml:"spk"`
+	Spks    Data     `xml:"spks"`
+	Ik      Data     `xml:"ik"`
+	PreKeys []PreKey `xml:"prekeys>pk"`
+}
+
+type PreKey struct {
+	Id  uint32 `xml:"id,attr"`
+	Key Data   `xml:",chardata"`
+}
+
+// An encrypted message. The payload is encrypted once, and the key
+// for it is encrypted for each of the recipients' devices. A message
+// without a payload only carries keys, to set up or keep up sessions.
+type Encrypted struct {
+	XMLName xml.Name `xml:"urn:xmpp:omemo:2 encrypted"`
+	Header  Header   `xml:"header"`
+	Payload Data     `xml:"payload,omitempty"`
+}
+
+type Header struct {
+	// The device which sent the message.
+	Sid  uint32 `xml:"sid,attr"`
+	Keys []Keys `xml:"keys"`
+}
+
+// The keys for one recipient's devices.
+type Keys struct {
+	Jid  xmpp.JID `xml:"jid,attr"`
+	Keys []Key    `xml:"key"`
+}
+
+type Key struct {
+	Rid uint32 `xml:"rid,attr"`
+	// Set if the key starts a new session.
+	Kex  bool `xml:"kex,attr,omitempty"`
+	Data Data `xml:",chardata"`
+}
+
+// What the payload of an encrypted message decrypts to, XEP-0420.
+// The padding hides the length of the message.
+type envelope struct {
+	XMLName xml.Name     `xml:"urn:xmpp:sce:1 envelope"`
+	Content content      `xml:"content"`
+	Rpad    string       `xml:"rpad,omitempty"`
+	From    *xmpp.SceJid `xml:"from"`
+}
+
+type content struct {
+	Body []xmpp.Text `xml:"jabber:client body"`
+}
+
+// Attached to a message which was decrypted, saying which of the
+// sender's devices it came from. It isn't sent if the message is.
+type Info struct {
+	Device uint32
+}
+
+func (*Info) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return nil
+}
+
+// Returns how a message was decrypted, or nil if it wasn't.
+func MessageInfo(m *xmpp.Message) *Info {
+	for _, ele := range m.Nested {
+		if info, ok := ele.(*Info); ok {
+			return info
+		}
+	}
+	return nil
+}
+
+// The body of an encrypted message, for clients which can't read it.
+const fallback = "This message is encrypted with OMEMO, " +
+	"which your client doesn't seem to support."
+
+// Ext decodes encrypted messages, without decrypting them. A Manager
+// includes it.
+var Ext xmpp.Extension = xmpp.Extension{}
+
+func init() {
+	Ext.StanzaTypes = make(map[xml.Name]reflect.Type)
+	eName := xml.Name{Space: NsOmemo, Local: "encrypted"}
+	Ext.StanzaTypes[eName] = reflect.TypeOf(Encrypted{})
+}
+
+// Publishes the list of the user's OMEMO devices. It must be readable
+// by anyone who might send the user encrypted messages. A Manager
+// adds its own device to the list.
+func PublishDevices(ctx context.Context, cl *xmpp.Client,
+	devices ...Device) error {
+
+	return publishDevices(ctx, cl, devices)
+}
+
+func publishDevices(ctx context.Context, p pep, devices []Device) error {
+	item, err := xmpp.NewPubsubItem("current", &Devices{Devices: devices})
+	if err != nil {
+		return err
+	}
+	_, err = p.Publish(ctx, "", NsDevices, item, map[string]string{
+		"pubsub#access_model": xmpp.AccessOpen,
+		"pubsub#max_items":    "1"})
+	return err
+}
+
+// Derives the keys for a payload from the key which is sent to each
+// device.
+func payloadKeys(key []byte) (encKey, authKey, iv []byte, err error) {
+	out, err := hkdf.Key(sha256.New, key, make([]byte, 32),
+		"OMEMO Payload", 80)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return out[:32], out[32:64], out[64:], nil
+}
+
+// Encrypts a payload with a new key. Returns the ciphertext, and the
+// key material to be encrypted for each device: the key, and the
+// ciphertext's authentication tag.
+func seal(plaintext []byte) (payload, keyMaterial []byte, err error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	encKey, authKey, iv, err := payloadKeys(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	pad := aes.BlockSize - len(plaintext)%aes.BlockSize
+	payload = append(append([]byte(nil), plaintext...),
+		bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(payload, payload)
+	mac := hmac.New(sha256.New, authKey)
+	mac.Write(payload)
+	return payload, append(key, mac.Sum(nil)[:16]...), nil
+}
+
+// Authenticates and decrypts a payload with the key material sent to
+// this device.
+func open(payload, keyMaterial []byte) ([]byte, error) {
+	if len(keyMaterial) != 48 {
+		return nil, fmt.Errorf("OMEMO key material is %d bytes, not 48",
+			len(keyMaterial))
+	}
+	encKey, authKey, iv, err := payloadKeys(keyMaterial[:32])
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, authKey)
+	mac.Write(payload)
+	if !hmac.Equal(mac.Sum(nil)[:16], keyMaterial[32:]) {
+		return nil, errors.New("OMEMO payload fails authentication")
+	}
+	if len(payload) == 0 || len(payload)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("OMEMO payload of %d bytes", len(payload))
+	}
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	buf := append([]byte(nil), payload...)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(buf, buf)
+	pad := int(buf[len(buf)-1])
+	if pad == 0 || pad > aes.BlockSize ||
+		!bytes.Equal(buf[len(buf)-pad:],
+			bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, errors.New("bad padding in OMEMO payload")
+	}
+	return buf[:len(buf)-pad], nil
+}
+
+// Backend does the cryptography of OMEMO sessions for one of the
+// user's devices: X3DH key agreement from the other device's bundle,
+// and the Double Ratchet after that. It keeps the device's own keys
+// and the state of its sessions. It's called from several goroutines.
+type Backend interface {
+	// The id of this device, which is published in the
+	// user's device list.
+	DeviceId() uint32
+	// The public keys of this device, to be published.
+	Bundle() (*Bundle, error)
+	// Reports whether there's a session with another device.
+	HasSession(jid xmpp.JID, device uint32) bool
+	// Starts a session with another device, from its bundle.
+	StartSession(jid xmpp.JID, device uint32, bundle *Bundle) error
+	// Encrypts key material for a device there's a session with.
+	// Kex is set if the result is a key exchange message, as it
+	// should be until the device has answered.
+	Encrypt(jid xmpp.JID, device uint32, plaintext []byte) (ciphertext []byte,
+		kex bool, err error)
+	// Decrypts key material from another device. If kex is set,
+	// it's a key exchange message, which may start a new session
+	// and use up one of this device's prekeys.
+	Decrypt(jid xmpp.JID, device uint32, ciphertext []byte,
+		kex bool) ([]byte, error)
+}
+
+// A message which couldn't be encrypted, and so wasn't sent, or which
+// couldn't be decrypted.
+type Failure struct {
+	Message *xmpp.Message
+	// Set if the message was going out.
+	Outgoing bool
+	Err      error
+}
+
+// The PEP requests the manager makes, as a Client makes them.
+type pep interface {
+	PubsubItems(ctx context.Context, service xmpp.JID, node string,
+		ids ...string) ([]xmpp.PubsubItem, error)
+	Publish(ctx context.Context, service xmpp.JID, node string,
+		item xmpp.PubsubItem, options map[string]string) (string, error)
+}
+
+var errNotForDevice = errors.New("message isn't encrypted for this device")
+
+// Manager is an extension which encrypts the messages the client
+// sends to contacts who publish OMEMO devices, and decrypts the
+// encrypted messages it receives. Messages to contacts without
+// devices aren't sent, and are reported as failures, unless
+// AllowPlaintext is set. Once the session is running, the
+// backend's device is added to the user's device list and its bundle
+// is published.
+//
+// Messages are only encrypted if they're one-to-one ones with a
+// body; the body is all that's encrypted. Encryption may need to
+// fetch keys first, so encrypted messages can overtake other stanzas
+// sent after them. A decrypted message is delivered with its body
+// replaced, and with an Info among its Nested elements.
+type Manager struct {
+	xmpp.Extension
+	// Messages which couldn't be encrypted or decrypted are
+	// reported here. They're discarded if the channel isn't ready
+	// for them.
+	Failures <-chan *Failure
+	// If set, messages to contacts without devices go out as they
+	// are. It should be set before the client starts.
+	AllowPlaintext bool
+
+	failures chan *Failure
+	backend  Backend
+	toServer chan xmpp.Stanza
+	sendDone chan bool
+	wake     chan struct{}
+	lock     sync.Mutex
+	pep      pep
+	jid      xmpp.JID
+	// Messages waiting to be encrypted.
+	queue []*xmpp.Message
+	// The device lists of contacts, and of the user, by bare JID.
+	// A nil list means the JID has none, as of when it was checked.
+	devices map[xmpp.JID][]uint32
+	checked map[xmpp.JID]time.Time
+}
+
+// How long to believe that a JID has no devices, without a
+// notification saying otherwise, before looking again.
+var recheck = 10 * time.Minute
+
+var errNoDevices = errors.New("recipient has no OMEMO devices")
+
+// Creates a Manager for the backend's device, to be passed to
+// NewClient among the extensions.
+func NewManager(backend Backend) *Manager {
+	om := &Manager{backend: backend}
+	om.failures = make(chan *Failure, 16)
+	om.Failures = om.failures
+	om.toServer = make(chan xmpp.Stanza)
+	om.sendDone = make(chan bool)
+	om.wake = make(chan struct{}, 1)
+	om.devices = make(map[xmpp.JID][]uint32)
+	om.checked = make(map[xmpp.JID]time.Time)
+	om.StanzaTypes = make(map[xml.Name]reflect.Type)
+	for _, types := range []map[xml.Name]reflect.Type{Ext.StanzaTypes,
+		xmpp.PubsubExt.StanzaTypes} {
+		for name, typ := range types {
+			om.StanzaTypes[name] = typ
+		}
+	}
+	om.Features = []string{NsDevices + "+notify"}
+	om.RecvFilter = om.recvFilter
+	om.SendFilter = om.sendFilter
+	om.Start = func(cl *xmpp.Client) {
+		om.start(cl, cl.Jid)
+	}
+	return om
+}
+
+func (om *Manager) start(p pep, jid xmpp.JID) {
+	om.lock.Lock()
+	om.pep = p
+	om.jid = jid.Bare()
+	om.lock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		30*time.Second)
+	defer cancel()
+	om.PublishDevice(ctx)
+}
+
+// Returns the client's PEP requests and the user's bare JID.
+func (om *Manager) client() (pep, xmpp.JID, error) {
+	om.lock.Lock()
+	defer om.lock.Unlock()
+	if om.pep == nil {
+		return nil, "", errors.New("OMEMO manager not started")
+	}
+	return om.pep, om.jid, nil
+}
+
+// Adds this device to the user's device list, if it isn't there, and
+// publishes its bundle. This is done when the session starts.
+func (om *Manager) PublishDevice(ctx context.Context) error {
+	p, _, err := om.client()
+	if err != nil {
+		return err
+	}
+	id := om.backend.DeviceId()
+	devices, err := deviceList(ctx, p, "")
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, d := range devices {
+		found = found || d.Id == id
+	}
+	if !found {
+		devices = append(devices, Device{Id: id})
+		if err := publishDevices(ctx, p, devices); err != nil {
+			return err
+		}
+	}
+	return om.publishBundle(ctx)
+}
+
+func (om *Manager) publishBundle(ctx context.Context) error {
+	p, _, err := om.client()
+	if err != nil {
+		return err
+	}
+	bundle, err := om.backend.Bundle()
+	if err != nil {
+		return err
+	}
+	item, err := xmpp.NewPubsubItem(
+		strconv.FormatUint(uint64(om.backend.DeviceId()), 10), bundle)
+	if err != nil {
+		return err
+	}
+	// Every device's bundle is an item of the same node.
+	_, err = p.Publish(ctx, "", NsBundles, item, map[string]string{
+		"pubsub#access_model": xmpp.AccessOpen,
+		"pubsub#max_items":    "max"})
+	return err
+}
+
+// Fetches a user's device list. A user who has never published one
+// has no devices.
+func deviceList(ctx context.Context, p pep, jid xmpp.JID) ([]Device,
+	error) {
+
+	items, err := p.PubsubItems(ctx, jid, NsDevices)
+	if er, ok := err.(*xmpp.Error); ok &&
+		er.Condition() == xmpp.CondItemNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		var devs Devices
+		if item.Decode(&devs) == nil {
+			return devs.Devices, nil
+		}
+	}
+	return nil, nil
+}
+
+func fetchBundle(ctx context.Context, p pep, jid xmpp.JID,
+	device uint32) (*Bundle, error) {
+
+	id := strconv.FormatUint(uint64(device), 10)
+	items, err := p.PubsubItems(ctx, jid, NsBundles, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		var bundle Bundle
+		if item.Id == id && item.Decode(&bundle) == nil {
+			return &bundle, nil
+		}
+	}
+	return nil, fmt.Errorf("no OMEMO bundle for device %d of %s", device,
+		jid)
+}
+
+// Returns the ids of a user's devices, fetching the list if it isn't
+// known yet, or if it was empty a while ago.
+func (om *Manager) deviceIds(ctx context.Context, p pep,
+	jid xmpp.JID) ([]uint32, error) {
+
+	om.lock.Lock()
+	ids, ok := om.devices[jid]
+	fresh := len(ids) > 0 || time.Since(om.checked[jid]) < recheck
+	om.lock.Unlock()
+	if ok && fresh {
+		return ids, nil
+	}
+	devs, err := deviceList(ctx, p, jid)
+	if err != nil {
+		return nil, err
+	}
+	return om.setDevices(jid, devs), nil
+}
+
+func (om *Manager) setDevices(jid xmpp.JID, devs []Device) []uint32 {
+	var ids []uint32
+	for _, d := range devs {
+		ids = append(ids, d.Id)
+	}
+	om.lock.Lock()
+	om.devices[jid] = ids
+	om.checked[jid] = time.Now()
+	om.lock.Unlock()
+	return ids
+}
+
+func (om *Manager) failed(m *xmpp.Message, outgoing bool, err error) {
+	select {
+	case om.failures <- &Failure{Message: m, Outgoing: outgoing,
+		Err: err}:
+	default:
+	}
+}
+
+// Reports whether a message the application sends should be
+// encrypted, if the recipient has devices.
+func wantsOmemo(m *xmpp.Message) bool {
+	if m.To == "" || len(m.Body) == 0 ||
+		(m.Type != "" && m.Type != "chat" && m.Type != "normal") {
+		return false
+	}
+	for _, ele := range m.Nested {
+		if _, ok := ele.(*Encrypted); ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (om *Manager) sendFilter(in <-chan xmpp.Stanza, out chan<- xmpp.Stanza) {
+	defer close(out)
+	defer close(om.sendDone)
+	go om.encryptQueued()
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			if m, ok := stan.(*xmpp.Message); ok && wantsOmemo(m) {
+				// Encrypting may need iqs, which come
+				// through here.
+				om.lock.Lock()
+				om.queue = append(om.queue, m)
+				om.lock.Unlock()
+				select {
+				case om.wake <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			out <- stan
+		case stan := <-om.toServer:
+			out <- stan
+		}
+	}
+}
+
+// Encrypts queued messages, in order, and sends them.
+func (om *Manager) encryptQueued() {
+	for {
+		select {
+		case <-om.wake:
+		case <-om.sendDone:
+			return
+		}
+		for {
+			om.lock.Lock()
+			if len(om.queue) == 0 {
+				om.lock.Unlock()
+				break
+			}
+			m := om.queue[0]
+			om.queue = om.queue[1:]
+			om.lock.Unlock()
+			ctx, cancel := context.WithTimeout(context.Background(),
+				30*time.Second)
+			enc, err := om.encrypt(ctx, m)
+			cancel()
+			if err != nil {
+				om.failed(m, true, err)
+				continue
+			}
+			select {
+			case om.toServer <- enc:
+			case <-om.sendDone:
+				return
+			}
+		}
+	}
+}
+
+// Returns the message encrypted for the recipient's devices and the
+// user's other ones. If the recipient has no devices, it's the
+// message itself, if plaintext is allowed.
+func (om *Manager) encrypt(ctx context.Context, m *xmpp.Message) (*xmpp.Message,
+	error) {
+
+	p, me, err := om.client()
+	if err != nil {
+		return nil, err
+	}
+	to := m.To.Bare()
+	theirs, err := om.deviceIds(ctx, p, to)
+	if err != nil {
+		return nil, err
+	}
+	if len(theirs) == 0 {
+		if om.AllowPlaintext {
+			return m, nil
+		}
+		return nil, errNoDevices
+	}
+	// The user's other devices should be able to read it too, but
+	// it doesn't matter if they can't.
+	var mine []uint32
+	if me != to {
+		mine, _ = om.deviceIds(ctx, p, me)
+	}
+
+	env := &envelope{Content: content{Body: m.Body},
+		Rpad: xmpp.ScePadding(), From: &xmpp.SceJid{Jid: me}}
+	plaintext, err := xml.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	payload, keyMaterial, err := seal(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	enc := &Encrypted{Payload: payload}
+	enc.Header.Sid = om.backend.DeviceId()
+	keys := om.encryptKey(ctx, p, me, to, theirs, keyMaterial)
+	if len(keys.Keys) == 0 {
+		return nil, fmt.Errorf("no OMEMO session with any device of %s",
+			to)
+	}
+	enc.Header.Keys = append(enc.Header.Keys, keys)
+	if keys := om.encryptKey(ctx, p, me, me, mine, keyMaterial); len(keys.Keys) > 0 {
+		enc.Header.Keys = append(enc.Header.Keys, keys)
+	}
+
+	msg := *m
+	msg.Body = []xmpp.Text{{Chardata: fallback}}
+	msg.Nested = append(append([]interface{}(nil), m.Nested...), enc,
+		&xmpp.Eme{Namespace: NsOmemo, Name: "OMEMO"}, &xmpp.StoreHint{})
+	return &msg, nil
+}
+
+// Encrypts the key material for each of a user's devices, starting
+// sessions where there are none. Devices it can't be encrypted for
+// are left out.
+func (om *Manager) encryptKey(ctx context.Context, p pep, me, jid xmpp.JID,
+	devices []uint32, keyMaterial []byte) Keys {
+
+	keys := Keys{Jid: jid}
+	for _, dev := range devices {
+		if jid == me && dev == om.backend.DeviceId() {
+			continue
+		}
+		if !om.backend.HasSession(jid, dev) {
+			bundle, err := fetchBundle(ctx, p, jid, dev)
+			if err != nil {
+				continue
+			}
+			if om.backend.StartSession(jid, dev, bundle) != nil {
+				continue
+			}
+		}
+		data, kex, err := om.backend.Encrypt(jid, dev, keyMaterial)
+		if err != nil {
+			continue
+		}
+		keys.Keys = append(keys.Keys, Key{Rid: dev, Kex: kex,
+			Data: data})
+	}
+	return keys
+}
+
+func (om *Manager) recvFilter(in <-chan xmpp.Stanza, out chan<- xmpp.Stanza) {
+	defer close(out)
+	for stan := range in {
+		m, ok := stan.(*xmpp.Message)
+		if !ok {
+			out <- stan
+			continue
+		}
+		if ev := m.PubsubEvent(); ev != nil && ev.Items != nil &&
+			ev.Items.Node == NsDevices {
+			om.devicesChanged(m.From.Bare(), ev.Items.Items)
+		}
+		var enc *Encrypted
+		for _, ele := range m.Nested {
+			if e, ok := ele.(*Encrypted); ok {
+				enc = e
+			}
+		}
+		if enc == nil {
+			out <- stan
+			continue
+		}
+		dec, err := om.decrypt(m, enc)
+		if err != nil {
+			om.failed(m, false, err)
+			out <- stan
+			continue
+		}
+		// A message with no payload only carries keys.
+		if dec != nil {
+			out <- dec
+		}
+	}
+}
+
+// Notes a user's new device list. If this device is missing from the
+// user's own list, it's added back.
+func (om *Manager) devicesChanged(jid xmpp.JID, items []xmpp.PubsubItem) {
+	for _, item := range items {
+		var devs Devices
+		if item.Decode(&devs) != nil {
+			continue
+		}
+		ids := om.setDevices(jid, devs.Devices)
+		if _, me, err := om.client(); err != nil || jid != me {
+			return
+		}
+		for _, id := range ids {
+			if id == om.backend.DeviceId() {
+				return
+			}
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(),
+				30*time.Second)
+			defer cancel()
+			om.PublishDevice(ctx)
+		}()
+		return
+	}
+}
+
+// Decrypts a message, returning a copy with the decrypted body, or
+// nil if the message carried no payload.
+func (om *Manager) decrypt(m *xmpp.Message, enc *Encrypted) (*xmpp.Message,
+	error) {
+
+	_, me, err := om.client()
+	if err != nil {
+		return nil, err
+	}
+	var key *Key
+	for _, keys := range enc.Header.Keys {
+		if keys.Jid.Bare() != me {
+			continue
+		}
+		for i := range keys.Keys {
+			if keys.Keys[i].Rid == om.backend.DeviceId() {
+				key = &keys.Keys[i]
+			}
+		}
+	}
+	if key == nil {
+		return nil, errNotForDevice
+	}
+	from := m.From.Bare()
+	keyMaterial, err := om.backend.Decrypt(from, enc.Header.Sid, key.Data,
+		key.Kex)
+	if err != nil {
+		return nil, err
+	}
+	if key.Kex {
+		// A prekey has been used up, so the bundle should be
+		// published without it.
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(),
+				30*time.Second)
+			defer cancel()
+			om.publishBundle(ctx)
+		}()
+	}
+	if len(enc.Payload) == 0 {
+		return nil, nil
+	}
+	plaintext, err := open(enc.Payload, keyMaterial)
+	if err != nil {
+		return nil, err
+	}
+	var env envelope
+	if err := xml.Unmarshal(plaintext, &env); err != nil {
+		return nil, err
+	}
+	// Otherwise the sender could pass off a message it was
+	// forwarded as its own.
+	if env.From == nil || env.From.Jid.Bare() != from {
+		return nil, fmt.Errorf("OMEMO envelope isn't from %s", from)
+	}
+	dec := *m
+	dec.Body = env.Content.Body
+	dec.Nested = nil
+	for _, ele := range m.Nested {
+		if ele != enc {
+			dec.Nested = append(dec.Nested, ele)
+		}
+	}
+	dec.Nested = append(dec.Nested, &Info{Device: enc.Header.Sid})
+	return &dec, nil
+}
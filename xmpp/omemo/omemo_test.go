@@ -0,0 +1,315 @@
+package omemo
+
+import (
+	".."
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func assertEquals(t *testing.T, expected, observed string) {
+	t.Helper()
+	if expected != observed {
+		t.Errorf("expected:\n%s\nobserved:\n%s", expected, observed)
+	}
+}
+
+func firstText(texts []xmpp.Text) string {
+	if len(texts) == 0 {
+		return ""
+	}
+	return texts[0].Chardata
+}
+
+func TestPayload(t *testing.T) {
+	payload, km, err := seal([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(km) != 48 || len(payload) != 16 {
+		t.Fatalf("key material %d, payload %d bytes", len(km), len(payload))
+	}
+	pt, err := open(payload, km)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, "hello", string(pt))
+
+	payload[0] ^= 1
+	if _, err := open(payload, km); err == nil {
+		t.Error("tampered payload accepted")
+	}
+}
+
+// A backend whose sessions only pretend to encrypt.
+type testOmemo struct {
+	id       uint32
+	lock     sync.Mutex
+	sessions map[string]bool
+}
+
+func newTestOmemo(id uint32) *testOmemo {
+	return &testOmemo{id: id, sessions: make(map[string]bool)}
+}
+
+func (o *testOmemo) DeviceId() uint32 { return o.id }
+
+func (o *testOmemo) Bundle() (*Bundle, error) {
+	return &Bundle{Spk: PreKey{Id: 1, Key: Data{1}},
+		Spks: Data{2}, Ik: Data{3},
+		PreKeys: []PreKey{{Id: 7, Key: Data{4}}}}, nil
+}
+
+func (o *testOmemo) HasSession(jid xmpp.JID, device uint32) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.sessions[fmt.Sprint(jid, device)]
+}
+
+func (o *testOmemo) StartSession(jid xmpp.JID, device uint32,
+	bundle *Bundle) error {
+
+	if !bytes.Equal(bundle.Ik, []byte{3}) || len(bundle.PreKeys) != 1 {
+		return fmt.Errorf("bundle %+v", bundle)
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.sessions[fmt.Sprint(jid, device)] = true
+	return nil
+}
+
+func (o *testOmemo) Encrypt(jid xmpp.JID, device uint32, plaintext []byte) ([]byte,
+	bool, error) {
+
+	return append([]byte("x"), plaintext...), true, nil
+}
+
+func (o *testOmemo) Decrypt(jid xmpp.JID, device uint32, ciphertext []byte,
+	kex bool) ([]byte, error) {
+
+	if !kex || len(ciphertext) == 0 || ciphertext[0] != 'x' {
+		return nil, errors.New("can't decrypt")
+	}
+	o.lock.Lock()
+	o.sessions[fmt.Sprint(jid, device)] = true
+	o.lock.Unlock()
+	return ciphertext[1:], nil
+}
+
+// Plays the server's PEP service, for all the peers.
+type pepServer struct {
+	lock  sync.Mutex
+	nodes map[string][]xmpp.PubsubItem
+}
+
+// The PEP requests of one peer's client.
+type pepClient struct {
+	ps  *pepServer
+	jid xmpp.JID
+}
+
+func (pc *pepClient) key(service xmpp.JID, node string) string {
+	if service == "" {
+		service = pc.jid.Bare()
+	}
+	return fmt.Sprint(service, " ", node)
+}
+
+func (pc *pepClient) PubsubItems(ctx context.Context, service xmpp.JID,
+	node string, ids ...string) ([]xmpp.PubsubItem, error) {
+
+	pc.ps.lock.Lock()
+	defer pc.ps.lock.Unlock()
+	items, ok := pc.ps.nodes[pc.key(service, node)]
+	if !ok {
+		return nil, xmpp.NewError("cancel", xmpp.CondItemNotFound, "")
+	}
+	var found []xmpp.PubsubItem
+	for _, it := range items {
+		if len(ids) == 0 || ids[0] == it.Id {
+			found = append(found, it)
+		}
+	}
+	return found, nil
+}
+
+func (pc *pepClient) Publish(ctx context.Context, service xmpp.JID,
+	node string, item xmpp.PubsubItem, options map[string]string) (string,
+	error) {
+
+	pc.ps.lock.Lock()
+	defer pc.ps.lock.Unlock()
+	key := pc.key(service, node)
+	items := pc.ps.nodes[key]
+	for i := range items {
+		if items[i].Id == item.Id {
+			items = append(items[:i], items[i+1:]...)
+			break
+		}
+	}
+	pc.ps.nodes[key] = append(items, item)
+	return item.Id, nil
+}
+
+type omemoPeer struct {
+	om      *Manager
+	sendIn  chan xmpp.Stanza
+	recvIn  chan xmpp.Stanza
+	recvOut chan xmpp.Stanza
+	sent    chan xmpp.Stanza
+	backend *testOmemo
+	jid     xmpp.JID
+}
+
+func newOmemoPeer(ps *pepServer, jid xmpp.JID, id uint32,
+	allowPlaintext bool) *omemoPeer {
+
+	p := &omemoPeer{backend: newTestOmemo(id), jid: jid,
+		sendIn: make(chan xmpp.Stanza), recvIn: make(chan xmpp.Stanza),
+		recvOut: make(chan xmpp.Stanza, 10),
+		sent:    make(chan xmpp.Stanza, 10)}
+	p.om = NewManager(p.backend)
+	p.om.AllowPlaintext = allowPlaintext
+	go p.om.SendFilter(p.sendIn, p.sent)
+	go p.om.RecvFilter(p.recvIn, p.recvOut)
+	p.om.start(&pepClient{ps: ps, jid: jid}, jid)
+	return p
+}
+
+func (p *omemoPeer) close() {
+	close(p.sendIn)
+	close(p.recvIn)
+}
+
+// Takes a message sent over the wire and decodes it as the receiver
+// would.
+func omemoWire(t *testing.T, st xmpp.Stanza, from xmpp.JID) *xmpp.Message {
+	sent := st.(*xmpp.Message)
+	m := &xmpp.Message{Header: sent.Header, Body: sent.Body}
+	m.From = from
+	m.Nested = nil
+	for _, ele := range sent.Nested {
+		buf, err := xml.Marshal(ele)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := ele.(*Encrypted); ok {
+			var enc Encrypted
+			if err := xml.Unmarshal(buf, &enc); err != nil {
+				t.Fatal(err)
+			}
+			m.Nested = append(m.Nested, &enc)
+		}
+	}
+	return m
+}
+
+func TestManager(t *testing.T) {
+	ps := &pepServer{nodes: make(map[string][]xmpp.PubsubItem)}
+	alice := newOmemoPeer(ps, "alice@b.c/pc", 1, true)
+	defer alice.close()
+	bob := newOmemoPeer(ps, "bob@b.c/phone", 2, false)
+	defer bob.close()
+	if items := ps.nodes["bob@b.c "+NsBundles]; len(items) != 1 ||
+		items[0].Id != "2" {
+		t.Fatalf("bob's bundles %+v", items)
+	}
+
+	// Carol has no devices.
+	alice.sendIn <- &xmpp.Message{Header: xmpp.Header{To: "carol@b.c", Type: "chat"},
+		Body: []xmpp.Text{{Chardata: "plain"}}}
+	m := (<-alice.sent).(*xmpp.Message)
+	assertEquals(t, "plain", firstText(m.Body))
+	// Bob doesn't allow that.
+	bob.sendIn <- &xmpp.Message{Header: xmpp.Header{To: "carol@b.c", Type: "chat"},
+		Body: []xmpp.Text{{Chardata: "plain"}}}
+	select {
+	case f := <-bob.om.Failures:
+		if !f.Outgoing || f.Err != errNoDevices {
+			t.Errorf("failure %+v", f)
+		}
+	case st := <-bob.sent:
+		t.Fatalf("sent %v in plaintext", st)
+	}
+
+	alice.sendIn <- &xmpp.Message{Header: xmpp.Header{To: "bob@b.c", Type: "chat",
+		Id: "m1"}, Body: []xmpp.Text{{Chardata: "secret"}}}
+	var enc *xmpp.Message
+	select {
+	case st := <-alice.sent:
+		enc = omemoWire(t, st, alice.jid)
+	case f := <-alice.om.Failures:
+		t.Fatalf("encryption failed: %v", f.Err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no encrypted message")
+	}
+	assertEquals(t, fallback, firstText(enc.Body))
+	assertEquals(t, "m1", enc.Id)
+
+	bob.recvIn <- enc
+	dec := (<-bob.recvOut).(*xmpp.Message)
+	assertEquals(t, "secret", firstText(dec.Body))
+	if info := MessageInfo(dec); info == nil || info.Device != 1 {
+		t.Errorf("OMEMO info %+v", info)
+	}
+
+	// Forged senders are caught by the envelope.
+	forged := omemoWire(t, enc, "mallory@b.c/x")
+	bob.recvIn <- forged
+	f := <-bob.om.Failures
+	if f.Outgoing || f.Message != forged {
+		t.Errorf("failure %+v", f)
+	}
+	if (<-bob.recvOut).(*xmpp.Message) != forged {
+		t.Error("undecryptable message not passed on")
+	}
+
+	// Bob's device list changes, and his device is gone.
+	notif := &xmpp.Message{Header: xmpp.Header{From: "bob@b.c",
+		Nested: []interface{}{&xmpp.PubsubEvent{Items: &xmpp.PubsubItems{
+			Node: NsDevices, Items: []xmpp.PubsubItem{{Id: "current",
+				Payload: `<devices xmlns="` + NsOmemo + `"/>`}}}}}}}
+	alice.recvIn <- notif
+	<-alice.recvOut
+	alice.sendIn <- &xmpp.Message{Header: xmpp.Header{To: "bob@b.c"},
+		Body: []xmpp.Text{{Chardata: "plain again"}}}
+	m = (<-alice.sent).(*xmpp.Message)
+	assertEquals(t, "plain again", firstText(m.Body))
+}
+
+func TestRecheck(t *testing.T) {
+	defer func(d time.Duration) { recheck = d }(recheck)
+	recheck = 0
+	ps := &pepServer{nodes: make(map[string][]xmpp.PubsubItem)}
+	alice := newOmemoPeer(ps, "alice@b.c/pc", 1, false)
+	defer alice.close()
+	send := func() xmpp.Stanza {
+		alice.sendIn <- &xmpp.Message{Header: xmpp.Header{To: "bob@b.c"},
+			Body: []xmpp.Text{{Chardata: "hi"}}}
+		select {
+		case st := <-alice.sent:
+			return st
+		case <-alice.om.Failures:
+			return nil
+		case <-time.After(5 * time.Second):
+			t.Fatal("nothing sent or failed")
+		}
+		return nil
+	}
+	if st := send(); st != nil {
+		t.Fatalf("sent %v before bob had devices", st)
+	}
+	// A device appears without a notification, and the empty list
+	// is looked up again.
+	bob := newOmemoPeer(ps, "bob@b.c/phone", 2, false)
+	defer bob.close()
+	m, ok := send().(*xmpp.Message)
+	if !ok || firstText(m.Body) != fallback {
+		t.Errorf("not encrypted once bob had devices: %v", m)
+	}
+}
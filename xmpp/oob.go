@@ -0,0 +1,69 @@
+package xmpp
+
+// This file contains support for out-of-band data, XEP-0066, with
+// which messages carry the URLs of attachments such as the files
+// uploaded with Client.Upload.
+
+import (
+	"encoding/xml"
+	"reflect"
+)
+
+const NsOob = "jabber:x:oob"
+
+// The URL of something attached to a message, with an optional
+// description.
+type Oob struct {
+	XMLName xml.Name `xml:"jabber:x:oob x"`
+	Url     string   `xml:"url"`
+	Desc    string   `xml:"desc,omitempty"`
+}
+
+// OobExt may be included in the extensions passed to NewClient to
+// decode attachments in incoming messages.
+var OobExt Extension = Extension{}
+
+func init() {
+	OobExt.Features = []string{NsOob}
+	OobExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	oName := xml.Name{Space: NsOob, Local: "x"}
+	OobExt.StanzaTypes[oName] = reflect.TypeOf(Oob{})
+}
+
+// Returns the attachments carried by the message, in order.
+func (m *Message) Attachments() []Oob {
+	var res []Oob
+	for _, ele := range m.Nested {
+		switch o := ele.(type) {
+		case *Oob:
+			res = append(res, *o)
+		case Oob:
+			res = append(res, o)
+		}
+	}
+	return res
+}
+
+// Attaches a URL to the message. If the message has no body, the
+// URL becomes its body, which is how clients know to show the
+// attachment inline, and how those without support for XEP-0066
+// still see it.
+func (m *Message) Attach(url, desc string) {
+	m.Nested = append(m.Nested, &Oob{Url: url, Desc: desc})
+	if len(m.Body) == 0 {
+		m.Body = []Text{{Chardata: url}}
+	}
+}
+
+// Is the message's body nothing but the URL of one of its
+// attachments, so that a client showing the attachment needn't show
+// the body too?
+func (m *Message) BodyIsAttachment() bool {
+	body := firstText(m.Body)
+	for _, o := range m.Attachments() {
+		if o.Url == body {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestOob(t *testing.T) {
+	m := &Message{Header: Header{To: "a@b.c", Type: "chat"}}
+	m.Attach("https://up.b.c/x/cat.jpg", "a cat")
+	assertEquals(t, "https://up.b.c/x/cat.jpg", firstText(m.Body))
+
+	buf, err := xml.Marshal(m)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var in Message
+	xml.Unmarshal(buf, &in)
+	if err := parseExtended(&in.Header, OobExt.StanzaTypes); err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	att := in.Attachments()
+	if len(att) != 1 || att[0].Url != "https://up.b.c/x/cat.jpg" ||
+		att[0].Desc != "a cat" {
+		t.Fatalf("got %+v from %s", att, buf)
+	}
+	if !in.BodyIsAttachment() {
+		t.Error("body isn't the attachment")
+	}
+
+	// A body of its own is kept.
+	m = &Message{Body: []Text{{Chardata: "look"}}}
+	m.Attach("https://up.b.c/x/cat.jpg", "")
+	assertEquals(t, "look", firstText(m.Body))
+	if m.BodyIsAttachment() {
+		t.Error("body is the attachment")
+	}
+}
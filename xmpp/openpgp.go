@@ -0,0 +1,380 @@
+package xmpp
+
+// This file contains OpenPGP for XMPP, XEP-0373, and its use for
+// instant messaging, XEP-0374. Public keys are published with PEP;
+// signing and encryption are left to a backend.
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NsOpenPgp        = "urn:xmpp:openpgp:0"
+	NsOpenPgpPubKeys = "urn:xmpp:openpgp:0:public-keys"
+)
+
+// How long a signcrypt element's time may be from now before the
+// message is taken for a replay.
+const openPgpMaxSkew = 7 * 24 * time.Hour
+
+// An OpenPGP public key, as published. The fingerprint is the key's
+// v4 fingerprint in upper-case hex; the data is the key in binary
+// OpenPGP format.
+type OpenPgpPublicKey struct {
+	Fingerprint string
+	Date        time.Time
+	Data        []byte
+}
+
+// The wire form of a public key.
+type openPgpPubkey struct {
+	XMLName xml.Name `xml:"urn:xmpp:openpgp:0 pubkey"`
+	Date    string   `xml:"date,attr,omitempty"`
+	Data    string   `xml:"data"`
+}
+
+// The list of a user's public keys.
+type OpenPgpKeyList struct {
+	XMLName xml.Name             `xml:"urn:xmpp:openpgp:0 public-keys-list"`
+	Keys    []OpenPgpKeyMetadata `xml:"pubkey-metadata"`
+}
+
+type OpenPgpKeyMetadata struct {
+	Fingerprint string `xml:"v4-fingerprint,attr"`
+	Date        string `xml:"date,attr"`
+}
+
+// An encrypted message element. The data is a base64-encoded OpenPGP
+// message, which decrypts to a signcrypt element.
+type OpenPgpElement struct {
+	XMLName xml.Name `xml:"urn:xmpp:openpgp:0 openpgp"`
+	Data    string   `xml:",chardata"`
+}
+
+// What an OpenPGP message decrypts to: who it was for, when it was
+// sent, random padding, and the stanza's real content.
+type openPgpSigncrypt struct {
+	XMLName xml.Name       `xml:"urn:xmpp:openpgp:0 signcrypt"`
+	To      []SceJid       `xml:"to"`
+	Time    openPgpStamp   `xml:"time"`
+	Rpad    string         `xml:"rpad,omitempty"`
+	Payload openPgpPayload `xml:"payload"`
+}
+
+type openPgpStamp struct {
+	Stamp string `xml:"stamp,attr"`
+}
+
+type openPgpPayload struct {
+	Body []Text `xml:"jabber:client body"`
+}
+
+// OpenPgpExt decodes OpenPGP messages, without decrypting them. An
+// OpenPgpManager includes it.
+var OpenPgpExt Extension = Extension{}
+
+func init() {
+	OpenPgpExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	oName := xml.Name{Space: NsOpenPgp, Local: "openpgp"}
+	OpenPgpExt.StanzaTypes[oName] = reflect.TypeOf(OpenPgpElement{})
+}
+
+// Returns the OpenPGP element of a message, or nil if it isn't an
+// encrypted one.
+func (m *Message) OpenPgp() *OpenPgpElement {
+	for _, ele := range m.Nested {
+		if o, ok := ele.(*OpenPgpElement); ok {
+			return o
+		}
+	}
+	return nil
+}
+
+// Publish one of the user's public keys, and add it to the list of
+// them. A key which is already on the list is replaced.
+func (cl *Client) PublishOpenPgpKey(ctx context.Context,
+	key *OpenPgpPublicKey) error {
+
+	fp := strings.ToUpper(key.Fingerprint)
+	date := key.Date.UTC().Format(time.RFC3339)
+	item, err := NewPubsubItem(date, &openPgpPubkey{Date: date,
+		Data: base64.StdEncoding.EncodeToString(key.Data)})
+	if err != nil {
+		return err
+	}
+	_, err = cl.Publish(ctx, "", NsOpenPgpPubKeys+":"+fp, item,
+		map[string]string{"pubsub#access_model": AccessOpen})
+	if err != nil {
+		return err
+	}
+	list, err := cl.OpenPgpKeyList(ctx, "")
+	if err != nil {
+		return err
+	}
+	keys := []OpenPgpKeyMetadata{{Fingerprint: fp, Date: date}}
+	for _, k := range list {
+		if k.Fingerprint != fp {
+			keys = append(keys, k)
+		}
+	}
+	return cl.PublishPep(ctx, NsOpenPgpPubKeys, "current",
+		&OpenPgpKeyList{Keys: keys}, AccessOpen)
+}
+
+// Fetches the list of a user's public keys. An empty JID means the
+// user's own. A user who has never published one has none.
+func (cl *Client) OpenPgpKeyList(ctx context.Context,
+	jid JID) ([]OpenPgpKeyMetadata, error) {
+
+	items, err := cl.PubsubItems(ctx, jid, NsOpenPgpPubKeys)
+	if errCondition(err) == "item-not-found" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		var list OpenPgpKeyList
+		if item.Decode(&list) == nil {
+			return list.Keys, nil
+		}
+	}
+	return nil, nil
+}
+
+// Fetches one of a user's public keys.
+func (cl *Client) OpenPgpKey(ctx context.Context, jid JID,
+	fingerprint string) (*OpenPgpPublicKey, error) {
+
+	fp := strings.ToUpper(fingerprint)
+	items, err := cl.PubsubItems(ctx, jid, NsOpenPgpPubKeys+":"+fp)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		var pk openPgpPubkey
+		if item.Decode(&pk) != nil {
+			continue
+		}
+		data, err := decodeBase64(pk.Data)
+		if err != nil {
+			return nil, err
+		}
+		key := &OpenPgpPublicKey{Fingerprint: fp, Data: data}
+		key.Date, _ = time.Parse(time.RFC3339, pk.Date)
+		return key, nil
+	}
+	return nil, fmt.Errorf("no OpenPGP key %s for %s", fp, jid)
+}
+
+// Decodes base64 text, which may be wrapped.
+func decodeBase64(b64 string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(
+		strings.Join(strings.Fields(b64), ""))
+}
+
+// OpenPgpBackend signs, encrypts, decrypts, and verifies OpenPGP
+// messages with the user's secret key. Public keys are in binary
+// OpenPGP format.
+type OpenPgpBackend interface {
+	// Signs a message with the user's key, and encrypts it for
+	// the given keys and the user's own.
+	SignEncrypt(plaintext []byte, to [][]byte) ([]byte, error)
+	// Decrypts a message with the user's key, and checks it was
+	// signed with one of the given keys.
+	DecryptVerify(ciphertext []byte, from [][]byte) ([]byte, error)
+}
+
+// OpenPgpManager is an extension which sends and opens messages
+// signed and encrypted with OpenPGP. Contacts' public keys are
+// fetched when they're first needed, and forgotten when the contact
+// publishes a new list of them.
+//
+// Encrypted messages are delivered on Client.Recv as they are, with
+// their fallback body; Open decrypts them.
+type OpenPgpManager struct {
+	Extension
+	backend OpenPgpBackend
+	lock    sync.Mutex
+	cl      *Client
+	// Public keys by bare JID.
+	keys map[JID][][]byte
+}
+
+// Creates an OpenPgpManager, to be passed to NewClient among the
+// extensions.
+func NewOpenPgpManager(backend OpenPgpBackend) *OpenPgpManager {
+	om := &OpenPgpManager{backend: backend}
+	om.keys = make(map[JID][][]byte)
+	om.StanzaTypes = mergeStanzaTypes(OpenPgpExt, PubsubExt)
+	om.Features = []string{NsOpenPgpPubKeys + "+notify"}
+	om.RecvFilter = om.recvFilter
+	om.Start = func(cl *Client) {
+		om.lock.Lock()
+		om.cl = cl
+		om.lock.Unlock()
+	}
+	return om
+}
+
+func (om *OpenPgpManager) client() (*Client, error) {
+	om.lock.Lock()
+	defer om.lock.Unlock()
+	if om.cl == nil {
+		return nil, errors.New("OpenPGP manager not started")
+	}
+	return om.cl, nil
+}
+
+// Returns the public keys of a user, fetching them if they aren't
+// known.
+func (om *OpenPgpManager) publicKeys(ctx context.Context, cl *Client,
+	jid JID) ([][]byte, error) {
+
+	om.lock.Lock()
+	keys, ok := om.keys[jid]
+	om.lock.Unlock()
+	if ok {
+		return keys, nil
+	}
+	list, err := cl.OpenPgpKeyList(ctx, jid)
+	if err != nil {
+		return nil, err
+	}
+	keys = nil
+	for _, md := range list {
+		key, err := cl.OpenPgpKey(ctx, jid, md.Fingerprint)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, key.Data)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s has no OpenPGP keys", jid)
+	}
+	om.lock.Lock()
+	om.keys[jid] = keys
+	om.lock.Unlock()
+	return keys, nil
+}
+
+func (om *OpenPgpManager) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for stan := range in {
+		if m, ok := stan.(*Message); ok {
+			if ev := m.PubsubEvent(); ev != nil && ev.Items != nil &&
+				ev.Items.Node == NsOpenPgpPubKeys {
+				om.lock.Lock()
+				delete(om.keys, m.From.Bare())
+				om.lock.Unlock()
+			}
+		}
+		out <- stan
+	}
+}
+
+// Signs and encrypts a message's body for its recipient, and sends
+// it. The body sent in the clear only says the message is encrypted.
+func (om *OpenPgpManager) Send(ctx context.Context, m *Message) error {
+	cl, err := om.client()
+	if err != nil {
+		return err
+	}
+	to := m.To.Bare()
+	keys, err := om.publicKeys(ctx, cl, to)
+	if err != nil {
+		return err
+	}
+	sc := &openPgpSigncrypt{To: []SceJid{{Jid: to}},
+		Time:    openPgpStamp{Stamp: time.Now().UTC().Format(time.RFC3339)},
+		Rpad:    ScePadding(),
+		Payload: openPgpPayload{Body: m.Body}}
+	plaintext, err := xml.Marshal(sc)
+	if err != nil {
+		return err
+	}
+	data, err := om.backend.SignEncrypt(plaintext, keys)
+	if err != nil {
+		return err
+	}
+	msg := *m
+	msg.Body = []Text{{Chardata: "This message is encrypted with " +
+		"OpenPGP, which your client doesn't seem to support."}}
+	msg.Nested = append(append([]interface{}(nil), m.Nested...),
+		&OpenPgpElement{Data: base64.StdEncoding.EncodeToString(data)},
+		&Eme{Namespace: NsOpenPgp, Name: "OpenPGP for XMPP"},
+		&StoreHint{})
+	return cl.send(ctx, &msg)
+}
+
+// Decrypts a message received with an OpenPGP element, and checks
+// that it was signed by the sender and meant for the user. Returns a
+// copy of the message with the decrypted body.
+func (om *OpenPgpManager) Open(ctx context.Context, m *Message) (*Message,
+	error) {
+
+	el := m.OpenPgp()
+	if el == nil {
+		return nil, errors.New("message isn't OpenPGP encrypted")
+	}
+	cl, err := om.client()
+	if err != nil {
+		return nil, err
+	}
+	from := m.From.Bare()
+	keys, err := om.publicKeys(ctx, cl, from)
+	if err != nil {
+		return nil, err
+	}
+	data, err := decodeBase64(el.Data)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := om.backend.DecryptVerify(data, keys)
+	if err != nil {
+		return nil, err
+	}
+	var sc openPgpSigncrypt
+	if err := xml.Unmarshal(plaintext, &sc); err != nil {
+		return nil, err
+	}
+	// Otherwise a message signed for someone else could be
+	// forwarded to the user, or an old one replayed.
+	forUs := false
+	for _, to := range sc.To {
+		forUs = forUs || to.Jid.Bare() == cl.Jid.Bare()
+	}
+	if !forUs {
+		return nil, fmt.Errorf("OpenPGP message from %s isn't for %s",
+			from, cl.Jid.Bare())
+	}
+	stamp, err := time.Parse(time.RFC3339Nano, sc.Time.Stamp)
+	if err != nil {
+		return nil, fmt.Errorf("OpenPGP message time: %v", err)
+	}
+	// A message the server held was sent when it says.
+	sent := time.Now()
+	if m.Delay != nil && !m.Delay.Stamp.IsZero() {
+		sent = m.Delay.Stamp
+	}
+	if d := sent.Sub(stamp); d > openPgpMaxSkew || d < -openPgpMaxSkew {
+		return nil, fmt.Errorf("OpenPGP message sent at %v", stamp)
+	}
+	dec := *m
+	dec.Body = sc.Payload.Body
+	dec.Nested = nil
+	for _, ele := range m.Nested {
+		if ele != el {
+			dec.Nested = append(dec.Nested, ele)
+		}
+	}
+	return &dec, nil
+}
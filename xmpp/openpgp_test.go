@@ -0,0 +1,160 @@
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A backend which signs with its one-byte key and doesn't encrypt.
+type testOpenPgp struct {
+	key byte
+}
+
+func (o *testOpenPgp) SignEncrypt(plaintext []byte, to [][]byte) ([]byte,
+	error) {
+
+	if len(to) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	return append([]byte{o.key}, plaintext...), nil
+}
+
+func (o *testOpenPgp) DecryptVerify(ciphertext []byte, from [][]byte) ([]byte,
+	error) {
+
+	for _, k := range from {
+		if len(ciphertext) > 0 && bytes.Equal(k, ciphertext[:1]) {
+			return ciphertext[1:], nil
+		}
+	}
+	return nil, errors.New("bad signature")
+}
+
+// Plays the server's PEP service for a client, and passes on the
+// messages it sends.
+type pepServer struct {
+	lock  sync.Mutex
+	nodes map[string][]PubsubItem
+}
+
+func (ps *pepServer) serve(cl *Client, out <-chan Stanza, msgs chan<- Stanza) {
+	callbacks := make(map[string]func(Stanza))
+	for {
+		select {
+		case h := <-cl.handlers:
+			callbacks[h.id] = h.f
+		case st, ok := <-out:
+			if !ok {
+				return
+			}
+			iq, ok := st.(*Iq)
+			if !ok {
+				msgs <- st
+				continue
+			}
+			reply := &Iq{Header: Header{Id: iq.Id, Type: "result"}}
+			service := iq.To
+			if service == "" {
+				service = cl.Jid.Bare()
+			}
+			req := iq.Nested[0].(*Pubsub)
+			ps.lock.Lock()
+			switch {
+			case req.Publish != nil:
+				key := fmt.Sprint(service, " ", req.Publish.Node)
+				items := ps.nodes[key]
+				for _, it := range req.Publish.Items {
+					for i := range items {
+						if items[i].Id == it.Id {
+							items = append(items[:i], items[i+1:]...)
+							break
+						}
+					}
+					items = append(items, it)
+				}
+				ps.nodes[key] = items
+			case req.Items != nil:
+				items, ok := ps.nodes[fmt.Sprint(service, " ", req.Items.Node)]
+				if !ok {
+					reply.Type = "error"
+					reply.Error = stanzaError("cancel", "item-not-found")
+					break
+				}
+				var found []PubsubItem
+				for _, it := range items {
+					if len(req.Items.Items) == 0 ||
+						req.Items.Items[0].Id == it.Id {
+						found = append(found, it)
+					}
+				}
+				reply.Nested = []interface{}{&Pubsub{
+					Items: &PubsubItems{Items: found}}}
+			}
+			ps.lock.Unlock()
+			if f := callbacks[iq.Id]; f != nil {
+				delete(callbacks, iq.Id)
+				f(reply)
+			}
+		}
+	}
+}
+
+func TestOpenPgp(t *testing.T) {
+	ps := &pepServer{nodes: make(map[string][]PubsubItem)}
+	newSide := func(jid JID, key byte) (*OpenPgpManager, chan Stanza) {
+		om := NewOpenPgpManager(&testOpenPgp{key: key})
+		send := make(chan Stanza)
+		sent := make(chan Stanza, 10)
+		cl := &Client{Jid: jid, handlers: make(chan *callback), Send: send}
+		go ps.serve(cl, send, sent)
+		om.Start(cl)
+		err := cl.PublishOpenPgpKey(context.Background(),
+			&OpenPgpPublicKey{Fingerprint: "ab" + string('0'+key),
+				Date: time.Now(), Data: []byte{key}})
+		if err != nil {
+			t.Fatalf("PublishOpenPgpKey: %v", err)
+		}
+		return om, sent
+	}
+	alice, aliceSent := newSide("alice@b.c/pc", 1)
+	bob, _ := newSide("bob@b.c/phone", 2)
+
+	list, err := bob.cl.OpenPgpKeyList(context.Background(), "alice@b.c")
+	if err != nil || len(list) != 1 || list[0].Fingerprint != "AB1" {
+		t.Fatalf("alice's keys %+v, %v", list, err)
+	}
+
+	err = alice.Send(context.Background(), &Message{Header: Header{
+		To: "bob@b.c", Type: "chat"}, Body: []Text{{Chardata: "secret"}}})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	m := (<-aliceSent).(*Message)
+	if m.OpenPgp() == nil || firstText(m.Body) == "secret" {
+		t.Fatalf("sent %+v", m)
+	}
+	m.From = "alice@b.c/pc"
+	dec, err := bob.Open(context.Background(), m)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	assertEquals(t, "secret", firstText(dec.Body))
+	if dec.OpenPgp() != nil {
+		t.Error("decrypted message still has the OpenPGP element")
+	}
+
+	// Carol didn't sign it, and Alice can't open what was meant for Bob.
+	m.From = "carol@b.c/x"
+	if _, err := bob.Open(context.Background(), m); err == nil {
+		t.Error("opened a message from someone without keys")
+	}
+	m.From = "alice@b.c/pc"
+	if _, err := alice.Open(context.Background(), m); err == nil {
+		t.Error("opened a message signed for someone else")
+	}
+}
@@ -0,0 +1,335 @@
+package xmpp
+
+// This file contains an outbox, which holds messages while the client
+// can't send them, such as while it's reconnecting or before it has
+// logged in, and sends them in order once it can.
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Given to the callbacks of messages which weren't sent within the
+// outbox's MaxAge.
+var ErrMessageExpired = errors.New("message expired before it was sent")
+
+// Configures an Outbox.
+type OutboxConfig struct {
+	// Where the messages are kept, so that those not yet sent
+	// survive a restart of the program, and the key they're kept
+	// under, such as the account's bare JID. Nil means in memory.
+	Storage Storage
+	Key     string
+	// How long a message may wait to be sent before it expires.
+	// Zero means it never does.
+	MaxAge time.Duration
+	// If non-nil, called with the outcome of each message which
+	// was queued without a callback of its own, such as those kept
+	// from an earlier run of the program.
+	Done func(m *Message, err error)
+}
+
+// Outbox is an extension which queues messages while the session
+// isn't running, and sends them, in the order they were queued, once
+// it is again. Messages are queued whether the client is connected
+// or not, so they may be queued before it's created.
+//
+// A message's callback is given nil once the server has it: once it
+// has acknowledged it with StreamManagementExt, or else once it's
+// been written. A message the server hasn't acknowledged when a new
+// session starts is sent again. With stream management, an error the
+// server sends back for the message before acknowledging it is
+// given to the callback, and the message isn't sent again; so is
+// ErrMessageExpired if it wasn't sent within MaxAge.
+type Outbox struct {
+	Extension
+	conf  OutboxConfig
+	lock  sync.Mutex
+	queue []*outboxEntry
+	// Waiting for acknowledgement, by id.
+	sent map[string]*outboxEntry
+	wake chan bool
+}
+
+type outboxEntry struct {
+	m *Message
+	// As it's stored, marshaled when it was queued, since filters
+	// may change it while it's sent.
+	raw    string
+	queued time.Time
+	done   func(error)
+	// Whether it's been sent in this session.
+	sending bool
+}
+
+// How the messages are stored.
+type outboxState struct {
+	XMLName xml.Name     `xml:"outbox"`
+	Items   []outboxItem `xml:"item"`
+}
+
+type outboxItem struct {
+	Queued  time.Time `xml:"queued,attr"`
+	Message string    `xml:",innerxml"`
+}
+
+// Creates an Outbox, to be passed to NewClient among the extensions,
+// with the messages kept in the storage, if any.
+func NewOutbox(conf OutboxConfig) (*Outbox, error) {
+	ob := &Outbox{conf: conf}
+	ob.sent = make(map[string]*outboxEntry)
+	ob.wake = make(chan bool, 1)
+	ob.RecvMiddleware = ob.recvMiddleware
+	ob.Start = ob.start
+	if err := ob.load(); err != nil {
+		return nil, err
+	}
+	return ob, nil
+}
+
+// Queues a message, which is given an id if it hasn't one, and calls
+// done, if it's not nil, with its outcome. Done is called in a
+// goroutine of its own.
+func (ob *Outbox) Queue(m *Message, done func(error)) error {
+	if m.Id == "" {
+		m.Id = NextId()
+	}
+	e := &outboxEntry{m: m, queued: time.Now(), done: done}
+	if ob.conf.Storage != nil {
+		buf, err := xml.Marshal(m)
+		if err != nil {
+			return err
+		}
+		e.raw = string(buf)
+	}
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	ob.queue = append(ob.queue, e)
+	if err := ob.save(); err != nil {
+		ob.queue = ob.queue[:len(ob.queue)-1]
+		return err
+	}
+	select {
+	case ob.wake <- true:
+	default:
+	}
+	return nil
+}
+
+// Returns the messages waiting to be sent, or to be acknowledged.
+func (ob *Outbox) Pending() []*Message {
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	var ms []*Message
+	for _, e := range ob.queue {
+		ms = append(ms, e.m)
+	}
+	return ms
+}
+
+func (ob *Outbox) start(cl *Client) {
+	stat := cl.statmgr.newListener()
+	check := time.Minute
+	if ob.conf.MaxAge > 0 && ob.conf.MaxAge < check {
+		check = ob.conf.MaxAge
+	}
+	tick := time.NewTicker(check)
+	defer tick.Stop()
+	running := false
+	for {
+		select {
+		case s, ok := <-stat:
+			if !ok || s.Fatal() {
+				return
+			}
+			running = s == StatusRunning
+		case <-ob.wake:
+		case <-tick.C:
+		}
+		ob.expire(time.Now())
+		if running && !ob.flush(cl) {
+			return
+		}
+	}
+}
+
+// Sends what hasn't been sent in this session. Returns false once the
+// client has closed.
+func (ob *Outbox) flush(cl *Client) bool {
+	for {
+		ob.lock.Lock()
+		var e *outboxEntry
+		for _, next := range ob.queue {
+			if !next.sending {
+				e = next
+				break
+			}
+		}
+		if e != nil {
+			e.sending = true
+			ob.sent[e.m.Id] = e
+		}
+		ob.lock.Unlock()
+		if e == nil {
+			return true
+		}
+		var err error
+		if cl.sm != nil {
+			err = cl.SendAcked(context.Background(), e.m,
+				func(err error) { ob.acked(e, err) })
+		} else if err = cl.SendContext(context.Background(),
+			e.m); err == nil {
+			ob.finish(e, nil)
+		}
+		if err != nil {
+			ob.lock.Lock()
+			e.sending = false
+			delete(ob.sent, e.m.Id)
+			ob.lock.Unlock()
+			return err != ErrClientClosed
+		}
+	}
+}
+
+// The outcome of a message sent with stream management.
+func (ob *Outbox) acked(e *outboxEntry, err error) {
+	switch err {
+	case nil, ErrNoStreamMgmt:
+		ob.finish(e, nil)
+	default:
+		// To be sent again in the next session.
+		ob.lock.Lock()
+		e.sending = false
+		delete(ob.sent, e.m.Id)
+		ob.lock.Unlock()
+	}
+}
+
+// Notices errors sent back, from their recipients, for messages being
+// sent.
+func (ob *Outbox) recvMiddleware(st Stanza, next func(Stanza)) {
+	if m, ok := st.(*Message); ok && m.Type == "error" && m.Id != "" {
+		ob.lock.Lock()
+		e := ob.sent[m.Id]
+		ob.lock.Unlock()
+		// Anyone can send an error with a guessed id; only the
+		// recipient's bounces count.
+		if e != nil && m.From.Bare() == e.m.To.Bare() {
+			var err error = m.Error
+			if m.Error == nil {
+				err = errors.New("message bounced")
+			}
+			ob.finish(e, err)
+		}
+	}
+	next(st)
+}
+
+// Drops the messages which have waited too long.
+func (ob *Outbox) expire(now time.Time) {
+	if ob.conf.MaxAge <= 0 {
+		return
+	}
+	ob.lock.Lock()
+	var expired []*outboxEntry
+	for _, e := range ob.queue {
+		if !e.sending && now.Sub(e.queued) >= ob.conf.MaxAge {
+			expired = append(expired, e)
+		}
+	}
+	for _, e := range expired {
+		ob.remove(e)
+	}
+	ob.lock.Unlock()
+	for _, e := range expired {
+		ob.report(e, ErrMessageExpired)
+	}
+}
+
+// Removes a message from the queue, and reports its outcome, unless
+// that's been done already.
+func (ob *Outbox) finish(e *outboxEntry, err error) {
+	ob.lock.Lock()
+	found := ob.remove(e)
+	ob.lock.Unlock()
+	if found {
+		ob.report(e, err)
+	}
+}
+
+// Removes a message from the queue, with the lock held. Returns false
+// if it isn't there.
+func (ob *Outbox) remove(e *outboxEntry) bool {
+	if ob.sent[e.m.Id] == e {
+		delete(ob.sent, e.m.Id)
+	}
+	for i, other := range ob.queue {
+		if other == e {
+			ob.queue = append(ob.queue[:i:i], ob.queue[i+1:]...)
+			ob.save()
+			return true
+		}
+	}
+	return false
+}
+
+func (ob *Outbox) report(e *outboxEntry, err error) {
+	if e.done != nil {
+		go e.done(err)
+	} else if ob.conf.Done != nil {
+		go ob.conf.Done(e.m, err)
+	}
+}
+
+// Stores the queue, with the lock held.
+func (ob *Outbox) save() error {
+	s := ob.conf.Storage
+	if s == nil {
+		return nil
+	}
+	if len(ob.queue) == 0 {
+		return s.Delete(StorageOutbox, ob.conf.Key)
+	}
+	var state outboxState
+	for _, e := range ob.queue {
+		state.Items = append(state.Items, outboxItem{Queued: e.queued,
+			Message: e.raw})
+	}
+	buf, err := xml.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.Set(StorageOutbox, ob.conf.Key, buf)
+}
+
+// Reads the stored queue. The messages keep their payloads as they
+// were marshaled, in Innerxml, to be sent as they are.
+func (ob *Outbox) load() error {
+	s := ob.conf.Storage
+	if s == nil {
+		return nil
+	}
+	buf, ok, err := s.Get(StorageOutbox, ob.conf.Key)
+	if err != nil || !ok {
+		return err
+	}
+	var state outboxState
+	if err := xml.Unmarshal(buf, &state); err != nil {
+		return err
+	}
+	for _, it := range state.Items {
+		var m Message
+		if err := xml.Unmarshal([]byte(it.Message), &m); err != nil {
+			return err
+		}
+		h := m.Header
+		m = Message{Header: Header{To: h.To, Id: h.Id, Type: h.Type,
+			Lang: h.Lang, Innerxml: h.Innerxml}}
+		ob.queue = append(ob.queue, &outboxEntry{m: &m,
+			raw: it.Message, queued: it.Queued})
+	}
+	return nil
+}
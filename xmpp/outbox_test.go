@@ -0,0 +1,132 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutbox(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	s.AddUser("bob", "hunter2")
+	bob := mockClient(t, s, "bob@b.c/phone", "hunter2", &tls.Config{})
+	defer bob.Close()
+
+	// Queued before the client exists, and before a restart.
+	storage := NewMemoryStorage()
+	ob, err := NewOutbox(OutboxConfig{Storage: storage, Key: "alice@b.c"})
+	if err != nil {
+		t.Fatalf("NewOutbox: %v", err)
+	}
+	if err := ob.Queue(&Message{Header: Header{To: "bob@b.c/phone",
+		Type: "chat"}, Body: []Text{{Chardata: "kept"}}},
+		nil); err != nil {
+		t.Fatalf("Queue: %v", err)
+	}
+	outcomes := make(chan string, 2)
+	ob, err = NewOutbox(OutboxConfig{Storage: storage, Key: "alice@b.c",
+		Done: func(m *Message, err error) {
+			outcomes <- m.Id + " " + errString(err)
+		}})
+	if err != nil || len(ob.Pending()) != 1 {
+		t.Fatalf("NewOutbox: %v %v", ob.Pending(), err)
+	}
+	kept := ob.Pending()[0].Id
+	ob.Queue(&Message{Header: Header{To: "bob@b.c/phone", Type: "chat",
+		Id: "m2"}, Body: []Text{{Chardata: "new"}}}, func(err error) {
+		outcomes <- "m2 " + errString(err)
+	})
+
+	jid := JID("alice@b.c/pc")
+	alice, err := NewClientFromConn(s.Dial(), &jid, "secret",
+		&tls.Config{}, []Extension{ob.Extension}, Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn: %v", err)
+	}
+	defer alice.Close()
+	for _, want := range []string{"kept", "new"} {
+		m := recvMessage(t, bob)
+		assertEquals(t, want, firstText(m.Body))
+		if len(m.Body) != 1 {
+			t.Errorf("bodies %v", m.Body)
+		}
+	}
+	got := map[string]bool{<-outcomes: true, <-outcomes: true}
+	if !got[kept+" <nil>"] || !got["m2 <nil>"] {
+		t.Errorf("outcomes %v", got)
+	}
+	if len(ob.Pending()) != 0 {
+		t.Errorf("pending %v", ob.Pending())
+	}
+	if _, ok, _ := storage.Get(StorageOutbox, "alice@b.c"); ok {
+		t.Errorf("sent messages still stored")
+	}
+}
+
+func TestOutboxFailures(t *testing.T) {
+	ob, _ := NewOutbox(OutboxConfig{MaxAge: time.Minute})
+	outcomes := make(chan string, 1)
+	done := func(err error) { outcomes <- errString(err) }
+	ob.Queue(&Message{Header: Header{Id: "old"}}, done)
+	ob.expire(time.Now().Add(30 * time.Second))
+	if len(ob.Pending()) != 1 {
+		t.Fatalf("expired early")
+	}
+	ob.expire(time.Now().Add(time.Hour))
+	assertEquals(t, ErrMessageExpired.Error(), <-outcomes)
+	ob.Queue(&Message{Header: Header{To: "bob@b.c", Id: "bounced"}}, done)
+
+	// Sent, and bounced before it was acknowledged.
+	e := ob.queue[0]
+	e.sending = true
+	ob.sent[e.m.Id] = e
+	var passed Stanza
+	// Not from the recipient.
+	forged := &Message{Header: Header{From: "mallory@b.c", Id: "bounced",
+		Type: "error", Error: stanzaError("", CondServiceUnavailable)}}
+	ob.recvMiddleware(forged, func(st Stanza) { passed = st })
+	if passed != forged || len(ob.Pending()) != 1 {
+		t.Fatalf("passed %v, pending %v", passed, ob.Pending())
+	}
+	bounce := &Message{Header: Header{From: "bob@b.c/phone", Id: "bounced",
+		Type: "error", Error: stanzaError("", CondServiceUnavailable)}}
+	ob.recvMiddleware(bounce, func(st Stanza) { passed = st })
+	assertEquals(t, CondServiceUnavailable+" (cancel)", <-outcomes)
+	if passed != bounce || len(ob.Pending()) != 0 {
+		t.Errorf("passed %v, pending %v", passed, ob.Pending())
+	}
+	// The ack which follows changes nothing.
+	ob.acked(e, nil)
+	select {
+	case o := <-outcomes:
+		t.Errorf("outcome %q", o)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestOutboxRestored(t *testing.T) {
+	storage := NewMemoryStorage()
+	ob, _ := NewOutbox(OutboxConfig{Storage: storage})
+	m := &Message{Header: Header{To: "al@b.c", Id: "x",
+		Nested: []interface{}{&Ping{}}}, Body: []Text{{Chardata: "hi"}}}
+	ob.Queue(m, nil)
+	want, _ := xml.Marshal(m)
+
+	ob, _ = NewOutbox(OutboxConfig{Storage: storage})
+	got, _ := xml.Marshal(ob.Pending()[0])
+	assertEquals(t, string(want), string(got))
+	if strings.Count(string(got), "<body") != 1 {
+		t.Errorf("restored %s", got)
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return "<nil>"
+	}
+	return err.Error()
+}
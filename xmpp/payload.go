@@ -0,0 +1,155 @@
+package xmpp
+
+// This file contains a type-safe way of registering and retrieving
+// extension payloads.
+
+import (
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var payloadLock sync.Mutex
+var payloadTypes = make(map[xml.Name]reflect.Type)
+var payloadNames = make(map[reflect.Type]xml.Name)
+
+// Registers T as the type to decode elements with the given
+// namespace and local name into, when they're nested in incoming
+// stanzas. It applies to every Client created afterwards, as if an
+// Extension with the type in its StanzaTypes had been passed to
+// NewClient. Registering a name twice with different types panics.
+//
+// T needn't have an XMLName field: values of it in the Nested field of
+// outgoing stanzas are marshaled with the registered name.
+func RegisterPayload[T any](space, local string) {
+	name := xml.Name{Space: space, Local: local}
+	var zero T
+	t := reflect.TypeOf(zero)
+	payloadLock.Lock()
+	defer payloadLock.Unlock()
+	if old, ok := payloadTypes[name]; ok && old != t {
+		panic(fmt.Sprintf("xmpp: %s %s registered as %v and %v",
+			space, local, old, t))
+	}
+	payloadTypes[name] = t
+	payloadNames[t] = name
+}
+
+// Like RegisterPayload, but only for the clients the returned
+// extension is passed to, or registered with by RegisterExtension.
+func PayloadExt[T any](space, local string) Extension {
+	var zero T
+	name := xml.Name{Space: space, Local: local}
+	return Extension{StanzaTypes: map[xml.Name]reflect.Type{
+		name: reflect.TypeOf(zero)}}
+}
+
+// Marshals a payload with the name it was registered with, for types
+// without an XMLName field.
+type namedPayload struct {
+	name xml.Name
+	v    interface{}
+}
+
+func (np namedPayload) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	return e.EncodeElement(np.v, xml.StartElement{Name: np.name})
+}
+
+// Returns the name a payload of type t is marshaled with, if it's
+// registered and has no XMLName field of its own.
+func (cl *Client) payloadName(t reflect.Type) (xml.Name, bool) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return xml.Name{}, false
+	}
+	if _, ok := t.FieldByName("XMLName"); ok {
+		return xml.Name{}, false
+	}
+	if cl.extensions != nil {
+		if name, ok := cl.extensions.payloadName(t); ok {
+			return name, true
+		}
+	}
+	payloadLock.Lock()
+	defer payloadLock.Unlock()
+	name, ok := payloadNames[t]
+	return name, ok
+}
+
+// Returns the stanza with its registered payloads wrapped so that
+// they're marshaled with their names. The stanza itself isn't
+// changed.
+func (cl *Client) namePayloads(st Stanza) Stanza {
+	h := st.GetHeader()
+	var nested []interface{}
+	for i, v := range h.Nested {
+		name, ok := cl.payloadName(reflect.TypeOf(v))
+		if !ok {
+			continue
+		}
+		if nested == nil {
+			nested = append([]interface{}(nil), h.Nested...)
+		}
+		nested[i] = namedPayload{name: name, v: v}
+	}
+	if nested == nil {
+		return st
+	}
+	switch st := st.(type) {
+	case *Message:
+		m := *st
+		m.Nested = nested
+		return &m
+	case *Presence:
+		p := *st
+		p.Nested = nested
+		return &p
+	case *Iq:
+		iq := *st
+		iq.Nested = nested
+		return &iq
+	}
+	return st
+}
+
+// Returns the registered payload types, to be merged with those of
+// the client's extensions.
+func registeredPayloads() map[xml.Name]reflect.Type {
+	payloadLock.Lock()
+	defer payloadLock.Unlock()
+	m := make(map[xml.Name]reflect.Type)
+	for k, v := range payloadTypes {
+		m[k] = v
+	}
+	return m
+}
+
+// Returns the first payload of type T nested in a stanza.
+func GetPayload[T any](st Stanza) (*T, bool) {
+	for _, ele := range st.GetHeader().Nested {
+		switch p := ele.(type) {
+		case *T:
+			return p, true
+		case T:
+			return &p, true
+		}
+	}
+	return nil, false
+}
+
+// Returns every payload of type T nested in a stanza.
+func GetPayloads[T any](st Stanza) []*T {
+	var res []*T
+	for _, ele := range st.GetHeader().Nested {
+		switch p := ele.(type) {
+		case *T:
+			res = append(res, p)
+		case T:
+			res = append(res, &p)
+		}
+	}
+	return res
+}
@@ -0,0 +1,87 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"encoding/xml"
+	"testing"
+)
+
+type testPayload struct {
+	XMLName xml.Name `xml:"urn:test:payload thing"`
+	Value   string   `xml:"value,attr"`
+}
+
+func TestPayload(t *testing.T) {
+	RegisterPayload[testPayload]("urn:test:payload", "thing")
+	// Registering the same type again is harmless.
+	RegisterPayload[testPayload]("urn:test:payload", "thing")
+
+	str := `<message xmlns="jabber:client"><thing ` +
+		`xmlns="urn:test:payload" value="1"/><thing ` +
+		`xmlns="urn:test:payload" value="2"/></message>`
+	var m Message
+	if err := xml.Unmarshal([]byte(str), &m); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if err := parseExtended(&m.Header, registeredPayloads()); err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	p, ok := GetPayload[testPayload](&m)
+	if !ok {
+		t.Fatalf("no payload in %v", m.Nested)
+	}
+	assertEquals(t, "1", p.Value)
+	ps := GetPayloads[testPayload](&m)
+	if len(ps) != 2 || ps[1].Value != "2" {
+		t.Errorf("GetPayloads: %v", ps)
+	}
+	if _, ok := GetPayload[DiscoInfo](&m); ok {
+		t.Errorf("found wrong payload type")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("conflicting registration didn't panic")
+		}
+	}()
+	RegisterPayload[DiscoInfo]("urn:test:payload", "thing")
+}
+
+// A payload without an XMLName of its own.
+type testBarePayload struct {
+	Value string `xml:"value,attr"`
+}
+
+func TestPayloadExt(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	jid := JID("alice@b.c/pc")
+	cl, err := NewClientFromConn(s.Dial(), &jid, "secret", &tls.Config{},
+		[]Extension{PayloadExt[testBarePayload]("urn:test:bare", "bare")},
+		Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn: %v", err)
+	}
+	defer cl.Close()
+
+	m := &Message{Header: Header{To: "b.c",
+		Nested: []interface{}{&testBarePayload{Value: "1"}}}}
+	buf, err := xml.Marshal(cl.namePayloads(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, `<message xmlns="jabber:client" to="b.c"><bare `+
+		`xmlns="urn:test:bare" value="1"></bare></message>`, string(buf))
+	if _, ok := m.Nested[0].(*testBarePayload); !ok {
+		t.Error("stanza changed")
+	}
+
+	// The server echoes it back.
+	cl.Send <- m
+	p, ok := GetPayload[testBarePayload](recvMessage(t, cl))
+	if !ok {
+		t.Fatal("no payload")
+	}
+	assertEquals(t, "1", p.Value)
+}
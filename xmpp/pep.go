@@ -0,0 +1,191 @@
+package xmpp
+
+// This file contains helpers for publishing to the common personal
+// eventing (PEP, XEP-0163) nodes of the user's own account.
+
+import (
+	"context"
+	"encoding/base64"
+	"reflect"
+)
+
+// Values for the pubsub#access_model publish option.
+const (
+	AccessOpen      = "open"
+	AccessPresence  = "presence"
+	AccessRoster    = "roster"
+	AccessWhitelist = "whitelist"
+)
+
+// Returns an extension which asks for notifications from the given
+// PEP nodes of the user's contacts, such as NsNick. The server sends
+// them to clients which advertise node+notify in their entity
+// capabilities, so this adds that to the client's features; there's
+// no explicit subscription. With a pubsub.Manager, the notifications
+// can be given to handlers for the nodes.
+func PepNotifyExt(nodes ...string) Extension {
+	ext := Extension{}
+	for _, node := range nodes {
+		ext.Features = append(ext.Features, node+"+notify")
+	}
+	return ext
+}
+
+// Publish a payload to one of the user's PEP nodes, with the given
+// access model, such as AccessPresence. The node is created if it
+// doesn't exist yet. An id of "current" makes the item the node's
+// only one.
+func (cl *Client) PublishPep(ctx context.Context, node, id string,
+	payload interface{}, access string) error {
+
+	item, err := NewPubsubItem(id, payload)
+	if err != nil {
+		return err
+	}
+	opts := map[string]string{"pubsub#access_model": access}
+	if id == "current" {
+		opts["pubsub#max_items"] = "1"
+	}
+	_, err = cl.Publish(ctx, "", node, item, opts)
+	return err
+}
+
+// Publish the user's nickname, XEP-0172, to everyone subscribed to
+// their presence.
+func (cl *Client) PublishNick(ctx context.Context, nick string) error {
+	return cl.PublishPep(ctx, NsNick, "current", &UserNick{Nick: nick},
+		AccessPresence)
+}
+
+// Publish the user's mood, XEP-0107. A nil mood clears it.
+func (cl *Client) PublishMood(ctx context.Context, mood *Mood) error {
+	if mood == nil {
+		mood = &Mood{}
+	}
+	return cl.PublishPep(ctx, NsMood, "current", mood, AccessPresence)
+}
+
+// Publish what the user is doing, XEP-0108. A nil activity clears it.
+func (cl *Client) PublishActivity(ctx context.Context,
+	activity *Activity) error {
+
+	if activity == nil {
+		activity = &Activity{}
+	}
+	return cl.PublishPep(ctx, NsActivity, "current", activity,
+		AccessPresence)
+}
+
+// Publish the music the user is listening to, XEP-0118. A nil tune
+// says they've stopped.
+func (cl *Client) PublishTune(ctx context.Context, tune *Tune) error {
+	if tune == nil {
+		tune = &Tune{}
+	}
+	return cl.PublishPep(ctx, NsTune, "current", tune, AccessPresence)
+}
+
+// Publish where the user is, XEP-0080. A nil location stops
+// publishing it.
+func (cl *Client) PublishGeoloc(ctx context.Context, loc *Geoloc) error {
+	if loc == nil {
+		loc = &Geoloc{}
+	}
+	return cl.PublishPep(ctx, NsGeoloc, "current", loc, AccessPresence)
+}
+
+// Publish an avatar's image data, XEP-0084. This must be done before
+// announcing it with PublishAvatarMetadata.
+func (cl *Client) PublishAvatarData(ctx context.Context, av *Avatar) error {
+	data := &AvatarData{Data: base64.StdEncoding.EncodeToString(av.Data)}
+	return cl.PublishPep(ctx, NsAvatarData, av.Hash, data, AccessPresence)
+}
+
+// Announce the user's avatar, described by one or more versions of
+// the image, the first of which must be published with
+// PublishAvatarData. With no info, the avatar is disabled.
+func (cl *Client) PublishAvatarMetadata(ctx context.Context,
+	info ...AvatarInfo) error {
+
+	id := "current"
+	if len(info) > 0 {
+		id = info[0].Id
+	}
+	return cl.PublishPep(ctx, NsAvatarMetadata, id,
+		&AvatarMetadata{Info: info}, AccessPresence)
+}
+
+// Publish the user's avatar: its image data, and then the metadata
+// announcing it. The width and height in pixels may be zero if
+// they're unknown.
+func (cl *Client) PublishAvatar(ctx context.Context, av *Avatar,
+	width, height int) error {
+
+	if err := cl.PublishAvatarData(ctx, av); err != nil {
+		return err
+	}
+	return cl.PublishAvatarMetadata(ctx, AvatarInfo{Id: av.Hash,
+		Type: av.Type, Bytes: len(av.Data), Width: width,
+		Height: height})
+}
+
+// A change to a contact's nickname, mood, activity, tune or location,
+// decoded from a PEP notification.
+type PersonalEvent struct {
+	// The contact's bare JID, and the node, such as NsMood.
+	From JID
+	Node string
+	// One of *UserNick, *Mood, *Activity, *Tune or *Geoloc. It's nil
+	// if the item was retracted, or the node deleted or purged,
+	// which clears what it said.
+	Payload interface{}
+}
+
+// The nodes PersonalEvents decodes, and the types of their payloads.
+var personalNodes = map[string]reflect.Type{
+	NsNick:     reflect.TypeOf(UserNick{}),
+	NsMood:     reflect.TypeOf(Mood{}),
+	NsActivity: reflect.TypeOf(Activity{}),
+	NsTune:     reflect.TypeOf(Tune{}),
+	NsGeoloc:   reflect.TypeOf(Geoloc{}),
+}
+
+// Returns the changes a PEP notification from the nickname, mood,
+// activity, tune or location nodes carries, if it's one. Those nodes
+// need to be given to PepNotifyExt for the server to send them. With
+// a pubsub.Manager, the notification's Message has them.
+func (m *Message) PersonalEvents() []PersonalEvent {
+	ev := m.PubsubEvent()
+	if ev == nil {
+		return nil
+	}
+	from := m.From.Bare()
+	var node string
+	switch {
+	case ev.Items != nil:
+		node = ev.Items.Node
+	case ev.Delete != nil:
+		node = ev.Delete.Node
+	case ev.Purge != nil:
+		node = ev.Purge.Node
+	}
+	typ, ok := personalNodes[node]
+	if !ok {
+		return nil
+	}
+	if ev.Items == nil {
+		return []PersonalEvent{{From: from, Node: node}}
+	}
+	var evs []PersonalEvent
+	for _, item := range ev.Items.Items {
+		payload := reflect.New(typ).Interface()
+		if item.Decode(payload) == nil {
+			evs = append(evs, PersonalEvent{From: from, Node: node,
+				Payload: payload})
+		}
+	}
+	if len(ev.Items.Retract) > 0 {
+		evs = append(evs, PersonalEvent{From: from, Node: node})
+	}
+	return evs
+}
@@ -0,0 +1,118 @@
+package xmpp
+
+import (
+	"./forms"
+	"encoding/xml"
+	"testing"
+)
+
+func TestPublishMarshal(t *testing.T) {
+	item, err := NewPubsubItem("current", &UserNick{Nick: "Al"})
+	if err != nil {
+		t.Fatalf("NewPubsubItem: %v", err)
+	}
+	ps := &Pubsub{Publish: &PubsubPublish{Node: NsNick,
+		Items: []PubsubItem{item}},
+		Options: &PubsubOptions{Form: forms.NewSubmit(
+			NsPubsubPublishOptions,
+			map[string]string{"pubsub#access_model": "open"})}}
+	assertMarshal(t, `<pubsub xmlns="`+NsPubsub+`"><publish node="`+
+		NsNick+`"><item id="current"><nick xmlns="`+NsNick+
+		`">Al</nick></item></publish><publish-options>`+
+		`<x xmlns="jabber:x:data" type="submit">`+
+		`<field var="FORM_TYPE" type="hidden"><value>`+
+		NsPubsubPublishOptions+`</value></field>`+
+		`<field var="pubsub#access_model"><value>open</value>`+
+		`</field></x></publish-options></pubsub>`, ps)
+}
+
+func TestMood(t *testing.T) {
+	assertMarshal(t, `<mood xmlns="`+NsMood+`"><happy xmlns="`+NsMood+`"></happy>`+
+		`<text>Yay</text></mood>`, NewMood("happy", "Yay"))
+	var m Mood
+	err := xml.Unmarshal([]byte(`<mood xmlns="`+NsMood+`"><sad/>`+
+		`<text>Boo</text></mood>`), &m)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	assertEquals(t, "sad", m.Name())
+	assertEquals(t, "Boo", m.Text)
+	assertEquals(t, "", NewMood("", "").Name())
+}
+
+func TestPepNotifyExt(t *testing.T) {
+	info := ownDiscoInfo([]Extension{PepNotifyExt(NsNick, NsMood)}, nil)
+	for _, node := range []string{NsNick, NsMood} {
+		if !info.HasFeature(node + "+notify") {
+			t.Errorf("no %s+notify in %v", node, info.Features)
+		}
+	}
+}
+
+func TestActivity(t *testing.T) {
+	assertMarshal(t, `<activity xmlns="`+NsActivity+`"><relaxing xmlns="`+
+		NsActivity+`"><partying xmlns="`+NsActivity+`"></partying>`+
+		`</relaxing><text>Party</text></activity>`,
+		NewActivity("relaxing", "partying", "Party"))
+	var a Activity
+	err := xml.Unmarshal([]byte(`<activity xmlns="`+NsActivity+`">`+
+		`<working><coding/></working></activity>`), &a)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	assertEquals(t, "working", a.General())
+	assertEquals(t, "coding", a.Specific())
+	a = *NewActivity("eating", "", "")
+	assertEquals(t, "", a.Specific())
+}
+
+func TestTuneGeoloc(t *testing.T) {
+	assertMarshal(t, `<tune xmlns="`+NsTune+`"><artist>Yes</artist>`+
+		`<length>686</length><title>Heart of the Sunrise</title></tune>`,
+		&Tune{Artist: "Yes", Length: 686, Title: "Heart of the Sunrise"})
+	if !(&Tune{}).Stopped() || (&Tune{Rating: 3}).Stopped() {
+		t.Errorf("Tune.Stopped wrong")
+	}
+
+	lat, lon := 45.44, 0.0
+	assertMarshal(t, `<geoloc xmlns="`+NsGeoloc+`"><lat>45.44</lat>`+
+		`<lon>0</lon><locality>Venice</locality></geoloc>`,
+		&Geoloc{Lat: &lat, Lon: &lon, Locality: "Venice"})
+	var g Geoloc
+	err := xml.Unmarshal([]byte(`<geoloc xmlns="`+NsGeoloc+`"><lat>1.5</lat>`+
+		`<timestamp>2004-02-19T21:12:00Z</timestamp></geoloc>`), &g)
+	if err != nil || g.Lat == nil || *g.Lat != 1.5 || g.Timestamp == nil ||
+		g.Timestamp.Hour() != 21 {
+		t.Errorf("Unmarshal: %+v %v", g, err)
+	}
+	if g.Stopped() || !(&Geoloc{}).Stopped() {
+		t.Errorf("Geoloc.Stopped wrong")
+	}
+}
+
+func TestPersonalEvents(t *testing.T) {
+	item, _ := NewPubsubItem("current", NewMood("happy", ""))
+	m := &Message{Header: Header{From: "al@b.c/pc", Nested: []interface{}{
+		&PubsubEvent{Items: &PubsubItems{Node: NsMood,
+			Items:   []PubsubItem{item},
+			Retract: []PubsubRetract{{Id: "old"}}}}}}}
+	evs := m.PersonalEvents()
+	if len(evs) != 2 || evs[0].From != "al@b.c" || evs[1].Payload != nil {
+		t.Fatalf("got %+v", evs)
+	}
+	if mood, ok := evs[0].Payload.(*Mood); !ok || mood.Name() != "happy" {
+		t.Errorf("payload %+v", evs[0].Payload)
+	}
+
+	m.Nested = []interface{}{&PubsubEvent{
+		Purge: &PubsubNode{Node: NsTune}}}
+	evs = m.PersonalEvents()
+	if len(evs) != 1 || evs[0].Node != NsTune || evs[0].Payload != nil {
+		t.Errorf("purge: %+v", evs)
+	}
+	m.Nested = []interface{}{&PubsubEvent{Items: &PubsubItems{
+		Node: NsAvatarMetadata, Items: []PubsubItem{item}}}}
+	if evs := m.PersonalEvents(); evs != nil {
+		t.Errorf("avatar: %+v", evs)
+	}
+}
@@ -0,0 +1,181 @@
+package xmpp
+
+// This file contains XMPP Ping, XEP-0199, and a keepalive which uses
+// it to notice dead connections.
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+const NsPing = "urn:xmpp:ping"
+
+type Ping struct {
+	XMLName xml.Name `xml:"urn:xmpp:ping ping"`
+}
+
+// Configures KeepaliveExt.
+type KeepaliveConfig struct {
+	// How often to ping the server while the session is running.
+	// Zero means 1 minute.
+	Interval time.Duration
+	// How long to wait for each answer. Zero means 30 seconds.
+	Timeout time.Duration
+	// The connection is declared dead after this many pings in a
+	// row go unanswered. Zero means 2.
+	MaxMissed int
+	// Send a single space between stanzas instead of a ping. That's
+	// cheaper, and keeps NAT mappings alive, but the server doesn't
+	// answer it, so a dead connection is only noticed when writing
+	// to it fails.
+	Whitespace bool
+}
+
+// Returns an extension which pings the server periodically, so that
+// a connection which has silently died is noticed instead of
+// swallowing what's sent. When it's declared dead, it's treated like
+// any other lost connection: with StreamManagementExt or
+// ReconnectExt, the client resumes or reconnects, and otherwise the
+// session ends with an error.
+func KeepaliveExt(conf KeepaliveConfig) Extension {
+	return Extension{option: func(o *options) {
+		o.keepalive = &conf
+	}}
+}
+
+// Sent between stanzas on its own by a whitespace keepalive.
+type whitespacePing struct{}
+
+// Answers the pings sent to the client.
+type pingResponder struct {
+	Extension
+	toServer chan Stanza
+	sendDone chan bool
+}
+
+func newPingResponder() *pingResponder {
+	pr := &pingResponder{}
+	pr.toServer = make(chan Stanza)
+	pr.sendDone = make(chan bool)
+	pr.StanzaTypes = make(map[xml.Name]reflect.Type)
+	pName := xml.Name{Space: NsPing, Local: "ping"}
+	pr.StanzaTypes[pName] = reflect.TypeOf(Ping{})
+	pr.Features = []string{NsPing}
+	pr.RecvFilter = pr.recvFilter
+	pr.SendFilter = pr.sendFilter
+	return pr
+}
+
+func (pr *pingResponder) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for stan := range in {
+		iq, ok := stan.(*Iq)
+		if !ok || iq.Type != "get" || len(iq.Nested) != 1 {
+			out <- stan
+			continue
+		}
+		if _, ok := iq.Nested[0].(*Ping); !ok {
+			out <- stan
+			continue
+		}
+		reply := &Iq{Header: Header{To: iq.From, Id: iq.Id,
+			Type: "result"}}
+		select {
+		case pr.toServer <- reply:
+		case <-pr.sendDone:
+		}
+	}
+}
+
+func (pr *pingResponder) sendFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	defer close(pr.sendDone)
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			out <- stan
+		case stan := <-pr.toServer:
+			out <- stan
+		}
+	}
+}
+
+// Pings an entity, or the server if to is empty, and returns the
+// round-trip time. An entity which doesn't support pings answers
+// with an error, which is returned; the time is still valid then.
+func (cl *Client) Ping(ctx context.Context, to JID) (time.Duration, error) {
+	if to == "" {
+		to = JID(cl.Jid.Domain())
+	}
+	start := time.Now()
+	iq := &Iq{Header: Header{To: to, Type: "get",
+		Nested: []interface{}{&Ping{}}}}
+	reply, err := cl.SendIq(ctx, iq)
+	rtt := time.Since(start)
+	if reply == nil {
+		return 0, err
+	}
+	return rtt, err
+}
+
+// Pings the server while the session runs, and declares the
+// connection dead when pings go unanswered.
+func (cl *Client) keepalive(conf KeepaliveConfig) {
+	if conf.Interval == 0 {
+		conf.Interval = time.Minute
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = 30 * time.Second
+	}
+	if conf.MaxMissed == 0 {
+		conf.MaxMissed = 2
+	}
+	stat := cl.statmgr.newListener()
+	running := false
+	missed := 0
+	ticker := time.NewTicker(conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case s, ok := <-stat:
+			if !ok || s.Fatal() {
+				return
+			}
+			running = s == StatusRunning
+			missed = 0
+		case <-ticker.C:
+			if !running {
+				continue
+			}
+			if conf.Whitespace {
+				if !cl.trySendRaw(whitespacePing{}) {
+					return
+				}
+				continue
+			}
+			sock := cl.layer1.current()
+			ctx, cancel := context.WithTimeout(context.Background(),
+				conf.Timeout)
+			_, err := cl.Ping(ctx, "")
+			cancel()
+			if !errors.Is(err, context.DeadlineExceeded) {
+				missed = 0
+				continue
+			}
+			missed++
+			if missed >= conf.MaxMissed && sock != nil &&
+				sock == cl.layer1.current() {
+				missed = 0
+				cl.lostConnection(sock, fmt.Errorf(
+					"no answer to %d pings", conf.MaxMissed))
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPingResponder(t *testing.T) {
+	pr := newPingResponder()
+	recvIn := make(chan Stanza)
+	recvOut := make(chan Stanza, 1)
+	go pr.RecvFilter(recvIn, recvOut)
+	sendIn := make(chan Stanza)
+	sendOut := make(chan Stanza)
+	go pr.SendFilter(sendIn, sendOut)
+	defer close(sendIn)
+	defer close(recvIn)
+
+	recvIn <- &Iq{Header: Header{From: "example.com", Id: "p1",
+		Type: "get", Nested: []interface{}{&Ping{}}}}
+	reply := (<-sendOut).(*Iq)
+	assertEquals(t, "example.com", string(reply.To))
+	assertEquals(t, "p1", reply.Id)
+	assertEquals(t, "result", reply.Type)
+}
+
+func TestKeepalive(t *testing.T) {
+	c1, s1 := net.Pipe()
+	defer s1.Close()
+	stanzas := make(chan string, 10)
+	go fakeServer(t, s1, stanzas)
+	redial := func(ctx context.Context) (net.Conn, error) {
+		return nil, context.Canceled
+	}
+	events := make(chan ConnectionEvent, 10)
+
+	jid := JID("user@example.com/res")
+	cl, err := newClient(c1, redial, &jid, "secret", &tls.Config{},
+		[]Extension{KeepaliveExt(KeepaliveConfig{
+			Interval: 20 * time.Millisecond,
+			Timeout:  20 * time.Millisecond}),
+			ReconnectExt(ReconnectConfig{MinBackoff: time.Hour,
+				Events: events})},
+		Presence{}, nil)
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	defer cl.Close()
+	assertEquals(t, "iq", <-stanzas)
+	assertEquals(t, "presence", <-stanzas)
+	// The server never answers the pings.
+	assertEquals(t, "iq", <-stanzas)
+	assertEquals(t, "iq", <-stanzas)
+	select {
+	case ev := <-events:
+		if ev.Online || ev.Err == nil ||
+			!strings.Contains(ev.Err.Error(), "no answer") {
+			t.Errorf("got %+v, want a dead connection", ev)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("connection not declared dead")
+	}
+}
@@ -0,0 +1,120 @@
+package xmpp
+
+// Manages the ordered chains of middleware through which stanzas pass
+// between the application and the filters.
+
+import (
+	"sort"
+	"sync"
+)
+
+// A Middleware is one stage of a client's pipeline. It's called with
+// each stanza, one at a time, and passes the stanza on by calling
+// next, which it may do with a modified or replacement stanza, more
+// than once, or not at all to consume it. Middleware runs on the
+// pipeline's own goroutine, so it mustn't block for long, and mustn't
+// send on the client's Send channel.
+//
+// Unlike a Filter, middleware holds no goroutine and has its place
+// in the chain given by its order, so it can be removed again at any
+// time and the order doesn't depend on when it was added.
+type Middleware func(st Stanza, next func(Stanza))
+
+type pipelineEntry struct {
+	order int
+	seq   uint64
+	m     Middleware
+}
+
+// One chain of middleware. Entries are kept sorted by order, and by
+// the order they were added in among equals.
+type pipeline struct {
+	lock    sync.Mutex
+	entries []pipelineEntry
+	seq     uint64
+}
+
+// Adds middleware to the chain, and returns the function which
+// removes it.
+func (p *pipeline) add(order int, m Middleware) func() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.seq++
+	seq := p.seq
+	entries := append([]pipelineEntry(nil), p.entries...)
+	entries = append(entries, pipelineEntry{order: order, seq: seq, m: m})
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].order < entries[j].order
+	})
+	p.entries = entries
+	return func() { p.remove(seq) }
+}
+
+func (p *pipeline) remove(seq uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, e := range p.entries {
+		if e.seq == seq {
+			entries := append([]pipelineEntry(nil), p.entries[:i]...)
+			p.entries = append(entries, p.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// Passes a stanza through the chain as it is now, and hands whatever
+// comes out of the end to out. The chain is copied on change, so
+// middleware may add or remove middleware while it runs.
+func (p *pipeline) run(st Stanza, out func(Stanza)) {
+	p.lock.Lock()
+	entries := p.entries
+	p.lock.Unlock()
+	var next func(i int) func(Stanza)
+	next = func(i int) func(Stanza) {
+		if i == len(entries) {
+			return out
+		}
+		return func(st Stanza) {
+			if st != nil {
+				entries[i].m(st, next(i+1))
+			}
+		}
+	}
+	next(0)(st)
+}
+
+// Runs the stanzas from in through the chain, and sends what comes
+// out on out. Closes out when in is closed. Once quit is closed, what
+// comes out is dropped rather than waiting for out to be read.
+func (p *pipeline) serve(in <-chan Stanza, out chan<- Stanza,
+	quit <-chan bool) {
+
+	defer close(out)
+	send := func(st Stanza) {
+		select {
+		case out <- st:
+		case <-quit:
+		}
+	}
+	for st := range in {
+		p.run(st, send)
+	}
+}
+
+// AddRecvMiddleware adds middleware to the chain through which
+// incoming stanzas pass after the filters, on their way to Recv.
+// Middleware with a lower order runs first, nearer the network, and
+// middleware of the same order runs in the order it was added. The
+// returned function removes it again.
+func (cl *Client) AddRecvMiddleware(order int, m Middleware) (remove func()) {
+	return cl.recvPipeline.add(order, m)
+}
+
+// AddSendMiddleware adds middleware to the chain through which
+// stanzas from Send pass before they reach the filters. Middleware
+// with a lower order runs first, nearer the application, and
+// middleware of the same order runs in the order it was added. The
+// returned function removes it again.
+func (cl *Client) AddSendMiddleware(order int, m Middleware) (remove func()) {
+	return cl.sendPipeline.add(order, m)
+}
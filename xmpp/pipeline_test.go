@@ -0,0 +1,72 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"testing"
+)
+
+func TestPipeline(t *testing.T) {
+	var p pipeline
+	var trace []string
+	mark := func(name string) Middleware {
+		return func(st Stanza, next func(Stanza)) {
+			trace = append(trace, name)
+			next(st)
+		}
+	}
+	p.add(2, mark("c"))
+	p.add(1, mark("a"))
+	removeB := p.add(1, mark("b"))
+	p.add(3, func(st Stanza, next func(Stanza)) {
+		// Consumes iqs, and doubles messages.
+		if _, ok := st.(*Message); ok {
+			next(st)
+			next(st)
+		}
+	})
+	var out []Stanza
+	collect := func(st Stanza) { out = append(out, st) }
+
+	p.run(&Message{}, collect)
+	assertEquals(t, "[a b c]", fmt.Sprint(trace))
+	assertEquals(t, "2", fmt.Sprint(len(out)))
+
+	trace, out = nil, nil
+	removeB()
+	removeB()
+	p.run(&Iq{}, collect)
+	assertEquals(t, "[a c]", fmt.Sprint(trace))
+	assertEquals(t, "0", fmt.Sprint(len(out)))
+}
+
+func TestClientMiddleware(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	cl := mockClient(t, s, "alice@b.c/pc", "secret", &tls.Config{})
+	defer cl.Close()
+
+	cl.AddSendMiddleware(0, func(st Stanza, next func(Stanza)) {
+		if m, ok := st.(*Message); ok {
+			m.Body = []Text{{Chardata: firstText(m.Body) + "!"}}
+		}
+		next(st)
+	})
+	remove := cl.AddRecvMiddleware(0, func(st Stanza, next func(Stanza)) {
+		if m, ok := st.(*Message); ok && firstText(m.Body) == "drop!" {
+			return
+		}
+		next(st)
+	})
+	for _, body := range []string{"drop", "keep"} {
+		cl.Send <- &Message{Header: Header{To: "b.c"},
+			Body: []Text{{Chardata: body}}}
+	}
+	assertEquals(t, "keep!", firstText(recvMessage(t, cl).Body))
+
+	remove()
+	cl.Send <- &Message{Header: Header{To: "b.c"},
+		Body: []Text{{Chardata: "drop"}}}
+	assertEquals(t, "drop!", firstText(recvMessage(t, cl).Body))
+}
@@ -0,0 +1,228 @@
+package xmpp
+
+// This file contains support for pre-authenticated roster
+// subscriptions, XEP-0379, and the invitation links which carry
+// them, XEP-0401.
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const NsPars = "urn:xmpp:pars:0"
+
+// Included in a subscription request to show the contact invited us.
+type Preauth struct {
+	XMLName xml.Name `xml:"urn:xmpp:pars:0 preauth"`
+	Token   string   `xml:"token,attr"`
+}
+
+// An invitation link, such as
+// xmpp:romeo@example.com?roster;preauth=TOKEN;ibr=y.
+type InviteURI struct {
+	// The inviter.
+	Jid   JID
+	Token string
+	// Can the token also be used to register an account on the
+	// inviter's server?
+	Ibr bool
+}
+
+func (u *InviteURI) String() string {
+	s := "xmpp:" + string(u.Jid) + "?roster;preauth=" +
+		url.QueryEscape(u.Token)
+	if u.Ibr {
+		s += ";ibr=y"
+	}
+	return s
+}
+
+// Parses an invitation link.
+func ParseInviteURI(s string) (*InviteURI, error) {
+	if !strings.HasPrefix(s, "xmpp:") {
+		return nil, fmt.Errorf("not an xmpp URI: %s", s)
+	}
+	s = strings.TrimPrefix(s, "xmpp:")
+	parts := strings.SplitN(s, "?", 2)
+	jid, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	u := &InviteURI{Jid: JID(jid)}
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("no query in %s", s)
+	}
+	params := strings.Split(parts[1], ";")
+	if params[0] != "roster" && params[0] != "register" {
+		return nil, fmt.Errorf("not an invitation: %s", s)
+	}
+	for _, p := range params[1:] {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v, err := url.QueryUnescape(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		switch kv[0] {
+		case "preauth":
+			u.Token = v
+		case "ibr":
+			u.Ibr = v == "y"
+		}
+	}
+	if u.Token == "" {
+		return nil, fmt.Errorf("no preauth token in %s", s)
+	}
+	return u, nil
+}
+
+// PreauthManager is an extension which issues invitation tokens and
+// honours them. A subscription request carrying a valid token is
+// approved, and answered with a subscription request of our own, so
+// one link establishes mutual subscription. Likewise, after Accept,
+// the inviter's subscription request is approved. Handled
+// subscription requests are consumed.
+type PreauthManager struct {
+	Extension
+	toServer chan Stanza
+	done     chan bool
+	lock     sync.Mutex
+	// Outstanding tokens and when they expire.
+	tokens map[string]time.Time
+	// Inviters whose invitations we've accepted.
+	accepted map[JID]bool
+}
+
+// Creates a PreauthManager, to be passed to NewClient among the
+// extensions.
+func NewPreauthManager() *PreauthManager {
+	pm := &PreauthManager{}
+	pm.toServer = make(chan Stanza)
+	pm.done = make(chan bool)
+	pm.tokens = make(map[string]time.Time)
+	pm.accepted = make(map[JID]bool)
+	pm.StanzaTypes = make(map[xml.Name]reflect.Type)
+	pName := xml.Name{Space: NsPars, Local: "preauth"}
+	pm.StanzaTypes[pName] = reflect.TypeOf(Preauth{})
+	pm.RecvFilter = pm.recvFilter
+	pm.SendFilter = pm.sendFilter
+	return pm
+}
+
+// Creates an invitation from the given JID, usually the client's
+// bare JID, whose token is good for one use within the given time.
+func (pm *PreauthManager) NewInvite(jid JID, valid time.Duration) *InviteURI {
+	buf := make([]byte, 18)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	now := time.Now()
+	pm.lock.Lock()
+	// Tokens nobody redeemed would otherwise pile up.
+	for t, exp := range pm.tokens {
+		if !now.Before(exp) {
+			delete(pm.tokens, t)
+		}
+	}
+	pm.tokens[token] = now.Add(valid)
+	pm.lock.Unlock()
+	return &InviteURI{Jid: jid.Bare(), Token: token}
+}
+
+// Accepts an invitation, by asking the inviter for a subscription
+// with its token.
+func (pm *PreauthManager) Accept(u *InviteURI) {
+	pm.lock.Lock()
+	pm.accepted[u.Jid.Bare()] = true
+	pm.lock.Unlock()
+	pm.send(&Presence{Header: Header{To: u.Jid.Bare(), Type: "subscribe",
+		Id: NextId(), Nested: []interface{}{&Preauth{Token: u.Token}}}})
+}
+
+func (pm *PreauthManager) send(st Stanza) {
+	select {
+	case pm.toServer <- st:
+	case <-pm.done:
+	}
+}
+
+// Checks and uses up a token.
+func (pm *PreauthManager) redeem(token string) bool {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	exp, ok := pm.tokens[token]
+	if !ok {
+		return false
+	}
+	delete(pm.tokens, token)
+	return time.Now().Before(exp)
+}
+
+// Decides whether a subscription request is pre-authorized. If it
+// answers an invitation of ours, we subscribe back.
+func (pm *PreauthManager) authorized(p *Presence) (ok, subscribe bool) {
+	for _, ele := range p.Nested {
+		if pa, isPa := ele.(*Preauth); isPa && pm.redeem(pa.Token) {
+			return true, true
+		}
+	}
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	from := p.From.Bare()
+	if pm.accepted[from] {
+		delete(pm.accepted, from)
+		return true, false
+	}
+	return false, false
+}
+
+func (pm *PreauthManager) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	defer close(pm.done)
+	for stan := range in {
+		p, ok := stan.(*Presence)
+		if !ok || p.Type != "subscribe" {
+			out <- stan
+			continue
+		}
+		ok, subscribe := pm.authorized(p)
+		if !ok {
+			out <- stan
+			continue
+		}
+		from := p.From.Bare()
+		go func() {
+			pm.send(&Presence{Header: Header{To: from,
+				Type: "subscribed", Id: NextId()}})
+			if subscribe {
+				pm.send(&Presence{Header: Header{To: from,
+					Type: "subscribe", Id: NextId()}})
+			}
+		}()
+	}
+}
+
+func (pm *PreauthManager) sendFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			out <- stan
+		case stan := <-pm.toServer:
+			out <- stan
+		}
+	}
+}
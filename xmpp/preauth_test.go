@@ -0,0 +1,82 @@
+package xmpp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInviteURI(t *testing.T) {
+	u := &InviteURI{Jid: "romeo@example.com", Token: "a+b", Ibr: true}
+	s := u.String()
+	assertEquals(t, "xmpp:romeo@example.com?roster;preauth=a%2Bb;ibr=y", s)
+	u2, err := ParseInviteURI(s)
+	if err != nil {
+		t.Fatalf("ParseInviteURI: %v", err)
+	}
+	if *u2 != *u {
+		t.Errorf("parsed %#v", u2)
+	}
+	if _, err := ParseInviteURI("xmpp:romeo@example.com?message"); err == nil {
+		t.Errorf("parsed a message URI")
+	}
+}
+
+func TestPreauthManager(t *testing.T) {
+	pm := NewPreauthManager()
+	recvIn := make(chan Stanza)
+	recvOut := make(chan Stanza)
+	go pm.RecvFilter(recvIn, recvOut)
+	sendIn := make(chan Stanza)
+	sendOut := make(chan Stanza)
+	go pm.SendFilter(sendIn, sendOut)
+	defer close(sendIn)
+
+	u := pm.NewInvite("me@b.c/x", time.Hour)
+	assertEquals(t, "me@b.c", string(u.Jid))
+
+	sub := func(from, token string) *Presence {
+		p := &Presence{Header: Header{From: JID(from), Type: "subscribe"}}
+		if token != "" {
+			p.Nested = []interface{}{&Preauth{Token: token}}
+		}
+		return p
+	}
+	recvIn <- sub("al@d.e/f", u.Token)
+	p := (<-sendOut).(*Presence)
+	assertEquals(t, "subscribed", p.Type)
+	assertEquals(t, "al@d.e", string(p.To))
+	p = (<-sendOut).(*Presence)
+	assertEquals(t, "subscribe", p.Type)
+
+	// Tokens are good once.
+	bad := sub("bo@d.e", u.Token)
+	recvIn <- bad
+	if st := <-recvOut; st != bad {
+		t.Errorf("reused token accepted")
+	}
+
+	// Accepting someone else's invitation.
+	go pm.Accept(&InviteURI{Jid: "cy@d.e", Token: "t"})
+	p = (<-sendOut).(*Presence)
+	assertEquals(t, "t", p.Nested[0].(*Preauth).Token)
+	recvIn <- sub("cy@d.e", "")
+	p = (<-sendOut).(*Presence)
+	assertEquals(t, "subscribed", p.Type)
+	assertEquals(t, "cy@d.e", string(p.To))
+
+	close(recvIn)
+	for _ = range recvOut {
+	}
+}
+
+func TestPreauthExpired(t *testing.T) {
+	pm := NewPreauthManager()
+	old := pm.NewInvite("me@b.c", -time.Second)
+	u := pm.NewInvite("me@b.c", time.Hour)
+	if len(pm.tokens) != 1 {
+		t.Errorf("%d tokens outstanding", len(pm.tokens))
+	}
+	if pm.redeem(old.Token) || !pm.redeem(u.Token) {
+		t.Error("wrong tokens redeemed")
+	}
+}
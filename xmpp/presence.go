@@ -0,0 +1,263 @@
+package xmpp
+
+// This file contains a manager for the client's own presence, which
+// can mark the client away when the user is idle.
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Values for the show element of a presence stanza. See RFC 3921,
+// Section 2.2.2.1.
+const (
+	ShowAway = "away"
+	ShowChat = "chat"
+	ShowDnd  = "dnd"
+	ShowXa   = "xa"
+)
+
+// PresenceManager is an extension which keeps track of the
+// presence the application has broadcast, and can send updates to
+// it. If configured with idle periods, it automatically switches
+// the presence to away and then xa when the application reports the
+// user has been idle, and back again when the user becomes active.
+//
+// The initial presence given to NewClient becomes the manager's
+// starting point, as does any later presence without a to address
+// which the application sends itself. When the client reconnects,
+// the managed presence, with any automatic away status, is sent in
+// place of the initial one. Once the client has closed, updates are
+// ignored.
+type PresenceManager struct {
+	Extension
+	awayAfter, xaAfter time.Duration
+	awayStatus         string
+	update             chan func(*Presence)
+	activity           chan time.Time
+	get                chan Presence
+	// Closed when the filter stops.
+	done chan bool
+	lock sync.Mutex
+	// Set before each session's initial presence is sent.
+	restoring bool
+	// The managed presence as it was when the filter stopped.
+	last Presence
+}
+
+// Creates a PresenceManager. If awayAfter (xaAfter) is non-zero, the
+// presence becomes away (xa) after that much idle time. If
+// awayStatus is non-empty, it replaces the status text while the
+// automatic presence is in effect.
+func NewPresenceManager(awayAfter, xaAfter time.Duration,
+	awayStatus string) *PresenceManager {
+
+	pm := &PresenceManager{awayAfter: awayAfter, xaAfter: xaAfter,
+		awayStatus: awayStatus}
+	pm.update = make(chan func(*Presence))
+	pm.activity = make(chan time.Time)
+	pm.get = make(chan Presence)
+	pm.done = make(chan bool)
+	pm.SendFilter = pm.sendFilter
+	pm.BeforePresence = func(*Client) {
+		pm.lock.Lock()
+		defer pm.lock.Unlock()
+		pm.restoring = true
+	}
+	return pm
+}
+
+// Reports whether the next initial presence starts a session, and
+// should be replaced by the one already managed.
+func (pm *PresenceManager) restore() bool {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	r := pm.restoring
+	pm.restoring = false
+	return r
+}
+
+// Applies a change to the managed presence, and broadcasts it.
+func (pm *PresenceManager) change(f func(*Presence)) {
+	select {
+	case pm.update <- f:
+	case <-pm.done:
+	}
+}
+
+// Reports when the user was last active.
+func (pm *PresenceManager) active(t time.Time) {
+	select {
+	case pm.activity <- t:
+	case <-pm.done:
+	}
+}
+
+// Replaces the managed presence, and broadcasts it.
+func (pm *PresenceManager) SetPresence(pr Presence) {
+	pm.change(func(p *Presence) { *p = pr })
+}
+
+// Changes the show and status of the managed presence, and
+// broadcasts it.
+func (pm *PresenceManager) SetStatus(show, status string) {
+	pm.change(func(p *Presence) {
+		p.Show = nil
+		if show != "" {
+			p.Show = &Data{Chardata: show}
+		}
+		p.Status = nil
+		if status != "" {
+			p.Status = []Text{{Chardata: status}}
+		}
+	})
+}
+
+// Changes the priority of the managed presence, and broadcasts it.
+func (pm *PresenceManager) SetPriority(priority int) {
+	pm.change(func(p *Presence) {
+		p.Priority = &Data{Chardata: strconv.Itoa(priority)}
+	})
+}
+
+// Tells the manager the user is active now.
+func (pm *PresenceManager) Activity() {
+	pm.active(time.Now())
+}
+
+// Tells the manager the user has been idle for the given time, as
+// measured by the application.
+func (pm *PresenceManager) Idle(d time.Duration) {
+	pm.active(time.Now().Add(-d))
+}
+
+// Returns the managed presence, not including any automatic away
+// status.
+func (pm *PresenceManager) Presence() Presence {
+	select {
+	case p := <-pm.get:
+		return p
+	case <-pm.done:
+		pm.lock.Lock()
+		defer pm.lock.Unlock()
+		return pm.last
+	}
+}
+
+func (pm *PresenceManager) sendFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	var current Presence
+	defer func() {
+		pm.lock.Lock()
+		pm.last = current
+		pm.lock.Unlock()
+		close(pm.done)
+	}()
+	var have bool
+	// The automatic show value currently in effect, if any.
+	var auto string
+	lastActive := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	// Work out whether the automatic show value needs to change,
+	// and when to check again.
+	check := func() {
+		idle := time.Since(lastActive)
+		want := ""
+		next := time.Duration(0)
+		switch {
+		case pm.xaAfter > 0 && idle >= pm.xaAfter:
+			want = ShowXa
+		case pm.awayAfter > 0 && idle >= pm.awayAfter:
+			want = ShowAway
+			if pm.xaAfter > 0 {
+				next = pm.xaAfter - idle
+			}
+		case pm.awayAfter > 0:
+			next = pm.awayAfter - idle
+		case pm.xaAfter > 0:
+			next = pm.xaAfter - idle
+		}
+		if next > 0 {
+			timer.Reset(next)
+		}
+		if !autoApplies(&current, want) {
+			want = ""
+		}
+		if want != auto && have {
+			auto = want
+			out <- pm.effective(&current, auto)
+		}
+	}
+
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			if p, ok := stan.(*Presence); ok && p.To == "" {
+				switch {
+				case p.Type == "" && pm.restore() && have:
+					// A new session after reconnecting.
+					stan = pm.effective(&current, auto)
+				case p.Type == "":
+					current = *p
+					current.Header = Header{Lang: p.Lang,
+						Nested: p.Nested}
+					have = true
+					auto = ""
+				case p.Type == "unavailable":
+					have = false
+				}
+			}
+			out <- stan
+		case f := <-pm.update:
+			f(&current)
+			have = true
+			auto = ""
+			check()
+			if auto == "" {
+				out <- pm.effective(&current, auto)
+			}
+		case t := <-pm.activity:
+			lastActive = t
+			check()
+		case <-timer.C:
+			check()
+		case pm.get <- current:
+		}
+	}
+}
+
+// Does an automatic show value override the one the application
+// chose? It never overrides do-not-disturb, nor makes the presence
+// more available.
+func autoApplies(p *Presence, auto string) bool {
+	show := ""
+	if p.Show != nil {
+		show = p.Show.Chardata
+	}
+	switch auto {
+	case ShowAway:
+		return show == "" || show == ShowChat
+	case ShowXa:
+		return show == "" || show == ShowChat || show == ShowAway
+	}
+	return false
+}
+
+// Builds the presence stanza to broadcast.
+func (pm *PresenceManager) effective(p *Presence, auto string) *Presence {
+	pr := *p
+	pr.Header = Header{Lang: p.Lang, Id: NextId(), Nested: p.Nested}
+	if auto != "" {
+		pr.Show = &Data{Chardata: auto}
+		if pm.awayStatus != "" {
+			pr.Status = []Text{{Chardata: pm.awayStatus}}
+		}
+	}
+	return &pr
+}
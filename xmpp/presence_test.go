@@ -0,0 +1,75 @@
+package xmpp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutoAway(t *testing.T) {
+	pm := NewPresenceManager(20*time.Millisecond, 40*time.Millisecond,
+		"idle")
+	in := make(chan Stanza)
+	out := make(chan Stanza)
+	go pm.SendFilter(in, out)
+	defer close(in)
+
+	show := func(st Stanza) string {
+		p, ok := st.(*Presence)
+		if !ok {
+			t.Fatalf("not presence: %T", st)
+		}
+		if p.Show == nil {
+			return ""
+		}
+		return p.Show.Chardata
+	}
+
+	in <- &Presence{Status: []Text{{Chardata: "here"}}}
+	assertEquals(t, "", show(<-out))
+	p := <-out
+	assertEquals(t, ShowAway, show(p))
+	assertEquals(t, "idle", p.(*Presence).Status[0].Chardata)
+	assertEquals(t, ShowXa, show(<-out))
+
+	pm.Activity()
+	p = <-out
+	assertEquals(t, "", show(p))
+	assertEquals(t, "here", p.(*Presence).Status[0].Chardata)
+
+	pm.SetStatus(ShowDnd, "busy")
+	assertEquals(t, ShowDnd, show(<-out))
+	pm.Idle(time.Minute)
+	select {
+	case st := <-out:
+		t.Errorf("dnd overridden: %v", st)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assertEquals(t, ShowDnd, pm.Presence().Show.Chardata)
+}
+
+func TestPresenceManagerClosed(t *testing.T) {
+	pm := NewPresenceManager(time.Minute, 0, "")
+	in := make(chan Stanza)
+	out := make(chan Stanza)
+	go pm.SendFilter(in, out)
+	in <- &Presence{Status: []Text{{Chardata: "here"}}}
+	<-out
+	close(in)
+	for range out {
+	}
+
+	done := make(chan bool)
+	go func() {
+		pm.SetStatus(ShowDnd, "busy")
+		pm.SetPriority(5)
+		pm.Activity()
+		pm.Idle(time.Hour)
+		assertEquals(t, "here", pm.Presence().Status[0].Chardata)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked after the filter stopped")
+	}
+}
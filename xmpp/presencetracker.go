@@ -0,0 +1,227 @@
+package xmpp
+
+// This file contains a tracker for the presence of contacts and
+// their resources.
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The last known presence of one resource.
+type ResourcePresence struct {
+	// The full JID.
+	Jid       JID
+	Available bool
+	// The show value, such as ShowAway, or empty if the resource is
+	// simply online.
+	Show     string
+	Status   string
+	Priority int
+	// When presence was last received from the resource, or when
+	// it was sent if the server held it.
+	LastSeen time.Time
+}
+
+// PresenceTracker is an extension which follows the presence
+// broadcast by contacts, and by anyone else the client receives
+// presence from, keeping the state of each of their resources.
+// Resources that go offline are remembered, unavailable, so their
+// last seen time can be looked up.
+type PresenceTracker struct {
+	Extension
+	// Each change to a resource's presence is reported here. If the
+	// application doesn't keep up, changes are discarded. Closed
+	// when the client closes.
+	Changes   <-chan ResourcePresence
+	changes   chan ResourcePresence
+	lock      sync.Mutex
+	resources map[JID]map[string]*ResourcePresence
+	cl        *Client
+}
+
+// Creates a PresenceTracker, to be passed to NewClient among the
+// extensions.
+func NewPresenceTracker() *PresenceTracker {
+	pt := &PresenceTracker{}
+	pt.changes = make(chan ResourcePresence, 16)
+	pt.Changes = pt.changes
+	pt.resources = make(map[JID]map[string]*ResourcePresence)
+	pt.RecvFilter = pt.recvFilter
+	pt.Start = func(cl *Client) {
+		pt.lock.Lock()
+		pt.cl = cl
+		pt.lock.Unlock()
+	}
+	return pt
+}
+
+// Returns what's known of a JID's presence. For a bare JID, that's
+// every resource seen, the available ones first in order of
+// priority. For a full JID, it's just that resource.
+func (pt *PresenceTracker) Lookup(jid JID) []ResourcePresence {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	res := pt.resources[jid.Bare()]
+	var list []ResourcePresence
+	for r, rp := range res {
+		if jid.Resource() == "" || jid.Resource() == r {
+			list = append(list, *rp)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Available != b.Available {
+			return a.Available
+		}
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.Jid < b.Jid
+	})
+	return list
+}
+
+// Is any of the JID's resources available?
+func (pt *PresenceTracker) Available(jid JID) bool {
+	list := pt.Lookup(jid)
+	return len(list) > 0 && list[0].Available
+}
+
+// How eager each show value says a resource is to chat.
+var showRank = map[string]int{ShowChat: 4, "": 3, ShowAway: 2, ShowXa: 1,
+	ShowDnd: 0}
+
+// Returns the available resources of a JID which may be sent a
+// message, the best first: by priority, then by how available the
+// show value says the resource is, then by the most recent presence.
+// Resources with a negative priority are left out, as RFC 6121
+// section 4.7.2.3 says, unless jid names one.
+func (pt *PresenceTracker) candidates(jid JID) []ResourcePresence {
+	var list []ResourcePresence
+	for _, rp := range pt.Lookup(jid) {
+		if rp.Available && (rp.Priority >= 0 || jid.Resource() != "") {
+			list = append(list, rp)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if ra, rb := showRank[a.Show], showRank[b.Show]; ra != rb {
+			return ra > rb
+		}
+		return a.LastSeen.After(b.LastSeen)
+	})
+	return list
+}
+
+// Returns the address to send a message for a contact to. A full JID
+// is returned as it is if that resource is available. Otherwise it's
+// the contact's best available resource, or the bare JID if none is,
+// so the server delivers it as it sees fit, or keeps it offline.
+func (pt *PresenceTracker) Route(jid JID) JID {
+	if jid.Resource() != "" && len(pt.candidates(jid)) > 0 {
+		return jid
+	}
+	if list := pt.candidates(jid.Bare()); len(list) > 0 {
+		return list[0].Jid
+	}
+	return jid.Bare()
+}
+
+// Like Route, but only picks a resource which supports a feature,
+// such as jingle.NsJingle, as reported by its caps or by asking it.
+// If no available resource supports it, the bare JID is returned
+// with found false.
+func (pt *PresenceTracker) RouteFeature(ctx context.Context, cl *Client,
+	jid JID, feature string) (to JID, found bool, err error) {
+
+	list := pt.candidates(jid)
+	if jid.Resource() != "" && len(list) == 0 {
+		list = pt.candidates(jid.Bare())
+	}
+	for _, rp := range list {
+		ok, err := cl.Supports(ctx, rp.Jid, feature)
+		if ctx.Err() != nil {
+			return "", false, ctx.Err()
+		}
+		if err == nil && ok {
+			return rp.Jid, true, nil
+		}
+	}
+	return jid.Bare(), false, nil
+}
+
+func (pt *PresenceTracker) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	defer close(pt.changes)
+	for stan := range in {
+		if p, ok := stan.(*Presence); ok {
+			pt.presence(p)
+		}
+		out <- stan
+	}
+}
+
+func (pt *PresenceTracker) presence(p *Presence) {
+	if p.From == "" {
+		return
+	}
+	var available bool
+	switch p.Type {
+	case "":
+		available = true
+	case "unavailable", "error":
+	default:
+		// Subscription management.
+		return
+	}
+	now := time.Now()
+	if p.Delay != nil && !p.Delay.Stamp.IsZero() {
+		now = p.Delay.Stamp
+	}
+	bare := p.From.Bare()
+	pt.lock.Lock()
+	res := pt.resources[bare]
+	if res == nil {
+		res = make(map[string]*ResourcePresence)
+		pt.resources[bare] = res
+	}
+	var changed []ResourcePresence
+	if p.From.Resource() == "" && !available {
+		// The whole account has gone offline.
+		for _, rp := range res {
+			rp.Available = false
+			rp.LastSeen = now
+			changed = append(changed, *rp)
+		}
+	} else {
+		rp := &ResourcePresence{Jid: p.From, Available: available,
+			LastSeen: now}
+		if available {
+			if p.Show != nil {
+				rp.Show = strings.TrimSpace(p.Show.Chardata)
+			}
+			if p.Priority != nil {
+				rp.Priority, _ = strconv.Atoi(
+					strings.TrimSpace(p.Priority.Chardata))
+			}
+		}
+		rp.Status = clientText(pt.cl, &p.Header, p.Status)
+		res[p.From.Resource()] = rp
+		changed = append(changed, *rp)
+	}
+	pt.lock.Unlock()
+	for _, rp := range changed {
+		select {
+		case pt.changes <- rp:
+		default:
+		}
+	}
+}
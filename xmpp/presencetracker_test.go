@@ -0,0 +1,107 @@
+package xmpp
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPresenceTracker(t *testing.T) {
+	pt := NewPresenceTracker()
+	in := make(chan Stanza)
+	out := make(chan Stanza, 1)
+	go pt.RecvFilter(in, out)
+	send := func(p *Presence) {
+		in <- p
+		<-out
+	}
+	send(&Presence{Header: Header{From: "a@b.c/phone"},
+		Show: &Data{Chardata: "away"}, Priority: &Data{Chardata: "-1"}})
+	send(&Presence{Header: Header{From: "a@b.c/laptop"},
+		Status:   []Text{{Chardata: "here"}},
+		Priority: &Data{Chardata: "5"}})
+	send(&Presence{Header: Header{From: "a@b.c", Type: "subscribe"}})
+
+	list := pt.Lookup("a@b.c")
+	if len(list) != 2 {
+		t.Fatalf("got %v", list)
+	}
+	assertEquals(t, "a@b.c/laptop", string(list[0].Jid))
+	assertEquals(t, "here", list[0].Status)
+	assertEquals(t, "away", list[1].Show)
+	if !pt.Available("a@b.c") {
+		t.Error("should be available")
+	}
+
+	send(&Presence{Header: Header{From: "a@b.c/laptop",
+		Type: "unavailable"}})
+	list = pt.Lookup("a@b.c/laptop")
+	if len(list) != 1 || list[0].Available {
+		t.Fatalf("got %v", list)
+	}
+	assertEquals(t, "a@b.c/phone", string(pt.Lookup("a@b.c")[0].Jid))
+
+	send(&Presence{Header: Header{From: "a@b.c", Type: "unavailable"}})
+	if pt.Available("a@b.c") {
+		t.Error("should be unavailable")
+	}
+	close(in)
+
+	var n int
+	for rp := range pt.Changes {
+		if rp.LastSeen.IsZero() {
+			t.Errorf("no last seen time in %v", rp)
+		}
+		n++
+	}
+	if n != 5 {
+		t.Errorf("got %d changes", n)
+	}
+}
+
+func TestPresenceRoute(t *testing.T) {
+	pt := NewPresenceTracker()
+	in := make(chan Stanza)
+	out := make(chan Stanza, 1)
+	go pt.RecvFilter(in, out)
+	defer close(in)
+	send := func(from, show, prio string) {
+		p := &Presence{Header: Header{From: JID(from)},
+			Priority: &Data{Chardata: prio}}
+		if show != "" {
+			p.Show = &Data{Chardata: show}
+		}
+		in <- p
+		<-out
+	}
+
+	assertEquals(t, "a@b.c", string(pt.Route("a@b.c/phone")))
+	send("a@b.c/bot", "", "-5")
+	// Resources with a negative priority only get what's sent to
+	// them.
+	assertEquals(t, "a@b.c", string(pt.Route("a@b.c")))
+	assertEquals(t, "a@b.c/bot", string(pt.Route("a@b.c/bot")))
+	send("a@b.c/phone", ShowAway, "1")
+	send("a@b.c/laptop", ShowChat, "1")
+	assertEquals(t, "a@b.c/laptop", string(pt.Route("a@b.c")))
+	// An offline resource is routed around.
+	assertEquals(t, "a@b.c/laptop", string(pt.Route("a@b.c/tablet")))
+
+	// Only the phone supports the feature.
+	cl := &Client{caps: newCapsCache()}
+	cl.caps.jids["a@b.c/phone"] = Caps{Ver: "v1"}
+	cl.caps.vers.put("v1", &DiscoInfo{Features: []DiscoFeature{
+		{Var: NsReceipts}}})
+	cl.caps.jids["a@b.c/laptop"] = Caps{Ver: "v2"}
+	cl.caps.vers.put("v2", &DiscoInfo{})
+	ctx := context.Background()
+	to, found, err := pt.RouteFeature(ctx, cl, "a@b.c", NsReceipts)
+	if err != nil || !found {
+		t.Fatalf("RouteFeature: %v %v", found, err)
+	}
+	assertEquals(t, "a@b.c/phone", string(to))
+	to, found, _ = pt.RouteFeature(ctx, cl, "a@b.c", "urn:x")
+	if found {
+		t.Error("no resource has the feature")
+	}
+	assertEquals(t, "a@b.c", string(to))
+}
@@ -0,0 +1,237 @@
+package xmpp
+
+// This file contains support for privacy lists, XEP-0016, which
+// older servers offer instead of the blocking command.
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+const NsPrivacy = "jabber:iq:privacy"
+
+// The kinds of privacy rule, and what they do.
+const (
+	PrivacyJid          = "jid"
+	PrivacyGroup        = "group"
+	PrivacySubscription = "subscription"
+
+	PrivacyAllow = "allow"
+	PrivacyDeny  = "deny"
+)
+
+// A privacy list request or result. The lists in a result which
+// names all the lists have no items.
+type PrivacyQuery struct {
+	XMLName xml.Name      `xml:"jabber:iq:privacy query"`
+	Active  *PrivacyName  `xml:"active"`
+	Default *PrivacyName  `xml:"default"`
+	Lists   []PrivacyList `xml:"list"`
+}
+
+// Names the active or default list. An empty name means none.
+type PrivacyName struct {
+	Name string `xml:"name,attr,omitempty"`
+}
+
+type PrivacyList struct {
+	Name  string        `xml:"name,attr"`
+	Items []PrivacyItem `xml:"item"`
+}
+
+// A rule in a privacy list. Rules are applied in ascending Order,
+// and the first which matches decides. Type is PrivacyJid,
+// PrivacyGroup, or PrivacySubscription, matched against Value; if
+// it's empty, the rule matches everything. If none of the stanza
+// kinds is set, the rule applies to all of them.
+type PrivacyItem struct {
+	Type        string    `xml:"type,attr,omitempty"`
+	Value       string    `xml:"value,attr,omitempty"`
+	Action      string    `xml:"action,attr"`
+	Order       uint      `xml:"order,attr"`
+	Message     *struct{} `xml:"message"`
+	Iq          *struct{} `xml:"iq"`
+	PresenceIn  *struct{} `xml:"presence-in"`
+	PresenceOut *struct{} `xml:"presence-out"`
+}
+
+// PrivacyExt may be included in the extensions passed to NewClient
+// to use the privacy list functions. A PrivacyManager includes it.
+var PrivacyExt Extension = Extension{}
+
+func init() {
+	PrivacyExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	pName := xml.Name{Space: NsPrivacy, Local: "query"}
+	PrivacyExt.StanzaTypes[pName] = reflect.TypeOf(PrivacyQuery{})
+}
+
+// The names of the user's privacy lists, and which of them are
+// active for this session and the default for the account.
+type PrivacyLists struct {
+	Names           []string
+	Active, Default string
+}
+
+func (cl *Client) privacyIq(ctx context.Context, typ string,
+	q *PrivacyQuery) (*PrivacyQuery, error) {
+
+	iq := &Iq{Header: Header{Type: typ, Nested: []interface{}{q}}}
+	reply, err := cl.SendIq(ctx, iq)
+	if err != nil {
+		return nil, err
+	}
+	for _, ele := range reply.Nested {
+		if q, ok := ele.(*PrivacyQuery); ok {
+			return q, nil
+		}
+	}
+	return &PrivacyQuery{}, nil
+}
+
+// Fetches the names of the user's privacy lists.
+func (cl *Client) PrivacyLists(ctx context.Context) (*PrivacyLists, error) {
+	q, err := cl.privacyIq(ctx, "get", &PrivacyQuery{})
+	if err != nil {
+		return nil, err
+	}
+	pl := &PrivacyLists{}
+	for _, l := range q.Lists {
+		pl.Names = append(pl.Names, l.Name)
+	}
+	if q.Active != nil {
+		pl.Active = q.Active.Name
+	}
+	if q.Default != nil {
+		pl.Default = q.Default.Name
+	}
+	return pl, nil
+}
+
+// Fetches a privacy list, with its items in order.
+func (cl *Client) PrivacyList(ctx context.Context, name string) (*PrivacyList,
+	error) {
+
+	q, err := cl.privacyIq(ctx, "get",
+		&PrivacyQuery{Lists: []PrivacyList{{Name: name}}})
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range q.Lists {
+		if l.Name == name {
+			sort.SliceStable(l.Items, func(i, j int) bool {
+				return l.Items[i].Order < l.Items[j].Order
+			})
+			return &l, nil
+		}
+	}
+	return nil, fmt.Errorf("no privacy list %q in reply", name)
+}
+
+// Creates or replaces a privacy list. It must have at least one item.
+func (cl *Client) SetPrivacyList(ctx context.Context, list *PrivacyList) error {
+	if len(list.Items) == 0 {
+		return fmt.Errorf("privacy list %q has no items", list.Name)
+	}
+	_, err := cl.privacyIq(ctx, "set",
+		&PrivacyQuery{Lists: []PrivacyList{*list}})
+	return err
+}
+
+// Removes a privacy list. The server refuses if it's active or the
+// default for another session.
+func (cl *Client) RemovePrivacyList(ctx context.Context, name string) error {
+	_, err := cl.privacyIq(ctx, "set",
+		&PrivacyQuery{Lists: []PrivacyList{{Name: name}}})
+	return err
+}
+
+// Makes a list active for this session. The empty name makes none
+// active.
+func (cl *Client) SetActivePrivacyList(ctx context.Context, name string) error {
+	_, err := cl.privacyIq(ctx, "set",
+		&PrivacyQuery{Active: &PrivacyName{Name: name}})
+	return err
+}
+
+// Makes a list the default for sessions which don't choose one. The
+// empty name makes none the default.
+func (cl *Client) SetDefaultPrivacyList(ctx context.Context, name string) error {
+	_, err := cl.privacyIq(ctx, "set",
+		&PrivacyQuery{Default: &PrivacyName{Name: name}})
+	return err
+}
+
+// PrivacyManager is an extension which acknowledges the server's
+// notices that a privacy list has changed, as clients must, and
+// reports the names of the changed lists.
+type PrivacyManager struct {
+	Extension
+	// The names of lists which were changed by this or another of
+	// the user's sessions. Names are discarded if the channel isn't
+	// ready for them.
+	Changes  <-chan string
+	changes  chan string
+	toServer chan Stanza
+	sendDone chan bool
+}
+
+// Creates a PrivacyManager, to be passed to NewClient among the
+// extensions.
+func NewPrivacyManager() *PrivacyManager {
+	pm := &PrivacyManager{}
+	pm.changes = make(chan string, 16)
+	pm.Changes = pm.changes
+	pm.toServer = make(chan Stanza)
+	pm.sendDone = make(chan bool)
+	pm.StanzaTypes = PrivacyExt.StanzaTypes
+	pm.RecvFilter = pm.recvFilter
+	pm.SendFilter = pm.sendFilter
+	return pm
+}
+
+func (pm *PrivacyManager) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for stan := range in {
+		iq, ok := stan.(*Iq)
+		if !ok || iq.Type != "set" || iq.From != "" ||
+			len(iq.Nested) != 1 {
+			out <- stan
+			continue
+		}
+		q, ok := iq.Nested[0].(*PrivacyQuery)
+		if !ok {
+			out <- stan
+			continue
+		}
+		for _, l := range q.Lists {
+			select {
+			case pm.changes <- l.Name:
+			default:
+			}
+		}
+		reply := &Iq{Header: Header{Id: iq.Id, Type: "result"}}
+		select {
+		case pm.toServer <- reply:
+		case <-pm.sendDone:
+		}
+	}
+}
+
+func (pm *PrivacyManager) sendFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	defer close(pm.sendDone)
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			out <- stan
+		case stan := <-pm.toServer:
+			out <- stan
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package xmpp
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPrivacyList(t *testing.T) {
+	send := make(chan Stanza, 1)
+	cl := &Client{handlers: make(chan *callback, 1), Send: send}
+	go func() {
+		h := <-cl.handlers
+		iq := (<-send).(*Iq)
+		assertMarshal(t, `<query xmlns="`+NsPrivacy+`"><list name="p">`+
+			`</list></query>`, iq.Nested[0])
+		h.f(&Iq{Header: Header{Id: iq.Id, Type: "result",
+			Nested: []interface{}{&PrivacyQuery{Lists: []PrivacyList{{
+				Name: "p", Items: []PrivacyItem{
+					{Action: PrivacyDeny, Order: 9},
+					{Type: PrivacyJid, Value: "a@b.c",
+						Action: PrivacyAllow, Order: 2,
+						Message: &struct{}{}},
+				}}}}}}})
+	}()
+	l, err := cl.PrivacyList(context.Background(), "p")
+	if err != nil {
+		t.Fatalf("PrivacyList: %v", err)
+	}
+	if len(l.Items) != 2 || l.Items[0].Value != "a@b.c" ||
+		l.Items[0].Message == nil {
+		t.Fatalf("items %+v", l.Items)
+	}
+
+	if err := cl.SetPrivacyList(context.Background(),
+		&PrivacyList{Name: "q"}); err == nil {
+		t.Error("set an empty list")
+	}
+	go func() {
+		h := <-cl.handlers
+		iq := (<-send).(*Iq)
+		assertMarshal(t, `<query xmlns="`+NsPrivacy+`"><active>`+
+			`</active></query>`, iq.Nested[0])
+		h.f(&Iq{Header: Header{Id: iq.Id, Type: "result"}})
+	}()
+	if err := cl.SetActivePrivacyList(context.Background(), ""); err != nil {
+		t.Errorf("SetActivePrivacyList: %v", err)
+	}
+}
+
+func TestPrivacyManager(t *testing.T) {
+	pm := NewPrivacyManager()
+	recvIn := make(chan Stanza)
+	recvOut := make(chan Stanza, 1)
+	go pm.RecvFilter(recvIn, recvOut)
+	sendIn := make(chan Stanza)
+	sendOut := make(chan Stanza)
+	go pm.SendFilter(sendIn, sendOut)
+	defer close(sendIn)
+	defer close(recvIn)
+
+	recvIn <- &Iq{Header: Header{Id: "p1", Type: "set",
+		Nested: []interface{}{&PrivacyQuery{Lists: []PrivacyList{{
+			Name: "work"}}}}}}
+	reply := (<-sendOut).(*Iq)
+	assertEquals(t, "p1", reply.Id)
+	assertEquals(t, "result", reply.Type)
+	assertEquals(t, "work", <-pm.Changes)
+
+	// Pushes from anyone but the server pass through.
+	recvIn <- &Iq{Header: Header{From: "x@b.c", Id: "p2", Type: "set",
+		Nested: []interface{}{&PrivacyQuery{}}}}
+	<-recvOut
+}
@@ -0,0 +1,182 @@
+package xmpp
+
+// This file contains connecting to the server through a Dialer of the
+// application's choosing, and dialers for SOCKS5 and HTTP proxies.
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Dialer makes the connections to the server. *net.Dialer is one, and
+// so are the dialers of golang.org/x/net/proxy, which implement
+// proxy.ContextDialer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn,
+		error)
+}
+
+// Makes a Dialer of a function.
+type DialerFunc func(ctx context.Context, network, addr string) (net.Conn,
+	error)
+
+func (f DialerFunc) DialContext(ctx context.Context, network,
+	addr string) (net.Conn, error) {
+
+	return f(ctx, network, addr)
+}
+
+// Returns an extension which has NewClient, NewClientFromHost and the
+// client's reconnections connect with the given Dialer. SRV records
+// are still looked up locally, but the host names they give are
+// passed to the Dialer unresolved, so a proxy can resolve them
+// itself.
+func DialerExt(d Dialer) Extension {
+	return Extension{option: func(o *options) {
+		o.dialer = d
+	}}
+}
+
+// Makes a TCP connection to addr, with the Dialer if there is one.
+func dialWith(ctx context.Context, d Dialer, addr string) (net.Conn, error) {
+	if d == nil {
+		return dialTCP(ctx, addr)
+	}
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// Returns a Dialer which connects through the SOCKS5 proxy at
+// proxyAddr, logging in with user and password if user isn't empty.
+// RFC 1928 and RFC 1929. The proxy resolves host names, as Tor needs.
+// The proxy is reached with forward, or directly if it's nil.
+func Socks5Proxy(proxyAddr, user, password string, forward Dialer) Dialer {
+	return DialerFunc(func(ctx context.Context, network,
+		addr string) (net.Conn, error) {
+
+		host, port, err := splitPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialWith(ctx, forward, proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		err = withDeadline(ctx, conn, func() error {
+			return socks5Negotiate(conn, user, password, host, port)
+		})
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("socks5 %s: %v", proxyAddr, err)
+		}
+		return conn, nil
+	})
+}
+
+// Returns a Dialer which connects through the HTTP proxy at
+// proxyAddr with the CONNECT method, logging in with basic
+// authentication if user isn't empty. The proxy is reached with
+// forward, or directly if it's nil.
+func HttpProxy(proxyAddr, user, password string, forward Dialer) Dialer {
+	return DialerFunc(func(ctx context.Context, network,
+		addr string) (net.Conn, error) {
+
+		conn, err := dialWith(ctx, forward, proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		var res net.Conn
+		err = withDeadline(ctx, conn, func() error {
+			var err error
+			res, err = httpConnect(conn, addr, user, password)
+			return err
+		})
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("http proxy %s: %v", proxyAddr, err)
+		}
+		return res, nil
+	})
+}
+
+// Splits an address into a host and a numeric port.
+func splitPort(addr string) (string, uint16, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("bad port in %s", addr)
+	}
+	return host, uint16(p), nil
+}
+
+// Runs f with the connection's deadline set to the context's, and the
+// connection closed if the context is cancelled first.
+func withDeadline(ctx context.Context, conn net.Conn, f func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	err := f()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Asks an HTTP proxy to connect to addr.
+func httpConnect(conn net.Conn, addr, user, password string) (net.Conn,
+	error) {
+
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if user != "" {
+		req += "Proxy-Authorization: Basic " +
+			base64.StdEncoding.EncodeToString([]byte(user+":"+
+				password)) + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	if r.Buffered() > 0 {
+		// The server spoke already.
+		return &bufferedConn{conn, r}, nil
+	}
+	return conn, nil
+}
+
+// A connection with some of what it's received already read into a
+// buffer.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
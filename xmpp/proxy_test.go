@@ -0,0 +1,133 @@
+package xmpp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// Returns a Dialer which hands one end of a pipe to serve, and the
+// other to whoever dials.
+func pipeDialer(serve func(conn net.Conn)) Dialer {
+	return DialerFunc(func(ctx context.Context, network,
+		addr string) (net.Conn, error) {
+
+		c, s := net.Pipe()
+		go func() {
+			defer s.Close()
+			serve(s)
+		}()
+		return c, nil
+	})
+}
+
+func TestSocks5Proxy(t *testing.T) {
+	dst := make(chan string, 1)
+	d := Socks5Proxy("proxy:1080", "user", "pass", pipeDialer(
+		func(conn net.Conn) {
+			buf := make([]byte, 3)
+			io.ReadFull(conn, buf)
+			if buf[2] != 2 {
+				t.Errorf("auth method %d", buf[2])
+			}
+			conn.Write([]byte{5, 2})
+			buf = make([]byte, 2+4+1+4)
+			io.ReadFull(conn, buf)
+			assertEquals(t, "user pass", string(buf[2:6])+" "+
+				string(buf[7:]))
+			conn.Write([]byte{1, 0})
+
+			buf = make([]byte, 5)
+			io.ReadFull(conn, buf)
+			if buf[3] != 3 {
+				t.Errorf("address type %d", buf[3])
+			}
+			addr := make([]byte, int(buf[4])+2)
+			io.ReadFull(conn, addr)
+			n := len(addr) - 2
+			port := int(addr[n])<<8 | int(addr[n+1])
+			dst <- net.JoinHostPort(string(addr[:n]),
+				strconv.Itoa(port))
+			conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			conn.Write([]byte("hi"))
+		}))
+	conn, err := d.DialContext(context.Background(), "tcp",
+		"xmpp.example.com:5222")
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	defer conn.Close()
+	// The proxy resolves the name.
+	assertEquals(t, "xmpp.example.com:5222", <-dst)
+	buf := make([]byte, 2)
+	io.ReadFull(conn, buf)
+	assertEquals(t, "hi", string(buf))
+}
+
+func TestHttpProxy(t *testing.T) {
+	serve := func(status string) Dialer {
+		return pipeDialer(func(conn net.Conn) {
+			req, err := http.ReadRequest(bufio.NewReader(conn))
+			if err != nil {
+				t.Errorf("ReadRequest: %v", err)
+				return
+			}
+			assertEquals(t, "CONNECT xmpp.example.com:5222",
+				req.Method+" "+req.Host)
+			user, pass, _ := parseProxyAuth(req)
+			assertEquals(t, "user pass", user+" "+pass)
+			// What the server sends may arrive along with
+			// the proxy's answer.
+			conn.Write([]byte("HTTP/1.1 " + status + "\r\n\r\nhi"))
+		})
+	}
+
+	conn, err := HttpProxy("proxy:3128", "user", "pass",
+		serve("200 Connection established")).DialContext(
+		context.Background(), "tcp", "xmpp.example.com:5222")
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	buf := make([]byte, 2)
+	io.ReadFull(conn, buf)
+	assertEquals(t, "hi", string(buf))
+	conn.Close()
+
+	if _, err := HttpProxy("proxy:3128", "user", "pass",
+		serve("403 Forbidden")).DialContext(context.Background(),
+		"tcp", "xmpp.example.com:5222"); err == nil {
+		t.Error("the proxy refused, but no error")
+	}
+}
+
+// Reads a request's basic proxy authentication.
+func parseProxyAuth(req *http.Request) (user, pass string, ok bool) {
+	r := &http.Request{Header: http.Header{
+		"Authorization": req.Header["Proxy-Authorization"]}}
+	return r.BasicAuth()
+}
+
+func TestDialerExt(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	var dialed string
+	d := DialerFunc(func(ctx context.Context, network,
+		addr string) (net.Conn, error) {
+		dialed = addr
+		return s.Dial(), nil
+	})
+	jid := JID("alice@b.c/pc")
+	cl, err := NewClientFromHost(&jid, "secret", &tls.Config{},
+		[]Extension{DialerExt(d)}, Presence{}, nil, "xmpp.b.c", 5222)
+	if err != nil {
+		t.Fatalf("NewClientFromHost: %v", err)
+	}
+	defer cl.Close()
+	assertEquals(t, "xmpp.b.c:5222", dialed)
+}
@@ -0,0 +1,225 @@
+package xmpp
+
+// This file contains support for publish-subscribe, XEP-0060: its
+// protocol elements, and the requests PEP and the other XEPs built
+// on it need. Subscriptions and node management are in the pubsub
+// subpackage.
+
+import (
+	"./forms"
+	"context"
+	"encoding/xml"
+	"reflect"
+)
+
+const (
+	NsPubsub               = "http://jabber.org/protocol/pubsub"
+	NsPubsubEvent          = "http://jabber.org/protocol/pubsub#event"
+	NsPubsubOwner          = "http://jabber.org/protocol/pubsub#owner"
+	NsPubsubPublishOptions = "http://jabber.org/protocol/pubsub#publish-options"
+	NsPubsubNodeConfig     = "http://jabber.org/protocol/pubsub#node_config"
+)
+
+// A pubsub request or result, carried in an iq.
+type Pubsub struct {
+	XMLName      xml.Name            `xml:"http://jabber.org/protocol/pubsub pubsub"`
+	Items        *PubsubItems        `xml:"items"`
+	Subscribe    *PubsubSubscribe    `xml:"subscribe"`
+	Unsubscribe  *PubsubSubscribe    `xml:"unsubscribe"`
+	Subscription *PubsubSubscription `xml:"subscription"`
+	Publish      *PubsubPublish      `xml:"publish"`
+	Options      *PubsubOptions      `xml:"publish-options"`
+	Retract      *PubsubRetraction   `xml:"retract"`
+	Create       *PubsubNode         `xml:"create"`
+	Configure    *PubsubOptions      `xml:"configure"`
+}
+
+// A request which only the owner of a node may make.
+type PubsubOwner struct {
+	XMLName xml.Name    `xml:"http://jabber.org/protocol/pubsub#owner pubsub"`
+	Delete  *PubsubNode `xml:"delete"`
+	Purge   *PubsubNode `xml:"purge"`
+}
+
+// Names a node.
+type PubsubNode struct {
+	Node string `xml:"node,attr,omitempty"`
+}
+
+// A notification of changes to a node, carried in a message: items
+// were published or retracted, or the node was deleted or purged of
+// all its items.
+type PubsubEvent struct {
+	XMLName xml.Name     `xml:"http://jabber.org/protocol/pubsub#event event"`
+	Items   *PubsubItems `xml:"items"`
+	Delete  *PubsubNode  `xml:"delete"`
+	Purge   *PubsubNode  `xml:"purge"`
+}
+
+// Items belonging to a node: the result of a request, or the
+// published and retracted items in a notification.
+type PubsubItems struct {
+	Node    string          `xml:"node,attr"`
+	Items   []PubsubItem    `xml:"item"`
+	Retract []PubsubRetract `xml:"retract"`
+}
+
+// A published item. Its payload is kept as raw XML; use Decode to
+// unmarshal it.
+type PubsubItem struct {
+	Id      string `xml:"id,attr,omitempty"`
+	Payload string `xml:",innerxml"`
+}
+
+type PubsubRetract struct {
+	Id string `xml:"id,attr"`
+}
+
+// A request to delete items from a node. If Notify is set,
+// subscribers are told.
+type PubsubRetraction struct {
+	Node   string       `xml:"node,attr"`
+	Notify bool         `xml:"notify,attr,omitempty"`
+	Items  []PubsubItem `xml:"item"`
+}
+
+// A request to publish items to a node, or the result, which gives
+// the ids the service assigned.
+type PubsubPublish struct {
+	Node  string       `xml:"node,attr"`
+	Items []PubsubItem `xml:"item"`
+}
+
+// Preconditions for publishing, such as pubsub#access_model. If the
+// node doesn't exist it's created with these options, and if it does
+// they must match its configuration.
+type PubsubOptions struct {
+	Form *forms.Form
+}
+
+// A request to subscribe to, or unsubscribe from, a node.
+type PubsubSubscribe struct {
+	Node  string `xml:"node,attr"`
+	Jid   JID    `xml:"jid,attr"`
+	SubId string `xml:"subid,attr,omitempty"`
+}
+
+// The state of a subscription to a node. Subscription is one of
+// none, pending, unconfigured, or subscribed.
+type PubsubSubscription struct {
+	Node         string `xml:"node,attr,omitempty"`
+	Jid          JID    `xml:"jid,attr"`
+	SubId        string `xml:"subid,attr,omitempty"`
+	Subscription string `xml:"subscription,attr,omitempty"`
+}
+
+// PubsubExt may be included in the extensions passed to NewClient to
+// decode pubsub results and event notifications.
+var PubsubExt Extension = Extension{}
+
+func init() {
+	PubsubExt.StanzaTypes = pubsubStanzaTypes()
+}
+
+// Returns the pubsub payload types. Other files' init functions may
+// run first, so they use this rather than PubsubExt.
+func pubsubStanzaTypes() map[xml.Name]reflect.Type {
+	types := make(map[xml.Name]reflect.Type)
+	pName := xml.Name{Space: NsPubsub, Local: "pubsub"}
+	types[pName] = reflect.TypeOf(Pubsub{})
+	pName = xml.Name{Space: NsPubsubEvent, Local: "event"}
+	types[pName] = reflect.TypeOf(PubsubEvent{})
+	pName = xml.Name{Space: NsPubsubOwner, Local: "pubsub"}
+	types[pName] = reflect.TypeOf(PubsubOwner{})
+	return types
+}
+
+// Creates an item with the given payload, which is marshaled to XML.
+func NewPubsubItem(id string, payload interface{}) (PubsubItem, error) {
+	buf, err := xml.Marshal(payload)
+	if err != nil {
+		return PubsubItem{}, err
+	}
+	return PubsubItem{Id: id, Payload: string(buf)}, nil
+}
+
+// Unmarshals the item's payload.
+func (it *PubsubItem) Decode(v interface{}) error {
+	return xml.Unmarshal([]byte(it.Payload), v)
+}
+
+// Returns the pubsub event notification carried by a message, if
+// any.
+func (m *Message) PubsubEvent() *PubsubEvent {
+	for _, ele := range m.Nested {
+		if ev, ok := ele.(*PubsubEvent); ok {
+			return ev
+		}
+	}
+	return nil
+}
+
+// Fetch the items of a node from a pubsub service, or only those with
+// the given ids. An empty service means the user's own account, for
+// PEP nodes.
+func (cl *Client) PubsubItems(ctx context.Context, service JID,
+	node string, ids ...string) ([]PubsubItem, error) {
+
+	req := &PubsubItems{Node: node}
+	for _, id := range ids {
+		req.Items = append(req.Items, PubsubItem{Id: id})
+	}
+	iq := &Iq{Header: Header{To: service, Type: "get",
+		Nested: []interface{}{&Pubsub{Items: req}}}}
+	reply, err := cl.SendIq(ctx, iq)
+	if err != nil {
+		return nil, err
+	}
+	for _, ele := range reply.Nested {
+		if ps, ok := ele.(*Pubsub); ok && ps.Items != nil {
+			return ps.Items.Items, nil
+		}
+	}
+	return nil, nil
+}
+
+// Publish an item to a node, with publish-options if options is
+// non-empty. An empty service means the user's own account, for PEP
+// nodes. Returns the id of the item, which the service assigns if
+// the item had none.
+func (cl *Client) Publish(ctx context.Context, service JID, node string,
+	item PubsubItem, options map[string]string) (string, error) {
+
+	ps := &Pubsub{Publish: &PubsubPublish{Node: node,
+		Items: []PubsubItem{item}}}
+	if len(options) > 0 {
+		ps.Options = &PubsubOptions{Form: forms.NewSubmit(
+			NsPubsubPublishOptions, options)}
+	}
+	iq := &Iq{Header: Header{To: service, Type: "set",
+		Nested: []interface{}{ps}}}
+	reply, err := cl.SendIq(ctx, iq)
+	if err != nil {
+		return "", err
+	}
+	for _, ele := range reply.Nested {
+		if ps, ok := ele.(*Pubsub); ok && ps.Publish != nil &&
+			len(ps.Publish.Items) > 0 {
+			return ps.Publish.Items[0].Id, nil
+		}
+	}
+	return item.Id, nil
+}
+
+// Retracts an item from a node. If notify is set, subscribers are
+// told it's gone.
+func (cl *Client) Retract(ctx context.Context, service JID, node,
+	id string, notify bool) error {
+
+	req := &PubsubRetraction{Node: node, Notify: notify,
+		Items: []PubsubItem{{Id: id}}}
+	iq := &Iq{Header: Header{To: service, Type: "set",
+		Nested: []interface{}{&Pubsub{Retract: req}}}}
+	_, err := cl.SendIq(ctx, iq)
+	return err
+}
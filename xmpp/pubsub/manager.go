@@ -0,0 +1,218 @@
+package pubsub
+
+// This file contains a manager for pubsub subscriptions, which routes
+// event notifications to handlers by node.
+
+import (
+	".."
+	"context"
+	"fmt"
+	"sync"
+)
+
+// A pubsub event notification, as delivered to a handler.
+type Notification struct {
+	// The service, or for PEP the user's bare JID.
+	From xmpp.JID
+	Node string
+	// Published items, and the ids of retracted ones.
+	Items   []xmpp.PubsubItem
+	Retract []string
+	// Set if the node was deleted, or if all its items were.
+	Deleted, Purged bool
+	// The stanza the notification was taken from.
+	Message *xmpp.Message
+}
+
+type subKey struct {
+	service xmpp.JID
+	node    string
+}
+
+// Manager is an extension which keeps track of the client's
+// pubsub subscriptions, and routes event notifications to handlers by
+// node name. Notifications for a node with a handler are consumed,
+// and don't appear on Client.Recv.
+//
+// The same Manager may be given to a new Client after a
+// disconnection; it subscribes again to everything it was subscribed
+// to once the new session is running.
+type Manager struct {
+	xmpp.Extension
+	lock sync.Mutex
+	// The client's SendIq and bare JID, once it's started.
+	sendIq   sendIq
+	jid      xmpp.JID
+	handlers map[string]func(*Notification)
+	subs     map[subKey]xmpp.PubsubSubscription
+}
+
+// Creates a Manager, to be passed to xmpp.NewClient among the
+// extensions.
+func NewManager() *Manager {
+	pm := &Manager{}
+	pm.handlers = make(map[string]func(*Notification))
+	pm.subs = make(map[subKey]xmpp.PubsubSubscription)
+	pm.StanzaTypes = xmpp.PubsubExt.StanzaTypes
+	pm.RecvFilter = pm.recvFilter
+	pm.Start = pm.start
+	return pm
+}
+
+// Registers a function to be called with notifications from the
+// given node, from any service. This includes PEP nodes, for which
+// no explicit subscription is needed. A nil function removes the
+// handler. Handlers are called from the client's receive path, so
+// they should return promptly.
+func (pm *Manager) Handle(node string, f func(*Notification)) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	if f == nil {
+		delete(pm.handlers, node)
+	} else {
+		pm.handlers[node] = f
+	}
+}
+
+// Subscribes the client's bare JID to a node, and remembers the
+// subscription so it can be renewed after reconnection.
+func (pm *Manager) Subscribe(ctx context.Context, service xmpp.JID,
+	node string) error {
+
+	send, jid, err := pm.client()
+	if err != nil {
+		return err
+	}
+	sub, err := subscribe(ctx, send, jid, service, node)
+	if err != nil {
+		return err
+	}
+	pm.lock.Lock()
+	pm.subs[subKey{service, node}] = *sub
+	pm.lock.Unlock()
+	return nil
+}
+
+// Unsubscribes from a node, and forgets the subscription.
+func (pm *Manager) Unsubscribe(ctx context.Context, service xmpp.JID,
+	node string) error {
+
+	send, jid, err := pm.client()
+	if err != nil {
+		return err
+	}
+	k := subKey{service, node}
+	pm.lock.Lock()
+	sub := pm.subs[k]
+	delete(pm.subs, k)
+	pm.lock.Unlock()
+	return unsubscribe(ctx, send, jid, service, node, sub.SubId)
+}
+
+// Returns a channel on which notifications from the given node are
+// delivered, in place of any handler. Notifications are discarded
+// if the channel isn't ready for them.
+func (pm *Manager) Notifications(node string) <-chan *Notification {
+	ch := make(chan *Notification, 16)
+	pm.Handle(node, func(n *Notification) {
+		select {
+		case ch <- n:
+		default:
+		}
+	})
+	return ch
+}
+
+// Returns the subscriptions the manager is keeping, by service and
+// node.
+func (pm *Manager) Subscriptions() map[xmpp.JID][]xmpp.PubsubSubscription {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	res := make(map[xmpp.JID][]xmpp.PubsubSubscription)
+	for k, sub := range pm.subs {
+		res[k.service] = append(res[k.service], sub)
+	}
+	return res
+}
+
+func (pm *Manager) client() (sendIq, xmpp.JID, error) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	if pm.sendIq == nil {
+		return nil, "", fmt.Errorf("pubsub manager not started")
+	}
+	return pm.sendIq, pm.jid, nil
+}
+
+// Renews the remembered subscriptions on a new session.
+func (pm *Manager) start(cl *xmpp.Client) {
+	pm.lock.Lock()
+	pm.sendIq = cl.SendIq
+	pm.jid = cl.Jid.Bare()
+	pm.lock.Unlock()
+	pm.renew()
+}
+
+// Subscribes again to everything the manager remembers.
+func (pm *Manager) renew() {
+	pm.lock.Lock()
+	send, jid := pm.sendIq, pm.jid
+	var keys []subKey
+	for k := range pm.subs {
+		keys = append(keys, k)
+	}
+	pm.lock.Unlock()
+	for _, k := range keys {
+		sub, err := subscribe(context.Background(), send, jid,
+			k.service, k.node)
+		pm.lock.Lock()
+		if _, ok := pm.subs[k]; ok && err == nil {
+			pm.subs[k] = *sub
+		}
+		pm.lock.Unlock()
+	}
+}
+
+func (pm *Manager) recvFilter(in <-chan xmpp.Stanza, out chan<- xmpp.Stanza) {
+	defer close(out)
+	for stan := range in {
+		if m, ok := stan.(*xmpp.Message); ok && pm.route(m) {
+			continue
+		}
+		out <- stan
+	}
+}
+
+// Passes a notification to its node's handler. Returns false if
+// there is none.
+func (pm *Manager) route(m *xmpp.Message) bool {
+	ev := m.PubsubEvent()
+	if ev == nil {
+		return false
+	}
+	n := &Notification{From: m.From, Message: m}
+	switch {
+	case ev.Items != nil:
+		n.Node = ev.Items.Node
+		n.Items = ev.Items.Items
+		for _, r := range ev.Items.Retract {
+			n.Retract = append(n.Retract, r.Id)
+		}
+	case ev.Delete != nil:
+		n.Node = ev.Delete.Node
+		n.Deleted = true
+	case ev.Purge != nil:
+		n.Node = ev.Purge.Node
+		n.Purged = true
+	default:
+		return false
+	}
+	pm.lock.Lock()
+	f := pm.handlers[n.Node]
+	pm.lock.Unlock()
+	if f == nil {
+		return false
+	}
+	f(n)
+	return true
+}
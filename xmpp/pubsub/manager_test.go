@@ -0,0 +1,110 @@
+package pubsub
+
+import (
+	".."
+	"context"
+	"testing"
+)
+
+func assertEquals(t *testing.T, expected, observed string) {
+	t.Helper()
+	if expected != observed {
+		t.Errorf("expected:\n%s\nobserved:\n%s", expected, observed)
+	}
+}
+
+func TestManagerRoute(t *testing.T) {
+	pm := NewManager()
+	var got []*Notification
+	pm.Handle("n", func(n *Notification) { got = append(got, n) })
+
+	in := make(chan xmpp.Stanza)
+	out := make(chan xmpp.Stanza)
+	go pm.RecvFilter(in, out)
+
+	msg := func(node string) *xmpp.Message {
+		items := &xmpp.PubsubItems{Node: node,
+			Items:   []xmpp.PubsubItem{{Id: "1", Payload: `<x xmlns="y"/>`}},
+			Retract: []xmpp.PubsubRetract{{Id: "2"}}}
+		return &xmpp.Message{Header: xmpp.Header{From: "svc",
+			Nested: []interface{}{&xmpp.PubsubEvent{Items: items}}}}
+	}
+
+	in <- msg("other")
+	if m, ok := (<-out).(*xmpp.Message); !ok || m.From != "svc" {
+		t.Errorf("unhandled node not passed on: %v", m)
+	}
+	in <- msg("n")
+	in <- &xmpp.Iq{}
+	if _, ok := (<-out).(*xmpp.Iq); !ok {
+		t.Errorf("expected iq")
+	}
+	close(in)
+	for _ = range out {
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("got %d notifications", len(got))
+	}
+	assertEquals(t, "svc", string(got[0].From))
+	assertEquals(t, "1", got[0].Items[0].Id)
+	assertEquals(t, "2", got[0].Retract[0])
+}
+
+func TestNotifications(t *testing.T) {
+	pm := NewManager()
+	ch := pm.Notifications("n")
+	in := make(chan xmpp.Stanza)
+	out := make(chan xmpp.Stanza)
+	go pm.RecvFilter(in, out)
+	defer close(in)
+
+	in <- &xmpp.Message{Header: xmpp.Header{From: "svc",
+		Nested: []interface{}{&xmpp.PubsubEvent{
+			Delete: &xmpp.PubsubNode{Node: "n"}}}}}
+	in <- &xmpp.Message{Header: xmpp.Header{From: "svc",
+		Nested: []interface{}{&xmpp.PubsubEvent{
+			Purge: &xmpp.PubsubNode{Node: "other"}}}}}
+	<-out
+	n := <-ch
+	if !n.Deleted || n.Node != "n" || n.From != "svc" {
+		t.Errorf("notification %+v", n)
+	}
+}
+
+func TestManagerRenew(t *testing.T) {
+	pm := NewManager()
+	var asked []string
+	pm.sendIq = func(ctx context.Context, iq *xmpp.Iq) (*xmpp.Iq, error) {
+		ps := iq.Nested[0].(*xmpp.Pubsub)
+		if ps.Subscribe != nil {
+			asked = append(asked, "sub "+ps.Subscribe.Node+" "+
+				string(ps.Subscribe.Jid))
+		} else {
+			asked = append(asked, "unsub "+ps.Unsubscribe.Node+" "+
+				ps.Unsubscribe.SubId)
+		}
+		sub := &xmpp.PubsubSubscription{SubId: "s1",
+			Subscription: "subscribed"}
+		return &xmpp.Iq{Header: xmpp.Header{Type: "result",
+			Nested: []interface{}{&xmpp.Pubsub{Subscription: sub}}}}, nil
+	}
+	pm.jid = "al@b.c"
+	ctx := context.Background()
+	if err := pm.Subscribe(ctx, "svc", "n"); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	subs := pm.Subscriptions()["svc"]
+	if len(subs) != 1 || subs[0].Node != "n" || subs[0].SubId != "s1" {
+		t.Errorf("subscriptions %+v", subs)
+	}
+	pm.renew()
+	if err := pm.Unsubscribe(ctx, "svc", "n"); err != nil {
+		t.Fatalf("Unsubscribe: %v", err)
+	}
+	pm.renew()
+	if len(asked) != 3 || asked[0] != "sub n al@b.c" ||
+		asked[1] != asked[0] || asked[2] != "unsub n s1" {
+		t.Errorf("asked %q", asked)
+	}
+}
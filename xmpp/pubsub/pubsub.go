@@ -0,0 +1,123 @@
+// This package implements the parts of publish-subscribe, XEP-0060,
+// which an application uses directly: subscribing to nodes, routing
+// their notifications, and creating and deleting nodes. The protocol
+// elements, and fetching, publishing and retracting items, are in
+// the xmpp package, since PEP and the XEPs built on it need them.
+package pubsub
+
+// This file contains the subscription and node management requests.
+
+import (
+	".."
+	"../forms"
+	"context"
+)
+
+// Sends an iq and waits for the reply, as Client.SendIq does.
+type sendIq func(context.Context, *xmpp.Iq) (*xmpp.Iq, error)
+
+// Subscribes the client's bare JID to a node. Manager.Subscribe also
+// renews the subscription after reconnection.
+func Subscribe(ctx context.Context, cl *xmpp.Client, service xmpp.JID,
+	node string) (*xmpp.PubsubSubscription, error) {
+
+	return subscribe(ctx, cl.SendIq, cl.Jid.Bare(), service, node)
+}
+
+func subscribe(ctx context.Context, send sendIq, jid, service xmpp.JID,
+	node string) (*xmpp.PubsubSubscription, error) {
+
+	req := &xmpp.PubsubSubscribe{Node: node, Jid: jid}
+	iq := &xmpp.Iq{Header: xmpp.Header{To: service, Type: "set",
+		Nested: []interface{}{&xmpp.Pubsub{Subscribe: req}}}}
+	reply, err := send(ctx, iq)
+	if err != nil {
+		return nil, err
+	}
+	sub := &xmpp.PubsubSubscription{Node: node, Jid: req.Jid}
+	for _, ele := range reply.Nested {
+		if ps, ok := ele.(*xmpp.Pubsub); ok && ps.Subscription != nil {
+			sub = ps.Subscription
+			if sub.Node == "" {
+				sub.Node = node
+			}
+		}
+	}
+	return sub, nil
+}
+
+// Unsubscribes the client's bare JID from a node. The subscription
+// id is needed if there are several subscriptions.
+func Unsubscribe(ctx context.Context, cl *xmpp.Client, service xmpp.JID,
+	node, subId string) error {
+
+	return unsubscribe(ctx, cl.SendIq, cl.Jid.Bare(), service, node, subId)
+}
+
+func unsubscribe(ctx context.Context, send sendIq, jid, service xmpp.JID,
+	node, subId string) error {
+
+	req := &xmpp.PubsubSubscribe{Node: node, Jid: jid, SubId: subId}
+	iq := &xmpp.Iq{Header: xmpp.Header{To: service, Type: "set",
+		Nested: []interface{}{&xmpp.Pubsub{Unsubscribe: req}}}}
+	_, err := send(ctx, iq)
+	return err
+}
+
+// Creates a node, configured with the given pubsub#node_config
+// options if config is non-empty. If node is empty the service
+// chooses a name for an instant node. Returns the node's name.
+func CreateNode(ctx context.Context, cl *xmpp.Client, service xmpp.JID,
+	node string, config map[string]string) (string, error) {
+
+	return createNode(ctx, cl.SendIq, service, node, config)
+}
+
+func createNode(ctx context.Context, send sendIq, service xmpp.JID,
+	node string, config map[string]string) (string, error) {
+
+	ps := &xmpp.Pubsub{Create: &xmpp.PubsubNode{Node: node}}
+	if len(config) > 0 {
+		ps.Configure = &xmpp.PubsubOptions{Form: forms.NewSubmit(
+			xmpp.NsPubsubNodeConfig, config)}
+	}
+	iq := &xmpp.Iq{Header: xmpp.Header{To: service, Type: "set",
+		Nested: []interface{}{ps}}}
+	reply, err := send(ctx, iq)
+	if err != nil {
+		return "", err
+	}
+	for _, ele := range reply.Nested {
+		if ps, ok := ele.(*xmpp.Pubsub); ok && ps.Create != nil &&
+			ps.Create.Node != "" {
+			return ps.Create.Node, nil
+		}
+	}
+	return node, nil
+}
+
+// Deletes a node, and all its items. Subscribers are told.
+func DeleteNode(ctx context.Context, cl *xmpp.Client, service xmpp.JID,
+	node string) error {
+
+	return owner(ctx, cl.SendIq, service,
+		&xmpp.PubsubOwner{Delete: &xmpp.PubsubNode{Node: node}})
+}
+
+// Deletes all the items of a node.
+func PurgeNode(ctx context.Context, cl *xmpp.Client, service xmpp.JID,
+	node string) error {
+
+	return owner(ctx, cl.SendIq, service,
+		&xmpp.PubsubOwner{Purge: &xmpp.PubsubNode{Node: node}})
+}
+
+// Sends an owner request about a node.
+func owner(ctx context.Context, send sendIq, service xmpp.JID,
+	req *xmpp.PubsubOwner) error {
+
+	iq := &xmpp.Iq{Header: xmpp.Header{To: service, Type: "set",
+		Nested: []interface{}{req}}}
+	_, err := send(ctx, iq)
+	return err
+}
@@ -0,0 +1,52 @@
+package pubsub
+
+import (
+	".."
+	"context"
+	"encoding/xml"
+	"testing"
+)
+
+func TestNodeRequests(t *testing.T) {
+	asked := make(chan string, 1)
+	replies := make(chan interface{}, 1)
+	send := func(ctx context.Context, iq *xmpp.Iq) (*xmpp.Iq, error) {
+		buf, _ := xml.Marshal(iq.Nested[0])
+		asked <- string(iq.To) + " " + string(buf)
+		reply := &xmpp.Iq{Header: xmpp.Header{Id: iq.Id, Type: "result"}}
+		if p := <-replies; p != nil {
+			reply.Nested = []interface{}{p}
+		}
+		return reply, nil
+	}
+	ctx := context.Background()
+
+	replies <- &xmpp.Pubsub{Create: &xmpp.PubsubNode{Node: "instant1"}}
+	node, err := createNode(ctx, send, "svc", "", nil)
+	assertEquals(t, `svc <pubsub xmlns="`+xmpp.NsPubsub+`"><create>`+
+		`</create></pubsub>`, <-asked)
+	if err != nil || node != "instant1" {
+		t.Errorf("createNode: %q %v", node, err)
+	}
+
+	replies <- nil
+	createNode(ctx, send, "svc", "n", map[string]string{
+		"pubsub#access_model": "open"})
+	assertEquals(t, `svc <pubsub xmlns="`+xmpp.NsPubsub+`"><create `+
+		`node="n"></create><configure><x xmlns="jabber:x:data" `+
+		`type="submit"><field var="FORM_TYPE" type="hidden"><value>`+
+		xmpp.NsPubsubNodeConfig+`</value></field><field `+
+		`var="pubsub#access_model"><value>open</value></field></x>`+
+		`</configure></pubsub>`, <-asked)
+
+	replies <- nil
+	owner(ctx, send, "svc",
+		&xmpp.PubsubOwner{Delete: &xmpp.PubsubNode{Node: "n"}})
+	assertEquals(t, `svc <pubsub xmlns="`+xmpp.NsPubsubOwner+`"><delete `+
+		`node="n"></delete></pubsub>`, <-asked)
+
+	replies <- nil
+	unsubscribe(ctx, send, "al@b.c", "svc", "n", "s1")
+	assertEquals(t, `svc <pubsub xmlns="`+xmpp.NsPubsub+`"><unsubscribe `+
+		`node="n" jid="al@b.c" subid="s1"></unsubscribe></pubsub>`, <-asked)
+}
@@ -0,0 +1,32 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+)
+
+func TestPubsubSubscribeMarshal(t *testing.T) {
+	ps := &Pubsub{Subscribe: &PubsubSubscribe{Node: "n", Jid: "a@b"}}
+	assertMarshal(t, `<pubsub xmlns="`+NsPubsub+`"><subscribe node="n"`+
+		` jid="a@b"></subscribe></pubsub>`, ps)
+}
+
+func TestPubsubRetract(t *testing.T) {
+	send := make(chan Stanza, 1)
+	cl := &Client{handlers: make(chan *callback, 1), Send: send}
+	asked := make(chan string, 1)
+	go func() {
+		h := <-cl.handlers
+		iq := (<-send).(*Iq)
+		buf, _ := xml.Marshal(iq.Nested[0])
+		asked <- string(buf)
+		h.f(&Iq{Header: Header{Id: iq.Id, Type: "result"}})
+	}()
+	if err := cl.Retract(context.Background(), "svc", "n", "i1",
+		true); err != nil {
+		t.Errorf("Retract: %v", err)
+	}
+	assertEquals(t, `<pubsub xmlns="`+NsPubsub+`"><retract node="n" `+
+		`notify="true"><item id="i1"></item></retract></pubsub>`, <-asked)
+}
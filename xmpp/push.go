@@ -0,0 +1,59 @@
+package xmpp
+
+// This file contains push notifications, XEP-0357, with which a
+// client which isn't connected can still be woken when something
+// arrives for it.
+
+import (
+	"./forms"
+	"context"
+	"encoding/xml"
+)
+
+const NsPush = "urn:xmpp:push:0"
+
+// Asks the server to notify an app server of traffic for the user
+// while this client is offline. The form carries the publish-options
+// the app server wants, such as a secret.
+type PushEnable struct {
+	XMLName xml.Name `xml:"urn:xmpp:push:0 enable"`
+	Jid     JID      `xml:"jid,attr"`
+	Node    string   `xml:"node,attr"`
+	Form    *forms.Form
+}
+
+// Asks the server to stop notifying an app server. With no node,
+// every node on the app server is disabled.
+type PushDisable struct {
+	XMLName xml.Name `xml:"urn:xmpp:push:0 disable"`
+	Jid     JID      `xml:"jid,attr"`
+	Node    string   `xml:"node,attr,omitempty"`
+}
+
+// Registers for push notifications. The app server and node are the
+// ones the client's push service handed out; options, if non-empty,
+// are sent as publish-options with each notification. Whether the
+// server supports this can be found with Supports, for the user's
+// bare JID and NsPush.
+func (cl *Client) EnablePush(ctx context.Context, service JID, node string,
+	options map[string]string) error {
+
+	en := &PushEnable{Jid: service, Node: node}
+	if len(options) > 0 {
+		en.Form = forms.NewSubmit(NsPubsubPublishOptions, options)
+	}
+	iq := &Iq{Header: Header{Type: "set", Nested: []interface{}{en}}}
+	_, err := cl.SendIq(ctx, iq)
+	return err
+}
+
+// Stops push notifications to a node of an app server, or to all of
+// its nodes if node is empty.
+func (cl *Client) DisablePush(ctx context.Context, service JID,
+	node string) error {
+
+	iq := &Iq{Header: Header{Type: "set", Nested: []interface{}{
+		&PushDisable{Jid: service, Node: node}}}}
+	_, err := cl.SendIq(ctx, iq)
+	return err
+}
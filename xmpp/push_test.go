@@ -0,0 +1,40 @@
+package xmpp
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPush(t *testing.T) {
+	send := make(chan Stanza, 1)
+	cl := &Client{handlers: make(chan *callback, 1), Send: send}
+	go func() {
+		h := <-cl.handlers
+		iq := (<-send).(*Iq)
+		assertEquals(t, "set", iq.Type)
+		assertMarshal(t, `<enable xmlns="`+NsPush+`" jid="push.b.c" `+
+			`node="n1"><x xmlns="jabber:x:data" type="submit">`+
+			`<field var="FORM_TYPE" type="hidden"><value>`+
+			NsPubsubPublishOptions+`</value></field>`+
+			`<field var="secret"><value>s</value></field></x></enable>`,
+			iq.Nested[0])
+		h.f(&Iq{Header: Header{Id: iq.Id, Type: "result"}})
+	}()
+	err := cl.EnablePush(context.Background(), "push.b.c", "n1",
+		map[string]string{"secret": "s"})
+	if err != nil {
+		t.Fatalf("EnablePush: %v", err)
+	}
+
+	go func() {
+		h := <-cl.handlers
+		iq := (<-send).(*Iq)
+		assertMarshal(t, `<disable xmlns="`+NsPush+`" jid="push.b.c">`+
+			`</disable>`, iq.Nested[0])
+		h.f(&Iq{Header: Header{Id: iq.Id, Type: "error",
+			Error: stanzaError("cancel", "item-not-found")}})
+	}()
+	if err := cl.DisablePush(context.Background(), "push.b.c", ""); err == nil {
+		t.Error("DisablePush succeeded despite an error reply")
+	}
+}
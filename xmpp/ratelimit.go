@@ -0,0 +1,176 @@
+package xmpp
+
+// This file contains a rate limiter for outgoing stanzas, to keep
+// clients from running afoul of servers' flood protection (often
+// called karma).
+
+import (
+	"time"
+)
+
+// Parameters for a token bucket. Rate is in stanzas per second, and
+// Burst is the number of stanzas which may be sent at once after a
+// quiet period. A zero Rate means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is an extension which delays outgoing stanzas so they
+// don't exceed a global rate, or a rate per destination bare JID.
+// Stanzas to one destination are kept in order, but a destination
+// which has used up its allowance doesn't hold up stanzas to the
+// others.
+type RateLimiter struct {
+	Extension
+	global, perDest RateLimit
+	queueLen        int
+	// Used by the tests.
+	now func() time.Time
+}
+
+// Creates a RateLimiter, to be passed to NewClient among the
+// extensions. Up to queueLen stanzas are held while waiting to be
+// sent; beyond that, writes to Client.Send block. Wherever it comes
+// among the extensions, it limits what all of them send, such as
+// replies to disco queries, as well as what the application sends.
+func NewRateLimiter(global, perDest RateLimit, queueLen int) *RateLimiter {
+	if queueLen < 1 {
+		queueLen = 1
+	}
+	r := &RateLimiter{global: global, perDest: perDest,
+		queueLen: queueLen, now: time.Now}
+	r.SendFilter = r.sendFilter
+	r.nearNetwork = true
+	return r
+}
+
+func (lim RateLimit) burst() float64 {
+	if lim.Burst < 1 {
+		return 1
+	}
+	return float64(lim.Burst)
+}
+
+func (lim RateLimit) fill(b *tokenBucket, now time.Time) {
+	burst := lim.burst()
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * lim.Rate
+	}
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// How long until the bucket holds a whole token.
+func (lim RateLimit) wait(b *tokenBucket) time.Duration {
+	if lim.Rate == 0 || b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / lim.Rate * float64(time.Second))
+}
+
+func (r *RateLimiter) sendFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	var global tokenBucket
+	dests := make(map[JID]*tokenBucket)
+	var queue []Stanza
+	for {
+		var wake <-chan time.Time
+		if len(queue) > 0 {
+			delay := r.release(&queue, &global, dests, out)
+			if len(queue) > 0 {
+				wake = time.After(delay)
+			}
+		}
+		if in == nil && len(queue) == 0 {
+			return
+		}
+		input := in
+		if len(queue) >= r.queueLen {
+			input = nil
+		}
+		select {
+		case stan, ok := <-input:
+			if !ok {
+				in = nil
+				continue
+			}
+			queue = append(queue, stan)
+		case <-wake:
+		}
+	}
+}
+
+// Send whatever stanzas in the queue the limits allow, and return
+// how long to wait before trying again.
+func (r *RateLimiter) release(queue *[]Stanza, global *tokenBucket,
+	dests map[JID]*tokenBucket, out chan<- Stanza) time.Duration {
+
+	now := r.now()
+	var delay time.Duration
+	blocked := make(map[JID]bool)
+	var remain []Stanza
+	for _, stan := range *queue {
+		if _, ok := stan.(*flushMarker); ok {
+			// It uses no allowance, but mustn't overtake
+			// anything.
+			if len(remain) > 0 {
+				remain = append(remain, stan)
+			} else {
+				out <- stan
+			}
+			continue
+		}
+		to := stan.GetHeader().To.Bare()
+		if blocked[to] {
+			remain = append(remain, stan)
+			continue
+		}
+		b := dests[to]
+		if b == nil {
+			b = &tokenBucket{}
+			dests[to] = b
+		}
+		r.global.fill(global, now)
+		r.perDest.fill(b, now)
+		wait := r.global.wait(global)
+		if w := r.perDest.wait(b); w > wait {
+			wait = w
+		}
+		if wait > 0 {
+			if delay == 0 || wait < delay {
+				delay = wait
+			}
+			blocked[to] = true
+			remain = append(remain, stan)
+			continue
+		}
+		if r.global.Rate != 0 {
+			global.tokens--
+		}
+		if r.perDest.Rate != 0 {
+			b.tokens--
+		}
+		out <- stan
+	}
+	*queue = remain
+
+	// Forget about destinations which have been quiet long enough
+	// to have a full bucket.
+	for to, b := range dests {
+		r.perDest.fill(b, now)
+		if !blocked[to] && b.tokens >= r.perDest.burst() {
+			delete(dests, to)
+		}
+	}
+	return delay
+}
@@ -0,0 +1,102 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func TestRateLimitRelease(t *testing.T) {
+	r := NewRateLimiter(RateLimit{Rate: 10, Burst: 3},
+		RateLimit{Rate: 1, Burst: 2}, 10)
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { return now }
+	var global tokenBucket
+	dests := make(map[JID]*tokenBucket)
+	out := make(chan Stanza, 10)
+
+	msg := func(to JID, id string) Stanza {
+		return &Message{Header: Header{To: to, Id: id}}
+	}
+	queue := []Stanza{msg("a@b/1", "1"), msg("a@b/2", "2"),
+		msg("a@b", "3"), msg("c@d", "4"), msg("e@f", "5")}
+	delay := r.release(&queue, &global, dests, out)
+	// Two to a@b (its burst), then one to c@d uses up the global
+	// burst.
+	if len(out) != 3 {
+		t.Fatalf("sent %d", len(out))
+	}
+	for _, id := range []string{"1", "2", "4"} {
+		assertEquals(t, id, (<-out).GetHeader().Id)
+	}
+	if len(queue) != 2 {
+		t.Fatalf("queued %d", len(queue))
+	}
+	if delay != 100*time.Millisecond {
+		t.Errorf("delay %v", delay)
+	}
+
+	now = now.Add(delay)
+	r.release(&queue, &global, dests, out)
+	if len(out) != 1 {
+		t.Fatalf("sent %d", len(out))
+	}
+	assertEquals(t, "5", (<-out).GetHeader().Id)
+
+	now = now.Add(time.Second)
+	r.release(&queue, &global, dests, out)
+	if len(queue) != 0 || len(out) != 1 {
+		t.Fatalf("queued %d, sent %d", len(queue), len(out))
+	}
+	assertEquals(t, "3", (<-out).GetHeader().Id)
+}
+
+func TestRateLimitFilter(t *testing.T) {
+	r := NewRateLimiter(RateLimit{Rate: 1000, Burst: 1}, RateLimit{}, 2)
+	in := make(chan Stanza)
+	out := make(chan Stanza)
+	go r.SendFilter(in, out)
+	go func() {
+		for i := 0; i < 5; i++ {
+			in <- &Message{}
+		}
+		close(in)
+	}()
+	n := 0
+	for _ = range out {
+		n++
+	}
+	if n != 5 {
+		t.Errorf("got %d", n)
+	}
+}
+
+// The library's own stanzas, sent by extensions which come after the
+// limiter, are limited too.
+func TestRateLimitClient(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	// The roster request and initial presence use up the burst.
+	r := NewRateLimiter(RateLimit{Rate: 0.001, Burst: 2}, RateLimit{}, 10)
+	jid := JID("alice@b.c/pc")
+	cl, err := NewClientFromConn(s.Dial(), &jid, "secret", &tls.Config{},
+		[]Extension{r.Extension}, Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn: %v", err)
+	}
+	defer cl.Close()
+	for {
+		if _, ok := (<-s.Received).(*Presence); ok {
+			break
+		}
+	}
+
+	s.Send(&Iq{Header: Header{From: "b.c", To: jid, Id: "q", Type: "get",
+		Nested: []interface{}{&DiscoInfo{}}}})
+	select {
+	case st := <-s.Received:
+		t.Errorf("sent %T %s over the limit", st, st.GetHeader().Id)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
@@ -0,0 +1,220 @@
+package xmpp
+
+// This file contains support for message delivery receipts, XEP-0184.
+
+import (
+	"encoding/xml"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+const NsReceipts = "urn:xmpp:receipts"
+
+// Asks the recipient of a message to acknowledge it.
+type ReceiptRequest struct {
+	XMLName xml.Name `xml:"urn:xmpp:receipts request"`
+}
+
+// Acknowledges receipt of the message with the given id.
+type ReceiptReceived struct {
+	XMLName xml.Name `xml:"urn:xmpp:receipts received"`
+	Id      string   `xml:"id,attr"`
+}
+
+// ReceiptsExt may be included in the extensions passed to NewClient
+// to decode receipt requests and acknowledgements in incoming
+// messages.
+var ReceiptsExt Extension = Extension{}
+
+func init() {
+	ReceiptsExt.Features = []string{NsReceipts}
+	ReceiptsExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	rName := xml.Name{Space: NsReceipts, Local: "request"}
+	ReceiptsExt.StanzaTypes[rName] = reflect.TypeOf(ReceiptRequest{})
+	rName = xml.Name{Space: NsReceipts, Local: "received"}
+	ReceiptsExt.StanzaTypes[rName] = reflect.TypeOf(ReceiptReceived{})
+}
+
+// Does the message ask for a receipt?
+func (m *Message) WantsReceipt() bool {
+	for _, ele := range m.Nested {
+		switch ele.(type) {
+		case *ReceiptRequest, ReceiptRequest:
+			return true
+		}
+	}
+	return false
+}
+
+// If the message is a receipt, returns the id of the message it
+// acknowledges.
+func (m *Message) Receipt() (string, bool) {
+	for _, ele := range m.Nested {
+		switch r := ele.(type) {
+		case *ReceiptReceived:
+			return r.Id, true
+		case ReceiptReceived:
+			return r.Id, true
+		}
+	}
+	return "", false
+}
+
+// An acknowledgement of a message we sent.
+type Receipt struct {
+	// The id of the acknowledged message.
+	Id string
+	// Who acknowledged it.
+	From JID
+	// When the message was sent.
+	Sent time.Time
+}
+
+// ReceiptManager is an extension which asks for receipts on
+// outgoing messages, acknowledges incoming messages which ask for a
+// receipt, and reports the acknowledgements of messages it sent.
+// Messages carrying receipts still appear on Client.Recv.
+type ReceiptManager struct {
+	Extension
+	// Acknowledgements of the messages this client asked receipts
+	// for. Receipts are discarded if the channel isn't ready for
+	// them. It's closed when the client closes.
+	Acks     <-chan Receipt
+	acks     chan Receipt
+	request  bool
+	toServer chan Stanza
+	sendDone chan bool
+	lock     sync.Mutex
+	// The messages waiting for a receipt, by id.
+	pending map[string]pendingReceipt
+}
+
+type pendingReceipt struct {
+	to   JID
+	sent time.Time
+}
+
+// Creates a ReceiptManager, to be passed to NewClient among the
+// extensions. If request is true, a receipt is asked for on every
+// outgoing message with a body, except in multi-user chat rooms;
+// otherwise only on those which already carry a ReceiptRequest.
+// Messages without an id are given one, since a receipt refers to
+// the id.
+func NewReceiptManager(request bool) *ReceiptManager {
+	rm := &ReceiptManager{request: request}
+	rm.acks = make(chan Receipt, 16)
+	rm.Acks = rm.acks
+	rm.toServer = make(chan Stanza)
+	rm.sendDone = make(chan bool)
+	rm.pending = make(map[string]pendingReceipt)
+	rm.StanzaTypes = ReceiptsExt.StanzaTypes
+	rm.Features = ReceiptsExt.Features
+	rm.RecvFilter = rm.recvFilter
+	rm.SendFilter = rm.sendFilter
+	return rm
+}
+
+// Returns the ids of the messages which haven't been acknowledged
+// yet, oldest first.
+func (rm *ReceiptManager) Unacknowledged() []string {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+	ids := make([]string, 0, len(rm.pending))
+	for id := range rm.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return rm.pending[ids[i]].sent.Before(rm.pending[ids[j]].sent)
+	})
+	return ids
+}
+
+// Stops waiting for a receipt for the message with the given id,
+// for instance because the application has given up on it.
+func (rm *ReceiptManager) Forget(id string) {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+	delete(rm.pending, id)
+}
+
+func (rm *ReceiptManager) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	defer close(rm.acks)
+	for stan := range in {
+		if m, ok := stan.(*Message); ok && m.Type != "error" {
+			if id, ok := m.Receipt(); ok {
+				rm.acked(id, m.From)
+			}
+			if m.WantsReceipt() && m.Id != "" &&
+				m.Type != "groupchat" {
+				ack := &Message{Header: Header{To: m.From,
+					Type: m.Type, Nested: []interface{}{
+						&ReceiptReceived{Id: m.Id}}}}
+				select {
+				case rm.toServer <- ack:
+				case <-rm.sendDone:
+				}
+			}
+		}
+		out <- stan
+	}
+}
+
+func (rm *ReceiptManager) acked(id string, from JID) {
+	rm.lock.Lock()
+	p, ok := rm.pending[id]
+	if ok && p.to.Bare() == from.Bare() {
+		delete(rm.pending, id)
+	} else {
+		ok = false
+	}
+	rm.lock.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case rm.acks <- Receipt{Id: id, From: from, Sent: p.sent}:
+	default:
+	}
+}
+
+func (rm *ReceiptManager) sendFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	defer close(rm.sendDone)
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			if m, ok := stan.(*Message); ok {
+				rm.sent(m)
+			}
+			out <- stan
+		case stan := <-rm.toServer:
+			out <- stan
+		}
+	}
+}
+
+// Asks for a receipt if need be, and remembers the message if it
+// asks for one.
+func (rm *ReceiptManager) sent(m *Message) {
+	if m.Type == "error" || m.Type == "groupchat" {
+		return
+	}
+	if !m.WantsReceipt() {
+		if !rm.request || len(m.Body) == 0 {
+			return
+		}
+		m.Nested = append(m.Nested, &ReceiptRequest{})
+	}
+	if m.Id == "" {
+		m.Id = NextId()
+	}
+	rm.lock.Lock()
+	rm.pending[m.Id] = pendingReceipt{to: m.To, sent: time.Now()}
+	rm.lock.Unlock()
+}
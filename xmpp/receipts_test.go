@@ -0,0 +1,58 @@
+package xmpp
+
+import (
+	"testing"
+)
+
+func TestReceiptManager(t *testing.T) {
+	rm := NewReceiptManager(true)
+	sendIn := make(chan Stanza)
+	sendOut := make(chan Stanza)
+	go rm.SendFilter(sendIn, sendOut)
+	defer close(sendIn)
+	recvIn := make(chan Stanza)
+	recvOut := make(chan Stanza)
+	go rm.RecvFilter(recvIn, recvOut)
+	defer close(recvIn)
+
+	// Outgoing messages with a body ask for a receipt.
+	sendIn <- &Message{Header: Header{To: "a@b.c/d", Type: "chat"},
+		Body: []Text{{Chardata: "hi"}}}
+	m := (<-sendOut).(*Message)
+	if !m.WantsReceipt() || m.Id == "" {
+		t.Fatalf("no receipt request in %+v", m)
+	}
+	sendIn <- &Message{Header: Header{To: "r@b.c", Type: "groupchat"},
+		Body: []Text{{Chardata: "hi"}}}
+	if (<-sendOut).(*Message).WantsReceipt() {
+		t.Error("receipt requested in a room")
+	}
+	assertEquals(t, m.Id, rm.Unacknowledged()[0])
+
+	// A receipt from someone else doesn't count.
+	recvIn <- &Message{Header: Header{From: "x@b.c/d", Nested: []interface{}{
+		&ReceiptReceived{Id: m.Id}}}}
+	<-recvOut
+	recvIn <- &Message{Header: Header{From: "a@b.c/e", Nested: []interface{}{
+		&ReceiptReceived{Id: m.Id}}}}
+	<-recvOut
+	ack := <-rm.Acks
+	assertEquals(t, m.Id, ack.Id)
+	assertEquals(t, "a@b.c/e", string(ack.From))
+	if len(rm.Unacknowledged()) != 0 || len(rm.Acks) != 0 {
+		t.Errorf("still pending: %v", rm.Unacknowledged())
+	}
+
+	// Incoming requests are acknowledged.
+	go func() {
+		recvIn <- &Message{Header: Header{From: "a@b.c/d", Id: "m2",
+			Type: "chat", Nested: []interface{}{&ReceiptRequest{}}},
+			Body: []Text{{Chardata: "yo"}}}
+	}()
+	m = (<-sendOut).(*Message)
+	assertEquals(t, "a@b.c/d", string(m.To))
+	if id, ok := m.Receipt(); !ok || id != "m2" {
+		t.Errorf("bad ack %+v", m)
+	}
+	<-recvOut
+}
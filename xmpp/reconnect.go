@@ -0,0 +1,279 @@
+package xmpp
+
+// This file contains automatic reconnection. When the connection to
+// the server is lost and the stream can't be resumed, the client
+// starts a new session over a new connection.
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Configures ReconnectExt.
+type ReconnectConfig struct {
+	// The delay before the first attempt to reconnect. It doubles
+	// after each failed attempt, up to MaxBackoff, and each delay
+	// is randomly shortened by up to half so that many clients
+	// don't reconnect in step. Zero means 1 second and 5 minutes.
+	MinBackoff, MaxBackoff time.Duration
+	// The client gives up, and the session ends with an error,
+	// after this many failed attempts in a row. Zero means it
+	// never gives up.
+	MaxAttempts int
+	// If non-nil, changes to the connection are reported here.
+	// Events are discarded if the channel isn't ready for them.
+	Events chan<- ConnectionEvent
+}
+
+// A change to the connection of a client created with ReconnectExt.
+type ConnectionEvent struct {
+	// Whether the session is running again, or has been
+	// interrupted.
+	Online bool
+	// Why the connection was lost, or why an attempt to reconnect
+	// failed.
+	Err error
+	// The number of failed attempts to reconnect since the
+	// connection was lost.
+	Attempts int
+	// When a new session replaces the lost one, the stanzas the
+	// server hadn't acknowledged. They're only known with
+	// StreamManagementExt, and may not have been delivered.
+	Unacked []Stanza
+}
+
+// How long one attempt to reconnect may take, until the resource is
+// bound.
+const reconnectTimeout = 30 * time.Second
+
+// Returns an extension which makes the client reconnect when its
+// connection to the server is lost. With StreamManagementExt, the
+// stream is resumed if possible. Otherwise a new session is
+// negotiated and authenticated and set up like the lost one: the
+// client is inactive again if SetInactive made it so, the
+// extensions' BeforePresence hooks run again, carbons are enabled
+// again if EnableCarbons enabled them, and the roster is requested
+// again, or only what changed if the server versions rosters. The
+// presence last broadcast is sent again, unless the session went
+// invisible with Client.GoInvisible, and the rooms which were joined
+// are joined again with the same nicks, asking for the history since
+// the connection was lost. Stanzas the application sends meanwhile wait
+// until the session is running. The password is kept in memory for
+// this. Clients created with NewClientFromConn or
+// NewClientFromReadWriter can't make a new connection, so they don't
+// reconnect.
+func ReconnectExt(conf ReconnectConfig) Extension {
+	return Extension{option: func(o *options) {
+		o.reconnect = &conf
+	}}
+}
+
+// The state of reconnection for one client.
+type reconnector struct {
+	conf ReconnectConfig
+	lock sync.Mutex
+	// What a new session sets up again: the presence last
+	// broadcast, at first the initial one, the presence which
+	// joined each room, by its bare JID, and whether the client
+	// was inactive and had enabled carbons.
+	presence Presence
+	rooms    map[JID]*Presence
+	inactive bool
+	carbons  bool
+	// Set once the first session is running. Until then, a lost
+	// connection is fatal.
+	armed bool
+	// Set while reconnecting. The outcome of each attempt is
+	// reported on result, and attempt is the connection being
+	// tried.
+	active  bool
+	result  chan error
+	attempt net.Conn
+	// Where the server redirected the client with see-other-host,
+	// if it did.
+	redirect string
+}
+
+// Makes the client reconnect to another host, with an optional port,
+// instead of the usual one.
+func (rc *reconnector) redirectTo(host string) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.redirect = host
+}
+
+func (rc *reconnector) arm() {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.armed = true
+}
+
+// Starts reconnecting, unless that's already under way or the first
+// session hasn't started.
+func (rc *reconnector) start() bool {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if !rc.armed || rc.active {
+		return false
+	}
+	rc.active = true
+	rc.result = make(chan error, 1)
+	return true
+}
+
+// Called when a connection fails. Returns true if it happened while
+// reconnecting, and the failure has been dealt with.
+func (rc *reconnector) lost(sock net.Conn, err error) bool {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if !rc.active {
+		return false
+	}
+	if sock == rc.attempt {
+		rc.attempt = nil
+		select {
+		case rc.result <- err:
+		default:
+		}
+	}
+	sock.Close()
+	return true
+}
+
+// Reports a change to the connection, if the client reconnects.
+func (cl *Client) connEvent(ev ConnectionEvent) {
+	if cl.rc == nil || cl.rc.conf.Events == nil {
+		return
+	}
+	select {
+	case cl.rc.conf.Events <- ev:
+	default:
+	}
+}
+
+// Keeps trying to start a new session, until one is running or the
+// client gives up.
+func (cl *Client) reconnect(cause error) {
+	rc := cl.rc
+	lost := time.Now()
+	stat := cl.statmgr.newListener()
+	cl.setStatus(StatusUnconnected)
+	var unacked []Stanza
+	if cl.sm != nil {
+		unacked = cl.sm.reset()
+	}
+	cl.connEvent(ConnectionEvent{Err: cause, Unacked: unacked})
+
+	backoff := rc.conf.MinBackoff
+	if backoff == 0 {
+		backoff = time.Second
+	}
+	max := rc.conf.MaxBackoff
+	if max == 0 {
+		max = 5 * time.Minute
+	}
+	var err error
+	for attempts := 0; rc.conf.MaxAttempts == 0 ||
+		attempts < rc.conf.MaxAttempts; attempts++ {
+
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if cl.opts.pace != nil {
+			// Other clients may be reconnecting too.
+			delay = cl.opts.pace(delay)
+		}
+		if !sleepUnlessFatal(stat, delay) {
+			return
+		}
+		err = cl.reconnectOnce(stat)
+		if err == nil {
+			rc.lock.Lock()
+			rc.active = false
+			rc.lock.Unlock()
+			cl.connEvent(ConnectionEvent{Online: true,
+				Attempts: attempts})
+			cl.logf(LogInfo, "reconnected after %d failed attempts",
+				attempts)
+			cl.countReconnect()
+			cl.restoreSession(lost)
+			return
+		}
+		if err == errSessionEnded {
+			return
+		}
+		cl.connEvent(ConnectionEvent{Err: err, Attempts: attempts + 1})
+		backoff *= 2
+		if backoff > max {
+			backoff = max
+		}
+	}
+	cl.setError(fmt.Errorf("can't reconnect after %v: %v", cause, err))
+}
+
+// Makes one attempt to start a new session over a new connection.
+func (cl *Client) reconnectOnce(stat <-chan Status) error {
+	rc := cl.rc
+	ctx, cancel := context.WithTimeout(context.Background(),
+		reconnectTimeout)
+	defer cancel()
+	rc.lock.Lock()
+	redirect := rc.redirect
+	rc.lock.Unlock()
+	var conn net.Conn
+	var err error
+	if redirect != "" {
+		conn, err = dialLocation(ctx, cl.opts.dialer, redirect)
+	} else {
+		conn, err = cl.redial(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	rc.lock.Lock()
+	rc.attempt = rawConn(conn)
+	result := rc.result
+	rc.lock.Unlock()
+	cl.saslExpected = ""
+	cl.compressTried = false
+	cl.layer1.setSock(conn)
+	cl.setStatus(StatusConnected)
+	if cl.layer1.encrypted() {
+		cl.setStatus(StatusConnectedTls)
+	}
+	if !cl.trySendRaw(cl.streamHeader()) {
+		return errSessionEnded
+	}
+
+	var session <-chan error
+	for err == nil {
+		select {
+		case err = <-result:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case err = <-session:
+			if err == nil {
+				if cl.sm != nil {
+					cl.enableStreamMgmt()
+				}
+				cl.setStatus(StatusRunning)
+				return nil
+			}
+		case s, ok := <-stat:
+			switch {
+			case !ok || s.Fatal():
+				err = errSessionEnded
+			case s == StatusBound && session == nil:
+				session = cl.startSession()
+			}
+		}
+	}
+	rc.lock.Lock()
+	rc.attempt = nil
+	rc.lock.Unlock()
+	conn.Close()
+	return err
+}
@@ -0,0 +1,195 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReconnect(t *testing.T) {
+	c1, s1 := net.Pipe()
+	c2, s2 := net.Pipe()
+	defer s2.Close()
+	stanzas1 := make(chan string, 10)
+	go fakeServer(t, s1, stanzas1)
+	redial := func(ctx context.Context) (net.Conn, error) {
+		return c2, nil
+	}
+	events := make(chan ConnectionEvent, 10)
+	event := func() ConnectionEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for an event")
+		}
+		return ConnectionEvent{}
+	}
+
+	jid := JID("user@example.com/res")
+	cl, err := newClient(c1, redial, &jid, "secret", &tls.Config{},
+		[]Extension{ReconnectExt(ReconnectConfig{
+			MinBackoff: 10 * time.Millisecond, Events: events})},
+		Presence{}, nil)
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	defer cl.Close()
+	assertEquals(t, "iq", <-stanzas1)
+	assertEquals(t, "presence", <-stanzas1)
+
+	s1.Close()
+	if ev := event(); ev.Online || ev.Err == nil {
+		t.Errorf("got %+v, want a lost connection", ev)
+	}
+	// A new session is negotiated, and the roster and presence are
+	// sent again.
+	stanzas2 := make(chan string, 10)
+	go fakeServer(t, s2, stanzas2)
+	if ev := event(); !ev.Online {
+		t.Errorf("got %+v, want to be online", ev)
+	}
+	assertEquals(t, "iq", <-stanzas2)
+	assertEquals(t, "presence", <-stanzas2)
+	cl.Send <- &Message{Header: Header{To: "a@example.com"}}
+	assertEquals(t, "message", <-stanzas2)
+}
+
+func TestReconnectPresence(t *testing.T) {
+	c1, s1 := net.Pipe()
+	c2, s2 := net.Pipe()
+	defer s2.Close()
+	go fakeServer(t, s1, make(chan string, 10))
+	redial := func(ctx context.Context) (net.Conn, error) {
+		return c2, nil
+	}
+	events := make(chan ConnectionEvent, 10)
+	// Sees the presence stanzas as they go out.
+	sent := make(chan *Presence, 10)
+	capture := Extension{SendFilter: func(in <-chan Stanza,
+		out chan<- Stanza) {
+		defer close(out)
+		for st := range in {
+			if p, ok := st.(*Presence); ok {
+				sent <- p
+			}
+			out <- st
+		}
+	}}
+	pm := NewPresenceManager(0, 0, "")
+
+	jid := JID("user@example.com/res")
+	cl, err := newClient(c1, redial, &jid, "secret", &tls.Config{},
+		[]Extension{pm.Extension, capture, ReconnectExt(ReconnectConfig{
+			MinBackoff: 10 * time.Millisecond, Events: events})},
+		Presence{Status: []Text{{Chardata: "starting"}}}, nil)
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	defer cl.Close()
+	assertEquals(t, "starting", (<-sent).Status[0].Chardata)
+	pm.SetStatus(ShowDnd, "busy")
+	assertEquals(t, "busy", (<-sent).Status[0].Chardata)
+
+	s1.Close()
+	go fakeServer(t, s2, make(chan string, 10))
+	for ev := range events {
+		if ev.Online {
+			break
+		}
+	}
+	select {
+	case p := <-sent:
+		assertEquals(t, ShowDnd, p.Show.Chardata)
+		assertEquals(t, "busy", p.Status[0].Chardata)
+	case <-time.After(10 * time.Second):
+		t.Fatal("no presence after reconnecting")
+	}
+}
+
+func TestReconnectRestore(t *testing.T) {
+	c1, s1 := net.Pipe()
+	c2, s2 := net.Pipe()
+	defer s2.Close()
+	stanzas1 := make(chan string, 10)
+	go fakeServer(t, s1, stanzas1)
+	redial := func(ctx context.Context) (net.Conn, error) {
+		return c2, nil
+	}
+	events := make(chan ConnectionEvent, 10)
+	sent := make(chan *Presence, 10)
+	capture := Extension{SendFilter: func(in <-chan Stanza,
+		out chan<- Stanza) {
+		defer close(out)
+		for st := range in {
+			if p, ok := st.(*Presence); ok {
+				sent <- p
+			}
+			out <- st
+		}
+	}}
+	next := func() *Presence {
+		select {
+		case p := <-sent:
+			return p
+		case <-time.After(10 * time.Second):
+			t.Fatal("no presence")
+		}
+		return nil
+	}
+
+	jid := JID("user@example.com/res")
+	cl, err := newClient(c1, redial, &jid, "secret", &tls.Config{},
+		[]Extension{capture, ReconnectExt(ReconnectConfig{
+			MinBackoff: 10 * time.Millisecond, Events: events})},
+		Presence{}, nil)
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	defer cl.Close()
+	next()
+	cl.Send <- &Presence{Show: &Data{Chardata: ShowAway}}
+	cl.Send <- MucJoinPresence("a@muc.example.com", "me", "pw", nil)
+	cl.Send <- &Presence{Header: Header{To: "a@muc.example.com/me2"}}
+	cl.Send <- MucJoinPresence("b@muc.example.com", "me", "", nil)
+	cl.Send <- MucLeavePresence("b@muc.example.com", "me")
+	for i := 0; i < 5; i++ {
+		next()
+	}
+	// Once the server has them all, they've been recorded.
+	cl.Send <- &Message{Header: Header{To: "a@example.com"}}
+	for st := range stanzas1 {
+		if st == "message" {
+			break
+		}
+	}
+
+	s1.Close()
+	go fakeServer(t, s2, make(chan string, 10))
+	for ev := range events {
+		if ev.Online {
+			break
+		}
+	}
+	p := next()
+	if p.To != "" || p.Show == nil || p.Show.Chardata != ShowAway {
+		t.Errorf("got %#v, want the away presence", p)
+	}
+	p = next()
+	assertEquals(t, "a@muc.example.com/me2", string(p.To))
+	if len(p.Nested) != 1 {
+		t.Fatalf("got %#v", p.Nested)
+	}
+	mj := p.Nested[0].(*MucJoin)
+	assertEquals(t, "pw", mj.Password)
+	if mj.History == nil || mj.History.Since == "" {
+		t.Errorf("history %#v", mj.History)
+	}
+	select {
+	case p := <-sent:
+		t.Errorf("unexpected presence %#v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
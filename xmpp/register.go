@@ -0,0 +1,183 @@
+package xmpp
+
+// This file contains in-band registration, XEP-0077: creating an
+// account on the server before authenticating, and changing the
+// password or cancelling the account afterwards.
+
+import (
+	"./forms"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+const (
+	NsRegister        = "jabber:iq:register"
+	NsRegisterFeature = "http://jabber.org/features/iq-register"
+)
+
+// A registration query. In the server's answer to a get, the fields
+// it wants are present but empty, or it asks for Form to be filled in
+// instead.
+type RegisterQuery struct {
+	XMLName      xml.Name    `xml:"jabber:iq:register query"`
+	Instructions string      `xml:"instructions,omitempty"`
+	Registered   *struct{}   `xml:"registered"`
+	Username     *string     `xml:"username"`
+	Password     *string     `xml:"password"`
+	Email        *string     `xml:"email"`
+	Name         *string     `xml:"name"`
+	Nick         *string     `xml:"nick"`
+	Key          *string     `xml:"key"`
+	Remove       *struct{}   `xml:"remove"`
+	Form         *forms.Form `xml:"jabber:x:data x"`
+}
+
+var registerExt Extension = Extension{}
+
+func init() {
+	registerExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	rName := xml.Name{Space: NsRegister, Local: "query"}
+	registerExt.StanzaTypes[rName] = reflect.TypeOf(RegisterQuery{})
+}
+
+// Fills in the server's registration query, which already holds the
+// client's username and password if the server asked for them.
+type RegisterFunc func(ctx context.Context, q *RegisterQuery) error
+
+// How long a RegisterFunc may take. It may need to ask a person to
+// solve a CAPTCHA.
+const registerTimeout = 5 * time.Minute
+
+// Returns an extension which makes the client create its account
+// before authenticating. The username is the node of the client's
+// JID, and the password the one given to NewClient. If the server
+// wants more, such as an email address or the answer to a form, fill
+// supplies it; fill may be nil otherwise. The client then
+// authenticates with the new account. If the account can't be
+// created, for instance because it exists already, the session ends
+// with an error.
+func RegisterExt(fill RegisterFunc) Extension {
+	ext := registerExt
+	ext.option = func(o *options) {
+		o.register = func(ctx context.Context, q *RegisterQuery) error {
+			if fill == nil {
+				return nil
+			}
+			return fill(ctx, q)
+		}
+	}
+	return ext
+}
+
+// Asks the server what it needs to create our account, before
+// authenticating.
+func (cl *Client) register() {
+	iq := &Iq{Header: Header{Type: "get", Id: cl.NextId(),
+		Nested: []interface{}{&RegisterQuery{}}}}
+	cl.SetCallback(iq.Id, func(st Stanza) {
+		q, err := registerReply(st)
+		if err != nil {
+			cl.setError(fmt.Errorf("registration: %v", err))
+			return
+		}
+		// Filling in the form may take a while, and this is
+		// called from the receive loop.
+		go cl.submitRegistration(q)
+	})
+	cl.sendRaw <- iq
+}
+
+func (cl *Client) submitRegistration(q *RegisterQuery) {
+	user, pass := cl.Jid.Node(), cl.password
+	if q.Form != nil {
+		q.Form.Set("username", user)
+		q.Form.Set("password", pass)
+	} else {
+		if q.Username != nil {
+			q.Username = &user
+		}
+		if q.Password != nil {
+			q.Password = &pass
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		registerTimeout)
+	defer cancel()
+	if err := cl.opts.register(ctx, q); err != nil {
+		cl.setError(fmt.Errorf("registration: %v", err))
+		return
+	}
+	iq := &Iq{Header: Header{Type: "set", Id: cl.NextId(),
+		Nested: []interface{}{q.submission()}}}
+	cl.SetCallback(iq.Id, func(st Stanza) {
+		if _, err := registerReply(st); err != nil {
+			cl.setError(fmt.Errorf("registration: %v", err))
+			return
+		}
+		cl.registered = true
+		cl.chooseSasl(cl.Features)
+	})
+	if !cl.trySendRaw(iq) {
+		cl.setError(fmt.Errorf("registration: session ended"))
+	}
+}
+
+// Returns what's sent of a query which has been filled in: the
+// form's values if there's a form, or else the fields.
+func (q *RegisterQuery) submission() *RegisterQuery {
+	sub := *q
+	sub.Instructions = ""
+	sub.Registered = nil
+	if q.Form != nil {
+		sub = RegisterQuery{Form: q.Form.Submit()}
+	}
+	return &sub
+}
+
+// Returns the query in the server's answer to a registration
+// request, or the error it reported.
+func registerReply(st Stanza) (*RegisterQuery, error) {
+	iq, ok := st.(*Iq)
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("non-iq response %#v", st)
+	case iq.Type == "error" && iq.Error != nil:
+		return nil, iq.Error
+	case iq.Type == "error":
+		return nil, fmt.Errorf("iq %s failed", iq.Id)
+	}
+	for _, ele := range iq.Nested {
+		if q, ok := ele.(*RegisterQuery); ok {
+			return q, nil
+		}
+	}
+	return &RegisterQuery{}, nil
+}
+
+// Changes the account's password. If the client keeps the password
+// to resume the stream or reconnect, it uses the new one.
+func (cl *Client) ChangePassword(ctx context.Context, password string) error {
+	user := cl.Jid.Node()
+	iq := &Iq{Header: Header{To: JID(cl.Jid.Domain()), Type: "set",
+		Nested: []interface{}{&RegisterQuery{Username: &user,
+			Password: &password}}}}
+	if _, err := cl.SendIq(ctx, iq); err != nil {
+		return err
+	}
+	if cl.password != "" {
+		cl.password = password
+	}
+	return nil
+}
+
+// Deletes the account from the server. The server ends the session
+// afterwards.
+func (cl *Client) CancelRegistration(ctx context.Context) error {
+	iq := &Iq{Header: Header{To: JID(cl.Jid.Domain()), Type: "set",
+		Nested: []interface{}{&RegisterQuery{Remove: &struct{}{}}}}}
+	_, err := cl.SendIq(ctx, iq)
+	return err
+}
@@ -0,0 +1,60 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"net"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	stanzas := make(chan string, 10)
+	go fakeServer(t, sconn, stanzas)
+
+	fill := func(ctx context.Context, q *RegisterQuery) error {
+		if q.Email == nil || q.Username == nil {
+			t.Errorf("fields not asked for: %+v", q)
+			return nil
+		}
+		email := "user@example.org"
+		q.Email = &email
+		return nil
+	}
+	jid := JID("user@example.com/res")
+	cl, err := NewClientFromConn(cconn, &jid, "secret", &tls.Config{},
+		[]Extension{RegisterExt(fill)}, Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn: %v", err)
+	}
+	// The registration comes before authentication.
+	assertEquals(t, `<query xmlns="`+NsRegister+`"><username>user`+
+		`</username><password>secret</password><email>`+
+		`user@example.org</email></query>`, <-stanzas)
+	assertEquals(t, "iq", <-stanzas)
+	assertEquals(t, "presence", <-stanzas)
+	cl.Close()
+	sconn.Close()
+}
+
+func TestChangePassword(t *testing.T) {
+	send := make(chan Stanza, 1)
+	cl := &Client{Jid: "user@example.com/res", password: "old",
+		handlers: make(chan *callback, 1), Send: send}
+	asked := make(chan string, 1)
+	go func() {
+		h := <-cl.handlers
+		iq := (<-send).(*Iq)
+		buf, _ := xml.Marshal(iq.Nested[0])
+		asked <- string(iq.To) + " " + string(buf)
+		h.f(&Iq{Header: Header{Id: iq.Id, Type: "result"}})
+	}()
+	if err := cl.ChangePassword(context.Background(), "new"); err != nil {
+		t.Fatalf("ChangePassword: %v", err)
+	}
+	assertEquals(t, `example.com <query xmlns="`+NsRegister+`">`+
+		`<username>user</username><password>new</password></query>`,
+		<-asked)
+	assertEquals(t, "new", cl.password)
+}
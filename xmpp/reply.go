@@ -0,0 +1,81 @@
+package xmpp
+
+// This file contains support for message replies, XEP-0461.
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+)
+
+const NsReply = "urn:xmpp:reply:0"
+
+// Marks a message as a reply to an earlier one. In a room, Id is the
+// stanza id the room gave the earlier message; otherwise it's that
+// message's id. To is the earlier message's author, if known.
+type Reply struct {
+	XMLName xml.Name `xml:"urn:xmpp:reply:0 reply"`
+	To      JID      `xml:"to,attr,omitempty"`
+	Id      string   `xml:"id,attr"`
+}
+
+// ReplyExt may be included in the extensions passed to NewClient to
+// decode replies in incoming messages. Include FallbackExt too to
+// have the quotations which clients without support for replies see
+// stripped from the bodies.
+var ReplyExt Extension = Extension{}
+
+func init() {
+	ReplyExt.Features = []string{NsReply}
+	ReplyExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	rName := xml.Name{Space: NsReply, Local: "reply"}
+	ReplyExt.StanzaTypes[rName] = reflect.TypeOf(Reply{})
+}
+
+// If the message is a reply, returns what it replies to.
+func (m *Message) ReplyTo() *Reply {
+	for _, ele := range m.Nested {
+		if r, ok := ele.(*Reply); ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// Returns a reply to a message, with the given body. Unless quote is
+// false, the body starts with the original's quoted, marked as
+// fallback text. The reply goes to the room, or to the original's
+// sender.
+func NewReply(orig *Message, body string, quote bool) *Message {
+	reply := &Reply{To: orig.From, Id: orig.Id}
+	to := orig.From
+	if orig.Type == "groupchat" {
+		to = orig.From.Bare()
+		reply.Id = orig.StanzaIds()[to]
+	}
+	m := &Message{Header: Header{To: to, Type: orig.Type, Id: NextId(),
+		Nested: []interface{}{reply}}}
+	if orig.Thread != nil {
+		thread := *orig.Thread
+		m.Thread = &thread
+	}
+	if q := Quote(firstText(orig.Body)); quote && q != "" {
+		body = q + body
+		m.MarkFallbackRange(NsReply, 0, len([]rune(q)))
+	}
+	m.Body = []Text{{Chardata: body}}
+	return m
+}
+
+// Quotes text the way replies do, with each line prefixed by "> ".
+func Quote(text string) string {
+	text = strings.TrimRight(text, "\n")
+	if text == "" {
+		return ""
+	}
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = "> " + line
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,53 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestReply(t *testing.T) {
+	orig := &Message{Header: Header{From: "room@muc/al", Type: "groupchat",
+		Id: "m1", Nested: []interface{}{&StanzaId{Id: "s1",
+			By: "room@muc"}}},
+		Body: []Text{{Chardata: "cake?\nor pie?"}}}
+	m := NewReply(orig, "cake", true)
+	assertEquals(t, "room@muc", string(m.To))
+	assertEquals(t, "> cake?\n> or pie?\ncake", firstText(m.Body))
+	r := m.ReplyTo()
+	if r == nil || r.Id != "s1" || r.To != "room@muc/al" {
+		t.Fatalf("reply %+v", r)
+	}
+
+	// What's received has the quotation stripped.
+	buf, err := xml.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Message
+	if err := xml.Unmarshal(buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	types := mergeStanzaTypes(ReplyExt, FallbackExt)
+	if err := parseExtended(&got.Header, types); err != nil {
+		t.Fatal(err)
+	}
+	in := make(chan Stanza, 1)
+	out := make(chan Stanza, 1)
+	go fallbackFilter(in, out)
+	in <- &got
+	close(in)
+	assertEquals(t, "cake", firstText((<-out).(*Message).Body))
+	if r := got.ReplyTo(); r == nil || r.Id != "s1" {
+		t.Errorf("received reply %+v", r)
+	}
+
+	// In a chat, the reply goes to the sender, by the message id.
+	orig = &Message{Header: Header{From: "al@b.c/pc", Type: "chat",
+		Id: "m2"}, Body: []Text{{Chardata: "hi"}}}
+	m = NewReply(orig, "yo", false)
+	assertEquals(t, "al@b.c/pc", string(m.To))
+	assertEquals(t, "yo", firstText(m.Body))
+	if r := m.ReplyTo(); r == nil || r.Id != "m2" {
+		t.Errorf("reply %+v", r)
+	}
+}
@@ -0,0 +1,58 @@
+package xmpp
+
+// This file contains support for spam reporting, XEP-0377.
+
+import (
+	"context"
+	"encoding/xml"
+	"reflect"
+)
+
+const (
+	NsReporting = "urn:xmpp:reporting:1"
+
+	// Reasons for a SpamReport.
+	ReportSpam  = "urn:xmpp:reporting:spam"
+	ReportAbuse = "urn:xmpp:reporting:abuse"
+)
+
+// Reports a JID as a source of spam or abuse. It's sent inside a
+// block request.
+type SpamReport struct {
+	XMLName xml.Name `xml:"urn:xmpp:reporting:1 report"`
+	Reason  string   `xml:"reason,attr"`
+	Text    []Text   `xml:"urn:xmpp:reporting:1 text"`
+}
+
+// ReportingExt may be included in the extensions passed to NewClient
+// to decode block requests carrying spam reports, for example when
+// acting as a service which receives them.
+var ReportingExt Extension = Extension{}
+
+func init() {
+	ReportingExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	bName := xml.Name{Space: NsBlocking, Local: "block"}
+	ReportingExt.StanzaTypes[bName] = reflect.TypeOf(BlockReq{})
+}
+
+// Block the given JID and report it to the server, with reason
+// ReportSpam or ReportAbuse.
+func (cl *Client) Report(ctx context.Context, jid JID, reason string) error {
+	req := &BlockReq{Items: []BlockItem{{Jid: jid,
+		Report: &SpamReport{Reason: reason}}}}
+	iq := &Iq{Header: Header{Type: "set", Nested: []interface{}{req}}}
+	_, err := cl.SendIq(ctx, iq)
+	return err
+}
+
+// Returns the spam reports, keyed by the reported JID, found in a
+// block request.
+func (req *BlockReq) Reports() map[JID]*SpamReport {
+	reports := make(map[JID]*SpamReport)
+	for _, item := range req.Items {
+		if item.Report != nil {
+			reports[item.Jid] = item.Report
+		}
+	}
+	return reports
+}
@@ -0,0 +1,41 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestReportMarshal(t *testing.T) {
+	req := &BlockReq{Items: []BlockItem{{Jid: "spammer@example.com",
+		Report: &SpamReport{Reason: ReportSpam}}}}
+	exp := `<block xmlns="` + NsBlocking + `"><item xmlns="` +
+		NsBlocking + `" jid="spammer@example.com"><report xmlns="` +
+		NsReporting + `" reason="` + ReportSpam + `"></report></item></block>`
+	assertMarshal(t, exp, req)
+}
+
+func TestReportUnmarshal(t *testing.T) {
+	str := `<iq xmlns="jabber:client" type="set"><block xmlns="` +
+		NsBlocking + `"><item jid="a@b.c"><report xmlns="` +
+		NsReporting + `" reason="` + ReportAbuse +
+		`"><text xml:lang="en">rude</text></report></item>` +
+		`<item jid="d@e.f"/></block></iq>`
+	iq := Iq{}
+	xml.Unmarshal([]byte(str), &iq)
+	err := parseExtended(&iq.Header, ReportingExt.StanzaTypes)
+	if err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	req, ok := iq.Nested[0].(*BlockReq)
+	if !ok {
+		t.Fatalf("nested not BlockReq: %T", iq.Nested[0])
+	}
+	reports := req.Reports()
+	if len(reports) != 1 {
+		t.Fatalf("wrong # reports: %v", reports)
+	}
+	rep := reports["a@b.c"]
+	assertEquals(t, ReportAbuse, rep.Reason)
+	assertEquals(t, "rude", rep.Text[0].Chardata)
+	assertEquals(t, "en", rep.Text[0].Lang)
+}
@@ -0,0 +1,176 @@
+package xmpp
+
+// This file contains what ReconnectExt sets up again in a new
+// session: the presence last broadcast, the rooms joined, client
+// state indication and carbons.
+
+import (
+	"context"
+	"time"
+)
+
+// Records a stanza on its way to the server, if it changes what a new
+// session has to set up again. Presence the application broadcasts
+// replaces the initial presence, joining a room adds it, and leaving
+// it, or broadcasting unavailable presence, removes it.
+func (rc *reconnector) sent(st Stanza) {
+	p, ok := st.(*Presence)
+	if rc == nil || !ok {
+		return
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if p.To == "" {
+		switch p.Type {
+		case "unavailable":
+			rc.rooms = nil
+			fallthrough
+		case "":
+			rc.presence = *restorable(p)
+		}
+		return
+	}
+	room := p.To.Bare().Normalized()
+	join := rc.rooms[room]
+	switch {
+	case p.Type == "" && isMucJoin(p):
+		if rc.rooms == nil {
+			rc.rooms = make(map[JID]*Presence)
+		}
+		rc.rooms[room] = restorable(p)
+	case join == nil:
+	case p.Type == "unavailable":
+		delete(rc.rooms, room)
+	case p.Type == "":
+		// Perhaps a new nick.
+		renamed := *join
+		renamed.To = p.To
+		rc.rooms[room] = &renamed
+	}
+}
+
+// Records presence from a room which says we're no longer in it, or
+// that our nick changed.
+func (rc *reconnector) received(st Stanza) {
+	p, ok := st.(*Presence)
+	if rc == nil || !ok || (p.Type != "unavailable" && p.Type != "error") {
+		return
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	room := p.From.Bare().Normalized()
+	join := rc.rooms[room]
+	if join == nil || !p.From.Equal(join.To) {
+		return
+	}
+	if x := p.MucUser(); p.Type == "unavailable" && x != nil &&
+		x.HasStatus(303) && len(x.Items) > 0 && x.Items[0].Nick != "" {
+		renamed := *join
+		renamed.To = JID(string(room) + "/" + x.Items[0].Nick)
+		rc.rooms[room] = &renamed
+		return
+	}
+	delete(rc.rooms, room)
+}
+
+func (rc *reconnector) setInactive(inactive bool) {
+	if rc == nil {
+		return
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.inactive = inactive
+}
+
+func (rc *reconnector) setCarbons(enabled bool) {
+	if rc == nil {
+		return
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.carbons = enabled
+}
+
+// Sets a new session up the way the lost one was, once it's running.
+// The client tells the server it's inactive again first, if it was,
+// so the server can hold back the presence that follows.
+func (cl *Client) restoreSession(lost time.Time) {
+	rc := cl.rc
+	rc.lock.Lock()
+	pr, inactive, carbons := rc.presence, rc.inactive, rc.carbons
+	var rooms []*Presence
+	for _, join := range rc.rooms {
+		rooms = append(rooms, MucRejoinPresence(join, lost))
+	}
+	rc.lock.Unlock()
+
+	if inactive {
+		if err := cl.SetInactive(); err != nil {
+			cl.logf(LogInfo, "can't stay inactive: %v", err)
+		}
+	}
+	cl.runBeforePresence()
+	if carbons && !cl.opts.carbons {
+		// CarbonsExt enables them itself.
+		ctx, cancel := context.WithTimeout(context.Background(),
+			10*time.Second)
+		if err := cl.EnableCarbons(ctx); err != nil {
+			cl.logf(LogError, "can't enable carbons again: %v", err)
+		}
+		cancel()
+	}
+	cl.requestRoster()
+	if pr.Type == "unavailable" {
+		return
+	}
+	cl.sendPresenceAgain(pr)
+	for _, join := range rooms {
+		cl.send(context.Background(), join)
+	}
+}
+
+// Is the presence a request to join a room?
+func isMucJoin(p *Presence) bool {
+	for _, ele := range p.Nested {
+		if _, ok := ele.(*MucJoin); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a copy of a presence which can be sent again in another
+// session. It has no id, and no caps, which are added again as they
+// are then.
+func restorable(p *Presence) *Presence {
+	pr := *p
+	pr.Id = ""
+	pr.Nested = nil
+	for _, ele := range p.Nested {
+		if _, ok := ele.(*Caps); !ok {
+			pr.Nested = append(pr.Nested, ele)
+		}
+	}
+	return &pr
+}
+
+// Returns the presence which joins a room again, given the one which
+// joined it, asking for only the history since the connection was
+// lost, unless the room wasn't to send any.
+func MucRejoinPresence(join *Presence, lost time.Time) *Presence {
+	pr := *join
+	pr.Nested = nil
+	for _, ele := range join.Nested {
+		if mj, ok := ele.(*MucJoin); ok {
+			j := *mj
+			if h := j.History; h == nil || h.MaxStanzas == nil ||
+				*h.MaxStanzas != 0 {
+				j.History = &MucHistory{
+					Since: lost.UTC().Format(time.RFC3339)}
+			}
+			ele = &j
+		}
+		pr.Nested = append(pr.Nested, ele)
+	}
+	return &pr
+}
@@ -0,0 +1,99 @@
+package xmpp
+
+// This file contains support for message retraction, XEP-0424, and
+// message moderation in multi-user chat rooms, XEP-0425. Moderating
+// a room is in the muc subpackage.
+
+import (
+	"encoding/xml"
+	"reflect"
+)
+
+const (
+	NsRetract  = "urn:xmpp:message-retract:1"
+	NsModerate = "urn:xmpp:message-moderate:1"
+)
+
+// The body clients which don't support retraction show instead.
+const retractionFallback = "This person attempted to retract a previous " +
+	"message, but it's unsupported by your client."
+
+// Asks for the message with the given id to be removed. In a chat
+// the id is the origin id the sender gave it; in a room it's the
+// stanza id the room gave it. If a moderator removed it, Moderated
+// says who.
+type Retract struct {
+	XMLName   xml.Name `xml:"urn:xmpp:message-retract:1 retract"`
+	Id        string   `xml:"id,attr,omitempty"`
+	Moderated *Moderated
+	Reason    string `xml:"reason,omitempty"`
+}
+
+// Marks a retraction as made by a room's moderator rather than the
+// message's sender.
+type Moderated struct {
+	XMLName xml.Name `xml:"urn:xmpp:message-moderate:1 moderated"`
+	// The moderator's occupant JID.
+	By JID `xml:"by,attr,omitempty"`
+}
+
+// What an archive keeps in place of a retracted message.
+type Retracted struct {
+	XMLName   xml.Name `xml:"urn:xmpp:message-retract:1 retracted"`
+	Stamp     string   `xml:"stamp,attr,omitempty"`
+	Moderated *Moderated
+	Reason    string `xml:"reason,omitempty"`
+}
+
+// RetractionExt may be included in the extensions passed to NewClient
+// to decode retractions and moderations in incoming messages.
+var RetractionExt Extension = Extension{}
+
+func init() {
+	RetractionExt.Features = []string{NsRetract}
+	RetractionExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	rName := xml.Name{Space: NsRetract, Local: "retract"}
+	RetractionExt.StanzaTypes[rName] = reflect.TypeOf(Retract{})
+	tName := xml.Name{Space: NsRetract, Local: "retracted"}
+	RetractionExt.StanzaTypes[tName] = reflect.TypeOf(Retracted{})
+}
+
+// Returns a message which retracts the earlier message with the given
+// id: its origin id in a chat, or the room's stanza id for it in a
+// room. Send it to the same recipient, with the same type, as the
+// original. It carries a fallback body, and asks to be stored so that
+// archives learn of it.
+func NewRetraction(to JID, typ, id string) *Message {
+	m := &Message{Header: Header{To: to, Type: typ, Id: NextId(),
+		Nested: []interface{}{&Retract{Id: id}}},
+		Body: []Text{{Chardata: retractionFallback}}}
+	m.MarkFallback(NsRetract)
+	m.Nested = append(m.Nested, &StoreHint{})
+	return m
+}
+
+// If the message retracts an earlier one, returns the retraction.
+func (m *Message) Retraction() *Retract {
+	for _, ele := range m.Nested {
+		if r, ok := ele.(*Retract); ok && r.Id != "" {
+			return r
+		}
+	}
+	return nil
+}
+
+// Does this message retract the given earlier one? In a chat, only
+// its sender may retract a message, by its origin id. In a room, the
+// room relays retractions, by the stanza id it gave the message.
+func (m *Message) Retracts(orig *Message) bool {
+	r := m.Retraction()
+	if r == nil {
+		return false
+	}
+	if m.Type == "groupchat" {
+		return m.From.Bare() == orig.From.Bare() &&
+			orig.StanzaIds()[m.From.Bare()] == r.Id
+	}
+	id, _ := orig.OriginId()
+	return id == r.Id && m.From == orig.From
+}
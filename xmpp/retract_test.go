@@ -0,0 +1,61 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestRetraction(t *testing.T) {
+	parse := func(str string) *Message {
+		var m Message
+		if err := xml.Unmarshal([]byte(str), &m); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		types := mergeStanzaTypes(RetractionExt, StanzaIdExt)
+		if err := parseExtended(&m.Header, types); err != nil {
+			t.Fatalf("parseExtended: %v", err)
+		}
+		return &m
+	}
+
+	orig := parse(`<message xmlns="jabber:client" from="al@b.c/pc" ` +
+		`type="chat"><body>oops</body><origin-id xmlns="` + NsSid +
+		`" id="o1"/></message>`)
+	m := parse(`<message xmlns="jabber:client" from="al@b.c/pc" ` +
+		`type="chat"><retract xmlns="` + NsRetract + `" id="o1"/>` +
+		`</message>`)
+	if r := m.Retraction(); r == nil || r.Id != "o1" || r.Moderated != nil {
+		t.Fatalf("retraction %+v", r)
+	}
+	if !m.Retracts(orig) {
+		t.Error("doesn't retract the original")
+	}
+	m.From = "eve@b.c/pc"
+	if m.Retracts(orig) {
+		t.Error("someone else retracted the message")
+	}
+
+	orig = parse(`<message xmlns="jabber:client" from="room@muc/al" ` +
+		`type="groupchat"><body>spam</body><stanza-id xmlns="` + NsSid +
+		`" id="s1" by="room@muc"/></message>`)
+	m = parse(`<message xmlns="jabber:client" from="room@muc" ` +
+		`type="groupchat"><retract xmlns="` + NsRetract + `" id="s1">` +
+		`<moderated xmlns="` + NsModerate + `" by="room@muc/mod"/>` +
+		`<reason>spam</reason></retract></message>`)
+	r := m.Retraction()
+	if r == nil || r.Moderated == nil || r.Moderated.By != "room@muc/mod" ||
+		r.Reason != "spam" {
+		t.Fatalf("moderation %+v", r)
+	}
+	if !m.Retracts(orig) {
+		t.Error("doesn't retract the room's message")
+	}
+
+	m = NewRetraction("bo@b.c", "chat", "o2")
+	if r := m.Retraction(); r == nil || r.Id != "o2" {
+		t.Errorf("retraction %+v", r)
+	}
+	if len(m.Fallbacks()) != 1 || m.Fallbacks()[0].For != NsRetract {
+		t.Errorf("fallbacks %v", m.Fallbacks())
+	}
+}
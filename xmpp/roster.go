@@ -3,90 +3,237 @@ package xmpp
 // This file contains support for roster management, RFC 3921, Section 7.
 
 import (
+	"context"
 	"encoding/xml"
+	"fmt"
 	"reflect"
+	"sort"
+	"sync"
 )
 
+const NsRosterVer = "urn:xmpp:features:rosterver"
+
 // Roster query/result
 type RosterQuery struct {
-	XMLName xml.Name     `xml:"jabber:iq:roster query"`
-	Item    []RosterItem `xml:"item"`
+	XMLName xml.Name `xml:"jabber:iq:roster query"`
+	// The roster version, XEP-0237. It's nil if the server doesn't
+	// version its rosters, or the client has no cached roster to
+	// offer.
+	Ver  *string      `xml:"ver,attr"`
+	Item []RosterItem `xml:"item"`
 }
 
 // See RFC 3921, Section 7.1.
 type RosterItem struct {
 	XMLName      xml.Name `xml:"jabber:iq:roster item"`
 	Jid          JID      `xml:"jid,attr"`
-	Subscription string   `xml:"subscription,attr"`
-	Name         string   `xml:"name,attr"`
-	Group        []string
+	Subscription string   `xml:"subscription,attr,omitempty"`
+	// "subscribe" while our subscription request is pending.
+	Ask   string   `xml:"ask,attr,omitempty"`
+	Name  string   `xml:"name,attr,omitempty"`
+	Group []string `xml:"group"`
+}
+
+// Keeps a copy of the roster between sessions, so that servers which
+// support roster versioning (XEP-0237) only need to send what has
+// // changed since. SaveRoster is called from the client's receiving
+// goroutine, as each versioned roster arrives.
+type RosterCache interface {
+	// Returns the cached roster and its version. An empty version
+	// means nothing is cached.
+	LoadRoster() (ver string, items []RosterItem)
+	// Replaces the cached roster.
+	SaveRoster(ver string, items []RosterItem)
+}
+
+// Returns an extension which keeps the client's roster in cache, and
+// requests only the changes to it from servers which support roster
+// versioning.
+func RosterCacheExt(cache RosterCache) Extension {
+	return Extension{option: func(o *options) {
+		o.rosterCache = cache
+	}}
+}
+
+// A RosterCache which keeps the roster in memory, so it lasts as long
+// as the process. This is enough to spare reconnecting clients a full
+// roster.
+type MemoryRosterCache struct {
+	lock  sync.Mutex
+	ver   string
+	items []RosterItem
+}
+
+func (mc *MemoryRosterCache) LoadRoster() (string, []RosterItem) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return mc.ver, append([]RosterItem(nil), mc.items...)
 }
 
+func (mc *MemoryRosterCache) SaveRoster(ver string, items []RosterItem) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.ver = ver
+	mc.items = append([]RosterItem(nil), items...)
+}
+
+// Each client has its own Roster. Roster pushes and results are
+// applied to it as they arrive, and each change makes a new
+// snapshot, which readers take without waiting for the next change.
 type Roster struct {
 	Extension
-	get      chan []RosterItem
+	state    *rosterState
 	toServer chan Stanza
+	cache    RosterCache
+	// Closed when the client has closed.
+	done chan bool
+	// Incoming subscription requests. If the application doesn't
+	// keep up, they're discarded; they're also passed on to
+	// Client.Recv as usual. Closed when the client closes.
+	Requests <-chan SubscriptionRequest
+	requests chan SubscriptionRequest
+	// The functions Watch has registered.
+	watchers *rosterWatchers
 }
 
-type rosterClient struct {
-	rosterChan   <-chan []RosterItem
-	rosterUpdate chan<- RosterItem
+// What a Roster knows. The roster itself is only used by the
+// receiving filter; the rest is guarded by the lock.
+type rosterState struct {
+	roster map[JID]RosterItem
+	lock   sync.Mutex
+	idx    *rosterIndex
+	// Closed once the first snapshot has been made, or the client
+	// has closed without one.
+	ready     chan bool
+	readyOnce sync.Once
+	// The id of the latest roster request.
+	fetchId string
+	// The user's bare JID, once the roster has been requested. Only
+	// it may change the roster.
+	account JID
+	ver     string
+	// Whether ver is worth sending: the roster came from the cache,
+	// or from a server which versions it, so that a new session
+	// only asks for what changed.
+	versioned bool
 }
 
-func (r *Roster) rosterMgr(upd <-chan Stanza) {
-	roster := make(map[JID]RosterItem)
-	var snapshot []RosterItem
-	var get chan<- []RosterItem
-	for {
-		select {
-		case get <- snapshot:
+// A snapshot of the roster, indexed, with the items in order of JID.
+// It isn't changed once it's made.
+type rosterIndex struct {
+	items  []RosterItem
+	byJid  map[JID]RosterItem
+	groups map[string][]RosterItem
+}
 
-		case stan, ok := <-upd:
-			if !ok {
-				return
-			}
-			iq, ok := stan.(*Iq)
-			if !ok {
-				continue
-			}
-			if iq.Type != "result" && iq.Type != "set" {
-				continue
-			}
-			var rq *RosterQuery
-			for _, ele := range iq.Nested {
-				if q, ok := ele.(*RosterQuery); ok {
-					rq = q
-					break
-				}
-			}
-			if rq == nil {
-				continue
-			}
-			for _, item := range rq.Item {
-				switch item.Subscription {
-				case "none", "from", "to", "both":
-					roster[item.Jid] = item
-				case "remove":
-					delete(roster, item.Jid)
-				}
-			}
-			snapshot = []RosterItem{}
-			for _, ri := range roster {
-				snapshot = append(snapshot, ri)
+func newRosterIndex(roster map[JID]RosterItem) *rosterIndex {
+	idx := &rosterIndex{items: []RosterItem{},
+		byJid:  make(map[JID]RosterItem, len(roster)),
+		groups: make(map[string][]RosterItem)}
+	for jid, ri := range roster {
+		idx.items = append(idx.items, ri)
+		idx.byJid[jid] = ri
+	}
+	sort.Slice(idx.items, func(i, j int) bool {
+		return idx.items[i].Jid < idx.items[j].Jid
+	})
+	for _, ri := range idx.items {
+		for _, g := range ri.Group {
+			idx.groups[g] = append(idx.groups[g], ri)
+		}
+	}
+	return idx
+}
+
+// Starts from the cached roster, if there is one, before the
+// filters run.
+func (r *Roster) load() {
+	s := r.state
+	s.roster = make(map[JID]RosterItem)
+	if r.cache == nil {
+		return
+	}
+	ver, items := r.cache.LoadRoster()
+	for _, item := range items {
+		item.Jid = item.Jid.Normalized()
+		s.roster[item.Jid] = item
+	}
+	s.ver, s.versioned = ver, true
+}
+
+// Applies a roster push or result, and tells the subscription
+// requests apart. Called from the receiving filter.
+func (r *Roster) received(stan Stanza) {
+	s := r.state
+	if pr, ok := stan.(*Presence); ok {
+		r.subscription(pr, s.roster)
+		return
+	}
+	iq, ok := stan.(*Iq)
+	if !ok || (iq.Type != "result" && iq.Type != "set") {
+		return
+	}
+	var rq *RosterQuery
+	for _, ele := range iq.Nested {
+		if q, ok := ele.(*RosterQuery); ok {
+			rq = q
+			break
+		}
+	}
+	s.lock.Lock()
+	if iq.From != "" && iq.From != s.account {
+		s.lock.Unlock()
+		return
+	}
+	reply := iq.Type == "result" && iq.Id == s.fetchId && s.fetchId != ""
+	if reply {
+		s.fetchId = ""
+	}
+	old := s.idx
+	s.lock.Unlock()
+	switch {
+	case rq == nil && !reply:
+		return
+	case rq != nil && reply:
+		// A whole roster replaces what we had.
+		s.roster = make(map[JID]RosterItem)
+	}
+	if rq != nil {
+		for _, item := range rq.Item {
+			item.Jid = item.Jid.Normalized()
+			switch item.Subscription {
+			case "none", "from", "to", "both":
+				s.roster[item.Jid] = item
+			case "remove":
+				delete(s.roster, item.Jid)
 			}
-			get = r.get
 		}
 	}
+	r.notify(old.byJid, s.roster)
+	idx := newRosterIndex(s.roster)
+	s.lock.Lock()
+	s.idx = idx
+	if rq != nil && rq.Ver != nil {
+		s.ver, s.versioned = *rq.Ver, true
+	}
+	s.lock.Unlock()
+	s.readyOnce.Do(func() { close(s.ready) })
+	if rq != nil && rq.Ver != nil && r.cache != nil {
+		r.cache.SaveRoster(*rq.Ver, idx.items)
+	}
 }
 
 func (r *Roster) makeFilters() (Filter, Filter) {
-	rosterUpdate := make(chan Stanza)
-	go r.rosterMgr(rosterUpdate)
 	recv := func(in <-chan Stanza, out chan<- Stanza) {
 		defer close(out)
-		defer close(rosterUpdate)
+		defer func() {
+			s := r.state
+			s.readyOnce.Do(func() { close(s.ready) })
+			close(r.done)
+			close(r.requests)
+		}()
 		for stan := range in {
-			rosterUpdate <- stan
+			r.received(stan)
 			out <- stan
 		}
 	}
@@ -107,29 +254,379 @@ func (r *Roster) makeFilters() (Filter, Filter) {
 	return recv, send
 }
 
-func newRosterExt() *Roster {
-	r := Roster{}
+func newRosterExt(cache RosterCache) *Roster {
+	r := Roster{cache: cache}
 	r.StanzaTypes = make(map[xml.Name]reflect.Type)
 	rName := xml.Name{Space: NsRoster, Local: "query"}
 	r.StanzaTypes[rName] = reflect.TypeOf(RosterQuery{})
+	r.state = &rosterState{idx: &rosterIndex{},
+		ready: make(chan bool)}
+	r.done = make(chan bool)
+	r.requests = make(chan SubscriptionRequest, 16)
+	r.Requests = r.requests
+	r.load()
 	r.RecvFilter, r.SendFilter = r.makeFilters()
-	r.get = make(chan []RosterItem)
+	r.watchers = &rosterWatchers{}
 	r.toServer = make(chan Stanza)
 	return &r
 }
 
-// Return the most recent snapshot of the roster status. This is
-// updated automatically as roster updates are received from the
-// server. This function may block immediately after the XMPP
+// Return the most recent snapshot of the roster status, in order of
+// JID. This is updated automatically as roster updates are received
+// from the server. This function may block immediately after the XMPP
 // connection has been established, until the first roster update is
-// received from the server.
+// received from the server. Once the client has closed, the last
+// snapshot is returned.
 func (r *Roster) Get() []RosterItem {
-	return <-r.get
+	items, _ := r.GetContext(context.Background())
+	return items
+}
+
+// Like Get, but gives up when the context is done.
+func (r *Roster) GetContext(ctx context.Context) ([]RosterItem, error) {
+	idx, err := r.index(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return idx.items, nil
+}
+
+// Returns the latest snapshot, as Get does.
+func (r *Roster) index(ctx context.Context) (*rosterIndex, error) {
+	s := r.state
+	select {
+	case <-s.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.idx, nil
+}
+
+// Returns a contact's roster item, and whether it's in the roster.
+// Like Get, it may wait for the roster to arrive.
+func (r *Roster) Item(ctx context.Context, jid JID) (RosterItem, bool,
+	error) {
+
+	idx, err := r.index(ctx)
+	if err != nil {
+		return RosterItem{}, false, err
+	}
+	ri, ok := idx.byJid[jid.Bare().Normalized()]
+	return ri, ok, nil
+}
+
+// Returns the contacts in a group. Like Get, it may wait for the
+// roster to arrive.
+func (r *Roster) Group(ctx context.Context, name string) ([]RosterItem,
+	error) {
+
+	idx, err := r.index(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return idx.groups[name], nil
+}
+
+// Returns the names of the groups the contacts belong to, sorted.
+// Like Get, it may wait for the roster to arrive.
+func (r *Roster) Groups(ctx context.Context) ([]string, error) {
+	idx, err := r.index(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(idx.groups))
+	for g := range idx.groups {
+		names = append(names, g)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Returns the contacts whose subscription state is one of those
+// given, such as "both", or "to" and "both" for the contacts whose
+// presence we receive. Like Get, it may wait for the roster to
+// arrive.
+func (r *Roster) WithSubscription(ctx context.Context,
+	subscriptions ...string) ([]RosterItem, error) {
+
+	idx, err := r.index(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var res []RosterItem
+	for _, ri := range idx.items {
+		for _, s := range subscriptions {
+			if ri.Subscription == s {
+				res = append(res, ri)
+				break
+			}
+		}
+	}
+	return res, nil
 }
 
-// Asynchronously fetch this entity's roster from the server.
-func (r *Roster) update() {
-	iq := &Iq{Header: Header{Type: "get", Id: NextId(),
-		Nested: []interface{}{RosterQuery{}}}}
-	r.toServer <- iq
+// Asynchronously fetch this entity's roster from the server. If the
+// server versions rosters, only the changes since the cached roster,
+// or the one fetched in an earlier session, are requested.
+func (r *Roster) update(versioned bool) {
+	s := r.state
+	id := NextId()
+	q := RosterQuery{}
+	s.lock.Lock()
+	s.fetchId = id
+	if versioned && s.versioned {
+		ver := s.ver
+		q.Ver = &ver
+	}
+	s.lock.Unlock()
+	iq := &Iq{Header: Header{Type: "get", Id: id,
+		Nested: []interface{}{q}}}
+	select {
+	case r.toServer <- iq:
+	case <-r.done:
+	}
+}
+
+// Requests the roster, once the session is running.
+func (cl *Client) requestRoster() {
+	s := cl.Roster.state
+	s.lock.Lock()
+	s.account = cl.Jid.Bare()
+	s.lock.Unlock()
+	cl.Roster.update(cl.Features != nil && cl.Features.RosterVer != nil)
+}
+
+// Sends a roster set with one item, and waits for the server to
+// accept it.
+func (cl *Client) rosterSet(ctx context.Context, item RosterItem) error {
+	iq := &Iq{Header: Header{Type: "set", Nested: []interface{}{
+		&RosterQuery{Item: []RosterItem{item}}}}}
+	_, err := cl.SendIq(ctx, iq)
+	return err
+}
+
+// Returns a contact's current roster item, ready to be changed and
+// sent back in a roster set.
+func (cl *Client) rosterItem(ctx context.Context, jid JID) (RosterItem, error) {
+	items, err := cl.Roster.GetContext(ctx)
+	if err != nil {
+		return RosterItem{}, err
+	}
+	for _, item := range items {
+		if item.Jid.Equal(jid) {
+			// The subscription is the server's business.
+			item.Subscription = ""
+			return item, nil
+		}
+	}
+	return RosterItem{}, fmt.Errorf("%s isn't in the roster", jid)
+}
+
+// Adds a contact to the roster, or replaces its name and groups if
+// it's already there. This doesn't ask for a subscription. RFC 6121,
+// section 2.3.
+func (cl *Client) AddContact(ctx context.Context, jid JID, name string,
+	groups []string) error {
+
+	return cl.rosterSet(ctx, RosterItem{Jid: jid, Name: name,
+		Group: groups})
+}
+
+// Removes a contact from the roster. The server also cancels any
+// subscriptions to and from it. RFC 6121, section 2.5.
+func (cl *Client) RemoveContact(ctx context.Context, jid JID) error {
+	return cl.rosterSet(ctx, RosterItem{Jid: jid, Subscription: "remove"})
+}
+
+// Changes the name of a contact in the roster, keeping its groups.
+func (cl *Client) RenameContact(ctx context.Context, jid JID,
+	name string) error {
+
+	item, err := cl.rosterItem(ctx, jid)
+	if err != nil {
+		return err
+	}
+	item.Name = name
+	return cl.rosterSet(ctx, item)
+}
+
+// Replaces the groups a contact in the roster belongs to, keeping its
+// name.
+func (cl *Client) SetContactGroups(ctx context.Context, jid JID,
+	groups []string) error {
+
+	item, err := cl.rosterItem(ctx, jid)
+	if err != nil {
+		return err
+	}
+	item.Group = groups
+	return cl.rosterSet(ctx, item)
+}
+
+// Renames a group, by moving each of its contacts to the new group.
+// If newName is empty the group is removed instead, and its contacts
+// stay in the roster. Stops at the first contact the server won't
+// change.
+func (cl *Client) RenameGroup(ctx context.Context, oldName,
+	newName string) error {
+
+	items, err := cl.Roster.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		var groups []string
+		found, present := false, false
+		for _, g := range item.Group {
+			if g == oldName {
+				found = true
+				continue
+			}
+			present = present || g == newName
+			groups = append(groups, g)
+		}
+		if !found {
+			continue
+		}
+		if newName != "" && !present {
+			groups = append(groups, newName)
+		}
+		item.Subscription = ""
+		item.Group = groups
+		if err := cl.rosterSet(ctx, item); err != nil {
+			return fmt.Errorf("moving %s: %v", item.Jid, err)
+		}
+	}
+	return nil
+}
+
+// Removes a group from all the contacts in it. The contacts stay in
+// the roster.
+func (cl *Client) RemoveGroup(ctx context.Context, name string) error {
+	return cl.RenameGroup(ctx, name, "")
+}
+
+// What happened to a roster item.
+type RosterEventKind int
+
+const (
+	// A contact was added to the roster.
+	RosterItemAdded RosterEventKind = iota
+	// A contact's name or groups changed.
+	RosterItemUpdated
+	// A contact was removed from the roster.
+	RosterItemRemoved
+	// A contact's subscription state changed, or a subscription
+	// request was sent or withdrawn. Its name and groups may have
+	// changed too.
+	RosterSubscriptionChanged
+)
+
+// A change to one roster item. Item is the item as it is now, and Old
+// as it was before; Old is nil when the item was added, and Item is
+// nil when it was removed.
+type RosterEvent struct {
+	Kind RosterEventKind
+	Jid  JID
+	Item *RosterItem
+	Old  *RosterItem
+}
+
+type rosterWatcher struct {
+	f func(RosterEvent)
+}
+
+// The list is copied on change.
+type rosterWatchers struct {
+	lock sync.Mutex
+	list []*rosterWatcher
+}
+
+// Registers a function to be called with each change to the roster,
+// in order, as roster pushes and results arrive. The function
+// removes it again. f is called from the client's receiving
+// goroutine, so the roster doesn't change, and nothing more is
+// received, until it returns; it mustn't call Get or the other
+// methods which wait for the roster.
+func (r *Roster) Watch(f func(RosterEvent)) (stop func()) {
+	w := &rosterWatcher{f: f}
+	rw := r.watchers
+	rw.lock.Lock()
+	rw.list = append(rw.list[:len(rw.list):len(rw.list)], w)
+	rw.lock.Unlock()
+	return func() {
+		rw.lock.Lock()
+		defer rw.lock.Unlock()
+		var list []*rosterWatcher
+		for _, other := range rw.list {
+			if other != w {
+				list = append(list, other)
+			}
+		}
+		rw.list = list
+	}
+}
+
+// Tells the watchers how the roster has changed. Called from the
+// receiving filter.
+func (r *Roster) notify(old, roster map[JID]RosterItem) {
+	r.watchers.lock.Lock()
+	ws := r.watchers.list
+	r.watchers.lock.Unlock()
+	if len(ws) == 0 {
+		return
+	}
+	var events []RosterEvent
+	for jid, ri := range roster {
+		ri := ri
+		prev, ok := old[jid]
+		switch {
+		case !ok:
+			events = append(events, RosterEvent{Kind: RosterItemAdded,
+				Jid: jid, Item: &ri})
+		case prev.Subscription != ri.Subscription || prev.Ask != ri.Ask:
+			events = append(events, RosterEvent{
+				Kind: RosterSubscriptionChanged, Jid: jid,
+				Item: &ri, Old: &prev})
+		case prev.Name != ri.Name || !sameGroups(prev.Group, ri.Group):
+			events = append(events, RosterEvent{
+				Kind: RosterItemUpdated, Jid: jid, Item: &ri,
+				Old: &prev})
+		}
+	}
+	for jid, prev := range old {
+		prev := prev
+		if _, ok := roster[jid]; !ok {
+			events = append(events, RosterEvent{
+				Kind: RosterItemRemoved, Jid: jid, Old: &prev})
+		}
+	}
+	// The same order every time.
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Jid < events[j].Jid
+	})
+	for _, ev := range events {
+		for _, w := range ws {
+			w.f(ev)
+		}
+	}
+}
+
+// Whether two lists hold the same groups, in any order.
+func sameGroups(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := make(map[string]int)
+	for _, g := range a {
+		count[g]++
+	}
+	for _, g := range b {
+		if count[g]--; count[g] < 0 {
+			return false
+		}
+	}
+	return true
 }
@@ -1,8 +1,14 @@
 package xmpp
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"encoding/xml"
+	"fmt"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 )
 
@@ -51,3 +57,398 @@ func TestRosterIqUnmarshal(t *testing.T) {
 	item := rq.Item[0]
 	assertEquals(t, "a@b.c", string(item.Jid))
 }
+
+func TestRosterItemMarshal(t *testing.T) {
+	q := &RosterQuery{Item: []RosterItem{{Jid: "a@b.c", Name: "A",
+		Group: []string{"Friends", "Work"}}}}
+	exp := `<query xmlns="` + NsRoster + `"><item xmlns="` + NsRoster +
+		`" jid="a@b.c" name="A"><group>Friends</group>` +
+		`<group>Work</group></item></query>`
+	assertMarshal(t, exp, q)
+
+	var rq RosterQuery
+	if err := xml.Unmarshal([]byte(exp), &rq); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	assertEquals(t, "Work", rq.Item[0].Group[1])
+}
+
+// Returns a Roster which has received the items.
+func rosterOf(items []RosterItem) Roster {
+	r := newRosterExt(nil)
+	roster := make(map[JID]RosterItem)
+	for _, ri := range items {
+		roster[ri.Jid] = ri
+	}
+	r.state.idx = newRosterIndex(roster)
+	close(r.state.ready)
+	return *r
+}
+
+func TestExportRoster(t *testing.T) {
+	cl := &Client{Jid: "me@b.c/x", Roster: rosterOf([]RosterItem{{
+		Jid: "a@b.c", Subscription: "both",
+		Group: []string{"Friends"}}})}
+	buf, err := json.Marshal(cl.ExportRoster())
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	assertEquals(t, `{"jid":"me@b.c","items":[{"jid":"a@b.c",`+
+		`"subscription":"both","groups":["Friends"]}]}`, string(buf))
+}
+
+func TestRosterGetContext(t *testing.T) {
+	r := newRosterExt(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// No roster has been received, so this would block.
+	if _, err := r.GetContext(ctx); err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRosterClosed(t *testing.T) {
+	r := newRosterExt(nil)
+	in := make(chan Stanza)
+	out := make(chan Stanza, 1)
+	go r.RecvFilter(in, out)
+	in <- &Iq{Header: Header{Type: "result", Nested: []interface{}{
+		&RosterQuery{Item: []RosterItem{{Jid: "a@b.c",
+			Subscription: "both"}}}}}}
+	<-out
+	close(in)
+	// Once the client has closed, the last roster is still there.
+	for i := 0; i < 2; i++ {
+		items := r.Get()
+		if len(items) != 1 {
+			t.Fatalf("got %v", items)
+		}
+		assertEquals(t, "a@b.c", string(items[0].Jid))
+	}
+}
+
+func TestRosterPushFrom(t *testing.T) {
+	cl := &Client{Jid: "me@b.c/r"}
+	cl.Roster = *newRosterExt(nil)
+	r := &cl.Roster
+	in := make(chan Stanza)
+	out := make(chan Stanza, 1)
+	go r.RecvFilter(in, out)
+	defer close(in)
+	sent := make(chan Stanza, 1)
+	go func() { sent <- <-r.toServer }()
+	cl.requestRoster()
+	fetch := (<-sent).(*Iq)
+	push := func(from JID, jid JID) {
+		in <- &Iq{Header: Header{From: from, Type: "set",
+			Nested: []interface{}{&RosterQuery{Item: []RosterItem{
+				{Jid: jid, Subscription: "both"}}}}}}
+		<-out
+	}
+	in <- &Iq{Header: Header{From: "me@b.c", Id: fetch.Id, Type: "result",
+		Nested: []interface{}{&RosterQuery{}}}}
+	<-out
+	// A stranger's push is ignored; the account's own are not.
+	push("mallory@evil.example", "mallory@evil.example")
+	push("me@b.c", "a@b.c")
+	push("", "d@b.c")
+	items := r.Get()
+	if len(items) != 2 || items[0].Jid != "a@b.c" ||
+		items[1].Jid != "d@b.c" {
+		t.Errorf("got %v", items)
+	}
+}
+
+func TestRosterReadDuringPush(t *testing.T) {
+	r := newRosterExt(nil)
+	in := make(chan Stanza)
+	out := make(chan Stanza, 2)
+	go r.RecvFilter(in, out)
+	defer close(in)
+	push := func(jid JID) {
+		in <- &Iq{Header: Header{Type: "set", Nested: []interface{}{
+			&RosterQuery{Item: []RosterItem{{Jid: jid,
+				Subscription: "both"}}}}}}
+	}
+	push("a@b.c")
+	<-out
+	// While a watcher holds up the next push, readers still get the
+	// roster as it was.
+	held := make(chan bool)
+	release := make(chan bool)
+	stop := r.Watch(func(RosterEvent) {
+		held <- true
+		<-release
+	})
+	defer stop()
+	go push("d@b.c")
+	<-held
+	items := r.Get()
+	if len(items) != 1 || items[0].Jid != "a@b.c" {
+		t.Errorf("during push: %v", items)
+	}
+	close(release)
+	<-out
+	if items := r.Get(); len(items) != 2 {
+		t.Errorf("after push: %v", items)
+	}
+}
+
+func TestRosterMutation(t *testing.T) {
+	send := make(chan Stanza, 1)
+	items := []RosterItem{{Jid: "a@b.c", Name: "A",
+		Subscription: "both", Group: []string{"Friends", "Work"}},
+		{Jid: "d@b.c", Subscription: "to", Group: []string{"Work"}}}
+	cl := &Client{handlers: make(chan *callback, 1), Send: send,
+		Roster: rosterOf(items)}
+	// Answers each roster set, and reports the items in it.
+	sets := make(chan string, 10)
+	go func() {
+		for {
+			h := <-cl.handlers
+			iq := (<-send).(*Iq)
+			rq := iq.Nested[0].(*RosterQuery)
+			buf, _ := xml.Marshal(rq.Item[0])
+			sets <- string(buf)
+			h.f(&Iq{Header: Header{Id: iq.Id, Type: "result"}})
+		}
+	}()
+	ctx := context.Background()
+	item := func(attrs, inner string) string {
+		return `<item xmlns="` + NsRoster + `"` + attrs + `>` + inner +
+			`</item>`
+	}
+
+	if err := cl.AddContact(ctx, "e@b.c", "E",
+		[]string{"Friends"}); err != nil {
+		t.Fatalf("AddContact: %v", err)
+	}
+	assertEquals(t, item(` jid="e@b.c" name="E"`,
+		`<group>Friends</group>`), <-sets)
+
+	cl.RemoveContact(ctx, "e@b.c")
+	assertEquals(t, item(` jid="e@b.c" subscription="remove"`, ""),
+		<-sets)
+
+	if err := cl.RenameContact(ctx, "a@b.c", "Al"); err != nil {
+		t.Fatalf("RenameContact: %v", err)
+	}
+	assertEquals(t, item(` jid="a@b.c" name="Al"`,
+		`<group>Friends</group><group>Work</group>`), <-sets)
+
+	if err := cl.RenameContact(ctx, "x@b.c", "X"); err == nil {
+		t.Error("renaming a stranger should fail")
+	}
+
+	cl.RenameGroup(ctx, "Work", "Office")
+	assertEquals(t, item(` jid="a@b.c" name="A"`,
+		`<group>Friends</group><group>Office</group>`), <-sets)
+	assertEquals(t, item(` jid="d@b.c"`, `<group>Office</group>`), <-sets)
+
+	// A contact already in both groups isn't in the new one twice.
+	cl.RenameGroup(ctx, "Work", "Friends")
+	assertEquals(t, item(` jid="a@b.c" name="A"`,
+		`<group>Friends</group>`), <-sets)
+	assertEquals(t, item(` jid="d@b.c"`, `<group>Friends</group>`), <-sets)
+
+	cl.RemoveGroup(ctx, "Friends")
+	assertEquals(t, item(` jid="a@b.c" name="A"`, `<group>Work</group>`),
+		<-sets)
+}
+
+func TestRosterVersioning(t *testing.T) {
+	cache := &MemoryRosterCache{}
+	cache.SaveRoster("v1", []RosterItem{{Jid: "a@b.c",
+		Subscription: "both"}})
+	r := newRosterExt(cache)
+	in := make(chan Stanza)
+	out := make(chan Stanza, 1)
+	go r.RecvFilter(in, out)
+	sendIn := make(chan Stanza)
+	sent := make(chan Stanza, 1)
+	go r.SendFilter(sendIn, sent)
+	defer close(sendIn)
+	defer close(in)
+
+	go r.update(true)
+	iq := (<-sent).(*Iq)
+	q := iq.Nested[0].(RosterQuery)
+	if q.Ver == nil {
+		t.Fatal("no version in roster request")
+	}
+	assertEquals(t, "v1", *q.Ver)
+
+	// An empty result means the cached roster is current.
+	in <- &Iq{Header: Header{Type: "result", Id: iq.Id}}
+	<-out
+	items := r.Get()
+	if len(items) != 1 {
+		t.Fatalf("got %v", items)
+	}
+	assertEquals(t, "a@b.c", string(items[0].Jid))
+
+	ver := "v2"
+	in <- &Iq{Header: Header{Type: "set", Nested: []interface{}{
+		&RosterQuery{Ver: &ver, Item: []RosterItem{{Jid: "a@b.c",
+			Subscription: "remove"}, {Jid: "d@b.c",
+			Subscription: "to"}}}}}}
+	<-out
+	r.Get()
+	cv, citems := cache.LoadRoster()
+	assertEquals(t, "v2", cv)
+	if len(citems) != 1 {
+		t.Fatalf("cached %v", citems)
+	}
+	assertEquals(t, "d@b.c", string(citems[0].Jid))
+
+	// Without versioning the whole roster is requested.
+	go r.update(false)
+	iq = (<-sent).(*Iq)
+	if iq.Nested[0].(RosterQuery).Ver != nil {
+		t.Error("unexpected version")
+	}
+}
+
+func TestRosterNormalized(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret", RosterItem{Jid: "Bob@B.c",
+		Subscription: "both"}, RosterItem{Jid: "bob@b.c",
+		Subscription: "both", Name: "Bob"})
+	cl := mockClient(t, s, "alice@b.c/pc", "secret", &tls.Config{})
+	defer cl.Close()
+	if r := cl.Roster.Get(); len(r) != 1 || r[0].Jid != "bob@b.c" {
+		t.Errorf("roster %v", r)
+	}
+
+	s.Send(&Message{Header: Header{From: "BOB@b.c/x", To: "alice@b.c/pc"}})
+	assertEquals(t, "bob@b.c/x", string(recvMessage(t, cl).From))
+}
+
+func TestRosterIndex(t *testing.T) {
+	r := newRosterExt(nil)
+	in := make(chan Stanza)
+	out := make(chan Stanza, 1)
+	go r.RecvFilter(in, out)
+	defer close(in)
+	in <- &Iq{Header: Header{Type: "result", Nested: []interface{}{
+		&RosterQuery{Item: []RosterItem{
+			{Jid: "a@b.c", Subscription: "both",
+				Group: []string{"Friends", "Work"}},
+			{Jid: "d@b.c", Subscription: "to",
+				Group: []string{"Work"}},
+			{Jid: "e@b.c", Subscription: "none"}}}}}}
+	<-out
+
+	ctx := context.Background()
+	if ri, ok, _ := r.Item(ctx, "A@b.c/phone"); !ok ||
+		ri.Subscription != "both" {
+		t.Errorf("got %v %v", ri, ok)
+	}
+	if _, ok, _ := r.Item(ctx, "x@b.c"); ok {
+		t.Error("found a contact who isn't there")
+	}
+	jids := func(items []RosterItem, err error) string {
+		var s []string
+		for _, ri := range items {
+			s = append(s, string(ri.Jid))
+		}
+		sort.Strings(s)
+		return strings.Join(s, " ")
+	}
+	assertEquals(t, "a@b.c d@b.c", jids(r.Group(ctx, "Work")))
+	assertEquals(t, "a@b.c", jids(r.Group(ctx, "Friends")))
+	groups, _ := r.Groups(ctx)
+	assertEquals(t, "Friends Work", strings.Join(groups, " "))
+	assertEquals(t, "a@b.c d@b.c", jids(r.WithSubscription(ctx, "to",
+		"both")))
+	assertEquals(t, "e@b.c", jids(r.WithSubscription(ctx, "none")))
+}
+
+func TestRosterWatch(t *testing.T) {
+	r := newRosterExt(nil)
+	in := make(chan Stanza)
+	out := make(chan Stanza, 1)
+	go r.RecvFilter(in, out)
+	defer close(in)
+	events := make(chan string, 10)
+	stop := r.Watch(func(ev RosterEvent) {
+		s := fmt.Sprint(ev.Kind, " ", ev.Jid)
+		if ev.Item != nil {
+			s += " " + ev.Item.Subscription + "/" + ev.Item.Name
+		}
+		events <- s
+	})
+	push := func(typ string, items ...RosterItem) {
+		in <- &Iq{Header: Header{Type: typ, Nested: []interface{}{
+			&RosterQuery{Item: items}}}}
+		<-out
+		// Once the roster goroutine answers, it's done with the
+		// push.
+		r.Get()
+	}
+	expect := func(want ...string) {
+		t.Helper()
+		for _, w := range want {
+			assertEquals(t, w, <-events)
+		}
+		select {
+		case ev := <-events:
+			t.Errorf("unexpected %s", ev)
+		default:
+		}
+	}
+
+	push("result", RosterItem{Jid: "a@b.c", Subscription: "none"},
+		RosterItem{Jid: "d@b.c", Subscription: "both", Name: "D"})
+	expect(fmt.Sprint(RosterItemAdded)+" a@b.c none/",
+		fmt.Sprint(RosterItemAdded)+" d@b.c both/D")
+	push("set", RosterItem{Jid: "a@b.c", Subscription: "to"})
+	expect(fmt.Sprint(RosterSubscriptionChanged) + " a@b.c to/")
+	push("set", RosterItem{Jid: "d@b.c", Subscription: "both",
+		Name: "Dee"})
+	expect(fmt.Sprint(RosterItemUpdated) + " d@b.c both/Dee")
+	// Nothing changed.
+	push("set", RosterItem{Jid: "d@b.c", Subscription: "both",
+		Name: "Dee"})
+	expect()
+	push("set", RosterItem{Jid: "d@b.c", Subscription: "remove"})
+	expect(fmt.Sprint(RosterItemRemoved) + " d@b.c")
+
+	stop()
+	push("set", RosterItem{Jid: "e@b.c", Subscription: "none"})
+	expect()
+}
+
+func TestRosterVersionKept(t *testing.T) {
+	r := newRosterExt(nil)
+	in := make(chan Stanza)
+	out := make(chan Stanza, 1)
+	go r.RecvFilter(in, out)
+	sendIn := make(chan Stanza)
+	sent := make(chan Stanza, 1)
+	go r.SendFilter(sendIn, sent)
+	defer close(sendIn)
+	defer close(in)
+
+	go r.update(true)
+	iq := (<-sent).(*Iq)
+	if iq.Nested[0].(RosterQuery).Ver != nil {
+		t.Error("version without a roster")
+	}
+	ver := "v1"
+	in <- &Iq{Header: Header{Type: "result", Id: iq.Id,
+		Nested: []interface{}{&RosterQuery{Ver: &ver,
+			Item: []RosterItem{{Jid: "a@b.c", Subscription: "both"}}}}}}
+	<-out
+
+	// A later session only asks for what changed, even without a
+	// cache.
+	go r.update(true)
+	iq = (<-sent).(*Iq)
+	q := iq.Nested[0].(RosterQuery)
+	if q.Ver == nil {
+		t.Fatal("no version in roster request")
+	}
+	assertEquals(t, "v1", *q.Ver)
+}
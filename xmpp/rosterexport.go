@@ -0,0 +1,50 @@
+package xmpp
+
+// This file contains export and import of the roster, for moving
+// contacts between accounts.
+
+import (
+	"context"
+	"fmt"
+)
+
+// A portable copy of a roster, suitable for encoding as JSON.
+type RosterExport struct {
+	// The account the roster was exported from.
+	Jid   JID                `json:"jid,omitempty"`
+	Items []RosterExportItem `json:"items"`
+}
+
+type RosterExportItem struct {
+	Jid  JID    `json:"jid"`
+	Name string `json:"name,omitempty"`
+	// One of none, from, to, or both.
+	Subscription string   `json:"subscription"`
+	Groups       []string `json:"groups,omitempty"`
+}
+
+// Returns a copy of the client's roster. Like Roster.Get, this may
+// block until the roster has been received from the server.
+func (cl *Client) ExportRoster() *RosterExport {
+	exp := &RosterExport{Jid: cl.Jid.Bare()}
+	for _, item := range cl.Roster.Get() {
+		exp.Items = append(exp.Items, RosterExportItem{Jid: item.Jid,
+			Name: item.Name, Subscription: item.Subscription,
+			Groups: item.Group})
+	}
+	return exp
+}
+
+// Adds the items of an exported roster to the client's roster, with
+// their names and groups, one roster set at a time. Subscriptions
+// can't be carried over this way; the contacts have to be asked
+// again. Stops at the first item the server rejects.
+func (cl *Client) ImportRoster(ctx context.Context, exp *RosterExport) error {
+	for _, it := range exp.Items {
+		err := cl.AddContact(ctx, it.Jid, it.Name, it.Groups)
+		if err != nil {
+			return fmt.Errorf("importing %s: %v", it.Jid, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package xmpp
+
+// This file contains roster item exchange, XEP-0144: other entities
+// suggesting contacts to add, remove or change, and suggesting them to
+// others.
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+const NsRosterX = "http://jabber.org/protocol/rosterx"
+
+// The actions a suggested item may have.
+const (
+	RosterXAdd    = "add"
+	RosterXDelete = "delete"
+	RosterXModify = "modify"
+)
+
+// Suggested roster items.
+type RosterExchange struct {
+	XMLName xml.Name             `xml:"http://jabber.org/protocol/rosterx x"`
+	Items   []RosterExchangeItem `xml:"item"`
+}
+
+// A contact to add, remove or change. An empty Action means add.
+type RosterExchangeItem struct {
+	Action string   `xml:"action,attr,omitempty"`
+	Jid    JID      `xml:"jid,attr"`
+	Name   string   `xml:"name,attr,omitempty"`
+	Group  []string `xml:"group"`
+}
+
+// Suggestions received from another entity, to be answered with
+// Accept or Decline. Items may be pruned before accepting.
+type RosterSuggestion struct {
+	From  JID
+	Items []RosterExchangeItem
+	// The message or iq which carried the suggestions.
+	Stanza Stanza
+	rm     *RosterExchangeManager
+}
+
+// RosterExchangeManager is an extension which delivers the roster
+// items other entities suggest on Suggestions, instead of in the
+// stanzas carrying them. Anyone may send suggestions, so they should
+// only be accepted from trusted senders, such as contacts or the
+// user's own server.
+type RosterExchangeManager struct {
+	Extension
+	// Buffered; suggestions are dropped if it fills up.
+	Suggestions <-chan *RosterSuggestion
+	suggestions chan *RosterSuggestion
+	lock        sync.Mutex
+	cl          *Client
+}
+
+// Creates a RosterExchangeManager, to be passed to NewClient among
+// the extensions.
+func NewRosterExchangeManager() *RosterExchangeManager {
+	rm := &RosterExchangeManager{}
+	rm.suggestions = make(chan *RosterSuggestion, 10)
+	rm.Suggestions = rm.suggestions
+	rm.Features = []string{NsRosterX}
+	rm.StanzaTypes = make(map[xml.Name]reflect.Type)
+	xName := xml.Name{Space: NsRosterX, Local: "x"}
+	rm.StanzaTypes[xName] = reflect.TypeOf(RosterExchange{})
+	rm.RecvFilter = rm.recvFilter
+	// Before the presence rather than in Start, so that the client
+	// is known by the time any suggestions arrive.
+	rm.BeforePresence = func(cl *Client) {
+		rm.lock.Lock()
+		rm.cl = cl
+		rm.lock.Unlock()
+	}
+	return rm
+}
+
+func (rm *RosterExchangeManager) client() (*Client, error) {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+	if rm.cl == nil {
+		return nil, fmt.Errorf("roster exchange manager not started")
+	}
+	return rm.cl, nil
+}
+
+func (rm *RosterExchangeManager) recvFilter(in <-chan Stanza,
+	out chan<- Stanza) {
+
+	defer close(out)
+	for stan := range in {
+		s := rm.suggestion(stan)
+		if s == nil {
+			out <- stan
+			continue
+		}
+		select {
+		case rm.suggestions <- s:
+		default:
+		}
+	}
+}
+
+// Returns the suggestions a stanza carries, or nil if it isn't an
+// exchange.
+func (rm *RosterExchangeManager) suggestion(stan Stanza) *RosterSuggestion {
+	h := stan.GetHeader()
+	switch st := stan.(type) {
+	case *Iq:
+		if st.Type != "set" {
+			return nil
+		}
+	case *Message:
+		if st.Type == "error" {
+			return nil
+		}
+	default:
+		return nil
+	}
+	for _, ele := range h.Nested {
+		if x, ok := ele.(*RosterExchange); ok {
+			return &RosterSuggestion{From: h.From, Items: x.Items,
+				Stanza: stan, rm: rm}
+		}
+	}
+	return nil
+}
+
+// Makes the suggested changes to the roster, asking the contacts
+// added for subscriptions, and acknowledges an iq which carried them.
+// Stops at the first change the server won't make.
+func (s *RosterSuggestion) Accept(ctx context.Context) error {
+	cl, err := s.rm.client()
+	if err != nil {
+		return err
+	}
+	for _, it := range s.Items {
+		var err error
+		switch it.Action {
+		case RosterXDelete:
+			err = cl.RemoveContact(ctx, it.Jid)
+		case RosterXModify:
+			err = cl.AddContact(ctx, it.Jid, it.Name, it.Group)
+		default:
+			err = cl.AddContact(ctx, it.Jid, it.Name, it.Group)
+			if err == nil {
+				cl.RequestSubscription(it.Jid, "")
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	s.answer(cl, nil)
+	return nil
+}
+
+// Refuses the suggestions. If an iq carried them, it's answered with
+// an error.
+func (s *RosterSuggestion) Decline() error {
+	cl, err := s.rm.client()
+	if err != nil {
+		return err
+	}
+	s.answer(cl, stanzaError("cancel", "not-acceptable"))
+	return nil
+}
+
+func (s *RosterSuggestion) answer(cl *Client, e *Error) {
+	iq, ok := s.Stanza.(*Iq)
+	if !ok {
+		return
+	}
+	reply := &Iq{Header: Header{To: iq.From, Id: iq.Id, Type: "result"}}
+	if e != nil {
+		reply.Type = "error"
+		reply.Error = e
+	}
+	cl.Send <- reply
+}
+
+// Suggests roster items to another entity, in a message so that it
+// needn't be online.
+func (cl *Client) SuggestContacts(to JID, items []RosterExchangeItem) {
+	cl.Send <- &Message{Header: Header{To: to, Id: cl.NextId(),
+		Nested: []interface{}{&RosterExchange{Items: items}}}}
+}
@@ -0,0 +1,48 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func TestRosterExchange(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	s.AddUser("bob", "secret", RosterItem{Jid: "dan@b.c",
+		Subscription: "both"})
+	alice := mockClient(t, s, "alice@b.c/pc", "secret", &tls.Config{})
+	defer alice.Close()
+	rm := NewRosterExchangeManager()
+	jid := JID("bob@b.c/pc")
+	bob, err := NewClientFromConn(s.Dial(), &jid, "secret", &tls.Config{},
+		[]Extension{rm.Extension}, Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn: %v", err)
+	}
+	defer bob.Close()
+
+	alice.SuggestContacts(jid, []RosterExchangeItem{
+		{Action: RosterXAdd, Jid: "carol@b.c", Name: "Carol",
+			Group: []string{"Friends"}},
+		{Action: RosterXDelete, Jid: "dan@b.c"}})
+	var sug *RosterSuggestion
+	select {
+	case sug = <-rm.Suggestions:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no suggestion")
+	}
+	assertEquals(t, "alice@b.c/pc", string(sug.From))
+	if len(sug.Items) != 2 || sug.Items[0].Group[0] != "Friends" {
+		t.Fatalf("items %+v", sug.Items)
+	}
+	if err := sug.Accept(context.Background()); err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	r := s.Roster("bob")
+	if len(r) != 1 || r[0].Jid != "carol@b.c" || r[0].Name != "Carol" {
+		t.Errorf("bob's roster %+v", r)
+	}
+}
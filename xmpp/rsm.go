@@ -0,0 +1,141 @@
+package xmpp
+
+// This file contains support for result set management, XEP-0059,
+// which is used to page through long lists of results.
+
+import (
+	"encoding/xml"
+)
+
+const NsRsm = "http://jabber.org/protocol/rsm"
+
+// Requests, or describes, one page of a result set. In a request,
+// Max limits the page size, and After or Before give the id of the
+// item the page follows or precedes. An empty Before asks for the
+// last page. In a result, First and Last give the ids of the page's
+// first and last items, and Count may give the size of the whole
+// set.
+type RsmSet struct {
+	XMLName xml.Name  `xml:"http://jabber.org/protocol/rsm set"`
+	Max     *int      `xml:"max,omitempty"`
+	After   string    `xml:"after,omitempty"`
+	Before  *string   `xml:"before"`
+	Index   *int      `xml:"index,omitempty"`
+	Count   *int      `xml:"count,omitempty"`
+	First   *RsmFirst `xml:"first"`
+	Last    string    `xml:"last,omitempty"`
+}
+
+type RsmFirst struct {
+	Index *int   `xml:"index,attr,omitempty"`
+	Id    string `xml:",chardata"`
+}
+
+// Returns the id of the first item in a result page, if given.
+func (s *RsmSet) FirstId() string {
+	if s == nil || s.First == nil {
+		return ""
+	}
+	return s.First.Id
+}
+
+// RsmPager pages through a result set, one request at a time. It's
+// used like bufio.Scanner, with a function which sends each request
+// and collects the items in the reply:
+//
+//	p := NewRsmPager(100, func(req *RsmSet) (*RsmSet, int, error) {
+//		reply, err := ...send a query including req...
+//		...keep the items...
+//		return replySet, len(items), err
+//	})
+//	for p.Next() {
+//	}
+//	if err := p.Err(); err != nil {
+//		...
+//	}
+//
+// Paging stops when a reply has no items or no set, or the server
+// makes no progress, as happens with servers which ignore the
+// request.
+type RsmPager struct {
+	// Page backwards from the end of the set, rather than forwards
+	// from the start.
+	Reverse bool
+	max     int
+	fetch   func(req *RsmSet) (*RsmSet, int, error)
+	// The id to continue from.
+	cursor  string
+	started bool
+	done    bool
+	err     error
+	// The set describing the page most recently fetched.
+	page *RsmSet
+}
+
+// Returns an RsmPager which asks for pageSize items at a time, or
+// lets the server choose if pageSize is zero. The fetch function is
+// given the set to include in each request, which is nil when
+// there's nothing to ask for, and returns the set describing the
+// page it got, if any, and how many items were in it.
+func NewRsmPager(pageSize int,
+	fetch func(req *RsmSet) (*RsmSet, int, error)) *RsmPager {
+
+	return &RsmPager{max: pageSize, fetch: fetch}
+}
+
+// Fetches the next page. Returns false when there are no more pages
+// or an error occurred.
+func (p *RsmPager) Next() bool {
+	if p.done || p.err != nil {
+		return false
+	}
+	var req *RsmSet
+	if p.max > 0 || p.Reverse || p.cursor != "" {
+		req = &RsmSet{}
+		if p.max > 0 {
+			max := p.max
+			req.Max = &max
+		}
+		if p.Reverse {
+			before := p.cursor
+			req.Before = &before
+		} else {
+			req.After = p.cursor
+		}
+	}
+	res, n, err := p.fetch(req)
+	if err != nil {
+		p.err = err
+		return false
+	}
+	p.page = res
+	next := ""
+	if res != nil {
+		next = res.Last
+		if p.Reverse {
+			next = res.FirstId()
+		}
+	}
+	if n == 0 || next == "" || (p.started && next == p.cursor) {
+		p.done = true
+	}
+	p.started = true
+	p.cursor = next
+	return true
+}
+
+// Stops paging after the current page, for instance because the
+// reply said the set is complete.
+func (p *RsmPager) Stop() {
+	p.done = true
+}
+
+// Returns the set describing the page Next fetched.
+func (p *RsmPager) Page() *RsmSet {
+	return p.page
+}
+
+// Returns the error which stopped paging, if any.
+func (p *RsmPager) Err() error {
+	return p.err
+}
@@ -0,0 +1,68 @@
+package xmpp
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRsmPager(t *testing.T) {
+	items := []string{"a", "b", "c", "d", "e"}
+	// Serves pages of the items, by their ids.
+	serve := func(req *RsmSet) (*RsmSet, int, error) {
+		max := len(items)
+		if req != nil && req.Max != nil {
+			max = *req.Max
+		}
+		lo, hi := 0, len(items)
+		for i, it := range items {
+			if req != nil && req.After == it {
+				lo = i + 1
+			}
+			if req != nil && req.Before != nil && *req.Before == it {
+				hi = i
+			}
+		}
+		if req != nil && req.Before != nil {
+			if hi-lo > max {
+				lo = hi - max
+			}
+		} else if hi-lo > max {
+			hi = lo + max
+		}
+		if lo >= hi {
+			return &RsmSet{}, 0, nil
+		}
+		return &RsmSet{First: &RsmFirst{Id: items[lo]},
+			Last: items[hi-1]}, hi - lo, nil
+	}
+	pages := func(p *RsmPager) string {
+		var s string
+		for p.Next() {
+			s += fmt.Sprintf("%s-%s ", p.Page().FirstId(),
+				p.Page().Last)
+		}
+		if p.Err() != nil {
+			t.Errorf("Err: %v", p.Err())
+		}
+		return s
+	}
+
+	assertEquals(t, "a-b c-d e-e - ", pages(NewRsmPager(2, serve)))
+	p := NewRsmPager(2, serve)
+	p.Reverse = true
+	assertEquals(t, "d-e b-c a-a - ", pages(p))
+	assertEquals(t, "a-e - ", pages(NewRsmPager(0, serve)))
+
+	// A server which ignores the request doesn't loop forever.
+	ignore := func(req *RsmSet) (*RsmSet, int, error) {
+		return &RsmSet{Last: "x"}, 1, nil
+	}
+	assertEquals(t, "-x -x ", pages(NewRsmPager(2, ignore)))
+
+	p = NewRsmPager(2, func(req *RsmSet) (*RsmSet, int, error) {
+		return nil, 0, fmt.Errorf("boom")
+	})
+	if p.Next() || p.Err() == nil {
+		t.Error("error not reported")
+	}
+}
@@ -5,22 +5,37 @@ package xmpp
 import (
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/xml"
 	"fmt"
+	"hash"
 	"math/big"
 	"regexp"
 	"strings"
 )
 
 // Server is advertising auth mechanisms it supports. Choose one and
-// respond.
-// BUG(cjyar): Doesn't implement TLS/SASL EXTERNAL.
+// respond. EXTERNAL is preferred if there's a client certificate in
+// the TLS config, and then the token mechanisms if there's a token
+// provider, since then no password is needed.
 func (cl *Client) chooseSasl(fe *Features) {
 	var digestMd5, plain bool
 	var mechs []string
-	for _, m := range fe.Mechanisms.Mechanism {
+	offered := make(map[string]bool)
+	cl.sasl2 = cl.useSasl2(fe)
+	cl.inlining, cl.inlined = nil, nil
+	available := fe.Mechanisms.Mechanism
+	if cl.sasl2 {
+		available = fe.Sasl2.Mechanisms
+	}
+	available, ok := cl.saslMechanisms(available)
+	if !ok {
+		return
+	}
+	for _, m := range available {
 		mechs = append(mechs, m)
+		offered[strings.ToUpper(m)] = true
 		switch strings.ToLower(m) {
 		case "digest-md5":
 			digestMd5 = true
@@ -29,22 +44,109 @@ func (cl *Client) chooseSasl(fe *Features) {
 		}
 	}
 
+	if offered["EXTERNAL"] && cl.hasClientCert() {
+		// An empty response: the server derives our identity
+		// from the certificate. XEP-0178, section 3.
+		cl.saslAuth("EXTERNAL", "=")
+		return
+	}
+	cl.saslMech = ""
+	if cl.startOAuth(offered) {
+		return
+	}
+	cl.scram = nil
+	cbType, cbData := cl.channelBinding(fe)
+	offeredPlus := false
+	for _, sm := range scramMechanisms {
+		offeredPlus = offeredPlus || (sm.plus && offered[sm.name])
+	}
+	for _, sm := range scramMechanisms {
+		if !offered[sm.name] || (sm.plus && cbType == "") {
+			continue
+		}
+		sc := cl.newScram(sm.name, sm.hash)
+		if sc == nil {
+			return
+		}
+		switch {
+		case sm.plus:
+			sc.bind(cbType, cbData)
+		case cbType != "" && !offeredPlus:
+			sc.couldBind()
+		}
+		cl.startScram(sc)
+		return
+	}
 	if digestMd5 {
-		auth := &auth{XMLName: xml.Name{Space: NsSASL, Local: "auth"},
-			Mechanism: "DIGEST-MD5"}
-		cl.sendRaw <- auth
+		cl.saslAuth("DIGEST-MD5", "")
 	} else if plain {
 		raw := "\x00" + cl.Jid.Node() + "\x00" + cl.password
-		enc := base64.StdEncoding.EncodeToString([]byte(raw))
-		auth := &auth{XMLName: xml.Name{Space: NsSASL, Local: "auth"},
-			Mechanism: "PLAIN", Chardata: enc}
-		cl.sendRaw <- auth
+		cl.saslAuth("PLAIN", base64.StdEncoding.EncodeToString([]byte(raw)))
 	} else {
 		cl.setError(fmt.Errorf("No supported auth mechanism in %v",
 			mechs))
 	}
 }
 
+// Channel binding types, most preferred first.
+var channelBindings = []string{"tls-exporter", "tls-unique"}
+
+// Returns the type of channel binding to use with SCRAM, and its data
+// for the stream's TLS connection. The type is empty if there's none
+// the server and the connection allow. Servers which don't say which
+// they support, as in XEP-0440, are assumed to support the one
+// which suits the TLS version.
+func (cl *Client) channelBinding(fe *Features) (string, []byte) {
+	if cl.layer1 == nil {
+		return "", nil
+	}
+	cs, ok := cl.layer1.tlsState()
+	if !ok {
+		return "", nil
+	}
+	supported := make(map[string]bool)
+	if fe.ChannelBindings != nil {
+		for _, cb := range fe.ChannelBindings.Types {
+			supported[cb.Type] = true
+		}
+	} else if cs.Version >= tls.VersionTLS13 {
+		supported["tls-exporter"] = true
+	} else {
+		supported["tls-unique"] = true
+	}
+	for _, cbType := range channelBindings {
+		if !supported[cbType] {
+			continue
+		}
+		switch cbType {
+		case "tls-exporter":
+			// Refused on TLS 1.2 connections without the
+			// extended master secret, as RFC 9266 requires.
+			data, err := cs.ExportKeyingMaterial(
+				"EXPORTER-Channel-Binding", nil, 32)
+			if err == nil {
+				return cbType, data
+			}
+		case "tls-unique":
+			// Not defined for TLS 1.3.
+			if len(cs.TLSUnique) > 0 {
+				return cbType, cs.TLSUnique
+			}
+		}
+	}
+	return "", nil
+}
+
+// Is the stream encrypted with TLS, in which we could have presented
+// a client certificate?
+func (cl *Client) hasClientCert() bool {
+	if cl.tlsConfig == nil || (len(cl.tlsConfig.Certificates) == 0 &&
+		cl.tlsConfig.GetClientCertificate == nil) {
+		return false
+	}
+	return cl.layer1.encrypted()
+}
+
 // Server is responding to our auth request.
 func (cl *Client) handleSasl(srv *auth) {
 	switch strings.ToLower(srv.XMLName.Local) {
@@ -55,6 +157,14 @@ func (cl *Client) handleSasl(srv *auth) {
 			cl.setError(fmt.Errorf("SASL: %v", err))
 			return
 		}
+		if cl.saslMech == "OAUTHBEARER" {
+			cl.oauthChallenge()
+			return
+		}
+		if cl.scram != nil {
+			cl.scramChallenge(string(str))
+			return
+		}
 		srvMap := parseSasl(string(str))
 
 		if cl.saslExpected == "" {
@@ -64,12 +174,66 @@ func (cl *Client) handleSasl(srv *auth) {
 		}
 	case "failure":
 		cl.setError(fmt.Errorf("SASL authentication failed"))
+	case "continue":
+		cl.setError(fmt.Errorf("SASL: server asks for tasks, " +
+			"which aren't supported"))
 	case "success":
+		if cl.scram != nil && !cl.scram.verified {
+			// The server-final-message may come with the
+			// success.
+			str, err := base64.StdEncoding.DecodeString(srv.Chardata)
+			if err == nil {
+				err = cl.scram.verify(string(str))
+			}
+			if err != nil {
+				cl.setError(fmt.Errorf("SASL: %v", err))
+				return
+			}
+		}
 		cl.setStatus(StatusAuthenticated)
 		cl.Features = nil
-		ss := &stream{To: cl.Jid.Domain(), Version: XMPPVersion}
-		cl.sendRaw <- ss
+		cl.sendRaw <- cl.streamHeader()
+	}
+}
+
+// Returns the state of a SCRAM exchange for a mechanism, or nil if
+// there's been an error.
+func (cl *Client) newScram(mech string, h func() hash.Hash) *scramClient {
+	user := cl.Jid.Node()
+	if user == "" {
+		user = cl.Jid.Domain()
+	}
+	sc, err := newScramClient(mech, h, user, cl.password)
+	if err != nil {
+		cl.setError(fmt.Errorf("SASL: %v", err))
+		return nil
 	}
+	return sc
+}
+
+func (cl *Client) startScram(sc *scramClient) {
+	cl.scram = sc
+	cl.saslAuth(sc.mech, base64.StdEncoding.EncodeToString(
+		[]byte(sc.clientFirst())))
+}
+
+// Answers the server-first-message, or checks the
+// server-final-message if the server sends that as a challenge.
+func (cl *Client) scramChallenge(msg string) {
+	b64 := base64.StdEncoding
+	resp := cl.saslElement("response", "")
+	if cl.scram.serverSig == nil {
+		final, err := cl.scram.clientFinal(msg)
+		if err != nil {
+			cl.setError(fmt.Errorf("SASL: %v", err))
+			return
+		}
+		resp.Chardata = b64.EncodeToString([]byte(final))
+	} else if err := cl.scram.verify(msg); err != nil {
+		cl.setError(fmt.Errorf("SASL: %v", err))
+		return
+	}
+	cl.sendRaw <- resp
 }
 
 func (cl *Client) saslDigest1(srvMap map[string]string) {
@@ -141,15 +305,15 @@ func (cl *Client) saslDigest1(srvMap map[string]string) {
 	// Encode the map and send it.
 	clStr := packSasl(clMap)
 	b64 := base64.StdEncoding
-	clObj := &auth{XMLName: xml.Name{Space: NsSASL, Local: "response"},
-		Chardata: b64.EncodeToString([]byte(clStr))}
-	cl.sendRaw <- clObj
+	cl.sendRaw <- cl.saslElement("response",
+		b64.EncodeToString([]byte(clStr)))
 }
 
 func (cl *Client) saslDigest2(srvMap map[string]string) {
 	if cl.saslExpected == srvMap["rspauth"] {
-		clObj := &auth{XMLName: xml.Name{Space: NsSASL, Local: "response"}}
-		cl.sendRaw <- clObj
+		cl.sendRaw <- cl.saslElement("response", "")
+	} else if cl.sasl2 {
+		cl.sendRaw <- cl.saslElement("abort", "")
 	} else {
 		clObj := &auth{XMLName: xml.Name{Space: NsSASL, Local: "failure"}, Any: &Generic{XMLName: xml.Name{Space: NsSASL,
 			Local: "abort"}}}
@@ -0,0 +1,210 @@
+package xmpp
+
+// This file contains Extensible SASL Profile, XEP-0388, and Resource
+// Binding 2.0, XEP-0386, with which the client authenticates, binds
+// a resource, and enables carbons and stream management, or resumes
+// the stream, in one exchange with the server instead of several.
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+)
+
+const (
+	NsSasl2 = "urn:xmpp:sasl:2"
+	NsBind2 = "urn:xmpp:bind:0"
+)
+
+// Identifies this installation of the client to servers which
+// support SASL2.
+type UserAgent struct {
+	// A UUID which stays the same for as long as the client is
+	// installed, so the server can tell its sessions apart from
+	// other devices'.
+	Id string `xml:"id,attr,omitempty"`
+	// The name of the client software, such as "Conversations".
+	Software string `xml:"software,omitempty"`
+	// The name of the device, such as "Kiva's Phone".
+	Device string `xml:"device,omitempty"`
+}
+
+// Returns an extension which has the client use SASL2 and Bind 2 if
+// the server offers them, so that carbons, with CarbonsExt, and
+// stream management, with StreamManagementExt, are enabled along
+// with authentication, and a stream is resumed along with it.
+// Otherwise the client authenticates and binds as usual.
+//
+// With Bind 2 the server chooses the resource. It starts with the
+// resource of the JID passed to NewClient, if there is one, or else
+// with the software name from the user agent.
+func Sasl2Ext(ua UserAgent) Extension {
+	return Extension{option: func(o *options) {
+		o.sasl2 = &ua
+	}}
+}
+
+// The SASL2 stream feature.
+type sasl2Feature struct {
+	Mechanisms []string `xml:"mechanism"`
+	Inline     struct {
+		Bind *bind2Feature `xml:"urn:xmpp:bind:0 bind"`
+		Sm   *Generic      `xml:"urn:xmpp:sm:3 sm"`
+	} `xml:"inline"`
+}
+
+// What Bind 2 can enable along with binding.
+type bind2Feature struct {
+	Features []struct {
+		Var string `xml:"var,attr"`
+	} `xml:"inline>feature"`
+}
+
+type sasl2Authenticate struct {
+	XMLName         xml.Name   `xml:"urn:xmpp:sasl:2 authenticate"`
+	Mechanism       string     `xml:"mechanism,attr"`
+	InitialResponse *string    `xml:"initial-response"`
+	UserAgent       *UserAgent `xml:"user-agent"`
+	Resume          *smResume
+	Bind            *bind2Request
+}
+
+type bind2Request struct {
+	XMLName xml.Name `xml:"urn:xmpp:bind:0 bind"`
+	Tag     string   `xml:"tag,omitempty"`
+	// Requests to enable features, such as *smEnable and
+	// *CarbonsEnable.
+	Enable []interface{}
+}
+
+type sasl2Success struct {
+	XMLName        xml.Name `xml:"urn:xmpp:sasl:2 success"`
+	AdditionalData string   `xml:"additional-data"`
+	AuthzId        JID      `xml:"authorization-identifier"`
+	Bound          *bind2Bound
+	Resumed        *smResumed
+	Failed         *smFailed
+}
+
+type bind2Bound struct {
+	XMLName xml.Name `xml:"urn:xmpp:bind:0 bound"`
+	Enabled *smEnabled
+	Failed  *smFailed
+}
+
+// Should the client authenticate with SASL2? Only if it can bind, or
+// resume, the same way, since the stream doesn't restart after
+// authentication to offer the old ways.
+func (cl *Client) useSasl2(fe *Features) bool {
+	if cl.opts.sasl2 == nil || fe.Sasl2 == nil ||
+		fe.Sasl2.Inline.Bind == nil {
+		return false
+	}
+	return cl.sm == nil || !cl.sm.resuming() || fe.Sasl2.Inline.Sm != nil
+}
+
+// Starts authenticating with a mechanism and an initial response,
+// which is already encoded. Empty means none.
+func (cl *Client) saslAuth(mech, initial string) {
+	if !cl.sasl2 {
+		cl.sendRaw <- &auth{XMLName: xml.Name{Space: NsSASL,
+			Local: "auth"}, Mechanism: mech, Chardata: initial}
+		return
+	}
+	a := &sasl2Authenticate{Mechanism: mech, UserAgent: cl.opts.sasl2}
+	if initial != "" {
+		a.InitialResponse = &initial
+	}
+	if cl.sm != nil && cl.sm.resuming() {
+		a.Resume = cl.sm.resumeRequest()
+	} else {
+		a.Bind = cl.bind2Request()
+	}
+	cl.sendRaw <- a
+}
+
+// Returns an element of the SASL exchange, such as a response, in
+// the namespace of the protocol in use.
+func (cl *Client) saslElement(local, data string) *auth {
+	ns := NsSASL
+	if cl.sasl2 {
+		ns = NsSasl2
+	}
+	return &auth{XMLName: xml.Name{Space: ns, Local: local}, Chardata: data}
+}
+
+// Asks to bind a resource, and to enable what the server can enable
+// along with it and the client wants.
+func (cl *Client) bind2Request() *bind2Request {
+	offered := make(map[string]bool)
+	for _, f := range cl.Features.Sasl2.Inline.Bind.Features {
+		offered[f.Var] = true
+	}
+	tag := cl.Jid.Resource()
+	if tag == "" {
+		tag = cl.opts.sasl2.Software
+	}
+	req := &bind2Request{Tag: tag}
+	cl.inlining = make(map[string]bool)
+	if cl.sm != nil && offered[NsSM] {
+		cl.sm.lock.Lock()
+		cl.sm.counting = true
+		cl.sm.lock.Unlock()
+		req.Enable = append(req.Enable, &smEnable{Resume: cl.redial != nil})
+		cl.inlining[NsSM] = true
+	}
+	if cl.opts.carbons && offered[NsCarbons] {
+		req.Enable = append(req.Enable, &CarbonsEnable{})
+		cl.inlining[NsCarbons] = true
+	}
+	if offered[NsCsi] {
+		cl.inlining[NsCsi] = true
+	}
+	return req
+}
+
+// The server has authenticated the client, and bound a resource or
+// resumed the stream, with SASL2.
+func (cl *Client) handleSasl2Success(s *sasl2Success) {
+	if cl.scram != nil && !cl.scram.verified {
+		str, err := base64.StdEncoding.DecodeString(s.AdditionalData)
+		if err == nil {
+			err = cl.scram.verify(string(str))
+		}
+		if err != nil {
+			cl.setError(fmt.Errorf("SASL: %v", err))
+			return
+		}
+	}
+	cl.setStatus(StatusAuthenticated)
+	switch {
+	case s.Resumed != nil:
+		cl.handleStreamMgmt(s.Resumed)
+	case s.Failed != nil:
+		cl.handleStreamMgmt(s.Failed)
+	case s.Bound != nil:
+		if s.AuthzId.Resource() == "" {
+			cl.setError(fmt.Errorf("no resource bound: %#v", s))
+			return
+		}
+		cl.Jid = s.AuthzId
+		inlined := cl.inlining
+		if inlined[NsSM] {
+			if s.Bound.Enabled != nil {
+				cl.handleStreamMgmt(s.Bound.Enabled)
+			} else {
+				delete(inlined, NsSM)
+				cl.handleStreamMgmt(&smFailed{})
+			}
+		}
+		if inlined[NsCsi] && cl.Features.Csi == nil {
+			// There won't be features after authentication
+			// to offer it.
+			cl.Features.Csi = &Generic{}
+		}
+		cl.inlined = inlined
+		cl.setStatus(StatusBound)
+	default:
+		cl.setError(fmt.Errorf("no resource bound: %#v", s))
+	}
+}
@@ -0,0 +1,80 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func TestSasl2(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.Sasl2 = true
+	s.AddUser("alice", "secret")
+	jid := JID("alice@b.c")
+	ua := Sasl2Ext(UserAgent{Id: "d4565fa7-4d72-4749-b3d3-740edbf87770",
+		Software: "test"})
+	cl, err := NewClientFromConn(s.Dial(), &jid, "secret", &tls.Config{},
+		[]Extension{ua}, Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn: %v", err)
+	}
+	defer cl.Close()
+	// The server chose the resource.
+	if !strings.HasPrefix(cl.Jid.Resource(), "test.") {
+		t.Errorf("bound %s", cl.Jid)
+	}
+	cl.Send <- &Message{Header: Header{To: "b.c"},
+		Body: []Text{{Chardata: "hi"}}}
+	assertEquals(t, "hi", firstText(recvMessage(t, cl).Body))
+
+	// Servers without SASL2 are dealt with as usual.
+	s.Sasl2 = false
+	jid = "alice@b.c/pc"
+	cl2, err := NewClientFromConn(s.Dial(), &jid, "secret", &tls.Config{},
+		[]Extension{ua}, Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn: %v", err)
+	}
+	defer cl2.Close()
+	assertEquals(t, "alice@b.c/pc", string(cl2.Jid))
+}
+
+func TestBind2Inline(t *testing.T) {
+	sendRaw := make(chan interface{}, 1)
+	cl := newBareClient(new(JID), "", nil)
+	cl.Jid = "a@b.c/pc"
+	cl.sendRaw = sendRaw
+	cl.sm = &streamMgmt{}
+	cl.opts = newOptions([]Extension{Sasl2Ext(UserAgent{Id: "u1"}),
+		CarbonsExt, StreamManagementExt})
+	fe := &Features{Sasl2: &sasl2Feature{Mechanisms: []string{"PLAIN"}}}
+	fe.Sasl2.Inline.Bind = &bind2Feature{}
+	for _, ns := range []string{NsCarbons, NsSM, NsCsi} {
+		fe.Sasl2.Inline.Bind.Features = append(
+			fe.Sasl2.Inline.Bind.Features,
+			struct {
+				Var string `xml:"var,attr"`
+			}{ns})
+	}
+	cl.Features = fe
+	cl.chooseSasl(fe)
+	assertMarshal(t, `<authenticate xmlns="`+NsSasl2+`" mechanism="PLAIN">`+
+		`<initial-response>AGEA</initial-response>`+
+		`<user-agent id="u1"></user-agent>`+
+		`<bind xmlns="`+NsBind2+`"><tag>pc</tag>`+
+		`<enable xmlns="`+NsSM+`"></enable>`+
+		`<enable xmlns="`+NsCarbons+`"></enable></bind></authenticate>`,
+		<-sendRaw)
+
+	cl.handleSasl2Success(&sasl2Success{AuthzId: "a@b.c/pc.1",
+		Bound: &bind2Bound{Enabled: &smEnabled{Id: "s1"}}})
+	assertEquals(t, "a@b.c/pc.1", string(cl.Jid))
+	if !cl.inlined[NsCarbons] || !cl.inlined[NsSM] || !cl.sm.enabled ||
+		cl.Features.Csi == nil {
+		t.Errorf("inlined %v, sm %+v", cl.inlined, cl.sm)
+	}
+	if err := <-cl.startSession(); err != nil {
+		t.Errorf("startSession: %v", err)
+	}
+}
@@ -1,6 +1,13 @@
 package xmpp
 
 import (
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net"
 	"testing"
 )
 
@@ -13,3 +20,172 @@ func TestSaslDigest(t *testing.T) {
 	exp := "d388dad90d4bbd760a152321f2143af7"
 	assertEquals(t, exp, obs)
 }
+
+func TestScram(t *testing.T) {
+	// These values are from RFC 5802, section 5, and RFC 7677,
+	// section 3.
+	cases := []struct {
+		mech, cnonce, serverFirst, final, serverFinal string
+	}{
+		{"SCRAM-SHA-1", "fyko+d2lbbFgONRv9qkxdawL",
+			"r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j," +
+				"s=QSXCR+Q6sek8bf92,i=4096",
+			"c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j," +
+				"p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+			"v=rmF9pqV8S7suAoZWja4dJRkFsKQ="},
+		{"SCRAM-SHA-256", "rOprNGfwEbeRWgbNEkqO",
+			"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+				"s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+				"p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			"v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="},
+	}
+	for _, c := range cases {
+		var sc *scramClient
+		for _, m := range scramMechanisms {
+			if m.name == c.mech {
+				sc = &scramClient{mech: m.name, hash: m.hash,
+					user: "user", password: "pencil",
+					cnonce: c.cnonce}
+			}
+		}
+		assertEquals(t, "n,,n=user,r="+c.cnonce, sc.clientFirst())
+		final, err := sc.clientFinal(c.serverFirst)
+		if err != nil {
+			t.Fatalf("%s: %v", c.mech, err)
+		}
+		assertEquals(t, c.final, final)
+		if err := sc.verify("v=AAAA"); err == nil {
+			t.Errorf("%s: bad signature accepted", c.mech)
+		}
+		if err := sc.verify(c.serverFinal); err != nil {
+			t.Errorf("%s: %v", c.mech, err)
+		}
+	}
+}
+
+func TestScramBadNonce(t *testing.T) {
+	sc, _ := newScramClient("SCRAM-SHA-1", sha1.New, "user", "pencil")
+	sc.clientFirst()
+	_, err := sc.clientFinal("r=someoneelse,s=QSXCR+Q6sek8bf92,i=4096")
+	if err == nil {
+		t.Error("nonce not checked")
+	}
+}
+
+func TestScramIterations(t *testing.T) {
+	for _, i := range []string{"0", "x", "1048577", "99999999999"} {
+		sc, _ := newScramClient("SCRAM-SHA-1", sha1.New, "user", "pencil")
+		sc.clientFirst()
+		_, err := sc.clientFinal("r=" + sc.cnonce +
+			"x,s=QSXCR+Q6sek8bf92,i=" + i)
+		if err == nil {
+			t.Errorf("iteration count %s accepted", i)
+		}
+	}
+}
+
+func TestScramChannelBinding(t *testing.T) {
+	sc := &scramClient{mech: "SCRAM-SHA-1-PLUS", hash: sha1.New,
+		user: "user", password: "pencil", cnonce: "abc"}
+	sc.bind("tls-exporter", []byte{1, 2})
+	assertEquals(t, "p=tls-exporter,,n=user,r=abc", sc.clientFirst())
+	final, err := sc.clientFinal("r=abcdef,s=QSXCR+Q6sek8bf92,i=4096")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := base64.StdEncoding.EncodeToString([]byte("p=tls-exporter,,\x01\x02"))
+	assertEquals(t, "c="+want, final[:len(want)+2])
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	cert, pool := mockCert(t, "example.com")
+	go tls.Server(c2, &tls.Config{Certificates: []tls.Certificate{cert}}).
+		Handshake()
+	tc := tls.Client(c1, &tls.Config{RootCAs: pool,
+		ServerName: "example.com"})
+	if err := tc.Handshake(); err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	sendRaw := make(chan interface{}, 1)
+	cl := &Client{Jid: "user@example.com/res", password: "secret",
+		sendRaw: sendRaw, layer1: &layer1{sock: tc}}
+	first := func(offered ...string) (string, string) {
+		cl.chooseSasl(&Features{Mechanisms: mechs{Mechanism: offered}})
+		a := (<-sendRaw).(*auth)
+		b, _ := base64.StdEncoding.DecodeString(a.Chardata)
+		return a.Mechanism, string(b[:3])
+	}
+	mech, gs2 := first("SCRAM-SHA-1", "SCRAM-SHA-1-PLUS")
+	assertEquals(t, "SCRAM-SHA-1-PLUS p=t", mech+" "+gs2)
+	// Without -PLUS, the server is told the client could bind.
+	mech, gs2 = first("SCRAM-SHA-1")
+	assertEquals(t, "SCRAM-SHA-1 y,,", mech+" "+gs2)
+	// The server may support only another kind.
+	cl.chooseSasl(&Features{Mechanisms: mechs{Mechanism: []string{
+		"SCRAM-SHA-1-PLUS", "SCRAM-SHA-1"}},
+		ChannelBindings: &channelBindingTypes{Types: []struct {
+			Type string `xml:"type,attr"`
+		}{{"tls-server-end-point"}}}})
+	assertEquals(t, "SCRAM-SHA-1", (<-sendRaw).(*auth).Mechanism)
+}
+
+func TestSaslExternal(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conf := &tls.Config{Certificates: []tls.Certificate{{}}}
+	fe := &Features{Mechanisms: mechs{Mechanism: []string{"PLAIN",
+		"EXTERNAL"}}}
+	sendRaw := make(chan interface{}, 1)
+	cl := &Client{Jid: "user@example.com/res", password: "secret",
+		sendRaw: sendRaw, tlsConfig: conf,
+		layer1: &layer1{sock: tls.Client(c1, conf)}}
+	cl.chooseSasl(fe)
+	a := (<-sendRaw).(*auth)
+	assertEquals(t, "EXTERNAL", a.Mechanism)
+	assertEquals(t, "=", a.Chardata)
+
+	// Without a certificate, a password is used.
+	cl.tlsConfig = &tls.Config{}
+	cl.chooseSasl(fe)
+	a = (<-sendRaw).(*auth)
+	assertEquals(t, "PLAIN", a.Mechanism)
+}
+
+func TestSaslOAuth(t *testing.T) {
+	calls := 0
+	tokens := func(ctx context.Context) (string, error) {
+		calls++
+		return fmt.Sprintf("tok%d", calls), nil
+	}
+	sendRaw := make(chan interface{}, 1)
+	cl := &Client{Jid: "user@example.com/res", sendRaw: sendRaw}
+	cl.opts = newOptions([]Extension{OAuthExt(tokens)})
+	decode := func() (string, string) {
+		a := (<-sendRaw).(*auth)
+		b, _ := base64.StdEncoding.DecodeString(a.Chardata)
+		return a.Mechanism, string(b)
+	}
+
+	cl.chooseSasl(&Features{Mechanisms: mechs{Mechanism: []string{
+		"PLAIN", "X-OAUTH2", "OAUTHBEARER"}}})
+	mech, data := decode()
+	assertEquals(t, "OAUTHBEARER", mech)
+	assertEquals(t, "n,a=user@example.com,\x01auth=Bearer tok1\x01\x01",
+		data)
+	// A challenge reports an error, which must be acknowledged.
+	cl.handleSasl(&auth{XMLName: xml.Name{Local: "challenge"},
+		Chardata: base64.StdEncoding.EncodeToString([]byte(
+			`{"status":"invalid_token"}`))})
+	_, data = decode()
+	assertEquals(t, "\x01", data)
+
+	// Each authentication gets a fresh token.
+	cl.chooseSasl(&Features{Mechanisms: mechs{Mechanism: []string{
+		"PLAIN", "X-OAUTH2"}}})
+	mech, data = decode()
+	assertEquals(t, "X-OAUTH2", mech)
+	assertEquals(t, "\x00user@example.com\x00tok2", data)
+}
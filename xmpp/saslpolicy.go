@@ -0,0 +1,130 @@
+package xmpp
+
+// This file contains the policy which limits the SASL mechanisms a
+// client may authenticate with, and the warning when a server offers
+// weaker ones than it has before.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Limits the SASL mechanisms the client may use. Of those allowed,
+// the strongest the server offers is used, as usual.
+type SaslPolicy struct {
+	// The mechanisms which may be used, such as "SCRAM-SHA-256" and
+	// "SCRAM-SHA-256-PLUS". Empty means any the client supports.
+	Allow []string
+	// Whether the mechanisms which send the password or token
+	// itself, PLAIN, X-OAUTH2 and OAUTHBEARER, are refused on
+	// connections without TLS.
+	CleartextNeedsTls bool
+}
+
+// Returns an extension which makes the client authenticate only as
+// the policy allows. If the server offers nothing it allows, the
+// session ends with a *SaslMechanismError.
+func SaslPolicyExt(policy SaslPolicy) Extension {
+	return Extension{option: func(o *options) {
+		o.saslPolicy = &policy
+	}}
+}
+
+// The session ends with this when the server offers no SASL mechanism
+// the SaslPolicy allows.
+type SaslMechanismError struct {
+	// What the server offered.
+	Offered []string
+}
+
+func (e *SaslMechanismError) Error() string {
+	return fmt.Sprintf("SASL: server offers no allowed mechanism in %v",
+		e.Offered)
+}
+
+// The mechanisms which send the secret as it is.
+var cleartextMechanisms = map[string]bool{
+	"PLAIN": true, "X-OAUTH2": true, "OAUTHBEARER": true,
+}
+
+// How strong each mechanism which authenticates with a password is,
+// for noticing downgrades. Those with other credentials, such as
+// EXTERNAL, aren't compared.
+var saslStrength = map[string]int{
+	"PLAIN":              1,
+	"DIGEST-MD5":         2,
+	"SCRAM-SHA-1":        3,
+	"SCRAM-SHA-256":      4,
+	"SCRAM-SHA-1-PLUS":   5,
+	"SCRAM-SHA-256-PLUS": 6,
+}
+
+// Returns what the policy allows of the mechanisms offered.
+func (p *SaslPolicy) allowed(offered []string, encrypted bool) []string {
+	var allowed []string
+	for _, m := range offered {
+		name := strings.ToUpper(m)
+		if p.CleartextNeedsTls && !encrypted && cleartextMechanisms[name] {
+			continue
+		}
+		ok := len(p.Allow) == 0
+		for _, a := range p.Allow {
+			ok = ok || strings.ToUpper(a) == name
+		}
+		if ok {
+			allowed = append(allowed, m)
+		}
+	}
+	return allowed
+}
+
+// Applies the policy, if any, to the mechanisms offered, and warns if
+// the strongest of them is weaker than the strongest the server has
+// offered before. Ends the session and returns false if none is
+// allowed.
+func (cl *Client) saslMechanisms(offered []string) ([]string, bool) {
+	cl.noticeDowngrade(offered)
+	p := cl.opts.saslPolicy
+	if p == nil {
+		return offered, true
+	}
+	allowed := p.allowed(offered, cl.layer1 != nil && cl.layer1.encrypted())
+	if len(allowed) == 0 {
+		cl.setError(&SaslMechanismError{Offered: offered})
+		return nil, false
+	}
+	return allowed, true
+}
+
+// Remembers the strongest mechanism each server offers, within the
+// client and in its Storage, if any, keyed by domain, and logs a
+// warning when a server offers only weaker ones.
+func (cl *Client) noticeDowngrade(offered []string) {
+	best := ""
+	for _, m := range offered {
+		if name := strings.ToUpper(m); saslStrength[name] >
+			saslStrength[best] {
+			best = name
+		}
+	}
+	if best == "" {
+		return
+	}
+	domain := cl.Jid.Domain()
+	prev := cl.saslBest
+	if s := cl.opts.storage; s != nil {
+		if buf, ok, err := s.Get(StorageSasl, domain); err == nil && ok &&
+			saslStrength[string(buf)] > saslStrength[prev] {
+			prev = string(buf)
+		}
+	}
+	if saslStrength[best] < saslStrength[prev] {
+		cl.logf(LogWarn, "SASL: %s offers at best %s, but has "+
+			"offered %s before", domain, best, prev)
+		return
+	}
+	cl.saslBest = best
+	if s := cl.opts.storage; s != nil && best != prev {
+		s.Set(StorageSasl, domain, []byte(best))
+	}
+}
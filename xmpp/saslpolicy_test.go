@@ -0,0 +1,67 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"errors"
+	"testing"
+)
+
+func TestSaslPolicy(t *testing.T) {
+	sendRaw := make(chan interface{}, 1)
+	cl := &Client{Jid: "user@example.com/res", password: "secret",
+		sendRaw: sendRaw}
+	cl.opts = newOptions([]Extension{SaslPolicyExt(SaslPolicy{
+		Allow: []string{"scram-sha-1", "PLAIN"}})})
+	fe := &Features{Mechanisms: mechs{Mechanism: []string{"PLAIN",
+		"SCRAM-SHA-256", "SCRAM-SHA-1"}}}
+	cl.chooseSasl(fe)
+	a := (<-sendRaw).(*auth)
+	assertEquals(t, "SCRAM-SHA-1", a.Mechanism)
+
+	// Without TLS, PLAIN is refused, and so the session ends.
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	jid := JID("alice@b.c/pc")
+	_, err := NewClientFromConn(s.Dial(), &jid, "secret", &tls.Config{},
+		[]Extension{SaslPolicyExt(SaslPolicy{CleartextNeedsTls: true})},
+		Presence{}, nil)
+	var me *SaslMechanismError
+	if !errors.As(err, &me) || len(me.Offered) != 1 ||
+		me.Offered[0] != "PLAIN" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestSaslDowngrade(t *testing.T) {
+	storage := NewMemoryStorage()
+	logger := &testLogger{}
+	sendRaw := make(chan interface{}, 1)
+	cl := &Client{Jid: "user@example.com/res", password: "secret",
+		sendRaw: sendRaw}
+	cl.opts = newOptions([]Extension{StorageExt(storage),
+		LoggerExt(logger)})
+	cl.chooseSasl(&Features{Mechanisms: mechs{Mechanism: []string{
+		"PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-1"}}})
+	<-sendRaw
+	best, _, _ := storage.Get(StorageSasl, "example.com")
+	assertEquals(t, "SCRAM-SHA-256", string(best))
+
+	// Another client of the same server, which now offers only
+	// PLAIN, still authenticates, but warns.
+	cl = &Client{Jid: "other@example.com/res", password: "secret",
+		sendRaw: sendRaw}
+	cl.opts = newOptions([]Extension{StorageExt(storage),
+		LoggerExt(logger)})
+	cl.chooseSasl(&Features{Mechanisms: mechs{Mechanism: []string{
+		"PLAIN"}}})
+	a := (<-sendRaw).(*auth)
+	assertEquals(t, "PLAIN", a.Mechanism)
+	if len(logger.msgs) != 1 {
+		t.Fatalf("logged %v", logger.msgs)
+	}
+	assertEquals(t, "warn: SASL: example.com offers at best PLAIN, "+
+		"but has offered SCRAM-SHA-256 before", logger.msgs[0])
+	best, _, _ = storage.Get(StorageSasl, "example.com")
+	assertEquals(t, "SCRAM-SHA-256", string(best))
+}
@@ -0,0 +1,50 @@
+package xmpp
+
+// This file contains the pieces the end-to-end encryption schemes
+// share: stanza content encryption, XEP-0420, explicit message
+// encryption, XEP-0380, and the store hint, XEP-0334, which encrypted
+// messages carry.
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"math/big"
+)
+
+const (
+	NsEme   = "urn:xmpp:eme:0"
+	NsHints = "urn:xmpp:hints"
+	NsSce   = "urn:xmpp:sce:1"
+)
+
+// Says how a message is encrypted, XEP-0380, for clients which can't
+// decrypt it.
+type Eme struct {
+	XMLName   xml.Name `xml:"urn:xmpp:eme:0 encryption"`
+	Namespace string   `xml:"namespace,attr"`
+	Name      string   `xml:"name,attr,omitempty"`
+}
+
+// Asks the server to store a message, XEP-0334, even though it has
+// no body it understands.
+type StoreHint struct {
+	XMLName xml.Name `xml:"urn:xmpp:hints store"`
+}
+
+// A JID named in an encrypted envelope, as its sender or recipient.
+type SceJid struct {
+	Jid JID `xml:"jid,attr"`
+}
+
+// Some random padding for an envelope, which hides the length of
+// what's encrypted.
+func ScePadding() string {
+	n, err := rand.Int(rand.Reader, big.NewInt(200))
+	if err != nil {
+		return ""
+	}
+	buf := make([]byte, n.Int64())
+	rand.Read(buf)
+	return base64.StdEncoding.EncodeToString(buf)
+}
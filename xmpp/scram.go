@@ -0,0 +1,187 @@
+package xmpp
+
+// This file contains the client side of the SCRAM SASL mechanisms,
+// RFC 5802 and RFC 7677, with channel binding to the TLS connection,
+// RFC 5929 and RFC 9266.
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// The SCRAM mechanisms we support, most preferred first. The -PLUS
+// ones bind the exchange to the TLS connection, so that a man in the
+// middle can't relay it even with a certificate the client trusts.
+var scramMechanisms = []struct {
+	name string
+	hash func() hash.Hash
+	plus bool
+}{
+	{"SCRAM-SHA-256-PLUS", sha256.New, true},
+	{"SCRAM-SHA-1-PLUS", sha1.New, true},
+	{"SCRAM-SHA-256", sha256.New, false},
+	{"SCRAM-SHA-1", sha1.New, false},
+}
+
+// The state of one SCRAM exchange.
+type scramClient struct {
+	mech     string
+	hash     func() hash.Hash
+	user     string
+	password string
+	cnonce   string
+	// The gs2-header, if it isn't scramGs2, and the channel binding
+	// data it names.
+	gs2    string
+	cbData []byte
+	// The client-first-message-bare, and later the whole
+	// AuthMessage.
+	first, authMessage string
+	serverSig          []byte
+	verified           bool
+}
+
+func newScramClient(mech string, h func() hash.Hash, user,
+	password string) (*scramClient, error) {
+
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &scramClient{mech: mech, hash: h, user: user,
+		password: password,
+		cnonce:   base64.RawStdEncoding.EncodeToString(b)}, nil
+}
+
+// The gs2-header: no channel binding, and no authorization identity.
+const scramGs2 = "n,,"
+
+// The most PBKDF2 iterations a server may ask for. Far more than any
+// server uses; a hostile one could otherwise have the client hash for
+// as long as it liked.
+const scramMaxIter = 1 << 20
+
+// Binds the exchange to the TLS connection, with the named type of
+// channel binding and its data.
+func (sc *scramClient) bind(cbType string, data []byte) {
+	sc.gs2 = "p=" + cbType + ",,"
+	sc.cbData = data
+}
+
+// Tells the server the client could have used channel binding, but
+// the server doesn't seem to offer it. If the server does, someone
+// removed the -PLUS mechanisms from what it offered, and it will
+// fail the exchange.
+func (sc *scramClient) couldBind() {
+	sc.gs2 = "y,,"
+}
+
+func (sc *scramClient) header() string {
+	if sc.gs2 == "" {
+		return scramGs2
+	}
+	return sc.gs2
+}
+
+// Escapes a name for a GS2 header or a SCRAM username, RFC 5801
+// section 4.
+func gs2Name(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+// Returns the client-first-message.
+func (sc *scramClient) clientFirst() string {
+	sc.first = "n=" + gs2Name(sc.user) + ",r=" + sc.cnonce
+	return sc.header() + sc.first
+}
+
+// Takes the server-first-message and returns the
+// client-final-message.
+func (sc *scramClient) clientFinal(serverFirst string) (string, error) {
+	var nonce, salt64, iterStr string
+	for _, attr := range strings.Split(serverFirst, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			continue
+		}
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt64 = attr[2:]
+		case 'i':
+			iterStr = attr[2:]
+		case 'm':
+			return "", fmt.Errorf("%s: unsupported extension", sc.mech)
+		}
+	}
+	if !strings.HasPrefix(nonce, sc.cnonce) || len(nonce) == len(sc.cnonce) {
+		return "", fmt.Errorf("%s: bad server nonce", sc.mech)
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return "", fmt.Errorf("%s: bad salt: %v", sc.mech, err)
+	}
+	iter, err := strconv.Atoi(iterStr)
+	if err != nil || iter < 1 || iter > scramMaxIter {
+		return "", fmt.Errorf("%s: bad iteration count %q", sc.mech,
+			iterStr)
+	}
+
+	salted, err := pbkdf2.Key(sc.hash, sc.password, salt, iter,
+		sc.hash().Size())
+	if err != nil {
+		return "", err
+	}
+	clientKey := sc.hmac(salted, "Client Key")
+	h := sc.hash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+
+	cbind := append([]byte(sc.header()), sc.cbData...)
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString(cbind) +
+		",r=" + nonce
+	sc.authMessage = sc.first + "," + serverFirst + "," + withoutProof
+	proof := sc.hmac(storedKey, sc.authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	sc.serverSig = sc.hmac(sc.hmac(salted, "Server Key"), sc.authMessage)
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof),
+		nil
+}
+
+// Checks the server-final-message, which proves the server knows
+// the password too.
+func (sc *scramClient) verify(serverFinal string) error {
+	if strings.HasPrefix(serverFinal, "e=") {
+		return fmt.Errorf("%s: %s", sc.mech, serverFinal[2:])
+	}
+	v, ok := strings.CutPrefix(serverFinal, "v=")
+	if !ok || sc.serverSig == nil {
+		return fmt.Errorf("%s: bad server-final-message", sc.mech)
+	}
+	if i := strings.IndexByte(v, ','); i >= 0 {
+		v = v[:i]
+	}
+	sig, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || subtle.ConstantTimeCompare(sig, sc.serverSig) != 1 {
+		return fmt.Errorf("%s: server signature doesn't match", sc.mech)
+	}
+	sc.verified = true
+	return nil
+}
+
+func (sc *scramClient) hmac(key []byte, data string) []byte {
+	mac := hmac.New(sc.hash, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
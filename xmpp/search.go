@@ -0,0 +1,131 @@
+package xmpp
+
+// This file contains searching user directories, XEP-0055.
+
+import (
+	"./forms"
+	"context"
+	"encoding/xml"
+	"errors"
+	"reflect"
+)
+
+const NsSearch = "jabber:iq:search"
+
+// A search query. In a directory's answer to a get, the fields it
+// searches by are present but empty, or it asks for Form to be filled
+// in instead. In its answer to a search, Items or Form holds the
+// results.
+type SearchQuery struct {
+	XMLName      xml.Name     `xml:"jabber:iq:search query"`
+	Instructions string       `xml:"instructions,omitempty"`
+	First        *string      `xml:"first"`
+	Last         *string      `xml:"last"`
+	Nick         *string      `xml:"nick"`
+	Email        *string      `xml:"email"`
+	Items        []SearchItem `xml:"item"`
+	Form         *forms.Form  `xml:"jabber:x:data x"`
+}
+
+// One result of a search without a form.
+type SearchItem struct {
+	Jid   JID    `xml:"jid,attr"`
+	First string `xml:"first,omitempty"`
+	Last  string `xml:"last,omitempty"`
+	Nick  string `xml:"nick,omitempty"`
+	Email string `xml:"email,omitempty"`
+}
+
+// One result of a search, whether the directory uses a form or not.
+type SearchResult struct {
+	Jid JID
+	// The result's values, by field. Without a form, the fields
+	// are "first", "last", "nick" and "email".
+	Fields map[string]string
+}
+
+// SearchExt must be included in the extensions passed to NewClient to
+// search directories.
+var SearchExt Extension = Extension{}
+
+func init() {
+	SearchExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	sName := xml.Name{Space: NsSearch, Local: "query"}
+	SearchExt.StanzaTypes[sName] = reflect.TypeOf(SearchQuery{})
+}
+
+// Asks a directory, such as a server's users directory, what it can
+// search by. Fill in the fields that are present, or the form, and
+// pass the query to Search.
+func (cl *Client) SearchFields(ctx context.Context,
+	directory JID) (*SearchQuery, error) {
+
+	return cl.searchIq(ctx, directory, "get", &SearchQuery{})
+}
+
+// Searches a directory with a query from SearchFields. If it has a
+// form, the form's current values are submitted.
+func (cl *Client) Search(ctx context.Context, directory JID,
+	q *SearchQuery) ([]SearchResult, error) {
+
+	sub := SearchQuery{First: q.First, Last: q.Last, Nick: q.Nick,
+		Email: q.Email}
+	if q.Form != nil {
+		sub = SearchQuery{Form: q.Form.Submit()}
+	}
+	res, err := cl.searchIq(ctx, directory, "set", &sub)
+	if err != nil {
+		return nil, err
+	}
+	return res.results(), nil
+}
+
+func (cl *Client) searchIq(ctx context.Context, directory JID, typ string,
+	q *SearchQuery) (*SearchQuery, error) {
+
+	iq := &Iq{Header: Header{To: directory, Type: typ,
+		Nested: []interface{}{q}}}
+	reply, err := cl.SendIq(ctx, iq)
+	if err != nil {
+		return nil, err
+	}
+	for _, ele := range reply.Nested {
+		if res, ok := ele.(*SearchQuery); ok {
+			return res, nil
+		}
+	}
+	return nil, errors.New("no search query in reply")
+}
+
+// Returns the results in a directory's answer to a search.
+func (q *SearchQuery) results() []SearchResult {
+	var res []SearchResult
+	for _, it := range q.Items {
+		fields := make(map[string]string)
+		for k, v := range map[string]string{"first": it.First,
+			"last": it.Last, "nick": it.Nick, "email": it.Email} {
+			if v != "" {
+				fields[k] = v
+			}
+		}
+		res = append(res, SearchResult{Jid: it.Jid, Fields: fields})
+	}
+	if q.Form == nil {
+		return res
+	}
+	for _, it := range q.Form.Items {
+		r := SearchResult{Fields: make(map[string]string)}
+		for _, f := range it.Fields {
+			if len(f.Values) == 0 {
+				continue
+			}
+			if f.Var == "jid" {
+				r.Jid = JID(f.Values[0])
+			} else {
+				r.Fields[f.Var] = f.Values[0]
+			}
+		}
+		res = append(res, r)
+	}
+	return res
+}
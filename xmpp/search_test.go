@@ -0,0 +1,66 @@
+package xmpp
+
+import (
+	"./forms"
+	"context"
+	"encoding/xml"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	send := make(chan Stanza, 1)
+	cl := &Client{handlers: make(chan *callback, 1), Send: send}
+	asked := make(chan string, 1)
+	replies := make(chan *SearchQuery, 1)
+	go func() {
+		for {
+			h := <-cl.handlers
+			iq := (<-send).(*Iq)
+			buf, _ := xml.Marshal(iq.Nested[0])
+			asked <- iq.Type + " " + string(iq.To) + " " + string(buf)
+			h.f(&Iq{Header: Header{Id: iq.Id, Type: "result",
+				Nested: []interface{}{<-replies}}})
+		}
+	}()
+	ctx := context.Background()
+	empty := ""
+
+	replies <- &SearchQuery{Instructions: "Fill in a field",
+		First: &empty, Nick: &empty}
+	q, err := cl.SearchFields(ctx, "search.b.c")
+	assertEquals(t, `get search.b.c <query xmlns="`+NsSearch+`"></query>`,
+		<-asked)
+	if err != nil || q.First == nil || q.Last != nil {
+		t.Fatalf("SearchFields: %+v %v", q, err)
+	}
+	nick := "al"
+	q.Nick = &nick
+	replies <- &SearchQuery{Items: []SearchItem{{Jid: "al@b.c",
+		Nick: "al", Email: "al@example.com"}}}
+	res, err := cl.Search(ctx, "search.b.c", q)
+	assertEquals(t, `set search.b.c <query xmlns="`+NsSearch+`"><first>`+
+		`</first><nick>al</nick></query>`, <-asked)
+	if err != nil || len(res) != 1 {
+		t.Fatalf("Search: %v %v", res, err)
+	}
+	if res[0].Jid != "al@b.c" || res[0].Fields["email"] != "al@example.com" ||
+		len(res[0].Fields) != 2 {
+		t.Errorf("result %+v", res[0])
+	}
+
+	// With a form.
+	form := &forms.Form{Type: forms.TypeResult, Items: []forms.Item{{Fields: []forms.Field{
+		{Var: "jid", Values: []string{"bo@b.c"}},
+		{Var: "nick", Values: []string{"bo"}}}}}}
+	replies <- &SearchQuery{Form: form}
+	q = &SearchQuery{Instructions: "x", Form: &forms.Form{Type: "form",
+		Fields: []forms.Field{{Var: "nick", Values: []string{"bo"}}}}}
+	res, err = cl.Search(ctx, "search.b.c", q)
+	assertEquals(t, `set search.b.c <query xmlns="`+NsSearch+`"><x `+
+		`xmlns="jabber:x:data" type="submit"><field var="nick"><value>`+
+		`bo</value></field></x></query>`, <-asked)
+	if err != nil || len(res) != 1 || res[0].Jid != "bo@b.c" ||
+		res[0].Fields["nick"] != "bo" {
+		t.Errorf("Search: %+v %v", res, err)
+	}
+}
@@ -0,0 +1,119 @@
+package xmpp
+
+// This file contains the bounded queue behind SendContext, and
+// flushing it.
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// How many stanzas SendContext queues if SendQueueExt doesn't say.
+const defaultSendQueue = 64
+
+var (
+	// Returned by SendContext and Flush once the client has
+	// closed.
+	ErrClientClosed = errClientClosed
+	// Returned by SendContext while the connection is down, if the
+	// client can't get it back.
+	ErrNotConnected = errors.New("not connected")
+)
+
+// Sets how many stanzas SendContext holds while they're waiting to be
+// sent, such as while ReconnectExt is reconnecting.
+func SendQueueExt(size int) Extension {
+	return Extension{option: func(o *options) {
+		o.sendQueue = size
+	}}
+}
+
+// Flush puts one of these through the whole of the sending side, and
+// it's closed once everything queued before it has been written.
+type flushMarker struct {
+	Header
+	done chan bool
+}
+
+var _ Stanza = &flushMarker{}
+
+func (m *flushMarker) GetHeader() *Header {
+	return &m.Header
+}
+
+// Queues a stanza to be sent, and returns once it's queued. If the
+// queue is full, it waits until there's room, or the context is done.
+// Unlike sending on Send, it reports an error instead of blocking
+// when the connection is down and won't come back, or the client has
+// closed. Stanzas are sent in the order they're queued.
+func (cl *Client) SendContext(ctx context.Context, st Stanza) error {
+	if st == nil {
+		return errors.New("nil stanza")
+	}
+	return cl.enqueue(ctx, st)
+}
+
+// Waits until every stanza queued with SendContext before the call has
+// been written to the connection, so that nothing is lost if the
+// client is then closed. Stanzas held by filters, such as a
+// RateLimiter's, are waited for too. Returns an error if the context
+// is done or the session ends first.
+func (cl *Client) Flush(ctx context.Context) error {
+	m := &flushMarker{done: make(chan bool)}
+	if err := cl.enqueue(ctx, m); err != nil {
+		return err
+	}
+	select {
+	case <-m.done:
+		return nil
+	case <-cl.closing:
+		return cl.getError(errClientClosed)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (cl *Client) enqueue(ctx context.Context, st Stanza) error {
+	select {
+	case <-cl.closing:
+		return cl.getError(errClientClosed)
+	default:
+	}
+	if atomic.LoadInt32(&cl.disconnected) != 0 && cl.rc == nil && cl.sm == nil {
+		return ErrNotConnected
+	}
+	select {
+	case cl.queue <- st:
+		return nil
+	case <-cl.closing:
+		return cl.getError(errClientClosed)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Moves stanzas from the queue to Send, and keeps track of whether
+// the session has stopped running.
+func (cl *Client) drainQueue(status <-chan Status) {
+	running := false
+	for {
+		select {
+		case st := <-cl.queue:
+			if cl.send(context.Background(), st) != nil {
+				return
+			}
+		case s, ok := <-status:
+			if !ok || s.Fatal() {
+				return
+			}
+			var disconnected int32
+			if s == StatusRunning {
+				running = true
+			} else if running {
+				disconnected = 1
+			}
+			atomic.StoreInt32(&cl.disconnected, disconnected)
+		}
+	}
+}
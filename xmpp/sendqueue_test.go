@@ -0,0 +1,78 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSendQueue(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	s.AddUser("bob", "secret")
+	// Delays what's sent, so the queue has something to flush.
+	r := NewRateLimiter(RateLimit{}, RateLimit{Rate: 20, Burst: 1}, 10)
+	jid := JID("alice@b.c/pc")
+	cl, err := NewClientFromConn(s.Dial(), &jid, "secret", &tls.Config{},
+		[]Extension{r.Extension, SendQueueExt(2)}, Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn: %v", err)
+	}
+	bob := mockClient(t, s, "bob@b.c/pc", "secret", &tls.Config{})
+	defer bob.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 5; i++ {
+		err := cl.SendContext(ctx, &Message{Header: Header{
+			To: "bob@b.c/pc"}, Body: []Text{{Chardata: fmt.Sprint(i)}}})
+		if err != nil {
+			t.Fatalf("SendContext: %v", err)
+		}
+	}
+	if err := cl.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	cl.Close()
+	// Nothing was lost by closing.
+	for i := 0; i < 5; i++ {
+		assertEquals(t, fmt.Sprint(i), firstText(recvMessage(t, bob).Body))
+	}
+
+	if err := cl.SendContext(ctx, &Message{}); err != ErrClientClosed {
+		t.Errorf("SendContext after Close: %v", err)
+	}
+	if err := cl.Flush(ctx); err != ErrClientClosed {
+		t.Errorf("Flush after Close: %v", err)
+	}
+}
+
+func TestSendQueueFull(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	// Nothing more gets out, so the queue fills up.
+	r := NewRateLimiter(RateLimit{Rate: 0.001, Burst: 2}, RateLimit{}, 1)
+	jid := JID("alice@b.c/pc")
+	cl, err := NewClientFromConn(s.Dial(), &jid, "secret", &tls.Config{},
+		[]Extension{r.Extension, SendQueueExt(1)}, Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn: %v", err)
+	}
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		200*time.Millisecond)
+	defer cancel()
+	var errs []error
+	for i := 0; i < 10 && ctx.Err() == nil; i++ {
+		errs = append(errs, cl.SendContext(ctx, &Message{Header: Header{
+			To: "b.c"}}))
+	}
+	if last := errs[len(errs)-1]; last != context.DeadlineExceeded {
+		t.Errorf("got %v, want to wait for room", last)
+	}
+}
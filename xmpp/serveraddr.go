@@ -0,0 +1,95 @@
+package xmpp
+
+// This file contains connecting to a server given explicitly, instead
+// of the ones the domain's SRV records name, as for testing, onion
+// services, or split DNS.
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+)
+
+// Where to connect, instead of where the JID's domain says.
+type ServerAddress struct {
+	// The host and port, such as "10.0.0.2:5222" or
+	// "abc...xyz.onion:5222". The server's certificate is still
+	// verified against the JID's domain.
+	Addr string
+	// Whether TLS starts as soon as the connection is made,
+	// XEP-0368, rather than with STARTTLS.
+	DirectTls bool
+	// The name sent with SNI. Empty means the JID's domain. An IP
+	// address sends none.
+	ServerName string
+	// The ALPN protocols offered with direct TLS. Empty means
+	// "xmpp-client".
+	NextProtos []string
+}
+
+// Returns an extension which makes NewClient, and NewClientContext,
+// connect to the given address every time, including when
+// ReconnectExt reconnects, through the Dialer of DialerExt if there
+// is one.
+func ServerAddressExt(addr ServerAddress) Extension {
+	return Extension{option: func(o *options) {
+		o.server = &addr
+	}}
+}
+
+// Connects to the explicit address, and starts TLS if it expects
+// that.
+func dialServer(ctx context.Context, o *options, domain string,
+	tlsconf *tls.Config) (net.Conn, error) {
+
+	sa := o.server
+	conn, err := dialWith(ctx, o.dialer, sa.Addr)
+	if err != nil || !sa.DirectTls {
+		return conn, err
+	}
+	conf := tlsconf
+	if len(sa.NextProtos) != 0 {
+		conf = tlsconf.Clone()
+		conf.NextProtos = sa.NextProtos
+	}
+	tlsConn := tls.Client(conn, directTlsConfig(conf, domain))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Makes the configuration verify the server's certificate against
+// name, whatever ServerName asks for with SNI. That's done by
+// VerifyConnection instead of by the handshake, which would check it
+// against ServerName. Configurations which don't verify are left
+// alone.
+func verifyAs(conf *tls.Config, name string) {
+	if conf.InsecureSkipVerify {
+		return
+	}
+	conf.InsecureSkipVerify = true
+	roots := conf.RootCAs
+	prev := conf.VerifyConnection
+	conf.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("server sent no certificate")
+		}
+		inter := x509.NewCertPool()
+		for _, c := range cs.PeerCertificates[1:] {
+			inter.AddCert(c)
+		}
+		if _, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+			DNSName: name, Roots: roots,
+			Intermediates: inter}); err != nil {
+			return err
+		}
+		if prev != nil {
+			return prev(cs)
+		}
+		return nil
+	}
+}
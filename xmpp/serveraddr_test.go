@@ -0,0 +1,95 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerAddressExt(t *testing.T) {
+	connect := func(certDomain, sni string) (string, string, error) {
+		cert, pool := mockCert(t, certDomain)
+		s := NewMockServer("b.c")
+		defer s.Close()
+		var hello string
+		s.TLS = &tls.Config{GetConfigForClient: func(
+			chi *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = chi.ServerName
+			return &tls.Config{Certificates: []tls.Certificate{cert}},
+				nil
+		}}
+		s.AddUser("alice", "secret")
+		var dialed string
+		d := DialerFunc(func(ctx context.Context, network,
+			addr string) (net.Conn, error) {
+			dialed = addr
+			return s.Dial(), nil
+		})
+		jid := JID("alice@b.c/pc")
+		ctx, cancel := context.WithTimeout(context.Background(),
+			10*time.Second)
+		defer cancel()
+		cl, err := NewClientContext(ctx, &jid, "secret",
+			&tls.Config{RootCAs: pool}, []Extension{DialerExt(d), ServerAddressExt(ServerAddress{
+				Addr: "10.1.2.3:5222", ServerName: sni})},
+			Presence{}, nil)
+		if err == nil {
+			cl.Close()
+		}
+		return dialed, hello, err
+	}
+
+	dialed, hello, err := connect("b.c", "front.example")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	assertEquals(t, "10.1.2.3:5222", dialed)
+	assertEquals(t, "front.example", hello)
+
+	// The certificate has to be valid for the domain, whatever SNI
+	// says.
+	if _, _, err := connect("front.example", "front.example"); err == nil {
+		t.Error("accepted a certificate for another domain")
+	}
+}
+
+func TestDialServerDirectTls(t *testing.T) {
+	cert, pool := mockCert(t, "b.c")
+	hello := make(chan *tls.ClientHelloInfo, 1)
+	d := pipeDialer(func(conn net.Conn) {
+		tc := tls.Server(conn, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{directTlsProto, "x-test"},
+			GetConfigForClient: func(
+				chi *tls.ClientHelloInfo) (*tls.Config, error) {
+				hello <- chi
+				return nil, nil
+			}})
+		tc.Handshake()
+		tc.Write([]byte("x"))
+	})
+	dial := func(sa ServerAddress) (*tls.Conn, *tls.ClientHelloInfo) {
+		o := newOptions([]Extension{DialerExt(d), ServerAddressExt(sa)})
+		conf := o.tlsConfig(&tls.Config{RootCAs: pool}, "b.c")
+		conn, err := dialServer(context.Background(), &o, "b.c", conf)
+		if err != nil {
+			t.Fatalf("dialServer: %v", err)
+		}
+		return conn.(*tls.Conn), <-hello
+	}
+
+	conn, chi := dial(ServerAddress{Addr: "127.0.0.1:5223",
+		DirectTls: true})
+	defer conn.Close()
+	assertEquals(t, "b.c", chi.ServerName)
+	assertEquals(t, directTlsProto, conn.ConnectionState().NegotiatedProtocol)
+
+	conn, chi = dial(ServerAddress{Addr: "127.0.0.1:5223",
+		DirectTls: true, ServerName: "front.example",
+		NextProtos: []string{"x-test"}})
+	defer conn.Close()
+	assertEquals(t, "front.example", chi.ServerName)
+	assertEquals(t, "x-test", conn.ConnectionState().NegotiatedProtocol)
+}
@@ -0,0 +1,567 @@
+package xmpp
+
+// This file contains support for stream management, XEP-0198. The
+// client and server acknowledge the stanzas they receive, so that a
+// stream which breaks can be resumed over a new connection without
+// losing any.
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const NsSM = "urn:xmpp:sm:3"
+
+// Passing StreamManagementExt to NewClient among the extensions turns
+// on stream management, if the server offers it. If the connection
+// to the server is lost, the client then reconnects and resumes the
+// stream, and sends again whatever the server hadn't acknowledged.
+// Meanwhile the status goes back to StatusUnconnected, writes to
+// Client.Send block, and nothing arrives on Client.Recv. The session
+// only fails if it can't be resumed within the time the server
+// allows.
+//
+// Resumption needs the password, so the client keeps it in memory.
+// Clients created with NewClientFromConn or NewClientFromReadWriter
+// can't make a new connection, so they only get acknowledgements.
+//
+// BUG(jerray): A connection which breaks in the middle of a stanza
+// can't be resumed, since the partial stanza can't be parsed.
+var StreamManagementExt = Extension{option: func(o *options) {
+	o.streamMgmt = true
+}}
+
+type smEnable struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 enable"`
+	Resume  bool     `xml:"resume,attr,omitempty"`
+}
+
+type smEnabled struct {
+	XMLName  xml.Name `xml:"urn:xmpp:sm:3 enabled"`
+	Id       string   `xml:"id,attr"`
+	Resume   string   `xml:"resume,attr"`
+	Max      int      `xml:"max,attr"`
+	Location string   `xml:"location,attr"`
+}
+
+type smResume struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 resume"`
+	H       uint32   `xml:"h,attr"`
+	PrevId  string   `xml:"previd,attr"`
+}
+
+type smResumed struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 resumed"`
+	H       uint32   `xml:"h,attr"`
+	PrevId  string   `xml:"previd,attr"`
+}
+
+type smFailed struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 failed"`
+	H       *uint32  `xml:"h,attr"`
+	Any     *Generic `xml:",any"`
+}
+
+type smRequest struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 r"`
+}
+
+type smAnswer struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 a"`
+	H       uint32   `xml:"h,attr"`
+}
+
+var (
+	// What SendAcked's callback is given if stream management isn't
+	// enabled when its stanza is sent.
+	ErrNoStreamMgmt = errors.New("stream management isn't enabled")
+	// What SendAcked's callback is given if the session ends, or
+	// starts afresh, before the server acknowledges its stanza. The
+	// stanza may or may not have been delivered.
+	ErrUnacked = errors.New("stanza wasn't acknowledged")
+
+	errResumeRefused = errors.New("server refused to resume the stream")
+	errSessionEnded  = errors.New("session ended")
+)
+
+const (
+	// How long to keep trying to resume, if the server doesn't say.
+	smDefaultMax = 5 * time.Minute
+	// How long one attempt to resume may take.
+	smAttemptTimeout = 30 * time.Second
+)
+
+// The state of stream management for one session.
+type streamMgmt struct {
+	lock sync.Mutex
+	// Outgoing stanzas are counted once enable has been sent, and
+	// incoming ones once the server has replied.
+	counting  bool
+	enabled   bool
+	id        string
+	resumable bool
+	location  string
+	max       time.Duration
+	// The number of stanzas received, and the server's count of
+	// the ones we sent.
+	inbound, acked uint32
+	// Stanzas sent which the server hasn't acknowledged, oldest
+	// first.
+	unacked []Stanza
+	// Whether an <r/> is outstanding.
+	requested bool
+	// Callbacks waiting for the acknowledgement of a stanza, by its
+	// id.
+	waiting map[string]func(error)
+	// While resuming, the outcome of each attempt is reported on
+	// result. Attempt is the connection being tried.
+	result  chan error
+	attempt net.Conn
+}
+
+// Records an outgoing stanza. Returns true if an acknowledgement
+// should be requested.
+func (sm *streamMgmt) sent(st Stanza) bool {
+	sm.lock.Lock()
+	if !sm.counting {
+		fs := sm.takeWaiting([]Stanza{st})
+		sm.lock.Unlock()
+		callAll(fs, ErrNoStreamMgmt)
+		return false
+	}
+	defer sm.lock.Unlock()
+	sm.unacked = append(sm.unacked, st)
+	if sm.requested {
+		return false
+	}
+	sm.requested = true
+	return true
+}
+
+func (sm *streamMgmt) received() {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	if sm.enabled {
+		sm.inbound++
+	}
+}
+
+// The server has handled h of our stanzas. Returns true if some are
+// still unacknowledged, and another acknowledgement should be
+// requested.
+func (sm *streamMgmt) ack(h uint32) bool {
+	sm.lock.Lock()
+	// The counters wrap around, so this is modulo 2^32.
+	n := h - sm.acked
+	if int64(n) > int64(len(sm.unacked)) {
+		n = uint32(len(sm.unacked))
+	}
+	fs := sm.takeWaiting(sm.unacked[:n])
+	sm.unacked = sm.unacked[n:]
+	sm.acked = h
+	sm.requested = len(sm.unacked) > 0
+	requested := sm.requested
+	sm.lock.Unlock()
+	callAll(fs, nil)
+	return requested
+}
+
+func (sm *streamMgmt) resuming() bool {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	return sm.result != nil
+}
+
+func (sm *streamMgmt) resumeRequest() *smResume {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	return &smResume{H: sm.inbound, PrevId: sm.id}
+}
+
+// Reports the outcome of an attempt to resume.
+func (sm *streamMgmt) report(err error) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	if sm.result == nil {
+		return
+	}
+	sm.attempt = nil
+	select {
+	case sm.result <- err:
+	default:
+	}
+}
+
+// Forgets the old stream, before a new session is started. Returns
+// the stanzas the server hadn't acknowledged.
+func (sm *streamMgmt) reset() []Stanza {
+	sm.lock.Lock()
+	unacked := sm.unacked
+	fs := sm.takeWaiting(unacked)
+	// The callbacks are called once the lock is released.
+	defer callAll(fs, ErrUnacked)
+	defer sm.lock.Unlock()
+	sm.counting, sm.enabled, sm.resumable = false, false, false
+	sm.id, sm.location, sm.max = "", "", 0
+	sm.inbound, sm.acked = 0, 0
+	sm.unacked, sm.requested = nil, false
+	sm.result, sm.attempt = nil, nil
+	return unacked
+}
+
+// Waits for the acknowledgement of the stanza with the given id.
+func (sm *streamMgmt) wait(id string, acked func(error)) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	if sm.waiting == nil {
+		sm.waiting = make(map[string]func(error))
+	}
+	sm.waiting[id] = acked
+}
+
+func (sm *streamMgmt) forget(id string) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	delete(sm.waiting, id)
+}
+
+// Takes the callbacks waiting for some stanzas. Called with the lock
+// held; the callbacks are called once it's released.
+func (sm *streamMgmt) takeWaiting(sts []Stanza) []func(error) {
+	if len(sm.waiting) == 0 {
+		return nil
+	}
+	var res []func(error)
+	for _, st := range sts {
+		id := st.GetHeader().Id
+		if f, ok := sm.waiting[id]; ok {
+			delete(sm.waiting, id)
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// Gives up on every acknowledgement, when the session has ended.
+func (sm *streamMgmt) abandon() {
+	if sm == nil {
+		return
+	}
+	sm.lock.Lock()
+	waiting := sm.waiting
+	sm.waiting = nil
+	sm.lock.Unlock()
+	for _, f := range waiting {
+		f(ErrUnacked)
+	}
+}
+
+func callAll(fs []func(error), err error) {
+	for _, f := range fs {
+		f(err)
+	}
+}
+
+// Sends a stanza with SendContext, and calls acked once the server
+// has acknowledged it with stream management. Acked is given nil
+// then, ErrNoStreamMgmt if the server doesn't offer stream
+// management, or ErrUnacked if the session ends, or a new session
+// starts without resuming the stream, before the acknowledgement
+// came. It's called once, from the client's own goroutines, so it
+// mustn't block. The stanza is given an id if it hasn't one; the ids
+// of stanzas awaiting acknowledgement must be unique.
+func (cl *Client) SendAcked(ctx context.Context, st Stanza,
+	acked func(error)) error {
+
+	if cl.sm == nil {
+		return ErrNoStreamMgmt
+	}
+	if st == nil {
+		return errors.New("nil stanza")
+	}
+	h := st.GetHeader()
+	if h.Id == "" {
+		h.Id = cl.NextId()
+	}
+	cl.sm.wait(h.Id, acked)
+	if err := cl.SendContext(ctx, st); err != nil {
+		cl.sm.forget(h.Id)
+		return err
+	}
+	return nil
+}
+
+// Returns the stanzas sent since stream management was enabled which
+// the server hasn't acknowledged. If the session ended because the
+// stream couldn't be resumed, these may not have been delivered.
+func (cl *Client) Unacked() []Stanza {
+	if cl.sm == nil {
+		return nil
+	}
+	cl.sm.lock.Lock()
+	defer cl.sm.lock.Unlock()
+	return append([]Stanza(nil), cl.sm.unacked...)
+}
+
+// Asks the server to enable stream management, once the session has
+// started.
+func (cl *Client) enableStreamMgmt() {
+	if cl.Features == nil || cl.Features.Sm == nil || cl.inlined[NsSM] {
+		return
+	}
+	cl.sm.lock.Lock()
+	cl.sm.counting = true
+	cl.sm.lock.Unlock()
+	cl.trySendRaw(&smEnable{Resume: cl.redial != nil})
+}
+
+func (cl *Client) handleStreamMgmt(obj interface{}) {
+	sm := cl.sm
+	if sm == nil {
+		return
+	}
+	switch obj := obj.(type) {
+	case *smEnabled:
+		sm.lock.Lock()
+		sm.enabled = true
+		sm.id = obj.Id
+		sm.resumable = obj.Resume == "true" || obj.Resume == "1"
+		sm.location = obj.Location
+		sm.max = time.Duration(obj.Max) * time.Second
+		sm.lock.Unlock()
+	case *smRequest:
+		sm.lock.Lock()
+		h := sm.inbound
+		sm.lock.Unlock()
+		cl.sendRaw <- &smAnswer{H: h}
+	case *smAnswer:
+		if sm.ack(obj.H) {
+			cl.sendRaw <- &smRequest{}
+		}
+	case *smResumed:
+		sm.ack(obj.H)
+		sm.lock.Lock()
+		resend := append([]Stanza(nil), sm.unacked...)
+		sm.requested = len(resend) > 0
+		sm.lock.Unlock()
+		// These go out before anything the application sends
+		// once the session is running again.
+		for _, st := range resend {
+			cl.sendRaw <- st
+		}
+		if len(resend) > 0 {
+			cl.sendRaw <- &smRequest{}
+		}
+		cl.setStatus(StatusRunning)
+		sm.report(nil)
+	case *smFailed:
+		if sm.resuming() {
+			sm.report(errResumeRefused)
+			return
+		}
+		// The server wouldn't enable stream management.
+		sm.lock.Lock()
+		fs := sm.takeWaiting(sm.unacked)
+		sm.counting = false
+		sm.unacked = nil
+		sm.requested = false
+		sm.lock.Unlock()
+		callAll(fs, ErrNoStreamMgmt)
+	}
+}
+
+// Called by the transport goroutines when the connection fails. If
+// the stream can be resumed, or the client reconnects, that's done in
+// the background and true is returned. Otherwise the error is fatal.
+func (cl *Client) lostConnection(sock net.Conn, err error) bool {
+	sock = rawConn(sock)
+	select {
+	case <-cl.closing:
+		// The server may well hang up on a client which is
+		// closing.
+		sock.Close()
+		return false
+	default:
+	}
+	cl.logf(LogWarn, "connection lost: %v", err)
+	if cl.rc != nil && cl.rc.lost(sock, err) {
+		return true
+	}
+	if sm := cl.sm; sm != nil && cl.redial != nil {
+		sm.lock.Lock()
+		if sm.result != nil {
+			// Either the other transport goroutine noticed
+			// the same failure, or an attempt to resume has
+			// failed.
+			if sock == sm.attempt {
+				sm.attempt = nil
+				select {
+				case sm.result <- err:
+				default:
+				}
+			}
+			sm.lock.Unlock()
+			sock.Close()
+			return true
+		}
+		if sm.enabled && sm.resumable {
+			sm.result = make(chan error, 1)
+			sm.lock.Unlock()
+			sock.Close()
+			cl.connEvent(ConnectionEvent{Err: err})
+			go cl.resume(err)
+			return true
+		}
+		sm.lock.Unlock()
+	}
+	if cl.rc != nil && cl.redial != nil && cl.rc.start() {
+		sock.Close()
+		go cl.reconnect(err)
+		return true
+	}
+	cl.setError(err)
+	return false
+}
+
+// Keeps trying to resume the stream until the server's limit
+// expires.
+func (cl *Client) resume(cause error) {
+	stat := cl.statmgr.newListener()
+	cl.setStatus(StatusUnconnected)
+	sm := cl.sm
+	sm.lock.Lock()
+	max := sm.max
+	sm.lock.Unlock()
+	if max == 0 {
+		max = smDefaultMax
+	}
+	deadline := time.Now().Add(max)
+	backoff := time.Second
+	var err error
+	for {
+		err = cl.resumeOnce(stat, deadline)
+		if err == nil {
+			sm.lock.Lock()
+			sm.result = nil
+			sm.lock.Unlock()
+			cl.connEvent(ConnectionEvent{Online: true})
+			cl.countReconnect()
+			return
+		}
+		if err == errSessionEnded {
+			return
+		}
+		if err == errResumeRefused ||
+			time.Now().Add(backoff).After(deadline) {
+			break
+		}
+		if !sleepUnlessFatal(stat, backoff) {
+			return
+		}
+		backoff *= 2
+		if backoff > smAttemptTimeout {
+			backoff = smAttemptTimeout
+		}
+	}
+	err = fmt.Errorf("can't resume stream after %v: %v", cause, err)
+	// Reconnecting is marked as under way before resuming stops, so
+	// failures of the last attempt's connection aren't mistaken for
+	// new ones.
+	if cl.rc != nil && cl.rc.start() {
+		sm.lock.Lock()
+		sm.result = nil
+		sm.lock.Unlock()
+		cl.reconnect(err)
+		return
+	}
+	cl.setError(err)
+}
+
+// Waits for d, or until the session ends. Returns false in the
+// latter case.
+func sleepUnlessFatal(stat <-chan Status, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case s, ok := <-stat:
+			if !ok || s.Fatal() {
+				return false
+			}
+		}
+	}
+}
+
+// Makes one attempt to resume the stream over a new connection.
+func (cl *Client) resumeOnce(stat <-chan Status, deadline time.Time) error {
+	sm := cl.sm
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	ctx, cancel = context.WithTimeout(ctx, smAttemptTimeout)
+	defer cancel()
+
+	sm.lock.Lock()
+	location := sm.location
+	sm.lock.Unlock()
+	conn, err := dialLocation(ctx, cl.opts.dialer, location)
+	if err != nil {
+		conn, err = cl.redial(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	sm.lock.Lock()
+	sm.attempt = rawConn(conn)
+	result := sm.result
+	sm.lock.Unlock()
+	cl.saslExpected = ""
+	cl.layer1.setSock(conn)
+	cl.setStatus(StatusConnected)
+	if !cl.trySendRaw(cl.streamHeader()) {
+		return errSessionEnded
+	}
+
+	for {
+		select {
+		case err = <-result:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case s, ok := <-stat:
+			if ok && !s.Fatal() {
+				continue
+			}
+			err = errSessionEnded
+		}
+		break
+	}
+	if err != nil {
+		sm.lock.Lock()
+		sm.attempt = nil
+		sm.lock.Unlock()
+		conn.Close()
+	}
+	return err
+}
+
+// Connects to the location the server gave for resuming the stream,
+// which is a host with an optional port, with d if it isn't nil.
+func dialLocation(ctx context.Context, d Dialer, location string) (net.Conn,
+	error) {
+	if location == "" {
+		return nil, fmt.Errorf("no location")
+	}
+	addr := location
+	if _, _, err := net.SplitHostPort(location); err != nil {
+		addr = net.JoinHostPort(strings.Trim(location, "[]"), "5222")
+	}
+	return dialWith(ctx, d, addr)
+}
@@ -0,0 +1,230 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStreamMgmtAck(t *testing.T) {
+	sm := &streamMgmt{counting: true, acked: 0xffffffff}
+	if !sm.sent(&Message{Header: Header{Id: "1"}}) {
+		t.Error("first stanza should request an ack")
+	}
+	if sm.sent(&Message{Header: Header{Id: "2"}}) {
+		t.Error("ack already requested")
+	}
+	sm.sent(&Message{Header: Header{Id: "3"}})
+
+	// The counter wraps around.
+	if !sm.ack(1) {
+		t.Error("one stanza should still be unacked")
+	}
+	assertEquals(t, "1", fmt.Sprint(len(sm.unacked)))
+	assertEquals(t, "3", sm.unacked[0].GetHeader().Id)
+	if sm.ack(2) {
+		t.Error("nothing should be unacked")
+	}
+	assertEquals(t, "0", fmt.Sprint(len(sm.unacked)))
+}
+
+func TestStreamMgmtWaiting(t *testing.T) {
+	results := make(map[string]error)
+	done := func(id string) func(error) {
+		return func(err error) { results[id] = err }
+	}
+	sm := &streamMgmt{}
+	for _, id := range []string{"0", "1", "2", "3"} {
+		sm.wait(id, done(id))
+	}
+	// Before stream management is enabled, nothing is acked.
+	sm.sent(&Message{Header: Header{Id: "0"}})
+	if results["0"] != ErrNoStreamMgmt {
+		t.Errorf("before enable: %v", results["0"])
+	}
+
+	sm.counting = true
+	for _, id := range []string{"1", "x", "2"} {
+		sm.sent(&Message{Header: Header{Id: id}})
+	}
+	sm.ack(2)
+	if err, ok := results["1"]; !ok || err != nil {
+		t.Errorf("acked: %v %v", ok, err)
+	}
+	// A new session doesn't resume the old one's acks.
+	sm.reset()
+	if results["2"] != ErrUnacked {
+		t.Errorf("after reset: %v", results["2"])
+	}
+	// Nor will the session's end.
+	if _, ok := results["3"]; ok {
+		t.Error("3 wasn't sent")
+	}
+	sm.abandon()
+	if results["3"] != ErrUnacked {
+		t.Errorf("after the end: %v", results["3"])
+	}
+
+	cl := &Client{}
+	if err := cl.SendAcked(context.Background(), &Message{}, done("4")); err != ErrNoStreamMgmt {
+		t.Errorf("without stream management: %v", err)
+	}
+}
+
+// Plays a server which supports stream management, and reports
+// stream management elements and message bodies the client sends.
+type smServer struct {
+	t      *testing.T
+	conn   net.Conn
+	lock   sync.Mutex
+	events chan string
+	// The h attribute sent in reply to a resume request.
+	resumedH string
+}
+
+func startSmServer(t *testing.T, conn net.Conn, resumedH string) *smServer {
+	srv := &smServer{t: t, conn: conn, events: make(chan string, 20),
+		resumedH: resumedH}
+	go srv.run()
+	return srv
+}
+
+func (srv *smServer) write(s string) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if _, err := io.WriteString(srv.conn, s); err != nil {
+		srv.t.Errorf("server write: %v", err)
+	}
+}
+
+func (srv *smServer) run() {
+	dec := xml.NewDecoder(srv.conn)
+	authed := false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if se.Name.Local == "stream" {
+			srv.write(`<stream:stream xmlns="jabber:client" ` +
+				`xmlns:stream="` + NsStream + `" ` +
+				`from="example.com" id="s1" version="1.0">`)
+			if authed {
+				srv.write(`<stream:features><bind xmlns="` +
+					NsBind + `"/><session xmlns="` +
+					NsSession + `"/><sm xmlns="` + NsSM +
+					`"/></stream:features>`)
+			} else {
+				srv.write(`<stream:features><mechanisms xmlns="` +
+					NsSASL + `"><mechanism>PLAIN</mechanism>` +
+					`</mechanisms></stream:features>`)
+			}
+			continue
+		}
+		var el struct {
+			Id   string   `xml:"id,attr"`
+			H    string   `xml:"h,attr"`
+			Bind *Generic `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+			Sess *Generic `xml:"urn:ietf:params:xml:ns:xmpp-session session"`
+			Body string   `xml:"body"`
+		}
+		if err := dec.DecodeElement(&el, &se); err != nil {
+			return
+		}
+		switch se.Name.Local {
+		case "auth":
+			authed = true
+			srv.write(`<success xmlns="` + NsSASL + `"/>`)
+		case "iq":
+			switch {
+			case el.Bind != nil:
+				srv.write(fmt.Sprintf(`<iq type="result" `+
+					`id="%s"><bind xmlns="%s"><jid>`+
+					`user@example.com/res</jid></bind></iq>`,
+					el.Id, NsBind))
+			case el.Sess != nil:
+				srv.write(fmt.Sprintf(`<iq type="result" id="%s"/>`,
+					el.Id))
+			default:
+				srv.events <- "iq"
+			}
+		case "enable":
+			srv.write(`<enabled xmlns="` + NsSM +
+				`" id="sm1" resume="true"/>`)
+			srv.events <- "enable"
+		case "resume":
+			srv.write(`<resumed xmlns="` + NsSM + `" previd="sm1" h="` +
+				srv.resumedH + `"/>`)
+			srv.events <- "resume:" + el.H
+		case "a":
+			srv.events <- "a:" + el.H
+		case "r":
+		case "message":
+			srv.events <- "message:" + el.Body
+		default:
+			srv.events <- se.Name.Local
+		}
+	}
+}
+
+func (srv *smServer) expect(want string) {
+	select {
+	case got := <-srv.events:
+		assertEquals(srv.t, want, got)
+	case <-time.After(10 * time.Second):
+		srv.t.Fatalf("timed out waiting for %s", want)
+	}
+}
+
+func TestStreamResumption(t *testing.T) {
+	c1, s1 := net.Pipe()
+	c2, s2 := net.Pipe()
+	srv1 := startSmServer(t, s1, "")
+	redial := func(ctx context.Context) (net.Conn, error) {
+		return c2, nil
+	}
+
+	jid := JID("user@example.com/res")
+	cl, err := newClient(c1, redial, &jid, "secret", &tls.Config{},
+		[]Extension{StreamManagementExt}, Presence{}, nil)
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	defer cl.Close()
+	srv1.expect("enable")
+	srv1.expect("iq")
+	srv1.expect("presence")
+
+	// Incoming stanzas are counted.
+	srv1.write(`<message from="a@example.com" id="m1"><body>hi</body>` +
+		`</message><r xmlns="` + NsSM + `"/>`)
+	<-cl.Recv
+	srv1.expect("a:1")
+
+	// The roster request and presence are acknowledged, but the
+	// message isn't.
+	srv1.write(`<a xmlns="` + NsSM + `" h="2"/>`)
+	cl.Send <- &Message{Header: Header{To: "a@example.com"},
+		Body: []Text{{Chardata: "one"}}}
+	srv1.expect("message:one")
+	s1.Close()
+
+	srv2 := startSmServer(t, s2, "2")
+	srv2.expect("resume:1")
+	srv2.expect("message:one")
+	cl.Send <- &Message{Header: Header{To: "a@example.com"},
+		Body: []Text{{Chardata: "two"}}}
+	srv2.expect("message:two")
+	assertEquals(t, "2", fmt.Sprint(len(cl.Unacked())))
+	s2.Close()
+}
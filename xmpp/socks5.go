@@ -0,0 +1,632 @@
+package xmpp
+
+// This file contains SOCKS5 bytestreams, XEP-0065: a TCP connection
+// between two entities, made directly or through a proxy after
+// negotiating over XMPP.
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const NsBytestreams = "http://jabber.org/protocol/bytestreams"
+
+// Negotiates a bytestream, or asks a proxy for its address or to
+// activate a stream.
+type BytestreamQuery struct {
+	XMLName        xml.Name        `xml:"http://jabber.org/protocol/bytestreams query"`
+	Sid            string          `xml:"sid,attr,omitempty"`
+	Mode           string          `xml:"mode,attr,omitempty"`
+	Streamhosts    []Streamhost    `xml:"streamhost"`
+	StreamhostUsed *StreamhostUsed `xml:"streamhost-used"`
+	Activate       JID             `xml:"activate,omitempty"`
+}
+
+// Somewhere the target of a bytestream may connect: the initiator
+// itself, or a proxy.
+type Streamhost struct {
+	Jid  JID    `xml:"jid,attr"`
+	Host string `xml:"host,attr"`
+	Port int    `xml:"port,attr,omitempty"`
+}
+
+type StreamhostUsed struct {
+	Jid JID `xml:"jid,attr"`
+}
+
+// BytestreamExt may be included in the extensions passed to
+// NewClient to decode bytestream negotiation. A BytestreamManager
+// includes it.
+var BytestreamExt Extension = Extension{}
+
+func init() {
+	BytestreamExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	bName := xml.Name{Space: NsBytestreams, Local: "query"}
+	BytestreamExt.StanzaTypes[bName] = reflect.TypeOf(BytestreamQuery{})
+}
+
+// How long connecting to a streamhost may take, including the SOCKS5
+// handshake.
+const streamhostTimeout = 10 * time.Second
+
+// The address both sides give the SOCKS5 server to identify a
+// stream: the hex SHA-1 of the stream id and the full JIDs of the
+// initiator and the target.
+func BytestreamAddr(sid string, initiator, target JID) string {
+	sum := sha1.Sum([]byte(sid + string(initiator) + string(target)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Connects to a SOCKS5 server and asks it for the given address,
+// without authenticating.
+func socks5Connect(ctx context.Context, addr, dst string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, streamhostTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if err := socks5Request(conn, dst); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 %s: %v", addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func socks5Request(rw io.ReadWriter, dst string) error {
+	return socks5Negotiate(rw, "", "", dst, 0)
+}
+
+// Asks a SOCKS5 server to connect to a host and port, logging in with
+// a user name and password if user isn't empty. RFC 1929.
+func socks5Negotiate(rw io.ReadWriter, user, password, dst string,
+	port uint16) error {
+
+	if len(dst) > 255 {
+		return errors.New("address too long")
+	}
+	if len(user) > 255 || len(password) > 255 {
+		return errors.New("user name or password too long")
+	}
+	method := byte(0)
+	if user != "" {
+		method = 2
+	}
+	if _, err := rw.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != 5 || buf[1] != method {
+		return errors.New("authentication refused")
+	}
+	if method == 2 {
+		req := append([]byte{1, byte(len(user))}, user...)
+		req = append(append(req, byte(len(password))), password...)
+		if _, err := rw.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return errors.New("login refused")
+		}
+	}
+	req := append([]byte{5, 1, 0, 3, byte(len(dst))}, dst...)
+	if ip := net.ParseIP(dst); ip.To4() != nil {
+		req = append([]byte{5, 1, 0, 1}, ip.To4()...)
+	} else if ip != nil {
+		req = append([]byte{5, 1, 0, 4}, ip...)
+	}
+	if _, err := rw.Write(append(req, byte(port>>8),
+		byte(port))); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return err
+	}
+	if buf[0] != 5 || buf[1] != 0 {
+		return fmt.Errorf("connect refused with code %d", buf[1])
+	}
+	// Skip the bound address.
+	var n int
+	switch buf[3] {
+	case 1:
+		n = net.IPv4len
+	case 4:
+		n = net.IPv6len
+	case 3:
+		if _, err := io.ReadFull(rw, buf[:1]); err != nil {
+			return err
+		}
+		n = int(buf[0])
+	default:
+		return fmt.Errorf("unknown address type %d", buf[3])
+	}
+	_, err := io.ReadFull(rw, make([]byte, n+2))
+	return err
+}
+
+// The server's half of socks5Request. Returns the address the client
+// asks for; the caller answers with socks5Reply.
+func socks5Accept(rw io.ReadWriter) (string, error) {
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != 5 {
+		return "", fmt.Errorf("socks version %d", buf[0])
+	}
+	methods := make([]byte, buf[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return "", err
+	}
+	noAuth := false
+	for _, m := range methods {
+		noAuth = noAuth || m == 0
+	}
+	if !noAuth {
+		rw.Write([]byte{5, 0xff})
+		return "", errors.New("no acceptable authentication method")
+	}
+	if _, err := rw.Write([]byte{5, 0}); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return "", err
+	}
+	if buf[0] != 5 || buf[1] != 1 || buf[3] != 3 {
+		return "", errors.New("not a connect request for a domain name")
+	}
+	if _, err := io.ReadFull(rw, buf[:1]); err != nil {
+		return "", err
+	}
+	dst := make([]byte, int(buf[0])+2)
+	if _, err := io.ReadFull(rw, dst); err != nil {
+		return "", err
+	}
+	return string(dst[:len(dst)-2]), nil
+}
+
+func socks5Reply(w io.Writer, dst string, ok bool) error {
+	code := byte(0)
+	if !ok {
+		code = 2
+	}
+	reply := append([]byte{5, code, 0, 3, byte(len(dst))}, dst...)
+	_, err := w.Write(append(reply, 0, 0))
+	return err
+}
+
+// Looks among the server's items for bytestream proxies, and asks
+// each for its address.
+func (cl *Client) BytestreamProxies(ctx context.Context) ([]Streamhost,
+	error) {
+
+	items, err := cl.DiscoItems(ctx, JID(cl.Jid.Domain()), "")
+	if err != nil {
+		return nil, err
+	}
+	var hosts []Streamhost
+	for _, item := range items.Items {
+		di, err := cl.DiscoInfo(ctx, item.Jid, "")
+		if err != nil || !di.HasFeature(NsBytestreams) {
+			continue
+		}
+		iq := &Iq{Header: Header{To: item.Jid, Type: "get",
+			Nested: []interface{}{&BytestreamQuery{}}}}
+		reply, err := cl.SendIq(ctx, iq)
+		if err != nil {
+			continue
+		}
+		for _, ele := range reply.Nested {
+			if q, ok := ele.(*BytestreamQuery); ok {
+				hosts = append(hosts, q.Streamhosts...)
+			}
+		}
+	}
+	return hosts, nil
+}
+
+// Configures a BytestreamManager.
+type BytestreamConfig struct {
+	// Decides whether to accept a stream someone else offers. It
+	// must not block. If it's nil, only expected streams are
+	// accepted.
+	Accept func(from JID, sid string) bool
+	// If non-nil, peers are offered direct connections to this
+	// listener, as Host and the listener's port.
+	Listener net.Listener
+	Host     string
+	// The proxies offered to peers. If it's nil, the server's
+	// proxies are discovered when they're first needed.
+	Proxies []Streamhost
+}
+
+// BytestreamManager is an extension which negotiates SOCKS5
+// bytestreams with other entities.
+type BytestreamManager struct {
+	Extension
+	// Streams offered by others and connected. If the channel isn't
+	// ready for a stream, it's closed.
+	Incoming <-chan *Bytestream
+	incoming chan *Bytestream
+	conf     BytestreamConfig
+	toServer chan Stanza
+	sendDone chan bool
+	listen   sync.Once
+	lock     sync.Mutex
+	cl       *Client
+	proxies  []Streamhost
+	expected map[sidKey]chan *Bytestream
+	// Direct connections awaited by Dial, by address.
+	direct map[string]chan net.Conn
+}
+
+// A SOCKS5 bytestream with a peer.
+type Bytestream struct {
+	net.Conn
+	Peer JID
+	Sid  string
+}
+
+// Creates a BytestreamManager, to be passed to NewClient among the
+// extensions.
+func NewBytestreamManager(conf BytestreamConfig) *BytestreamManager {
+	m := &BytestreamManager{conf: conf, proxies: conf.Proxies}
+	m.incoming = make(chan *Bytestream, 16)
+	m.Incoming = m.incoming
+	m.toServer = make(chan Stanza)
+	m.sendDone = make(chan bool)
+	m.expected = make(map[sidKey]chan *Bytestream)
+	m.direct = make(map[string]chan net.Conn)
+	m.StanzaTypes = BytestreamExt.StanzaTypes
+	m.Features = []string{NsBytestreams}
+	m.RecvFilter = m.recvFilter
+	m.SendFilter = m.sendFilter
+	m.Start = m.start
+	return m
+}
+
+func (m *BytestreamManager) start(cl *Client) {
+	m.lock.Lock()
+	m.cl = cl
+	m.lock.Unlock()
+	if m.conf.Listener != nil {
+		m.listen.Do(func() { go m.serve(m.conf.Listener) })
+	}
+}
+
+func (m *BytestreamManager) client() (*Client, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.cl == nil {
+		return nil, fmt.Errorf("bytestream manager not started")
+	}
+	return m.cl, nil
+}
+
+// Makes the manager accept a stream with the given id from the given
+// full JID, once, as when the stream was negotiated by another
+// protocol. The stream arrives on the returned channel rather than
+// on Incoming.
+func (m *BytestreamManager) Expect(from JID, sid string) <-chan *Bytestream {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ch := make(chan *Bytestream, 1)
+	m.expected[sidKey{from, sid}] = ch
+	return ch
+}
+
+// Accepts direct connections from peers until the listener is
+// closed.
+func (m *BytestreamManager) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go m.serveConn(conn)
+	}
+}
+
+func (m *BytestreamManager) serveConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(streamhostTimeout))
+	dst, err := socks5Accept(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	m.lock.Lock()
+	ch := m.direct[dst]
+	delete(m.direct, dst)
+	m.lock.Unlock()
+	if ch == nil {
+		socks5Reply(conn, dst, false)
+		conn.Close()
+		return
+	}
+	if err := socks5Reply(conn, dst, true); err != nil {
+		conn.Close()
+		ch <- nil
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	ch <- conn
+}
+
+// The streamhosts offered to peers.
+func (m *BytestreamManager) streamhosts(ctx context.Context,
+	cl *Client) []Streamhost {
+
+	var hosts []Streamhost
+	if l := m.conf.Listener; l != nil {
+		host, port, _ := net.SplitHostPort(l.Addr().String())
+		if m.conf.Host != "" {
+			host = m.conf.Host
+		}
+		p, _ := strconv.Atoi(port)
+		hosts = append(hosts, Streamhost{Jid: cl.Jid, Host: host,
+			Port: p})
+	}
+	m.lock.Lock()
+	proxies := m.proxies
+	m.lock.Unlock()
+	if proxies == nil {
+		proxies, _ = cl.BytestreamProxies(ctx)
+		if proxies == nil {
+			proxies = []Streamhost{}
+		}
+		m.lock.Lock()
+		m.proxies = proxies
+		m.lock.Unlock()
+	}
+	return append(hosts, proxies...)
+}
+
+// Returns the streamhosts the manager offers peers: the client
+// itself if there's a listener, and the proxies. It's for protocols
+// which negotiate bytestreams themselves, such as Jingle.
+func (m *BytestreamManager) Streamhosts(ctx context.Context) []Streamhost {
+	cl, err := m.client()
+	if err != nil {
+		return nil
+	}
+	return m.streamhosts(ctx, cl)
+}
+
+// Opens a stream to a full JID. The id must be unique between the
+// two entities. The peer connects to this client directly if it can,
+// or else to a proxy.
+func (m *BytestreamManager) Dial(ctx context.Context, to JID,
+	sid string) (*Bytestream, error) {
+
+	cl, err := m.client()
+	if err != nil {
+		return nil, err
+	}
+	dst := BytestreamAddr(sid, cl.Jid, to)
+	direct, cancel := m.AwaitDirect(dst)
+	defer cancel()
+
+	hosts := m.streamhosts(ctx, cl)
+	if len(hosts) == 0 {
+		return nil, errors.New("no streamhosts to offer")
+	}
+	iq := &Iq{Header: Header{To: to, Type: "set",
+		Nested: []interface{}{&BytestreamQuery{Sid: sid, Mode: "tcp",
+			Streamhosts: hosts}}}}
+	reply, err := cl.SendIq(ctx, iq)
+	if err != nil {
+		return nil, err
+	}
+	var used JID
+	for _, ele := range reply.Nested {
+		if q, ok := ele.(*BytestreamQuery); ok && q.StreamhostUsed != nil {
+			used = q.StreamhostUsed.Jid
+		}
+	}
+	if used == cl.Jid && m.conf.Listener != nil {
+		conn, err := WaitDirect(ctx, direct)
+		if err != nil {
+			return nil, err
+		}
+		return &Bytestream{Conn: conn, Peer: to, Sid: sid}, nil
+	}
+	for _, h := range hosts {
+		if h.Jid != used || h.Jid == cl.Jid {
+			continue
+		}
+		conn, err := DialStreamhost(ctx, h, dst)
+		if err != nil {
+			return nil, err
+		}
+		if err := cl.activateBytestream(ctx, h.Jid, sid, to); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return &Bytestream{Conn: conn, Peer: to, Sid: sid}, nil
+	}
+	return nil, fmt.Errorf("%s used unknown streamhost %q", to, used)
+}
+
+// Registers for a direct connection from a peer asking for the given
+// address, which WaitDirect then waits for. The returned function
+// stops waiting.
+func (m *BytestreamManager) AwaitDirect(dst string) (<-chan net.Conn,
+	func()) {
+
+	ch := make(chan net.Conn, 1)
+	m.lock.Lock()
+	m.direct[dst] = ch
+	m.lock.Unlock()
+	return ch, func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		if m.direct[dst] == ch {
+			delete(m.direct, dst)
+		}
+	}
+}
+
+// Waits for the direct connection AwaitDirect registered for.
+func WaitDirect(ctx context.Context, ch <-chan net.Conn) (net.Conn, error) {
+	select {
+	case conn := <-ch:
+		if conn == nil {
+			return nil, errors.New("direct connection failed")
+		}
+		return conn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Connects to a streamhost, and asks it for the address BytestreamAddr
+// gives.
+func DialStreamhost(ctx context.Context, h Streamhost,
+	dst string) (net.Conn, error) {
+
+	return socks5Connect(ctx, net.JoinHostPort(h.Host,
+		strconv.Itoa(h.Port)), dst)
+}
+
+// Asks a proxy to relay between the two connections it holds for a
+// stream.
+func (cl *Client) activateBytestream(ctx context.Context, proxy JID,
+	sid string, target JID) error {
+
+	iq := &Iq{Header: Header{To: proxy, Type: "set",
+		Nested: []interface{}{&BytestreamQuery{Sid: sid,
+			Activate: target}}}}
+	_, err := cl.SendIq(ctx, iq)
+	return err
+}
+
+// Asks a proxy to relay a stream negotiated by another protocol, once
+// both sides are connected to it.
+func (m *BytestreamManager) Activate(ctx context.Context, proxy JID,
+	sid string, target JID) error {
+
+	cl, err := m.client()
+	if err != nil {
+		return err
+	}
+	return cl.activateBytestream(ctx, proxy, sid, target)
+}
+
+// Tries the streamhosts a peer offers, in order, and reports which
+// one worked.
+func (m *BytestreamManager) connect(cl *Client, iq *Iq, q *BytestreamQuery,
+	incoming chan<- *Bytestream) {
+
+	reply := &Iq{Header: Header{To: iq.From, Id: iq.Id, Type: "error",
+		Error: stanzaError("cancel", "item-not-found")}}
+	dst := BytestreamAddr(q.Sid, iq.From, cl.Jid)
+	for _, h := range q.Streamhosts {
+		conn, err := DialStreamhost(context.Background(), h, dst)
+		if err != nil {
+			continue
+		}
+		bs := &Bytestream{Conn: conn, Peer: iq.From, Sid: q.Sid}
+		select {
+		case incoming <- bs:
+			reply = &Iq{Header: Header{To: iq.From, Id: iq.Id,
+				Type: "result", Nested: []interface{}{
+					&BytestreamQuery{Sid: q.Sid,
+						StreamhostUsed: &StreamhostUsed{
+							Jid: h.Jid}}}}}
+		default:
+			conn.Close()
+			reply.Error = stanzaError("wait", "resource-constraint")
+		}
+		break
+	}
+	select {
+	case m.toServer <- reply:
+	case <-m.sendDone:
+	}
+}
+
+// Returns where to deliver the stream a peer offers, or nil if the
+// offer is refused. Expected streams are accepted once.
+func (m *BytestreamManager) accepts(from JID, sid string) chan<- *Bytestream {
+	key := sidKey{from, sid}
+	m.lock.Lock()
+	expected := m.expected[key]
+	delete(m.expected, key)
+	m.lock.Unlock()
+	switch {
+	case expected != nil:
+		return expected
+	case m.conf.Accept != nil && m.conf.Accept(from, sid):
+		return m.incoming
+	}
+	return nil
+}
+
+func (m *BytestreamManager) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for stan := range in {
+		iq, ok := stan.(*Iq)
+		if !ok || iq.Type != "set" || len(iq.Nested) != 1 {
+			out <- stan
+			continue
+		}
+		q, ok := iq.Nested[0].(*BytestreamQuery)
+		if !ok || len(q.Streamhosts) == 0 {
+			out <- stan
+			continue
+		}
+		cl, err := m.client()
+		var incoming chan<- *Bytestream
+		if err == nil && q.Mode != "udp" {
+			incoming = m.accepts(iq.From, q.Sid)
+		}
+		if incoming == nil {
+			reply := &Iq{Header: Header{To: iq.From, Id: iq.Id,
+				Type:  "error",
+				Error: stanzaError("cancel", "not-acceptable")}}
+			select {
+			case m.toServer <- reply:
+			case <-m.sendDone:
+			}
+			continue
+		}
+		// Connecting may take a while.
+		go m.connect(cl, iq, q, incoming)
+	}
+}
+
+func (m *BytestreamManager) sendFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	defer close(m.sendDone)
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			out <- stan
+		case stan := <-m.toServer:
+			out <- stan
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package xmpp
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSocks5Handshake(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	done := make(chan error, 1)
+	go func() { done <- socks5Request(c, "abc") }()
+	dst, err := socks5Accept(s)
+	if err != nil {
+		t.Fatalf("socks5Accept: %v", err)
+	}
+	assertEquals(t, "abc", dst)
+	go socks5Reply(s, dst, false)
+	if err := <-done; err == nil {
+		t.Error("connect wasn't refused")
+	}
+}
+
+func TestBytestreamDirect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	send := make(chan Stanza, 1)
+	icl := &Client{Jid: "a@b.c/x", handlers: make(chan *callback, 1),
+		Send: send}
+	im := NewBytestreamManager(BytestreamConfig{Listener: l,
+		Proxies: []Streamhost{}})
+	im.Start(icl)
+
+	tm := NewBytestreamManager(BytestreamConfig{})
+	tm.Start(&Client{Jid: "d@b.c/y"})
+	recvIn := make(chan Stanza)
+	recvOut := make(chan Stanza, 1)
+	go tm.RecvFilter(recvIn, recvOut)
+	sendIn := make(chan Stanza)
+	sendOut := make(chan Stanza)
+	go tm.SendFilter(sendIn, sendOut)
+	defer close(sendIn)
+	defer close(recvIn)
+
+	// The target's answer to the initiator's offer is relayed back.
+	go func() {
+		for i := 0; i < 2; i++ {
+			h := <-icl.handlers
+			iq := (<-send).(*Iq)
+			iq.From = icl.Jid
+			recvIn <- iq
+			reply := (<-sendOut).(*Iq)
+			reply.Id = iq.Id
+			h.f(reply)
+		}
+	}()
+	if _, err := im.Dial(context.Background(), "d@b.c/y",
+		"s1"); err == nil {
+		t.Fatal("unexpected stream accepted")
+	}
+	expected := tm.Expect("a@b.c/x", "s1")
+	bs, err := im.Dial(context.Background(), "d@b.c/y", "s1")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer bs.Close()
+	in := <-expected
+	defer in.Close()
+	assertEquals(t, "a@b.c/x", string(in.Peer))
+	go bs.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(in, buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	assertEquals(t, "hello", string(buf))
+}
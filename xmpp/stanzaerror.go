@@ -0,0 +1,176 @@
+package xmpp
+
+// This file contains the defined conditions of stanza errors, RFC
+// 6120 section 8.3, and the construction of error replies.
+
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+// Values of the type attribute of a stanza error.
+const (
+	// Don't retry; the error can't be remedied.
+	ErrorCancel = "cancel"
+	// Proceed; the condition was only a warning.
+	ErrorContinue = "continue"
+	// Retry after changing the data sent.
+	ErrorModify = "modify"
+	// Retry after providing credentials.
+	ErrorAuth = "auth"
+	// Retry after waiting; the error is temporary.
+	ErrorWait = "wait"
+)
+
+// The defined conditions of stanza errors.
+const (
+	CondBadRequest            = "bad-request"
+	CondConflict              = "conflict"
+	CondFeatureNotImplemented = "feature-not-implemented"
+	CondForbidden             = "forbidden"
+	CondGone                  = "gone"
+	CondInternalServerError   = "internal-server-error"
+	CondItemNotFound          = "item-not-found"
+	CondJidMalformed          = "jid-malformed"
+	CondNotAcceptable         = "not-acceptable"
+	CondNotAllowed            = "not-allowed"
+	CondNotAuthorized         = "not-authorized"
+	CondPolicyViolation       = "policy-violation"
+	CondRecipientUnavailable  = "recipient-unavailable"
+	CondRedirect              = "redirect"
+	CondRegistrationRequired  = "registration-required"
+	CondRemoteServerNotFound  = "remote-server-not-found"
+	CondRemoteServerTimeout   = "remote-server-timeout"
+	CondResourceConstraint    = "resource-constraint"
+	CondServiceUnavailable    = "service-unavailable"
+	CondSubscriptionRequired  = "subscription-required"
+	CondUndefinedCondition    = "undefined-condition"
+	CondUnexpectedRequest     = "unexpected-request"
+)
+
+// The type RFC 6120 suggests for each defined condition.
+var conditionTypes = map[string]string{
+	CondBadRequest:            ErrorModify,
+	CondConflict:              ErrorCancel,
+	CondFeatureNotImplemented: ErrorCancel,
+	CondForbidden:             ErrorAuth,
+	CondGone:                  ErrorCancel,
+	CondInternalServerError:   ErrorCancel,
+	CondItemNotFound:          ErrorCancel,
+	CondJidMalformed:          ErrorModify,
+	CondNotAcceptable:         ErrorModify,
+	CondNotAllowed:            ErrorCancel,
+	CondNotAuthorized:         ErrorAuth,
+	CondPolicyViolation:       ErrorModify,
+	CondRecipientUnavailable:  ErrorWait,
+	CondRedirect:              ErrorModify,
+	CondRegistrationRequired:  ErrorAuth,
+	CondRemoteServerNotFound:  ErrorCancel,
+	CondRemoteServerTimeout:   ErrorWait,
+	CondResourceConstraint:    ErrorWait,
+	CondServiceUnavailable:    ErrorCancel,
+	CondSubscriptionRequired:  ErrorAuth,
+	CondUndefinedCondition:    ErrorCancel,
+	CondUnexpectedRequest:     ErrorWait,
+}
+
+// Creates a stanza error with one of the defined conditions, and
+// optionally some human-readable text. If typ is empty, the type RFC
+// 6120 suggests for the condition is used.
+func NewError(typ, condition, text string) *Error {
+	if typ == "" {
+		typ = conditionTypes[condition]
+		if typ == "" {
+			typ = ErrorCancel
+		}
+	}
+	er := &Error{Type: typ, Any: &Generic{
+		XMLName: xml.Name{Space: NsStanzas, Local: condition}}}
+	if text != "" {
+		er.Text = &Text{Chardata: text}
+	}
+	return er
+}
+
+// Returns a stanza error of the given type with one of the defined
+// conditions, such as item-not-found.
+func stanzaError(typ, condition string) *Error {
+	return NewError(typ, condition, "")
+}
+
+// Returns the defined condition of the error, or undefined-condition
+// if it doesn't have one.
+func (er *Error) Condition() string {
+	if er.Any != nil && er.Any.XMLName.Space == NsStanzas {
+		return er.Any.XMLName.Local
+	}
+	return CondUndefinedCondition
+}
+
+// Returns the error's human-readable text, if there is any.
+func (er *Error) Message() string {
+	if er.Text == nil {
+		return ""
+	}
+	return er.Text.Chardata
+}
+
+func (er *Error) Error() string {
+	s := fmt.Sprintf("%s (%s)", er.Condition(), er.Type)
+	if er.App != nil {
+		s += " " + er.App.XMLName.Space + " " + er.App.XMLName.Local
+	}
+	if msg := er.Message(); msg != "" {
+		s += ": " + msg
+	}
+	return s
+}
+
+// The defined condition and the application-specific one may come in
+// either order, and the text between them.
+func (er *Error) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var aux struct {
+		Type     string    `xml:"type,attr"`
+		By       string    `xml:"by,attr"`
+		Text     *Text     `xml:"urn:ietf:params:xml:ns:xmpp-stanzas text"`
+		Children []Generic `xml:",any"`
+	}
+	if err := d.DecodeElement(&aux, &start); err != nil {
+		return err
+	}
+	*er = Error{XMLName: start.Name, Type: aux.Type, By: aux.By,
+		Text: aux.Text}
+	for i := range aux.Children {
+		child := &aux.Children[i]
+		if child.XMLName.Space == NsStanzas && er.Any == nil {
+			er.Any = child
+		} else if er.App == nil {
+			er.App = child
+		}
+	}
+	return nil
+}
+
+// Returns the defined condition of a stanza error, such as
+// item-not-found, or the empty string if err isn't one.
+func errCondition(err error) string {
+	if er, ok := err.(*Error); ok && er != nil {
+		return er.Condition()
+	}
+	return ""
+}
+
+// Builds the error reply to a stanza: it goes back to the sender with
+// the same id, and carries the error.
+func ErrorReply(st Stanza, er *Error) Stanza {
+	h := st.GetHeader()
+	hdr := Header{To: h.From, From: h.To, Id: h.Id, Type: "error",
+		Lang: h.Lang, Error: er}
+	switch st.(type) {
+	case *Message:
+		return &Message{Header: hdr}
+	case *Presence:
+		return &Presence{Header: hdr}
+	}
+	return &Iq{Header: hdr}
+}
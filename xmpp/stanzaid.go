@@ -0,0 +1,84 @@
+package xmpp
+
+// This file contains support for unique and stable stanza ids,
+// XEP-0359.
+
+import (
+	"encoding/xml"
+	"reflect"
+)
+
+const NsSid = "urn:xmpp:sid:0"
+
+// An id assigned to a message by an entity which stored or relayed
+// it, such as the user's server or a multi-user chat room.
+type StanzaId struct {
+	XMLName xml.Name `xml:"urn:xmpp:sid:0 stanza-id"`
+	Id      string   `xml:"id,attr"`
+	By      JID      `xml:"by,attr"`
+}
+
+// An id assigned to a message by its sender, which survives
+// relaying.
+type OriginId struct {
+	XMLName xml.Name `xml:"urn:xmpp:sid:0 origin-id"`
+	Id      string   `xml:"id,attr"`
+}
+
+// StanzaIdExt may be included in the extensions passed to NewClient
+// to decode stanza and origin ids. It also gives the messages the
+// client sends origin ids, the same as their ids. Use Client.NextId
+// for those.
+var StanzaIdExt Extension = Extension{}
+
+func init() {
+	StanzaIdExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	sName := xml.Name{Space: NsSid, Local: "stanza-id"}
+	StanzaIdExt.StanzaTypes[sName] = reflect.TypeOf(StanzaId{})
+	oName := xml.Name{Space: NsSid, Local: "origin-id"}
+	StanzaIdExt.StanzaTypes[oName] = reflect.TypeOf(OriginId{})
+	StanzaIdExt.SendMiddleware = addOriginId
+}
+
+// Gives an outgoing message an origin id. The message is copied, so
+// the application's isn't changed.
+func addOriginId(st Stanza, next func(Stanza)) {
+	m, ok := st.(*Message)
+	if !ok || m.Id == "" || m.Type == "error" {
+		next(st)
+		return
+	}
+	if _, ok := m.OriginId(); ok {
+		next(st)
+		return
+	}
+	cp := *m
+	cp.Nested = append(cp.Nested[:len(cp.Nested):len(cp.Nested)],
+		&OriginId{Id: cp.Id})
+	next(&cp)
+}
+
+// Returns the stanza ids in a message, by the JID which assigned
+// each.
+func (m *Message) StanzaIds() map[JID]string {
+	var ids map[JID]string
+	for _, ele := range m.Nested {
+		if sid, ok := ele.(*StanzaId); ok {
+			if ids == nil {
+				ids = make(map[JID]string)
+			}
+			ids[sid.By] = sid.Id
+		}
+	}
+	return ids
+}
+
+// Returns the origin id of a message, if it has one.
+func (m *Message) OriginId() (string, bool) {
+	for _, ele := range m.Nested {
+		if oid, ok := ele.(*OriginId); ok {
+			return oid.Id, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,64 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNextId(t *testing.T) {
+	uuid := regexp.MustCompile(
+		`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	a, b := NextId(), NextId()
+	if !uuid.MatchString(a) || a == b {
+		t.Errorf("ids %s and %s", a, b)
+	}
+
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	var n int32
+	gen := IdGeneratorExt(func() string {
+		return "x" + strconv.Itoa(int(atomic.AddInt32(&n, 1)))
+	})
+	jid := JID("alice@b.c/pc")
+	cl, err := NewClientFromConn(s.Dial(), &jid, "secret", &tls.Config{},
+		[]Extension{gen}, Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn: %v", err)
+	}
+	defer cl.Close()
+	if atomic.LoadInt32(&n) == 0 {
+		t.Error("the session's iqs didn't use the generator")
+	}
+	if id := cl.NextId(); id[0] != 'x' {
+		t.Error("NextId didn't use the generator")
+	}
+}
+
+func TestAddOriginId(t *testing.T) {
+	var out []Stanza
+	next := func(st Stanza) { out = append(out, st) }
+	m := &Message{Header: Header{To: "a@b.c", Id: "m1"}}
+	addOriginId(m, next)
+	sent := out[0].(*Message)
+	if id, ok := sent.OriginId(); !ok || id != "m1" {
+		t.Errorf("origin id %q", id)
+	}
+	if len(m.Nested) != 0 {
+		t.Error("the application's message was changed")
+	}
+
+	// An origin id isn't added twice, or to messages without ids.
+	addOriginId(sent, next)
+	if out[1] != sent {
+		t.Error("replaced a message which had an origin id")
+	}
+	bare := &Message{Header: Header{To: "a@b.c"}}
+	addOriginId(bare, next)
+	if out[2] != bare {
+		t.Error("gave an origin id to a message without an id")
+	}
+}
@@ -0,0 +1,76 @@
+package xmpp
+
+// This file contains the hooks through which a client's traffic can
+// be measured.
+
+import "time"
+
+// A StatsCollector is told about a client's traffic, so that it can
+// be exported as metrics, to Prometheus or expvar for example. Its
+// methods are called from the client's goroutines, so they must be
+// safe for concurrent use and mustn't block.
+type StatsCollector interface {
+	// A stanza was sent or received. The kind is message,
+	// presence or iq, and typ is its type attribute.
+	Stanza(outbound bool, kind, typ string)
+	// Bytes were written to or read from the connection.
+	Bytes(outbound bool, n int)
+	// The reply to an iq arrived this long after it was sent.
+	IqRoundTrip(d time.Duration)
+	// The session was resumed, or a new one started, after the
+	// connection was lost.
+	Reconnected()
+}
+
+// Reports the client's traffic to sc.
+func StatsExt(sc StatsCollector) Extension {
+	return Extension{option: func(o *options) {
+		o.stats = sc
+	}}
+}
+
+// Reports a stanza which was sent or received.
+func (cl *Client) countStanza(outbound bool, st Stanza) {
+	if cl.opts.stats == nil {
+		return
+	}
+	var kind string
+	switch st.(type) {
+	case *Message:
+		kind = "message"
+	case *Presence:
+		kind = "presence"
+	case *Iq:
+		kind = "iq"
+	default:
+		return
+	}
+	cl.opts.stats.Stanza(outbound, kind, st.GetHeader().Type)
+}
+
+func (cl *Client) countBytes(outbound bool, n int) {
+	if cl.opts.stats != nil && n > 0 {
+		cl.opts.stats.Bytes(outbound, n)
+	}
+}
+
+func (cl *Client) countReconnect() {
+	if cl.opts.stats != nil {
+		cl.opts.stats.Reconnected()
+	}
+}
+
+// Wraps a callback for the reply to an iq, so that the round trip is
+// timed.
+func (cl *Client) timeCallback(f func(Stanza)) func(Stanza) {
+	if cl.opts.stats == nil {
+		return f
+	}
+	sent := time.Now()
+	return func(st Stanza) {
+		if _, ok := st.(*Iq); ok {
+			cl.opts.stats.IqRoundTrip(time.Since(sent))
+		}
+		f(st)
+	}
+}
@@ -0,0 +1,76 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testStats struct {
+	lock       sync.Mutex
+	stanzas    map[string]int
+	in, out    int
+	roundTrips int
+}
+
+func (ts *testStats) Stanza(outbound bool, kind, typ string) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	dir := "in "
+	if outbound {
+		dir = "out "
+	}
+	ts.stanzas[dir+kind+" "+typ]++
+}
+
+func (ts *testStats) Bytes(outbound bool, n int) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if outbound {
+		ts.out += n
+	} else {
+		ts.in += n
+	}
+}
+
+func (ts *testStats) IqRoundTrip(d time.Duration) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.roundTrips++
+}
+
+func (ts *testStats) Reconnected() {}
+
+func TestStats(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	ts := &testStats{stanzas: make(map[string]int)}
+	jid := JID("alice@b.c/pc")
+	cl, err := NewClientFromConn(s.Dial(), &jid, "secret", &tls.Config{},
+		[]Extension{StatsExt(ts)}, Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn: %v", err)
+	}
+	defer cl.Close()
+	cl.Send <- &Message{Header: Header{To: "b.c", Type: "chat"},
+		Body: []Text{{Chardata: "echo"}}}
+	recvMessage(t, cl)
+
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	for _, k := range []string{"out message chat", "in message chat",
+		"out iq get", "in iq result", "out presence "} {
+		if ts.stanzas[k] == 0 {
+			t.Errorf("no %q in %v", k, ts.stanzas)
+		}
+	}
+	if ts.in == 0 || ts.out == 0 {
+		t.Errorf("bytes %d in, %d out", ts.in, ts.out)
+	}
+	// Binding the resource and starting the session.
+	if ts.roundTrips < 2 {
+		t.Errorf("%d round trips", ts.roundTrips)
+	}
+}
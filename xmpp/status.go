@@ -56,12 +56,20 @@ func (s Status) Fatal() bool {
 type statmgr struct {
 	newStatus   chan Status
 	newlistener chan chan Status
+	// Receives once the listeners have a new status, so that
+	// setStatus returns only after that.
+	notified chan bool
+	// Closed when the session ends. Listeners added after that get
+	// a closed channel, and new statuses are dropped.
+	closing chan bool
 }
 
 func newStatmgr(client chan<- Status) *statmgr {
 	s := statmgr{}
 	s.newStatus = make(chan Status)
 	s.newlistener = make(chan chan Status)
+	s.notified = make(chan bool)
+	s.closing = make(chan bool)
 	go s.manager(client)
 	return &s
 }
@@ -87,13 +95,17 @@ func (s *statmgr) manager(client chan<- Status) {
 			for _, l := range listeners {
 				sendToListener(l, stat)
 			}
+			select {
+			case s.notified <- true:
+			case <-s.closing:
+				return
+			}
 			if client != nil && stat != StatusShutdown {
 				client <- stat
 			}
-		case l, ok := <-s.newlistener:
-			if !ok {
-				return
-			}
+		case <-s.closing:
+			return
+		case l := <-s.newlistener:
 			defer close(l)
 			sendToListener(l, stat)
 			listeners = append(listeners, l)
@@ -116,17 +128,29 @@ func (cl *Client) setStatus(stat Status) {
 }
 
 func (s *statmgr) setStatus(stat Status) {
-	s.newStatus <- stat
+	select {
+	case s.newStatus <- stat:
+	case <-s.closing:
+		return
+	}
+	select {
+	case <-s.notified:
+	case <-s.closing:
+	}
 }
 
 func (s *statmgr) newListener() <-chan Status {
 	l := make(chan Status, 1)
-	s.newlistener <- l
+	select {
+	case s.newlistener <- l:
+	case <-s.closing:
+		close(l)
+	}
 	return l
 }
 
 func (s *statmgr) close() {
-	close(s.newlistener)
+	close(s.closing)
 }
 
 func (s *statmgr) awaitStatus(waitFor Status) error {
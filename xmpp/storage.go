@@ -0,0 +1,204 @@
+package xmpp
+
+// This file contains the storage through which clients keep what
+// they've learned between runs of a program: the roster and its
+// version, what caps stand for, and how far message archives have
+// been caught up with.
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Keeps values by key, within namespaces which keep the values of
+// different kinds apart. Methods may be called from several
+// goroutines at once.
+type Storage interface {
+	// Returns the value of a key, and whether there is one.
+	Get(ns, key string) (value []byte, ok bool, err error)
+	Set(ns, key string, value []byte) error
+	// Deleting a key which has no value isn't an error.
+	Delete(ns, key string) error
+}
+
+// The namespaces of Storage which the client uses. Keys in the
+// roster and archive namespaces start with the account's bare JID.
+const (
+	// Keyed by the account, the roster and its version.
+	StorageRoster = "roster"
+	// Keyed by caps ver, the disco#info it stands for.
+	StorageCaps = "caps"
+	// Keyed by the account and the archive, the id of the last
+	// message ArchiveManager.Sync fetched.
+	StorageArchive = "mam"
+	// Keyed by OutboxConfig.Key, the messages an Outbox holds.
+	StorageOutbox = "outbox"
+	// Keyed by the server's domain, the strongest SASL mechanism it
+	// has offered.
+	StorageSasl = "sasl"
+)
+
+// Returns an extension which keeps the client's state in a Storage:
+// the roster, unless RosterCacheExt gives a cache of its own, so that
+// servers which version it only send what changed, what the caps the
+// client sees stand for, so that they needn't be looked up again,
+// how far ArchiveManager.Sync has caught up with each archive, and
+// the strongest SASL mechanism each server has offered, so that a
+// downgrade is noticed.
+// Clients of one ClientManager share what caps stand for, so they
+// should be given the same Storage.
+func StorageExt(s Storage) Extension {
+	return Extension{option: func(o *options) {
+		o.storage = s
+	}}
+}
+
+// Returns the roster cache of an account.
+func (o *options) rosterCacheFor(account JID) RosterCache {
+	if o.rosterCache != nil || o.storage == nil {
+		return o.rosterCache
+	}
+	return &storedRoster{o.storage, string(account.Bare())}
+}
+
+// A RosterCache which keeps the roster in a Storage, as the result of
+// a roster query with the version.
+type storedRoster struct {
+	s   Storage
+	key string
+}
+
+func (sr *storedRoster) LoadRoster() (string, []RosterItem) {
+	buf, ok, err := sr.s.Get(StorageRoster, sr.key)
+	if err != nil || !ok {
+		return "", nil
+	}
+	var q RosterQuery
+	if err := xml.Unmarshal(buf, &q); err != nil || q.Ver == nil {
+		return "", nil
+	}
+	return *q.Ver, q.Item
+}
+
+func (sr *storedRoster) SaveRoster(ver string, items []RosterItem) {
+	buf, err := xml.Marshal(RosterQuery{Ver: &ver, Item: items})
+	if err == nil {
+		sr.s.Set(StorageRoster, sr.key, buf)
+	}
+}
+
+// A Storage which keeps values in memory, so they last as long as the
+// process.
+type MemoryStorage struct {
+	lock sync.Mutex
+	m    map[string]map[string][]byte
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{m: make(map[string]map[string][]byte)}
+}
+
+func (ms *MemoryStorage) Get(ns, key string) ([]byte, bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	v, ok := ms.m[ns][key]
+	return append([]byte(nil), v...), ok, nil
+}
+
+func (ms *MemoryStorage) Set(ns, key string, value []byte) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if ms.m[ns] == nil {
+		ms.m[ns] = make(map[string][]byte)
+	}
+	ms.m[ns][key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (ms *MemoryStorage) Delete(ns, key string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.m[ns], key)
+	return nil
+}
+
+// A Storage which keeps each value in a file of its own, in a
+// directory for each namespace. It's simple rather than fast, as an
+// example of a Storage; a program with many keys might rather use a
+// database.
+type FileStorage struct {
+	dir string
+}
+
+// Returns a FileStorage which keeps its files under dir. The
+// directory is created when the first value is set.
+func NewFileStorage(dir string) *FileStorage {
+	return &FileStorage{dir: dir}
+}
+
+func (s *FileStorage) path(ns, key string) string {
+	return filepath.Join(s.dir, fileName(ns), fileName(key))
+}
+
+// Keys may hold any characters, such as the slashes of full JIDs and
+// caps vers, so they're escaped in file names. Neither may a name
+// start with a dot, which would be a temporary file, or "..", or be
+// empty.
+func fileName(key string) string {
+	name := url.PathEscape(key)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	if name == "" {
+		name = "%"
+	}
+	return name
+}
+
+func (s *FileStorage) Get(ns, key string) ([]byte, bool, error) {
+	buf, err := os.ReadFile(s.path(ns, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return buf, true, nil
+}
+
+// Values are written to a temporary file which then replaces the old
+// one, so that a crash can't leave half a value.
+func (s *FileStorage) Set(ns, key string, value []byte) error {
+	p := s.path(ns, key)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(value)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (s *FileStorage) Delete(ns, key string) error {
+	err := os.Remove(s.path(ns, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,163 @@
+package xmpp
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestStorages(t *testing.T) {
+	for name, s := range map[string]Storage{
+		"memory": NewMemoryStorage(),
+		"file":   NewFileStorage(t.TempDir()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, ok, err := s.Get("ns", "k"); ok || err != nil {
+				t.Fatalf("Get of nothing: %v %v", ok, err)
+			}
+			for _, key := range []string{"a@b.c/r", "..", ".x", "",
+				"a b"} {
+				if err := s.Set("ns", key, []byte(key+"!")); err != nil {
+					t.Fatalf("Set %q: %v", key, err)
+				}
+			}
+			for _, key := range []string{"a@b.c/r", "..", ".x", "",
+				"a b"} {
+				v, ok, err := s.Get("ns", key)
+				if !ok || err != nil {
+					t.Fatalf("Get %q: %v %v", key, ok, err)
+				}
+				assertEquals(t, key+"!", string(v))
+			}
+			if _, ok, _ := s.Get("other", "a b"); ok {
+				t.Errorf("namespaces not apart")
+			}
+			s.Set("ns", "k", []byte("1"))
+			s.Set("ns", "k", []byte("2"))
+			v, _, _ := s.Get("ns", "k")
+			assertEquals(t, "2", string(v))
+			if err := s.Delete("ns", "k"); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if err := s.Delete("ns", "k"); err != nil {
+				t.Fatalf("Delete again: %v", err)
+			}
+			if _, ok, _ := s.Get("ns", "k"); ok {
+				t.Errorf("deleted key still there")
+			}
+		})
+	}
+}
+
+func TestStorageRoster(t *testing.T) {
+	s := NewFileStorage(t.TempDir())
+	o := newOptions([]Extension{StorageExt(s)})
+	cache := o.rosterCacheFor("me@b.c/r")
+	if ver, items := cache.LoadRoster(); ver != "" || items != nil {
+		t.Fatalf("empty storage has %q %v", ver, items)
+	}
+	cache.SaveRoster("v1", []RosterItem{{Jid: "al@b.c", Name: "Al",
+		Group: []string{"Friends"}}})
+
+	// Another run of the program, and another resource, finds it.
+	o = newOptions([]Extension{StorageExt(NewFileStorage(s.dir))})
+	ver, items := o.rosterCacheFor("me@b.c/s").LoadRoster()
+	assertEquals(t, "v1", ver)
+	if len(items) != 1 || items[0].Jid != "al@b.c" ||
+		items[0].Name != "Al" || items[0].Group[0] != "Friends" {
+		t.Errorf("items %+v", items)
+	}
+	if _, items := o.rosterCacheFor("else@b.c").LoadRoster(); items != nil {
+		t.Errorf("another account's roster: %v", items)
+	}
+
+	// A cache of its own is preferred.
+	own := &MemoryRosterCache{}
+	o = newOptions([]Extension{StorageExt(s), RosterCacheExt(own)})
+	if o.rosterCacheFor("me@b.c") != own {
+		t.Errorf("cache not preferred")
+	}
+	o = newOptions(nil)
+	if o.rosterCacheFor("me@b.c") != nil {
+		t.Errorf("cache without storage")
+	}
+}
+
+func TestStorageCaps(t *testing.T) {
+	s := NewMemoryStorage()
+	v := newCapsVers()
+	v.useStorage(s)
+	di := &DiscoInfo{Identities: []DiscoIdentity{{Category: "client",
+		Type: "pc", Name: "x"}}, Features: []DiscoFeature{{Var: NsCaps}}}
+	v.put("ver1", di)
+
+	v = newCapsVers()
+	if v.get("ver1") != nil {
+		t.Fatalf("known without storage")
+	}
+	v.useStorage(s)
+	got := v.get("ver1")
+	if got == nil || len(got.Identities) != 1 ||
+		got.Identities[0].Name != "x" || got.Features[0].Var != NsCaps {
+		t.Fatalf("got %+v", got)
+	}
+	if v.get("ver2") != nil {
+		t.Errorf("unknown ver found")
+	}
+}
+
+func TestArchiveSync(t *testing.T) {
+	s := NewMemoryStorage()
+	send := make(chan Stanza, 1)
+	cl := &Client{Jid: "me@b.c/r", handlers: make(chan *callback, 1),
+		Send: send}
+	cl.opts.storage = s
+	am := NewArchiveManager()
+	am.Start(cl)
+	recvIn := make(chan Stanza)
+	recvOut := make(chan Stanza, 10)
+	go am.RecvFilter(recvIn, recvOut)
+	defer close(recvIn)
+
+	// Plays an archive which has a page of messages after every id.
+	afters := make(chan string, 2)
+	go func() {
+		for n := 0; n < 2; n++ {
+			h := <-cl.handlers
+			iq := (<-send).(*Iq)
+			q := iq.Nested[0].(*MamQuery)
+			after := ""
+			if q.Form != nil {
+				after = q.Form.Values("after-id")[0]
+			}
+			afters <- after
+			for i := 1; i <= 2; i++ {
+				recvIn <- &Message{Header: Header{
+					From: "room@muc.b.c",
+					Nested: []interface{}{&MamResult{
+						QueryId:   q.QueryId,
+						Id:        fmt.Sprintf("%s-%d", after, i),
+						Forwarded: Forwarded{Message: &Message{}},
+					}}}}
+			}
+			reply := &Iq{Header: Header{Id: iq.Id, Type: "result",
+				Nested: []interface{}{&MamFin{Complete: true,
+					Set: &RsmSet{}}}}}
+			h.f(reply)
+			recvIn <- reply
+		}
+	}()
+
+	for i, last := range []string{"-2", "-2-2"} {
+		q := am.Sync(context.Background(), "room@muc.b.c",
+			ArchiveFilter{})
+		for range q.Messages {
+		}
+		if err := q.Err(); err != nil {
+			t.Fatalf("Err: %v", err)
+		}
+		assertEquals(t, []string{"", "-2"}[i], <-afters)
+		id, _, _ := s.Get(StorageArchive, "me@b.c room@muc.b.c")
+		assertEquals(t, last, string(id))
+	}
+}
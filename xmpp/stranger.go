@@ -0,0 +1,297 @@
+package xmpp
+
+// This file contains a filter which protects the client from
+// messages and subscription requests sent by strangers.
+
+import (
+	"strings"
+	"sync"
+)
+
+// What to do with a stanza from a stranger.
+type StrangerAction int
+
+const (
+	// Pass it on as usual.
+	StrangerAllow StrangerAction = iota
+	// Discard it.
+	StrangerDrop
+	// Deliver it on StrangerFilter.Quarantined instead of
+	// Client.Recv.
+	StrangerQuarantine
+	// Hold it, and send the stranger a question. If they answer
+	// correctly, they're no longer a stranger, and what was held is
+	// passed on.
+	StrangerChallenge
+)
+
+// Configures a StrangerFilter.
+type StrangerPolicy struct {
+	// The treatment of chat and normal messages.
+	Messages StrangerAction
+	// The treatment of subscription requests.
+	Subscriptions StrangerAction
+	// Users at these domains are never strangers.
+	AllowDomains []string
+	// The question sent with StrangerChallenge, and the expected
+	// answer. Answers are compared ignoring case and surrounding
+	// space.
+	Challenge, Answer string
+	// How many stanzas to hold for each challenged stranger. Later
+	// ones are dropped. Zero means 10.
+	HoldLimit int
+	// How many challenged strangers to hold stanzas for at once.
+	// When there are more, the one challenged longest ago is
+	// forgotten, and asked again if they write again. Zero means
+	// 100.
+	MaxStrangers int
+}
+
+// StrangerFilter is an extension which applies a StrangerPolicy to
+// incoming messages and subscription requests from JIDs which aren't
+// in the roster. Entities without a node part (servers and
+// services), the user's own account, and anyone the client has sent
+// a message or directed presence to are not strangers, so replies
+// from multi-user chat rooms and services aren't affected.
+type StrangerFilter struct {
+	Extension
+	// Stanzas quarantined by the policy. If the application doesn't
+	// keep up, they're discarded.
+	Quarantined <-chan Stanza
+	quarantined chan Stanza
+	policy      StrangerPolicy
+	toServer    chan Stanza
+	sendDone    chan bool
+	lock        sync.Mutex
+	// The user's own JID, once the session is running, before the
+	// roster arrives.
+	jid JID
+	// Bare JIDs in the roster, or otherwise known.
+	roster  map[JID]bool
+	allowed map[JID]bool
+	// Stanzas held from challenged strangers, and the strangers in
+	// the order they were challenged.
+	held      map[JID][]Stanza
+	heldOrder []JID
+}
+
+// Creates a StrangerFilter, to be passed to NewClient among the
+// extensions.
+func NewStrangerFilter(policy StrangerPolicy) *StrangerFilter {
+	if policy.HoldLimit == 0 {
+		policy.HoldLimit = 10
+	}
+	if policy.MaxStrangers == 0 {
+		policy.MaxStrangers = 100
+	}
+	sf := &StrangerFilter{policy: policy}
+	sf.quarantined = make(chan Stanza, 16)
+	sf.Quarantined = sf.quarantined
+	sf.toServer = make(chan Stanza)
+	sf.sendDone = make(chan bool)
+	sf.roster = make(map[JID]bool)
+	sf.allowed = make(map[JID]bool)
+	sf.held = make(map[JID][]Stanza)
+	sf.RecvFilter = sf.recvFilter
+	sf.SendFilter = sf.sendFilter
+	sf.BeforePresence = sf.attach
+	return sf
+}
+
+func (sf *StrangerFilter) attach(cl *Client) {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	sf.jid = cl.Jid
+	sf.allowed[cl.Jid.Bare()] = true
+}
+
+// Stops treating a JID as a stranger. Anything held from it is
+// passed on along with the next stanza it sends.
+func (sf *StrangerFilter) Allow(jid JID) {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	sf.allowed[jid.Bare()] = true
+}
+
+func (sf *StrangerFilter) known(jid JID) bool {
+	bare := jid.Bare()
+	if jid.Node() == "" || sf.roster[bare] || sf.allowed[bare] {
+		return true
+	}
+	for _, d := range sf.policy.AllowDomains {
+		if strings.EqualFold(d, jid.Domain()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (sf *StrangerFilter) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	defer close(sf.quarantined)
+	for stan := range in {
+		pass, q := sf.filter(stan)
+		if q != nil {
+			select {
+			case sf.toServer <- q:
+			case <-sf.sendDone:
+			}
+		}
+		for _, st := range pass {
+			out <- st
+		}
+	}
+}
+
+// Applies the policy to one incoming stanza. Returns what should be
+// passed on, and the challenge to send, if any.
+func (sf *StrangerFilter) filter(stan Stanza) ([]Stanza, *Message) {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	action := StrangerAllow
+	switch st := stan.(type) {
+	case *Iq:
+		sf.rosterUpdate(st)
+	case *Message:
+		switch st.Type {
+		case "", "normal", "chat":
+			action = sf.policy.Messages
+		}
+	case *Presence:
+		if st.Type == "subscribe" {
+			action = sf.policy.Subscriptions
+		}
+	}
+	from := stan.GetHeader().From
+	if from == "" || sf.known(from) {
+		// Deliver anything which was held first.
+		res := sf.held[from.Bare()]
+		sf.release(from.Bare())
+		return append(res, stan), nil
+	}
+	switch action {
+	case StrangerDrop:
+		return nil, nil
+	case StrangerQuarantine:
+		select {
+		case sf.quarantined <- stan:
+		default:
+		}
+		return nil, nil
+	case StrangerChallenge:
+		return sf.challenge(from, stan)
+	}
+	return []Stanza{stan}, nil
+}
+
+// Holds a stranger's stanza, unless it's the answer to our
+// challenge.
+func (sf *StrangerFilter) challenge(from JID, stan Stanza) ([]Stanza,
+	*Message) {
+
+	bare := from.Bare()
+	held, asked := sf.held[bare]
+	if m, ok := stan.(*Message); ok && asked {
+		ans := strings.TrimSpace(firstText(m.Body))
+		if strings.EqualFold(ans, strings.TrimSpace(sf.policy.Answer)) {
+			sf.allowed[bare] = true
+			sf.release(bare)
+			return held, nil
+		}
+	}
+	if !asked {
+		// A flood from many JIDs mustn't grow without limit.
+		if len(sf.heldOrder) >= sf.policy.MaxStrangers {
+			sf.release(sf.heldOrder[0])
+		}
+		sf.heldOrder = append(sf.heldOrder, bare)
+	}
+	if len(held) < sf.policy.HoldLimit {
+		sf.held[bare] = append(held, stan)
+	}
+	if asked {
+		return nil, nil
+	}
+	q := &Message{Header: Header{To: from, Type: "chat", Id: NextId()},
+		Body: []Text{{Chardata: sf.policy.Challenge}}}
+	return nil, q
+}
+
+// Forgets a challenged stranger.
+func (sf *StrangerFilter) release(bare JID) {
+	if _, ok := sf.held[bare]; !ok {
+		return
+	}
+	delete(sf.held, bare)
+	for i, jid := range sf.heldOrder {
+		if jid == bare {
+			sf.heldOrder = append(sf.heldOrder[:i],
+				sf.heldOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// Keeps track of the roster from the server's results and pushes.
+// Only the user's own account may change the roster; a stranger
+// could otherwise push an item naming themselves.
+func (sf *StrangerFilter) rosterUpdate(iq *Iq) {
+	if iq.Type != "result" && iq.Type != "set" {
+		return
+	}
+	if iq.From != "" && iq.From != sf.jid.Bare() {
+		return
+	}
+	for _, ele := range iq.Nested {
+		rq, ok := ele.(*RosterQuery)
+		if !ok {
+			continue
+		}
+		for _, item := range rq.Item {
+			if item.Subscription == "remove" {
+				delete(sf.roster, item.Jid.Bare())
+			} else {
+				sf.roster[item.Jid.Bare()] = true
+			}
+		}
+	}
+}
+
+// Remembers who the client writes to, and sends challenges.
+func (sf *StrangerFilter) sendFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	defer close(sf.sendDone)
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			sf.sent(stan)
+			out <- stan
+		case stan := <-sf.toServer:
+			out <- stan
+		}
+	}
+}
+
+func (sf *StrangerFilter) sent(stan Stanza) {
+	to := stan.GetHeader().To
+	if to == "" {
+		return
+	}
+	switch st := stan.(type) {
+	case *Message:
+	case *Presence:
+		switch st.Type {
+		case "", "subscribe", "subscribed":
+		default:
+			return
+		}
+	default:
+		return
+	}
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	sf.allowed[to.Bare()] = true
+}
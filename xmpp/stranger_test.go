@@ -0,0 +1,119 @@
+package xmpp
+
+import (
+	"testing"
+)
+
+func TestStrangerFilter(t *testing.T) {
+	sf := NewStrangerFilter(StrangerPolicy{Messages: StrangerChallenge,
+		Subscriptions: StrangerQuarantine,
+		AllowDomains:  []string{"friends.org"},
+		Challenge:     "2+2?", Answer: "4"})
+	recvIn := make(chan Stanza)
+	recvOut := make(chan Stanza)
+	go sf.RecvFilter(recvIn, recvOut)
+	sendIn := make(chan Stanza)
+	sendOut := make(chan Stanza)
+	go sf.SendFilter(sendIn, sendOut)
+	defer close(sendIn)
+
+	msg := func(from, body string) *Message {
+		return &Message{Header: Header{From: JID(from), Type: "chat"},
+			Body: []Text{{Chardata: body}}}
+	}
+
+	roster := &Iq{Header: Header{Type: "result", Nested: []interface{}{
+		&RosterQuery{Item: []RosterItem{{Jid: "pal@b.c"}}}}}}
+	recvIn <- roster
+	<-recvOut
+
+	m := msg("pal@b.c/x", "hi")
+	recvIn <- m
+	if st := <-recvOut; st != m {
+		t.Errorf("contact's message not passed: %v", st)
+	}
+	m = msg("al@friends.org/x", "hi")
+	recvIn <- m
+	if st := <-recvOut; st != m {
+		t.Errorf("allowed domain's message not passed: %v", st)
+	}
+
+	// Only the account's own roster pushes count.
+	recvIn <- &Iq{Header: Header{From: "spam@x.y/z", Type: "set",
+		Nested: []interface{}{&RosterQuery{Item: []RosterItem{
+			{Jid: "spam@x.y"}}}}}}
+	<-recvOut
+
+	sub := &Presence{Header: Header{From: "spam@x.y", Type: "subscribe"}}
+	recvIn <- sub
+	if st := <-sf.Quarantined; st != sub {
+		t.Errorf("subscription not quarantined: %v", st)
+	}
+
+	spam := msg("spam@x.y/z", "buy")
+	go func() { recvIn <- spam }()
+	q := (<-sendOut).(*Message)
+	assertEquals(t, "spam@x.y/z", string(q.To))
+	assertEquals(t, "2+2?", q.Body[0].Chardata)
+	recvIn <- msg("spam@x.y/z", "5")
+	recvIn <- msg("spam@x.y/z", " 4 ")
+	if st := <-recvOut; st != spam {
+		t.Errorf("held message not released: %v", st)
+	}
+	// The wrong answer was held too.
+	if st := (<-recvOut).(*Message); st.Body[0].Chardata != "5" {
+		t.Errorf("got %v", st)
+	}
+
+	// Writing to someone makes them known.
+	sendIn <- &Message{Header: Header{To: "new@x.y/z"}}
+	<-sendOut
+	m = msg("new@x.y/z", "hello")
+	recvIn <- m
+	if st := <-recvOut; st != m {
+		t.Errorf("correspondent's message not passed: %v", st)
+	}
+
+	close(recvIn)
+	for _ = range recvOut {
+	}
+}
+
+func TestStrangerFilterLimit(t *testing.T) {
+	sf := NewStrangerFilter(StrangerPolicy{Messages: StrangerChallenge,
+		Challenge: "2+2?", Answer: "4", MaxStrangers: 2})
+	for _, from := range []JID{"a@x.y", "b@x.y", "c@x.y"} {
+		_, q := sf.filter(&Message{Header: Header{From: from}})
+		if q == nil {
+			t.Errorf("%s not challenged", from)
+		}
+	}
+	if len(sf.held) != 2 || sf.held["a@x.y"] != nil {
+		t.Errorf("held %v", sf.held)
+	}
+	// The forgotten stranger is asked again.
+	if _, q := sf.filter(&Message{Header: Header{From: "a@x.y"}}); q == nil {
+		t.Error("a@x.y not challenged again")
+	}
+}
+
+func TestStrangerFilterRosterFrom(t *testing.T) {
+	sf := NewStrangerFilter(StrangerPolicy{Messages: StrangerQuarantine})
+	in := make(chan Stanza)
+	out := make(chan Stanza)
+	go sf.RecvFilter(in, out)
+	defer close(in)
+	// The client learns who it is before it requests the roster,
+	// whose result the server may stamp with the user's bare JID.
+	sf.BeforePresence(&Client{Jid: "alice@b.c/pc"})
+	in <- &Iq{Header: Header{From: "alice@b.c", Type: "result",
+		Nested: []interface{}{&RosterQuery{Item: []RosterItem{
+			{Jid: "pal@b.c"}}}}}}
+	<-out
+
+	m := &Message{Header: Header{From: "pal@b.c/x", Type: "chat"}}
+	in <- m
+	if st := <-out; st != m {
+		t.Errorf("contact's message not passed: %v", st)
+	}
+}
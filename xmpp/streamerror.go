@@ -0,0 +1,166 @@
+package xmpp
+
+// This file contains stream errors, RFC 6120 section 4.9, which end
+// the session.
+
+import "encoding/xml"
+
+// The defined conditions of stream errors.
+const (
+	StreamBadFormat              = "bad-format"
+	StreamBadNamespacePrefix     = "bad-namespace-prefix"
+	StreamConflict               = "conflict"
+	StreamConnectionTimeout      = "connection-timeout"
+	StreamHostGone               = "host-gone"
+	StreamHostUnknown            = "host-unknown"
+	StreamImproperAddressing     = "improper-addressing"
+	StreamInternalServerError    = "internal-server-error"
+	StreamInvalidFrom            = "invalid-from"
+	StreamInvalidNamespace       = "invalid-namespace"
+	StreamInvalidXml             = "invalid-xml"
+	StreamNotAuthorized          = "not-authorized"
+	StreamNotWellFormed          = "not-well-formed"
+	StreamPolicyViolation        = "policy-violation"
+	StreamRemoteConnectionFailed = "remote-connection-failed"
+	StreamReset                  = "reset"
+	StreamResourceConstraint     = "resource-constraint"
+	StreamRestrictedXml          = "restricted-xml"
+	StreamSeeOtherHost           = "see-other-host"
+	StreamSystemShutdown         = "system-shutdown"
+	StreamUndefinedCondition     = "undefined-condition"
+	StreamUnsupportedEncoding    = "unsupported-encoding"
+	StreamUnsupportedFeature     = "unsupported-feature"
+	StreamUnsupportedStanzaType  = "unsupported-stanza-type"
+	StreamUnsupportedVersion     = "unsupported-version"
+)
+
+// StreamError is the error a session ends with when the server sends
+// a stream error.
+type StreamError struct {
+	// The defined condition, such as StreamConflict when another
+	// session bound the same resource.
+	Condition string
+	// Human-readable text, if the server gave any.
+	Text string
+	// For StreamSeeOtherHost, the host the client should connect
+	// to instead, with an optional port.
+	Host string
+	// An application-specific condition, if present.
+	App *Generic
+}
+
+var _ error = &StreamError{}
+
+func (se *StreamError) Error() string {
+	s := "stream error: " + se.Condition
+	if se.Host != "" {
+		s += " " + se.Host
+	}
+	if se.Text != "" {
+		s += ": " + se.Text
+	}
+	return s
+}
+
+// Servers may put an application-specific condition before the defined
+// one, so the children are told apart by namespace.
+func (se *streamError) UnmarshalXML(d *xml.Decoder,
+	start xml.StartElement) error {
+
+	var aux struct {
+		Text     *errText
+		Children []Generic `xml:",any"`
+	}
+	if err := d.DecodeElement(&aux, &start); err != nil {
+		return err
+	}
+	*se = streamError{XMLName: start.Name, Text: aux.Text}
+	found := false
+	for _, child := range aux.Children {
+		if child.XMLName.Space == NsStreams && !found {
+			se.Any = child
+			found = true
+		} else if se.App == nil {
+			app := child
+			se.App = &app
+		}
+	}
+	if !found && se.App != nil {
+		se.Any, se.App = *se.App, nil
+	}
+	return nil
+}
+
+// Returns the typed form of a stream error which has arrived.
+func (se *streamError) typed() *StreamError {
+	err := &StreamError{Condition: StreamUndefinedCondition, App: se.App}
+	if se.Any.XMLName.Space == NsStreams {
+		err.Condition = se.Any.XMLName.Local
+		if err.Condition == StreamSeeOtherHost {
+			err.Host = se.Any.Chardata
+		}
+	} else if se.Any.XMLName.Local != "" {
+		err.App = &se.Any
+	}
+	if se.Text != nil {
+		err.Text = se.Text.Text
+	}
+	return err
+}
+
+// Ends the session because of a stream error, unless it's a
+// redirection which can be followed by reconnecting elsewhere. Returns
+// true if the session goes on.
+func (cl *Client) handleStreamError(se *StreamError) bool {
+	if se.Condition == StreamSeeOtherHost && se.Host != "" &&
+		cl.rc != nil && cl.redial != nil {
+		cl.rc.redirectTo(se.Host)
+		if sm := cl.sm; sm != nil {
+			sm.lock.Lock()
+			sm.location = se.Host
+			sm.lock.Unlock()
+		}
+		if sock := cl.layer1.current(); sock != nil &&
+			cl.lostConnection(sock, se) {
+			return true
+		}
+	}
+	// The server closes the connection after the error, and that
+	// may be noticed first; the stream error is the better
+	// explanation.
+	cl.doneLock.Lock()
+	cl.doneErr = se
+	cl.doneLock.Unlock()
+	select {
+	case <-cl.error:
+	default:
+	}
+	cl.setError(se)
+	return false
+}
+
+// Records the error the session ended with, for Done. Only the first
+// is kept, and errors which follow the application closing the client
+// are ignored.
+func (cl *Client) terminal(err error) {
+	cl.doneLock.Lock()
+	defer cl.doneLock.Unlock()
+	select {
+	case <-cl.closing:
+		return
+	default:
+	}
+	if cl.doneErr == nil {
+		cl.doneErr = err
+	}
+}
+
+// Delivers the error the session ended with, if any, and closes Done.
+func (cl *Client) finish() {
+	cl.doneLock.Lock()
+	defer cl.doneLock.Unlock()
+	if cl.doneErr != nil {
+		cl.done <- cl.doneErr
+	}
+	close(cl.done)
+}
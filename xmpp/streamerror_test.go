@@ -0,0 +1,132 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseStreamError(t *testing.T) {
+	str := `<error xmlns="` + NsStream + `"><text xmlns="` + NsStreams +
+		`">bye</text><app xmlns="urn:example"/><see-other-host xmlns="` +
+		NsStreams + `">[2001:db8::1]:5222</see-other-host></error>`
+	var se streamError
+	if err := xml.Unmarshal([]byte(str), &se); err != nil {
+		t.Fatal(err)
+	}
+	err := se.typed()
+	assertEquals(t, StreamSeeOtherHost, err.Condition)
+	assertEquals(t, "[2001:db8::1]:5222", err.Host)
+	assertEquals(t, "bye", err.Text)
+	if err.App == nil || err.App.XMLName.Local != "app" {
+		t.Errorf("app condition %v", err.App)
+	}
+
+	str = `<error xmlns="` + NsStream + `"><app xmlns="urn:example"/></error>`
+	if err := xml.Unmarshal([]byte(str), &se); err != nil {
+		t.Fatal(err)
+	}
+	err = se.typed()
+	assertEquals(t, StreamUndefinedCondition, err.Condition)
+	if err.App == nil {
+		t.Error("no app condition")
+	}
+}
+
+func awaitDone(t *testing.T, cl *Client) error {
+	select {
+	case err := <-cl.Done:
+		if _, ok := <-cl.Done; ok {
+			t.Error("Done not closed")
+		}
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("session didn't end")
+	}
+	return nil
+}
+
+func TestStreamErrorDone(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	cl := mockClient(t, s, "alice@b.c/pc", "secret", &tls.Config{})
+	defer cl.Close()
+
+	if err := s.StreamError("alice@b.c/pc", &StreamError{
+		Condition: StreamConflict, Text: "replaced"}); err != nil {
+		t.Fatal(err)
+	}
+	err := awaitDone(t, cl)
+	se, ok := err.(*StreamError)
+	if !ok {
+		t.Fatalf("got %v, want a stream error", err)
+	}
+	assertEquals(t, StreamConflict, se.Condition)
+	assertEquals(t, "replaced", se.Text)
+
+	// Nothing is delivered if the application closes the client.
+	cl = mockClient(t, s, "alice@b.c/pc", "secret", &tls.Config{})
+	cl.Close()
+	if err := awaitDone(t, cl); err != nil {
+		t.Errorf("got %v after Close", err)
+	}
+}
+
+func TestSeeOtherHost(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.Serve(conn)
+		}
+	}()
+
+	redial := func(ctx context.Context) (net.Conn, error) {
+		return nil, net.UnknownNetworkError("not the other host")
+	}
+	events := make(chan ConnectionEvent, 10)
+	jid := JID("alice@b.c/pc")
+	cl, err := newClient(s.Dial(), redial, &jid, "secret", &tls.Config{},
+		[]Extension{ReconnectExt(ReconnectConfig{
+			MinBackoff: 10 * time.Millisecond, MaxAttempts: 3,
+			Events: events})},
+		Presence{}, nil)
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	defer cl.Close()
+
+	if err := s.StreamError("alice@b.c/pc", &StreamError{
+		Condition: StreamSeeOtherHost,
+		Host:      l.Addr().String()}); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(10 * time.Second)
+	for online := false; !online; {
+		select {
+		case ev := <-events:
+			online = ev.Online
+		case err := <-cl.Done:
+			t.Fatalf("session ended: %v", err)
+		case <-timeout:
+			t.Fatal("didn't reconnect")
+		}
+	}
+	cl.Send <- &Message{Header: Header{To: "b.c"},
+		Body: []Text{{Chardata: "echo"}}}
+	assertEquals(t, "echo", firstText(recvMessage(t, cl).Body))
+}
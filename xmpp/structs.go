@@ -6,12 +6,12 @@ import (
 	"bytes"
 	"encoding/xml"
 	"fmt"
-	"log"
 	"reflect"
 	"strings"
 )
 
-// BUG(cjyar): Doesn't use stringprep. Could try the implementation at
+// BUG(cjyar): Doesn't use stringprep or the PRECIS tables; ParseJID
+// only case-folds. Could try the implementation at
 // "code.google.com/p/go-idn/src/stringprep"
 
 // JID represents an entity that can communicate with other
@@ -27,15 +27,23 @@ type stream struct {
 	Id      string   `xml:"id,attr"`
 	Lang    string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
 	Version string   `xml:"version,attr"`
+	// The default namespace, if it isn't the client one.
+	ns string
 }
 
 var _ fmt.Stringer = &stream{}
 
+// </stream:stream>, which ends the stream.
+type streamEnd struct{}
+
 // <stream:error>
 type streamError struct {
 	XMLName xml.Name `xml:"http://etherx.jabber.org/streams error"`
 	Any     Generic  `xml:",any"`
 	Text    *errText
+	// An application-specific condition, besides the defined
+	// one in Any.
+	App *Generic `xml:"-"`
 }
 
 type errText struct {
@@ -49,7 +57,24 @@ type Features struct {
 	Mechanisms mechs     `xml:"urn:ietf:params:xml:ns:xmpp-sasl mechanisms"`
 	Bind       *bindIq
 	Session    *Generic
-	Any        *Generic
+	Sm         *Generic `xml:"urn:xmpp:sm:3 sm"`
+	RosterVer  *Generic `xml:"urn:xmpp:features:rosterver ver"`
+	Register   *Generic `xml:"http://jabber.org/features/iq-register register"`
+	// Client state indication, XEP-0352.
+	Csi *Generic `xml:"urn:xmpp:csi:0 csi"`
+	// Stream compression methods, XEP-0138.
+	Compression *compressionFeature `xml:"http://jabber.org/features/compress compression"`
+	// SASL2, and what can be done along with it, XEP-0388.
+	Sasl2 *sasl2Feature `xml:"urn:xmpp:sasl:2 authentication"`
+	// The types of channel binding the server supports, XEP-0440.
+	ChannelBindings *channelBindingTypes `xml:"urn:xmpp:sasl-cb:0 sasl-channel-binding"`
+	Any             *Generic
+}
+
+type channelBindingTypes struct {
+	Types []struct {
+		Type string `xml:"type,attr"`
+	} `xml:"channel-binding"`
 }
 
 type starttls struct {
@@ -92,6 +117,9 @@ type Message struct {
 	Subject []Text `xml:"jabber:client subject"`
 	Body    []Text `xml:"jabber:client body"`
 	Thread  *Data  `xml:"jabber:client thread"`
+	// When the message was originally sent, if it was stored or
+	// relayed on the way.
+	Delay *Delay
 }
 
 var _ Stanza = &Message{}
@@ -103,6 +131,8 @@ type Presence struct {
 	Show     *Data  `xml:"jabber:client show"`
 	Status   []Text `xml:"jabber:client status"`
 	Priority *Data  `xml:"jabber:client priority"`
+	// When the presence was originally sent, if the server held it.
+	Delay *Delay
 }
 
 var _ Stanza = &Presence{}
@@ -115,13 +145,20 @@ type Iq struct {
 
 var _ Stanza = &Iq{}
 
-// Describes an XMPP stanza error. See RFC 3920, Section 9.3.
+// Describes an XMPP stanza error. See RFC 6120, Section 8.3.
 type Error struct {
 	XMLName xml.Name `xml:"error"`
-	// The error type attribute.
+	// The error type attribute, such as ErrorCancel.
 	Type string `xml:"type,attr"`
-	// Any nested element, if present.
+	// The entity which generated the error, if it isn't the one
+	// the stanza was sent to.
+	By string `xml:"by,attr,omitempty"`
+	// The defined condition, such as item-not-found.
 	Any *Generic
+	// Human-readable text, if present.
+	Text *Text `xml:"urn:ietf:params:xml:ns:xmpp-stanzas text"`
+	// An application-specific condition, if present.
+	App *Generic
 }
 
 var _ error = &Error{}
@@ -159,28 +196,18 @@ type Generic struct {
 var _ fmt.Stringer = &Generic{}
 
 func (j JID) Node() string {
-	at := strings.Index(string(j), "@")
-	if at == -1 {
-		return ""
-	}
-	return string(j[:at])
+	node, _, _ := j.split()
+	return node
 }
 
 func (j JID) Domain() string {
-	at := strings.Index(string(j), "@")
-	slash := strings.LastIndex(string(j), "/")
-	if slash == -1 {
-		slash = len(j)
-	}
-	return string(j[at+1 : slash])
+	_, domain, _ := j.split()
+	return domain
 }
 
 func (j JID) Resource() string {
-	slash := strings.LastIndex(string(j), "/")
-	if slash == -1 {
-		return ""
-	}
-	return string(j[slash+1:])
+	_, _, res := j.split()
+	return res
 }
 
 // Returns the bare JID, which is the JID without the resource part.
@@ -195,7 +222,11 @@ func (j JID) Bare() JID {
 func (s *stream) String() string {
 	var buf bytes.Buffer
 	buf.WriteString(`<stream:stream xmlns="`)
-	buf.WriteString(NsClient)
+	if s.ns != "" {
+		buf.WriteString(s.ns)
+	} else {
+		buf.WriteString(NsClient)
+	}
 	buf.WriteString(`" xmlns:stream="`)
 	buf.WriteString(NsStream)
 	buf.WriteString(`"`)
@@ -272,15 +303,6 @@ func (u *Generic) String() string {
 		u.XMLName.Local)
 }
 
-func (er *Error) Error() string {
-	buf, err := xml.Marshal(er)
-	if err != nil {
-		log.Println("double bad error: couldn't marshal error")
-		return "unreadable error"
-	}
-	return string(buf)
-}
-
 var bindExt Extension = Extension{}
 
 func init() {
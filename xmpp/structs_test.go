@@ -129,3 +129,74 @@ func TestUnmarshalMessage(t *testing.T) {
 		t.Errorf("body\ngot:  %#v\nwant: %#v\n", obsBody, expBody)
 	}
 }
+
+func TestParseJID(t *testing.T) {
+	for in, want := range map[string]string{
+		"User@Example.COM/Res": "user@example.com/Res",
+		"example.com.":         "example.com",
+		"a@b/c@d/e":            "a@b/c@d/e",
+		"b/c@d":                "b/c@d",
+		"[::1]":                "[::1]",
+		"room@muc.b/Nick Name": "room@muc.b/Nick Name",
+	} {
+		jid, err := ParseJID(in)
+		if err != nil {
+			t.Errorf("ParseJID(%q): %v", in, err)
+			continue
+		}
+		assertEquals(t, want, string(jid))
+	}
+	for _, in := range []string{"", "@b", "a@", "a@b/", "a b@c", "a@b:5",
+		"a\x00@b", strings.Repeat("a", 1024) + "@b"} {
+		if _, err := ParseJID(in); err == nil {
+			t.Errorf("ParseJID(%q) succeeded", in)
+		}
+	}
+	jid := JID("b/c@d")
+	assertEquals(t, "", jid.Node())
+	assertEquals(t, "b", jid.Domain())
+	assertEquals(t, "c@d", jid.Resource())
+	if !JID("User@B.c").Equal("user@b.c") {
+		t.Error("not equal")
+	}
+}
+
+func TestEscapeNode(t *testing.T) {
+	for in, want := range map[string]string{
+		"d'artagnan":         `d\27artagnan`,
+		"joe smith@mail.org": `joe\20smith\40mail.org`,
+		`c:\net`:             `c\3a\net`,
+		`c:\5commas`:         `c\3a\5c5commas`,
+		"space cadet":        `space\20cadet`,
+	} {
+		assertEquals(t, want, EscapeNode(in))
+		assertEquals(t, in, UnescapeNode(EscapeNode(in)))
+	}
+}
+
+func TestStanzaError(t *testing.T) {
+	str := `<iq xmlns="jabber:client" type="error" id="1">` +
+		`<error type="cancel" by="b.c"><text xmlns="` + NsStanzas +
+		`">gone away</text><item-not-found xmlns="` + NsStanzas +
+		`"/><no-such xmlns="urn:x"/></error></iq>`
+	var iq Iq
+	if err := xml.Unmarshal([]byte(str), &iq); err != nil {
+		t.Fatal(err)
+	}
+	er := iq.Error
+	assertEquals(t, CondItemNotFound, er.Condition())
+	assertEquals(t, ErrorCancel, er.Type)
+	assertEquals(t, "b.c", er.By)
+	assertEquals(t, "gone away", er.Message())
+	assertEquals(t, "no-such", er.App.XMLName.Local)
+	assertEquals(t, "item-not-found (cancel) urn:x no-such: gone away",
+		er.Error())
+	assertEquals(t, CondItemNotFound, errCondition(er))
+
+	req := &Iq{Header: Header{From: "a@b.c/d", To: "b.c", Id: "7",
+		Type: "get"}}
+	reply := ErrorReply(req, NewError("", CondForbidden, "no"))
+	assertMarshal(t, `<iq to="a@b.c/d" from="b.c" id="7" type="error">`+
+		`<error type="auth"><forbidden xmlns="`+NsStanzas+`"></forbidden>`+
+		`<text xmlns="`+NsStanzas+`">no</text></error></iq>`, reply)
+}
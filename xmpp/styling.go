@@ -0,0 +1,252 @@
+package xmpp
+
+// This file contains a parser for message styling, XEP-0393, the
+// *strong*, _emphasis_, ~strikethrough~, `code`, preformatted blocks
+// and quotes of plain text bodies.
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const NsStyling = "urn:xmpp:styling:0"
+
+// Asks the recipient not to style a message's body.
+type Unstyled struct {
+	XMLName xml.Name `xml:"urn:xmpp:styling:0 unstyled"`
+}
+
+// StylingExt may be included in the extensions passed to NewClient
+// to advertise support for message styling, and to decode the hints
+// of messages which shouldn't be styled.
+var StylingExt Extension = Extension{}
+
+func init() {
+	StylingExt.Features = []string{NsStyling}
+	StylingExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	uName := xml.Name{Space: NsStyling, Local: "unstyled"}
+	StylingExt.StanzaTypes[uName] = reflect.TypeOf(Unstyled{})
+}
+
+// Did the sender ask for the message's body not to be styled?
+func (m *Message) IsUnstyled() bool {
+	for _, ele := range m.Nested {
+		switch ele.(type) {
+		case *Unstyled, Unstyled:
+			return true
+		}
+	}
+	return false
+}
+
+// The styles of a span of text, combined.
+type Style uint
+
+const (
+	StyleStrong Style = 1 << iota
+	StyleEmphasis
+	StyleStrike
+	// Inline `code`.
+	StylePre
+	// The lines of a preformatted block, between lines of ```.
+	StylePreBlock
+)
+
+// A run of a message's body in one style.
+type StyledSpan struct {
+	Text  string
+	Style Style
+	// How deeply the span is quoted: 0 outside quotes, 1 in a
+	// quote, 2 in a quote within a quote, and so on.
+	Quote int
+	// Is the text a styling directive, such as the asterisks around
+	// strong text, the lines which start and end a preformatted block,
+	// or the "> " which starts a quoted line? Clients may show
+	// directives in their span's style, or leave them out.
+	Directive bool
+}
+
+// Splits a body into styled spans, whose texts together are the
+// body.
+func ParseStyling(body string) []StyledSpan {
+	var p styler
+	var lines []styledLine
+	for body != "" {
+		i := strings.IndexByte(body, '\n') + 1
+		if i == 0 {
+			i = len(body)
+		}
+		lines = append(lines, styledLine{text: body[:i]})
+		body = body[i:]
+	}
+	p.blocks(lines, 0)
+	return p.spans
+}
+
+// Returns the message's body as styled spans, or as one unstyled
+// span if its sender asked for that.
+func (m *Message) Styled() []StyledSpan {
+	body := firstText(m.Body)
+	if body == "" {
+		return nil
+	}
+	if m.IsUnstyled() {
+		return []StyledSpan{{Text: body}}
+	}
+	return ParseStyling(body)
+}
+
+// Returns a body with its styling directives left out, for clients
+// which show text without styles, such as in notifications.
+func StripStyling(body string) string {
+	var b strings.Builder
+	for _, sp := range ParseStyling(body) {
+		if !sp.Directive {
+			b.WriteString(sp.Text)
+		}
+	}
+	return b.String()
+}
+
+// A line of a body, as a block sees it: what came before it in the
+// line, such as the "> " of the quotes around the block, and what's
+// left, including the newline.
+type styledLine struct {
+	prefix string
+	text   string
+}
+
+type styler struct {
+	spans []StyledSpan
+}
+
+// Adds a span, joined to the last one if they're alike.
+func (p *styler) emit(text string, style Style, quote int, directive bool) {
+	if text == "" {
+		return
+	}
+	if n := len(p.spans); n > 0 {
+		last := &p.spans[n-1]
+		if last.Style == style && last.Quote == quote &&
+			last.Directive == directive {
+			last.Text += text
+			return
+		}
+	}
+	p.spans = append(p.spans, StyledSpan{Text: text, Style: style,
+		Quote: quote, Directive: directive})
+}
+
+// Parses the lines of a block quoted quote times.
+func (p *styler) blocks(lines []styledLine, quote int) {
+	for len(lines) > 0 {
+		l := lines[0]
+		switch {
+		case strings.HasPrefix(l.text, "```"):
+			// A preformatted block, which ends with a line of
+			// ``` or with its parent.
+			p.emit(l.prefix, 0, quote, true)
+			p.emit(l.text, StylePreBlock, quote, true)
+			lines = lines[1:]
+			for len(lines) > 0 {
+				l = lines[0]
+				lines = lines[1:]
+				p.emit(l.prefix, 0, quote, true)
+				if strings.TrimRight(l.text, "\n") == "```" {
+					p.emit(l.text, StylePreBlock, quote, true)
+					break
+				}
+				p.emit(l.text, StylePreBlock, quote, false)
+			}
+		case strings.HasPrefix(l.text, ">"):
+			// A quote, which goes on as long as its lines start
+			// with >, and may hold blocks of its own.
+			var inner []styledLine
+			for len(lines) > 0 && strings.HasPrefix(lines[0].text, ">") {
+				l = lines[0]
+				n := 1
+				if strings.HasPrefix(l.text[1:], " ") {
+					n++
+				}
+				inner = append(inner, styledLine{
+					prefix: l.prefix + l.text[:n],
+					text:   l.text[n:]})
+				lines = lines[1:]
+			}
+			p.blocks(inner, quote+1)
+		default:
+			p.emit(l.prefix, 0, quote, true)
+			text := strings.TrimSuffix(l.text, "\n")
+			p.inline(text, 0, quote)
+			p.emit(l.text[len(text):], 0, quote, false)
+			lines = lines[1:]
+		}
+	}
+}
+
+// The styles the directives of spans stand for.
+var spanStyles = map[byte]Style{
+	'*': StyleStrong,
+	'_': StyleEmphasis,
+	'~': StyleStrike,
+	'`': StylePre,
+}
+
+// Parses the spans of a line, or of a span, in the given style.
+func (p *styler) inline(s string, style Style, quote int) {
+	plain := 0
+	for i := 0; i < len(s); i++ {
+		st, ok := spanStyles[s[i]]
+		if !ok || !opens(s, i) {
+			continue
+		}
+		j := closes(s, i)
+		if j < 0 {
+			continue
+		}
+		p.emit(s[plain:i], style, quote, false)
+		p.emit(s[i:i+1], style|st, quote, true)
+		if st == StylePre {
+			// Nothing is styled in code.
+			p.emit(s[i+1:j], style|st, quote, false)
+		} else {
+			p.inline(s[i+1:j], style|st, quote)
+		}
+		p.emit(s[j:j+1], style|st, quote, true)
+		i = j
+		plain = j + 1
+	}
+	p.emit(s[plain:], style, quote, false)
+}
+
+// Can the directive at s[i] start a span? It must begin the text or
+// follow whitespace, and mustn't be followed by whitespace.
+func opens(s string, i int) bool {
+	if i > 0 {
+		r, _ := utf8.DecodeLastRuneInString(s[:i])
+		if !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	r, n := utf8.DecodeRuneInString(s[i+1:])
+	return n > 0 && !unicode.IsSpace(r)
+}
+
+// Returns where the span opened at s[i] ends: at the first of the
+// same directive which doesn't follow whitespace, leaving the span
+// not empty. Returns -1 if there's none.
+func closes(s string, i int) int {
+	for j := i + 2; j < len(s); j++ {
+		if s[j] != s[i] {
+			continue
+		}
+		r, _ := utf8.DecodeLastRuneInString(s[:j])
+		if !unicode.IsSpace(r) {
+			return j
+		}
+	}
+	return -1
+}
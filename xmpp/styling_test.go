@@ -0,0 +1,65 @@
+package xmpp
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Writes spans compactly: directives in brackets, styles and quotes
+// after a colon.
+func formatSpans(spans []StyledSpan) string {
+	var res []string
+	for _, sp := range spans {
+		s := fmt.Sprintf("%q", sp.Text)
+		if sp.Directive {
+			s = "[" + s + "]"
+		}
+		if sp.Style != 0 || sp.Quote != 0 {
+			s += fmt.Sprintf(":%d/%d", sp.Style, sp.Quote)
+		}
+		res = append(res, s)
+	}
+	return strings.Join(res, " ")
+}
+
+func TestParseStyling(t *testing.T) {
+	tests := []struct{ body, want string }{
+		{"plain", `"plain"`},
+		{"a *b* c", `"a " ["*"]:1/0 "b":1/0 ["*"]:1/0 " c"`},
+		{"*_both_*", `["*"]:1/0 ["_"]:3/0 "both":3/0 ["_"]:3/0 ["*"]:1/0`},
+		// Not spans.
+		{"a* b*", `"a* b*"`},
+		{"* a*", `"* a*"`},
+		{"*a *", `"*a *"`},
+		{"**", `"**"`},
+		{"x*y*", `"x*y*"`},
+		{"*a\nb*", `"*a\nb*"`},
+		{"`*x*` ~y~", "[\"`\"]:8/0 \"*x*\":8/0 [\"`\"]:8/0 \" \" " +
+			`["~"]:4/0 "y":4/0 ["~"]:4/0`},
+		{"```go\n*x*\n```\nafter", "[\"```go\\n\"]:16/0 \"*x*\\n\":16/0 " +
+			"[\"```\\n\"]:16/0 \"after\""},
+		// An unclosed block ends with the body.
+		{"```\nx", "[\"```\\n\"]:16/0 \"x\":16/0"},
+		{"> a\n>> _b_\nc", `["> "]:0/1 "a\n":0/1 [">> "]:0/2 ` +
+			`["_"]:2/2 "b":2/2 ["_"]:2/2 "\n":0/2 "c"`},
+		// A block in a quote ends with the quote.
+		{"> ```\n> x\ny", "[\"> \"]:0/1 [\"```\\n\"]:16/1 " +
+			"[\"> \"]:0/1 \"x\\n\":16/1 \"y\""},
+	}
+	for _, test := range tests {
+		got := formatSpans(ParseStyling(test.body))
+		if got != test.want {
+			t.Errorf("%q:\ngot  %s\nwant %s", test.body, got, test.want)
+		}
+	}
+}
+
+func TestStripStyling(t *testing.T) {
+	assertEquals(t, "a b c\nquoted\ncode\n",
+		StripStyling("a *b* _c_\n> quoted\n```\ncode\n```\n"))
+
+	m := &Message{Body: []Text{{Chardata: "*not*"}},
+		Header: Header{Nested: []interface{}{&Unstyled{}}}}
+	assertEquals(t, `"*not*"`, formatSpans(m.Styled()))
+}
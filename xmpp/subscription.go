@@ -0,0 +1,67 @@
+package xmpp
+
+// This file contains helpers for managing presence subscriptions,
+// RFC 6121 section 3.
+
+// A request from another entity to subscribe to our presence. It
+// should be answered with ApproveSubscription or DenySubscription.
+type SubscriptionRequest struct {
+	From JID
+	// The text the requester sent with the request, if any.
+	Status string
+	// The requester's roster item, if it's already in the roster.
+	Item *RosterItem
+	// The request itself.
+	Presence *Presence
+}
+
+// Reports an incoming subscription request on Requests. Called from
+// the receiving filter.
+func (r *Roster) subscription(pr *Presence, roster map[JID]RosterItem) {
+	if pr.Type != "subscribe" || pr.From == "" {
+		return
+	}
+	req := SubscriptionRequest{From: pr.From.Bare(),
+		Status: BestText(pr.Status, pr.Lang), Presence: pr}
+	if item, ok := roster[req.From]; ok {
+		req.Item = &item
+	}
+	select {
+	case r.requests <- req:
+	default:
+	}
+}
+
+func (cl *Client) sendSubscription(jid JID, typ, status string) {
+	pr := &Presence{Header: Header{To: jid.Bare(), Type: typ,
+		Id: cl.NextId()}}
+	if status != "" {
+		pr.Status = []Text{{Chardata: status}}
+	}
+	cl.Send <- pr
+}
+
+// Asks to subscribe to a contact's presence. The optional status is
+// shown to the contact with the request. Until the contact answers,
+// the contact's roster item has Ask set to "subscribe".
+func (cl *Client) RequestSubscription(jid JID, status string) {
+	cl.sendSubscription(jid, "subscribe", status)
+}
+
+// Allows a contact to see our presence, answering its request or
+// approving it in advance.
+func (cl *Client) ApproveSubscription(jid JID) {
+	cl.sendSubscription(jid, "subscribed", "")
+}
+
+// Refuses a contact's subscription request, or revokes a
+// subscription already granted.
+func (cl *Client) DenySubscription(jid JID) {
+	cl.sendSubscription(jid, "unsubscribed", "")
+}
+
+// Stops receiving a contact's presence, or withdraws a pending
+// request to.
+func (cl *Client) CancelSubscription(jid JID) {
+	cl.sendSubscription(jid, "unsubscribe", "")
+}
@@ -0,0 +1,54 @@
+package xmpp
+
+import (
+	"testing"
+)
+
+func TestSubscriptionRequests(t *testing.T) {
+	r := newRosterExt(nil)
+	in := make(chan Stanza)
+	out := make(chan Stanza, 1)
+	go r.RecvFilter(in, out)
+	in <- &Iq{Header: Header{Type: "set", Nested: []interface{}{
+		&RosterQuery{Item: []RosterItem{{Jid: "a@b.c",
+			Subscription: "to", Name: "A"}}}}}}
+	<-out
+	in <- &Presence{Header: Header{From: "d@b.c/x", Type: "subscribe"},
+		Status: []Text{{Chardata: "hi"}}}
+	<-out
+	in <- &Presence{Header: Header{From: "a@b.c", Type: "subscribe"}}
+	<-out
+	in <- &Presence{Header: Header{From: "a@b.c"}}
+	<-out
+	close(in)
+
+	req := <-r.Requests
+	assertEquals(t, "d@b.c", string(req.From))
+	assertEquals(t, "hi", req.Status)
+	if req.Item != nil {
+		t.Errorf("unexpected item %v", req.Item)
+	}
+	req = <-r.Requests
+	assertEquals(t, "a@b.c", string(req.From))
+	if req.Item == nil || req.Item.Name != "A" {
+		t.Errorf("item %v", req.Item)
+	}
+	if req, ok := <-r.Requests; ok {
+		t.Errorf("unexpected request %v", req)
+	}
+}
+
+func TestSubscriptionHelpers(t *testing.T) {
+	send := make(chan Stanza, 4)
+	cl := &Client{Send: send}
+	cl.RequestSubscription("a@b.c/r", "me")
+	cl.ApproveSubscription("a@b.c")
+	cl.DenySubscription("a@b.c")
+	cl.CancelSubscription("a@b.c")
+	for _, typ := range []string{"subscribe", "subscribed",
+		"unsubscribed", "unsubscribe"} {
+		pr := (<-send).(*Presence)
+		assertEquals(t, typ, pr.Type)
+		assertEquals(t, "a@b.c", string(pr.To))
+	}
+}
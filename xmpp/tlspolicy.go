@@ -0,0 +1,106 @@
+package xmpp
+
+// This file contains the settings which decide whether a session must
+// be encrypted, and how the server's certificate is checked.
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+)
+
+// Decides whether the client insists on TLS. The tls.Config given to
+// NewClient and the other constructors is used for every TLS
+// connection the client makes, so servers with private CAs can be
+// reached by setting its RootCAs.
+type TlsPolicy int
+
+const (
+	// Use TLS if the server offers it. This is the default.
+	TlsOpportunistic TlsPolicy = iota
+	// Refuse to run the session without TLS.
+	TlsRequired
+	// Never use TLS. Servers which require it can't be used.
+	TlsDisabled
+)
+
+// Returns an extension which sets the client's TLS policy.
+func TlsPolicyExt(policy TlsPolicy) Extension {
+	return Extension{option: func(o *options) {
+		o.tlsPolicy = policy
+	}}
+}
+
+// Checks the server's certificate.
+type TlsVerifier func(cs tls.ConnectionState) error
+
+// Returns an extension which checks the server's certificate with
+// verify, after the usual checks, on every TLS connection the client
+// makes for STARTTLS or direct TLS. A connection is abandoned if
+// verify returns an error. To accept certificates which don't chain
+// to a trusted CA, such as self-signed ones, set InsecureSkipVerify
+// in the client's tls.Config and let verify decide. Transports which
+// are given their own tls.Config, such as WebSocketTransport, aren't
+// affected.
+func TlsVerifyExt(verify TlsVerifier) Extension {
+	return Extension{option: func(o *options) {
+		o.verify = verify
+	}}
+}
+
+// Returns a TlsVerifier which accepts only servers whose certificate
+// has one of the given public keys. Each pin is the SHA-256 digest of
+// a certificate's DER-encoded SubjectPublicKeyInfo.
+func PinPublicKeys(pins ...[]byte) TlsVerifier {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("no server certificate")
+		}
+		sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if subtle.ConstantTimeCompare(sum[:], pin) == 1 {
+				return nil
+			}
+		}
+		return fmt.Errorf("server's public key isn't pinned")
+	}
+}
+
+// Returns the configuration for the client's TLS connections to the
+// domain.
+func (o *options) tlsConfig(tlsconf *tls.Config, domain string) *tls.Config {
+	sni := ""
+	if o.server != nil {
+		sni = o.server.ServerName
+	}
+	if tlsconf != nil && tlsconf.ServerName != "" && o.verify == nil &&
+		sni == "" {
+		return tlsconf
+	}
+	var conf *tls.Config
+	if tlsconf == nil {
+		conf = &tls.Config{}
+	} else {
+		conf = tlsconf.Clone()
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = domain
+	}
+	if verify := o.verify; verify != nil {
+		prev := conf.VerifyConnection
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			if prev != nil {
+				if err := prev(cs); err != nil {
+					return err
+				}
+			}
+			return verify(cs)
+		}
+	}
+	if sni != "" && sni != conf.ServerName {
+		verifyAs(conf, conf.ServerName)
+		conf.ServerName = sni
+	}
+	return conf
+}
@@ -0,0 +1,57 @@
+package xmpp
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTlsRequired(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer sconn.Close()
+	stanzas := make(chan string, 10)
+	go fakeServer(t, sconn, stanzas)
+
+	jid := JID("user@example.com/res")
+	_, err := NewClientFromConn(cconn, &jid, "secret", &tls.Config{},
+		[]Extension{TlsPolicyExt(TlsRequired)}, Presence{}, nil)
+	if err == nil || !strings.Contains(err.Error(), "TLS") {
+		t.Fatalf("got %v, want a TLS error", err)
+	}
+}
+
+func TestPinPublicKeys(t *testing.T) {
+	hs := httptest.NewTLSServer(nil)
+	defer hs.Close()
+	cert := hs.Certificate()
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	pin := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	if err := PinPublicKeys(make([]byte, 32), pin[:])(cs); err != nil {
+		t.Errorf("pinned key refused: %v", err)
+	}
+	if err := PinPublicKeys(make([]byte, 32))(cs); err == nil {
+		t.Error("unpinned key accepted")
+	}
+
+	// The verifier runs after any the config already had.
+	var calls []string
+	conf := &tls.Config{VerifyConnection: func(tls.ConnectionState) error {
+		calls = append(calls, "config")
+		return nil
+	}}
+	o := newOptions([]Extension{TlsVerifyExt(func(cs tls.ConnectionState) error {
+		calls = append(calls, "pin")
+		return PinPublicKeys(pin[:])(cs)
+	})})
+	conf = o.tlsConfig(conf, "example.com")
+	assertEquals(t, "example.com", conf.ServerName)
+	if err := conf.VerifyConnection(cs); err != nil {
+		t.Errorf("VerifyConnection: %v", err)
+	}
+	assertEquals(t, "config pin", strings.Join(calls, " "))
+}
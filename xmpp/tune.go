@@ -0,0 +1,30 @@
+package xmpp
+
+// This file contains support for user tune, XEP-0118.
+
+import (
+	"encoding/xml"
+)
+
+const NsTune = "http://jabber.org/protocol/tune"
+
+// The music a user is listening to. A Tune with no fields set says
+// they've stopped.
+type Tune struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/tune tune"`
+	Artist  string   `xml:"artist,omitempty"`
+	// The duration in seconds.
+	Length int `xml:"length,omitempty"`
+	// From 1 to 10.
+	Rating int    `xml:"rating,omitempty"`
+	Source string `xml:"source,omitempty"`
+	Title  string `xml:"title,omitempty"`
+	// The track number or other identifier in the source.
+	Track string `xml:"track,omitempty"`
+	Uri   string `xml:"uri,omitempty"`
+}
+
+// Whether the tune says the user has stopped listening.
+func (t *Tune) Stopped() bool {
+	return *t == Tune{XMLName: t.XMLName}
+}
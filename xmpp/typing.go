@@ -0,0 +1,160 @@
+package xmpp
+
+// This file contains a manager for typing notifications, built on
+// chat states (XEP-0085).
+
+import (
+	"sync"
+	"time"
+)
+
+// TypingManager is an extension which sends composing and paused
+// chat states on the application's behalf, and keeps track of which
+// contacts are typing to us.
+type TypingManager struct {
+	Extension
+	pause, timeout time.Duration
+	toServer       chan Stanza
+	lock           sync.Mutex
+	// Outgoing notifications: the timers which will send paused.
+	composing map[JID]*time.Timer
+	// Incoming notifications: when each bare JID last said it was
+	// composing.
+	remote map[JID]time.Time
+}
+
+// Creates a TypingManager, to be passed to NewClient among the
+// extensions. After NotifyTyping hasn't been called for pause, a
+// paused notification is sent. A contact who said they were
+// composing is considered to have stopped after timeout, even if
+// they never said so.
+func NewTypingManager(pause, timeout time.Duration) *TypingManager {
+	tm := &TypingManager{pause: pause, timeout: timeout}
+	tm.toServer = make(chan Stanza)
+	tm.composing = make(map[JID]*time.Timer)
+	tm.remote = make(map[JID]time.Time)
+	tm.StanzaTypes = ChatStatesExt.StanzaTypes
+	tm.RecvFilter = tm.recvFilter
+	tm.SendFilter = tm.sendFilter
+	return tm
+}
+
+// Tells the manager the user is typing a message to the given JID.
+// This may be called on every keystroke; a composing notification is
+// only sent when the user starts typing.
+func (tm *TypingManager) NotifyTyping(to JID) {
+	tm.lock.Lock()
+	if t, ok := tm.composing[to]; ok {
+		t.Reset(tm.pause)
+		tm.lock.Unlock()
+		return
+	}
+	tm.composing[to] = time.AfterFunc(tm.pause, func() { tm.paused(to) })
+	tm.lock.Unlock()
+	tm.sendState(to, ChatComposing)
+}
+
+// Tells the manager the user has stopped typing to the given JID
+// without sending anything, for instance by clearing what they'd
+// typed. If a composing notification was sent, paused is sent now
+// instead of waiting.
+func (tm *TypingManager) StopTyping(to JID) {
+	tm.lock.Lock()
+	t, ok := tm.composing[to]
+	if ok {
+		t.Stop()
+	}
+	tm.lock.Unlock()
+	if ok {
+		tm.paused(to)
+	}
+}
+
+func (tm *TypingManager) paused(to JID) {
+	tm.lock.Lock()
+	_, ok := tm.composing[to]
+	delete(tm.composing, to)
+	tm.lock.Unlock()
+	if ok {
+		tm.sendState(to, ChatPaused)
+	}
+}
+
+func (tm *TypingManager) sendState(to JID, state string) {
+	tm.toServer <- &Message{Header: Header{To: to, Type: "chat",
+		Nested: []interface{}{NewChatState(state)}}}
+}
+
+// Is the given contact typing to us?
+func (tm *TypingManager) IsTyping(jid JID) bool {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	t, ok := tm.remote[jid.Bare()]
+	return ok && time.Since(t) < tm.timeout
+}
+
+// Returns the bare JIDs of the contacts which are typing to us.
+func (tm *TypingManager) Typing() []JID {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	var jids []JID
+	for jid, t := range tm.remote {
+		if time.Since(t) < tm.timeout {
+			jids = append(jids, jid)
+		} else {
+			delete(tm.remote, jid)
+		}
+	}
+	return jids
+}
+
+func (tm *TypingManager) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for stan := range in {
+		if m, ok := stan.(*Message); ok && m.Type != "error" {
+			state := m.ChatState()
+			from := m.From.Bare()
+			tm.lock.Lock()
+			switch {
+			case state == ChatComposing:
+				tm.remote[from] = time.Now()
+			case state != "" || len(m.Body) > 0:
+				delete(tm.remote, from)
+			}
+			tm.lock.Unlock()
+		}
+		out <- stan
+	}
+}
+
+func (tm *TypingManager) sendFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			if m, ok := stan.(*Message); ok && len(m.Body) > 0 {
+				tm.sent(m)
+			}
+			out <- stan
+		case stan := <-tm.toServer:
+			out <- stan
+		}
+	}
+}
+
+// The application sent a message, so it's no longer composing one.
+// Make sure the message says so.
+func (tm *TypingManager) sent(m *Message) {
+	tm.lock.Lock()
+	if t, ok := tm.composing[m.To]; ok {
+		t.Stop()
+		delete(tm.composing, m.To)
+	}
+	tm.lock.Unlock()
+	if m.ChatState() == "" {
+		m.Nested = append(m.Nested, NewChatState(ChatActive))
+	}
+}
@@ -0,0 +1,55 @@
+package xmpp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTypingManager(t *testing.T) {
+	tm := NewTypingManager(20*time.Millisecond, 20*time.Millisecond)
+	sendIn := make(chan Stanza)
+	sendOut := make(chan Stanza)
+	go tm.SendFilter(sendIn, sendOut)
+	defer close(sendIn)
+	recvIn := make(chan Stanza)
+	recvOut := make(chan Stanza)
+	go tm.RecvFilter(recvIn, recvOut)
+	defer close(recvIn)
+
+	state := func() string {
+		return (<-sendOut).(*Message).ChatState()
+	}
+	go func() {
+		tm.NotifyTyping("a@b.c")
+		tm.NotifyTyping("a@b.c")
+	}()
+	assertEquals(t, ChatComposing, state())
+	assertEquals(t, ChatPaused, state())
+
+	go tm.NotifyTyping("a@b.c")
+	assertEquals(t, ChatComposing, state())
+	sendIn <- &Message{Header: Header{To: "a@b.c"},
+		Body: []Text{{Chardata: "hi"}}}
+	assertEquals(t, ChatActive, state())
+
+	go tm.NotifyTyping("a@b.c")
+	assertEquals(t, ChatComposing, state())
+	go tm.StopTyping("a@b.c")
+	assertEquals(t, ChatPaused, state())
+	select {
+	case st := <-sendOut:
+		t.Errorf("unexpected %v", st)
+	case <-time.After(40 * time.Millisecond):
+	}
+
+	recvIn <- &Message{Header: Header{From: "d@e.f/g",
+		Nested: []interface{}{NewChatState(ChatComposing)}}}
+	<-recvOut
+	if !tm.IsTyping("d@e.f") {
+		t.Errorf("not typing")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if tm.IsTyping("d@e.f") {
+		t.Errorf("didn't time out")
+	}
+}
@@ -0,0 +1,175 @@
+package xmpp
+
+// This file contains HTTP file upload, XEP-0363: the server hands
+// out URLs to which a file may be uploaded, and from which others
+// can then download it.
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const NsHttpUpload = "urn:xmpp:http:upload:0"
+
+// Asks an upload service for a slot.
+type UploadRequest struct {
+	XMLName     xml.Name `xml:"urn:xmpp:http:upload:0 request"`
+	Filename    string   `xml:"filename,attr"`
+	Size        int64    `xml:"size,attr"`
+	ContentType string   `xml:"content-type,attr,omitempty"`
+}
+
+// The URLs for one upload. The file is uploaded to Put, with the
+// given headers, and may then be downloaded from Get.
+type UploadSlot struct {
+	XMLName xml.Name  `xml:"urn:xmpp:http:upload:0 slot"`
+	Put     UploadPut `xml:"put"`
+	Get     UploadGet `xml:"get"`
+}
+
+type UploadPut struct {
+	Url     string         `xml:"url,attr"`
+	Headers []UploadHeader `xml:"header"`
+}
+
+type UploadGet struct {
+	Url string `xml:"url,attr"`
+}
+
+type UploadHeader struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+// UploadExt may be included in the extensions passed to NewClient to
+// upload files.
+var UploadExt Extension = Extension{}
+
+func init() {
+	UploadExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	sName := xml.Name{Space: NsHttpUpload, Local: "slot"}
+	UploadExt.StanzaTypes[sName] = reflect.TypeOf(UploadSlot{})
+}
+
+// Looks among the server's items for an upload service. Returns its
+// JID and the largest file it accepts, or 0 if it doesn't say.
+func (cl *Client) UploadService(ctx context.Context) (JID, int64, error) {
+	domain := JID(cl.Jid.Domain())
+	items, err := cl.DiscoItems(ctx, domain, "")
+	if err != nil {
+		return "", 0, err
+	}
+	for _, item := range items.Items {
+		di, err := cl.DiscoInfo(ctx, item.Jid, "")
+		if err != nil || !di.HasFeature(NsHttpUpload) {
+			continue
+		}
+		var max int64
+		for _, f := range di.Forms {
+			if f.Value("FORM_TYPE") == NsHttpUpload {
+				max, _ = strconv.ParseInt(f.Value("max-file-size"),
+					10, 64)
+			}
+		}
+		return item.Jid, max, nil
+	}
+	return "", 0, fmt.Errorf("%s has no upload service", domain)
+}
+
+// Asks an upload service for a slot for a file.
+func (cl *Client) UploadSlot(ctx context.Context, svc JID,
+	req *UploadRequest) (*UploadSlot, error) {
+
+	iq := &Iq{Header: Header{To: svc, Type: "get",
+		Nested: []interface{}{req}}}
+	reply, err := cl.SendIq(ctx, iq)
+	if err != nil {
+		return nil, err
+	}
+	for _, ele := range reply.Nested {
+		if slot, ok := ele.(*UploadSlot); ok {
+			return slot, nil
+		}
+	}
+	return nil, fmt.Errorf("no upload slot in %#v", reply)
+}
+
+// A file to be uploaded by Client.Upload.
+type UploadFile struct {
+	Filename    string
+	Size        int64
+	ContentType string
+	// Exactly Size bytes are read from Body.
+	Body io.Reader
+	// The upload service. If it's empty, one is discovered.
+	Service JID
+	// Does the upload. If it's nil, http.DefaultClient is used.
+	HttpClient *http.Client
+}
+
+// The only headers a client may copy from a slot to its upload.
+var uploadHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+	"Expires":       true,
+}
+
+// Uploads a file, and returns the URL from which it may be
+// downloaded, to be sent to others.
+func (cl *Client) Upload(ctx context.Context, f *UploadFile) (string, error) {
+	svc := f.Service
+	if svc == "" {
+		var max int64
+		var err error
+		svc, max, err = cl.UploadService(ctx)
+		if err != nil {
+			return "", err
+		}
+		if max > 0 && f.Size > max {
+			return "", fmt.Errorf("%s is %d bytes; %s accepts %d",
+				f.Filename, f.Size, svc, max)
+		}
+	}
+	slot, err := cl.UploadSlot(ctx, svc, &UploadRequest{
+		Filename: f.Filename, Size: f.Size,
+		ContentType: f.ContentType})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", slot.Put.Url,
+		io.LimitReader(f.Body, f.Size))
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = f.Size
+	if f.ContentType != "" {
+		req.Header.Set("Content-Type", f.ContentType)
+	}
+	for _, h := range slot.Put.Headers {
+		name := http.CanonicalHeaderKey(h.Name)
+		if uploadHeaders[name] {
+			value := strings.NewReplacer("\r", "", "\n", "").
+				Replace(h.Value)
+			req.Header.Set(name, value)
+		}
+	}
+	hc := f.HttpClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("upload of %s: %s", f.Filename, resp.Status)
+	}
+	return slot.Get.Url, nil
+}
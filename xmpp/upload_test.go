@@ -0,0 +1,63 @@
+package xmpp
+
+import (
+	"./forms"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUpload(t *testing.T) {
+	var got, auth, other string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		buf, _ := ioutil.ReadAll(r.Body)
+		got = string(buf)
+		auth = r.Header.Get("Authorization")
+		other = r.Header.Get("X-Other")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	send := make(chan Stanza, 1)
+	cl := &Client{Jid: "me@b.c/r", handlers: make(chan *callback, 1),
+		Send: send}
+	replies := []interface{}{
+		&DiscoItems{Items: []DiscoItem{{Jid: "muc.b.c"},
+			{Jid: "up.b.c"}}},
+		&DiscoInfo{Features: []DiscoFeature{{Var: NsMuc}}},
+		&DiscoInfo{Features: []DiscoFeature{{Var: NsHttpUpload}},
+			Forms: []forms.Form{{Type: forms.TypeResult, Fields: []forms.Field{
+				{Var: "FORM_TYPE", Values: []string{NsHttpUpload}},
+				{Var: "max-file-size", Values: []string{"100"}}}}}},
+		&UploadSlot{Put: UploadPut{Url: srv.URL + "/put",
+			Headers: []UploadHeader{{Name: "authorization",
+				Value: "Basic x\n"}, {Name: "X-Other", Value: "y"}}},
+			Get: UploadGet{Url: srv.URL + "/get"}},
+	}
+	go func() {
+		for _, r := range replies {
+			h := <-cl.handlers
+			iq := (<-send).(*Iq)
+			if req, ok := iq.Nested[0].(*UploadRequest); ok {
+				assertEquals(t, "up.b.c", string(iq.To))
+				assertEquals(t, "a.txt", req.Filename)
+			}
+			h.f(&Iq{Header: Header{Id: iq.Id, Type: "result",
+				Nested: []interface{}{r}}})
+		}
+	}()
+	f := &UploadFile{Filename: "a.txt", Size: 5, ContentType: "text/plain",
+		Body: strings.NewReader("hello, world")}
+	url, err := cl.Upload(context.Background(), f)
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	assertEquals(t, srv.URL+"/get", url)
+	assertEquals(t, "hello", got)
+	assertEquals(t, "Basic x", auth)
+	assertEquals(t, "", other)
+}
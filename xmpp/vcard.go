@@ -0,0 +1,152 @@
+package xmpp
+
+// This file contains support for vCards, XEP-0054, and vCard-based
+// avatars, XEP-0153.
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+)
+
+const (
+	NsVCard       = "vcard-temp"
+	NsVCardUpdate = "vcard-temp:x:update"
+)
+
+// A user's vCard.
+type VCard struct {
+	XMLName  xml.Name     `xml:"vcard-temp vCard"`
+	FN       string       `xml:"FN,omitempty"`
+	N        *VCardName   `xml:"N"`
+	Nickname string       `xml:"NICKNAME,omitempty"`
+	Photo    *VCardPhoto  `xml:"PHOTO"`
+	Birthday string       `xml:"BDAY,omitempty"`
+	Url      string       `xml:"URL,omitempty"`
+	Emails   []VCardEmail `xml:"EMAIL"`
+	Tels     []VCardTel   `xml:"TEL"`
+	Org      *VCardOrg    `xml:"ORG"`
+	Title    string       `xml:"TITLE,omitempty"`
+	Role     string       `xml:"ROLE,omitempty"`
+	Desc     string       `xml:"DESC,omitempty"`
+	JabberId JID          `xml:"JABBERID,omitempty"`
+}
+
+// The parts of a person's name.
+type VCardName struct {
+	Family string `xml:"FAMILY,omitempty"`
+	Given  string `xml:"GIVEN,omitempty"`
+	Middle string `xml:"MIDDLE,omitempty"`
+	Prefix string `xml:"PREFIX,omitempty"`
+	Suffix string `xml:"SUFFIX,omitempty"`
+}
+
+// An email address. The flags say what kind it is.
+type VCardEmail struct {
+	Home     *struct{} `xml:"HOME"`
+	Work     *struct{} `xml:"WORK"`
+	Internet *struct{} `xml:"INTERNET"`
+	Pref     *struct{} `xml:"PREF"`
+	UserId   string    `xml:"USERID"`
+}
+
+// A telephone number. The flags say what kind it is.
+type VCardTel struct {
+	Home   *struct{} `xml:"HOME"`
+	Work   *struct{} `xml:"WORK"`
+	Voice  *struct{} `xml:"VOICE"`
+	Cell   *struct{} `xml:"CELL"`
+	Pref   *struct{} `xml:"PREF"`
+	Number string    `xml:"NUMBER"`
+}
+
+type VCardOrg struct {
+	Name string `xml:"ORGNAME"`
+	Unit string `xml:"ORGUNIT,omitempty"`
+}
+
+// A photo in a vCard, either included as base64 data or referred to
+// by URL.
+type VCardPhoto struct {
+	Type   string `xml:"TYPE,omitempty"`
+	BinVal string `xml:"BINVAL,omitempty"`
+	ExtVal string `xml:"EXTVAL,omitempty"`
+}
+
+// Included in presence to advertise the hash of the vCard photo. A
+// nil Photo means the client isn't ready to advertise one; an empty
+// one means there's no photo.
+type VCardUpdate struct {
+	XMLName xml.Name `xml:"vcard-temp:x:update x"`
+	Photo   *string  `xml:"photo"`
+}
+
+// VCardExt may be included in the extensions passed to NewClient to
+// decode vCards in incoming iq results and photo hashes in presence.
+var VCardExt Extension = Extension{}
+
+func init() {
+	VCardExt.StanzaTypes = make(map[xml.Name]reflect.Type)
+	vName := xml.Name{Space: NsVCard, Local: "vCard"}
+	VCardExt.StanzaTypes[vName] = reflect.TypeOf(VCard{})
+	vName = xml.Name{Space: NsVCardUpdate, Local: "x"}
+	VCardExt.StanzaTypes[vName] = reflect.TypeOf(VCardUpdate{})
+}
+
+// Returns the photo hash advertised in the presence, if any.
+func (p *Presence) VCardPhotoHash() (string, bool) {
+	for _, ele := range p.Nested {
+		if u, ok := ele.(*VCardUpdate); ok && u.Photo != nil {
+			return *u.Photo, true
+		}
+	}
+	return "", false
+}
+
+// Sets the photo to the given image, which is included in the vCard
+// as base64 data.
+func (vc *VCard) SetPhoto(typ string, data []byte) {
+	vc.Photo = &VCardPhoto{Type: typ,
+		BinVal: base64.StdEncoding.EncodeToString(data)}
+}
+
+// Returns the photo included in the vCard, with its hash and MIME
+// type, or nil if there's none. A photo only referred to by URL
+// isn't fetched.
+func (vc *VCard) Avatar() (*Avatar, error) {
+	if vc.Photo == nil || vc.Photo.BinVal == "" {
+		return nil, nil
+	}
+	av, err := decodeAvatar(vc.Photo.Type, vc.Photo.BinVal)
+	if err != nil {
+		return nil, fmt.Errorf("bad vCard photo: %v", err)
+	}
+	return av, nil
+}
+
+// Fetches the vCard of the given entity, or the client's own if jid
+// is empty. An entity without one gives an empty vCard.
+func (cl *Client) VCard(ctx context.Context, jid JID) (*VCard, error) {
+	iq := &Iq{Header: Header{To: jid.Bare(), Type: "get",
+		Nested: []interface{}{&VCard{}}}}
+	reply, err := cl.SendIq(ctx, iq)
+	if err != nil {
+		return nil, err
+	}
+	for _, ele := range reply.Nested {
+		if vc, ok := ele.(*VCard); ok {
+			return vc, nil
+		}
+	}
+	return &VCard{}, nil
+}
+
+// Publishes the client's own vCard, replacing the whole of the old
+// one.
+func (cl *Client) SetVCard(ctx context.Context, vc *VCard) error {
+	iq := &Iq{Header: Header{Type: "set", Nested: []interface{}{vc}}}
+	_, err := cl.SendIq(ctx, iq)
+	return err
+}
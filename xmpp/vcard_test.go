@@ -0,0 +1,50 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+)
+
+func TestVCard(t *testing.T) {
+	str := `<vCard xmlns="vcard-temp"><FN>Al Jones</FN>` +
+		`<N><FAMILY>Jones</FAMILY><GIVEN>Al</GIVEN></N>` +
+		`<EMAIL><INTERNET/><PREF/><USERID>al@b.c</USERID></EMAIL>` +
+		`<PHOTO><TYPE>image/png</TYPE><BINVAL>YW` + "\n" + `Jj</BINVAL></PHOTO>` +
+		`</vCard>`
+	var vc VCard
+	if err := xml.Unmarshal([]byte(str), &vc); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	assertEquals(t, "Jones", vc.N.Family)
+	if len(vc.Emails) != 1 || vc.Emails[0].Pref == nil ||
+		vc.Emails[0].Home != nil {
+		t.Errorf("emails %+v", vc.Emails)
+	}
+	av, err := vc.Avatar()
+	if err != nil || av == nil {
+		t.Fatalf("Avatar: %v %v", av, err)
+	}
+	assertEquals(t, "image/png", av.Type)
+	assertEquals(t, "abc", string(av.Data))
+	assertEquals(t, "a9993e364706816aba3e25717850c26c9cd0d89d", av.Hash)
+
+	send := make(chan Stanza, 1)
+	cl := &Client{handlers: make(chan *callback, 1), Send: send}
+	sent := make(chan string, 1)
+	go func() {
+		h := <-cl.handlers
+		iq := (<-send).(*Iq)
+		buf, _ := xml.Marshal(iq.Nested[0])
+		sent <- string(iq.To) + " " + string(buf)
+		h.f(&Iq{Header: Header{Id: iq.Id, Type: "result"}})
+	}()
+	vc = VCard{Nickname: "al"}
+	vc.SetPhoto("image/gif", []byte("abc"))
+	if err := cl.SetVCard(context.Background(), &vc); err != nil {
+		t.Fatalf("SetVCard: %v", err)
+	}
+	assertEquals(t, ` <vCard xmlns="vcard-temp"><NICKNAME>al</NICKNAME>`+
+		`<PHOTO><TYPE>image/gif</TYPE><BINVAL>YWJj</BINVAL></PHOTO>`+
+		`</vCard>`, <-sent)
+}
@@ -0,0 +1,213 @@
+package xmpp
+
+// This file contains software version, XEP-0092, and entity time,
+// XEP-0202: answering other entities' queries about the client, and
+// asking them about themselves.
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+const (
+	NsVersion = "jabber:iq:version"
+	NsTime    = "urn:xmpp:time"
+)
+
+// The software an entity runs. In a query, all of it is empty.
+type SoftwareVersion struct {
+	XMLName xml.Name `xml:"jabber:iq:version query"`
+	Name    string   `xml:"name,omitempty"`
+	Version string   `xml:"version,omitempty"`
+	// The operating system, which many clients don't disclose.
+	OS string `xml:"os,omitempty"`
+}
+
+// An entity's time, and its offset from UTC. In a query, both are
+// empty.
+type EntityTime struct {
+	XMLName xml.Name `xml:"urn:xmpp:time time"`
+	// Such as "+02:00", or "Z".
+	Tzo string `xml:"tzo,omitempty"`
+	// In UTC, as in XEP-0082.
+	Utc string `xml:"utc,omitempty"`
+}
+
+// Returns the entity's time in its own zone.
+func (et *EntityTime) Time() (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, et.Utc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if et.Tzo == "" || et.Tzo == "Z" {
+		return t, nil
+	}
+	var sign byte
+	var h, m int
+	if _, err := fmt.Sscanf(et.Tzo, "%c%d:%d", &sign, &h, &m); err != nil ||
+		(sign != '+' && sign != '-') {
+		return time.Time{}, fmt.Errorf("bad time zone offset %q", et.Tzo)
+	}
+	offset := h*3600 + m*60
+	if sign == '-' {
+		offset = -offset
+	}
+	return t.In(time.FixedZone(et.Tzo, offset)), nil
+}
+
+// Returns an extension which has the client answer software version
+// queries with v. Leave out what shouldn't be disclosed, such as OS.
+func VersionExt(v SoftwareVersion) Extension {
+	return Extension{Features: []string{NsVersion},
+		option: func(o *options) {
+			o.version = &v
+		}}
+}
+
+// Returns an extension which has the client answer entity time
+// queries, giving the time in loc, or the local time zone if it's
+// nil. time.UTC hides where the user is.
+func EntityTimeExt(loc *time.Location) Extension {
+	if loc == nil {
+		loc = time.Local
+	}
+	return Extension{Features: []string{NsTime},
+		option: func(o *options) {
+			o.timeLoc = loc
+		}}
+}
+
+// Answers software version, entity time and last activity queries,
+// if the options say to.
+type infoResponder struct {
+	Extension
+	version  *SoftwareVersion
+	timeLoc  *time.Location
+	idle     func() time.Duration
+	toServer chan Stanza
+	sendDone chan bool
+}
+
+func newInfoResponder(o *options) *infoResponder {
+	ir := &infoResponder{version: o.version, timeLoc: o.timeLoc,
+		idle: o.idle}
+	ir.toServer = make(chan Stanza)
+	ir.sendDone = make(chan bool)
+	ir.StanzaTypes = make(map[xml.Name]reflect.Type)
+	vName := xml.Name{Space: NsVersion, Local: "query"}
+	ir.StanzaTypes[vName] = reflect.TypeOf(SoftwareVersion{})
+	tName := xml.Name{Space: NsTime, Local: "time"}
+	ir.StanzaTypes[tName] = reflect.TypeOf(EntityTime{})
+	lName := xml.Name{Space: NsLast, Local: "query"}
+	ir.StanzaTypes[lName] = reflect.TypeOf(LastActivity{})
+	ir.RecvFilter = ir.recvFilter
+	ir.SendFilter = ir.sendFilter
+	return ir
+}
+
+func (ir *infoResponder) recvFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for stan := range in {
+		iq, ok := stan.(*Iq)
+		if !ok || iq.Type != "get" || len(iq.Nested) != 1 {
+			out <- stan
+			continue
+		}
+		reply := &Iq{Header: Header{To: iq.From, Id: iq.Id,
+			Type: "result"}}
+		switch iq.Nested[0].(type) {
+		case *SoftwareVersion:
+			if ir.version == nil {
+				out <- stan
+				continue
+			}
+			v := *ir.version
+			reply.Nested = []interface{}{&v}
+		case *EntityTime:
+			if ir.timeLoc == nil {
+				out <- stan
+				continue
+			}
+			reply.Nested = []interface{}{entityTime(time.Now(),
+				ir.timeLoc)}
+		case *LastActivity:
+			if ir.idle == nil {
+				out <- stan
+				continue
+			}
+			reply.Nested = []interface{}{lastActivity(ir.idle())}
+		default:
+			out <- stan
+			continue
+		}
+		select {
+		case ir.toServer <- reply:
+		case <-ir.sendDone:
+		}
+	}
+}
+
+func (ir *infoResponder) sendFilter(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	defer close(ir.sendDone)
+	for {
+		select {
+		case stan, ok := <-in:
+			if !ok {
+				return
+			}
+			out <- stan
+		case stan := <-ir.toServer:
+			out <- stan
+		}
+	}
+}
+
+func entityTime(now time.Time, loc *time.Location) *EntityTime {
+	tzo := now.In(loc).Format("-07:00")
+	if tzo == "+00:00" {
+		tzo = "Z"
+	}
+	return &EntityTime{Tzo: tzo,
+		Utc: now.UTC().Format("2006-01-02T15:04:05.000Z")}
+}
+
+// Asks an entity what software it runs.
+func (cl *Client) SoftwareVersion(ctx context.Context,
+	jid JID) (*SoftwareVersion, error) {
+
+	iq := &Iq{Header: Header{To: jid, Type: "get",
+		Nested: []interface{}{&SoftwareVersion{}}}}
+	reply, err := cl.SendIq(ctx, iq)
+	if err != nil {
+		return nil, err
+	}
+	for _, ele := range reply.Nested {
+		if v, ok := ele.(*SoftwareVersion); ok {
+			return v, nil
+		}
+	}
+	return nil, errors.New("no software version in reply")
+}
+
+// Asks an entity its time. It's returned in the entity's zone.
+func (cl *Client) EntityTime(ctx context.Context, jid JID) (time.Time,
+	error) {
+
+	iq := &Iq{Header: Header{To: jid, Type: "get",
+		Nested: []interface{}{&EntityTime{}}}}
+	reply, err := cl.SendIq(ctx, iq)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, ele := range reply.Nested {
+		if et, ok := ele.(*EntityTime); ok {
+			return et.Time()
+		}
+	}
+	return time.Time{}, errors.New("no time in reply")
+}
@@ -0,0 +1,69 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func TestEntityTime(t *testing.T) {
+	now := time.Date(2006, 12, 19, 17, 58, 35, 0, time.UTC)
+	et := entityTime(now, time.FixedZone("CST", -6*3600))
+	assertEquals(t, "-06:00", et.Tzo)
+	assertEquals(t, "2006-12-19T17:58:35.000Z", et.Utc)
+	got, err := et.Time()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(now) || got.Format("15:04 -07:00") != "11:58 -06:00" {
+		t.Errorf("got %v", got)
+	}
+	assertEquals(t, "Z", entityTime(now, time.UTC).Tzo)
+	if _, err := (&EntityTime{Tzo: "six", Utc: et.Utc}).Time(); err == nil {
+		t.Error("bad offset accepted")
+	}
+}
+
+func TestVersionExt(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	s.AddUser("bob", "secret")
+	alice := mockClient(t, s, "alice@b.c/pc", "secret", &tls.Config{})
+	defer alice.Close()
+	jid := JID("bob@b.c/pc")
+	bob, err := NewClientFromConn(s.Dial(), &jid, "secret", &tls.Config{},
+		[]Extension{VersionExt(SoftwareVersion{Name: "bot",
+			Version: "1.0"}), EntityTimeExt(time.UTC)}, Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn: %v", err)
+	}
+	defer bob.Close()
+
+	ctx := context.Background()
+	v, err := alice.SoftwareVersion(ctx, jid)
+	if err != nil {
+		t.Fatalf("SoftwareVersion: %v", err)
+	}
+	assertEquals(t, "bot 1.0 ", v.Name+" "+v.Version+" "+v.OS)
+	at, err := alice.EntityTime(ctx, jid)
+	if err != nil {
+		t.Fatalf("EntityTime: %v", err)
+	}
+	if d := time.Since(at); d < 0 || d > time.Minute {
+		t.Errorf("time %v", at)
+	}
+
+	// Without the extensions, the queries are left to the
+	// application.
+	short, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := bob.SoftwareVersion(short, "alice@b.c/pc"); err == nil {
+		t.Error("alice answered")
+	}
+	if !bob.disco.info.HasFeature(NsVersion) ||
+		alice.disco.info.HasFeature(NsTime) {
+		t.Error("features not advertised as configured")
+	}
+}
@@ -0,0 +1,568 @@
+package xmpp
+
+// This file contains a transport which carries the XMPP stream over a
+// WebSocket, as RFC 7395 describes.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NsFraming = "urn:ietf:params:xml:ns:xmpp-framing"
+
+	// From RFC 6455, section 1.3.
+	wsGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// The largest message we'll accept from the server.
+	wsMaxMessage = 16 << 20
+)
+
+// WebSocket opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// Returns a Transport which connects to a ws:// or wss:// URL, for
+// NewClientWithFailover. The domain being connected to is ignored. See
+// DialWebSocket.
+func WebSocketTransport(rawurl string, tlsconf *tls.Config) Transport {
+	return Transport{Name: "websocket",
+		Dial: func(ctx context.Context, domain string) (net.Conn, error) {
+			return DialWebSocket(ctx, rawurl, tlsconf)
+		}}
+}
+
+// Opens a WebSocket to an XMPP server, negotiating the xmpp
+// subprotocol. The connection translates between the framing of RFC
+// 7395 and an ordinary XMPP stream, so it can be given to
+// NewClientFromConn. For wss:// URLs, tlsconf configures TLS; if it's
+// nil, the URL's host is verified against the system roots. Servers
+// don't offer STARTTLS over WebSockets, so a ws:// URL leaves the
+// session unencrypted.
+func DialWebSocket(ctx context.Context, rawurl string,
+	tlsconf *tls.Config) (net.Conn, error) {
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	var port string
+	switch u.Scheme {
+	case "ws":
+		port = "80"
+	case "wss":
+		port = "443"
+	default:
+		return nil, fmt.Errorf("not a WebSocket URL: %s", rawurl)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		conf := &tls.Config{}
+		if tlsconf != nil {
+			conf = tlsconf.Clone()
+		}
+		if conf.ServerName == "" {
+			conf.ServerName = u.Hostname()
+		}
+		tc := tls.Client(conn, conf)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	ws, err := wsHandshake(ctx, conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// Upgrades an HTTP connection to a WebSocket, RFC 6455 section 4.1.
+func wsHandshake(ctx context.Context, conn net.Conn, u *url.URL) (*wsConn,
+	error) {
+
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+		defer conn.SetDeadline(time.Time{})
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{Method: "GET", URL: u, Host: u.Host,
+		Header: make(http.Header)}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", "xmpp")
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("WebSocket handshake: %s", resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		return nil, fmt.Errorf("WebSocket handshake: bad upgrade %q",
+			resp.Header.Get("Upgrade"))
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return nil, fmt.Errorf("WebSocket handshake: bad accept key")
+	}
+	if resp.Header.Get("Sec-WebSocket-Protocol") != "xmpp" {
+		return nil, fmt.Errorf("WebSocket server doesn't speak xmpp")
+	}
+	return newWsConn(conn, br, true), nil
+}
+
+// The value of Sec-WebSocket-Accept expected for a key.
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGuid))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Reads one frame. Control frames may come between the fragments of
+// a message.
+func wsReadFrame(r io.Reader) (fin bool, op byte, payload []byte,
+	err error) {
+
+	var hdr [2]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	fin = hdr[0]&0x80 != 0
+	op = hdr[0] & 0xf
+	masked := hdr[1]&0x80 != 0
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > wsMaxMessage {
+		err = fmt.Errorf("WebSocket frame of %d bytes is too large", n)
+		return
+	}
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(r, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// Writes one unfragmented frame. Clients must mask their frames, and
+// servers must not.
+func wsWriteFrame(w io.Writer, op byte, payload []byte, masked bool) error {
+	var buf bytes.Buffer
+	buf.WriteByte(0x80 | op)
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	n := len(payload)
+	switch {
+	case n < 126:
+		buf.WriteByte(maskBit | byte(n))
+	case n <= 0xffff:
+		buf.WriteByte(maskBit | 126)
+		binary.Write(&buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(maskBit | 127)
+		binary.Write(&buf, binary.BigEndian, uint64(n))
+	}
+	if masked {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		buf.Write(mask[:])
+		for i, c := range payload {
+			buf.WriteByte(c ^ mask[i%4])
+		}
+	} else {
+		buf.Write(payload)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// A WebSocket carrying XMPP, which looks like an ordinary XMPP stream
+// to the layers above.
+type wsConn struct {
+	msgReader
+	conn   net.Conn
+	br     *bufio.Reader
+	masked bool
+	// Protects the writing side.
+	wlock  sync.Mutex
+	split  xmlSplitter
+	closed bool
+}
+
+func newWsConn(conn net.Conn, br *bufio.Reader, masked bool) *wsConn {
+	c := &wsConn{conn: conn, br: br, masked: masked}
+	c.input = make(chan []byte, 16)
+	go c.reader()
+	return c
+}
+
+func (c *wsConn) reader() {
+	defer close(c.input)
+	var msg []byte
+	for {
+		fin, op, payload, err := wsReadFrame(c.br)
+		if err != nil {
+			c.err = err
+			return
+		}
+		switch op {
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.writeFrame(wsClose, payload)
+			c.err = io.EOF
+			return
+		}
+		msg = append(msg, payload...)
+		if len(msg) > wsMaxMessage {
+			c.err = fmt.Errorf("WebSocket message is too large")
+			return
+		}
+		if !fin {
+			continue
+		}
+		data, err := wsFromFraming(msg)
+		msg = nil
+		if err != nil {
+			c.err = err
+			return
+		}
+		c.input <- data
+	}
+}
+
+// Translates a message from the server into part of an XMPP stream.
+// The open and close elements stand for the stream's start and end
+// tags.
+func wsFromFraming(msg []byte) ([]byte, error) {
+	p := xml.NewDecoder(bytes.NewReader(msg))
+	for {
+		t, err := p.Token()
+		if err != nil {
+			return nil, fmt.Errorf("WebSocket message: %v", err)
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if se.Name.Space != NsFraming {
+			return msg, nil
+		}
+		switch se.Name.Local {
+		case "open":
+			st, _ := parseStream(se)
+			return []byte(st.String()), nil
+		case "close":
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("unknown framing element %s",
+			se.Name.Local)
+	}
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return wsWriteFrame(c.conn, op, payload, c.masked)
+}
+
+// Reads from messages which arrive on a channel, for transports
+// which are message-based rather than byte stream-based. Once the
+// channel has been closed, err says why. Only one goroutine may read.
+type msgReader struct {
+	input   chan []byte
+	pending []byte
+	err     error
+	// Protects the read deadline.
+	lock     sync.Mutex
+	deadline time.Time
+}
+
+func (c *msgReader) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		c.lock.Lock()
+		deadline := c.deadline
+		c.lock.Unlock()
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case data, ok := <-c.input:
+			if !ok {
+				return 0, c.err
+			}
+			c.pending = data
+		case <-timeout:
+			return 0, timeoutError{}
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Splits what the client writes into top-level elements, and sends
+// each one as a message.
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	for _, piece := range c.split.write(b) {
+		var msg []byte
+		switch {
+		case piece.stream != nil:
+			msg = wsOpen(piece.stream)
+		case piece.end:
+			msg = []byte(`<close xmlns="` + NsFraming + `"/>`)
+		default:
+			msg = piece.elem
+		}
+		if err := wsWriteFrame(c.conn, wsText, msg, c.masked); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// The open element which replaces a stream header.
+func wsOpen(st *stream) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`<open xmlns="` + NsFraming + `"`)
+	if st.To != "" {
+		buf.WriteString(` to="`)
+		xml.Escape(&buf, []byte(st.To))
+		buf.WriteString(`"`)
+	}
+	if st.Lang != "" {
+		buf.WriteString(` xml:lang="`)
+		xml.Escape(&buf, []byte(st.Lang))
+		buf.WriteString(`"`)
+	}
+	buf.WriteString(` version="` + XMPPVersion + `"/>`)
+	return buf.Bytes()
+}
+
+// Describes the TLS connection under a wss:// WebSocket.
+func (c *wsConn) ConnectionState() tls.ConnectionState {
+	if tc, ok := c.conn.(*tls.Conn); ok {
+		return tc.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+func (c *wsConn) Close() error {
+	c.wlock.Lock()
+	if c.closed {
+		c.wlock.Unlock()
+		return nil
+	}
+	c.closed = true
+	// Status code 1000, normal closure.
+	wsWriteFrame(c.conn, wsClose, []byte{0x03, 0xe8}, c.masked)
+	c.wlock.Unlock()
+	return c.conn.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *msgReader) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// One piece of the stream the client writes: a stream header, the
+// end of the stream, or a complete top-level element.
+type xmlPiece struct {
+	stream *stream
+	end    bool
+	elem   []byte
+}
+
+// Splits the XML stream the client writes into pieces, however it
+// happens to be divided among writes. This relies on the client
+// writing well-formed XML.
+type xmlSplitter struct {
+	buf []byte
+	// How far into buf has been scanned, and the depth there.
+	pos, depth int
+}
+
+func (s *xmlSplitter) write(b []byte) []xmlPiece {
+	s.buf = append(s.buf, b...)
+	var pieces []xmlPiece
+	for s.pos < len(s.buf) {
+		rest := s.buf[s.pos:]
+		if rest[0] != '<' {
+			i := bytes.IndexByte(rest, '<')
+			if i < 0 {
+				i = len(rest)
+			}
+			if s.depth == 0 {
+				// Whitespace between elements.
+				s.buf = s.buf[s.pos+i:]
+				s.pos = 0
+			} else {
+				s.pos += i
+			}
+			continue
+		}
+		n := xmlMarkupEnd(rest)
+		if n < 0 {
+			break
+		}
+		tag := rest[:n]
+		s.pos += n
+		switch {
+		case bytes.HasPrefix(tag, []byte("<?")),
+			bytes.HasPrefix(tag, []byte("<!--")) && s.depth == 0:
+			s.buf = s.buf[s.pos:]
+			s.pos = 0
+			continue
+		case bytes.HasPrefix(tag, []byte("<!")):
+			continue
+		case bytes.HasPrefix(tag, []byte("</")):
+			if s.depth == 0 {
+				// The end of the stream.
+				pieces = append(pieces, xmlPiece{end: true})
+				s.buf = s.buf[s.pos:]
+				s.pos = 0
+				continue
+			}
+			s.depth--
+		case bytes.HasSuffix(tag, []byte("/>")):
+		case s.depth == 0 && bytes.HasPrefix(tag, []byte("<stream:stream")):
+			pieces = append(pieces, xmlPiece{stream: parseStreamTag(tag)})
+			s.buf = s.buf[s.pos:]
+			s.pos = 0
+			continue
+		default:
+			s.depth++
+		}
+		if s.depth == 0 {
+			elem := make([]byte, s.pos)
+			copy(elem, s.buf)
+			pieces = append(pieces, xmlPiece{elem: elem})
+			s.buf = s.buf[s.pos:]
+			s.pos = 0
+		}
+	}
+	return pieces
+}
+
+// Returns the length of the tag, comment, or CDATA section at the
+// start of b, or -1 if it isn't complete.
+func xmlMarkupEnd(b []byte) int {
+	for _, delim := range [][2]string{{"<!--", "-->"},
+		{"<![CDATA[", "]]>"}} {
+		if bytes.HasPrefix(b, []byte(delim[0])) {
+			i := bytes.Index(b, []byte(delim[1]))
+			if i < 0 {
+				return -1
+			}
+			return i + len(delim[1])
+		}
+	}
+	return tagEnd(b)
+}
+
+func parseStreamTag(tag []byte) *stream {
+	p := xml.NewDecoder(bytes.NewReader(tag))
+	p.Strict = false
+	t, _ := p.Token()
+	se, ok := t.(xml.StartElement)
+	if !ok {
+		return &stream{}
+	}
+	st, _ := parseStream(se)
+	return st
+}
@@ -0,0 +1,105 @@
+package xmpp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestXmlSplitter(t *testing.T) {
+	var s xmlSplitter
+	var got []string
+	input := `<?xml version='1.0'?><stream:stream xmlns="jabber:client" ` +
+		`xmlns:stream="http://etherx.jabber.org/streams" to="example.com" ` +
+		`version="1.0"> <message to="a@b"><body a="x>y">hi<![CDATA[<x>]]>` +
+		`</body></message><presence/></stream:stream>`
+	// Feed it a few bytes at a time.
+	for i := 0; i < len(input); i += 7 {
+		end := i + 7
+		if end > len(input) {
+			end = len(input)
+		}
+		for _, p := range s.write([]byte(input[i:end])) {
+			switch {
+			case p.stream != nil:
+				got = append(got, "stream to "+p.stream.To)
+			case p.end:
+				got = append(got, "end")
+			default:
+				got = append(got, string(p.elem))
+			}
+		}
+	}
+	assertEquals(t, `stream to example.com|<message to="a@b"><body a="x>y">`+
+		`hi<![CDATA[<x>]]></body></message>|<presence/>|end`,
+		strings.Join(got, "|"))
+}
+
+func TestWebSocket(t *testing.T) {
+	frames := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		if r.Header.Get("Sec-WebSocket-Protocol") != "xmpp" {
+			t.Errorf("no xmpp protocol requested")
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Protocol: xmpp\r\n" +
+			"Sec-WebSocket-Accept: " +
+			wsAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+		brw.Flush()
+		for {
+			_, op, payload, err := wsReadFrame(brw)
+			if err != nil || op == wsClose {
+				close(frames)
+				return
+			}
+			frames <- string(payload)
+			if strings.HasPrefix(string(payload), "<open") {
+				wsWriteFrame(conn, wsText, []byte(`<open xmlns="`+
+					NsFraming+`" from="example.com" id="s1" `+
+					`version="1.0"/>`), false)
+				wsWriteFrame(conn, wsPing, []byte("p"), false)
+				wsWriteFrame(conn, wsText, []byte(`<stream:features `+
+					`xmlns:stream="`+NsStream+`"/>`), false)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	conn, err := DialWebSocket(context.Background(), url, nil)
+	if err != nil {
+		t.Fatalf("DialWebSocket: %v", err)
+	}
+	st := &stream{To: "example.com", Version: XMPPVersion}
+	conn.Write([]byte(st.String()))
+	assertEquals(t, `<open xmlns="`+NsFraming+`" to="example.com" `+
+		`version="1.0"/>`, <-frames)
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	assertEquals(t, (&stream{From: "example.com", Id: "s1",
+		Version: "1.0"}).String(), string(buf[:n]))
+	// The ping is answered.
+	assertEquals(t, "p", <-frames)
+	n, _ = conn.Read(buf)
+	assertEquals(t, `<stream:features xmlns:stream="`+NsStream+`"/>`,
+		string(buf[:n]))
+
+	conn.Write([]byte(`<message to="a@b"><body>hi</body>`))
+	conn.Write([]byte(`</message>`))
+	assertEquals(t, `<message to="a@b"><body>hi</body></message>`, <-frames)
+	conn.Close()
+}
@@ -4,16 +4,30 @@
 // bottom and the application at the top. The application receives and
 // sends structures representing XMPP stanzas. Additional stanza
 // parsers can be inserted into the stack of layers as extensions.
+//
+// Most XEPs are implemented in this package, as extensions. Larger
+// ones are subpackages, built on the same exported API an
+// application's own extensions use:
+//
+//	forms  data forms, XEP-0004, which many of the XEPs embed
+//	jingle Jingle sessions, XEP-0166, and file transfer over them
+//	muc    joined multi-user chat rooms, XEP-0045
+//	omemo  OMEMO encryption of one-to-one messages, XEP-0384
+//	pubsub subscriptions and node management, XEP-0060
 package xmpp
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"reflect"
+	"strconv"
 	"sync"
+	"time"
 )
 
 const (
@@ -23,6 +37,7 @@ const (
 	// Various XML namespaces.
 	NsClient  = "jabber:client"
 	NsStreams = "urn:ietf:params:xml:ns:xmpp-streams"
+	NsStanzas = "urn:ietf:params:xml:ns:xmpp-stanzas"
 	NsStream  = "http://etherx.jabber.org/streams"
 	NsTLS     = "urn:ietf:params:xml:ns:xmpp-tls"
 	NsSASL    = "urn:ietf:params:xml:ns:xmpp-sasl"
@@ -33,12 +48,15 @@ const (
 	// DNS SRV names
 	serverSrv = "xmpp-server"
 	clientSrv = "xmpp-client"
+	// Direct TLS, XEP-0368
+	directTlsSrv = "xmpps-client"
 )
 
 // A filter can modify the XMPP traffic to or from the remote
 // server. It's part of an Extension. The filter function will be
 // called in a new goroutine, so it doesn't need to return. The filter
-// should close its output when its input is closed.
+// should close its output when its input is closed. Middleware is
+// simpler to write, and can be removed again.
 type Filter func(in <-chan Stanza, out chan<- Stanza)
 
 // Extensions can add stanza filters and/or new XML element types.
@@ -52,6 +70,85 @@ type Extension struct {
 	// intercepts messages going the other direction.
 	RecvFilter Filter
 	SendFilter Filter
+	// If non-nil, added to the client's pipelines with
+	// AddRecvMiddleware and AddSendMiddleware, at MiddlewareOrder,
+	// before anything is received.
+	RecvMiddleware, SendMiddleware Middleware
+	MiddlewareOrder                int
+	// If non-nil, will be called in a new goroutine once the
+	// session is running and the initial presence has been sent.
+	Start func(cl *Client)
+	// If non-nil, will be called once the session has ended, or
+	// when an extension added with RegisterExtension is
+	// unregistered.
+	Stop func(cl *Client)
+	// If non-nil, will be called once the session is running but
+	// before the roster is requested and the initial presence is
+	// sent. The session doesn't proceed until it returns, and
+	// stanzas other than replies to its own iqs can't be delivered
+	// meanwhile. It's called again whenever ReconnectExt starts a
+	// new session.
+	BeforePresence func(cl *Client)
+	// The disco#info features the extension adds to those the
+	// client reports, XEP-0030.
+	Features []string
+	// Extensions which are really options, like
+	// StreamManagementExt, change the client's settings with this
+	// before it connects.
+	option func(o *options)
+	// Set if the extension's filters go nearest the network,
+	// after those of every other extension, so that they see what
+	// the others send.
+	nearNetwork bool
+}
+
+// Settings which option extensions change.
+type options struct {
+	streamMgmt   bool
+	tokens       TokenProvider
+	directTls    DirectTlsMode
+	tlsPolicy    TlsPolicy
+	verify       TlsVerifier
+	reconnect    *ReconnectConfig
+	rosterCache  RosterCache
+	identities   []DiscoIdentity
+	keepalive    *KeepaliveConfig
+	register     RegisterFunc
+	compress     bool
+	logger       Logger
+	traffic      func(outbound bool, xml []byte)
+	capture      *Capture
+	stats        StatsCollector
+	sendQueue    int
+	dialer       Dialer
+	limits       ParserLimits
+	ids          func() string
+	version      *SoftwareVersion
+	timeLoc      *time.Location
+	idle         func() time.Duration
+	sasl2        *UserAgent
+	carbons      bool
+	server       *ServerAddress
+	storage      Storage
+	maxCallbacks int
+	saslPolicy   *SaslPolicy
+	langs        []string
+	hostMeta     bool
+	// Set by a ClientManager.
+	capsVers *capsVers
+	srv      *srvCache
+	pace     func(delay time.Duration) time.Duration
+}
+
+// Collects the settings made by option extensions.
+func newOptions(exts []Extension) options {
+	var o options
+	for _, ext := range exts {
+		if ext.option != nil {
+			ext.option(&o)
+		}
+	}
+	return o
 }
 
 // The client in a client-server XMPP connection.
@@ -60,8 +157,23 @@ type Client struct {
 	Jid          JID
 	password     string
 	saslExpected string
+	scram        *scramClient
+	saslMech     string
+	opts         options
 	authDone     bool
-	handlers     chan *callback
+	// Set while authenticating with SASL2.
+	sasl2 bool
+	// The strongest SASL mechanism the server has offered.
+	saslBest string
+	// The namespaces of the features asked to be enabled along with
+	// binding a resource with Bind 2, and those which were. Inlined
+	// is nil if the resource was bound the old way.
+	inlining, inlined map[string]bool
+	// Set once the account has been created with RegisterExt.
+	registered bool
+	// Set once compression has been asked for on this connection.
+	compressTried bool
+	handlers      chan *callback
 	// Incoming XMPP stanzas from the remote will be published on
 	// this channel. Information which is used by this library to
 	// set up the XMPP stream will not appear here.
@@ -71,57 +183,140 @@ type Client struct {
 	// rather, call Close().
 	Send    chan<- Stanza
 	sendRaw chan<- interface{}
-	statmgr *statmgr
+	// Closed once nothing more can be sent on sendRaw.
+	sendQuit <-chan bool
+	statmgr  *statmgr
+	caps     *capsCache
 	// The client's roster is also known as the buddy list. It's
 	// the set of contacts which are known to this JID, or which
 	// this JID is known to.
 	Roster Roster
 	// Features advertised by the remote.
-	Features                     *Features
+	Features *Features
+	// Set if the client is an external component, XEP-0114.
+	component bool
+	// The name of the transport the session runs over, if it was
+	// chosen by NewClientWithFailover.
+	Transport                    string
 	sendFilterAdd, recvFilterAdd chan Filter
+	recvPipeline, sendPipeline   *pipeline
 	tlsConfig                    *tls.Config
 	layer1                       *layer1
-	error                        chan error
-	shutdownOnce                 sync.Once
+	sm                           *streamMgmt
+	rc                           *reconnector
+	// The extensions the client was created with, and those
+	// registered since.
+	extensions *extRegistry
+	disco      *discoResponder
+	// Makes a new connection to the server, for resuming the
+	// stream or reconnecting. Nil if the client was given its connection.
+	redial       func(ctx context.Context) (net.Conn, error)
+	error        chan error
+	shutdownOnce sync.Once
+	// Once the session has ended, Done delivers the error it ended
+	// with, such as a *StreamError from the server, and is then
+	// closed. Nothing is delivered if the application closed the
+	// client.
+	Done     <-chan error
+	done     chan error
+	doneLock sync.Mutex
+	doneErr  error
+	// The default language of the server's stream.
+	langLock   sync.Mutex
+	streamLang string
+	// Closed when the client closes, before Send is. The library's
+	// own sends to Send hold sendLock for reading, so that Send
+	// isn't closed under them.
+	closing  chan bool
+	sendLock sync.RWMutex
+	// Closed once the end of the stream has been handed to be
+	// written, once the server has ended its stream after that,
+	// and once Recv has been closed.
+	ended, serverEnded chan bool
+	serverEndOnce      sync.Once
+	recvDone           chan bool
+	// What SendContext queues, and whether the connection has been
+	// lost since the session started running.
+	queue        chan Stanza
+	disconnected int32
+	// Whether the session has gone invisible, and how.
+	invisible int32
+	// The handlers of HandleIq.
+	iqs iqRegistry
 }
 
 // Creates an XMPP client identified by the given JID, authenticating
 // with the provided password and TLS config. Zero or more extensions
 // may be specified. The initial presence will be broadcast. If status
 // is non-nil, connection progress information will be sent on it.
+// Direct TLS endpoints are used if the domain advertises them; see
+// DirectTlsExt. ServerAddressExt connects elsewhere.
 func NewClient(jid *JID, password string, tlsconf *tls.Config, exts []Extension,
 	pr Presence, status chan<- Status) (*Client, error) {
 
-	// Resolve the domain in the JID.
-	domain := jid.Domain()
-	_, srvs, err := net.LookupSRV(clientSrv, "tcp", domain)
-	if err != nil {
-		return nil, fmt.Errorf("LookupSrv %s: %v", domain, err)
-	}
-	if len(srvs) == 0 {
-		return nil, fmt.Errorf("LookupSrv %s: no results", domain)
-	}
+	return NewClientContext(context.Background(), jid, password, tlsconf,
+		exts, pr, status)
+}
 
-	var tcp *net.TCPConn
-	for _, srv := range srvs {
-		addrStr := fmt.Sprintf("%s:%d", srv.Target, srv.Port)
-		var addr *net.TCPAddr
-		addr, err = net.ResolveTCPAddr("tcp", addrStr)
-		if err != nil {
-			err = fmt.Errorf("ResolveTCPAddr(%s): %s",
-				addrStr, err.Error())
-			continue
-		}
-		tcp, err = net.DialTCP("tcp", nil, addr)
-		if tcp != nil {
-			break
+// Like NewClient, but gives up if the context is done before the
+// session is running. Once the client has been returned, the context
+// has no effect.
+func NewClientContext(ctx context.Context, jid *JID, password string,
+	tlsconf *tls.Config, exts []Extension, pr Presence,
+	status chan<- Status) (*Client, error) {
+
+	opts := newOptions(exts)
+	mode := opts.directTls
+	if opts.tlsPolicy == TlsDisabled {
+		mode = DirectTlsNever
+	}
+	conf := opts.tlsConfig(tlsconf, jid.Domain())
+	redial := func(ctx context.Context) (net.Conn, error) {
+		if opts.server != nil {
+			return dialServer(ctx, &opts, jid.Domain(), conf)
 		}
+		return dialDomain(ctx, &opts, jid.Domain(), conf, mode)
 	}
-	if tcp == nil {
+	tcp, err := redial(ctx)
+	if err != nil {
 		return nil, err
 	}
 
-	return newClient(tcp, jid, password, tlsconf, exts, pr, status)
+	return newClientContext(ctx, tcp, redial, jid, password, tlsconf,
+		exts, pr, status)
+}
+
+// Runs newClient, closing the connection if the context is done
+// before the session is running.
+func newClientContext(ctx context.Context, sock net.Conn,
+	redial func(context.Context) (net.Conn, error), jid *JID,
+	password string, tlsconf *tls.Config, exts []Extension, pr Presence,
+	status chan<- Status) (*Client, error) {
+
+	negotiated := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sock.Close()
+		case <-negotiated:
+		}
+	}()
+	cl, err := newClient(sock, redial, jid, password, tlsconf, exts, pr,
+		status)
+	close(negotiated)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return cl, err
+}
+
+// Looks up SRV records. Replaced by the tests.
+var lookupSRV = net.DefaultResolver.LookupSRV
+
+// Resolve the domain's client SRV records, and connect to the first
+// server which answers.
+func dialSrv(ctx context.Context, domain string) (net.Conn, error) {
+	return dialDomain(ctx, nil, domain, nil, DirectTlsNever)
 }
 
 // Connect to the specified host and port. This is otherwise identical
@@ -130,139 +325,405 @@ func NewClientFromHost(jid *JID, password string, tlsconf *tls.Config,
 	exts []Extension, pr Presence, status chan<- Status, host string,
 	port int) (*Client, error) {
 
-	addrStr := fmt.Sprintf("%s:%d", host, port)
-	addr, err := net.ResolveTCPAddr("tcp", addrStr)
-	if err != nil {
-		return nil, err
+	addrStr := net.JoinHostPort(host, strconv.Itoa(port))
+	d := newOptions(exts).dialer
+	redial := func(ctx context.Context) (net.Conn, error) {
+		return dialWith(ctx, d, addrStr)
 	}
-	tcp, err := net.DialTCP("tcp", nil, addr)
+	tcp, err := redial(context.Background())
 	if err != nil {
 		return nil, err
 	}
 
-	return newClient(tcp, jid, password, tlsconf, exts, pr, status)
+	return newClient(tcp, redial, jid, password, tlsconf, exts, pr,
+		status)
+}
+
+// Run an XMPP session over a connection which has already been
+// established, such as a tunnel or one end of net.Pipe, instead of
+// dialing the server. This is otherwise identical to NewClient.
+func NewClientFromConn(conn net.Conn, jid *JID, password string,
+	tlsconf *tls.Config, exts []Extension, pr Presence,
+	status chan<- Status) (*Client, error) {
+
+	return newClient(conn, nil, jid, password, tlsconf, exts, pr,
+		status)
 }
 
-func newClient(tcp *net.TCPConn, jid *JID, password string, tlsconf *tls.Config,
-	exts []Extension, pr Presence, status chan<- Status) (*Client, error) {
+// Run an XMPP session over an arbitrary byte stream. If rw is also an
+// io.Closer, it's closed when the session ends. Since a plain
+// ReadWriter has no read deadlines, the session only notices it's
+// been closed when the next read returns. This is otherwise
+// identical to NewClientFromConn.
+func NewClientFromReadWriter(rw io.ReadWriter, jid *JID, password string,
+	tlsconf *tls.Config, exts []Extension, pr Presence,
+	status chan<- Status) (*Client, error) {
+
+	return newClient(&rwConn{rw}, nil, jid, password, tlsconf, exts,
+		pr, status)
+}
+
+func newClient(sock net.Conn, redial func(context.Context) (net.Conn, error),
+	jid *JID, password string, tlsconf *tls.Config, exts []Extension,
+	pr Presence, status chan<- Status) (*Client, error) {
 
 	// Include the mandatory extensions.
-	roster := newRosterExt()
+	opts := newOptions(exts)
+	roster := newRosterExt(opts.rosterCacheFor(*jid))
 	exts = append(exts, roster.Extension)
 	exts = append(exts, bindExt)
+	caps := newCapsCache()
+	exts = append(exts, caps.Extension)
+	exts = append(exts, newPingResponder().Extension)
 
-	cl := new(Client)
+	cl := newBareClient(jid, password, status)
+	cl.caps = caps
 	cl.Roster = *roster
+	cl.redial = redial
+	cl.opts = newOptions(exts)
+	if cl.opts.capsVers != nil {
+		caps.vers = cl.opts.capsVers
+	}
+	if cl.opts.storage != nil {
+		caps.vers.useStorage(cl.opts.storage)
+	}
+	cl.tlsConfig = cl.opts.tlsConfig(tlsconf, jid.Domain())
+	if cl.opts.streamMgmt {
+		cl.sm = &streamMgmt{}
+	}
+	if cl.opts.reconnect != nil {
+		cl.rc = &reconnector{conf: *cl.opts.reconnect, presence: pr}
+	}
+	exts = append(exts, newInfoResponder(&cl.opts).Extension)
+	info := ownDiscoInfo(exts, cl.opts.identities)
+	disco := newDiscoResponder(info, caps.advertise(info))
+	exts = append(exts, disco.Extension)
+	cl.disco = disco
+
+	if err := cl.startStream(sock, exts); err != nil {
+		return nil, err
+	}
+
+	// Initial handshake.
+	cl.sendRaw <- cl.streamHeader()
+
+	// Wait until resource binding is complete.
+	if err := cl.statmgr.awaitStatus(StatusBound); err != nil {
+		return nil, cl.getError(err)
+	}
+
+	// Forget about the password, for paranoia's sake, unless it's
+	// needed to resume the stream or reconnect.
+	if cl.sm == nil && cl.rc == nil {
+		cl.password = ""
+	}
+
+	// Initialize the session.
+	if err := cl.awaitSession(); err != nil {
+		return nil, cl.getError(err)
+	}
+
+	if cl.sm != nil {
+		cl.enableStreamMgmt()
+	}
+
+	// This allows the client to receive stanzas.
+	cl.setStatus(StatusRunning)
+	if cl.rc != nil {
+		cl.rc.arm()
+	}
+	if cl.opts.keepalive != nil {
+		go cl.keepalive(*cl.opts.keepalive)
+	}
+
+	cl.runBeforePresence()
+
+	// Request the roster.
+	cl.requestRoster()
+
+	// Send the initial presence.
+	cl.Send <- &pr
+
+	for _, ext := range exts {
+		if ext.Start != nil {
+			go ext.Start(cl)
+		}
+	}
+
+	return cl, cl.getError(nil)
+}
+
+// Makes a client with the channels every session needs, which isn't
+// connected yet.
+func newBareClient(jid *JID, password string, status chan<- Status) *Client {
+	cl := new(Client)
 	cl.password = password
 	cl.Jid = *jid
 	cl.handlers = make(chan *callback, 100)
-	cl.tlsConfig = tlsconf
 	cl.sendFilterAdd = make(chan Filter)
 	cl.recvFilterAdd = make(chan Filter)
+	cl.recvPipeline = new(pipeline)
+	cl.extensions = new(extRegistry)
+	cl.sendPipeline = new(pipeline)
 	cl.statmgr = newStatmgr(status)
 	cl.error = make(chan error, 1)
+	cl.done = make(chan error, 1)
+	cl.Done = cl.done
+	cl.closing = make(chan bool)
+	cl.ended = make(chan bool)
+	cl.serverEnded = make(chan bool)
+	cl.recvDone = make(chan bool)
+	return cl
+}
 
-	extStanza := make(map[xml.Name]reflect.Type)
+// Starts the filters and the layers of the stream over a connection.
+// Nothing is sent yet.
+func (cl *Client) startStream(sock net.Conn, exts []Extension) error {
+	extStanza := registeredPayloads()
 	for _, ext := range exts {
 		for k, v := range ext.StanzaTypes {
-			if _, ok := extStanza[k]; ok {
-				return nil, fmt.Errorf("duplicate handler %s",
+			// Several extensions may share a payload type.
+			if t, ok := extStanza[k]; ok && t != v {
+				return fmt.Errorf("duplicate handler %s",
 					k)
 			}
 			extStanza[k] = v
 		}
 	}
+	cl.extensions.init(exts, extStanza)
 
-	// The thing that called this made a TCP connection, so now we
-	// can signal that it's connected.
+	// The thing that called this made a connection, so now we can
+	// signal that it's connected.
 	cl.setStatus(StatusConnected)
+	if _, ok := sock.(*tls.Conn); ok {
+		cl.setStatus(StatusConnectedTls)
+	}
+
+	// Start the managers for the filters that can modify what the
+	// app sees or sends, and set up the initial filters. This is
+	// done before anything can fail and close the client.
+	recvRawXmpp := make(chan Stanza)
+	sendRawXmpp := make(chan Stanza)
+	recvFiltXmpp := make(chan Stanza)
+	recvAppXmpp := make(chan Stanza)
+	cl.Recv = recvAppXmpp
+	sendAppXmpp := make(chan Stanza)
+	cl.Send = sendAppXmpp
+	sendFiltXmpp := make(chan Stanza)
+	go filterMgr(cl.recvFilterAdd, recvRawXmpp, recvFiltXmpp)
+	go func() {
+		defer close(cl.recvDone)
+		cl.recvPipeline.serve(recvFiltXmpp, recvAppXmpp, cl.closing)
+	}()
+	// What the application sent before closing is still sent.
+	go cl.sendPipeline.serve(sendAppXmpp, sendFiltXmpp, nil)
+	go filterMgr(cl.sendFilterAdd, sendFiltXmpp, sendRawXmpp)
+	size := cl.opts.sendQueue
+	if size < 1 {
+		size = defaultSendQueue
+	}
+	cl.queue = make(chan Stanza, size)
+	go cl.drainQueue(cl.statmgr.newListener())
+	// Received stanzas pass through the filters added first first,
+	// and sent ones through those added first last.
+	var near, far []Extension
+	for _, ext := range exts {
+		if ext.nearNetwork {
+			near = append(near, ext)
+		} else {
+			far = append(far, ext)
+		}
+	}
+	for _, ext := range append(near, far...) {
+		cl.AddRecvFilter(ext.RecvFilter)
+	}
+	for _, ext := range append(far, near...) {
+		cl.AddSendFilter(ext.SendFilter)
+	}
+	for _, ext := range exts {
+		if ext.RecvMiddleware != nil {
+			cl.AddRecvMiddleware(ext.MiddlewareOrder,
+				ext.RecvMiddleware)
+		}
+		if ext.SendMiddleware != nil {
+			cl.AddSendMiddleware(ext.MiddlewareOrder,
+				ext.SendMiddleware)
+		}
+	}
 
 	// Start the transport handler, initially unencrypted.
 	recvReader, recvWriter := io.Pipe()
 	sendReader, sendWriter := io.Pipe()
-	cl.layer1 = cl.startLayer1(tcp, recvWriter, sendReader,
+	cl.layer1 = cl.startLayer1(sock, recvWriter, sendReader,
 		cl.statmgr.newListener())
 
 	// Start the reader and writer that convert to and from XML.
 	recvXmlCh := make(chan interface{})
 	go cl.recvXml(recvReader, recvXmlCh, extStanza)
-	sendXmlCh := make(chan interface{})
+	sendXmlCh := make(chan interface{}, sendXmlBuffer)
 	cl.sendRaw = sendXmlCh
-	go cl.sendXml(sendWriter, sendXmlCh)
+	sendQuit := make(chan bool)
+	cl.sendQuit = sendQuit
+	go cl.sendXml(sendWriter, sendXmlCh, sendQuit)
 
 	// Start the reader and writer that convert between XML and
 	// XMPP stanzas.
-	recvRawXmpp := make(chan Stanza)
 	go cl.recvStream(recvXmlCh, recvRawXmpp, cl.statmgr.newListener())
-	sendRawXmpp := make(chan Stanza)
-	go sendStream(sendXmlCh, sendRawXmpp, cl.statmgr.newListener())
-
-	// Start the managers for the filters that can modify what the
-	// app sees or sends.
-	recvFiltXmpp := make(chan Stanza)
-	cl.Recv = recvFiltXmpp
-	go filterMgr(cl.recvFilterAdd, recvRawXmpp, recvFiltXmpp)
-	sendFiltXmpp := make(chan Stanza)
-	cl.Send = sendFiltXmpp
-	go filterMgr(cl.sendFilterAdd, sendFiltXmpp, sendRawXmpp)
-	// Set up the initial filters.
-	for _, ext := range exts {
-		cl.AddRecvFilter(ext.RecvFilter)
-		cl.AddSendFilter(ext.SendFilter)
-	}
+	go cl.sendStream(sendXmlCh, sendQuit, sendRawXmpp,
+		cl.statmgr.newListener(), cl.sm)
 
-	// Initial handshake.
-	hsOut := &stream{To: jid.Domain(), Version: XMPPVersion}
-	cl.sendRaw <- hsOut
+	return nil
+}
 
-	// Wait until resource binding is complete.
-	if err := cl.statmgr.awaitStatus(StatusBound); err != nil {
-		return nil, cl.getError(err)
+// Asks the server to start the session, once the resource is bound.
+// The outcome is reported on the returned channel. RFC 3921, section
+// 3.
+func (cl *Client) startSession() <-chan error {
+	if cl.inlined != nil {
+		// Bind 2 started it already.
+		ch := make(chan error, 1)
+		ch <- nil
+		return ch
 	}
-
-	// Forget about the password, for paranoia's sake.
-	cl.password = ""
-
-	// Initialize the session.
-	id := NextId()
+	id := cl.NextId()
 	iq := &Iq{Header: Header{To: JID(cl.Jid.Domain()), Id: id, Type: "set",
 		Nested: []interface{}{Generic{XMLName: xml.Name{Space: NsSession, Local: "session"}}}}}
-	ch := make(chan error)
+	ch := make(chan error, 1)
 	f := func(st Stanza) {
 		iq, ok := st.(*Iq)
 		if !ok {
 			ch <- fmt.Errorf("bad session start reply: %#v", st)
+			return
 		}
 		if iq.Type == "error" {
 			ch <- fmt.Errorf("Can't start session: %v", iq.Error)
+			return
 		}
 		ch <- nil
 	}
 	cl.SetCallback(id, f)
-	cl.sendRaw <- iq
-	// Now wait until the callback is called.
-	if err := <-ch; err != nil {
-		return nil, cl.getError(err)
+	cl.trySendRaw(iq)
+	return ch
+}
+
+// Sends on sendRaw from outside the goroutines of the stream, which
+// may have shut down. Returns false if they have.
+func (cl *Client) trySendRaw(x interface{}) bool {
+	select {
+	case cl.sendRaw <- x:
+		return true
+	case <-cl.sendQuit:
+		return false
 	}
+}
 
-	// This allows the client to receive stanzas.
-	cl.setStatus(StatusRunning)
+// Starts the session, and waits until it has started or the client
+// has shut down.
+func (cl *Client) awaitSession() error {
+	stat := cl.statmgr.newListener()
+	session := cl.startSession()
+	for {
+		select {
+		case err := <-session:
+			return err
+		case s, ok := <-stat:
+			if !ok || s.Fatal() {
+				return fmt.Errorf("shut down waiting for session")
+			}
+		}
+	}
+}
 
-	// Request the roster.
-	cl.Roster.update()
+// How long Close waits for the stream to be ended politely, and for
+// everything to stop.
+var closeTimeout = 5 * time.Second
 
-	// Send the initial presence.
-	cl.Send <- &pr
+// Close ends the session. What was sent on Send before the call is
+// sent, followed by the end of the stream, and Close waits for the
+// server to end its stream in turn. It then stops the filters,
+// middleware, callbacks and extensions, and returns once Recv has
+// been closed, or after a few seconds if something holds it up. Close
+// may be called more than once.
+func (cl *Client) Close() {
+	cl.closeSenders()
+	if cl.sendQuit == nil {
+		// The stream never started.
+		cl.setStatus(StatusShutdown)
+		return
+	}
+	timeout := time.After(closeTimeout)
+	select {
+	case <-cl.sendQuit:
+	case <-timeout:
+	}
+	select {
+	case <-cl.ended:
+		select {
+		case <-cl.serverEnded:
+		case <-cl.recvDone:
+		case <-timeout:
+		}
+	default:
+		// The session wasn't running, so there's no stream to
+		// end.
+	}
+	cl.shutdown()
+	if sock := cl.layer1.current(); sock != nil {
+		sock.Close()
+	}
+	select {
+	case <-cl.recvDone:
+	case <-timeout:
+	}
+}
 
-	return cl, cl.getError(nil)
+// Called when the server ends its stream. That only matters once the
+// client is closing; otherwise the connection is about to be lost.
+func (cl *Client) streamEnded() {
+	select {
+	case <-cl.closing:
+		cl.serverEndOnce.Do(func() { close(cl.serverEnded) })
+	default:
+	}
 }
 
-func (cl *Client) Close() {
+// Stops the session at once, without ending the stream.
+func (cl *Client) shutdown() {
 	// Shuts down the receivers:
 	cl.setStatus(StatusShutdown)
+	cl.closeSenders()
+}
+
+// Shuts down the senders.
+func (cl *Client) closeSenders() {
+	cl.shutdownOnce.Do(func() {
+		close(cl.closing)
+		cl.sendLock.Lock()
+		defer cl.sendLock.Unlock()
+		close(cl.Send)
+	})
+}
 
-	// Shuts down the senders:
-	cl.shutdownOnce.Do(func() { close(cl.Send) })
+var errClientClosed = errors.New("client closed")
+
+// Sends a stanza on Send from within the library, unless the client
+// has closed.
+func (cl *Client) send(ctx context.Context, st Stanza) error {
+	cl.sendLock.RLock()
+	defer cl.sendLock.RUnlock()
+	select {
+	case <-cl.closing:
+		return errClientClosed
+	default:
+	}
+	select {
+	case cl.Send <- st:
+		return nil
+	case <-cl.closing:
+		return errClientClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // If there's a buffered error in the channel, return it. Otherwise,
@@ -282,12 +743,20 @@ func (cl *Client) getError(err1 error) error {
 // there's already an error in the channel, discard the newer one in
 // favor of the older.
 func (cl *Client) setError(err error) {
-	defer cl.Close()
+	select {
+	case <-cl.closing:
+		// Whatever goes wrong while closing doesn't matter.
+		return
+	default:
+	}
+	defer cl.shutdown()
 	defer cl.setStatus(StatusError)
+	cl.terminal(err)
 
 	if len(cl.error) > 0 {
 		return
 	}
+	cl.logf(LogError, "session ended: %v", err)
 	// If we're in a race between two calls to this function,
 	// trying to set the "first" error, just arbitrarily let one
 	// of them win.
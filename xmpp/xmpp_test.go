@@ -2,11 +2,16 @@ package xmpp
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/xml"
+	"io"
+	"net"
 	"reflect"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestReadError(t *testing.T) {
@@ -69,7 +74,7 @@ func testWrite(obj interface{}) string {
 	cl := &Client{}
 	go func() {
 		defer wg.Done()
-		cl.sendXml(w, ch)
+		cl.sendXml(w, ch, nil)
 	}()
 	ch <- obj
 	close(ch)
@@ -99,3 +104,111 @@ func TestWriteStream(t *testing.T) {
 		` from="bar.com" id="42" xml:lang="en" version="1.0">`
 	assertEquals(t, exp, str)
 }
+
+func TestNewClientContext(t *testing.T) {
+	c, s := net.Pipe()
+	defer s.Close()
+	// A server which never answers.
+	go io.Copy(io.Discard, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+	jid := JID("user@example.com/res")
+	_, err := newClientContext(ctx, c, nil, &jid, "secret", &tls.Config{},
+		nil, Presence{}, nil)
+	if err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestSendIq(t *testing.T) {
+	send := make(chan Stanza, 1)
+	cl := &Client{handlers: make(chan *callback, 1), Send: send}
+	answer := func(typ string) {
+		h := <-cl.handlers
+		iq := (<-send).(*Iq)
+		if iq.Id == "" || iq.Id != h.id {
+			t.Errorf("callback for %q, iq id %q", h.id, iq.Id)
+		}
+		h.f(&Iq{Header: Header{Id: iq.Id, Type: typ}})
+	}
+
+	go answer("result")
+	reply, err := cl.SendIq(context.Background(),
+		&Iq{Header: Header{Type: "get"}})
+	if err != nil {
+		t.Fatalf("SendIq: %v", err)
+	}
+	assertEquals(t, "result", reply.Type)
+
+	go answer("error")
+	if _, err := cl.SendIq(context.Background(),
+		&Iq{Header: Header{Type: "set"}}); err == nil {
+		t.Error("error reply should fail")
+	}
+
+	// Without a reply, it times out.
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+	_, err = cl.SendIq(ctx, &Iq{Header: Header{Type: "get"}})
+	if err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if _, err := cl.SendIq(ctx, &Iq{Header: Header{Type: "result"}}); err == nil {
+		t.Error("a result doesn't get a reply")
+	}
+}
+
+func TestClose(t *testing.T) {
+	s := NewMockServer("b.c")
+	defer s.Close()
+	s.AddUser("alice", "secret")
+	var lock sync.Mutex
+	var sent, recvd bytes.Buffer
+	tap := func(outbound bool, p []byte) {
+		lock.Lock()
+		defer lock.Unlock()
+		if outbound {
+			sent.Write(p)
+		} else {
+			recvd.Write(p)
+		}
+	}
+	jid := JID("alice@b.c/pc")
+	cl, err := NewClientFromConn(s.Dial(), &jid, "secret", &tls.Config{},
+		[]Extension{TrafficExt(tap)}, Presence{}, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConn: %v", err)
+	}
+	// Nobody reads what arrives, which mustn't hold up closing.
+	for i := 0; i < 3; i++ {
+		cl.Send <- &Message{Header: Header{To: "b.c"},
+			Body: []Text{{Chardata: "echo"}}}
+	}
+
+	start := time.Now()
+	cl.Close()
+	if d := time.Since(start); d >= closeTimeout {
+		t.Errorf("Close took %v", d)
+	}
+	for range cl.Recv {
+	}
+	lock.Lock()
+	if !strings.HasSuffix(sent.String(), "</stream:stream>") {
+		t.Errorf("stream not ended: %s", sent.String())
+	}
+	if !strings.HasSuffix(recvd.String(), "</stream:stream>") {
+		t.Errorf("server didn't end its stream: %s", recvd.String())
+	}
+	lock.Unlock()
+
+	if _, err := cl.SendIq(context.Background(),
+		&Iq{Header: Header{Type: "get"}}); err != errClientClosed {
+		t.Errorf("SendIq after Close: %v", err)
+	}
+	// Closing again does nothing.
+	cl.Close()
+}